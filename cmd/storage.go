@@ -0,0 +1,271 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// The largest line an import reads, enough for the largest stored value.
+const storageImportMaxLine = 8 * 1024 * 1024
+
+// storageRecord is one stored record, as a line of newline-delimited JSON in an export.
+type storageRecord struct {
+	Bucket          string          `json:"bucket"`
+	Collection      string          `json:"collection"`
+	Record          string          `json:"record"`
+	UserID          string          `json:"user_id,omitempty"`
+	Value           json.RawMessage `json:"value"`
+	PermissionRead  int64           `json:"permission_read"`
+	PermissionWrite int64           `json:"permission_write"`
+	ExpiresAt       int64           `json:"expires_at,omitempty"`
+}
+
+// StorageParse runs the storage export and import subcommands. Progress is logged with the cursor or line number
+// to resume from if a run is interrupted.
+func StorageParse(args []string, logger *zap.Logger) {
+	if len(args) == 0 {
+		logger.Fatal("Storage requires a subcommand. Available commands are: 'export', 'import'.")
+	}
+
+	switch args[0] {
+	case "export":
+		storageExport(args[1:], logger)
+	case "import":
+		storageImport(args[1:], logger)
+	default:
+		logger.Fatal("Unrecognized storage subcommand. Available commands are: 'export', 'import'.")
+	}
+
+	os.Exit(0)
+}
+
+func storageExport(args []string, logger *zap.Logger) {
+	flags := flag.NewFlagSet("storage export", flag.ExitOnError)
+	dbAddress := flags.String("database.address", "root@localhost:26257", "Address of CockroachDB server (username:password@address:port/dbname)")
+	bucket := flags.String("bucket", "", "Bucket of the collection to export.")
+	collection := flags.String("collection", "", "Collection to export.")
+	userID := flags.String("user_id", "", "Only export records owned by this user.")
+	output := flags.String("output", "", "File to write records to, standard output if not set. Appended to when resuming.")
+	cursor := flags.String("cursor", "", "Resume an export from the cursor logged by an earlier run.")
+	batchSize := flags.Int64("batch_size", 100, "Number of records read at a time, between 10 and 100.")
+
+	if err := flags.Parse(args); err != nil {
+		logger.Fatal("Could not parse storage export flags.")
+	}
+	if *bucket == "" || *collection == "" {
+		logger.Fatal("A bucket and collection are required.")
+	}
+
+	var owner []byte
+	if *userID != "" {
+		uid, err := uuid.FromString(*userID)
+		if err != nil {
+			logger.Fatal("Invalid user ID", zap.Error(err))
+		}
+		owner = uid.Bytes()
+	}
+	var listCursor []byte
+	if *cursor != "" {
+		var err error
+		if listCursor, err = base64.RawURLEncoding.DecodeString(*cursor); err != nil {
+			logger.Fatal("Invalid cursor", zap.Error(err))
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if len(listCursor) != 0 {
+			mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(*output, mode, 0644)
+		if err != nil {
+			logger.Fatal("Could not open output file", zap.Error(err))
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	encoder := json.NewEncoder(w)
+
+	db := storageDB(logger, *dbAddress)
+	defer db.Close()
+
+	count := 0
+	for {
+		data, nextCursor, _, err := server.StorageList(logger, db, uuid.Nil, owner, *bucket, *collection, *batchSize, listCursor)
+		if err != nil {
+			logger.Fatal("Could not list storage records", zap.Error(err))
+		}
+
+		for _, d := range data {
+			record := &storageRecord{
+				Bucket:          d.Bucket,
+				Collection:      d.Collection,
+				Record:          d.Record,
+				Value:           json.RawMessage(d.Value),
+				PermissionRead:  d.PermissionRead,
+				PermissionWrite: d.PermissionWrite,
+				ExpiresAt:       d.ExpiresAt,
+			}
+			if len(d.UserId) != 0 {
+				record.UserID = uuid.FromBytesOrNil(d.UserId).String()
+			}
+			if err = encoder.Encode(record); err != nil {
+				logger.Fatal("Could not encode storage record", zap.Error(err))
+			}
+		}
+		// Flush each batch, so a logged cursor never skips records that were not written.
+		if err = w.Flush(); err != nil {
+			logger.Fatal("Could not write storage records", zap.Error(err))
+		}
+		count += len(data)
+
+		if len(nextCursor) == 0 {
+			break
+		}
+		listCursor = nextCursor
+		logger.Info("Exported storage records", zap.Int("count", count), zap.String("cursor", base64.RawURLEncoding.EncodeToString(listCursor)))
+	}
+
+	logger.Info("Storage export complete", zap.Int("count", count))
+}
+
+func storageImport(args []string, logger *zap.Logger) {
+	flags := flag.NewFlagSet("storage import", flag.ExitOnError)
+	dbAddress := flags.String("database.address", "root@localhost:26257", "Address of CockroachDB server (username:password@address:port/dbname)")
+	input := flags.String("input", "", "File to read records from, standard input if not set.")
+	skip := flags.Int64("skip", 0, "Number of lines to skip, to resume an import from the line logged by an earlier run.")
+	batchSize := flags.Int("batch_size", 100, "Number of records written in each transaction, between 1 and 100.")
+
+	if err := flags.Parse(args); err != nil {
+		logger.Fatal("Could not parse storage import flags.")
+	}
+	if *batchSize < 1 || *batchSize > 100 {
+		logger.Fatal("Batch size must be between 1 and 100.")
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			logger.Fatal("Could not open input file", zap.Error(err))
+		}
+		defer f.Close()
+		in = f
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), storageImportMaxLine)
+
+	db := storageDB(logger, *dbAddress)
+	defer db.Close()
+	config := server.NewStorageConfig()
+
+	line := int64(0)
+	count := 0
+	expired := 0
+	batch := make([]*server.StorageData, 0, *batchSize)
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Writes as the script runtime keep indexes and usage in step, and check collection schemas.
+		if _, _, err := server.StorageBatch(logger, db, config, uuid.Nil, batch, nil); err != nil {
+			logger.Fatal("Could not import storage records", zap.Int64("line", line), zap.Error(err))
+		}
+		count += len(batch)
+		batch = batch[:0]
+		logger.Info("Imported storage records", zap.Int("count", count), zap.Int64("line", line))
+	}
+
+	for scanner.Scan() {
+		line++
+		if line <= *skip || len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := &storageRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			logger.Fatal("Invalid storage record", zap.Int64("line", line), zap.Error(err))
+		}
+		// Records that expired since they were exported are left out.
+		if record.ExpiresAt != 0 && record.ExpiresAt <= time.Now().UTC().UnixNano()/int64(time.Millisecond) {
+			expired++
+			continue
+		}
+
+		data := &server.StorageData{
+			Bucket:          record.Bucket,
+			Collection:      record.Collection,
+			Record:          record.Record,
+			Value:           []byte(record.Value),
+			PermissionRead:  record.PermissionRead,
+			PermissionWrite: record.PermissionWrite,
+			ExpiresAt:       record.ExpiresAt,
+		}
+		if record.UserID != "" {
+			uid, err := uuid.FromString(record.UserID)
+			if err != nil {
+				logger.Fatal("Invalid storage record user ID", zap.Int64("line", line), zap.Error(err))
+			}
+			data.UserId = uid.Bytes()
+		}
+
+		batch = append(batch, data)
+		if len(batch) == *batchSize {
+			write()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Fatal("Could not read storage records", zap.Int64("line", line), zap.Error(err))
+	}
+	write()
+
+	logger.Info("Storage import complete", zap.Int("count", count), zap.Int("expired", expired))
+}
+
+func storageDB(logger *zap.Logger, dbAddress string) *sql.DB {
+	url, err := url.Parse(fmt.Sprintf("postgresql://%s?sslmode=disable", dbAddress))
+	if err != nil {
+		logger.Fatal("Bad connection URL", zap.Error(err))
+	}
+	if len(url.Path) < 1 {
+		url.Path = "/nakama"
+	}
+
+	db, err := sql.Open(dialect, url.String())
+	if err != nil {
+		logger.Fatal("Failed to open database", zap.Error(err))
+	}
+	if err = db.Ping(); err != nil {
+		logger.Fatal("Error pinging database", zap.Error(err))
+	}
+	return db
+}
@@ -62,6 +62,9 @@ func main() {
 			cmd.DoctorParse(os.Args[2:])
 		case "migrate":
 			cmd.MigrateParse(os.Args[2:], cmdLogger)
+		case "storage":
+			// Records stream to standard output, so progress is logged to standard error.
+			cmd.StorageParse(os.Args[2:], server.NewJSONLogger(os.Stderr, true))
 		}
 	}
 
@@ -78,30 +81,90 @@ func main() {
 	multiLogger.Info("Data directory", zap.String("path", config.GetDataDir()))
 	multiLogger.Info("Database connections", zap.Strings("dsns", config.GetDatabase().Addresses))
 
-	db := dbConnect(multiLogger, config.GetDatabase().Addresses)
+	metrics := server.NewMetrics(config.GetMetrics())
+	tracer := server.NewTracer(jsonLogger, config.GetTracing(), config.GetName())
+	db := dbConnect(multiLogger, config.GetDatabase().Addresses, metrics, tracer)
 
 	// Check migration status and log if the schema has diverged.
 	cmd.MigrationStartupCheck(multiLogger, db)
 
 	trackerService := server.NewTrackerService(config.GetName())
-	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, startedAt)
+	authRateLimiter := server.NewAuthRateLimiter(jsonLogger, config.GetSession().RateLimit)
+	messageRateLimiter := server.NewMessageRateLimiter(config.GetSocket().MessageRateLimits)
+	runtimeCache := server.NewRuntimeCache(config.GetRuntime().Cache)
+	runtimeLimits := server.NewRuntimeLimits(config.GetRuntime().Limits)
 	matchmakerService := server.NewMatchmakerService(config.GetName())
 	sessionRegistry := server.NewSessionRegistry(jsonLogger, config, trackerService, matchmakerService)
-	messageRouter := server.NewMessageRouterService(sessionRegistry)
+	datagramServer := server.NewDatagramServer(jsonLogger, config)
+	statsService := server.NewStatsService(jsonLogger, config, semver, trackerService, startedAt, authRateLimiter, runtimeCache, runtimeLimits, sessionRegistry, datagramServer, messageRateLimiter)
+	clusterService := server.NewClusterService(jsonLogger, config, trackerService)
+	trackerService.AddDiffListener(clusterService.HandleDiff)
+	messageRouter := server.NewMessageRouterService(sessionRegistry, clusterService)
 	presenceNotifier := server.NewPresenceNotifier(jsonLogger, config.GetName(), trackerService, messageRouter)
 	trackerService.AddDiffListener(presenceNotifier.HandleDiff)
-	notificationService := server.NewNotificationService(jsonLogger, db, trackerService, messageRouter, config.GetSocial().Notification)
+	matchAllocator := server.NewMatchAllocator(jsonLogger, config.GetMatchmaker())
+	matchmakerNotifier := server.NewMatchmakerNotifier(jsonLogger, config, trackerService, messageRouter, matchAllocator)
+	matchmakerService.AddMatchListener(matchmakerNotifier.HandleMatched)
+	matchmakerService.AddTimeoutListener(matchmakerNotifier.HandleTimeout)
+	matchmakerService.AddBackfillListener(matchmakerNotifier.HandleBackfill)
+	trackerService.AddDiffListener(matchmakerService.HandleDiff)
+	partyRegistry := server.NewPartyRegistry(jsonLogger, config.GetName(), trackerService, matchmakerService, messageRouter, clusterService)
+	trackerService.AddDiffListener(partyRegistry.HandleDiff)
+	matchRegistry := server.NewMatchRegistry(jsonLogger, config.GetName(), config.GetMatch(), trackerService, messageRouter, clusterService)
+	trackerService.AddDiffListener(matchRegistry.HandleDiff)
+	matchRecorder := server.NewMatchRecorder(jsonLogger, db, config.GetMatch(), trackerService)
+	trackerService.AddDiffListener(matchRecorder.HandleDiff)
+	notificationService := server.NewNotificationService(jsonLogger, db, trackerService, messageRouter, metrics, tracer, config.GetSocial().Notification)
+
+	leaderboardRankCache := server.NewLeaderboardRankCache(config.GetLeaderboard())
+	if err := leaderboardRankCache.Load(jsonLogger, db); err != nil {
+		multiLogger.Fatal("Failed loading leaderboard rank cache.", zap.Error(err))
+	}
+
+	if err := server.StorageIndexesSync(jsonLogger, db, config.GetStorage()); err != nil {
+		multiLogger.Fatal("Failed syncing storage indexes.", zap.Error(err))
+	}
+	if err := server.StorageSchemasSync(jsonLogger, db, config.GetStorage()); err != nil {
+		multiLogger.Fatal("Failed syncing storage schemas.", zap.Error(err))
+	}
+
+	storageFeed := server.NewStorageFeed(jsonLogger, trackerService, messageRouter)
 
-	runtime, err := server.NewRuntime(jsonLogger, multiLogger, db, config.GetRuntime(), notificationService)
+	runtime, err := server.NewRuntime(jsonLogger, multiLogger, db, config.GetRuntime(), notificationService, leaderboardRankCache, matchRegistry, storageFeed, config.GetStorage(), sessionRegistry, runtimeCache, runtimeLimits)
 	if err != nil {
 		multiLogger.Fatal("Failed initializing runtime modules.", zap.Error(err))
 	}
 
+	chatFilter, err := server.NewChatFilter(config.GetSocial().Chat)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing chat filter.", zap.Error(err))
+	}
+
 	socialClient := social.NewClient(5 * time.Second)
 	purchaseService := server.NewPurchaseService(jsonLogger, multiLogger, db, config.GetPurchase())
-	pipeline := server.NewPipeline(config, db, trackerService, matchmakerService, messageRouter, sessionRegistry, socialClient, runtime, purchaseService, notificationService)
-	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, socialClient, pipeline, runtime)
-	dashboardService := server.NewDashboardService(jsonLogger, multiLogger, semver, config, statsService)
+	mailer := server.NewMailer(jsonLogger, config.GetMail())
+	registrationChallenge, err := server.NewRegistrationChallenge(jsonLogger, config.GetSession().Challenge, []byte(config.GetSession().EncryptionKey))
+	if err != nil {
+		multiLogger.Fatal("Failed initializing registration challenge.", zap.Error(err))
+	}
+	clientIPFilter, err := server.NewClientIPFilter(config.GetSocket().ClientIP)
+	if err != nil {
+		multiLogger.Fatal("Failed initializing client IP filter.", zap.Error(err))
+	}
+	pipeline := server.NewPipeline(config, db, trackerService, matchmakerService, partyRegistry, matchRegistry, matchRecorder, matchAllocator, messageRouter, sessionRegistry, socialClient, runtime, chatFilter, leaderboardRankCache, purchaseService, notificationService, storageFeed, mailer, datagramServer, messageRateLimiter, metrics, tracer)
+	authService := server.NewAuthenticationService(jsonLogger, config, db, statsService, sessionRegistry, socialClient, pipeline, runtime, mailer, registrationChallenge, authRateLimiter, clientIPFilter)
+	metrics.Watch(sessionRegistry, trackerService, matchmakerService, messageRateLimiter)
+	dashboardService := server.NewDashboardService(jsonLogger, multiLogger, semver, config, statsService, metrics)
+	leaderboardScheduler := server.NewLeaderboardScheduler(jsonLogger, db, leaderboardRankCache, runtime)
+	turnMatchScheduler := server.NewTurnMatchScheduler(jsonLogger, db, notificationService)
+	storageExpirySweeper := server.NewStorageExpirySweeper(jsonLogger, db, config.GetStorage())
+	messageExpirySweeper := server.NewMessageExpirySweeper(jsonLogger, db, config.GetSocial().Chat)
+	accountDeletionSweeper := server.NewAccountDeletionSweeper(jsonLogger, db, leaderboardRankCache, config.GetSocial().Deletion)
+	runtimeJobScheduler, err := server.NewRuntimeJobScheduler(jsonLogger, db, config.GetName(), runtime)
+	if err != nil {
+		multiLogger.Fatal("Failed scheduling runtime jobs.", zap.Error(err))
+	}
+	runtimeTaskWorker := server.NewRuntimeTaskWorker(jsonLogger, db, runtime, config.GetRuntime().Task)
 
 	gaenabled := len(os.Getenv("NAKAMA_TELEMETRY")) < 1
 	cookie := newOrLoadCookie(config.GetDataDir())
@@ -118,10 +181,24 @@ func main() {
 		<-c
 		multiLogger.Info("Shutting down")
 
+		authService.Drain()
 		authService.Stop()
+		datagramServer.Stop()
+		clusterService.Stop()
 		dashboardService.Stop()
 		trackerService.Stop()
+		matchmakerService.Stop()
+		leaderboardScheduler.Stop()
+		turnMatchScheduler.Stop()
+		storageExpirySweeper.Stop()
+		messageExpirySweeper.Stop()
+		accountDeletionSweeper.Stop()
+		runtimeJobScheduler.Stop()
+		runtimeTaskWorker.Stop()
+		matchRegistry.Stop()
+		matchRecorder.Stop()
 		runtime.Stop()
+		tracer.Stop()
 
 		if gaenabled {
 			ga.SendSessionStop(http.DefaultClient, gacode, cookie)
@@ -131,12 +208,15 @@ func main() {
 	}()
 
 	authService.StartServer(multiLogger)
+	datagramServer.Start(multiLogger)
+	clusterService.Start(multiLogger, messageRouter, leaderboardRankCache)
+	tracer.Start()
 
 	multiLogger.Info("Startup done")
 	select {}
 }
 
-func dbConnect(multiLogger *zap.Logger, dsns []string) *sql.DB {
+func dbConnect(multiLogger *zap.Logger, dsns []string, metrics *server.Metrics, tracer *server.Tracer) *sql.DB {
 	// TODO config database pooling
 	rawurl := fmt.Sprintf("postgresql://%s?sslmode=disable", dsns[0])
 	url, err := url.Parse(rawurl)
@@ -148,7 +228,14 @@ func dbConnect(multiLogger *zap.Logger, dsns []string) *sql.DB {
 		url.Path = "/nakama"
 	}
 
-	db, err := sql.Open("postgres", url.String())
+	driverName := "postgres"
+	if metrics.Enabled() || tracer.Enabled() {
+		if driverName, err = server.RegisterInstrumentedDriver(driverName, metrics, tracer); err != nil {
+			multiLogger.Fatal("Could not instrument database queries", zap.Error(err))
+		}
+	}
+
+	db, err := sql.Open(driverName, url.String())
 	if err != nil {
 		multiLogger.Fatal("Error connecting to database", zap.Error(err))
 	}
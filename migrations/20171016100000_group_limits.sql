@@ -0,0 +1,29 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS max_count INT DEFAULT 100 CHECK (max_count > 0) NOT NULL;
+
+CREATE TABLE IF NOT EXISTS group_cooldown (
+    PRIMARY KEY (group_id, user_id),
+    group_id   BYTEA  NOT NULL,
+    user_id    BYTEA  NOT NULL,
+    expires_at BIGINT CHECK (expires_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS group_cooldown;
+ALTER TABLE groups DROP COLUMN IF EXISTS max_count;
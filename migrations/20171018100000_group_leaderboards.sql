@@ -0,0 +1,24 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Leaderboards with a group ID only accept and list records for members of that group.
+ALTER TABLE leaderboard ADD COLUMN IF NOT EXISTS group_id BYTEA DEFAULT NULL::BYTEA;
+CREATE INDEX IF NOT EXISTS group_id_idx ON leaderboard (group_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS leaderboard@group_id_idx;
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS group_id;
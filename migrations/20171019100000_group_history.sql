@@ -0,0 +1,30 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS group_history (
+    PRIMARY KEY (group_id, created_at, id),
+    id         BYTEA    UNIQUE NOT NULL,
+    group_id   BYTEA    NOT NULL,
+    type       SMALLINT CHECK (type >= 0) NOT NULL, -- join(0), add(1), leave(2), kick(3), promote(4), ban(5), ownership(6), announcement(7)
+    actor_id   BYTEA    DEFAULT NULL::BYTEA, -- NULL if the event was triggered by the script runtime or the server.
+    user_id    BYTEA    DEFAULT NULL::BYTEA,
+    data       BYTEA    DEFAULT '{}' CHECK (length(data) < 16000) NOT NULL,
+    created_at BIGINT   CHECK (created_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS group_history;
@@ -0,0 +1,29 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS group_invite (
+    PRIMARY KEY (group_id, user_id),
+    group_id   BYTEA  NOT NULL,
+    user_id    BYTEA  NOT NULL,
+    invited_by BYTEA  NOT NULL,
+    created_at BIGINT CHECK (created_at > 0) NOT NULL,
+    expires_at BIGINT CHECK (expires_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_id_expires_at_idx ON group_invite (user_id, expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS group_invite;
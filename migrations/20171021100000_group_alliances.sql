@@ -0,0 +1,27 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Links member groups (children) to the alliance group (parent) they belong to.
+CREATE TABLE IF NOT EXISTS group_relation (
+    PRIMARY KEY (parent_id, child_id),
+    parent_id  BYTEA  NOT NULL,
+    child_id   BYTEA  UNIQUE NOT NULL, -- A group may only belong to a single alliance.
+    created_at BIGINT CHECK (created_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS group_relation;
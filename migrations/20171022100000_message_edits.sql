@@ -0,0 +1,35 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+ALTER TABLE message ADD COLUMN IF NOT EXISTS updated_at BIGINT DEFAULT 0 CHECK (updated_at >= 0) NOT NULL;
+ALTER TABLE message ADD COLUMN IF NOT EXISTS deleted_at BIGINT DEFAULT 0 CHECK (deleted_at >= 0) NOT NULL;
+
+-- Previous contents of edited messages, one row per edit.
+CREATE TABLE IF NOT EXISTS message_version (
+    PRIMARY KEY (topic, topic_type, message_id, updated_at),
+    topic      BYTEA    CHECK (length(topic) <= 128) NOT NULL,
+    topic_type SMALLINT NOT NULL, -- dm(0), room(1), group(2)
+    message_id BYTEA    NOT NULL,
+    -- FIXME replace with JSONB
+    data       BYTEA    DEFAULT '{}' CHECK (length(data) <= 1000) NOT NULL,
+    updated_at BIGINT   CHECK (updated_at > 0) NOT NULL -- When this version was superseded.
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS message_version;
+ALTER TABLE message DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE message DROP COLUMN IF EXISTS updated_at;
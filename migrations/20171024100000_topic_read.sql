@@ -0,0 +1,28 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Position up to which a user has read each topic they take part in.
+CREATE TABLE IF NOT EXISTS topic_read (
+    PRIMARY KEY (user_id, topic_type, topic),
+    user_id    BYTEA    NOT NULL,
+    topic      BYTEA    CHECK (length(topic) <= 128) NOT NULL,
+    topic_type SMALLINT NOT NULL, -- dm(0), room(1), group(2)
+    read_at    BIGINT   DEFAULT 0 CHECK (read_at >= 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS topic_read;
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS topic_setting (
+    PRIMARY KEY (topic, topic_type),
+    topic        BYTEA    CHECK (length(topic) <= 128) NOT NULL,
+    topic_type   SMALLINT NOT NULL, -- dm(0), room(1), group(2)
+    slow_mode_ms BIGINT   DEFAULT 0 CHECK (slow_mode_ms >= 0) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS topic_user (
+    PRIMARY KEY (topic, topic_type, user_id),
+    topic           BYTEA    CHECK (length(topic) <= 128) NOT NULL,
+    topic_type      SMALLINT NOT NULL, -- dm(0), room(1), group(2)
+    user_id         BYTEA    NOT NULL,
+    muted_until     BIGINT   DEFAULT 0 CHECK (muted_until >= 0) NOT NULL,
+    last_message_at BIGINT   DEFAULT 0 CHECK (last_message_at >= 0) NOT NULL -- Only tracked while slow mode is enabled.
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS topic_user;
+DROP TABLE IF EXISTS topic_setting;
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- One row for each leaderboard season that has ended and been archived.
+CREATE TABLE IF NOT EXISTS leaderboard_season (
+    PRIMARY KEY (leaderboard_id, expires_at),
+    leaderboard_id BYTEA  NOT NULL,
+    expires_at     BIGINT CHECK (expires_at > 0) NOT NULL, -- When the season ended.
+    archived_at    BIGINT CHECK (archived_at > 0) NOT NULL,
+    count          BIGINT DEFAULT 0 CHECK (count >= 0) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS leaderboard_record_archive (
+    PRIMARY KEY (leaderboard_id, expires_at, owner_id),
+    id                 BYTEA         UNIQUE NOT NULL,
+    leaderboard_id     BYTEA         NOT NULL,
+    owner_id           BYTEA         NOT NULL,
+    handle             VARCHAR(128)  NOT NULL,
+    lang               VARCHAR(18)   DEFAULT 'en' NOT NULL,
+    location           VARCHAR(255),
+    timezone           VARCHAR(255),
+    score              BIGINT        DEFAULT 0 NOT NULL,
+    num_score          INT           DEFAULT 0 CHECK (num_score >= 0) NOT NULL,
+    -- FIXME replace with JSONB
+    metadata           BYTEA         DEFAULT '{}' CHECK (length(metadata) < 16000) NOT NULL,
+    updated_at         BIGINT        CHECK (updated_at > 0) NOT NULL,
+    updated_at_inverse BIGINT        CHECK (updated_at > 0) NOT NULL,
+    expires_at         BIGINT        CHECK (expires_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS archive_leaderboard_id_expires_at_score_updated_at_inverse_id_idx ON leaderboard_record_archive (leaderboard_id, expires_at, score, updated_at_inverse, id);
+CREATE INDEX IF NOT EXISTS archive_leaderboard_id_expires_at_score_updated_at_id_idx ON leaderboard_record_archive (leaderboard_id, expires_at, score, updated_at, id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS leaderboard_record_archive;
+DROP TABLE IF EXISTS leaderboard_season;
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Tournaments extend a leaderboard with the same ID.
+CREATE TABLE IF NOT EXISTS tournament (
+    PRIMARY KEY (id),
+    FOREIGN KEY (id) REFERENCES leaderboard(id),
+    id            BYTEA        NOT NULL,
+    title         VARCHAR(255) DEFAULT '' NOT NULL,
+    description   VARCHAR(255) DEFAULT '' NOT NULL,
+    start_time    BIGINT       CHECK (start_time > 0) NOT NULL,
+    end_time      BIGINT       CHECK (end_time > start_time) NOT NULL,
+    max_size      BIGINT       DEFAULT 0 CHECK (max_size >= 0) NOT NULL, -- 0 for no limit.
+    size          BIGINT       DEFAULT 0 CHECK (size >= 0) NOT NULL,
+    join_required BOOLEAN      DEFAULT FALSE NOT NULL,
+    ended_at      BIGINT       DEFAULT 0 CHECK (ended_at >= 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS ended_at_end_time_id_idx ON tournament (ended_at, end_time, id);
+
+CREATE TABLE IF NOT EXISTS tournament_member (
+    PRIMARY KEY (tournament_id, user_id),
+    tournament_id BYTEA  NOT NULL,
+    user_id       BYTEA  NOT NULL,
+    joined_at     BIGINT CHECK (joined_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS tournament_member;
+DROP TABLE IF EXISTS tournament;
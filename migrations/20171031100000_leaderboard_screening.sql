@@ -0,0 +1,49 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+ALTER TABLE leaderboard ADD COLUMN IF NOT EXISTS min_delta BIGINT DEFAULT NULL; -- Bounds on the score change of each submission, NULL for no bound.
+ALTER TABLE leaderboard ADD COLUMN IF NOT EXISTS max_delta BIGINT DEFAULT NULL;
+ALTER TABLE leaderboard ADD COLUMN IF NOT EXISTS max_submit_rate INT DEFAULT 0 CHECK (max_submit_rate >= 0) NOT NULL; -- Per user per minute, 0 for no limit.
+
+-- Submissions by each user in the current one minute window, for leaderboards with a rate limit.
+CREATE TABLE IF NOT EXISTS leaderboard_submit_rate (
+    PRIMARY KEY (leaderboard_id, owner_id),
+    leaderboard_id BYTEA  NOT NULL,
+    owner_id       BYTEA  NOT NULL,
+    window_start   BIGINT CHECK (window_start > 0) NOT NULL,
+    count          INT    DEFAULT 0 CHECK (count >= 0) NOT NULL
+);
+
+-- Rejected score submissions, kept for review.
+CREATE TABLE IF NOT EXISTS leaderboard_record_flag (
+    PRIMARY KEY (leaderboard_id, created_at, id),
+    id             BYTEA        NOT NULL,
+    leaderboard_id BYTEA        NOT NULL,
+    owner_id       BYTEA        NOT NULL,
+    op             VARCHAR(16)  NOT NULL,
+    value          BIGINT       NOT NULL,
+    reason         VARCHAR(255) NOT NULL,
+    created_at     BIGINT       CHECK (created_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS owner_id_created_at_idx ON leaderboard_record_flag (owner_id, created_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS leaderboard_record_flag;
+DROP TABLE IF EXISTS leaderboard_submit_rate;
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS max_submit_rate;
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS max_delta;
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS min_delta;
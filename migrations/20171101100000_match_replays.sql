@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Relayed matches created with recording enabled.
+CREATE TABLE IF NOT EXISTS match_replay (
+    PRIMARY KEY (id),
+    id          BYTEA  NOT NULL, -- Match ID.
+    creator_id  BYTEA  NOT NULL,
+    frame_count INT    DEFAULT 0 CHECK (frame_count >= 0) NOT NULL,
+    created_at  BIGINT CHECK (created_at > 0) NOT NULL,
+    updated_at  BIGINT CHECK (updated_at > 0) NOT NULL
+);
+
+-- Users who were in a recorded match, who may list and download its replay.
+CREATE TABLE IF NOT EXISTS match_replay_user (
+    PRIMARY KEY (user_id, created_at, match_id),
+    user_id    BYTEA  NOT NULL,
+    match_id   BYTEA  NOT NULL,
+    created_at BIGINT CHECK (created_at > 0) NOT NULL -- When the match started recording.
+);
+CREATE UNIQUE INDEX IF NOT EXISTS match_id_user_id_idx ON match_replay_user (match_id, user_id);
+
+-- Match data sent in a recorded match, in the order it was relayed.
+CREATE TABLE IF NOT EXISTS match_replay_frame (
+    PRIMARY KEY (match_id, seq),
+    match_id   BYTEA        NOT NULL,
+    seq        INT          CHECK (seq >= 0) NOT NULL,
+    user_id    BYTEA        NOT NULL,
+    session_id BYTEA        NOT NULL,
+    handle     VARCHAR(128) NOT NULL,
+    op_code    BIGINT       NOT NULL,
+    data       BYTEA        NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS match_replay_frame;
+DROP TABLE IF EXISTS match_replay_user;
+DROP TABLE IF EXISTS match_replay;
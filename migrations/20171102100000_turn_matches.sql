@@ -0,0 +1,48 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Turn-based matches, played asynchronously by users who do not need to be online at the same time.
+CREATE TABLE IF NOT EXISTS turn_match (
+    PRIMARY KEY (id),
+    id               BYTEA    NOT NULL,
+    creator_id       BYTEA    NOT NULL,
+    state            BYTEA    DEFAULT '' NOT NULL, -- Game state, opaque to the server, replaced by each move.
+    turn             BIGINT   DEFAULT 0 CHECK (turn >= 0) NOT NULL, -- Number of moves made so far.
+    turn_user_id     BYTEA,                        -- User whose turn it is, NULL once the match has ended.
+    turn_timeout_sec BIGINT   CHECK (turn_timeout_sec >= 0) NOT NULL, -- 0 for no turn time limit.
+    turn_expires_at  BIGINT   DEFAULT 0 CHECK (turn_expires_at >= 0) NOT NULL,
+    ended            BOOLEAN  DEFAULT FALSE NOT NULL,
+    winner_id        BYTEA,
+    created_at       BIGINT   CHECK (created_at > 0) NOT NULL,
+    updated_at       BIGINT   CHECK (updated_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS turn_expires_at_idx ON turn_match (turn_expires_at) WHERE ended = FALSE AND turn_expires_at > 0;
+
+-- Users in a turn-based match, in turn order.
+CREATE TABLE IF NOT EXISTS turn_match_user (
+    PRIMARY KEY (match_id, position),
+    match_id   BYTEA   NOT NULL,
+    position   INT     CHECK (position >= 0) NOT NULL,
+    user_id    BYTEA   NOT NULL,
+    forfeited  BOOLEAN DEFAULT FALSE NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS user_id_match_id_idx ON turn_match_user (user_id, match_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS turn_match_user;
+DROP TABLE IF EXISTS turn_match;
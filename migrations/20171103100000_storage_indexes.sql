@@ -0,0 +1,44 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Fields of stored objects declared as indexed in the server config, synced on startup.
+CREATE TABLE IF NOT EXISTS storage_index_field (
+    PRIMARY KEY (bucket, collection, field),
+    bucket     VARCHAR(128) NOT NULL,
+    collection VARCHAR(128) NOT NULL,
+    field      VARCHAR(255) NOT NULL, -- Dot separated path, for example "stats.level".
+    path       VARCHAR(255) NOT NULL  -- The same path as a text array literal, for example "{stats,level}".
+);
+
+-- Values of indexed fields in each live stored object, so listings can filter and sort on them without a table scan.
+CREATE TABLE IF NOT EXISTS storage_index (
+    PRIMARY KEY (bucket, collection, user_id, record, field),
+    bucket       VARCHAR(128) NOT NULL,
+    collection   VARCHAR(128) NOT NULL,
+    user_id      BYTEA        NOT NULL,
+    record       VARCHAR(128) NOT NULL,
+    field        VARCHAR(255) NOT NULL,
+    string_value VARCHAR,       -- Set if the field is a string.
+    number_value DECIMAL        -- Set if the field is a number.
+);
+CREATE INDEX IF NOT EXISTS bucket_collection_field_string_value_idx ON storage_index (bucket, collection, field, string_value);
+CREATE INDEX IF NOT EXISTS bucket_collection_field_number_value_idx ON storage_index (bucket, collection, field, number_value);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_index;
+DROP TABLE IF EXISTS storage_index_field;
@@ -0,0 +1,23 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Lets the expiry sweeper find live records whose expiry time has passed.
+CREATE INDEX IF NOT EXISTS deleted_at_expires_at_idx ON storage (deleted_at, expires_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS storage@deleted_at_expires_at_idx;
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Grants of access to stored records beyond their read and write permissions. Entries belong to the stored row, so
+-- they carry over when the record is written again but not to a record created after it is removed or expires.
+CREATE TABLE IF NOT EXISTS storage_acl (
+    PRIMARY KEY (storage_id, grantee_id),
+    storage_id BYTEA   NOT NULL,
+    grantee_id BYTEA   NOT NULL, -- A user ID, or a group ID granting access to its admins and members.
+    is_group   BOOLEAN NOT NULL,
+    can_read   BOOLEAN NOT NULL,
+    can_write  BOOLEAN NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_acl;
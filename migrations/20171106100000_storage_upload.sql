@@ -0,0 +1,45 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Values uploaded in chunks can be larger than the original limit, their size is checked by the server.
+ALTER TABLE storage DROP CONSTRAINT IF EXISTS check_value;
+ALTER TABLE storage ADD CONSTRAINT check_value_size CHECK (length(value) <= 4194304);
+
+-- Values being uploaded in chunks, written to storage when the upload is committed.
+CREATE TABLE IF NOT EXISTS storage_upload (
+    PRIMARY KEY (id),
+    id         BYTEA        NOT NULL,
+    user_id    BYTEA        NOT NULL,
+    bucket     VARCHAR(128) NOT NULL,
+    collection VARCHAR(128) NOT NULL,
+    record     VARCHAR(128) NOT NULL,
+    version    BYTEA, -- Checked when the upload is committed, if given.
+    read       SMALLINT     DEFAULT 1 CHECK (read >= 0) NOT NULL,
+    write      SMALLINT     DEFAULT 1 CHECK (write >= 0) NOT NULL,
+    size       BIGINT       CHECK (size > 0) NOT NULL,
+    value      BYTEA        DEFAULT '' NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL
+);
+-- For upload quotas and stale upload removal.
+CREATE INDEX IF NOT EXISTS user_id_idx ON storage_upload (user_id);
+CREATE INDEX IF NOT EXISTS created_at_idx ON storage_upload (created_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_upload;
+ALTER TABLE storage DROP CONSTRAINT IF EXISTS check_value_size;
+ALTER TABLE storage ADD CONSTRAINT check_value CHECK (length(value) < 16000);
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Bytes stored by each user, kept in step with their records, and any quota set for them by an admin.
+CREATE TABLE IF NOT EXISTS storage_usage (
+    PRIMARY KEY (user_id),
+    user_id     BYTEA  NOT NULL,
+    bytes       BIGINT DEFAULT 0 NOT NULL,
+    quota_bytes BIGINT -- Overrides the configured quota if set, 0 for no quota.
+);
+
+INSERT INTO storage_usage (user_id, bytes)
+SELECT user_id, SUM(length(value)) FROM storage WHERE deleted_at = 0 AND user_id != '' GROUP BY user_id;
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_usage;
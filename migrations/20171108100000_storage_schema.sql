@@ -0,0 +1,30 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- JSON Schemas that values written to storage collections must match. Schemas from the server config are synced on
+-- startup, others are set by the script runtime.
+CREATE TABLE IF NOT EXISTS storage_schema (
+    PRIMARY KEY (bucket, collection),
+    bucket      VARCHAR(128) NOT NULL,
+    collection  VARCHAR(128) NOT NULL,
+    schema      BYTEA        NOT NULL,
+    from_config BOOLEAN      NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS storage_schema;
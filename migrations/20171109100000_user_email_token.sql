@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Email address verification and password reset tokens. Only a hash of each token is kept.
+CREATE TABLE IF NOT EXISTS user_email_token (
+    PRIMARY KEY (token_hash),
+    token_hash BYTEA        NOT NULL,
+    user_id    BYTEA        NOT NULL,
+    purpose    SMALLINT     NOT NULL, -- 0 verification, 1 password reset.
+    email      VARCHAR(255) NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL,
+    expires_at BIGINT       CHECK (expires_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_id_purpose_idx ON user_email_token (user_id, purpose);
+
+-- +migrate Down
+DROP TABLE IF EXISTS user_email_token;
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Every ban and suspension, kept after it ends or is lifted as an audit trail.
+CREATE TABLE IF NOT EXISTS user_ban (
+    PRIMARY KEY (user_id, created_at),
+    user_id    BYTEA        NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL,
+    created_by BYTEA,       -- NULL when banned by the server runtime.
+    reason     VARCHAR(255) DEFAULT '' NOT NULL,
+    expires_at BIGINT       DEFAULT 0 CHECK (expires_at >= 0) NOT NULL, -- 0 for a permanent ban.
+    lifted_at  BIGINT       DEFAULT 0 CHECK (lifted_at >= 0) NOT NULL,
+    lifted_by  BYTEA
+);
+
+-- Users disabled before bans were recorded keep a permanent ban.
+INSERT INTO user_ban (user_id, created_at)
+SELECT id, disabled_at FROM users WHERE disabled_at > 0;
+
+-- +migrate Down
+DROP TABLE IF EXISTS user_ban;
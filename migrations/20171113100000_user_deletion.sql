@@ -0,0 +1,25 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Set when a user asks for their account to be deleted, it is erased once the grace period has passed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at BIGINT CHECK (deleted_at >= 0) DEFAULT 0 NOT NULL;
+-- Lets the deletion sweeper find accounts whose grace period has passed.
+CREATE INDEX IF NOT EXISTS deleted_at_idx ON users (deleted_at);
+
+-- +migrate Down
+DROP INDEX IF EXISTS users@deleted_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
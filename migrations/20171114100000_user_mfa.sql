@@ -0,0 +1,37 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- TOTP secrets of users enrolled in multi-factor authentication.
+CREATE TABLE IF NOT EXISTS user_mfa (
+    PRIMARY KEY (user_id),
+    user_id      BYTEA  NOT NULL,
+    secret       BYTEA  NOT NULL,
+    created_at   BIGINT CHECK (created_at > 0) NOT NULL,
+    enabled_at   BIGINT DEFAULT 0 CHECK (enabled_at >= 0) NOT NULL,   -- 0 until enrollment is confirmed with a code.
+    last_counter BIGINT DEFAULT 0 CHECK (last_counter >= 0) NOT NULL  -- Time step of the last code used, codes are not accepted twice.
+);
+
+-- Single use recovery codes. Only a hash of each code is kept.
+CREATE TABLE IF NOT EXISTS user_mfa_recovery (
+    PRIMARY KEY (user_id, code_hash),
+    user_id   BYTEA NOT NULL,
+    code_hash BYTEA NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS user_mfa_recovery;
+DROP TABLE IF EXISTS user_mfa;
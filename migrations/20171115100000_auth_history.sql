@@ -0,0 +1,31 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+-- +migrate Up
+-- Authentication, link and unlink events, kept so users and support staff can investigate account access.
+CREATE TABLE IF NOT EXISTS auth_history (
+    PRIMARY KEY (user_id, created_at, id),
+    user_id    BYTEA        NOT NULL,
+    created_at BIGINT       CHECK (created_at > 0) NOT NULL,
+    id         BYTEA        NOT NULL,
+    type       SMALLINT     NOT NULL, -- Login (0), register (1), refresh (2), link (3), unlink (4).
+    provider   VARCHAR(32)  NOT NULL, -- Device, email, facebook, etc.
+    ip         VARCHAR(64)  DEFAULT '' NOT NULL,
+    user_agent VARCHAR(255) DEFAULT '' NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS auth_history;
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Recurring runtime jobs. Nodes claim each run by moving next_run_at forward, so a run happens on one node only.
+CREATE TABLE IF NOT EXISTS runtime_job (
+    PRIMARY KEY (id),
+    id               VARCHAR(128)  NOT NULL,
+    schedule         VARCHAR(255)  NOT NULL, -- Cron expression.
+    next_run_at      BIGINT        CHECK (next_run_at >= 0) NOT NULL,
+    last_run_at      BIGINT        DEFAULT 0 CHECK (last_run_at >= 0) NOT NULL,
+    last_duration_ms BIGINT        DEFAULT 0 CHECK (last_duration_ms >= 0) NOT NULL,
+    last_status      SMALLINT      DEFAULT 0 NOT NULL, -- Never run (0), running (1), succeeded (2), failed (3).
+    last_error       VARCHAR(1024) DEFAULT '' NOT NULL,
+    last_node        VARCHAR(255)  DEFAULT '' NOT NULL,
+    runs             BIGINT        DEFAULT 0 CHECK (runs >= 0) NOT NULL,
+    failures         BIGINT        DEFAULT 0 CHECK (failures >= 0) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS runtime_job;
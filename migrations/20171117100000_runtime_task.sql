@@ -0,0 +1,35 @@
+/*
+ * Copyright 2017 The Nakama Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+-- +migrate Up
+-- Deferred runtime tasks. Finished tasks are deleted, tasks that fail too often are kept as dead letters.
+CREATE TABLE IF NOT EXISTS runtime_task (
+    PRIMARY KEY (id),
+    id         BYTEA         NOT NULL,
+    handler    VARCHAR(128)  NOT NULL,
+    payload    BYTEA         DEFAULT '{}' CHECK (length(payload) < 16000) NOT NULL,
+    state      SMALLINT      DEFAULT 0 NOT NULL, -- Pending (0), dead (1).
+    run_at     BIGINT        CHECK (run_at > 0) NOT NULL, -- Moved forward while a node runs the task.
+    attempts   INT           DEFAULT 0 CHECK (attempts >= 0) NOT NULL,
+    last_error VARCHAR(1024) DEFAULT '' NOT NULL,
+    created_at BIGINT        CHECK (created_at > 0) NOT NULL,
+    updated_at BIGINT        CHECK (updated_at > 0) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS state_run_at_idx ON runtime_task (state, run_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS runtime_task;
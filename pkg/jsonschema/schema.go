@@ -0,0 +1,530 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonschema validates JSON documents against the self-contained subset of JSON Schema (draft 4 to 6) that
+// needs no references: type, enum, const, the numeric, string, array and object constraints, and the allOf, anyOf,
+// oneOf and not combinators. Formats are treated as annotations and not checked, as the specification allows.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The most errors reported for a single document.
+const maxErrors = 10
+
+// Keywords that affect validation but are not supported, rejected so schemas are never silently ignored.
+var unsupportedKeywords = []string{"$ref", "additionalItems", "contains", "dependencies", "if", "then", "else", "patternProperties", "propertyNames"}
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	// Set for the boolean schemas true and false.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	items       *Schema
+	tupleItems  []*Schema
+	minItems    int
+	maxItems    int
+	uniqueItems bool
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        int
+	maxProperties        int
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// ValidationError is a single way a document does not match a schema.
+type ValidationError struct {
+	// JSON Pointer to the invalid value, "/" for the whole document.
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors are all the ways a document does not match a schema, up to a limit.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Parse compiles a JSON Schema.
+func Parse(data []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid schema JSON: %v", err)
+	}
+	return compile(raw, "/")
+}
+
+func compile(raw interface{}, path string) (*Schema, error) {
+	if b, ok := raw.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: schema must be an object or a boolean", path)
+	}
+	for _, k := range unsupportedKeywords {
+		if _, ok := m[k]; ok {
+			return nil, fmt.Errorf("%v: unsupported keyword %q", path, k)
+		}
+	}
+
+	s := &Schema{minLength: -1, maxLength: -1, minItems: -1, maxItems: -1, minProperties: -1, maxProperties: -1}
+	var err error
+
+	if t, ok := m["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			for _, e := range t {
+				name, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("%v: type must be a string or an array of strings", path)
+				}
+				s.types = append(s.types, name)
+			}
+		default:
+			return nil, fmt.Errorf("%v: type must be a string or an array of strings", path)
+		}
+		for _, name := range s.types {
+			switch name {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fmt.Errorf("%v: unknown type %q", path, name)
+			}
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		if s.enum, ok = e.([]interface{}); !ok {
+			return nil, fmt.Errorf("%v: enum must be an array", path)
+		}
+	}
+	if c, ok := m["const"]; ok {
+		s.constant, s.hasConst = c, true
+	}
+
+	if s.minimum, err = number(m, "minimum", path); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = number(m, "maximum", path); err != nil {
+		return nil, err
+	}
+	// Draft 4 marks the minimum and maximum as exclusive with booleans, later drafts give the exclusive bound itself.
+	if b, ok := m["exclusiveMinimum"].(bool); ok {
+		if b {
+			s.exclusiveMinimum, s.minimum = s.minimum, nil
+		}
+	} else if s.exclusiveMinimum, err = number(m, "exclusiveMinimum", path); err != nil {
+		return nil, err
+	}
+	if b, ok := m["exclusiveMaximum"].(bool); ok {
+		if b {
+			s.exclusiveMaximum, s.maximum = s.maximum, nil
+		}
+	} else if s.exclusiveMaximum, err = number(m, "exclusiveMaximum", path); err != nil {
+		return nil, err
+	}
+	if s.multipleOf, err = number(m, "multipleOf", path); err != nil {
+		return nil, err
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fmt.Errorf("%v: multipleOf must be greater than 0", path)
+	}
+
+	if s.minLength, err = count(m, "minLength", path); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = count(m, "maxLength", path); err != nil {
+		return nil, err
+	}
+	if p, ok := m["pattern"]; ok {
+		pattern, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v: pattern must be a string", path)
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%v: invalid pattern: %v", path, err)
+		}
+	}
+
+	if items, ok := m["items"]; ok {
+		if tuple, ok := items.([]interface{}); ok {
+			s.tupleItems = make([]*Schema, len(tuple))
+			for i, item := range tuple {
+				if s.tupleItems[i], err = compile(item, join(path, "items", strconv.Itoa(i))); err != nil {
+					return nil, err
+				}
+			}
+		} else if s.items, err = compile(items, join(path, "items")); err != nil {
+			return nil, err
+		}
+	}
+	if s.minItems, err = count(m, "minItems", path); err != nil {
+		return nil, err
+	}
+	if s.maxItems, err = count(m, "maxItems", path); err != nil {
+		return nil, err
+	}
+	if u, ok := m["uniqueItems"]; ok {
+		if s.uniqueItems, ok = u.(bool); !ok {
+			return nil, fmt.Errorf("%v: uniqueItems must be a boolean", path)
+		}
+	}
+
+	if p, ok := m["properties"]; ok {
+		properties, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v: properties must be an object", path)
+		}
+		s.properties = make(map[string]*Schema, len(properties))
+		for name, property := range properties {
+			if s.properties[name], err = compile(property, join(path, "properties", name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, ok := m["required"]; ok {
+		required, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v: required must be an array of strings", path)
+		}
+		for _, e := range required {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v: required must be an array of strings", path)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if a, ok := m["additionalProperties"]; ok {
+		if s.additionalProperties, err = compile(a, join(path, "additionalProperties")); err != nil {
+			return nil, err
+		}
+	}
+	if s.minProperties, err = count(m, "minProperties", path); err != nil {
+		return nil, err
+	}
+	if s.maxProperties, err = count(m, "maxProperties", path); err != nil {
+		return nil, err
+	}
+
+	if s.allOf, err = schemas(m, "allOf", path); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = schemas(m, "anyOf", path); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = schemas(m, "oneOf", path); err != nil {
+		return nil, err
+	}
+	if n, ok := m["not"]; ok {
+		if s.not, err = compile(n, join(path, "not")); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func number(m map[string]interface{}, keyword string, path string) (*float64, error) {
+	v, ok := m[keyword]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%v: %v must be a number", path, keyword)
+	}
+	return &f, nil
+}
+
+func count(m map[string]interface{}, keyword string, path string) (int, error) {
+	v, ok := m[keyword]
+	if !ok {
+		return -1, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return -1, fmt.Errorf("%v: %v must be a non-negative integer", path, keyword)
+	}
+	return int(f), nil
+}
+
+func schemas(m map[string]interface{}, keyword string, path string) ([]*Schema, error) {
+	v, ok := m[keyword]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%v: %v must be a non-empty array of schemas", path, keyword)
+	}
+	compiled := make([]*Schema, len(list))
+	for i, raw := range list {
+		var err error
+		if compiled[i], err = compile(raw, join(path, keyword, strconv.Itoa(i))); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// Validate checks a JSON document matches the schema, returning ValidationErrors if it does not.
+func (s *Schema) Validate(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return ValidationErrors{&ValidationError{Path: "/", Message: "is not valid JSON"}}
+	}
+	if errs := s.validate(value, "/", nil); len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Schema) validate(value interface{}, path string, errs ValidationErrors) ValidationErrors {
+	if len(errs) >= maxErrors {
+		return errs
+	}
+	fail := func(format string, args ...interface{}) {
+		if len(errs) < maxErrors {
+			errs = append(errs, &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("is not allowed")
+		}
+		return errs
+	}
+
+	if len(s.types) != 0 {
+		matched := false
+		for _, t := range s.types {
+			if typeMatches(t, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must be of type %v", strings.Join(s.types, " or "))
+			// Further checks would only repeat the type mismatch.
+			return errs
+		}
+	}
+	if s.enum != nil {
+		matched := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must be one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, value) {
+		fail("must be the allowed value")
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			if q := v / *s.multipleOf; math.Abs(q-math.Floor(q+0.5)) > 1e-9 {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != -1 && length < s.minLength {
+			fail("must be at least %v characters", s.minLength)
+		}
+		if s.maxLength != -1 && length > s.maxLength {
+			fail("must be at most %v characters", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match the pattern %v", s.pattern.String())
+		}
+	case []interface{}:
+		if s.minItems != -1 && len(v) < s.minItems {
+			fail("must have at least %v items", s.minItems)
+		}
+		if s.maxItems != -1 && len(v) > s.maxItems {
+			fail("must have at most %v items", s.maxItems)
+		}
+		if s.uniqueItems {
+		unique:
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						fail("must not have duplicate items")
+						break unique
+					}
+				}
+			}
+		}
+		for i, item := range v {
+			if s.tupleItems != nil {
+				if i < len(s.tupleItems) {
+					errs = s.tupleItems[i].validate(item, join(path, strconv.Itoa(i)), errs)
+				}
+			} else if s.items != nil {
+				errs = s.items.validate(item, join(path, strconv.Itoa(i)), errs)
+			}
+		}
+	case map[string]interface{}:
+		if s.minProperties != -1 && len(v) < s.minProperties {
+			fail("must have at least %v properties", s.minProperties)
+		}
+		if s.maxProperties != -1 && len(v) > s.maxProperties {
+			fail("must have at most %v properties", s.maxProperties)
+		}
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, &ValidationError{Path: join(path, name), Message: "is required"})
+				if len(errs) >= maxErrors {
+					return errs
+				}
+			}
+		}
+		// Check properties in a stable order, so the same document always reports the same errors.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.properties[name]; ok {
+				errs = property.validate(v[name], join(path, name), errs)
+			} else if s.additionalProperties != nil {
+				errs = s.additionalProperties.validate(v[name], join(path, name), errs)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		errs = sub.validate(value, path, errs)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(value, path, nil)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the anyOf schemas")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(value, path, nil)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the oneOf schemas, matched %v", matched)
+		}
+	}
+	if s.not != nil && len(s.not.validate(value, path, nil)) == 0 {
+		fail("must not match the not schema")
+	}
+
+	return errs
+}
+
+func typeMatches(t string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v) && !math.IsInf(v, 0))
+	}
+	return false
+}
+
+// join appends reference tokens to a JSON Pointer, escaping them.
+func join(path string, tokens ...string) string {
+	for _, t := range tokens {
+		t = strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1)
+		if path == "/" {
+			path += t
+		} else {
+			path += "/" + t
+		}
+	}
+	return path
+}
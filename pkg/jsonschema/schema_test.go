@@ -0,0 +1,115 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonschema
+
+import (
+	"testing"
+)
+
+const profileSchema = `{
+  "type": "object",
+  "required": ["name", "level"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "minLength": 1, "maxLength": 16, "pattern": "^[a-z]+$"},
+    "level": {"type": "integer", "minimum": 1, "exclusiveMaximum": 100},
+    "class": {"enum": ["warrior", "mage"]},
+    "tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3, "uniqueItems": true},
+    "wallet": {
+      "type": "object",
+      "properties": {"coins": {"type": "number", "minimum": 0, "multipleOf": 0.5}}
+    },
+    "slot/a": {"oneOf": [{"type": "string"}, {"type": "null"}]}
+  }
+}`
+
+var validateTests = []struct {
+	doc  string
+	errs []string
+}{
+	{doc: `{"name": "ann", "level": 3}`},
+	{doc: `{"name": "ann", "level": 3, "class": "mage", "tags": ["a", "b"], "wallet": {"coins": 10.5}, "slot/a": null}`},
+	{doc: `{"name": "ann"}`, errs: []string{"/level: is required"}},
+	{doc: `{"name": "Ann", "level": 3}`, errs: []string{"/name: must match the pattern ^[a-z]+$"}},
+	{doc: `{"name": "ann", "level": 3.5}`, errs: []string{"/level: must be of type integer"}},
+	{doc: `{"name": "ann", "level": 100}`, errs: []string{"/level: must be less than 100"}},
+	{doc: `{"name": "ann", "level": 3, "class": "rogue"}`, errs: []string{"/class: must be one of the allowed values"}},
+	{doc: `{"name": "ann", "level": 3, "tags": ["a", "a", 1]}`, errs: []string{"/tags: must not have duplicate items", "/tags/2: must be of type string"}},
+	{doc: `{"name": "ann", "level": 3, "wallet": {"coins": -0.25}}`, errs: []string{"/wallet/coins: must be at least 0", "/wallet/coins: must be a multiple of 0.5"}},
+	{doc: `{"name": "ann", "level": 3, "slot/a": 1}`, errs: []string{"/slot~1a: must match exactly one of the oneOf schemas, matched 0"}},
+	{doc: `{"name": "ann", "level": 3, "extra": true}`, errs: []string{"/extra: is not allowed"}},
+	{doc: `[]`, errs: []string{"/: must be of type object"}},
+}
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(profileSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range validateTests {
+		err := s.Validate([]byte(tt.doc))
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("Validate(%s) = %v, want no error", tt.doc, err)
+			}
+			continue
+		}
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Errorf("Validate(%s) = %v, want %v", tt.doc, err, tt.errs)
+			continue
+		}
+		if len(errs) != len(tt.errs) {
+			t.Errorf("Validate(%s) = %v, want %v", tt.doc, err, tt.errs)
+			continue
+		}
+		for i, e := range errs {
+			if e.Error() != tt.errs[i] {
+				t.Errorf("Validate(%s) error %v = %q, want %q", tt.doc, i, e.Error(), tt.errs[i])
+			}
+		}
+	}
+}
+
+func TestValidateDraft4ExclusiveMinimum(t *testing.T) {
+	s, err := Parse([]byte(`{"minimum": 0, "exclusiveMinimum": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate([]byte(`0`)); err == nil {
+		t.Error("Validate(0) = nil, want error")
+	}
+	if err := s.Validate([]byte(`1`)); err != nil {
+		t.Errorf("Validate(1) = %v, want no error", err)
+	}
+}
+
+var parseErrorTests = []string{
+	`[]`,
+	`{"type": "text"}`,
+	`{"minLength": -1}`,
+	`{"pattern": "("}`,
+	`{"properties": {"a": {"$ref": "#/definitions/a"}}}`,
+	`{"anyOf": []}`,
+	`{"multipleOf": 0}`,
+}
+
+func TestParseError(t *testing.T) {
+	for _, schema := range parseErrorTests {
+		if _, err := Parse([]byte(schema)); err == nil {
+			t.Errorf("Parse(%s) = nil error, want error", schema)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package social
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Shortest time between fetches of a key set, so tokens naming unknown keys cannot flood the provider with requests.
+const jwksMinRefresh = time.Minute
+
+// jwks caches the RSA public keys of a provider's JSON Web Key Set. Keys are fetched again when a token names a key
+// that is not cached, which picks up keys the provider has rotated in.
+type jwks struct {
+	sync.Mutex
+	provider  string
+	url       string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+type jwksResponse struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func newJwks(provider string, url string) *jwks {
+	return &jwks{
+		provider: provider,
+		url:      url,
+		keys:     make(map[string]*rsa.PublicKey),
+	}
+}
+
+func (c *Client) jwksKey(set *jwks, kid string) (*rsa.PublicKey, error) {
+	set.Lock()
+	defer set.Unlock()
+
+	if key, ok := set.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(set.fetchedAt) < jwksMinRefresh {
+		return nil, fmt.Errorf("%v error: unknown key %v", set.provider, kid)
+	}
+
+	body, err := c.requestRaw(set.provider, set.url, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	var response jwksResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(response.Keys))
+	for _, k := range response.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	set.keys = keys
+	set.fetchedAt = time.Now()
+
+	if key, ok := set.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v error: unknown key %v", set.provider, kid)
+}
+
+// verifyJWT checks an RS256 token is signed by a key in the set, has not expired, and was issued by the issuer for
+// the audience, returning its claims.
+func (c *Client) verifyJWT(set *jwks, token string, issuer string, audience string) (jwt.MapClaims, error) {
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("%v error: unexpected signing method %v", set.provider, t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return c.jwksKey(set, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("%v error: invalid claims", set.provider)
+	}
+	if !claims.VerifyIssuer(issuer, true) {
+		return nil, fmt.Errorf("%v error: invalid issuer", set.provider)
+	}
+	if audience == "" || !claims.VerifyAudience(audience, true) {
+		return nil, fmt.Errorf("%v error: invalid audience", set.provider)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New(set.provider + " error: missing subject")
+	}
+	return claims, nil
+}
@@ -28,6 +28,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +36,9 @@ import (
 type Client struct {
 	client           *http.Client
 	gamecenterCaCert *x509.Certificate
+	appleKeys        *jwks
+	oidcKeysMutex    sync.Mutex
+	oidcKeys         map[string]*jwks
 }
 
 // FacebookProfile is an abbreviated version of a Facebook profile.
@@ -72,9 +76,41 @@ type GoogleProfile struct {
 	Locale string `json:"locale"`
 }
 
+// AppleProfile is the identity in a Sign in with Apple token.
+type AppleProfile struct {
+	ID            string
+	Email         string
+	EmailVerified bool
+}
+
 // SteamProfile is an abbreviated version of a Steam profile.
 type SteamProfile struct {
-	SteamID uint64 `json:"steamid"`
+	SteamID uint64 `json:"steamid,string"`
+	// OwnerSteamID differs from SteamID when the game is borrowed through Family Sharing.
+	OwnerSteamID    uint64 `json:"ownersteamid,string"`
+	VACBanned       bool   `json:"vacbanned"`
+	PublisherBanned bool   `json:"publisherbanned"`
+}
+
+type steamError struct {
+	ErrorCode int    `json:"errorcode"`
+	ErrorDesc string `json:"errordesc"`
+}
+
+type steamAuthenticateUserTicket struct {
+	Response struct {
+		Params *struct {
+			Result string `json:"result"`
+			SteamProfile
+		} `json:"params"`
+		Error *steamError `json:"error"`
+	} `json:"response"`
+}
+
+type steamFriendList struct {
+	FriendsList struct {
+		Friends []SteamProfile `json:"friends"`
+	} `json:"friendslist"`
 }
 
 // NewClient creates a new Social Client
@@ -120,6 +156,8 @@ dAUK75fDiSKxH3fzvc1D1PFMqT+1i4SvZPLQFCE=
 	return &Client{
 		client:           &http.Client{Timeout: timeout},
 		gamecenterCaCert: caCert,
+		appleKeys:        newJwks("apple keys", "https://appleid.apple.com/auth/keys"),
+		oidcKeys:         make(map[string]*jwks),
 	}
 }
 
@@ -220,18 +258,77 @@ func (c *Client) CheckGameCenterID(playerID string, bundleID string, timestamp i
 	return true, nil
 }
 
+// CheckAppleToken verifies a Sign in with Apple identity token was issued to the app with the bundle ID, returning
+// the identity in it.
+func (c *Client) CheckAppleToken(bundleID string, token string) (*AppleProfile, error) {
+	claims, err := c.verifyJWT(c.appleKeys, token, "https://appleid.apple.com", bundleID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &AppleProfile{ID: claims["sub"].(string)}
+	profile.Email, _ = claims["email"].(string)
+	// Apple sends this as a string or a boolean.
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		profile.EmailVerified = v
+	case string:
+		profile.EmailVerified = v == "true"
+	}
+	return profile, nil
+}
+
+// CheckOIDCToken verifies an OpenID Connect ID token was signed with a key from the JWKS URL, and issued by the issuer
+// for the audience, returning its claims.
+func (c *Client) CheckOIDCToken(issuer string, jwksURL string, audience string, token string) (map[string]interface{}, error) {
+	c.oidcKeysMutex.Lock()
+	keys, ok := c.oidcKeys[jwksURL]
+	if !ok {
+		keys = newJwks("oidc keys", jwksURL)
+		c.oidcKeys[jwksURL] = keys
+	}
+	c.oidcKeysMutex.Unlock()
+
+	claims, err := c.verifyJWT(keys, token, issuer, audience)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
 // GetSteamProfile retrieves the user's Steam Profile.
 // Key and App ID should be configured at the application level.
 // See: https://partner.steamgames.com/documentation/auth#client_to_backend_webapi
 func (c *Client) GetSteamProfile(publisherKey string, appID int, ticket string) (*SteamProfile, error) {
 	path := "https://api.steampowered.com/ISteamUserAuth/AuthenticateUserTicket/v0001/?format=json" +
 		"&key=" + url.QueryEscape(publisherKey) + "&appid=" + strconv.Itoa(appID) + "&ticket=" + url.QueryEscape(ticket)
-	var profile SteamProfile
-	err := c.request("steam profile", path, map[string]string{}, &profile)
+	var response steamAuthenticateUserTicket
+	err := c.request("steam profile", path, map[string]string{}, &response)
 	if err != nil {
 		return nil, err
 	}
-	return &profile, nil
+	// Tickets issued for another app are reported as errors, the app ID is part of the check.
+	if e := response.Response.Error; e != nil {
+		return nil, fmt.Errorf("steam profile error: %v %v", e.ErrorCode, e.ErrorDesc)
+	}
+	params := response.Response.Params
+	if params == nil || params.Result != "OK" || params.SteamID == 0 {
+		return nil, errors.New("steam profile error: ticket not valid")
+	}
+	return &params.SteamProfile, nil
+}
+
+// GetSteamFriends retrieves the Steam IDs of the user's friends. This only succeeds when the user's friend list is
+// public on their Steam profile.
+func (c *Client) GetSteamFriends(publisherKey string, steamID uint64) ([]SteamProfile, error) {
+	path := "https://api.steampowered.com/ISteamUser/GetFriendList/v0001/?format=json&relationship=friend" +
+		"&key=" + url.QueryEscape(publisherKey) + "&steamid=" + strconv.FormatUint(steamID, 10)
+	var friends steamFriendList
+	err := c.request("steam friends", path, map[string]string{}, &friends)
+	if err != nil {
+		return nil, err
+	}
+	return friends.FriendsList.Friends, nil
 }
 
 func (c *Client) request(provider, path string, headers map[string]string, to interface{}) error {
@@ -0,0 +1,118 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// AccountDeletionSweeper periodically erases accounts whose deletion grace period has passed, along with their
+// friends, groups, storage, notifications and leaderboard records.
+type AccountDeletionSweeper struct {
+	logger    *zap.Logger
+	db        *sql.DB
+	rankCache *LeaderboardRankCache
+	graceMs   int64
+	batchSize int
+	ticker    *time.Ticker
+	stopCh    chan bool
+}
+
+// NewAccountDeletionSweeper creates a new AccountDeletionSweeper and starts it.
+func NewAccountDeletionSweeper(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, config *DeletionConfig) *AccountDeletionSweeper {
+	s := &AccountDeletionSweeper{
+		logger:    logger,
+		db:        db,
+		rankCache: rankCache,
+		graceMs:   config.GraceMs,
+		batchSize: config.SweepBatchSize,
+		ticker:    time.NewTicker(time.Duration(config.SweepIntervalMs) * time.Millisecond),
+		stopCh:    make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.sweep()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *AccountDeletionSweeper) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+// sweep erases accounts due for erasure a batch at a time, until a batch comes up short or the sweeper is stopped. An
+// account that cannot be erased is tried again on the next sweep.
+func (s *AccountDeletionSweeper) sweep() {
+	for {
+		userIDs, err := s.due()
+		if err != nil {
+			s.logger.Error("Could not find accounts to erase", zap.Error(err))
+			return
+		}
+
+		for _, userID := range userIDs {
+			if err = accountErase(s.db, s.rankCache, userID, s.batchSize); err != nil {
+				s.logger.Error("Could not erase account", zap.Error(err))
+				return
+			}
+			s.logger.Info("Erased account", zap.String("user_id", uuid.FromBytesOrNil(userID).String()))
+
+			select {
+			case <-s.stopCh:
+				return
+			default:
+			}
+		}
+
+		if len(userIDs) < s.batchSize {
+			return
+		}
+	}
+}
+
+// due returns a batch of accounts scheduled for deletion before the grace period.
+func (s *AccountDeletionSweeper) due() ([][]byte, error) {
+	rows, err := s.db.Query(`
+SELECT id FROM users@deleted_at_idx
+WHERE deleted_at > 0 AND deleted_at <= $1
+LIMIT $2`, nowMs()-s.graceMs, s.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make([][]byte, 0)
+	for rows.Next() {
+		var userID []byte
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
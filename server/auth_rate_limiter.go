@@ -0,0 +1,165 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+type authRateLimitEntry struct {
+	windowStart int64
+	failures    int
+	lockedUntil int64
+}
+
+// AuthRateLimiter counts failed authentication attempts by client IP and by account, and locks either out for a time
+// once they fail too often. This slows credential stuffing and guessing of device and custom IDs.
+type AuthRateLimiter struct {
+	sync.Mutex
+	logger   *zap.Logger
+	config   *AuthRateLimitConfig
+	ips      map[string]*authRateLimitEntry
+	accounts map[string]*authRateLimitEntry
+	prunedAt int64
+	lockouts *atomic.Int64
+	rejected *atomic.Int64
+}
+
+// NewAuthRateLimiter creates a new AuthRateLimiter.
+func NewAuthRateLimiter(logger *zap.Logger, config *AuthRateLimitConfig) *AuthRateLimiter {
+	return &AuthRateLimiter{
+		logger:   logger,
+		config:   config,
+		ips:      make(map[string]*authRateLimitEntry),
+		accounts: make(map[string]*authRateLimitEntry),
+		lockouts: atomic.NewInt64(0),
+		rejected: atomic.NewInt64(0),
+	}
+}
+
+// authRateLimitAccount names the account an authentication request guesses at, or returns an empty string when the
+// request carries a token checked by a provider instead.
+func authRateLimitAccount(authReq *AuthenticateRequest) string {
+	switch id := authReq.Id.(type) {
+	case *AuthenticateRequest_Email_:
+		if id.Email != nil {
+			return "email:" + strings.ToLower(id.Email.Email)
+		}
+	case *AuthenticateRequest_Device:
+		return "device:" + id.Device
+	case *AuthenticateRequest_Custom:
+		return "custom:" + id.Custom
+	}
+	return ""
+}
+
+// Check returns how long in milliseconds the IP or account is still locked out for, or 0 if it may try.
+func (l *AuthRateLimiter) Check(ip string, account string, now int64) int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	var lockedUntil int64
+	if e, ok := l.ips[ip]; ok && e.lockedUntil > lockedUntil {
+		lockedUntil = e.lockedUntil
+	}
+	if e, ok := l.accounts[account]; ok && account != "" && e.lockedUntil > lockedUntil {
+		lockedUntil = e.lockedUntil
+	}
+	if lockedUntil <= now {
+		return 0
+	}
+	l.rejected.Inc()
+	return lockedUntil - now
+}
+
+// Fail records a failed attempt from the IP on the account, locking out either if it is over its limit. An empty IP or
+// account is not counted.
+func (l *AuthRateLimiter) Fail(ip string, account string, now int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune(now)
+	if ip != "" && l.fail(l.ips, ip, l.config.IPMaxFailures, now) {
+		l.lockouts.Inc()
+		l.logger.Warn("Authentication locked out for IP", zap.String("ip", ip), zap.Int64("lockout_ms", l.config.LockoutMs))
+	}
+	if account != "" && l.fail(l.accounts, account, l.config.AccountMaxFailures, now) {
+		l.lockouts.Inc()
+		// Device and custom IDs are credentials themselves, so only a hash of the account is logged.
+		hash := sha256.Sum256([]byte(account))
+		l.logger.Warn("Authentication locked out for account", zap.String("ip", ip),
+			zap.String("type", account[:strings.Index(account, ":")]), zap.String("account_hash", hex.EncodeToString(hash[:8])),
+			zap.Int64("lockout_ms", l.config.LockoutMs))
+	}
+}
+
+// Succeed clears failed attempts on the account once it authenticates.
+func (l *AuthRateLimiter) Succeed(account string) {
+	if account == "" {
+		return
+	}
+	l.Lock()
+	delete(l.accounts, account)
+	l.Unlock()
+}
+
+// Stats returns the number of lockouts and of attempts rejected while locked out since the server started.
+func (l *AuthRateLimiter) Stats() (int64, int64) {
+	return l.lockouts.Load(), l.rejected.Load()
+}
+
+// fail counts a failure against the key, returning true if it locks the key out. A limit of 0 disables the check.
+func (l *AuthRateLimiter) fail(entries map[string]*authRateLimitEntry, key string, limit int, now int64) bool {
+	if limit <= 0 {
+		return false
+	}
+	e, ok := entries[key]
+	if !ok {
+		e = &authRateLimitEntry{windowStart: now}
+		entries[key] = e
+	} else if e.windowStart+l.config.WindowMs <= now {
+		e.windowStart = now
+		e.failures = 0
+	}
+	e.failures++
+	if e.failures < limit {
+		return false
+	}
+	e.failures = 0
+	e.windowStart = now
+	e.lockedUntil = now + l.config.LockoutMs
+	return true
+}
+
+// prune drops entries that are neither counting failures nor locked out, at most once per window.
+func (l *AuthRateLimiter) prune(now int64) {
+	if l.prunedAt+l.config.WindowMs > now {
+		return
+	}
+	l.prunedAt = now
+	for _, entries := range []map[string]*authRateLimitEntry{l.ips, l.accounts} {
+		for key, e := range entries {
+			if e.windowStart+l.config.WindowMs <= now && e.lockedUntil <= now {
+				delete(entries, key)
+			}
+		}
+	}
+}
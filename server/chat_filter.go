@@ -0,0 +1,116 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChatFilter checks chat message content against the configured word list and patterns.
+type ChatFilter struct {
+	patterns []*regexp.Regexp
+	mask     bool
+}
+
+// NewChatFilter compiles the chat filter word list and patterns from configuration.
+func NewChatFilter(config *ChatConfig) (*ChatFilter, error) {
+	patterns := make([]*regexp.Regexp, 0, len(config.FilterWords)+len(config.FilterPatterns))
+	for _, word := range config.FilterWords {
+		if word == "" {
+			continue
+		}
+		patterns = append(patterns, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(word)+`\b`))
+	}
+	for _, pattern := range config.FilterPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat filter pattern %q: %s", pattern, err.Error())
+		}
+		patterns = append(patterns, re)
+	}
+
+	return &ChatFilter{
+		patterns: patterns,
+		mask:     config.FilterMask,
+	}, nil
+}
+
+// Apply checks all string values in the JSON message data. It returns the data to store, masked if configured,
+// or false if the message should be rejected.
+func (f *ChatFilter) Apply(data []byte) ([]byte, bool) {
+	if len(f.patterns) == 0 {
+		return data, true
+	}
+
+	var content interface{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, false
+	}
+
+	content, matched := f.filterValue(content)
+	if !matched {
+		return data, true
+	}
+	if !f.mask {
+		return nil, false
+	}
+
+	filtered, err := json.Marshal(content)
+	if err != nil {
+		return nil, false
+	}
+	return filtered, true
+}
+
+func (f *ChatFilter) filterValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		matched := false
+		for _, re := range f.patterns {
+			if !re.MatchString(v) {
+				continue
+			}
+			matched = true
+			if !f.mask {
+				break
+			}
+			v = re.ReplaceAllStringFunc(v, func(s string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(s))
+			})
+		}
+		return v, matched
+	case map[string]interface{}:
+		matched := false
+		for k, e := range v {
+			filtered, m := f.filterValue(e)
+			v[k] = filtered
+			matched = matched || m
+		}
+		return v, matched
+	case []interface{}:
+		matched := false
+		for i, e := range v {
+			filtered, m := f.filterValue(e)
+			v[i] = filtered
+			matched = matched || m
+		}
+		return v, matched
+	}
+	return value, false
+}
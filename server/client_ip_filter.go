@@ -0,0 +1,282 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Time a connection has to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyHeaderSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errClientIPDenied     = errors.New("client address denied")
+	errProxyHeaderInvalid = errors.New("invalid PROXY protocol header")
+)
+
+// ClientIPFilter works out the real address of clients behind proxies and load balancers, and decides which
+// addresses may connect.
+type ClientIPFilter struct {
+	proxyProtocol  bool
+	trustedProxies []*net.IPNet
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+}
+
+// NewClientIPFilter parses the CIDR ranges from configuration. Single addresses are accepted as ranges of one.
+func NewClientIPFilter(config *ClientIPConfig) (*ClientIPFilter, error) {
+	trustedProxies, err := parseCIDRs("trusted proxy", config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseCIDRs("allow", config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs("deny", config.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientIPFilter{
+		proxyProtocol:  config.ProxyProtocol,
+		trustedProxies: trustedProxies,
+		allow:          allow,
+		deny:           deny,
+	}, nil
+}
+
+func parseCIDRs(name string, values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s range %q: %s", name, value, err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether a client may connect from the address. Deny ranges are checked first, then if any allow
+// ranges are configured the address must be in one of them.
+func (f *ClientIPFilter) Allowed(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// ClientIP returns the address of the client that made the request. X-Forwarded-For is followed back from the
+// connecting address for as long as each hop is a trusted proxy.
+func (f *ClientIPFilter) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !f.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !f.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (f *ClientIPFilter) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && containsIP(f.trustedProxies, ip)
+}
+
+// Handler turns away requests from denied client addresses, as seen through trusted proxies.
+func (f *ClientIPFilter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.Allowed(f.ClientIP(r)) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Listener wraps a listener to read PROXY protocol headers if configured, and to close connections from denied
+// addresses as they are accepted.
+func (f *ClientIPFilter) Listener(logger *zap.Logger, listener net.Listener) net.Listener {
+	return &clientIPListener{Listener: listener, logger: logger, filter: f}
+}
+
+type clientIPListener struct {
+	net.Listener
+	logger *zap.Logger
+	filter *ClientIPFilter
+}
+
+func (l *clientIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// The header is read on first use, by the connection's own goroutine, so slow clients can't hold up others.
+		if l.filter.proxyProtocol {
+			return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), logger: l.logger, filter: l.filter}, nil
+		}
+
+		if ip, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && !l.filter.Allowed(ip) {
+			l.logger.Debug("Closed connection from denied address", zap.String("remoteAddress", ip))
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// proxyConn is a connection that starts with a PROXY protocol v2 header giving the client's real address.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	logger *zap.Logger
+	filter *ClientIPFilter
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.logger.Debug("Closed connection with invalid PROXY protocol header", zap.String("remoteAddress", c.Conn.RemoteAddr().String()), zap.Error(c.err))
+		} else {
+			addr := c.Conn.RemoteAddr()
+			if c.remote != nil {
+				addr = c.remote
+			}
+			if ip, _, err := net.SplitHostPort(addr.String()); err == nil && !c.filter.Allowed(ip) {
+				c.logger.Debug("Closed connection from denied address", zap.String("remoteAddress", ip))
+				c.err = errClientIPDenied
+			}
+		}
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v2 header. It returns the source address it gives, or nil for health checks
+// the proxy makes on its own behalf.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyHeaderSignature) || header[12]>>4 != 2 {
+		return nil, errProxyHeaderInvalid
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the connection is the proxy's own.
+		return nil, nil
+	case 0x1:
+		// PROXY, addresses follow.
+	default:
+		return nil, errProxyHeaderInvalid
+	}
+
+	switch family {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errProxyHeaderInvalid
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errProxyHeaderInvalid
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// Unspecified or Unix sockets, keep the connecting address.
+		return nil, nil
+	}
+}
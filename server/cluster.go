@@ -0,0 +1,785 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	clusterKeyHeader  = "X-Nakama-Cluster-Key"
+	clusterNodeHeader = "X-Nakama-Cluster-Node"
+	// Messages waiting for one node. Past this the node is considered too slow, its queue is dropped and its copy
+	// of this node's presences resent in full.
+	clusterQueueSize = 4096
+	// Presence diffs are not guaranteed to arrive in order, so every node's presences are resent in full this often.
+	clusterSyncIntervalMs = 60000
+	// Most messages published to the bus at once, to stay under broker message size limits.
+	clusterBusBatchSize = 256
+
+	clusterMembersSubject = "cluster.members"
+	clusterNodeSubject    = "cluster.node."
+)
+
+// clusterMember is one node as known through gossip. Heartbeats only grow while the node runs, and the incarnation
+// changes each time it starts.
+type clusterMember struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Incarnation int64  `json:"incarnation"`
+	Heartbeat   int64  `json:"heartbeat"`
+	Left        bool   `json:"left,omitempty"`
+}
+
+// newer reports whether m is later news of the same node than o.
+func (m *clusterMember) newer(o *clusterMember) bool {
+	return m.Incarnation > o.Incarnation || (m.Incarnation == o.Incarnation && m.Heartbeat > o.Heartbeat)
+}
+
+type clusterGossip struct {
+	Members []*clusterMember `json:"members"`
+}
+
+// clusterBusMessages are messages for one node sent through the bus, along with the sending member so the receiver
+// knows of it even before its heartbeat arrives.
+type clusterBusMessages struct {
+	From     *clusterMember    `json:"from"`
+	Messages []*clusterMessage `json:"messages"`
+}
+
+// clusterMessage carries either presence changes on the sending node, all its presences and claims when Sync is set,
+// an envelope to deliver to sessions on the receiving node, changes to the leaderboard rank cache, or topics the
+// sending node has claimed or released.
+type clusterMessage struct {
+	Sync        bool                     `json:"sync,omitempty"`
+	RanksLost   bool                     `json:"ranks_lost,omitempty"`
+	Joins       []Presence               `json:"joins,omitempty"`
+	Leaves      []Presence               `json:"leaves,omitempty"`
+	Sessions    []uuid.UUID              `json:"sessions,omitempty"`
+	Payload     []byte                   `json:"payload,omitempty"`
+	RankChanges []*leaderboardRankChange `json:"rank_changes,omitempty"`
+	Claims      []string                 `json:"claims,omitempty"`
+	Releases    []string                 `json:"releases,omitempty"`
+}
+
+type clusterPeer struct {
+	member *clusterMember
+	seenAt int64 // When the member's heartbeat last grew, by this node's clock.
+	queue  []*clusterMessage
+	resync bool
+	// Set when rank cache changes meant for the node may have been lost, so it reloads its cache on the next sync.
+	ranksLost bool
+	wakeCh    chan struct{}
+	stopCh    chan struct{}
+}
+
+// ClusterService joins this node with others into one deployment. Nodes find each other by gossiping their member
+// lists, starting from the configured seeds, or by heartbeats published on a message bus when one is configured.
+// Each node replicates presences on it to the others, so every tracker holds the presences of the whole cluster, and
+// envelopes for sessions on other nodes are forwarded to them in order.
+//
+// Matches, parties and matchmaking are held by the node they were created on. Nodes claim the topics of the matches
+// and parties they hold, so other nodes can turn away joins rather than start a second copy. Changes to the
+// leaderboard rank cache are replicated so every node reports the same ranks.
+type ClusterService struct {
+	sync.Mutex
+	logger    *zap.Logger
+	config    *ClusterConfig
+	name      string
+	self      *clusterMember
+	tracker   *TrackerService
+	router    MessageRouter
+	rankCache *LeaderboardRankCache
+	client    *http.Client
+	server    *http.Server
+	bus       MessageBus
+	peers     map[string]*clusterPeer
+	dead      map[string]*clusterMember
+	claims    map[string]struct{} // Topics claimed by this node.
+	owners    map[string]string   // Topics claimed by other nodes, to the node that claimed them.
+	syncedAt  int64
+	started   bool
+	stopped   bool
+	stopCh    chan struct{}
+}
+
+// NewClusterService creates a new ClusterService. It does not join other nodes until started.
+func NewClusterService(logger *zap.Logger, config Config, tracker *TrackerService) *ClusterService {
+	c := &ClusterService{
+		logger:  logger,
+		config:  config.GetCluster(),
+		name:    config.GetName(),
+		tracker: tracker,
+		client:  &http.Client{Timeout: time.Duration(config.GetCluster().NodeTimeoutMs) * time.Millisecond},
+		peers:   make(map[string]*clusterPeer),
+		dead:    make(map[string]*clusterMember),
+		claims:  make(map[string]struct{}),
+		owners:  make(map[string]string),
+		stopCh:  make(chan struct{}),
+	}
+	address := c.config.Address
+	if address == "" {
+		address = net.JoinHostPort(localIP(logger), strconv.Itoa(c.config.Port))
+	}
+	c.self = &clusterMember{Name: c.name, Address: address, Incarnation: nowMs()}
+	return c
+}
+
+func (c *ClusterService) enabled() bool {
+	return c != nil && (c.config.Port != 0 || c.config.Bus.Backend != "")
+}
+
+// Start listens for other nodes and begins gossiping. Envelopes forwarded from other nodes are delivered through the
+// router, and changes to the rank cache are sent to and received from other nodes. It does nothing if neither a
+// cluster port nor a message bus is configured.
+func (c *ClusterService) Start(logger *zap.Logger, router MessageRouter, rankCache *LeaderboardRankCache) {
+	if !c.enabled() {
+		return
+	}
+	c.router = router
+	c.rankCache = rankCache
+	rankCache.addChangeListener(c.handleRankChange)
+	c.started = true
+
+	if c.config.Bus.Backend != "" {
+		bus, err := NewMessageBus(c.logger, c.config.Bus)
+		if err != nil {
+			logger.Fatal("Cluster message bus connection failed", zap.String("backend", c.config.Bus.Backend), zap.Error(err))
+		}
+		c.bus = bus
+		if err := bus.Subscribe(clusterMembersSubject, c.handleBusMembers); err != nil {
+			logger.Fatal("Cluster message bus subscription failed", zap.Error(err))
+		}
+		if err := bus.Subscribe(clusterNodeSubject+c.name, c.handleBusMessages); err != nil {
+			logger.Fatal("Cluster message bus subscription failed", zap.Error(err))
+		}
+		go c.gossipPeriodically()
+
+		logger.Info("Cluster", zap.String("backend", c.config.Bus.Backend), zap.String("address", c.config.Bus.Address))
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/gossip", c.authorize(c.handleGossip))
+	mux.HandleFunc("/cluster/messages", c.authorize(c.handleMessages))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.config.Port))
+	if err != nil {
+		logger.Fatal("Cluster listener failed", zap.Error(err))
+	}
+	c.server = &http.Server{Handler: mux}
+	go func() {
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.logger.Error("Cluster listener stopped", zap.Error(err))
+		}
+	}()
+	go c.gossipPeriodically()
+
+	logger.Info("Cluster", zap.Int("port", c.config.Port), zap.String("address", c.self.Address), zap.Strings("seeds", c.config.Seeds))
+}
+
+// Stop tells known nodes this node is leaving, so they drop its presences straight away, and stops listening.
+func (c *ClusterService) Stop() {
+	c.Lock()
+	if c.stopped || !c.started {
+		c.Unlock()
+		return
+	}
+	c.stopped = true
+	close(c.stopCh)
+	c.self.Heartbeat++
+	c.self.Left = true
+	gossip := &clusterGossip{Members: []*clusterMember{c.copySelf()}}
+	addresses := make([]string, 0, len(c.peers))
+	for name, peer := range c.peers {
+		addresses = append(addresses, peer.member.Address)
+		close(peer.stopCh)
+		delete(c.peers, name)
+	}
+	c.Unlock()
+
+	if c.bus != nil {
+		if err := c.publish(clusterMembersSubject, gossip); err != nil {
+			c.logger.Warn("Could not tell nodes of leaving cluster", zap.Error(err))
+		}
+		c.bus.Close()
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			if err := c.post(address, "/cluster/gossip", gossip, nil); err != nil {
+				c.logger.Warn("Could not tell node of leaving cluster", zap.String("address", address), zap.Error(err))
+			}
+			wg.Done()
+		}(address)
+	}
+	wg.Wait()
+	c.server.Close()
+}
+
+// Nodes lists the names of other nodes currently in the cluster.
+func (c *ClusterService) Nodes() []string {
+	c.Lock()
+	names := make([]string, 0, len(c.peers))
+	for name := range c.peers {
+		names = append(names, name)
+	}
+	c.Unlock()
+	return names
+}
+
+// HandleDiff replicates changes to presences on this node to all other nodes.
+func (c *ClusterService) HandleDiff(joins, leaves []Presence) {
+	if !c.enabled() {
+		return
+	}
+	localJoins := c.filterLocal(joins)
+	localLeaves := c.filterLocal(leaves)
+	if len(localJoins) == 0 && len(localLeaves) == 0 {
+		return
+	}
+
+	c.Lock()
+	for _, peer := range c.peers {
+		c.enqueue(peer, &clusterMessage{Joins: localJoins, Leaves: localLeaves})
+	}
+	c.Unlock()
+}
+
+// Route forwards an envelope, already serialized, to sessions on another node. Returns false if the node is not
+// known to be in the cluster.
+func (c *ClusterService) Route(node string, ps []Presence, payload []byte) bool {
+	if !c.enabled() {
+		return false
+	}
+	sessions := make([]uuid.UUID, 0, len(ps))
+	for _, p := range ps {
+		sessions = append(sessions, p.ID.SessionID)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	peer, ok := c.peers[node]
+	if !ok {
+		return false
+	}
+	c.enqueue(peer, &clusterMessage{Sessions: sessions, Payload: payload})
+	return true
+}
+
+// Claim tells other nodes this node holds the given topic, such as a match or party.
+func (c *ClusterService) Claim(topic string) {
+	if !c.enabled() {
+		return
+	}
+	c.Lock()
+	c.claims[topic] = struct{}{}
+	for _, peer := range c.peers {
+		c.enqueue(peer, &clusterMessage{Claims: []string{topic}})
+	}
+	c.Unlock()
+}
+
+// Release tells other nodes this node no longer holds the given topic.
+func (c *ClusterService) Release(topic string) {
+	if !c.enabled() {
+		return
+	}
+	c.Lock()
+	if _, ok := c.claims[topic]; ok {
+		delete(c.claims, topic)
+		for _, peer := range c.peers {
+			c.enqueue(peer, &clusterMessage{Releases: []string{topic}})
+		}
+	}
+	c.Unlock()
+}
+
+// Owner returns the other node holding the given topic, if there is one.
+func (c *ClusterService) Owner(topic string) (string, bool) {
+	if !c.enabled() {
+		return "", false
+	}
+	c.Lock()
+	node, ok := c.owners[topic]
+	c.Unlock()
+	return node, ok
+}
+
+// handleRankChange replicates a change to the rank cache on this node to all other nodes.
+func (c *ClusterService) handleRankChange(change *leaderboardRankChange) {
+	c.Lock()
+	for _, peer := range c.peers {
+		c.enqueue(peer, &clusterMessage{RankChanges: []*leaderboardRankChange{change}})
+	}
+	c.Unlock()
+}
+
+func (c *ClusterService) filterLocal(ps []Presence) []Presence {
+	local := make([]Presence, 0, len(ps))
+	for _, p := range ps {
+		if p.ID.Node == c.name {
+			local = append(local, p)
+		}
+	}
+	return local
+}
+
+// enqueue must be called with the lock held.
+func (c *ClusterService) enqueue(peer *clusterPeer, msg *clusterMessage) {
+	if len(peer.queue) >= clusterQueueSize {
+		c.logger.Warn("Cluster node fell behind, resyncing", zap.String("node", peer.member.Name))
+		peer.queue = nil
+		peer.resync = true
+		peer.ranksLost = true
+	}
+	peer.queue = append(peer.queue, msg)
+	c.wake(peer)
+}
+
+func (c *ClusterService) wake(peer *clusterPeer) {
+	select {
+	case peer.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// sendToPeer sends queued messages to one node in order, resending all presences on this node first when needed.
+func (c *ClusterService) sendToPeer(peer *clusterPeer) {
+	for {
+		select {
+		case <-peer.wakeCh:
+		case <-peer.stopCh:
+			return
+		}
+
+		c.Lock()
+		queued := peer.queue
+		peer.queue = nil
+		messages := queued
+		if peer.resync {
+			peer.resync = false
+			// Queued diffs are already part of the current presences and claims.
+			messages = []*clusterMessage{{Sync: true, RanksLost: peer.ranksLost, Joins: c.tracker.ListLocal(), Claims: c.claimList()}}
+			peer.ranksLost = false
+			for _, msg := range queued {
+				if msg.Payload != nil || len(msg.RankChanges) != 0 {
+					messages = append(messages, msg)
+				}
+			}
+		}
+		address := peer.member.Address
+		name := peer.member.Name
+		from := c.copySelf()
+		c.Unlock()
+
+		if len(messages) == 0 {
+			continue
+		}
+		if err := c.send(from, name, address, messages); err != nil {
+			c.logger.Warn("Could not send to cluster node", zap.String("node", name), zap.Int("count", len(messages)), zap.Error(err))
+			c.Lock()
+			peer.resync = true
+			peer.ranksLost = true
+			c.Unlock()
+		}
+	}
+}
+
+func (c *ClusterService) gossipPeriodically() {
+	ticker := time.NewTicker(time.Duration(c.config.GossipIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.gossip()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// gossip exchanges member lists with one other node, picked at random, or a seed if no other node is known yet. On a
+// message bus every node hears every heartbeat, so only this node's own member is published.
+func (c *ClusterService) gossip() {
+	now := nowMs()
+	c.Lock()
+	if c.stopped {
+		c.Unlock()
+		return
+	}
+	c.self.Heartbeat++
+	resyncAll := now-c.syncedAt >= clusterSyncIntervalMs
+	if resyncAll {
+		c.syncedAt = now
+	}
+	addresses := make([]string, 0, len(c.peers))
+	for name, peer := range c.peers {
+		if now-peer.seenAt > int64(c.config.NodeTimeoutMs) {
+			c.logger.Warn("Cluster node timed out", zap.String("node", name))
+			c.removePeer(name)
+			continue
+		}
+		if resyncAll {
+			peer.resync = true
+		}
+		if peer.resync {
+			c.wake(peer)
+		}
+		addresses = append(addresses, peer.member.Address)
+	}
+	if len(addresses) == 0 {
+		for _, seed := range c.config.Seeds {
+			if seed != c.self.Address {
+				addresses = append(addresses, seed)
+			}
+		}
+	}
+	gossip := &clusterGossip{Members: c.members()}
+	self := c.copySelf()
+	c.Unlock()
+
+	if c.bus != nil {
+		if err := c.publish(clusterMembersSubject, &clusterGossip{Members: []*clusterMember{self}}); err != nil {
+			c.logger.Warn("Could not publish cluster heartbeat", zap.Error(err))
+		}
+		return
+	}
+	if len(addresses) == 0 {
+		return
+	}
+	address := addresses[rand.Intn(len(addresses))]
+	reply := &clusterGossip{}
+	if err := c.post(address, "/cluster/gossip", gossip, reply); err != nil {
+		c.logger.Debug("Could not gossip with cluster node", zap.String("address", address), zap.Error(err))
+		return
+	}
+	c.merge(reply.Members)
+}
+
+// members must be called with the lock held.
+func (c *ClusterService) members() []*clusterMember {
+	members := make([]*clusterMember, 0, len(c.peers)+1)
+	members = append(members, c.copySelf())
+	for _, peer := range c.peers {
+		m := *peer.member
+		members = append(members, &m)
+	}
+	return members
+}
+
+// claimList must be called with the lock held.
+func (c *ClusterService) claimList() []string {
+	topics := make([]string, 0, len(c.claims))
+	for topic := range c.claims {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// dropOwners forgets the topics claimed by another node. Must be called with the lock held.
+func (c *ClusterService) dropOwners(node string) {
+	for topic, owner := range c.owners {
+		if owner == node {
+			delete(c.owners, topic)
+		}
+	}
+}
+
+func (c *ClusterService) copySelf() *clusterMember {
+	m := *c.self
+	return &m
+}
+
+// merge applies member lists received from other nodes.
+func (c *ClusterService) merge(members []*clusterMember) {
+	now := nowMs()
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return
+	}
+	for _, m := range members {
+		if m == nil || m.Name == "" || m.Name == c.name {
+			continue
+		}
+		if d, ok := c.dead[m.Name]; ok && !m.newer(d) {
+			continue
+		}
+		peer, ok := c.peers[m.Name]
+		if ok && !m.newer(peer.member) {
+			continue
+		}
+		if m.Left {
+			if ok {
+				c.logger.Info("Cluster node left", zap.String("node", m.Name))
+				c.removePeer(m.Name)
+			}
+			d := *m
+			c.dead[m.Name] = &d
+			continue
+		}
+
+		member := *m
+		if !ok {
+			delete(c.dead, m.Name)
+			// Rank cache changes made before the nodes knew of each other were not sent.
+			peer = &clusterPeer{
+				member:    &member,
+				seenAt:    now,
+				resync:    true,
+				ranksLost: true,
+				wakeCh:    make(chan struct{}, 1),
+				stopCh:    make(chan struct{}),
+			}
+			c.peers[m.Name] = peer
+			c.logger.Info("Cluster node joined", zap.String("node", m.Name), zap.String("address", m.Address))
+			go c.sendToPeer(peer)
+			c.wake(peer)
+			continue
+		}
+		if member.Incarnation != peer.member.Incarnation {
+			// The node restarted, so the sessions it had are gone and it no longer holds presences on this node.
+			c.logger.Info("Cluster node restarted", zap.String("node", m.Name))
+			c.tracker.UntrackNode(m.Name)
+			c.dropOwners(m.Name)
+			peer.queue = nil
+			peer.resync = true
+			peer.ranksLost = true
+			c.wake(peer)
+		}
+		peer.member = &member
+		peer.seenAt = now
+	}
+}
+
+// removePeer must be called with the lock held.
+func (c *ClusterService) removePeer(name string) {
+	peer, ok := c.peers[name]
+	if !ok {
+		return
+	}
+	close(peer.stopCh)
+	delete(c.peers, name)
+	c.dead[name] = peer.member
+	c.tracker.UntrackNode(name)
+	c.dropOwners(name)
+}
+
+func (c *ClusterService) authorize(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterKeyHeader)), []byte(c.config.Secret)) != 1 {
+			http.Error(w, "Cluster key invalid", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (c *ClusterService) handleGossip(w http.ResponseWriter, r *http.Request) {
+	gossip := &clusterGossip{}
+	if err := json.NewDecoder(r.Body).Decode(gossip); err != nil {
+		http.Error(w, "Gossip invalid", http.StatusBadRequest)
+		return
+	}
+	c.merge(gossip.Members)
+
+	c.Lock()
+	reply := &clusterGossip{Members: c.members()}
+	c.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (c *ClusterService) handleMessages(w http.ResponseWriter, r *http.Request) {
+	node := r.Header.Get(clusterNodeHeader)
+	c.Lock()
+	_, known := c.peers[node]
+	c.Unlock()
+	if !known {
+		// Presences from a node this one has not heard of would never be removed if it went away.
+		http.Error(w, "Unknown node", http.StatusConflict)
+		return
+	}
+
+	messages := make([]*clusterMessage, 0)
+	if err := json.NewDecoder(r.Body).Decode(&messages); err != nil {
+		http.Error(w, "Messages invalid", http.StatusBadRequest)
+		return
+	}
+	c.apply(node, messages)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *ClusterService) handleBusMembers(data []byte) {
+	gossip := &clusterGossip{}
+	if err := json.Unmarshal(data, gossip); err != nil {
+		c.logger.Warn("Could not unmarshal cluster heartbeat", zap.Error(err))
+		return
+	}
+	c.merge(gossip.Members)
+}
+
+func (c *ClusterService) handleBusMessages(data []byte) {
+	busMessages := &clusterBusMessages{}
+	if err := json.Unmarshal(data, busMessages); err != nil {
+		c.logger.Warn("Could not unmarshal cluster messages", zap.Error(err))
+		return
+	}
+	if busMessages.From == nil {
+		return
+	}
+	c.merge([]*clusterMember{busMessages.From})
+
+	c.Lock()
+	_, known := c.peers[busMessages.From.Name]
+	c.Unlock()
+	if !known {
+		// The node has left, or is older news than a node of the same name that has.
+		return
+	}
+	c.apply(busMessages.From.Name, busMessages.Messages)
+}
+
+// apply handles messages from another node in the order they were sent.
+func (c *ClusterService) apply(node string, messages []*clusterMessage) {
+	for _, msg := range messages {
+		switch {
+		case msg.Sync:
+			c.tracker.SyncRemote(node, msg.Joins)
+			c.syncOwners(node, msg.Claims)
+			if msg.RanksLost {
+				c.rankCache.reload()
+			}
+		case msg.Payload != nil:
+			c.deliver(node, msg)
+		case len(msg.RankChanges) != 0:
+			for _, change := range msg.RankChanges {
+				c.rankCache.applyRemote(change)
+			}
+		case len(msg.Claims) != 0 || len(msg.Releases) != 0:
+			c.applyOwners(node, msg.Claims, msg.Releases)
+		default:
+			c.tracker.ApplyRemote(node, msg.Joins, msg.Leaves)
+		}
+	}
+}
+
+// syncOwners replaces the topics claimed by another node with all the topics it currently claims.
+func (c *ClusterService) syncOwners(node string, claims []string) {
+	c.Lock()
+	c.dropOwners(node)
+	for _, topic := range claims {
+		c.owners[topic] = node
+	}
+	c.Unlock()
+}
+
+func (c *ClusterService) applyOwners(node string, claims, releases []string) {
+	c.Lock()
+	for _, topic := range claims {
+		c.owners[topic] = node
+	}
+	for _, topic := range releases {
+		if c.owners[topic] == node {
+			delete(c.owners, topic)
+		}
+	}
+	c.Unlock()
+}
+
+// deliver sends an envelope forwarded by another node to sessions on this node.
+func (c *ClusterService) deliver(node string, msg *clusterMessage) {
+	envelope := &Envelope{}
+	if err := proto.Unmarshal(msg.Payload, envelope); err != nil {
+		c.logger.Warn("Could not unmarshal envelope from cluster node", zap.String("node", node), zap.Error(err))
+		return
+	}
+	ps := make([]Presence, 0, len(msg.Sessions))
+	for _, sessionID := range msg.Sessions {
+		ps = append(ps, Presence{ID: PresenceID{Node: c.name, SessionID: sessionID}})
+	}
+	c.router.Send(c.logger, ps, envelope)
+}
+
+// send delivers messages to another node, through the bus if there is one.
+func (c *ClusterService) send(from *clusterMember, name, address string, messages []*clusterMessage) error {
+	if c.bus == nil {
+		return c.post(address, "/cluster/messages", messages, nil)
+	}
+	for start := 0; start < len(messages); start += clusterBusBatchSize {
+		end := start + clusterBusBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		if err := c.publish(clusterNodeSubject+name, &clusterBusMessages{From: from, Messages: messages[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ClusterService) publish(subject string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.bus.Publish(subject, data)
+}
+
+func (c *ClusterService) post(address, path string, body interface{}, reply interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+address+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterKeyHeader, c.config.Secret)
+	req.Header.Set(clusterNodeHeader, c.name)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node responded with status %v", resp.StatusCode)
+	}
+	if reply != nil {
+		return json.NewDecoder(resp.Body).Decode(reply)
+	}
+	return nil
+}
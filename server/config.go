@@ -15,6 +15,7 @@
 package server
 
 import (
+	"compress/flate"
 	"os"
 	"path/filepath"
 	"strings"
@@ -40,6 +41,14 @@ type Config interface {
 	GetSocial() *SocialConfig
 	GetRuntime() *RuntimeConfig
 	GetPurchase() *PurchaseConfig
+	GetLeaderboard() *LeaderboardConfig
+	GetMatchmaker() *MatchmakerConfig
+	GetMatch() *MatchConfig
+	GetStorage() *StorageConfig
+	GetMail() *MailConfig
+	GetCluster() *ClusterConfig
+	GetMetrics() *MetricsConfig
+	GetTracing() *TracingConfig
 }
 
 func ParseArgs(logger *zap.Logger, args []string) Config {
@@ -91,6 +100,96 @@ func ParseArgs(logger *zap.Logger, args []string) Config {
 		mainConfig.GetRuntime().Path = filepath.Join(mainConfig.GetDataDir(), "modules")
 	}
 
+	if level := mainConfig.GetSocket().CompressionLevel; level < flate.HuffmanOnly || level > flate.BestCompression {
+		logger.Fatal("Socket compression level must be between -2 and 9", zap.Int("socket.compression_level", level))
+	}
+
+	if mainConfig.GetSocket().OutgoingQueueSize < 1 {
+		logger.Fatal("Socket outgoing queue size must be at least 1", zap.Int("socket.outgoing_queue_size", mainConfig.GetSocket().OutgoingQueueSize))
+	}
+	for param, policy := range map[string]string{
+		"socket.outgoing_queue_policy":            mainConfig.GetSocket().OutgoingQueuePolicy,
+		"socket.outgoing_queue_match_data_policy": mainConfig.GetSocket().OutgoingQueueMatchDataPolicy,
+	} {
+		if policy != sessionQueuePolicyDisconnect && policy != sessionQueuePolicyDropOldest {
+			logger.Fatal("Socket outgoing queue policy must be disconnect or drop_oldest", zap.String(param, policy))
+		}
+	}
+
+	// Rate limits are keyed by message names as used by runtime hooks.
+	knownMessages := make(map[string]bool, len(RUNTIME_MESSAGES))
+	for _, name := range RUNTIME_MESSAGES {
+		knownMessages[name] = true
+	}
+	for messageType, limit := range mainConfig.GetSocket().MessageRateLimits {
+		if !knownMessages[messageType] {
+			logger.Fatal("Unknown message type in socket message rate limits", zap.String("message", messageType))
+		}
+		if limit == nil || limit.Rate <= 0 || limit.Burst < 1 {
+			logger.Fatal("Socket message rate limits must have a rate above 0 and a burst of at least 1", zap.String("message", messageType))
+		}
+	}
+
+	if bus := mainConfig.GetCluster().Bus; bus.Backend != "" {
+		if bus.Backend != messageBusNATS && bus.Backend != messageBusRedis {
+			logger.Fatal("Cluster bus backend must be nats or redis", zap.String("cluster.bus.backend", bus.Backend))
+		}
+		if bus.Address == "" {
+			logger.Fatal("Cluster bus address must be set", zap.String("cluster.bus.backend", bus.Backend))
+		}
+		if bus.Prefix == "" {
+			logger.Fatal("Cluster bus prefix must be set", zap.String("cluster.bus.prefix", bus.Prefix))
+		}
+		if bus.Backend == messageBusRedis && bus.StreamMaxLen < 1 {
+			logger.Fatal("Cluster bus stream max length must be at least 1", zap.Int("cluster.bus.stream_max_len", bus.StreamMaxLen))
+		}
+	}
+	if cluster := mainConfig.GetCluster(); cluster.Port > 0 || cluster.Bus.Backend != "" {
+		if cluster.GossipIntervalMs < 1 {
+			logger.Fatal("Cluster gossip interval must be at least 1", zap.Int("cluster.gossip_interval_ms", cluster.GossipIntervalMs))
+		}
+		if cluster.NodeTimeoutMs <= cluster.GossipIntervalMs {
+			logger.Fatal("Cluster node timeout must be longer than the gossip interval", zap.Int("cluster.node_timeout_ms", cluster.NodeTimeoutMs))
+		}
+	}
+
+	if metrics := mainConfig.GetMetrics(); metrics.Enabled {
+		if metrics.Namespace == "" {
+			logger.Fatal("Metrics namespace must be set", zap.String("metrics.namespace", metrics.Namespace))
+		}
+		if metrics.MaxLabelValues < 1 {
+			logger.Fatal("Metrics max label values must be at least 1", zap.Int("metrics.max_label_values", metrics.MaxLabelValues))
+		}
+		if len(metrics.LatencyBucketsMs) == 0 {
+			logger.Fatal("Metrics latency buckets must be set")
+		}
+		for i, bucket := range metrics.LatencyBucketsMs {
+			if bucket <= 0 || (i > 0 && bucket <= metrics.LatencyBucketsMs[i-1]) {
+				logger.Fatal("Metrics latency buckets must be positive and increasing", zap.Float64("metrics.latency_buckets_ms", bucket))
+			}
+		}
+		for _, messageType := range metrics.MessageTypes {
+			if !knownMessages[messageType] {
+				logger.Fatal("Unknown message type in metrics message types", zap.String("message", messageType))
+			}
+		}
+	}
+
+	if tracing := mainConfig.GetTracing(); tracing.Endpoint != "" {
+		if tracing.SampleRate < 0 || tracing.SampleRate > 1 {
+			logger.Fatal("Tracing sample rate must be between 0 and 1", zap.Float64("tracing.sample_rate", tracing.SampleRate))
+		}
+		if tracing.BatchSize < 1 {
+			logger.Fatal("Tracing batch size must be at least 1", zap.Int("tracing.batch_size", tracing.BatchSize))
+		}
+		if tracing.QueueSize < tracing.BatchSize {
+			logger.Fatal("Tracing queue size must be at least the batch size", zap.Int("tracing.queue_size", tracing.QueueSize))
+		}
+		if tracing.ExportIntervalMs < 1 {
+			logger.Fatal("Tracing export interval must be at least 1", zap.Int("tracing.export_interval_ms", tracing.ExportIntervalMs))
+		}
+	}
+
 	// Log warnings for insecure default parameter values.
 	if mainConfig.GetSocket().ServerKey == "defaultkey" {
 		logger.Warn("WARNING: insecure default parameter value, change this for production!", zap.String("param", "socket.server_key"))
@@ -101,22 +200,36 @@ func ParseArgs(logger *zap.Logger, args []string) Config {
 	if mainConfig.GetRuntime().HTTPKey == "defaultkey" {
 		logger.Warn("WARNING: insecure default parameter value, change this for production!", zap.String("param", "runtime.http_key"))
 	}
+	if mainConfig.GetCluster().Port > 0 && mainConfig.GetCluster().Bus.Backend == "" && mainConfig.GetCluster().Secret == "defaultclustersecret" {
+		logger.Warn("WARNING: insecure default parameter value, change this for production!", zap.String("param", "cluster.secret"))
+	}
+	if mainConfig.GetRuntime().HTTPClient.InsecureSkipVerify {
+		logger.Warn("WARNING: runtime HTTP requests do not verify server certificates, change this for production!", zap.String("param", "runtime.http_client.insecure_skip_verify"))
+	}
 
 	return mainConfig
 }
 
 type config struct {
-	Name      string           `yaml:"name" json:"name" usage:"Nakama server’s node name - must be unique"`
-	Config    string           `yaml:"config" json:"config" usage:"The absolute file path to configuration YAML file."`
-	Datadir   string           `yaml:"data_dir" json:"data_dir" usage:"An absolute path to a writeable folder where Nakama will store its data."`
-	Dashboard *DashboardConfig `yaml:"dashboard" json:"dashboard" usage:"Dashboard configuration"`
-	Log       *LogConfig       `yaml:"log" json:"log" usage:"Log levels and output"`
-	Session   *SessionConfig   `yaml:"session" json:"session" usage:"Session authentication settings"`
-	Socket    *SocketConfig    `yaml:"socket" json:"socket" usage:"Socket configurations"`
-	Database  *DatabaseConfig  `yaml:"database" json:"database" usage:"Database connection settings"`
-	Social    *SocialConfig    `yaml:"social" json:"social" usage:"Properties for social providers"`
-	Runtime   *RuntimeConfig   `yaml:"runtime" json:"runtime" usage:"Script Runtime properties"`
-	Purchase  *PurchaseConfig  `yaml:"purchase" json:"purchase" usage:"In-App Purchase provider configuration"`
+	Name        string             `yaml:"name" json:"name" usage:"Nakama server’s node name - must be unique"`
+	Config      string             `yaml:"config" json:"config" usage:"The absolute file path to configuration YAML file."`
+	Datadir     string             `yaml:"data_dir" json:"data_dir" usage:"An absolute path to a writeable folder where Nakama will store its data."`
+	Dashboard   *DashboardConfig   `yaml:"dashboard" json:"dashboard" usage:"Dashboard configuration"`
+	Log         *LogConfig         `yaml:"log" json:"log" usage:"Log levels and output"`
+	Session     *SessionConfig     `yaml:"session" json:"session" usage:"Session authentication settings"`
+	Socket      *SocketConfig      `yaml:"socket" json:"socket" usage:"Socket configurations"`
+	Database    *DatabaseConfig    `yaml:"database" json:"database" usage:"Database connection settings"`
+	Social      *SocialConfig      `yaml:"social" json:"social" usage:"Properties for social providers"`
+	Runtime     *RuntimeConfig     `yaml:"runtime" json:"runtime" usage:"Script Runtime properties"`
+	Purchase    *PurchaseConfig    `yaml:"purchase" json:"purchase" usage:"In-App Purchase provider configuration"`
+	Leaderboard *LeaderboardConfig `yaml:"leaderboard" json:"leaderboard" usage:"Leaderboard settings"`
+	Matchmaker  *MatchmakerConfig  `yaml:"matchmaker" json:"matchmaker" usage:"Matchmaker settings"`
+	Match       *MatchConfig       `yaml:"match" json:"match" usage:"Match settings"`
+	Storage     *StorageConfig     `yaml:"storage" json:"storage" usage:"Storage engine settings"`
+	Mail        *MailConfig        `yaml:"mail" json:"mail" usage:"Outgoing email settings"`
+	Cluster     *ClusterConfig     `yaml:"cluster" json:"cluster" usage:"Settings for running several nodes as one deployment"`
+	Metrics     *MetricsConfig     `yaml:"metrics" json:"metrics" usage:"Prometheus metrics settings"`
+	Tracing     *TracingConfig     `yaml:"tracing" json:"tracing" usage:"Distributed tracing settings"`
 }
 
 // NewConfig constructs a Config struct which represents server settings.
@@ -125,16 +238,24 @@ func NewConfig() *config {
 	dataDirectory := filepath.Join(cwd, "data")
 	nodeName := "nakama-" + strings.Split(uuid.NewV4().String(), "-")[3]
 	return &config{
-		Name:      nodeName,
-		Datadir:   dataDirectory,
-		Dashboard: NewDashboardConfig(),
-		Log:       NewLogConfig(),
-		Session:   NewSessionConfig(),
-		Socket:    NewSocketConfig(),
-		Database:  NewDatabaseConfig(),
-		Social:    NewSocialConfig(),
-		Runtime:   NewRuntimeConfig(),
-		Purchase:  NewPurchaseConfig(),
+		Name:        nodeName,
+		Datadir:     dataDirectory,
+		Dashboard:   NewDashboardConfig(),
+		Log:         NewLogConfig(),
+		Session:     NewSessionConfig(),
+		Socket:      NewSocketConfig(),
+		Database:    NewDatabaseConfig(),
+		Social:      NewSocialConfig(),
+		Runtime:     NewRuntimeConfig(),
+		Purchase:    NewPurchaseConfig(),
+		Leaderboard: NewLeaderboardConfig(),
+		Matchmaker:  NewMatchmakerConfig(),
+		Match:       NewMatchConfig(),
+		Storage:     NewStorageConfig(),
+		Mail:        NewMailConfig(),
+		Cluster:     NewClusterConfig(),
+		Metrics:     NewMetricsConfig(),
+		Tracing:     NewTracingConfig(),
 	}
 }
 
@@ -178,6 +299,38 @@ func (c *config) GetPurchase() *PurchaseConfig {
 	return c.Purchase
 }
 
+func (c *config) GetLeaderboard() *LeaderboardConfig {
+	return c.Leaderboard
+}
+
+func (c *config) GetMatchmaker() *MatchmakerConfig {
+	return c.Matchmaker
+}
+
+func (c *config) GetMatch() *MatchConfig {
+	return c.Match
+}
+
+func (c *config) GetStorage() *StorageConfig {
+	return c.Storage
+}
+
+func (c *config) GetMail() *MailConfig {
+	return c.Mail
+}
+
+func (c *config) GetCluster() *ClusterConfig {
+	return c.Cluster
+}
+
+func (c *config) GetMetrics() *MetricsConfig {
+	return c.Metrics
+}
+
+func (c *config) GetTracing() *TracingConfig {
+	return c.Tracing
+}
+
 // DashboardConfig is configuration relevant to the dashboard
 type DashboardConfig struct {
 	Port int `yaml:"port" json:"port" usage:"The port for accepting connections to the dashboard, listening on all interfaces."`
@@ -211,40 +364,148 @@ func NewLogConfig() *LogConfig {
 
 // SessionConfig is configuration relevant to the session
 type SessionConfig struct {
-	EncryptionKey string `yaml:"encryption_key" json:"encryption_key" usage:"The encryption key used to produce the client token."`
-	TokenExpiryMs int64  `yaml:"token_expiry_ms" json:"token_expiry_ms" usage:"Token expiry in milliseconds."`
+	EncryptionKey             string               `yaml:"encryption_key" json:"encryption_key" usage:"The encryption key used to produce the client token."`
+	TokenExpiryMs             int64                `yaml:"token_expiry_ms" json:"token_expiry_ms" usage:"Token expiry in milliseconds."`
+	RefreshTokenExpiryMs      int64                `yaml:"refresh_token_expiry_ms" json:"refresh_token_expiry_ms" usage:"Refresh token expiry in milliseconds. Each refresh issues a new token with a new expiry."`
+	SingleSocket              bool                 `yaml:"single_socket" json:"single_socket" usage:"Only allow one socket per user. Connecting a new socket disconnects the user's other sockets."`
+	EmailVerificationExpiryMs int64                `yaml:"email_verification_expiry_ms" json:"email_verification_expiry_ms" usage:"Time in milliseconds an email address verification link remains valid."`
+	PasswordResetExpiryMs     int64                `yaml:"password_reset_expiry_ms" json:"password_reset_expiry_ms" usage:"Time in milliseconds a password reset link remains valid."`
+	MfaIssuer                 string               `yaml:"mfa_issuer" json:"mfa_issuer" usage:"Name authenticator apps show for multi-factor authentication codes. Default 'Nakama'."`
+	Challenge                 *ChallengeConfig     `yaml:"challenge" json:"challenge" usage:"Registration challenge configuration."`
+	RateLimit                 *AuthRateLimitConfig `yaml:"rate_limit" json:"rate_limit" usage:"Authentication rate limit configuration."`
+	MaxTopics                 int                  `yaml:"max_topics" json:"max_topics" usage:"Chat topics a single session may be in at once. 0 for no limit. Default 0."`
+	MaxMatches                int                  `yaml:"max_matches" json:"max_matches" usage:"Matches a single session may be in at once, as player or spectator. 0 for no limit. Default 0."`
+	MaxMatchmakerTickets      int                  `yaml:"max_matchmaker_tickets" json:"max_matchmaker_tickets" usage:"Matchmaker tickets a single session may have waiting at once. 0 for no limit. Default 0."`
 }
 
 // NewSessionConfig creates a new SessionConfig struct
 func NewSessionConfig() *SessionConfig {
 	return &SessionConfig{
-		EncryptionKey: "defaultencryptionkey",
-		TokenExpiryMs: 60000,
+		EncryptionKey:             "defaultencryptionkey",
+		TokenExpiryMs:             60000,
+		RefreshTokenExpiryMs:      604800000, // one week expiry
+		SingleSocket:              false,
+		EmailVerificationExpiryMs: 86400000, // one day expiry
+		PasswordResetExpiryMs:     3600000,  // one hour expiry
+		MfaIssuer:                 "Nakama",
+		Challenge: &ChallengeConfig{
+			Provider:   "",
+			Difficulty: 20,
+			ExpiryMs:   300000,
+			TimeoutMs:  5000,
+		},
+		RateLimit: &AuthRateLimitConfig{
+			IPMaxFailures:      50,
+			AccountMaxFailures: 10,
+			WindowMs:           60000,
+			LockoutMs:          300000,
+		},
+		MaxTopics:            0,
+		MaxMatches:           0,
+		MaxMatchmakerTickets: 0,
 	}
 }
 
+// AuthRateLimitConfig is configuration relevant to limiting failed authentication attempts
+type AuthRateLimitConfig struct {
+	IPMaxFailures      int   `yaml:"ip_max_failures" json:"ip_max_failures" usage:"Failed authentication attempts allowed from one IP address in each window before it is locked out. 0 for no limit. Default 50."`
+	AccountMaxFailures int   `yaml:"account_max_failures" json:"account_max_failures" usage:"Failed authentication attempts allowed on one email address, device ID or custom ID in each window before it is locked out. 0 for no limit. Default 10."`
+	WindowMs           int64 `yaml:"window_ms" json:"window_ms" usage:"Time in milliseconds failed attempts are counted over. Default 60000."`
+	LockoutMs          int64 `yaml:"lockout_ms" json:"lockout_ms" usage:"Time in milliseconds an IP address or account is locked out for. Default 300000."`
+}
+
+// ChallengeConfig is configuration relevant to the challenge clients must pass to register a new user
+type ChallengeConfig struct {
+	Provider   string `yaml:"provider" json:"provider" usage:"Challenge required to register: 'pow' for a built-in proof of work, 'recaptcha' or 'hcaptcha'. Empty to register without a challenge."`
+	Secret     string `yaml:"secret" json:"secret" usage:"reCAPTCHA or hCaptcha secret key."`
+	Difficulty int    `yaml:"difficulty" json:"difficulty" usage:"Leading zero bits required in the proof of work hash, each one doubles the average work. Default 20."`
+	ExpiryMs   int64  `yaml:"expiry_ms" json:"expiry_ms" usage:"Time in milliseconds a proof of work challenge can be answered in. Default 300000."`
+	TimeoutMs  int    `yaml:"timeout_ms" json:"timeout_ms" usage:"reCAPTCHA or hCaptcha verification timeout in milliseconds. Default 5000."`
+}
+
 // SocketConfig is configuration relevant to the transport socket and protocol
 type SocketConfig struct {
-	ServerKey           string `yaml:"server_key" json:"server_key" usage:"Server key to use to establish a connection to the server."`
-	Port                int    `yaml:"port" json:"port" usage:"The port for accepting connections from the client, listening on all interfaces."`
-	MaxMessageSizeBytes int64  `yaml:"max_message_size_bytes" json:"max_message_size_bytes" usage:"Maximum amount of data in bytes allowed to be read from the client socket per message."`
-	WriteWaitMs         int    `yaml:"write_wait_ms" json:"write_wait_ms" usage:"Time in milliseconds to wait for an ack from the client when writing data."`
-	PongWaitMs          int    `yaml:"pong_wait_ms" json:"pong_wait_ms" usage:"Time in milliseconds to wait for a pong message from the client after sending a ping."`
-	PingPeriodMs        int    `yaml:"ping_period_ms" json:"ping_period_ms" usage:"Time in milliseconds to wait between client ping messages. This value must be less than the pong_wait_ms."`
+	ServerKey                    string                             `yaml:"server_key" json:"server_key" usage:"Server key to use to establish a connection to the server."`
+	Port                         int                                `yaml:"port" json:"port" usage:"The port for accepting connections from the client, listening on all interfaces."`
+	MaxMessageSizeBytes          int64                              `yaml:"max_message_size_bytes" json:"max_message_size_bytes" usage:"Maximum amount of data in bytes allowed to be read from the client socket per message."`
+	WriteWaitMs                  int                                `yaml:"write_wait_ms" json:"write_wait_ms" usage:"Time in milliseconds to wait for an ack from the client when writing data."`
+	PongWaitMs                   int                                `yaml:"pong_wait_ms" json:"pong_wait_ms" usage:"Time in milliseconds to wait for a pong message from the client after sending a ping."`
+	PingPeriodMs                 int                                `yaml:"ping_period_ms" json:"ping_period_ms" usage:"Time in milliseconds to wait between client ping messages. This value must be less than the pong_wait_ms."`
+	MaxMissedPongs               int                                `yaml:"max_missed_pongs" json:"max_missed_pongs" usage:"Number of pings in a row the client may leave unanswered before its session is declared dead and reaped. Default 2."`
+	DatagramPort                 int                                `yaml:"datagram_port" json:"datagram_port" usage:"The UDP port for exchanging match data as datagrams, listening on all interfaces. 0 disables datagrams. Default 0."`
+	GRPCPort                     int                                `yaml:"grpc_port" json:"grpc_port" usage:"The port for the gRPC API, for backend services calling the server without a socket, listening on all interfaces. 0 disables gRPC. Default 0."`
+	DatagramResendMs             int                                `yaml:"datagram_resend_ms" json:"datagram_resend_ms" usage:"Time in milliseconds to wait for the client to acknowledge reliable match data before sending it again. Default 100."`
+	DatagramMaxResends           int                                `yaml:"datagram_max_resends" json:"datagram_max_resends" usage:"Number of times reliable match data is sent again before it is sent over the socket instead. Default 10."`
+	DatagramPingPeriodMs         int                                `yaml:"datagram_ping_period_ms" json:"datagram_ping_period_ms" usage:"Time in milliseconds between empty datagrams sent to keep the client's route open. Clients answer with an empty datagram. Default 5000."`
+	DatagramPongWaitMs           int                                `yaml:"datagram_pong_wait_ms" json:"datagram_pong_wait_ms" usage:"Time in milliseconds without a datagram from the client after which its datagram binding is dropped. Default 15000."`
+	Compression                  bool                               `yaml:"compression" json:"compression" usage:"Compress socket messages with permessage-deflate for clients that support it. Match data is never compressed. Default false."`
+	CompressionLevel             int                                `yaml:"compression_level" json:"compression_level" usage:"Deflate compression level, from -2 for Huffman only to 9 for best compression. Default 1, fastest."`
+	CompressionMinBytes          int                                `yaml:"compression_min_bytes" json:"compression_min_bytes" usage:"Messages smaller than this many bytes are sent uncompressed. Default 512."`
+	OutgoingQueueSize            int                                `yaml:"outgoing_queue_size" json:"outgoing_queue_size" usage:"Maximum number of messages waiting to be written to each client socket. Default 64."`
+	OutgoingQueuePolicy          string                             `yaml:"outgoing_queue_policy" json:"outgoing_queue_policy" usage:"What to do with a message other than match data when the outgoing queue is full. 'disconnect' closes the session, 'drop_oldest' drops the oldest such message queued. Default 'disconnect'."`
+	OutgoingQueueMatchDataPolicy string                             `yaml:"outgoing_queue_match_data_policy" json:"outgoing_queue_match_data_policy" usage:"What to do with match data when the outgoing queue is full. 'drop_oldest' drops the oldest match data queued, 'disconnect' closes the session. Default 'drop_oldest'."`
+	BatchWindowMs                int                                `yaml:"batch_window_ms" json:"batch_window_ms" usage:"Time in milliseconds outgoing messages are held so those sent close together go out in one frame, for sockets that connect with batch=true. Match data is never held. 0 disables batching. Default 5."`
+	BatchMaxBytes                int                                `yaml:"batch_max_bytes" json:"batch_max_bytes" usage:"Size in bytes at which a batch of outgoing messages stops growing. Default 65536."`
+	ShutdownDrainMs              int                                `yaml:"shutdown_drain_ms" json:"shutdown_drain_ms" usage:"Time in milliseconds connected sessions are given to wind down once the server is told to shut down. Default 5000."`
+	ShutdownReconnectSpreadMs    int                                `yaml:"shutdown_reconnect_spread_ms" json:"shutdown_reconnect_spread_ms" usage:"Clients are told to reconnect at a random time up to this many milliseconds after the drain period. Default 5000."`
+	ResumeWindowMs               int                                `yaml:"resume_window_ms" json:"resume_window_ms" usage:"Time in milliseconds a session is kept after its socket drops, with its presences, so a reconnecting client can resume it. 0 disables resuming. Default 0."`
+	ResumeBufferSize             int                                `yaml:"resume_buffer_size" json:"resume_buffer_size" usage:"Maximum number of messages kept for a session waiting to be resumed. Older messages are dropped. Default 256."`
+	ClientIP                     *ClientIPConfig                    `yaml:"client_ip" json:"client_ip" usage:"Client address settings."`
+	MessageRateLimits            map[string]*MessageRateLimitConfig `yaml:"message_rate_limits" json:"message_rate_limits"` // not supported in FlagOverrides
 }
 
 // NewTransportConfig creates a new TransportConfig struct
 func NewSocketConfig() *SocketConfig {
 	return &SocketConfig{
-		ServerKey:           "defaultkey",
-		Port:                7350,
-		MaxMessageSizeBytes: 1024,
-		WriteWaitMs:         5000,
-		PongWaitMs:          10000,
-		PingPeriodMs:        8000,
+		ServerKey:                    "defaultkey",
+		Port:                         7350,
+		MaxMessageSizeBytes:          1024,
+		WriteWaitMs:                  5000,
+		PongWaitMs:                   10000,
+		PingPeriodMs:                 8000,
+		MaxMissedPongs:               2,
+		DatagramPort:                 0,
+		GRPCPort:                     0,
+		DatagramResendMs:             100,
+		DatagramMaxResends:           10,
+		DatagramPingPeriodMs:         5000,
+		DatagramPongWaitMs:           15000,
+		Compression:                  false,
+		CompressionLevel:             flate.BestSpeed,
+		CompressionMinBytes:          512,
+		OutgoingQueueSize:            64,
+		OutgoingQueuePolicy:          sessionQueuePolicyDisconnect,
+		OutgoingQueueMatchDataPolicy: sessionQueuePolicyDropOldest,
+		BatchWindowMs:                5,
+		BatchMaxBytes:                65536,
+		ShutdownDrainMs:              5000,
+		ShutdownReconnectSpreadMs:    5000,
+		ResumeWindowMs:               0,
+		ResumeBufferSize:             256,
+		ClientIP: &ClientIPConfig{
+			ProxyProtocol:  false,
+			TrustedProxies: []string{},
+			Allow:          []string{},
+			Deny:           []string{},
+		},
+		MessageRateLimits: make(map[string]*MessageRateLimitConfig),
 	}
 }
 
+// ClientIPConfig is configuration relevant to client addresses
+type ClientIPConfig struct {
+	ProxyProtocol  bool     `yaml:"proxy_protocol" json:"proxy_protocol" usage:"Expect a PROXY protocol v2 header with the client address at the start of every connection, as sent by HAProxy and many load balancers. Default false."`
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies" usage:"CIDR ranges of proxies trusted to give the client address in the X-Forwarded-For header."`
+	Allow          []string `yaml:"allow" json:"allow" usage:"CIDR ranges clients may connect from. Empty allows all addresses not denied."`
+	Deny           []string `yaml:"deny" json:"deny" usage:"CIDR ranges clients may not connect from. Checked before allow."`
+}
+
+// MessageRateLimitConfig is a token bucket limiting how often each session may send one type of message
+type MessageRateLimitConfig struct {
+	Rate  float64 `yaml:"rate" json:"rate" usage:"Messages per second a session may send on average."`
+	Burst int     `yaml:"burst" json:"burst" usage:"Messages a session may send in a row before it is held to the rate."`
+}
+
 // DatabaseConfig is configuration relevant to the Database storage
 type DatabaseConfig struct {
 	Addresses         []string `yaml:"address" json:"address" usage:"List of CockroachDB servers (username:password@address:port/dbname)"`
@@ -267,12 +528,33 @@ func NewDatabaseConfig() *DatabaseConfig {
 type SocialConfig struct {
 	Notification *NotificationConfig `yaml:"notification" json:"notification" usage:"Notification configuration"`
 	Steam        *SocialConfigSteam  `yaml:"steam" json:"steam" usage:"Steam configuration"`
+	Apple        *SocialConfigApple  `yaml:"apple" json:"apple" usage:"Apple configuration"`
+	OIDC         *SocialConfigOIDC   `yaml:"oidc" json:"oidc" usage:"OpenID Connect configuration"`
+	Group        *GroupConfig        `yaml:"group" json:"group" usage:"Group configuration"`
+	Chat         *ChatConfig         `yaml:"chat" json:"chat" usage:"Chat configuration"`
+	Deletion     *DeletionConfig     `yaml:"deletion" json:"deletion" usage:"Account deletion configuration"`
 }
 
 // SocialConfigSteam is configuration relevant to Steam
 type SocialConfigSteam struct {
-	PublisherKey string `yaml:"publisher_key" json:"publisher_key" usage:"Steam Publisher Key value."`
-	AppID        int    `yaml:"app_id" json:"app_id" usage:"Steam App ID."`
+	PublisherKey  string `yaml:"publisher_key" json:"publisher_key" usage:"Steam Publisher Key value."`
+	AppID         int    `yaml:"app_id" json:"app_id" usage:"Steam App ID. Session tickets must be issued for this app."`
+	ImportFriends bool   `yaml:"import_friends" json:"import_friends" usage:"Add Steam friends who also play as friends when a user registers with or links Steam. Only public friend lists can be read."`
+}
+
+// SocialConfigApple is configuration relevant to Sign in with Apple
+type SocialConfigApple struct {
+	BundleID string `yaml:"bundle_id" json:"bundle_id" usage:"App bundle ID or services ID that Apple identity tokens must be issued to."`
+}
+
+// SocialConfigOIDC is configuration relevant to OpenID Connect authentication against an external identity provider.
+// Identities are stored as custom IDs, so clients should not also be able to authenticate with custom IDs directly.
+type SocialConfigOIDC struct {
+	Issuer      string `yaml:"issuer" json:"issuer" usage:"Issuer that ID tokens must be issued by. OpenID Connect authentication is disabled if empty."`
+	JwksURL     string `yaml:"jwks_url" json:"jwks_url" usage:"URL of the JSON Web Key Set that ID tokens are signed with."`
+	Audience    string `yaml:"audience" json:"audience" usage:"Client ID that ID tokens must be issued to."`
+	IDClaim     string `yaml:"id_claim" json:"id_claim" usage:"Claim used as the user's custom ID. Default 'sub'."`
+	HandleClaim string `yaml:"handle_claim" json:"handle_claim" usage:"Claim used as the handle of new users, if it is not already taken. Default 'name'."`
 }
 
 // NotificationConfig is configuration relevant to notification center
@@ -280,6 +562,30 @@ type NotificationConfig struct {
 	ExpiryMs int64 `yaml:"expiry_ms" json:"expiry_ms" usage:"Notification expiry in milliseconds."`
 }
 
+// GroupConfig is configuration relevant to groups
+type GroupConfig struct {
+	RejoinCooldownMs int64 `yaml:"rejoin_cooldown_ms" json:"rejoin_cooldown_ms" usage:"Time in milliseconds a user must wait before rejoining a group they left or were kicked from. Set to 0 to disable."`
+	InviteExpiryMs   int64 `yaml:"invite_expiry_ms" json:"invite_expiry_ms" usage:"Time in milliseconds a group invitation remains valid."`
+}
+
+// ChatConfig is configuration relevant to chat topics
+type ChatConfig struct {
+	RetentionMs           int64    `yaml:"retention_ms" json:"retention_ms" usage:"Time in milliseconds messages are kept in topic history. Set to 0 to keep messages indefinitely."`
+	FilterWords           []string `yaml:"filter_words" json:"filter_words" usage:"Words not allowed in chat messages, matched as whole words ignoring case."`
+	FilterPatterns        []string `yaml:"filter_patterns" json:"filter_patterns" usage:"Regular expressions not allowed in chat messages."`
+	FilterMask            bool     `yaml:"filter_mask" json:"filter_mask" usage:"Replace filtered content with asterisks instead of rejecting the message."`
+	MaxAttachments        int      `yaml:"max_attachments" json:"max_attachments" usage:"Maximum number of storage records that may be attached to a chat message. Set to 0 to disallow attachments. Default 4."`
+	ExpirySweepIntervalMs int64    `yaml:"expiry_sweep_interval_ms" json:"expiry_sweep_interval_ms" usage:"Time in milliseconds between removals of messages past the retention window."`
+	ExpirySweepBatchSize  int      `yaml:"expiry_sweep_batch_size" json:"expiry_sweep_batch_size" usage:"Maximum number of expired messages removed in each batch."`
+}
+
+// DeletionConfig is configuration relevant to users deleting their accounts
+type DeletionConfig struct {
+	GraceMs         int64 `yaml:"grace_ms" json:"grace_ms" usage:"Time in milliseconds a deleted account is kept, disabled and hidden, before it is erased. It can be restored from the runtime until then. Default 2592000000."`
+	SweepIntervalMs int64 `yaml:"sweep_interval_ms" json:"sweep_interval_ms" usage:"Time in milliseconds between erasures of deleted accounts past their grace period."`
+	SweepBatchSize  int   `yaml:"sweep_batch_size" json:"sweep_batch_size" usage:"Maximum number of accounts, and of rows of each kind they own, removed in each batch."`
+}
+
 // NewSocialConfig creates a new SocialConfig struct
 func NewSocialConfig() *SocialConfig {
 	return &SocialConfig{
@@ -287,17 +593,92 @@ func NewSocialConfig() *SocialConfig {
 			PublisherKey: "",
 			AppID:        0,
 		},
+		Apple: &SocialConfigApple{
+			BundleID: "",
+		},
+		OIDC: &SocialConfigOIDC{
+			IDClaim:     "sub",
+			HandleClaim: "name",
+		},
 		Notification: &NotificationConfig{
 			ExpiryMs: 86400000, // one day expiry
 		},
+		Group: &GroupConfig{
+			RejoinCooldownMs: 0,
+			InviteExpiryMs:   604800000, // one week expiry
+		},
+		Chat: &ChatConfig{
+			RetentionMs:           0,
+			FilterWords:           []string{},
+			FilterPatterns:        []string{},
+			FilterMask:            false,
+			MaxAttachments:        4,
+			ExpirySweepIntervalMs: 60000,
+			ExpirySweepBatchSize:  1000,
+		},
+		Deletion: &DeletionConfig{
+			GraceMs:         2592000000, // 30 days
+			SweepIntervalMs: 3600000,
+			SweepBatchSize:  1000,
+		},
 	}
 }
 
 // RuntimeConfig is configuration relevant to the Runtime Lua VM
 type RuntimeConfig struct {
-	Environment map[string]interface{} `yaml:"env" json:"env"` // not supported in FlagOverrides
-	Path        string                 `yaml:"path" json:"path" usage:"Path of modules for the server to scan."`
-	HTTPKey     string                 `yaml:"http_key" json:"http_key" usage:"Runtime HTTP Invocation key"`
+	Environment      map[string]interface{}   `yaml:"env" json:"env"` // not supported in FlagOverrides
+	Path             string                   `yaml:"path" json:"path" usage:"Path of modules for the server to scan."`
+	HTTPKey          string                   `yaml:"http_key" json:"http_key" usage:"Runtime HTTP Invocation key"`
+	ServerKeys       map[string]string        `yaml:"server_keys" json:"server_keys"` // not supported in FlagOverrides
+	HTTPClient       *RuntimeHTTPClientConfig `yaml:"http_client" json:"http_client" usage:"Settings for HTTP requests made by runtime modules"`
+	Cache            *RuntimeCacheConfig      `yaml:"cache" json:"cache" usage:"Settings for the in-memory cache shared by runtime modules"`
+	Task             *RuntimeTaskConfig       `yaml:"task" json:"task" usage:"Settings for deferred tasks enqueued by runtime modules"`
+	SQL              *RuntimeSQLConfig        `yaml:"sql" json:"sql" usage:"Settings for SQL queries made by runtime modules"`
+	Limits           *RuntimeLimitsConfig     `yaml:"limits" json:"limits" usage:"Limits on the resources a single runtime function invocation may use"`
+	ReloadIntervalMs int64                    `yaml:"reload_interval_ms" json:"reload_interval_ms" usage:"Time in milliseconds between checks for changed Lua modules, which are reloaded when found. Default 0, which disables checking."`
+}
+
+// RuntimeSQLConfig is configuration relevant to SQL queries runtime modules make against the database
+type RuntimeSQLConfig struct {
+	MaxRows   int   `yaml:"max_rows" json:"max_rows" usage:"Maximum number of rows a query may return. Queries returning more fail. Default 1000."`
+	TimeoutMs int64 `yaml:"timeout_ms" json:"timeout_ms" usage:"Time in milliseconds a statement may run before it is cancelled. Default 5000."`
+}
+
+// RuntimeLimitsConfig is configuration relevant to bounding the resources used by runtime function invocations
+type RuntimeLimitsConfig struct {
+	MaxExecutionMs  int64 `yaml:"max_execution_ms" json:"max_execution_ms" usage:"Time in milliseconds a hook, RPC or other function invocation may run before it is aborted, including time spent waiting on the server. 0 disables the limit. Default 10000."`
+	MaxInstructions int64 `yaml:"max_instructions" json:"max_instructions" usage:"Number of Lua instructions an invocation may execute before it is aborted. 0 disables the limit. Default 100000000."`
+	MaxLibraryBytes int64 `yaml:"max_library_bytes" json:"max_library_bytes" usage:"Bytes of strings and table entries an invocation may create by calling string and table library functions before it is aborted. This is not a memory limit, the .. operator, table constructors and assignments are not counted. 0 disables the limit. Default 67108864."`
+	CallStackSize   int   `yaml:"call_stack_size" json:"call_stack_size" usage:"Maximum depth of nested Lua function calls. Default 1024."`
+	RegistrySize    int   `yaml:"registry_size" json:"registry_size" usage:"Size of the Lua value stack. Together with the call stack size this bounds the memory used by the stack. Default 1024."`
+}
+
+// RuntimeTaskConfig is configuration relevant to running deferred tasks enqueued by runtime modules
+type RuntimeTaskConfig struct {
+	Workers        int   `yaml:"workers" json:"workers" usage:"Number of tasks each node runs at the same time. Default 4."`
+	PollIntervalMs int64 `yaml:"poll_interval_ms" json:"poll_interval_ms" usage:"Time in milliseconds between checks for due tasks. Default 1000."`
+	BatchSize      int   `yaml:"batch_size" json:"batch_size" usage:"Maximum number of due tasks picked up in each check. Default 100."`
+	MaxAttempts    int   `yaml:"max_attempts" json:"max_attempts" usage:"Number of times a task is tried before it is kept aside as a dead letter. Default 5."`
+	RetryBackoffMs int64 `yaml:"retry_backoff_ms" json:"retry_backoff_ms" usage:"Time in milliseconds before a failed task is tried again, doubled after each further failure. Default 5000."`
+	LeaseMs        int64 `yaml:"lease_ms" json:"lease_ms" usage:"Time in milliseconds a node has to finish a task before other nodes may try it. Default 60000."`
+}
+
+// RuntimeCacheConfig is configuration relevant to the in-memory cache shared by runtime modules
+type RuntimeCacheConfig struct {
+	MaxEntries   int   `yaml:"max_entries" json:"max_entries" usage:"Maximum number of values kept. The least recently used values are evicted to make room. Default 10000."`
+	DefaultTTLMs int64 `yaml:"default_ttl_ms" json:"default_ttl_ms" usage:"Time in milliseconds values are kept when the module does not give one. Default 60000."`
+}
+
+// RuntimeHTTPClientConfig is configuration relevant to HTTP requests runtime modules make to external services
+type RuntimeHTTPClientConfig struct {
+	TimeoutMs           int64  `yaml:"timeout_ms" json:"timeout_ms" usage:"Time in milliseconds allowed for a request, including reading the response, when the module does not give one."`
+	MaxTimeoutMs        int64  `yaml:"max_timeout_ms" json:"max_timeout_ms" usage:"Longest time in milliseconds a module may allow for a request."`
+	MaxResponseBytes    int64  `yaml:"max_response_bytes" json:"max_response_bytes" usage:"Maximum size of a response body. Larger responses fail the request."`
+	MaxIdleConns        int    `yaml:"max_idle_conns" json:"max_idle_conns" usage:"Maximum number of idle connections kept open across all hosts."`
+	MaxIdleConnsPerHost int    `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host" usage:"Maximum number of idle connections kept open to each host."`
+	IdleConnTimeoutMs   int64  `yaml:"idle_conn_timeout_ms" json:"idle_conn_timeout_ms" usage:"Time in milliseconds an idle connection is kept open before it is closed."`
+	CACertFile          string `yaml:"ca_cert_file" json:"ca_cert_file" usage:"Path of a PEM file of certificate authorities to trust in addition to the system ones."`
+	InsecureSkipVerify  bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify" usage:"Do not verify server certificates. Only for development."`
 }
 
 // NewRuntimeConfig creates a new RuntimeConfig struct
@@ -306,6 +687,41 @@ func NewRuntimeConfig() *RuntimeConfig {
 		Environment: make(map[string]interface{}),
 		Path:        "",
 		HTTPKey:     "defaultkey",
+		ServerKeys:  make(map[string]string),
+		HTTPClient: &RuntimeHTTPClientConfig{
+			TimeoutMs:           5000,
+			MaxTimeoutMs:        30000,
+			MaxResponseBytes:    4194304, // 4 MB
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeoutMs:   90000,
+			CACertFile:          "",
+			InsecureSkipVerify:  false,
+		},
+		Cache: &RuntimeCacheConfig{
+			MaxEntries:   10000,
+			DefaultTTLMs: 60000,
+		},
+		Task: &RuntimeTaskConfig{
+			Workers:        4,
+			PollIntervalMs: 1000,
+			BatchSize:      100,
+			MaxAttempts:    5,
+			RetryBackoffMs: 5000,
+			LeaseMs:        60000,
+		},
+		SQL: &RuntimeSQLConfig{
+			MaxRows:   1000,
+			TimeoutMs: 5000,
+		},
+		Limits: &RuntimeLimitsConfig{
+			MaxExecutionMs:  10000,
+			MaxInstructions: 100000000,
+			MaxLibraryBytes: 67108864, // 64 MB
+			CallStackSize:   1024,
+			RegistrySize:    1024,
+		},
+		ReloadIntervalMs: 0,
 	}
 }
 
@@ -334,3 +750,218 @@ type GooglePurchaseProviderConfig struct {
 	ServiceKeyFilePath string `yaml:"service_key_file" json:"service_key_file" usage:"Absolute file path to the service key JSON file."`
 	TimeoutMs          int    `yaml:"timeout_ms" json:"timeout_ms" usage:"Google connection timeout in milliseconds"`
 }
+
+// LeaderboardConfig is configuration relevant to leaderboards
+type LeaderboardConfig struct {
+	RankCache           bool  `yaml:"rank_cache" json:"rank_cache" usage:"Keep an in-memory rank index of active leaderboards for exact ranks. Default true."`
+	RankCacheMaxRecords int64 `yaml:"rank_cache_max_records" json:"rank_cache_max_records" usage:"Leaderboards with more records than this are not kept in the rank index. 0 for no limit. Default 1000000."`
+}
+
+// NewLeaderboardConfig creates a new LeaderboardConfig struct
+func NewLeaderboardConfig() *LeaderboardConfig {
+	return &LeaderboardConfig{
+		RankCache:           true,
+		RankCacheMaxRecords: 1000000,
+	}
+}
+
+// MatchmakerConfig is configuration relevant to the matchmaker
+type MatchmakerConfig struct {
+	TicketTimeoutSec   int64  `yaml:"ticket_timeout_sec" json:"ticket_timeout_sec" usage:"Matchmaking tickets not matched within this many seconds are removed. Clients may ask for a shorter timeout. 0 for no timeout. Default 300."`
+	MaxRttSpreadMs     int64  `yaml:"max_rtt_spread_ms" json:"max_rtt_spread_ms" usage:"Users are only matched in a region where the difference between their best and worst reported round trip times is at most this many milliseconds. 0 for no limit. Default 100."`
+	AllocatorUrl       string `yaml:"allocator_url" json:"allocator_url" usage:"Fleet manager endpoint asked to allocate a dedicated game server for each new match made by the matchmaker. Empty to always use relayed matches."`
+	AllocatorKey       string `yaml:"allocator_key" json:"allocator_key" usage:"Sent to the fleet manager as a bearer token, if set."`
+	AllocatorTimeoutMs int64  `yaml:"allocator_timeout_ms" json:"allocator_timeout_ms" usage:"Timeout in milliseconds of each dedicated game server allocation request. Default 5000."`
+	AllocatorRetries   int    `yaml:"allocator_retries" json:"allocator_retries" usage:"Number of times a failed dedicated game server allocation is retried before falling back to a relayed match. Default 2."`
+}
+
+// NewMatchmakerConfig creates a new MatchmakerConfig struct
+func NewMatchmakerConfig() *MatchmakerConfig {
+	return &MatchmakerConfig{
+		TicketTimeoutSec:   300,
+		MaxRttSpreadMs:     100,
+		AllocatorTimeoutMs: 5000,
+		AllocatorRetries:   2,
+	}
+}
+
+// MatchConfig is configuration relevant to matches
+type MatchConfig struct {
+	HostRejoinGraceSec    int64 `yaml:"host_rejoin_grace_sec" json:"host_rejoin_grace_sec" usage:"Seconds the host of a relayed match has to rejoin after disconnecting before a new host is elected. 0 to elect a new host straight away. Default 10."`
+	DataMaxSizeBytes      int64 `yaml:"data_max_size_bytes" json:"data_max_size_bytes" usage:"Maximum size in bytes of the data payload in a single match data message. Default 4096."`
+	DataRateLimit         int64 `yaml:"data_rate_limit" json:"data_rate_limit" usage:"Maximum number of match data messages each presence may send to a match per second. Default 30."`
+	DataMaxWarnings       int64 `yaml:"data_max_warnings" json:"data_max_warnings" usage:"Number of rejected match data messages after which the session is disconnected. 0 to never disconnect. Default 10."`
+	DataWarningResetSec   int64 `yaml:"data_warning_reset_sec" json:"data_warning_reset_sec" usage:"Seconds a session must go without a rejected match data message for its warnings to be reset. 0 to never reset. Default 60."`
+	LabelMaxSizeBytes     int64 `yaml:"label_max_size_bytes" json:"label_max_size_bytes" usage:"Maximum size in bytes of a match label. Default 2048."`
+	ReplayMaxFrames       int64 `yaml:"replay_max_frames" json:"replay_max_frames" usage:"Maximum number of frames recorded in a match replay, after which recording stops. 0 for no limit. Default 100000."`
+	TurnTimeoutSec        int64 `yaml:"turn_timeout_sec" json:"turn_timeout_sec" usage:"Seconds users have to move in a turn-based match before they forfeit, unless the match sets its own timeout. 0 for no limit. Default 86400."`
+	TurnMaxUsers          int64 `yaml:"turn_max_users" json:"turn_max_users" usage:"Maximum number of users in a turn-based match. Default 8."`
+	TurnStateMaxSizeBytes int64 `yaml:"turn_state_max_size_bytes" json:"turn_state_max_size_bytes" usage:"Maximum size in bytes of a turn-based match state. Default 16384."`
+}
+
+// NewMatchConfig creates a new MatchConfig struct
+func NewMatchConfig() *MatchConfig {
+	return &MatchConfig{
+		HostRejoinGraceSec:    10,
+		DataMaxSizeBytes:      4096,
+		DataRateLimit:         30,
+		DataMaxWarnings:       10,
+		DataWarningResetSec:   60,
+		LabelMaxSizeBytes:     2048,
+		ReplayMaxFrames:       100000,
+		TurnTimeoutSec:        86400,
+		TurnMaxUsers:          8,
+		TurnStateMaxSizeBytes: 16384,
+	}
+}
+
+// StorageConfig is configuration relevant to the storage engine
+type StorageConfig struct {
+	Indexes               []*StorageIndexConfig       `yaml:"indexes" json:"indexes" usage:"Fields of objects in storage collections that listings can filter and sort on."` // not supported in FlagOverrides
+	ExpirySweepIntervalMs int64                       `yaml:"expiry_sweep_interval_ms" json:"expiry_sweep_interval_ms" usage:"Time in milliseconds between removals of expired storage records."`
+	ExpirySweepBatchSize  int                         `yaml:"expiry_sweep_batch_size" json:"expiry_sweep_batch_size" usage:"Maximum number of expired storage records removed in each batch."`
+	UploadMaxSizeBytes    int64                       `yaml:"upload_max_size_bytes" json:"upload_max_size_bytes" usage:"Maximum size in bytes of a storage value uploaded in chunks. Cannot be more than 4194304."`
+	UploadLimits          []*StorageUploadLimitConfig `yaml:"upload_limits" json:"upload_limits" usage:"Maximum size in bytes of storage values uploaded in chunks to specific collections."` // not supported in FlagOverrides
+	UploadUserQuotaBytes  int64                       `yaml:"upload_user_quota_bytes" json:"upload_user_quota_bytes" usage:"Maximum combined size in bytes of the unfinished uploads of a user."`
+	UploadExpiryMs        int64                       `yaml:"upload_expiry_ms" json:"upload_expiry_ms" usage:"Time in milliseconds after which unfinished uploads are discarded."`
+	UserQuotaBytes        int64                       `yaml:"user_quota_bytes" json:"user_quota_bytes" usage:"Maximum combined size in bytes of the values of records a user owns, unless set for the user by the script runtime. 0 for no quota."`
+	Schemas               []*StorageSchemaConfig      `yaml:"schemas" json:"schemas" usage:"JSON Schemas that values written to storage collections must match."` // not supported in FlagOverrides
+}
+
+// NewStorageConfig creates a new StorageConfig struct
+func NewStorageConfig() *StorageConfig {
+	return &StorageConfig{
+		Indexes:               []*StorageIndexConfig{},
+		ExpirySweepIntervalMs: 60000,
+		ExpirySweepBatchSize:  1000,
+		UploadMaxSizeBytes:    1048576,
+		UploadLimits:          []*StorageUploadLimitConfig{},
+		UploadUserQuotaBytes:  4194304,
+		UploadExpiryMs:        3600000,
+		Schemas:               []*StorageSchemaConfig{},
+	}
+}
+
+// StorageIndexConfig declares indexed fields of the objects in one storage collection.
+type StorageIndexConfig struct {
+	Bucket     string   `yaml:"bucket" json:"bucket"`
+	Collection string   `yaml:"collection" json:"collection"`
+	Fields     []string `yaml:"fields" json:"fields"` // Dot separated paths to string or number fields.
+}
+
+// StorageSchemaConfig declares the JSON Schema that values written to one storage collection must match.
+type StorageSchemaConfig struct {
+	Bucket     string `yaml:"bucket" json:"bucket"`
+	Collection string `yaml:"collection" json:"collection"`
+	Schema     string `yaml:"schema" json:"schema"` // The schema as JSON text.
+}
+
+// StorageUploadLimitConfig overrides the maximum size of values uploaded in chunks to one storage collection.
+type StorageUploadLimitConfig struct {
+	Bucket       string `yaml:"bucket" json:"bucket"`
+	Collection   string `yaml:"collection" json:"collection"`
+	MaxSizeBytes int64  `yaml:"max_size_bytes" json:"max_size_bytes"`
+}
+
+// MailConfig is configuration relevant to sending email, such as address verification and password reset links
+type MailConfig struct {
+	SMTPAddress     string `yaml:"smtp_address" json:"smtp_address" usage:"Address of the SMTP server (host:port). Email is not sent if not set."`
+	Username        string `yaml:"username" json:"username" usage:"Username to authenticate with the SMTP server, if any."`
+	Password        string `yaml:"password" json:"password" usage:"Password to authenticate with the SMTP server."`
+	From            string `yaml:"from" json:"from" usage:"Sender address of email from the server."`
+	VerificationURL string `yaml:"verification_url" json:"verification_url" usage:"Link sent to verify an email address, where {token} is replaced with the verification token."`
+	ResetURL        string `yaml:"reset_url" json:"reset_url" usage:"Link sent to reset a password, where {token} is replaced with the reset token."`
+}
+
+// NewMailConfig creates a new MailConfig struct
+func NewMailConfig() *MailConfig {
+	return &MailConfig{
+		SMTPAddress:     "",
+		Username:        "",
+		Password:        "",
+		From:            "",
+		VerificationURL: "",
+		ResetURL:        "",
+	}
+}
+
+// ClusterConfig is configuration relevant to running several nodes as one deployment
+type ClusterConfig struct {
+	Port             int               `yaml:"port" json:"port" usage:"The port nodes exchange membership, presences and messages on. 0 runs the node on its own. Default 0."`
+	Address          string            `yaml:"address" json:"address" usage:"Host and port other nodes reach this node's cluster port at. Defaults to the first non-loopback address and the cluster port."`
+	Seeds            []string          `yaml:"seeds" json:"seeds" usage:"Host and port of the cluster port of nodes to join the cluster through."`
+	Secret           string            `yaml:"secret" json:"secret" usage:"Key nodes present to each other. Must be the same on every node."`
+	GossipIntervalMs int               `yaml:"gossip_interval_ms" json:"gossip_interval_ms" usage:"Milliseconds between membership exchanges with another node. Default 1000."`
+	NodeTimeoutMs    int               `yaml:"node_timeout_ms" json:"node_timeout_ms" usage:"Milliseconds without news of a node before it is removed from the cluster, along with its presences. Default 10000."`
+	Bus              *MessageBusConfig `yaml:"bus" json:"bus" usage:"Broker nodes exchange membership, presences and messages through instead of the cluster port"`
+}
+
+// MessageBusConfig is configuration relevant to connecting cluster nodes through an external broker
+type MessageBusConfig struct {
+	Backend      string `yaml:"backend" json:"backend" usage:"Broker to use, 'nats' or 'redis' for Redis Streams. Empty connects nodes directly through the cluster port."`
+	Address      string `yaml:"address" json:"address" usage:"Host and port of the broker."`
+	Password     string `yaml:"password" json:"password" usage:"Token to authenticate with NATS, or password to authenticate with Redis. Nothing is sent if empty."`
+	Prefix       string `yaml:"prefix" json:"prefix" usage:"Prefix of NATS subjects and Redis stream keys, so several deployments can share a broker. Default 'nakama'."`
+	StreamMaxLen int    `yaml:"stream_max_len" json:"stream_max_len" usage:"Approximate number of entries Redis keeps in each stream. Default 10000."`
+}
+
+// NewClusterConfig creates a new ClusterConfig struct
+func NewClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		Port:             0,
+		Address:          "",
+		Seeds:            []string{},
+		Secret:           "defaultclustersecret",
+		GossipIntervalMs: 1000,
+		NodeTimeoutMs:    10000,
+		Bus: &MessageBusConfig{
+			Backend:      "",
+			Address:      "",
+			Password:     "",
+			Prefix:       "nakama",
+			StreamMaxLen: 10000,
+		},
+	}
+}
+
+// MetricsConfig is configuration relevant to metrics exposed for Prometheus to scrape
+type MetricsConfig struct {
+	Enabled          bool      `yaml:"enabled" json:"enabled" usage:"Expose metrics in the Prometheus text format at /metrics on the dashboard port."`
+	Namespace        string    `yaml:"namespace" json:"namespace" usage:"Prefix of every metric name. Default 'nakama'."`
+	MessageTypes     []string  `yaml:"message_types" json:"message_types" usage:"Message types, by runtime hook message names, to label message metrics with. Other types are counted together as 'other'. Empty labels every type."`
+	MaxLabelValues   int       `yaml:"max_label_values" json:"max_label_values" usage:"Most distinct values of a label on one metric. Further values are counted together as 'other'. Default 100."`
+	LatencyBucketsMs []float64 `yaml:"latency_buckets_ms" json:"latency_buckets_ms" usage:"Upper bounds in milliseconds of the buckets of message and database query latency histograms."`
+}
+
+// NewMetricsConfig creates a new MetricsConfig struct
+func NewMetricsConfig() *MetricsConfig {
+	return &MetricsConfig{
+		Enabled:          false,
+		Namespace:        "nakama",
+		MessageTypes:     []string{},
+		MaxLabelValues:   100,
+		LatencyBucketsMs: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500},
+	}
+}
+
+// TracingConfig is configuration relevant to tracing requests through the server with OpenTelemetry
+type TracingConfig struct {
+	Endpoint         string  `yaml:"endpoint" json:"endpoint" usage:"OTLP/HTTP endpoint spans are exported to as JSON, such as http://localhost:4318/v1/traces on an OpenTelemetry collector or Jaeger. Tracing is off if empty."`
+	ServiceName      string  `yaml:"service_name" json:"service_name" usage:"Service name spans are reported under. Default 'nakama'."`
+	SampleRate       float64 `yaml:"sample_rate" json:"sample_rate" usage:"Fraction of received messages traced, between 0 and 1. Default 0.1."`
+	BatchSize        int     `yaml:"batch_size" json:"batch_size" usage:"Most spans exported in one request. Default 512."`
+	QueueSize        int     `yaml:"queue_size" json:"queue_size" usage:"Most finished spans waiting to be exported. Further spans are dropped. Default 4096."`
+	ExportIntervalMs int     `yaml:"export_interval_ms" json:"export_interval_ms" usage:"Longest time in milliseconds finished spans wait before being exported. Default 2000."`
+}
+
+// NewTracingConfig creates a new TracingConfig struct
+func NewTracingConfig() *TracingConfig {
+	return &TracingConfig{
+		Endpoint:         "",
+		ServiceName:      "nakama",
+		SampleRate:       0.1,
+		BatchSize:        512,
+		QueueSize:        4096,
+		ExportIntervalMs: 2000,
+	}
+}
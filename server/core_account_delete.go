@@ -0,0 +1,298 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// accountEraseBatches remove everything else an erased account owns, a batch at a time so large accounts do not hold
+// long transactions. Each deletes rows of the table whose key is in the first batch matching the condition, with the
+// user as $1 and the batch size as $2. Messages, group history, purchases and bans are kept.
+var accountEraseBatches = []struct {
+	table     string
+	key       string
+	condition string
+}{
+	{"user_edge", "source_id, destination_id", "source_id = $1"},
+	{"storage_acl", "storage_id, grantee_id", "storage_id IN (SELECT id FROM storage WHERE user_id = $1)"},
+	{"storage_acl", "storage_id, grantee_id", "grantee_id = $1 AND is_group = FALSE"},
+	{"storage_index", "bucket, collection, user_id, record, field", "user_id = $1"},
+	{"storage", "bucket, collection, user_id, record, deleted_at", "user_id = $1"},
+	{"storage_upload", "id", "user_id = $1"},
+	{"notification", "id", "user_id = $1"},
+	{"leaderboard_record_archive", "id", "owner_id = $1"},
+	{"leaderboard_submit_rate", "leaderboard_id, owner_id", "owner_id = $1"},
+	{"topic_read", "user_id, topic_type, topic", "user_id = $1"},
+	{"group_invite", "group_id, user_id", "user_id = $1"},
+	{"group_cooldown", "group_id, user_id", "user_id = $1"},
+	{"user_device", "id", "user_id = $1"},
+	{"auth_history", "user_id, created_at, id", "user_id = $1"},
+}
+
+// AccountDelete schedules the user's account for deletion. It is disabled and hidden from other users straight away,
+// and erased by the AccountDeletionSweeper once the grace period has passed. Until then it can be restored with
+// AccountDeleteCancel.
+func AccountDelete(logger *zap.Logger, db *sql.DB, userID uuid.UUID) (Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not delete account, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not delete account")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not delete account, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	var deletedAt int64
+	if err = tx.QueryRow("SELECT deleted_at FROM users WHERE id = $1", userID.Bytes()).Scan(&deletedAt); err == sql.ErrNoRows {
+		return USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not delete account, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not delete account")
+	}
+	if deletedAt != 0 {
+		err = errors.New("Account is already scheduled for deletion")
+		return BAD_INPUT, err
+	}
+
+	// Disabling the user sends their authentication attempts through the ban check, which turns them away.
+	ts := nowMs()
+	if _, err = tx.Exec("UPDATE users SET deleted_at = $2, disabled_at = $2, updated_at = $2 WHERE id = $1", userID.Bytes(), ts); err != nil {
+		logger.Error("Could not delete account, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not delete account")
+	}
+	for _, statement := range []string{
+		"DELETE FROM user_refresh_token WHERE user_id = $1",
+		"DELETE FROM user_email_token WHERE user_id = $1",
+	} {
+		if _, err = tx.Exec(statement, userID.Bytes()); err != nil {
+			logger.Error("Could not delete account, token error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not delete account")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not delete account, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not delete account")
+	}
+
+	logger.Info("Scheduled account deletion", zap.String("user_id", userID.String()))
+	return 0, nil
+}
+
+// AccountDeleteCancel restores an account scheduled for deletion that has not been erased yet. The user stays
+// disabled if they are also banned.
+func AccountDeleteCancel(logger *zap.Logger, db *sql.DB, userID uuid.UUID) (Error_Code, error) {
+	res, err := db.Exec(`
+UPDATE users SET deleted_at = 0, updated_at = $2,
+disabled_at = CASE WHEN EXISTS (
+	SELECT user_id FROM user_ban WHERE user_id = $1 AND lifted_at = 0 AND (expires_at = 0 OR expires_at > $2)
+) THEN disabled_at ELSE 0 END
+WHERE id = $1 AND deleted_at > 0`, userID.Bytes(), nowMs())
+	if err != nil {
+		logger.Error("Could not cancel account deletion", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not cancel account deletion")
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return BAD_INPUT, errors.New("Account is not scheduled for deletion")
+	}
+
+	logger.Info("Cancelled account deletion", zap.String("user_id", userID.String()))
+	return 0, nil
+}
+
+// accountErase removes an account scheduled for deletion and what it owns. Work is committed in batches, so an
+// interrupted erasure is picked up again from where it stopped, and the user row goes last.
+func accountErase(db *sql.DB, rankCache *LeaderboardRankCache, userID []byte, batchSize int) error {
+	if err := accountEraseGroups(db, userID); err != nil {
+		return err
+	}
+
+	// Friends lose their edge to the user along with a friend from their count.
+	for {
+		count := 0
+		err := accountEraseTx(db, func(tx *sql.Tx) error {
+			rows, err := tx.Query(`
+DELETE FROM user_edge WHERE (source_id, destination_id) IN (
+	SELECT source_id, destination_id FROM user_edge WHERE destination_id = $1 LIMIT $2
+)
+RETURNING source_id`, userID, batchSize)
+			if err != nil {
+				return err
+			}
+			sourceIDs := make([][]byte, 0)
+			for rows.Next() {
+				var sourceID []byte
+				if err = rows.Scan(&sourceID); err != nil {
+					rows.Close()
+					return err
+				}
+				sourceIDs = append(sourceIDs, sourceID)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return err
+			}
+
+			ts := nowMs()
+			for _, sourceID := range sourceIDs {
+				if _, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", sourceID, ts); err != nil {
+					return err
+				}
+			}
+			count = len(sourceIDs)
+			return nil
+		})
+		if err != nil {
+			return err
+		} else if count < batchSize {
+			break
+		}
+	}
+
+	// Leaderboard records leave the rank cache as they go.
+	for {
+		rows, err := db.Query(`
+DELETE FROM leaderboard_record WHERE id IN (SELECT id FROM leaderboard_record WHERE owner_id = $1 LIMIT $2)
+RETURNING leaderboard_id, expires_at`, userID, batchSize)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for rows.Next() {
+			var leaderboardID []byte
+			var expiresAt int64
+			if err = rows.Scan(&leaderboardID, &expiresAt); err != nil {
+				rows.Close()
+				return err
+			}
+			rankCache.Delete(leaderboardID, expiresAt, userID)
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		} else if count < batchSize {
+			break
+		}
+	}
+
+	for _, b := range accountEraseBatches {
+		query := "DELETE FROM " + b.table + " WHERE (" + b.key + ") IN (SELECT " + b.key + " FROM " + b.table + " WHERE " + b.condition + " LIMIT $2)"
+		for {
+			res, err := db.Exec(query, userID, batchSize)
+			if err != nil {
+				return err
+			}
+			if count, _ := res.RowsAffected(); count < int64(batchSize) {
+				break
+			}
+		}
+	}
+
+	return accountEraseTx(db, func(tx *sql.Tx) error {
+		for _, statement := range []string{
+			"DELETE FROM user_edge_metadata WHERE source_id = $1",
+			"DELETE FROM storage_usage WHERE user_id = $1",
+			"DELETE FROM user_refresh_token WHERE user_id = $1",
+			"DELETE FROM user_email_token WHERE user_id = $1",
+			"DELETE FROM user_mfa WHERE user_id = $1",
+			"DELETE FROM user_mfa_recovery WHERE user_id = $1",
+			"DELETE FROM users WHERE id = $1",
+		} {
+			if _, err := tx.Exec(statement, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// accountEraseGroups removes the user from their groups in one transaction, handing groups over to the next member in
+// line where they were the last admin.
+func accountEraseGroups(db *sql.DB, userID []byte) error {
+	return accountEraseTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT destination_id, state FROM group_edge WHERE source_id = $1", userID)
+		if err != nil {
+			return err
+		}
+		groupIDs := make([][]byte, 0)
+		states := make([]int64, 0)
+		for rows.Next() {
+			var groupID []byte
+			var state int64
+			if err = rows.Scan(&groupID, &state); err != nil {
+				rows.Close()
+				return err
+			}
+			groupIDs = append(groupIDs, groupID)
+			states = append(states, state)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		ts := nowMs()
+		for i, groupID := range groupIDs {
+			if _, err = tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID, userID); err != nil {
+				return err
+			}
+			// Join requests were never counted as members.
+			if states[i] == 2 {
+				continue
+			}
+			if _, err = tx.Exec("UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2", ts, groupID); err != nil {
+				return err
+			}
+			if err = groupHistoryAdd(tx, groupID, GROUP_HISTORY_LEAVE, nil, userID, nil, ts); err != nil {
+				return err
+			}
+			if _, _, err = groupAdminSuccession(tx, groupID, ts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// accountEraseTx runs part of an erasure in its own transaction.
+func accountEraseTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		if e := tx.Rollback(); e != nil {
+			return e
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// accountMergeRecord is a leaderboard record moved or removed by a merge, applied to the rank cache once committed.
+type accountMergeRecord struct {
+	leaderboardID []byte
+	expiresAt     int64
+	sortOrder     int64
+	recordID      []byte
+	score         int64
+	updatedAt     int64
+	numScore      int64
+	// moved is false when the source record lost to a better one the target already had.
+	moved bool
+}
+
+// accountMergeStatements move everything else the source account owns to the target, with the source as $1 and the
+// target as $2. Where both accounts hold the same thing the target's is kept, except for group membership where the
+// higher role wins.
+var accountMergeStatements = []string{
+	// Devices.
+	"UPDATE user_device SET user_id = $2 WHERE user_id = $1",
+
+	// Friends. Edges between the two accounts go, and the target's edge wins where both have one with the same user.
+	"DELETE FROM user_edge WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)",
+	`DELETE FROM user_edge WHERE source_id = $1
+AND destination_id IN (SELECT destination_id FROM user_edge WHERE source_id = $2)`,
+	`DELETE FROM user_edge WHERE destination_id = $1
+AND source_id IN (SELECT destination_id FROM user_edge WHERE source_id = $2)`,
+	"UPDATE user_edge SET source_id = $2 WHERE source_id = $1",
+	"UPDATE user_edge SET destination_id = $2 WHERE destination_id = $1",
+	"DELETE FROM user_edge_metadata WHERE source_id = $1",
+	// Recounted once everything has moved, the target may have lost its only edge.
+	"UPDATE user_edge_metadata SET count = 0 WHERE source_id = $2",
+
+	// Groups. Roles in groups both accounts belong to were settled beforehand.
+	"DELETE FROM group_edge WHERE source_id = $1 AND destination_id IN (SELECT destination_id FROM group_edge WHERE source_id = $2)",
+	"DELETE FROM group_edge WHERE destination_id = $1 AND source_id IN (SELECT destination_id FROM group_edge WHERE source_id = $2)",
+	"UPDATE group_edge SET source_id = $2 WHERE source_id = $1",
+	"UPDATE group_edge SET destination_id = $2 WHERE destination_id = $1",
+	"UPDATE groups SET creator_id = $2 WHERE creator_id = $1",
+	"DELETE FROM group_ban WHERE user_id = $1 AND group_id IN (SELECT group_id FROM group_ban WHERE user_id = $2)",
+	"UPDATE group_ban SET user_id = $2 WHERE user_id = $1",
+
+	// Storage. Live records the target also has are dropped with their grants and indexed fields, as are tombstones.
+	`DELETE FROM storage_acl WHERE storage_id IN (
+SELECT id FROM storage WHERE user_id = $1 AND (deleted_at > 0 OR (bucket, collection, record) IN (
+SELECT bucket, collection, record FROM storage WHERE user_id = $2 AND deleted_at = 0)))`,
+	`DELETE FROM storage_index WHERE user_id = $1 AND (bucket, collection, record) IN (
+SELECT bucket, collection, record FROM storage WHERE user_id = $2 AND deleted_at = 0)`,
+	`DELETE FROM storage WHERE user_id = $1 AND (deleted_at > 0 OR (bucket, collection, record) IN (
+SELECT bucket, collection, record FROM storage WHERE user_id = $2 AND deleted_at = 0))`,
+	"UPDATE storage SET user_id = $2 WHERE user_id = $1",
+	"UPDATE storage_index SET user_id = $2 WHERE user_id = $1",
+	"UPDATE storage_upload SET user_id = $2 WHERE user_id = $1",
+	"DELETE FROM storage_acl WHERE grantee_id = $1 AND storage_id IN (SELECT storage_id FROM storage_acl WHERE grantee_id = $2)",
+	"UPDATE storage_acl SET grantee_id = $2 WHERE grantee_id = $1 AND is_group = FALSE",
+	"DELETE FROM storage_usage WHERE user_id = $1",
+	`INSERT INTO storage_usage (user_id, bytes)
+SELECT $2::BYTEA, COALESCE(SUM(length(value)), 0) FROM storage WHERE user_id = $2 AND deleted_at = 0
+ON CONFLICT (user_id) DO UPDATE SET bytes = excluded.bytes`,
+
+	// Notifications, purchases and auth history.
+	"UPDATE notification SET user_id = $2 WHERE user_id = $1",
+	"DELETE FROM purchase WHERE user_id = $1 AND (provider, receipt_id) IN (SELECT provider, receipt_id FROM purchase WHERE user_id = $2)",
+	"UPDATE purchase SET user_id = $2 WHERE user_id = $1",
+	"UPDATE auth_history SET user_id = $2 WHERE user_id = $1",
+
+	// The source account itself. Its bans are kept for the audit trail.
+	"DELETE FROM user_email_token WHERE user_id = $1",
+	"DELETE FROM user_refresh_token WHERE user_id = $1",
+	"DELETE FROM user_mfa WHERE user_id = $1",
+	"DELETE FROM user_mfa_recovery WHERE user_id = $1",
+	"DELETE FROM users WHERE id = $1",
+}
+
+// AccountMerge folds the source account into the target in one transaction: credentials and devices, friends, groups,
+// storage, leaderboard records, notifications and purchases. The source account is removed. Where both accounts have
+// a credential of the same kind, or a record in the same leaderboard period, the target keeps its own credential and
+// the better of the two scores.
+func AccountMerge(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, target uuid.UUID, source uuid.UUID) (Error_Code, error) {
+	if target == source {
+		return BAD_INPUT, errors.New("Cannot merge an account into itself")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not merge accounts, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not merge accounts, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	var targetHandle string
+	var targetDisabledAt int64
+	if err = tx.QueryRow("SELECT handle, disabled_at FROM users WHERE id = $1", target.Bytes()).Scan(&targetHandle, &targetDisabledAt); err == sql.ErrNoRows {
+		return USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not merge accounts, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	var email, facebookID, googleID, gamecenterID, steamID, customID, appleID sql.NullString
+	var password []byte
+	var verifiedAt, disabledAt int64
+	err = tx.QueryRow(`
+SELECT email, password, facebook_id, google_id, gamecenter_id, steam_id, custom_id, apple_id, verified_at, disabled_at
+FROM users WHERE id = $1`, source.Bytes()).
+		Scan(&email, &password, &facebookID, &googleID, &gamecenterID, &steamID, &customID, &appleID, &verifiedAt, &disabledAt)
+	if err == sql.ErrNoRows {
+		return USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not merge accounts, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+	// Merging must not become a way around a ban.
+	if targetDisabledAt != 0 || disabledAt != 0 {
+		err = errors.New("User is banned")
+		return USER_BANNED, err
+	}
+
+	ts := nowMs()
+
+	// Credentials must be released by the source before the target can take them, they are unique across users.
+	if _, err = tx.Exec(`
+UPDATE users SET email = NULL, password = NULL, facebook_id = NULL, google_id = NULL, gamecenter_id = NULL,
+steam_id = NULL, custom_id = NULL, apple_id = NULL
+WHERE id = $1`, source.Bytes()); err != nil {
+		logger.Error("Could not merge accounts, credential error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+	// The email address and password move together, with the verification of the address.
+	if _, err = tx.Exec(`
+UPDATE users SET
+	password = CASE WHEN email IS NULL THEN $3 ELSE password END,
+	verified_at = CASE WHEN email IS NULL AND $2::VARCHAR IS NOT NULL THEN $4 ELSE verified_at END,
+	email = COALESCE(email, $2),
+	facebook_id = COALESCE(facebook_id, $5),
+	google_id = COALESCE(google_id, $6),
+	gamecenter_id = COALESCE(gamecenter_id, $7),
+	steam_id = COALESCE(steam_id, $8),
+	custom_id = COALESCE(custom_id, $9),
+	apple_id = COALESCE(apple_id, $10),
+	updated_at = $11
+WHERE id = $1`, target.Bytes(), email, password, verifiedAt, facebookID, googleID, gamecenterID, steamID, customID, appleID, ts); err != nil {
+		logger.Error("Could not merge accounts, credential error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	records, err := accountMergeLeaderboards(tx, target, source, targetHandle)
+	if err != nil {
+		logger.Error("Could not merge accounts, leaderboard error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	if err = accountMergeGroupRoles(tx, target, source); err != nil {
+		logger.Error("Could not merge accounts, group error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	for _, statement := range accountMergeStatements {
+		if _, err = tx.Exec(statement, source.Bytes(), target.Bytes()); err != nil {
+			logger.Error("Could not merge accounts, update error", zap.String("statement", statement), zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+		}
+	}
+
+	// Friend and member counts change for the target, its friends and its groups.
+	if err = accountMergeCounts(tx, target, ts); err != nil {
+		logger.Error("Could not merge accounts, count error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not merge accounts, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not merge accounts")
+	}
+
+	for _, r := range records {
+		rankCache.Delete(r.leaderboardID, r.expiresAt, source.Bytes())
+		if r.moved {
+			rankCache.Set(r.leaderboardID, r.expiresAt, r.sortOrder, target.Bytes(), r.recordID, r.score, r.updatedAt, r.numScore)
+		}
+	}
+
+	logger.Info("Merged accounts", zap.String("target", target.String()), zap.String("source", source.String()))
+	return 0, nil
+}
+
+// accountMergeLeaderboards moves the source's leaderboard records to the target. Where both have a record in the same
+// leaderboard period the better score is kept, and the worse record is removed.
+func accountMergeLeaderboards(tx *sql.Tx, target uuid.UUID, source uuid.UUID, targetHandle string) ([]*accountMergeRecord, error) {
+	rows, err := tx.Query(`
+SELECT r.id, r.leaderboard_id, r.expires_at, r.score, r.updated_at, r.num_score, l.sort_order, t.id, t.score
+FROM leaderboard_record AS r
+JOIN leaderboard AS l ON l.id = r.leaderboard_id
+LEFT JOIN leaderboard_record AS t ON t.leaderboard_id = r.leaderboard_id AND t.expires_at = r.expires_at AND t.owner_id = $2
+WHERE r.owner_id = $1`, source.Bytes(), target.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*accountMergeRecord, 0)
+	// The target's record is removed when the source's one is better.
+	replaced := make([][]byte, 0)
+	for rows.Next() {
+		r := &accountMergeRecord{}
+		var targetRecordID []byte
+		var targetScore sql.NullInt64
+		if err = rows.Scan(&r.recordID, &r.leaderboardID, &r.expiresAt, &r.score, &r.updatedAt, &r.numScore, &r.sortOrder, &targetRecordID, &targetScore); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !targetScore.Valid {
+			r.moved = true
+		} else if (r.sortOrder == 0 && r.score < targetScore.Int64) || (r.sortOrder == 1 && r.score > targetScore.Int64) {
+			r.moved = true
+			replaced = append(replaced, targetRecordID)
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range replaced {
+		if _, err = tx.Exec("DELETE FROM leaderboard_record WHERE id = $1", id); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range records {
+		if r.moved {
+			_, err = tx.Exec("UPDATE leaderboard_record SET owner_id = $2, handle = $3 WHERE id = $1", r.recordID, target.Bytes(), targetHandle)
+		} else {
+			_, err = tx.Exec("DELETE FROM leaderboard_record WHERE id = $1", r.recordID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// accountMergeGroupRoles gives the target the higher of the two roles in groups both accounts belong to, so merging
+// never demotes a group admin.
+func accountMergeGroupRoles(tx *sql.Tx, target uuid.UUID, source uuid.UUID) error {
+	rows, err := tx.Query(`
+SELECT s.destination_id, s.state FROM group_edge AS s
+JOIN group_edge AS t ON t.destination_id = s.destination_id AND t.source_id = $2
+WHERE s.source_id = $1 AND s.state < t.state`, source.Bytes(), target.Bytes())
+	if err != nil {
+		return err
+	}
+	groupIDs := make([][]byte, 0)
+	states := make([]int64, 0)
+	for rows.Next() {
+		var groupID []byte
+		var state int64
+		if err = rows.Scan(&groupID, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		groupIDs = append(groupIDs, groupID)
+		states = append(states, state)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, groupID := range groupIDs {
+		if _, err = tx.Exec(`
+UPDATE group_edge SET state = $3
+WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)`,
+			target.Bytes(), groupID, states[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountMergeCounts recounts the friends of the target and of everyone it has an edge with, and the members of the
+// target's groups.
+func accountMergeCounts(tx *sql.Tx, target uuid.UUID, ts int64) error {
+	counts := []struct {
+		query  string
+		update string
+	}{
+		{`
+SELECT source_id, COUNT(*) FROM user_edge
+WHERE source_id = $1 OR source_id IN (SELECT destination_id FROM user_edge WHERE source_id = $1)
+GROUP BY source_id`,
+			"UPDATE user_edge_metadata SET count = $2, updated_at = $3 WHERE source_id = $1"},
+		{`
+SELECT source_id, COUNT(*) FROM group_edge
+WHERE source_id IN (SELECT destination_id FROM group_edge WHERE source_id = $1) AND state IN (0, 1)
+GROUP BY source_id`,
+			"UPDATE groups SET count = $2, updated_at = $3 WHERE id = $1"},
+	}
+
+	for _, c := range counts {
+		rows, err := tx.Query(c.query, target.Bytes())
+		if err != nil {
+			return err
+		}
+		ids := make([][]byte, 0)
+		values := make([]int64, 0)
+		for rows.Next() {
+			var id []byte
+			var count int64
+			if err = rows.Scan(&id, &count); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			values = append(values, count)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			if _, err = tx.Exec(c.update, id, values[i], ts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
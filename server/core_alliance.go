@@ -0,0 +1,312 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// allianceGroupAdmin checks if the user is an admin of the given active group.
+func allianceGroupAdmin(tx *sql.Tx, groupID []byte, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := tx.QueryRow(`
+SELECT COUNT(source_id) FROM group_edge
+WHERE
+	source_id = $1 AND destination_id = $2 AND state = 0
+AND
+	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)`, groupID, userID.Bytes()).Scan(&count)
+	return count != 0, err
+}
+
+// allianceGroupLinked checks if the group is already part of an alliance, or is an alliance itself.
+func allianceGroupLinked(tx *sql.Tx, groupID []byte) (bool, error) {
+	var count int64
+	err := tx.QueryRow("SELECT COUNT(child_id) FROM group_relation WHERE child_id = $1 OR parent_id = $1", groupID).Scan(&count)
+	return count != 0, err
+}
+
+func AllianceCreate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, params *GroupCreateParam) (alliance *Group, code Error_Code, err error) {
+	allianceLogger := logger.With(zap.String("group_id", groupID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		allianceLogger.Error("Could not create alliance, begin error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not create alliance")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			allianceLogger.Warn("Could not create alliance", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				allianceLogger.Error("Could not create alliance, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				allianceLogger.Error("Could not create alliance, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not create alliance")
+			}
+		}
+	}()
+
+	admin, err := allianceGroupAdmin(tx, groupID.Bytes(), caller)
+	if err != nil {
+		return nil, code, err
+	}
+	if !admin {
+		code = BAD_INPUT
+		err = errors.New("Cannot create alliance - Make sure you are a group admin and group exists")
+		return nil, code, err
+	}
+
+	linked, err := allianceGroupLinked(tx, groupID.Bytes())
+	if err != nil {
+		return nil, code, err
+	}
+	if linked {
+		code = BAD_INPUT
+		err = errors.New("Group is already part of an alliance")
+		return nil, code, err
+	}
+
+	params.Creator = caller
+	alliance, err = groupCreate(tx, params)
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "violates unique constraint \"groups_name_key\"") {
+			code = GROUP_NAME_INUSE
+			err = errors.New("Name is in use")
+		}
+		return nil, code, err
+	}
+
+	_, err = tx.Exec("INSERT INTO group_relation (parent_id, child_id, created_at) VALUES ($1, $2, $3)", alliance.Id, groupID.Bytes(), nowMs())
+	if err != nil {
+		return nil, code, err
+	}
+
+	allianceLogger.Info("Created alliance", zap.String("name", alliance.Name))
+	return alliance, code, err
+}
+
+func AllianceJoin(logger *zap.Logger, db *sql.DB, caller uuid.UUID, allianceID uuid.UUID, groupID uuid.UUID) (code Error_Code, err error) {
+	allianceLogger := logger.With(zap.String("alliance_id", allianceID.String()), zap.String("group_id", groupID.String()))
+
+	if allianceID == groupID {
+		return BAD_INPUT, errors.New("A group cannot join itself")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		allianceLogger.Error("Could not join alliance, begin error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not join alliance")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			allianceLogger.Warn("Could not join alliance", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				allianceLogger.Error("Could not join alliance, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				allianceLogger.Error("Could not join alliance, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not join alliance")
+			}
+		}
+	}()
+
+	// Alliances are identified by having at least one member group.
+	var allianceState int64
+	err = tx.QueryRow(`
+SELECT state FROM groups
+WHERE
+	id = $1 AND disabled_at = 0
+AND
+	EXISTS (SELECT parent_id FROM group_relation WHERE parent_id = $1)`, allianceID.Bytes()).Scan(&allianceState)
+	if err == sql.ErrNoRows {
+		code = BAD_INPUT
+		err = errors.New("Alliance not found")
+		return code, err
+	} else if err != nil {
+		return code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	if caller != uuid.Nil {
+		admin, e := allianceGroupAdmin(tx, groupID.Bytes(), caller)
+		if e != nil {
+			err = e
+			return code, err
+		}
+		if !admin {
+			code = BAD_INPUT
+			err = errors.New("Cannot join alliance - Make sure you are a group admin and group exists")
+			return code, err
+		}
+
+		if allianceState == 1 {
+			admin, e = allianceGroupAdmin(tx, allianceID.Bytes(), caller)
+			if e != nil {
+				err = e
+				return code, err
+			}
+			if !admin {
+				code = BAD_INPUT
+				err = errors.New("Cannot join private alliance - Make sure you are an alliance admin")
+				return code, err
+			}
+		}
+	}
+
+	linked, err := allianceGroupLinked(tx, groupID.Bytes())
+	if err != nil {
+		return code, err
+	}
+	if linked {
+		code = BAD_INPUT
+		err = errors.New("Group is already part of an alliance")
+		return code, err
+	}
+
+	_, err = tx.Exec("INSERT INTO group_relation (parent_id, child_id, created_at) VALUES ($1, $2, $3)", allianceID.Bytes(), groupID.Bytes(), nowMs())
+	if err != nil {
+		return code, err
+	}
+
+	allianceLogger.Info("Group joined alliance")
+	return code, err
+}
+
+func AllianceLeave(logger *zap.Logger, db *sql.DB, caller uuid.UUID, allianceID uuid.UUID, groupID uuid.UUID) (Error_Code, error) {
+	allianceLogger := logger.With(zap.String("alliance_id", allianceID.String()), zap.String("group_id", groupID.String()))
+
+	query := "DELETE FROM group_relation WHERE parent_id = $1 AND child_id = $2"
+	params := []interface{}{allianceID.Bytes(), groupID.Bytes()}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		query += " AND EXISTS (SELECT source_id FROM group_edge WHERE (source_id = $1 OR source_id = $2) AND destination_id = $3 AND state = 0)"
+	}
+
+	res, err := db.Exec(query, params...)
+	if err != nil {
+		allianceLogger.Error("Could not leave alliance, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not leave alliance")
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return BAD_INPUT, errors.New("Could not leave alliance. Group may not be part of the alliance or you may not be an admin")
+	}
+
+	allianceLogger.Info("Group left alliance")
+	return 0, nil
+}
+
+func AllianceGroupsList(logger *zap.Logger, db *sql.DB, allianceID uuid.UUID) ([]*Group, Error_Code, error) {
+	allianceLogger := logger.With(zap.String("alliance_id", allianceID.String()))
+
+	rows, err := db.Query(`
+SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at, max_count
+FROM groups
+WHERE disabled_at = 0 AND id IN (SELECT child_id FROM group_relation WHERE parent_id = $1)`, allianceID.Bytes())
+	if err != nil {
+		allianceLogger.Error("Could not get alliance groups, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get alliance groups")
+	}
+	defer rows.Close()
+
+	groups := make([]*Group, 0)
+	for rows.Next() {
+		group, err := extractGroup(rows)
+		if err != nil {
+			allianceLogger.Error("Could not get alliance groups, scan error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not get alliance groups")
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, 0, nil
+}
+
+func AllianceUsersList(logger *zap.Logger, db *sql.DB, allianceID uuid.UUID) ([]*GroupUser, Error_Code, error) {
+	allianceLogger := logger.With(zap.String("alliance_id", allianceID.String()))
+
+	// Users in several member groups are reported with their highest role.
+	query := `
+SELECT u.id, u.handle, u.fullname, u.avatar_url,
+	u.lang, u.location, u.timezone, u.metadata,
+	u.created_at, u.updated_at, u.last_online_at, MIN(ge.state)
+FROM users u, group_edge ge, group_relation gr
+WHERE u.id = ge.source_id AND ge.destination_id = gr.child_id AND gr.parent_id = $1 AND ge.state IN (0, 1) AND u.deleted_at = 0
+GROUP BY u.id, u.handle, u.fullname, u.avatar_url,
+	u.lang, u.location, u.timezone, u.metadata,
+	u.created_at, u.updated_at, u.last_online_at`
+
+	rows, err := db.Query(query, allianceID.Bytes())
+	if err != nil {
+		allianceLogger.Error("Could not get alliance users, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get alliance users")
+	}
+	defer rows.Close()
+
+	users := make([]*GroupUser, 0)
+	for rows.Next() {
+		var id []byte
+		var handle sql.NullString
+		var fullname sql.NullString
+		var avatarURL sql.NullString
+		var lang sql.NullString
+		var location sql.NullString
+		var timezone sql.NullString
+		var metadata []byte
+		var createdAt sql.NullInt64
+		var updatedAt sql.NullInt64
+		var lastOnlineAt sql.NullInt64
+		var state sql.NullInt64
+
+		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &lastOnlineAt, &state)
+		if err != nil {
+			allianceLogger.Error("Could not get alliance users, scan error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not get alliance users")
+		}
+
+		users = append(users, &GroupUser{
+			User: &User{
+				Id:           id,
+				Handle:       handle.String,
+				Fullname:     fullname.String,
+				AvatarUrl:    avatarURL.String,
+				Lang:         lang.String,
+				Location:     location.String,
+				Timezone:     timezone.String,
+				Metadata:     metadata,
+				CreatedAt:    createdAt.Int64,
+				UpdatedAt:    updatedAt.Int64,
+				LastOnlineAt: lastOnlineAt.Int64,
+			},
+			State: state.Int64,
+		})
+	}
+
+	return users, 0, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	AUTH_HISTORY_LOGIN    int64 = 0
+	AUTH_HISTORY_REGISTER int64 = 1
+	AUTH_HISTORY_REFRESH  int64 = 2
+	AUTH_HISTORY_LINK     int64 = 3
+	AUTH_HISTORY_UNLINK   int64 = 4
+)
+
+// Longest values kept, matching the column sizes.
+const (
+	authHistoryMaxIP        = 64
+	authHistoryMaxUserAgent = 255
+)
+
+type authHistoryCursor struct {
+	CreatedAt int64
+	Id        []byte
+}
+
+// authHistoryProvider names the login method of an authentication request.
+func authHistoryProvider(authReq *AuthenticateRequest) string {
+	switch authReq.Id.(type) {
+	case *AuthenticateRequest_Device:
+		return "device"
+	case *AuthenticateRequest_Facebook:
+		return "facebook"
+	case *AuthenticateRequest_Google:
+		return "google"
+	case *AuthenticateRequest_GameCenter_:
+		return "gamecenter"
+	case *AuthenticateRequest_Steam:
+		return "steam"
+	case *AuthenticateRequest_Email_:
+		return "email"
+	case *AuthenticateRequest_Custom:
+		return "custom"
+	case *AuthenticateRequest_Apple_:
+		return "apple"
+	case *AuthenticateRequest_Refresh:
+		return "refresh"
+	case *AuthenticateRequest_Oidc:
+		return "oidc"
+	}
+	return "unknown"
+}
+
+func authHistoryAdd(e execer, userID []byte, eventType int64, provider string, ip string, userAgent string, ts int64) error {
+	if len(ip) > authHistoryMaxIP {
+		ip = ip[:authHistoryMaxIP]
+	}
+	if len(userAgent) > authHistoryMaxUserAgent {
+		userAgent = userAgent[:authHistoryMaxUserAgent]
+	}
+
+	_, err := e.Exec(`
+INSERT INTO auth_history (user_id, created_at, id, type, provider, ip, user_agent)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, userID, ts, uuid.NewV4().Bytes(), eventType, provider, ip, userAgent)
+	return err
+}
+
+// AuthHistoryList returns a user's authentication, link and unlink events, most recent first.
+func AuthHistoryList(logger *zap.Logger, db *sql.DB, userID uuid.UUID, limit int64, cursor []byte) ([]*AuthHistoryEntry, []byte, Error_Code, error) {
+	userLogger := logger.With(zap.String("user_id", userID.String()))
+
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	query := "SELECT id, type, provider, ip, user_agent, created_at FROM auth_history WHERE user_id = $1"
+	params := []interface{}{userID.Bytes()}
+
+	if len(cursor) != 0 {
+		incomingCursor := &authHistoryCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		query += " AND (created_at, id) < ($2, $3)"
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.Id)
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY created_at DESC, id DESC LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		userLogger.Error("Could not get auth history, query error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get auth history")
+	}
+	defer rows.Close()
+
+	entries := make([]*AuthHistoryEntry, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		if int64(len(entries)) >= limit {
+			last := entries[len(entries)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&authHistoryCursor{CreatedAt: last.CreatedAt, Id: last.Id}); err != nil {
+				userLogger.Error("Could not create auth history cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get auth history")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		entry := &AuthHistoryEntry{}
+		if err = rows.Scan(&entry.Id, &entry.Type, &entry.Provider, &entry.Ip, &entry.UserAgent, &entry.CreatedAt); err != nil {
+			userLogger.Error("Could not get auth history, scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get auth history")
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		userLogger.Error("Could not get auth history, rows error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get auth history")
+	}
+
+	return entries, outgoingCursor, 0, nil
+}
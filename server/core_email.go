@@ -0,0 +1,257 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of email tokens.
+const (
+	emailTokenVerification  = 0
+	emailTokenPasswordReset = 1
+)
+
+var errorInvalidEmailToken = errors.New("Invalid or expired token")
+
+// randomToken creates a secret token to hand to a client.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenHash is how secret tokens are stored, so the database alone does not hold usable tokens.
+func tokenHash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// emailTokenCreate replaces any token the user has for the purpose with a new one, returning the token to send.
+func emailTokenCreate(tx *sql.Tx, userID []byte, purpose int, email string, expiryMs int64) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_email_token WHERE user_id = $1 AND purpose = $2", userID, purpose); err != nil {
+		return "", err
+	}
+	ts := nowMs()
+	_, err = tx.Exec(`
+INSERT INTO user_email_token (token_hash, user_id, purpose, email, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)`, tokenHash(token), userID, purpose, email, ts, ts+expiryMs)
+	return token, err
+}
+
+// emailTokenUse removes the token, returning the user and email address it was sent to if it was still valid.
+func emailTokenUse(tx *sql.Tx, token string, purpose int) ([]byte, string, error) {
+	var userID []byte
+	var email string
+	var expiresAt int64
+	err := tx.QueryRow("DELETE FROM user_email_token WHERE token_hash = $1 AND purpose = $2 RETURNING user_id, email, expires_at",
+		tokenHash(token), purpose).Scan(&userID, &email, &expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if expiresAt <= nowMs() {
+		return nil, "", sql.ErrNoRows
+	}
+	return userID, email, nil
+}
+
+// emailTokenLink puts the token into a configured link, or sends the token alone if there is no link.
+func emailTokenLink(link string, token string) string {
+	if link == "" {
+		return token
+	}
+	return strings.Replace(link, "{token}", token, -1)
+}
+
+// emailTokenSend creates a token and emails it to the user, committing the token before it is sent.
+func emailTokenSend(logger *zap.Logger, db *sql.DB, mailer Mailer, userID []byte, email string, purpose int, expiryMs int64, subject string, body string, link string) (Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not create email token, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not send email")
+	}
+	token, err := emailTokenCreate(tx, userID, purpose, email, expiryMs)
+	if err != nil {
+		logger.Error("Could not create email token", zap.Error(err))
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not create email token, rollback error", zap.Error(e))
+		}
+		return RUNTIME_EXCEPTION, errors.New("Could not send email")
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not create email token, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not send email")
+	}
+
+	if err = mailer.Send(email, subject, body+"\n\n"+emailTokenLink(link, token)+"\n"); err != nil {
+		logger.Error("Could not send email", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not send email")
+	}
+	return 0, nil
+}
+
+// EmailVerificationSend emails a link to verify the address linked to the user, replacing any earlier link.
+func EmailVerificationSend(logger *zap.Logger, db *sql.DB, config Config, mailer Mailer, userID uuid.UUID) (Error_Code, error) {
+	var email sql.NullString
+	var verifiedAt int64
+	err := db.QueryRow("SELECT email, verified_at FROM users WHERE id = $1", userID.Bytes()).Scan(&email, &verifiedAt)
+	if err == sql.ErrNoRows {
+		return USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not send email verification, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not send email verification")
+	}
+	if !email.Valid {
+		return BAD_INPUT, errors.New("No email address is linked")
+	}
+	if verifiedAt != 0 {
+		return BAD_INPUT, errors.New("Already verified")
+	}
+
+	return emailTokenSend(logger, db, mailer, userID.Bytes(), email.String, emailTokenVerification, config.GetSession().EmailVerificationExpiryMs,
+		"Verify your email address", "Use this link to verify your email address:", config.GetMail().VerificationURL)
+}
+
+// EmailVerify marks the user a verification token was sent to as verified, as long as their email address has not
+// changed since.
+func EmailVerify(logger *zap.Logger, db *sql.DB, token string) (Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not verify email, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not verify email")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not verify email, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	userID, email, err := emailTokenUse(tx, token, emailTokenVerification)
+	if err == sql.ErrNoRows {
+		return BAD_INPUT, errorInvalidEmailToken
+	} else if err != nil {
+		logger.Error("Could not verify email, token error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not verify email")
+	}
+
+	ts := nowMs()
+	res, err := tx.Exec("UPDATE users SET verified_at = $3, updated_at = $3 WHERE id = $1 AND email = $2", userID, email, ts)
+	if err != nil {
+		logger.Error("Could not verify email, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not verify email")
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		err = errorInvalidEmailToken
+		return BAD_INPUT, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not verify email, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not verify email")
+	}
+	return 0, nil
+}
+
+// PasswordResetSend emails a password reset link to the user with the email address. Whether there is such a user is
+// not revealed.
+func PasswordResetSend(logger *zap.Logger, db *sql.DB, config Config, mailer Mailer, email string) (Error_Code, error) {
+	if email == "" || invalidCharsRegex.MatchString(email) || !emailRegex.MatchString(email) {
+		return BAD_INPUT, errors.New("Invalid email address")
+	}
+
+	cleanEmail := strings.ToLower(email)
+	var userID []byte
+	err := db.QueryRow("SELECT id FROM users WHERE email = $1", cleanEmail).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		logger.Error("Could not send password reset, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not send password reset")
+	}
+
+	return emailTokenSend(logger, db, mailer, userID, cleanEmail, emailTokenPasswordReset, config.GetSession().PasswordResetExpiryMs,
+		"Reset your password", "Use this link to reset your password. If you did not ask to reset it, you can ignore this email.", config.GetMail().ResetURL)
+}
+
+// PasswordReset sets a new password for the user a reset token was sent to. Receiving the token also verifies their
+// email address.
+func PasswordReset(logger *zap.Logger, db *sql.DB, token string, password string) (Error_Code, error) {
+	if len(password) < 8 {
+		return BAD_INPUT, errors.New("Password must be longer than 8 characters")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Error("Could not reset password, hash error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not reset password")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not reset password, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not reset password")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not reset password, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	userID, email, err := emailTokenUse(tx, token, emailTokenPasswordReset)
+	if err == sql.ErrNoRows {
+		return BAD_INPUT, errorInvalidEmailToken
+	} else if err != nil {
+		logger.Error("Could not reset password, token error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not reset password")
+	}
+
+	ts := nowMs()
+	res, err := tx.Exec(`
+UPDATE users SET password = $3, verified_at = CASE WHEN verified_at = 0 THEN $4 ELSE verified_at END, updated_at = $4
+WHERE id = $1 AND email = $2`, userID, email, hashedPassword, ts)
+	if err != nil {
+		logger.Error("Could not reset password, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not reset password")
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		err = errorInvalidEmailToken
+		return BAD_INPUT, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not reset password, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not reset password")
+	}
+	return 0, nil
+}
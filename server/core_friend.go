@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 
@@ -61,7 +62,7 @@ func friendAdd(logger *zap.Logger, db *sql.DB, ns *NotificationService, userID [
 				code = NOTIFICATION_FRIEND_REQUEST
 			}
 
-			if e := ns.NotificationSend([]*NNotification{
+			if e := ns.NotificationSend(context.Background(), []*NNotification{
 				&NNotification{
 					Id:         uuid.NewV4().Bytes(),
 					UserID:     friendID,
@@ -102,7 +103,7 @@ FROM (VALUES
   ($1::BYTEA, $2::BYTEA, 2, $3::BIGINT, $3::BIGINT),
   ($2::BYTEA, $1::BYTEA, 1, $3::BIGINT, $3::BIGINT)
 ) AS ue(source_id, destination_id, state, position, updated_at)
-WHERE EXISTS (SELECT id FROM users WHERE id = $2::BYTEA)
+WHERE EXISTS (SELECT id FROM users WHERE id = $2::BYTEA AND deleted_at = 0)
 	`, userID, friendID, updatedAt)
 	if err != nil {
 		return err
@@ -135,10 +136,134 @@ OR source_id = $3`,
 
 func friendAddHandle(logger *zap.Logger, db *sql.DB, ns *NotificationService, userID []byte, handle string, friendHandle string) error {
 	var friendIdBytes []byte
-	err := db.QueryRow("SELECT id FROM users WHERE handle = $1", friendHandle).Scan(&friendIdBytes)
+	err := db.QueryRow("SELECT id FROM users WHERE handle = $1 AND deleted_at = 0", friendHandle).Scan(&friendIdBytes)
 	if err != nil {
 		return err
 	}
 
 	return friendAdd(logger, db, ns, userID, handle, friendIdBytes)
 }
+
+// friendRemove removes the friendship, invite or block between the users, from both sides.
+func friendRemove(logger *zap.Logger, db *sql.DB, userID []byte, friendID []byte) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil { // don't override value of err
+				logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	updatedAt := nowMs()
+	for _, edge := range [][2][]byte{{userID, friendID}, {friendID, userID}} {
+		res, err := tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", edge[0], edge[1])
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+			if _, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", edge[0], updatedAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// friendBlock blocks the other user, removing any friendship or invite between them unless the other user has
+// already blocked the user.
+func friendBlock(logger *zap.Logger, db *sql.DB, userID []byte, blockedID []byte) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil { // don't override value of err
+				logger.Error("Could not rollback transaction", zap.Error(rollbackErr))
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	updatedAt := nowMs()
+	res, err := tx.Exec("UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
+		userID, blockedID, updatedAt)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return errors.New("Could not block user. User ID may not exist")
+	}
+
+	// Delete opposite relationship if user hasn't blocked you already
+	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
+		blockedID, userID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
+		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", blockedID, updatedAt)
+	}
+	return err
+}
+
+// friendsList returns the user's friends, invites and blocked users.
+func friendsList(db *sql.DB, userID []byte) ([]*Friend, error) {
+	rows, err := db.Query(`
+SELECT id, handle, fullname, avatar_url,
+	lang, location, timezone, metadata,
+	created_at, users.updated_at, last_online_at, state
+FROM users, user_edge WHERE id = destination_id AND source_id = $1 AND deleted_at = 0`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := make([]*Friend, 0)
+
+	for rows.Next() {
+		var id []byte
+		var handle sql.NullString
+		var fullname sql.NullString
+		var avatarURL sql.NullString
+		var lang sql.NullString
+		var location sql.NullString
+		var timezone sql.NullString
+		var metadata []byte
+		var createdAt sql.NullInt64
+		var updatedAt sql.NullInt64
+		var lastOnlineAt sql.NullInt64
+		var state sql.NullInt64
+
+		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &lastOnlineAt, &state)
+		if err != nil {
+			return nil, err
+		}
+
+		friends = append(friends, &Friend{
+			User: &User{
+				Id:           id,
+				Handle:       handle.String,
+				Fullname:     fullname.String,
+				AvatarUrl:    avatarURL.String,
+				Lang:         lang.String,
+				Location:     location.String,
+				Timezone:     timezone.String,
+				Metadata:     metadata,
+				CreatedAt:    createdAt.Int64,
+				UpdatedAt:    updatedAt.Int64,
+				LastOnlineAt: lastOnlineAt.Int64,
+			},
+			State: state.Int64,
+		})
+	}
+
+	return friends, rows.Err()
+}
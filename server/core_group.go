@@ -15,7 +15,9 @@
 package server
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/gob"
 	"errors"
 	"strconv"
 	"strings"
@@ -25,6 +27,22 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	GROUP_HISTORY_JOIN         int64 = 0
+	GROUP_HISTORY_ADD          int64 = 1
+	GROUP_HISTORY_LEAVE        int64 = 2
+	GROUP_HISTORY_KICK         int64 = 3
+	GROUP_HISTORY_PROMOTE      int64 = 4
+	GROUP_HISTORY_BAN          int64 = 5
+	GROUP_HISTORY_OWNERSHIP    int64 = 6
+	GROUP_HISTORY_ANNOUNCEMENT int64 = 7
+)
+
+type groupHistoryCursor struct {
+	CreatedAt int64
+	Id        []byte
+}
+
 type GroupCreateParam struct {
 	Name        string    // mandatory
 	Creator     uuid.UUID // mandatory
@@ -33,6 +51,7 @@ type GroupCreateParam struct {
 	Lang        string
 	Metadata    []byte
 	Private     bool
+	MaxCount    int64
 }
 
 func extractGroup(r scanner) (*Group, error) {
@@ -48,11 +67,12 @@ func extractGroup(r scanner) (*Group, error) {
 	var count sql.NullInt64
 	var createdAt sql.NullInt64
 	var updatedAt sql.NullInt64
+	var maxCount sql.NullInt64
 
 	err := r.Scan(&id, &creatorID, &name,
 		&description, &avatarURL, &lang,
 		&utcOffsetMs, &metadata, &state,
-		&count, &createdAt, &updatedAt)
+		&count, &createdAt, &updatedAt, &maxCount)
 
 	if err != nil {
 		return nil, err
@@ -83,6 +103,7 @@ func extractGroup(r scanner) (*Group, error) {
 		Count:       count.Int64,
 		CreatedAt:   createdAt.Int64,
 		UpdatedAt:   updatedAt.Int64,
+		MaxCount:    maxCount.Int64,
 	}, nil
 }
 
@@ -182,6 +203,15 @@ func groupCreate(tx *sql.Tx, g *GroupCreateParam) (*Group, error) {
 		values = append(values, g.Metadata)
 	}
 
+	if g.MaxCount != 0 {
+		if g.MaxCount < 1 {
+			return nil, errors.New("Group max count must be greater than 0")
+		}
+		columns = append(columns, "max_count")
+		params = append(params, "$"+strconv.Itoa(len(values)+1))
+		values = append(values, g.MaxCount)
+	}
+
 	query := "INSERT INTO groups (id, creator_id, name, state, count, created_at, updated_at"
 	if len(columns) != 0 {
 		query += ", " + strings.Join(columns, ", ")
@@ -190,7 +220,7 @@ func groupCreate(tx *sql.Tx, g *GroupCreateParam) (*Group, error) {
 	if len(params) != 0 {
 		query += ", " + strings.Join(params, ",")
 	}
-	query += ") RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at"
+	query += ") RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at, max_count"
 
 	r := tx.QueryRow(query, values...)
 
@@ -288,6 +318,15 @@ func GroupsUpdate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, updates []*T
 			params = append(params, g.Name)
 		}
 
+		if g.MaxCount < 0 {
+			code = BAD_INPUT
+			err = errors.New("Group max count must be greater than 0")
+			return code, err
+		} else if g.MaxCount != 0 {
+			statements = append(statements, fmt.Sprintf("max_count = $%v", len(params)+1))
+			params = append(params, g.MaxCount)
+		}
+
 		query := "UPDATE groups SET " + strings.Join(statements, ", ") + " WHERE id = $1"
 
 		// If the caller is not the script runtime, apply group membership and admin role checks.
@@ -326,7 +365,7 @@ func GroupsSelfList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID uui
 	}
 
 	rows, err := db.Query(`
-SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, groups.state, count, created_at, groups.updated_at, group_edge.state
+SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, groups.state, count, created_at, groups.updated_at, max_count, group_edge.state
 FROM groups
 JOIN group_edge ON (group_edge.source_id = id)
 WHERE group_edge.destination_id = $1 AND disabled_at = 0 AND (group_edge.state = 1 OR group_edge.state = 0)
@@ -352,12 +391,13 @@ WHERE group_edge.destination_id = $1 AND disabled_at = 0 AND (group_edge.state =
 		var count sql.NullInt64
 		var createdAt sql.NullInt64
 		var updatedAt sql.NullInt64
+		var maxCount sql.NullInt64
 		var userState sql.NullInt64
 
 		err := rows.Scan(&id, &creatorID, &name,
 			&description, &avatarURL, &lang,
 			&utcOffsetMs, &metadata, &state,
-			&count, &createdAt, &updatedAt, &userState)
+			&count, &createdAt, &updatedAt, &maxCount, &userState)
 
 		if err != nil {
 			logger.Error("Could not list joined groups, scan error", zap.Error(err))
@@ -390,6 +430,7 @@ WHERE group_edge.destination_id = $1 AND disabled_at = 0 AND (group_edge.state =
 				Count:       count.Int64,
 				CreatedAt:   createdAt.Int64,
 				UpdatedAt:   updatedAt.Int64,
+				MaxCount:    maxCount.Int64,
 			},
 			State: userState.Int64,
 		})
@@ -406,7 +447,7 @@ SELECT u.id, u.handle, u.fullname, u.avatar_url,
 	u.lang, u.location, u.timezone, u.metadata,
 	u.created_at, u.updated_at, u.last_online_at, ge.state
 FROM users u, group_edge ge
-WHERE u.id = ge.source_id AND ge.destination_id = $1`
+WHERE u.id = ge.source_id AND ge.destination_id = $1 AND u.deleted_at = 0`
 
 	rows, err := db.Query(query, groupID.Bytes())
 	if err != nil {
@@ -457,3 +498,1041 @@ WHERE u.id = ge.source_id AND ge.destination_id = $1`
 
 	return users, 0, nil
 }
+
+// groupCooldownActive checks if the user is still within a rejoin cooldown period for the given group.
+func groupCooldownActive(tx *sql.Tx, groupID []byte, userID []byte, ts int64) (bool, error) {
+	var expiresAt int64
+	err := tx.QueryRow("SELECT expires_at FROM group_cooldown WHERE group_id = $1 AND user_id = $2", groupID, userID).Scan(&expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return expiresAt > ts, nil
+}
+
+// groupCooldownStart records a rejoin cooldown for a user that has just left or been kicked from a group.
+func groupCooldownStart(tx *sql.Tx, groupID []byte, userID []byte, ts int64, cooldownMs int64) error {
+	if cooldownMs <= 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+INSERT INTO group_cooldown (group_id, user_id, expires_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (group_id, user_id)
+DO UPDATE SET expires_at = $3`, groupID, userID, ts+cooldownMs)
+	return err
+}
+
+// groupUserBanned checks if the user is on the ban list for the given group.
+func groupUserBanned(tx *sql.Tx, groupID []byte, userID []byte) (bool, error) {
+	var count int64
+	err := tx.QueryRow("SELECT COUNT(user_id) FROM group_ban WHERE group_id = $1 AND user_id = $2", groupID, userID).Scan(&count)
+	return count != 0, err
+}
+
+// groupUserAdmin returns true if the user is an admin of the group.
+func groupUserAdmin(tx *sql.Tx, groupID []byte, userID []byte) (bool, error) {
+	var state int64
+	err := tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID, userID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil && state == 0, err
+}
+
+// GroupUsersAdd adds the user to the group as a member, accepting any join request they made. Returns the user's
+// handle and the group's name.
+func GroupUsersAdd(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID) (handle string, name string, code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not add user to group, begin error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not add user to group")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not add user to group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not add user to group, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not add user to group")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not add user to group, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not add user to group")
+			}
+		}
+	}()
+
+	err = tx.QueryRow("SELECT name FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			code = BAD_INPUT
+			err = errors.New("Group not found")
+		}
+		return "", "", code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	var callerID []byte
+	if caller != uuid.Nil {
+		callerID = caller.Bytes()
+		var admin bool
+		if admin, err = groupUserAdmin(tx, groupID.Bytes(), callerID); err != nil {
+			return "", "", code, err
+		}
+		if !admin {
+			code = BAD_INPUT
+			err = errors.New("Cannot add to group - Make sure you are a group admin")
+			return "", "", code, err
+		}
+	}
+
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&handle)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			code = BAD_INPUT
+			err = errors.New("User not found")
+		}
+		return "", "", code, err
+	}
+
+	// Banned users must be unbanned before they can be added back.
+	banned, err := groupUserBanned(tx, groupID.Bytes(), userID.Bytes())
+	if err != nil {
+		return "", "", code, err
+	}
+	if banned {
+		code = GROUP_USER_BANNED
+		err = errors.New("User is banned from this group")
+		return "", "", code, err
+	}
+
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	if err == nil && userState != 2 {
+		code = BAD_INPUT
+		err = errors.New("User is already part of the group")
+		return "", "", code, err
+	} else if err != nil && err != sql.ErrNoRows {
+		return "", "", code, err
+	}
+
+	ts := nowMs()
+	_, err = tx.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+VALUES ($1, $2, $2, $3, 1), ($3, $2, $2, $1, 1)
+ON CONFLICT (source_id, destination_id)
+DO UPDATE SET state = 1, updated_at = $2`, groupID.Bytes(), ts, userID.Bytes())
+	if err != nil {
+		return "", "", code, err
+	}
+
+	res, err := tx.Exec("UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2 AND count < max_count", ts, groupID.Bytes())
+	if err != nil {
+		return "", "", code, err
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		code = GROUP_FULL
+		err = errors.New("Group has reached its maximum member count")
+		return "", "", code, err
+	}
+
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_ADD, callerID, userID.Bytes(), nil, ts)
+	if err != nil {
+		return "", "", code, err
+	}
+
+	groupLogger.Info("Added user to the group")
+	return handle, name, code, err
+}
+
+// GroupUsersKick removes the user from the group, or rejects their join request. Users removed from the group must
+// wait for the given cooldown before rejoining. Returns the user's handle.
+func GroupUsersKick(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID, cooldownMs int64) (handle string, code Error_Code, err error) {
+	if caller == userID {
+		return "", BAD_INPUT, errors.New("You can't kick yourself from the group")
+	}
+
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not kick user from group, begin error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not kick user from group")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not kick user from group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not kick user from group, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not kick user from group")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not kick user from group, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not kick user from group")
+			}
+		}
+	}()
+
+	var groupCount int64
+	err = tx.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupCount)
+	if err != nil {
+		return "", code, err
+	}
+	if groupCount == 0 {
+		code = BAD_INPUT
+		err = errors.New("Group not found")
+		return "", code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	var callerID []byte
+	if caller != uuid.Nil {
+		callerID = caller.Bytes()
+		var admin bool
+		if admin, err = groupUserAdmin(tx, groupID.Bytes(), callerID); err != nil {
+			return "", code, err
+		}
+		if !admin {
+			code = BAD_INPUT
+			err = errors.New("Cannot kick from group - Make sure you are a group admin")
+			return "", code, err
+		}
+	}
+
+	// Check the user's group_edge state. If it's a pending join request being rejected then no need to decrement the group count.
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			code = BAD_INPUT
+			err = errors.New("Cannot kick from group - Make sure user is part of the group")
+		}
+		return "", code, err
+	}
+	if userState == 0 {
+		var adminCount int64
+		err = tx.QueryRow("SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND state = 0", groupID.Bytes()).Scan(&adminCount)
+		if err != nil {
+			return "", code, err
+		}
+		if adminCount == 1 {
+			code = GROUP_LAST_ADMIN
+			err = errors.New("Cannot kick the last group admin")
+			return "", code, err
+		}
+	}
+
+	_, err = tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID.Bytes(), userID.Bytes())
+	if err != nil {
+		return "", code, err
+	}
+
+	// Join requests aren't reflected in group count, and rejecting one does not start a rejoin cooldown.
+	if userState != 2 {
+		ts := nowMs()
+		_, err = tx.Exec("UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2", ts, groupID.Bytes())
+		if err != nil {
+			return "", code, err
+		}
+
+		err = groupCooldownStart(tx, groupID.Bytes(), userID.Bytes(), ts, cooldownMs)
+		if err != nil {
+			return "", code, err
+		}
+
+		err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_KICK, callerID, userID.Bytes(), nil, ts)
+		if err != nil {
+			return "", code, err
+		}
+	}
+
+	// Look up the user being kicked. Allow kicking disabled users.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	if err != nil {
+		return "", code, err
+	}
+
+	groupLogger.Info("Kicked user from group")
+	return handle, code, err
+}
+
+// GroupUsersPromote makes a member of the group an admin. Returns the user's handle.
+func GroupUsersPromote(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID) (handle string, code Error_Code, err error) {
+	if caller == userID {
+		return "", BAD_INPUT, errors.New("You can't promote yourself")
+	}
+
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not promote user, begin error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not promote user")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not promote user", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not promote user, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not promote user")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not promote user, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not promote user")
+			}
+		}
+	}()
+
+	var groupCount int64
+	err = tx.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupCount)
+	if err != nil {
+		return "", code, err
+	}
+	if groupCount == 0 {
+		code = BAD_INPUT
+		err = errors.New("Group not found")
+		return "", code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	var callerID []byte
+	if caller != uuid.Nil {
+		callerID = caller.Bytes()
+		var admin bool
+		if admin, err = groupUserAdmin(tx, groupID.Bytes(), callerID); err != nil {
+			return "", code, err
+		}
+		if !admin {
+			code = BAD_INPUT
+			err = errors.New("Cannot promote user - Make sure you are a group admin")
+			return "", code, err
+		}
+	}
+
+	// Join requests must be accepted before the user can be promoted.
+	ts := nowMs()
+	res, err := tx.Exec(`
+UPDATE group_edge SET state = 0, updated_at = $3
+WHERE
+	((source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1))
+AND
+	state != 2`, groupID.Bytes(), userID.Bytes(), ts)
+	if err != nil {
+		return "", code, err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		code = BAD_INPUT
+		err = errors.New("Could not promote user - Make sure user is part of the group")
+		return "", code, err
+	}
+
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_PROMOTE, callerID, userID.Bytes(), nil, ts)
+	if err != nil {
+		return "", code, err
+	}
+
+	// Look up the user being promoted. Allow promoting disabled users as long as they're still part of the group.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	if err != nil {
+		return "", code, err
+	}
+
+	groupLogger.Info("Promoted user")
+	return handle, code, err
+}
+
+func GroupUsersBan(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID) (handle string, code Error_Code, err error) {
+	if caller == userID {
+		return "", BAD_INPUT, errors.New("You can't ban yourself from the group")
+	}
+
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not ban user from group, begin error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not ban user from group")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not ban user from group", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not ban user from group, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not ban user from group")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not ban user from group, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not ban user from group")
+			}
+		}
+	}()
+
+	var groupCount int64
+	err = tx.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupCount)
+	if err != nil {
+		return "", code, err
+	}
+	if groupCount == 0 {
+		code = BAD_INPUT
+		err = errors.New("Group not found")
+		return "", code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	var callerID []byte
+	if caller != uuid.Nil {
+		callerID = caller.Bytes()
+		var callerState int64
+		err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), callerID).Scan(&callerState)
+		if err == sql.ErrNoRows || (err == nil && callerState != 0) {
+			code = BAD_INPUT
+			err = errors.New("Cannot ban from group - Make sure you are a group admin")
+			return "", code, err
+		} else if err != nil {
+			return "", code, err
+		}
+	}
+
+	// Allow banning disabled users.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			code = BAD_INPUT
+			err = errors.New("User not found")
+		}
+		return "", code, err
+	}
+
+	// If the user is currently part of the group, remove them first.
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	if err != nil && err != sql.ErrNoRows {
+		return "", code, err
+	}
+	if err == nil {
+		if userState == 0 {
+			var adminCount int64
+			err = tx.QueryRow("SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND state = 0", groupID.Bytes()).Scan(&adminCount)
+			if err != nil {
+				return "", code, err
+			}
+			if adminCount == 1 {
+				code = GROUP_LAST_ADMIN
+				err = errors.New("Cannot ban the last group admin")
+				return "", code, err
+			}
+		}
+
+		_, err = tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID.Bytes(), userID.Bytes())
+		if err != nil {
+			return "", code, err
+		}
+
+		// Join requests aren't reflected in group count.
+		if userState != 2 {
+			_, err = tx.Exec("UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2", nowMs(), groupID.Bytes())
+			if err != nil {
+				return "", code, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+INSERT INTO group_ban (group_id, user_id, banned_by, created_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (group_id, user_id) DO NOTHING`, groupID.Bytes(), userID.Bytes(), callerID, nowMs())
+	if err != nil {
+		return "", code, err
+	}
+
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_BAN, callerID, userID.Bytes(), nil, nowMs())
+	if err != nil {
+		return "", code, err
+	}
+
+	groupLogger.Info("Banned user from group")
+	return handle, code, err
+}
+
+func GroupUsersUnban(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID) (Error_Code, error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	query := "DELETE FROM group_ban WHERE group_id = $1 AND user_id = $2"
+	params := []interface{}{groupID.Bytes(), userID.Bytes()}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		query += " AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)"
+	}
+
+	res, err := db.Exec(query, params...)
+	if err != nil {
+		groupLogger.Error("Could not unban user from group, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not unban user from group")
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return BAD_INPUT, errors.New("Could not unban user from group. User may not be banned or you may not be group admin")
+	}
+
+	groupLogger.Info("Unbanned user from group")
+	return 0, nil
+}
+
+func GroupBannedUsersList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID) ([]*GroupBannedUser, Error_Code, error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()))
+
+	query := `
+SELECT u.id, u.handle, u.fullname, u.avatar_url,
+	u.lang, u.location, u.timezone, u.metadata,
+	u.created_at, u.updated_at, u.last_online_at, gb.banned_by, gb.created_at
+FROM users u, group_ban gb
+WHERE u.id = gb.user_id AND gb.group_id = $1`
+	params := []interface{}{groupID.Bytes()}
+
+	// If the caller is not the script runtime, only group admins may view the ban list.
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		query += " AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)"
+	}
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		groupLogger.Error("Could not get group banned users, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not get group banned users")
+	}
+	defer rows.Close()
+
+	users := make([]*GroupBannedUser, 0)
+	for rows.Next() {
+		var id []byte
+		var handle sql.NullString
+		var fullname sql.NullString
+		var avatarURL sql.NullString
+		var lang sql.NullString
+		var location sql.NullString
+		var timezone sql.NullString
+		var metadata []byte
+		var createdAt sql.NullInt64
+		var updatedAt sql.NullInt64
+		var lastOnlineAt sql.NullInt64
+		var bannedBy []byte
+		var bannedAt sql.NullInt64
+
+		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &lastOnlineAt, &bannedBy, &bannedAt)
+		if err != nil {
+			groupLogger.Error("Could not get group banned users, scan error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not get group banned users")
+		}
+
+		users = append(users, &GroupBannedUser{
+			User: &User{
+				Id:           id,
+				Handle:       handle.String,
+				Fullname:     fullname.String,
+				AvatarUrl:    avatarURL.String,
+				Lang:         lang.String,
+				Location:     location.String,
+				Timezone:     timezone.String,
+				Metadata:     metadata,
+				CreatedAt:    createdAt.Int64,
+				UpdatedAt:    updatedAt.Int64,
+				LastOnlineAt: lastOnlineAt.Int64,
+			},
+			BannedBy:  bannedBy,
+			CreatedAt: bannedAt.Int64,
+		})
+	}
+
+	return users, 0, nil
+}
+
+// groupAdminSuccession keeps a group manageable once it no longer has any admins. The longest-tenured remaining
+// member is promoted to admin and becomes the group owner, or the group is archived if it has no members left.
+// Returns the ID and handle of the promoted user, if any.
+func groupAdminSuccession(tx *sql.Tx, groupID []byte, ts int64) ([]byte, string, error) {
+	var adminCount int64
+	err := tx.QueryRow("SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND state = 0", groupID).Scan(&adminCount)
+	if err != nil || adminCount != 0 {
+		return nil, "", err
+	}
+
+	// Join order is recorded in the edge position.
+	var userID []byte
+	var handle string
+	err = tx.QueryRow(`
+SELECT u.id, u.handle
+FROM users u, group_edge ge
+WHERE u.id = ge.destination_id AND ge.source_id = $1 AND ge.state = 1 AND u.deleted_at = 0
+ORDER BY ge.position ASC
+LIMIT 1`, groupID).Scan(&userID, &handle)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", err
+	}
+
+	if err == sql.ErrNoRows {
+		// No members left, archive the group and drop any pending join requests.
+		_, err = tx.Exec("UPDATE groups SET disabled_at = $1, updated_at = $1 WHERE id = $2", ts, groupID)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = tx.Exec(`
+DELETE FROM group_edge
+WHERE
+	(source_id = $1 AND state = 2)
+OR
+	(destination_id = $1 AND state = 2)`, groupID)
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`
+UPDATE group_edge SET state = 0, updated_at = $3
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID, userID, ts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = tx.Exec("UPDATE groups SET creator_id = $1, updated_at = $2 WHERE id = $3", userID, ts, groupID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = groupHistoryAdd(tx, groupID, GROUP_HISTORY_PROMOTE, nil, userID, nil, ts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return userID, handle, nil
+}
+
+func GroupTransferOwnership(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID) (handle string, code Error_Code, err error) {
+	if caller == userID {
+		return "", BAD_INPUT, errors.New("You already own the group")
+	}
+
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not transfer group ownership, begin error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not transfer group ownership")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not transfer group ownership", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not transfer group ownership, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not transfer group ownership")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not transfer group ownership, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not transfer group ownership")
+			}
+		}
+	}()
+
+	var groupCount int64
+	err = tx.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupCount)
+	if err != nil {
+		return "", code, err
+	}
+	if groupCount == 0 {
+		code = BAD_INPUT
+		err = errors.New("Group not found")
+		return "", code, err
+	}
+
+	// If the caller is not the script runtime, apply admin role checks.
+	if caller != uuid.Nil {
+		var callerState int64
+		err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), caller.Bytes()).Scan(&callerState)
+		if err == sql.ErrNoRows || (err == nil && callerState != 0) {
+			code = BAD_INPUT
+			err = errors.New("Cannot transfer group ownership - Make sure you are a group admin")
+			return "", code, err
+		} else if err != nil {
+			return "", code, err
+		}
+	}
+
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	if err == sql.ErrNoRows || (err == nil && userState > 1) {
+		code = BAD_INPUT
+		err = errors.New("Cannot transfer group ownership - Make sure user is part of the group")
+		return "", code, err
+	} else if err != nil {
+		return "", code, err
+	}
+
+	// Allow transferring to disabled users as long as they're still part of the group.
+	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	if err != nil {
+		return "", code, err
+	}
+
+	ts := nowMs()
+	_, err = tx.Exec(`
+UPDATE group_edge SET state = 0, updated_at = $3
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID.Bytes(), userID.Bytes(), ts)
+	if err != nil {
+		return "", code, err
+	}
+
+	// The previous owner steps down to a regular member.
+	if caller != uuid.Nil {
+		_, err = tx.Exec(`
+UPDATE group_edge SET state = 1, updated_at = $3
+WHERE
+	(source_id = $1 AND destination_id = $2)
+OR
+	(source_id = $2 AND destination_id = $1)`, groupID.Bytes(), caller.Bytes(), ts)
+		if err != nil {
+			return "", code, err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE groups SET creator_id = $1, updated_at = $2 WHERE id = $3", userID.Bytes(), ts, groupID.Bytes())
+	if err != nil {
+		return "", code, err
+	}
+
+	var callerID []byte
+	if caller != uuid.Nil {
+		callerID = caller.Bytes()
+	}
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_OWNERSHIP, callerID, userID.Bytes(), nil, ts)
+	if err != nil {
+		return "", code, err
+	}
+
+	groupLogger.Info("Transferred group ownership")
+	return handle, code, err
+}
+
+// groupHistoryAdd records a membership event in the group's history. Actor and user IDs may be nil.
+func groupHistoryAdd(e execer, groupID []byte, eventType int64, actorID []byte, userID []byte, data []byte, ts int64) error {
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+
+	_, err := e.Exec(`
+INSERT INTO group_history (id, group_id, type, actor_id, user_id, data, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, uuid.NewV4().Bytes(), groupID, eventType, actorID, userID, data, ts)
+	return err
+}
+
+func GroupAnnouncementAdd(logger *zap.Logger, db *sql.DB, groupID uuid.UUID, data []byte) (Error_Code, error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()))
+
+	var groupCount int64
+	err := db.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupCount)
+	if err != nil {
+		groupLogger.Error("Could not add group announcement, query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not add group announcement")
+	}
+	if groupCount == 0 {
+		return BAD_INPUT, errors.New("Group not found")
+	}
+
+	err = groupHistoryAdd(db, groupID.Bytes(), GROUP_HISTORY_ANNOUNCEMENT, nil, nil, data, nowMs())
+	if err != nil {
+		groupLogger.Error("Could not add group announcement, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not add group announcement")
+	}
+
+	return 0, nil
+}
+
+func GroupHistoryList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, limit int64, cursor []byte) ([]*GroupHistoryEntry, []byte, Error_Code, error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()))
+
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	// If the caller is not the script runtime, only group members may view the history.
+	if caller != uuid.Nil {
+		var memberCount int64
+		err := db.QueryRow("SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state IN (0, 1)", groupID.Bytes(), caller.Bytes()).Scan(&memberCount)
+		if err != nil {
+			groupLogger.Error("Could not get group history, membership query error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get group history")
+		}
+		if memberCount == 0 {
+			return nil, nil, BAD_INPUT, errors.New("Could not get group history - Make sure you are part of the group")
+		}
+	}
+
+	query := "SELECT id, type, actor_id, user_id, data, created_at FROM group_history WHERE group_id = $1"
+	params := []interface{}{groupID.Bytes()}
+
+	if len(cursor) != 0 {
+		incomingCursor := &groupHistoryCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		query += " AND (created_at, id) < ($2, $3)"
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.Id)
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY created_at DESC, id DESC LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		groupLogger.Error("Could not get group history, query error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get group history")
+	}
+	defer rows.Close()
+
+	entries := make([]*GroupHistoryEntry, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		if int64(len(entries)) >= limit {
+			last := entries[len(entries)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&groupHistoryCursor{CreatedAt: last.CreatedAt, Id: last.Id}); err != nil {
+				groupLogger.Error("Could not create group history cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get group history")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		var id []byte
+		var eventType int64
+		var actorID []byte
+		var userID []byte
+		var data []byte
+		var createdAt int64
+		if err = rows.Scan(&id, &eventType, &actorID, &userID, &data, &createdAt); err != nil {
+			groupLogger.Error("Could not get group history, scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get group history")
+		}
+
+		entries = append(entries, &GroupHistoryEntry{
+			Id:        id,
+			GroupId:   groupID.Bytes(),
+			Type:      eventType,
+			ActorId:   actorID,
+			UserId:    userID,
+			Data:      data,
+			CreatedAt: createdAt,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		groupLogger.Error("Could not get group history, rows error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not get group history")
+	}
+
+	return entries, outgoingCursor, 0, nil
+}
+
+func GroupUsersInvite(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID, userID uuid.UUID, expiryMs int64) (string, Error_Code, error) {
+	if caller == userID {
+		return "", BAD_INPUT, errors.New("You can't invite yourself to the group")
+	}
+
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	var name string
+	err := db.QueryRow(`
+SELECT name FROM groups
+WHERE
+	id = $1 AND disabled_at = 0
+AND
+	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)`,
+		groupID.Bytes(), caller.Bytes()).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", BAD_INPUT, errors.New("Cannot invite to group - Make sure you are a group admin and group exists")
+	} else if err != nil {
+		groupLogger.Error("Could not invite user to group, group query error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not invite user to group")
+	}
+
+	var userState int64
+	err = db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+	if err == nil && userState != 2 {
+		return "", BAD_INPUT, errors.New("User is already part of the group")
+	} else if err != nil && err != sql.ErrNoRows {
+		groupLogger.Error("Could not invite user to group, membership query error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not invite user to group")
+	}
+
+	ts := nowMs()
+	res, err := db.Exec(`
+INSERT INTO group_invite (group_id, user_id, invited_by, created_at, expires_at)
+SELECT $1, $2, $3, $4, $5
+WHERE
+	EXISTS (SELECT id FROM users WHERE id = $2 AND disabled_at = 0)
+AND
+	NOT EXISTS (SELECT user_id FROM group_ban WHERE group_id = $1 AND user_id = $2)
+ON CONFLICT (group_id, user_id)
+DO UPDATE SET invited_by = $3, created_at = $4, expires_at = $5`,
+		groupID.Bytes(), userID.Bytes(), caller.Bytes(), ts, ts+expiryMs)
+	if err != nil {
+		groupLogger.Error("Could not invite user to group, exec error", zap.Error(err))
+		return "", RUNTIME_EXCEPTION, errors.New("Could not invite user to group")
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return "", BAD_INPUT, errors.New("Could not invite user to group. User may not exist or may be banned from the group")
+	}
+
+	groupLogger.Info("Invited user to group")
+	return name, 0, nil
+}
+
+func GroupInviteAccept(logger *zap.Logger, db *sql.DB, caller uuid.UUID, groupID uuid.UUID) (code Error_Code, err error) {
+	groupLogger := logger.With(zap.String("group_id", groupID.String()), zap.String("user_id", caller.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		groupLogger.Error("Could not accept group invite, begin error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not accept group invite")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			groupLogger.Warn("Could not accept group invite", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				groupLogger.Error("Could not accept group invite, rollback error", zap.Error(e))
+			}
+			if code == RUNTIME_EXCEPTION {
+				err = errors.New("Could not accept group invite")
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				groupLogger.Error("Could not accept group invite, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not accept group invite")
+			}
+		}
+	}()
+
+	ts := nowMs()
+	var invitedBy []byte
+	err = tx.QueryRow("DELETE FROM group_invite WHERE group_id = $1 AND user_id = $2 AND expires_at > $3 RETURNING invited_by", groupID.Bytes(), caller.Bytes(), ts).Scan(&invitedBy)
+	if err == sql.ErrNoRows {
+		code = BAD_INPUT
+		err = errors.New("No pending invitation found for this group")
+		return code, err
+	} else if err != nil {
+		return code, err
+	}
+
+	banned, err := groupUserBanned(tx, groupID.Bytes(), caller.Bytes())
+	if err != nil {
+		return code, err
+	}
+	if banned {
+		code = GROUP_USER_BANNED
+		err = errors.New("You are banned from this group")
+		return code, err
+	}
+
+	var userState int64
+	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), caller.Bytes()).Scan(&userState)
+	if err == nil && userState != 2 {
+		code = BAD_INPUT
+		err = errors.New("You are already part of the group")
+		return code, err
+	} else if err != nil && err != sql.ErrNoRows {
+		return code, err
+	}
+
+	// An outstanding join request is converted into a membership.
+	res, err := tx.Exec(`
+INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
+SELECT data.id, data.position, data.updated_at, data.destination, data.state
+FROM (
+  SELECT $1::BYTEA AS id, $2::INT AS position, $2::INT AS updated_at, $3::BYTEA AS destination, 1 AS state
+  UNION ALL
+  SELECT $3::BYTEA AS id, $2::INT AS position, $2::INT AS updated_at, $1::BYTEA AS destination, 1 AS state
+) AS data
+WHERE
+  EXISTS (SELECT id FROM groups WHERE id = $1::BYTEA AND disabled_at = 0)
+ON CONFLICT (source_id, destination_id)
+DO UPDATE SET state = 1, updated_at = $2::INT`,
+		groupID.Bytes(), ts, caller.Bytes())
+	if err != nil {
+		return code, err
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		code = BAD_INPUT
+		err = errors.New("Group not found")
+		return code, err
+	}
+
+	res, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2 AND count < max_count", ts, groupID.Bytes())
+	if err != nil {
+		return code, err
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		code = GROUP_FULL
+		err = errors.New("Group has reached its maximum member count")
+		return code, err
+	}
+
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_ADD, invitedBy, caller.Bytes(), nil, ts)
+	if err != nil {
+		return code, err
+	}
+
+	groupLogger.Info("Accepted group invite")
+	return code, err
+}
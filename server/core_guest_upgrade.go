@@ -0,0 +1,125 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// guestUpgradeColumns are the users columns a guest upgrade may set, by provider.
+var guestUpgradeColumns = map[string]string{
+	"email":      "email",
+	"facebook":   "facebook_id",
+	"google":     "google_id",
+	"gamecenter": "gamecenter_id",
+	"steam":      "steam_id",
+	"custom":     "custom_id",
+	"apple":      "apple_id",
+}
+
+// GuestUpgrade turns a guest account, one with only device IDs linked, into a named account. The handle is claimed and
+// the provider's ID linked in one transaction, so either both are set or neither is. The user ID is unchanged, keeping
+// all data and relationships. A password is only set for the email provider.
+func GuestUpgrade(logger *zap.Logger, db *sql.DB, userID uuid.UUID, handle string, provider string, providerID string, password []byte) (Error_Code, error) {
+	column, ok := guestUpgradeColumns[provider]
+	if !ok {
+		return BAD_INPUT, errors.New("Unknown provider")
+	}
+	if handle == "" || len(handle) > 128 {
+		return BAD_INPUT, errors.New("Handle must be 1-128 characters long")
+	} else if invalidCharsRegex.MatchString(handle) {
+		return BAD_INPUT, errors.New("Invalid handle, no spaces or control characters allowed")
+	}
+	if providerID == "" {
+		return BAD_INPUT, errors.New("Provider ID is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not upgrade guest, transaction begin error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+	code, err := guestUpgrade(logger, tx, userID, handle, column, providerID, password)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Error("Could not upgrade guest, rollback error", zap.Error(rollbackErr))
+		}
+		return code, err
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not upgrade guest, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+
+	return 0, nil
+}
+
+func guestUpgrade(logger *zap.Logger, tx *sql.Tx, userID uuid.UUID, handle string, column string, providerID string, password []byte) (Error_Code, error) {
+	var guest bool
+	err := tx.QueryRow(`
+SELECT email IS NULL AND facebook_id IS NULL AND google_id IS NULL AND gamecenter_id IS NULL
+    AND steam_id IS NULL AND custom_id IS NULL AND apple_id IS NULL
+FROM users WHERE id = $1 AND disabled_at = 0`, userID.Bytes()).Scan(&guest)
+	if err == sql.ErrNoRows {
+		return USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not upgrade guest, user query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+	if !guest {
+		return BAD_INPUT, errors.New("Only guest accounts with no login other than device IDs can be upgraded")
+	}
+
+	// Checked up front to give a clear error, the unique constraints still guard against concurrent claims.
+	var handleCount int64
+	if err = tx.QueryRow("SELECT COUNT(id) FROM users WHERE handle = $1 AND id <> $2", handle, userID.Bytes()).Scan(&handleCount); err != nil {
+		logger.Error("Could not upgrade guest, handle query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+	if handleCount != 0 {
+		return USER_HANDLE_INUSE, errors.New("Handle is in use")
+	}
+	var idCount int64
+	if err = tx.QueryRow("SELECT COUNT(id) FROM users WHERE "+column+" = $1", providerID).Scan(&idCount); err != nil {
+		logger.Error("Could not upgrade guest, provider ID query error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+	if idCount != 0 {
+		return USER_LINK_INUSE, errors.New("Provider ID is in use")
+	}
+
+	query := "UPDATE users SET handle = $2, " + column + " = $3, updated_at = $4"
+	params := []interface{}{userID.Bytes(), handle, providerID, nowMs()}
+	if len(password) != 0 {
+		query += ", password = $5"
+		params = append(params, password)
+	}
+	if _, err = tx.Exec(query+" WHERE id = $1", params...); err != nil {
+		if strings.HasSuffix(err.Error(), "violates unique constraint \"users_handle_key\"") {
+			return USER_HANDLE_INUSE, errors.New("Handle is in use")
+		} else if strings.Contains(err.Error(), "violates unique constraint") {
+			return USER_LINK_INUSE, errors.New("Provider ID is in use")
+		}
+		logger.Error("Could not upgrade guest, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not upgrade guest")
+	}
+
+	return 0, nil
+}
@@ -29,9 +29,9 @@ import (
 	"strings"
 )
 
-func leaderboardCreate(logger *zap.Logger, db *sql.DB, id []byte, sortOrder, resetSchedule, metadata string, authoritative bool) ([]byte, error) {
-	query := `INSERT INTO leaderboard (id, authoritative, sort_order, reset_schedule, metadata)
-	VALUES ($1, $2, $3, $4, $5)`
+func leaderboardCreate(logger *zap.Logger, db *sql.DB, id []byte, sortOrder, resetSchedule, metadata string, authoritative bool, groupID []byte) ([]byte, error) {
+	query := `INSERT INTO leaderboard (id, authoritative, sort_order, reset_schedule, metadata, group_id)
+	VALUES ($1, $2, $3, $4, $5, $6)`
 	params := []interface{}{}
 
 	// ID.
@@ -77,6 +77,21 @@ func leaderboardCreate(logger *zap.Logger, db *sql.DB, id []byte, sortOrder, res
 	}
 	params = append(params, metadataBytes)
 
+	// Group scope.
+	if len(groupID) != 0 {
+		var groupCount int64
+		if err := db.QueryRow("SELECT COUNT(id) FROM groups WHERE id = $1 AND disabled_at = 0", groupID).Scan(&groupCount); err != nil {
+			logger.Error("Could not look up leaderboard group", zap.Error(err))
+			return nil, err
+		}
+		if groupCount == 0 {
+			return nil, errors.New("Leaderboard group not found")
+		}
+		params = append(params, groupID)
+	} else {
+		params = append(params, nil)
+	}
+
 	res, err := db.Exec(query, params...)
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "violates unique constraint \"primary\"") {
@@ -94,7 +109,7 @@ func leaderboardCreate(logger *zap.Logger, db *sql.DB, id []byte, sortOrder, res
 	return params[0].([]byte), nil
 }
 
-func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, list *TLeaderboardRecordsList) ([]*LeaderboardRecord, []byte, Error_Code, error) {
+func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, caller uuid.UUID, list *TLeaderboardRecordsList) ([]*LeaderboardRecord, []byte, Error_Code, error) {
 	if len(list.LeaderboardId) == 0 {
 		return nil, nil, BAD_INPUT, errors.New("Leaderboard ID must be present")
 	}
@@ -116,15 +131,27 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 
 	var sortOrder int64
 	var resetSchedule sql.NullString
-	query := "SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1"
+	var groupID []byte
+	query := "SELECT sort_order, reset_schedule, group_id FROM leaderboard WHERE id = $1"
 	logger.Debug("Leaderboard lookup", zap.String("query", query))
 	err := db.QueryRow(query, list.LeaderboardId).
-		Scan(&sortOrder, &resetSchedule)
+		Scan(&sortOrder, &resetSchedule, &groupID)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records list metadata query", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
 
+	if len(groupID) != 0 && caller != uuid.Nil {
+		member, err := leaderboardGroupMember(db, groupID, caller)
+		if err != nil {
+			logger.Error("Could not check leaderboard group membership", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+		}
+		if !member {
+			return nil, nil, BAD_INPUT, errors.New("Leaderboard is restricted to group members")
+		}
+	}
+
 	currentExpiresAt := int64(0)
 	if resetSchedule.Valid {
 		expr, err := cronexpr.Parse(resetSchedule.String)
@@ -142,14 +169,13 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 	AND expires_at = $2`
 	params := []interface{}{list.LeaderboardId, currentExpiresAt}
 
-	returnCursor := true
 	switch list.Filter.(type) {
 	case *TLeaderboardRecordsList_OwnerId:
 		if incomingCursor != nil {
 			return nil, nil, BAD_INPUT, errors.New("Cursor not allowed with haystack query")
 		}
 		// Haystack queries are executed in a separate flow.
-		return loadLeaderboardRecordsHaystack(logger, db, caller, list, list.LeaderboardId, list.GetOwnerId(), currentExpiresAt, limit, sortOrder, query, params)
+		return loadLeaderboardRecordsHaystack(logger, db, rankCache, list.LeaderboardId, list.GetOwnerId(), currentExpiresAt, limit, sortOrder)
 	case *TLeaderboardRecordsList_OwnerIds:
 		if incomingCursor != nil {
 			return nil, nil, BAD_INPUT, errors.New("Cursor not allowed with batch filter query")
@@ -157,14 +183,8 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 		if len(list.GetOwnerIds().OwnerIds) < 1 || len(list.GetOwnerIds().OwnerIds) > 100 {
 			return nil, nil, BAD_INPUT, errors.New("Must be 1-100 owner IDs")
 		}
-		statements := []string{}
-		for _, ownerId := range list.GetOwnerIds().OwnerIds {
-			params = append(params, ownerId)
-			statements = append(statements, "$"+strconv.Itoa(len(params)))
-		}
-		query += " AND owner_id IN (" + strings.Join(statements, ", ") + ")"
-		// Never return a cursor with this filter type.
-		returnCursor = false
+		// Batch owner queries are executed in a separate flow, and never return a cursor.
+		return loadLeaderboardRecordsOwners(logger, db, rankCache, list.LeaderboardId, list.GetOwnerIds().OwnerIds, currentExpiresAt, sortOrder)
 	case *TLeaderboardRecordsList_Lang:
 		query += " AND lang = $3"
 		params = append(params, list.GetLang())
@@ -174,6 +194,37 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 	case *TLeaderboardRecordsList_Timezone:
 		query += " AND timezone = $3"
 		params = append(params, list.GetTimezone())
+	case *TLeaderboardRecordsList_Friends:
+		if caller == uuid.Nil {
+			return nil, nil, BAD_INPUT, errors.New("Friends filter requires a user")
+		}
+		query += " AND (owner_id = $3 OR owner_id IN (SELECT destination_id FROM user_edge WHERE source_id = $3 AND state = 0))"
+		params = append(params, caller.Bytes())
+	case *TLeaderboardRecordsList_GroupId:
+		filterGroupID := list.GetGroupId()
+		if caller != uuid.Nil {
+			// Records of private group members are only visible to other members.
+			var private bool
+			err = db.QueryRow("SELECT state = 1 FROM groups WHERE id = $1 AND disabled_at = 0", filterGroupID).Scan(&private)
+			if err == sql.ErrNoRows {
+				return nil, nil, BAD_INPUT, errors.New("Group not found")
+			} else if err != nil {
+				logger.Error("Could not check leaderboard filter group", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+			}
+			if private {
+				member, err := leaderboardGroupMember(db, filterGroupID, caller)
+				if err != nil {
+					logger.Error("Could not check leaderboard filter group membership", zap.Error(err))
+					return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+				}
+				if !member {
+					return nil, nil, BAD_INPUT, errors.New("Group is private")
+				}
+			}
+		}
+		query += " AND owner_id IN (SELECT destination_id FROM group_edge WHERE source_id = $3 AND state IN (0, 1))"
+		params = append(params, filterGroupID)
 	case nil:
 		// No filter.
 		break
@@ -185,15 +236,15 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 		count := len(params)
 		if sortOrder == 0 {
 			// Ascending leaderboard.
-			query += " AND (score, updated_at, id) > ($" + strconv.Itoa(count) +
-				", $" + strconv.Itoa(count+1) +
-				", $" + strconv.Itoa(count+2) + ")"
+			query += " AND (score, updated_at, id) > ($" + strconv.Itoa(count+1) +
+				", $" + strconv.Itoa(count+2) +
+				", $" + strconv.Itoa(count+3) + ")"
 			params = append(params, incomingCursor.Score, incomingCursor.UpdatedAt, incomingCursor.Id)
 		} else {
 			// Descending leaderboard.
-			query += " AND (score, updated_at_inverse, id) < ($" + strconv.Itoa(count) +
-				", $" + strconv.Itoa(count+1) +
-				", $" + strconv.Itoa(count+2) + ")"
+			query += " AND (score, updated_at_inverse, id) < ($" + strconv.Itoa(count+1) +
+				", $" + strconv.Itoa(count+2) +
+				", $" + strconv.Itoa(count+3) + ")"
 			params = append(params, incomingCursor.Score, invertMs(incomingCursor.UpdatedAt), incomingCursor.Id)
 		}
 	}
@@ -235,7 +286,7 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 	var expiresAt int64
 	var bannedAt int64
 	for rows.Next() {
-		if returnCursor && int64(len(leaderboardRecords)) >= limit {
+		if int64(len(leaderboardRecords)) >= limit {
 			cursorBuf := new(bytes.Buffer)
 			newCursor := &leaderboardRecordListCursor{
 				Score:     score,
@@ -278,81 +329,178 @@ func leaderboardRecordsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, li
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
 
+	// Prefer exact ranks from the rank cache where the leaderboard is cached.
+	ranked := true
+	for _, record := range leaderboardRecords {
+		if rank := rankCache.Get(list.LeaderboardId, currentExpiresAt, record.OwnerId); rank != 0 {
+			record.Rank = rank
+		} else {
+			ranked = false
+		}
+	}
+	if ranked {
+		return leaderboardRecords, outgoingCursor, 0, nil
+	}
+
 	return normalizeLeaderboardRecords(leaderboardRecords), outgoingCursor, 0, nil
 }
 
-func loadLeaderboardRecordsHaystack(logger *zap.Logger, db *sql.DB, caller uuid.UUID, list *TLeaderboardRecordsList, leaderboardId, findOwnerId []byte, currentExpiresAt, limit, sortOrder int64, query string, params []interface{}) ([]*LeaderboardRecord, []byte, Error_Code, error) {
-	// Find the owner's record.
-	var pivotID []byte
-	var pivotScore int64
-	var pivotUpdatedAt int64
-	findQuery := `SELECT id, score, updated_at
-		FROM leaderboard_record
-		WHERE leaderboard_id = $1
-		AND expires_at = $2
-		AND owner_id = $3`
-	logger.Debug("Leaderboard record find", zap.String("query", findQuery))
-	err := db.QueryRow(findQuery, leaderboardId, currentExpiresAt, findOwnerId).Scan(&pivotID, &pivotScore, &pivotUpdatedAt)
-	if err == sql.ErrNoRows {
-		return []*LeaderboardRecord{}, nil, 0, nil
-	} else if err != nil {
-		logger.Error("Could not load owner record in leaderboard records list haystack", zap.Error(err))
+// loadLeaderboardRecordsOwners returns the records of a set of owners, such as a party, with each owner's exact rank.
+// Ranks come from the rank cache when available, otherwise they are counted in the same query.
+func loadLeaderboardRecordsOwners(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, leaderboardId []byte, ownerIds [][]byte, currentExpiresAt, sortOrder int64) ([]*LeaderboardRecord, []byte, Error_Code, error) {
+	rankSql := "0"
+	order := "lr.score ASC, lr.updated_at ASC, lr.id ASC"
+	if sortOrder != 0 {
+		order = "lr.score DESC, lr.updated_at_inverse DESC, lr.id DESC"
+	}
+	if !rankCache.Has(leaderboardId, currentExpiresAt) {
+		better := "(b.score, b.updated_at, b.id) < (lr.score, lr.updated_at, lr.id)"
+		if sortOrder != 0 {
+			better = "(b.score, b.updated_at_inverse, b.id) > (lr.score, lr.updated_at_inverse, lr.id)"
+		}
+		rankSql = `(SELECT COUNT(b.id) + 1 FROM leaderboard_record AS b
+	    WHERE b.leaderboard_id = lr.leaderboard_id AND b.expires_at = lr.expires_at AND ` + better + `)`
+	}
+
+	params := []interface{}{leaderboardId, currentExpiresAt}
+	statements := []string{}
+	for _, ownerId := range ownerIds {
+		params = append(params, ownerId)
+		statements = append(statements, "$"+strconv.Itoa(len(params)))
+	}
+
+	query := `SELECT lr.owner_id, lr.handle, lr.lang, lr.location, lr.timezone,
+	  lr.score, lr.num_score, lr.metadata, lr.ranked_at, lr.updated_at, lr.expires_at, ` + rankSql + `
+	FROM leaderboard_record AS lr
+	WHERE lr.leaderboard_id = $1 AND lr.expires_at = $2 AND lr.owner_id IN (` + strings.Join(statements, ", ") + `)
+	ORDER BY ` + order
+
+	logger.Debug("Leaderboard records owners", zap.String("query", query))
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not execute leaderboard records owners query", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
+	defer rows.Close()
 
-	// First half.
-	count := len(params)
-	firstQuery := query
-	firstParams := make([]interface{}, count)
-	copy(firstParams, params)
+	leaderboardRecords := []*LeaderboardRecord{}
+	for rows.Next() {
+		record := &LeaderboardRecord{LeaderboardId: leaderboardId}
+		var location sql.NullString
+		var timezone sql.NullString
+		err = rows.Scan(&record.OwnerId, &record.Handle, &record.Lang, &location, &timezone,
+			&record.Score, &record.NumScore, &record.Metadata, &record.RankedAt, &record.UpdatedAt, &record.ExpiresAt, &record.Rank)
+		if err != nil {
+			logger.Error("Could not scan leaderboard records owners query results", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+		}
+		record.Location = location.String
+		record.Timezone = timezone.String
+		if rank := rankCache.Get(leaderboardId, currentExpiresAt, record.OwnerId); rank != 0 {
+			record.Rank = rank
+		}
+		leaderboardRecords = append(leaderboardRecords, record)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not process leaderboard records owners query results", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+	}
+
+	return leaderboardRecords, nil, 0, nil
+}
+
+// loadLeaderboardRecordsHaystack returns a page of records centered on the given owner's record. The owner's rank
+// is taken from the rank cache when available, otherwise it is counted from the score index in the same query as both
+// halves of the page, so ranks are exact and consistent.
+func loadLeaderboardRecordsHaystack(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, leaderboardId, findOwnerId []byte, currentExpiresAt, limit, sortOrder int64) ([]*LeaderboardRecord, []byte, Error_Code, error) {
+	columns := `lr.id, lr.owner_id, lr.handle, lr.lang, lr.location, lr.timezone,
+	  lr.score, lr.num_score, lr.metadata, lr.ranked_at, lr.updated_at, lr.expires_at`
+	pivot := `(SELECT id, score, updated_at, updated_at_inverse
+		FROM leaderboard_record
+		WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3) AS p`
+
+	// Records strictly better than the owner, records from the owner onwards, and the overall order of both.
+	var better, worse, betterOrder, worseOrder, order string
 	if sortOrder == 0 {
-		// Lower score is better, but get in reverse order from current user to get those immediately above.
-		firstQuery += " AND (score, updated_at_inverse, id) <= ($" + strconv.Itoa(count+1) +
-			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score DESC, updated_at_inverse DESC"
-		firstParams = append(firstParams, pivotScore, invertMs(pivotUpdatedAt), pivotID)
+		// Ascending leaderboard, lower score is better.
+		better = "(lr.score, lr.updated_at, lr.id) < (p.score, p.updated_at, p.id)"
+		worse = "(lr.score, lr.updated_at, lr.id) >= (p.score, p.updated_at, p.id)"
+		betterOrder = "lr.score DESC, lr.updated_at DESC, lr.id DESC"
+		worseOrder = "lr.score ASC, lr.updated_at ASC, lr.id ASC"
+		order = "h.score ASC, h.updated_at ASC, h.id ASC"
 	} else {
-		// Higher score is better.
-		firstQuery += " AND (score, updated_at, id) >= ($" + strconv.Itoa(count+1) +
-			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score ASC, updated_at ASC"
-		firstParams = append(firstParams, pivotScore, pivotUpdatedAt, pivotID)
+		// Descending leaderboard, higher score is better.
+		better = "(lr.score, lr.updated_at_inverse, lr.id) > (p.score, p.updated_at_inverse, p.id)"
+		worse = "(lr.score, lr.updated_at_inverse, lr.id) <= (p.score, p.updated_at_inverse, p.id)"
+		betterOrder = "lr.score ASC, lr.updated_at_inverse ASC, lr.id ASC"
+		worseOrder = "lr.score DESC, lr.updated_at_inverse DESC, lr.id DESC"
+		order = "h.score DESC, h.updated_at_inverse DESC, h.id DESC"
+	}
+
+	// Only count the owner's rank in the database if the leaderboard is not in the rank cache.
+	cachedRank := rankCache.Get(leaderboardId, currentExpiresAt, findOwnerId)
+	rankSql := "0"
+	if cachedRank == 0 {
+		rankSql = `(SELECT COUNT(lr.id) FROM leaderboard_record AS lr, ` + pivot + `
+	    WHERE lr.leaderboard_id = $1 AND lr.expires_at = $2 AND ` + better + `)`
 	}
-	firstParams = append(firstParams, limit)
-	firstQuery += " LIMIT $" + strconv.Itoa(len(firstParams))
 
-	logger.Debug("Leaderboard records list", zap.String("query", firstQuery))
-	firstRows, err := db.Query(firstQuery, firstParams...)
+	// Fetch enough on each side to fill the page even if the owner is near either end of the leaderboard, plus one
+	// extra record past the end to know if a cursor is needed.
+	query := `SELECT h.id, h.owner_id, h.handle, h.lang, h.location, h.timezone,
+	  h.score, h.num_score, h.metadata, h.ranked_at, h.updated_at, h.expires_at, ` + rankSql + `
+	FROM (
+	  (SELECT ` + columns + `, lr.updated_at_inverse FROM leaderboard_record AS lr, ` + pivot + `
+	    WHERE lr.leaderboard_id = $1 AND lr.expires_at = $2 AND ` + better + `
+	    ORDER BY ` + betterOrder + ` LIMIT $4)
+	  UNION ALL
+	  (SELECT ` + columns + `, lr.updated_at_inverse FROM leaderboard_record AS lr, ` + pivot + `
+	    WHERE lr.leaderboard_id = $1 AND lr.expires_at = $2 AND ` + worse + `
+	    ORDER BY ` + worseOrder + ` LIMIT $5)
+	) AS h
+	ORDER BY ` + order
+
+	logger.Debug("Leaderboard records haystack", zap.String("query", query))
+	rows, err := db.Query(query, leaderboardId, currentExpiresAt, findOwnerId, limit-1, limit+1)
 	if err != nil {
-		logger.Error("Could not execute leaderboard records list query", zap.Error(err))
+		logger.Error("Could not execute leaderboard records haystack query", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
-	defer firstRows.Close()
+	defer rows.Close()
 
 	leaderboardRecords := []*LeaderboardRecord{}
-
-	var id []byte
-	var ownerId []byte
-	var handle string
-	var lang string
-	var location sql.NullString
-	var timezone sql.NullString
-	var rankValue int64
-	var score int64
-	var numScore int64
-	var metadata []byte
-	var rankedAt int64
-	var updatedAt int64
-	var expiresAt int64
-	var bannedAt int64
-	for firstRows.Next() {
-		err = firstRows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
-			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt)
+	recordIDs := [][]byte{}
+	pivotIndex := -1
+	var pivotRank int64
+	for rows.Next() {
+		var id []byte
+		var ownerId []byte
+		var handle string
+		var lang string
+		var location sql.NullString
+		var timezone sql.NullString
+		var score int64
+		var numScore int64
+		var metadata []byte
+		var rankedAt int64
+		var updatedAt int64
+		var expiresAt int64
+		var betterCount int64
+		err = rows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
+			&score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &betterCount)
 		if err != nil {
-			logger.Error("Could not scan leaderboard records list query results", zap.Error(err))
+			logger.Error("Could not scan leaderboard records haystack query results", zap.Error(err))
 			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 		}
 
+		if bytes.Equal(ownerId, findOwnerId) {
+			pivotIndex = len(leaderboardRecords)
+			pivotRank = betterCount + 1
+			if cachedRank != 0 {
+				pivotRank = cachedRank
+			}
+		}
+		recordIDs = append(recordIDs, id)
 		leaderboardRecords = append(leaderboardRecords, &LeaderboardRecord{
 			LeaderboardId: leaderboardId,
 			OwnerId:       ownerId,
@@ -360,7 +508,6 @@ func loadLeaderboardRecordsHaystack(logger *zap.Logger, db *sql.DB, caller uuid.
 			Lang:          lang,
 			Location:      location.String,
 			Timezone:      timezone.String,
-			Rank:          rankValue,
 			Score:         score,
 			NumScore:      numScore,
 			Metadata:      metadata,
@@ -369,104 +516,204 @@ func loadLeaderboardRecordsHaystack(logger *zap.Logger, db *sql.DB, caller uuid.
 			ExpiresAt:     expiresAt,
 		})
 	}
-	if err = firstRows.Err(); err != nil {
-		logger.Error("Could not process leaderboard records list query results", zap.Error(err))
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not process leaderboard records haystack query results", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+	}
+
+	// The owner has no record in the current leaderboard period.
+	if pivotIndex == -1 {
+		return []*LeaderboardRecord{}, nil, 0, nil
+	}
+
+	// Ranks are contiguous around the owner's rank.
+	for i, record := range leaderboardRecords {
+		record.Rank = pivotRank + int64(i-pivotIndex)
+	}
+
+	// Center the page on the owner, shifting it if there are not enough records on one side.
+	start := int64(pivotIndex) - (limit-1)/2
+	if max := int64(len(leaderboardRecords)) - limit; start > max {
+		start = max
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + limit
+	if end > int64(len(leaderboardRecords)) {
+		end = int64(len(leaderboardRecords))
+	}
+
+	var outgoingCursor []byte
+	if end < int64(len(leaderboardRecords)) {
+		cursorBuf := new(bytes.Buffer)
+		newCursor := &leaderboardRecordListCursor{
+			Score:     leaderboardRecords[end-1].Score,
+			UpdatedAt: leaderboardRecords[end-1].UpdatedAt,
+			Id:        recordIDs[end-1],
+		}
+		if err = gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+			logger.Error("Error creating leaderboard records list cursor", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+		}
+		outgoingCursor = cursorBuf.Bytes()
+	}
+
+	return leaderboardRecords[start:end], outgoingCursor, 0, nil
+}
+
+func leaderboardRecordsListArchive(logger *zap.Logger, db *sql.DB, caller uuid.UUID, list *TLeaderboardRecordsListArchive) ([]*LeaderboardRecord, []byte, Error_Code, error) {
+	if len(list.LeaderboardId) == 0 {
+		return nil, nil, BAD_INPUT, errors.New("Leaderboard ID must be present")
+	}
+
+	limit := list.Limit
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	var incomingCursor *leaderboardRecordArchiveCursor
+	if len(list.Cursor) != 0 {
+		incomingCursor = &leaderboardRecordArchiveCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(list.Cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+	}
+
+	var sortOrder int64
+	var groupID []byte
+	err := db.QueryRow("SELECT sort_order, group_id FROM leaderboard WHERE id = $1", list.LeaderboardId).
+		Scan(&sortOrder, &groupID)
+	if err == sql.ErrNoRows {
+		return nil, nil, BAD_INPUT, errors.New("Leaderboard not found")
+	} else if err != nil {
+		logger.Error("Could not execute leaderboard archive list metadata query", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
 
-	// We went 'up' on the leaderboard, so reverse the first half of records.
-	for left, right := 0, len(leaderboardRecords)-1; left < right; left, right = left+1, right-1 {
-		leaderboardRecords[left], leaderboardRecords[right] = leaderboardRecords[right], leaderboardRecords[left]
+	if len(groupID) != 0 && caller != uuid.Nil {
+		member, err := leaderboardGroupMember(db, groupID, caller)
+		if err != nil {
+			logger.Error("Could not check leaderboard group membership", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+		}
+		if !member {
+			return nil, nil, BAD_INPUT, errors.New("Leaderboard is restricted to group members")
+		}
+	}
+
+	season := list.Season
+	if season == 0 {
+		err = db.QueryRow("SELECT expires_at FROM leaderboard_season WHERE leaderboard_id = $1 ORDER BY expires_at DESC LIMIT 1", list.LeaderboardId).
+			Scan(&season)
+		if err == sql.ErrNoRows {
+			return []*LeaderboardRecord{}, nil, 0, nil
+		} else if err != nil {
+			logger.Error("Could not execute leaderboard season lookup query", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
+		}
+	}
+
+	query := `SELECT id, owner_id, handle, lang, location, timezone, score, num_score, metadata, updated_at, expires_at
+	FROM leaderboard_record_archive
+	WHERE leaderboard_id = $1
+	AND expires_at = $2`
+	params := []interface{}{list.LeaderboardId, season}
+
+	rank := int64(1)
+	if incomingCursor != nil {
+		rank = incomingCursor.Rank
+		if sortOrder == 0 {
+			// Ascending leaderboard.
+			query += " AND (score, updated_at, id) > ($3, $4, $5)"
+			params = append(params, incomingCursor.Score, incomingCursor.UpdatedAt, incomingCursor.Id)
+		} else {
+			// Descending leaderboard.
+			query += " AND (score, updated_at_inverse, id) < ($3, $4, $5)"
+			params = append(params, incomingCursor.Score, invertMs(incomingCursor.UpdatedAt), incomingCursor.Id)
+		}
 	}
 
-	// Second half.
-	secondQuery := query
-	secondParams := make([]interface{}, count)
-	copy(secondParams, params)
 	if sortOrder == 0 {
-		// Lower score is better.
-		secondQuery += " AND (score, updated_at, id) > ($" + strconv.Itoa(count+1) +
-			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score ASC, updated_at ASC"
-		secondParams = append(secondParams, pivotScore, pivotUpdatedAt, pivotID)
+		query += " ORDER BY score ASC, updated_at ASC, id ASC"
 	} else {
-		// Higher score is better.
-		secondQuery += " AND (score, updated_at_inverse, id) < ($" + strconv.Itoa(count+1) +
-			", $" + strconv.Itoa(count+2) +
-			", $" + strconv.Itoa(count+3) + ") ORDER BY score DESC, updated_at DESC"
-		secondParams = append(secondParams, pivotScore, invertMs(pivotUpdatedAt), pivotID)
-	}
-	secondLimit := limit/2 + 2
-	if l := int64(len(leaderboardRecords)); l < limit/2 {
-		secondLimit = limit - l + 2
+		query += " ORDER BY score DESC, updated_at_inverse DESC, id DESC"
 	}
-	secondParams = append(secondParams, secondLimit)
-	secondQuery += " LIMIT $" + strconv.Itoa(len(secondParams))
 
-	logger.Debug("Leaderboard records list", zap.String("query", secondQuery))
-	secondRows, err := db.Query(secondQuery, secondParams...)
+	params = append(params, limit+1)
+	query += " LIMIT $" + strconv.Itoa(len(params))
+
+	logger.Debug("Leaderboard archive records list", zap.String("query", query))
+	rows, err := db.Query(query, params...)
 	if err != nil {
-		logger.Error("Could not execute leaderboard records list query", zap.Error(err))
+		logger.Error("Could not execute leaderboard archive records list query", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
-	defer secondRows.Close()
+	defer rows.Close()
 
+	leaderboardRecords := []*LeaderboardRecord{}
 	var outgoingCursor []byte
 
-	need := limit / 2
-	if l := int64(len(leaderboardRecords)); l < limit/2 {
-		need += limit/2 - l
-	}
-	for secondRows.Next() {
-		if need <= 0 {
+	var id []byte
+	var ownerId []byte
+	var handle string
+	var lang string
+	var location sql.NullString
+	var timezone sql.NullString
+	var score int64
+	var numScore int64
+	var metadata []byte
+	var updatedAt int64
+	var expiresAt int64
+	for rows.Next() {
+		if int64(len(leaderboardRecords)) >= limit {
 			cursorBuf := new(bytes.Buffer)
-			newCursor := &leaderboardRecordListCursor{
+			newCursor := &leaderboardRecordArchiveCursor{
 				Score:     score,
 				UpdatedAt: updatedAt,
 				Id:        id,
+				Rank:      rank,
 			}
-			if gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
-				logger.Error("Error creating leaderboard records list cursor", zap.Error(err))
+			if err = gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
+				logger.Error("Error creating leaderboard archive records list cursor", zap.Error(err))
 				return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 			}
 			outgoingCursor = cursorBuf.Bytes()
 			break
 		}
 
-		err = secondRows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone,
-			&rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt, &expiresAt, &bannedAt)
+		err = rows.Scan(&id, &ownerId, &handle, &lang, &location, &timezone, &score, &numScore, &metadata, &updatedAt, &expiresAt)
 		if err != nil {
-			logger.Error("Could not scan leaderboard records list query results", zap.Error(err))
+			logger.Error("Could not scan leaderboard archive records list query results", zap.Error(err))
 			return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 		}
 
+		// Archived seasons are final, so ranks follow directly from the sort order.
 		leaderboardRecords = append(leaderboardRecords, &LeaderboardRecord{
-			LeaderboardId: leaderboardId,
+			LeaderboardId: list.LeaderboardId,
 			OwnerId:       ownerId,
 			Handle:        handle,
 			Lang:          lang,
 			Location:      location.String,
 			Timezone:      timezone.String,
-			Rank:          rankValue,
+			Rank:          rank,
 			Score:         score,
 			NumScore:      numScore,
 			Metadata:      metadata,
-			RankedAt:      rankedAt,
+			RankedAt:      expiresAt,
 			UpdatedAt:     updatedAt,
 			ExpiresAt:     expiresAt,
 		})
-		need--
+		rank++
 	}
-	if err = secondRows.Err(); err != nil {
-		logger.Error("Could not process leaderboard records list query results", zap.Error(err))
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not process leaderboard archive records list query results", zap.Error(err))
 		return nil, nil, RUNTIME_EXCEPTION, errors.New("Error loading leaderboard records")
 	}
 
-	start := int64(len(leaderboardRecords)) - limit
-	if start < 0 {
-		start = 0
-	}
-	return normalizeLeaderboardRecords(leaderboardRecords[start:]), outgoingCursor, 0, nil
+	return leaderboardRecords, outgoingCursor, 0, nil
 }
 
 func normalizeLeaderboardRecords(records []*LeaderboardRecord) []*LeaderboardRecord {
@@ -484,14 +731,16 @@ func normalizeLeaderboardRecords(records []*LeaderboardRecord) []*LeaderboardRec
 	return records
 }
 
-func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller uuid.UUID, leaderboardID []byte, ownerID uuid.UUID, handle string, lang string, op string, value int64, location string, timezone string, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
+func leaderboardSubmit(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, caller uuid.UUID, leaderboardID []byte, ownerID uuid.UUID, handle string, lang string, op string, value int64, location string, timezone string, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
 	var authoritative bool
 	var sortOrder int64
 	var resetSchedule sql.NullString
-	query := "SELECT authoritative, sort_order, reset_schedule FROM leaderboard WHERE id = $1"
+	var groupID []byte
+	var tournament bool
+	query := "SELECT authoritative, sort_order, reset_schedule, group_id, EXISTS (SELECT id FROM tournament WHERE id = $1) FROM leaderboard WHERE id = $1"
 	logger.Debug("Leaderboard lookup", zap.String("query", query), zap.Any("leaderboard_id", leaderboardID))
 	err := db.QueryRow(query, leaderboardID).
-		Scan(&authoritative, &sortOrder, &resetSchedule)
+		Scan(&authoritative, &sortOrder, &resetSchedule, &groupID, &tournament)
 	if err != nil {
 		logger.Error("Could not execute leaderboard record write metadata query", zap.Error(err))
 		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
@@ -513,7 +762,30 @@ func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller uuid.UUID, leaderb
 		return nil, BAD_INPUT, errors.New("Cannot submit to authoritative leaderboard")
 	}
 
+	if tournament && caller != uuid.Nil {
+		// Tournament windows and membership are checked by tournament record writes.
+		return nil, BAD_INPUT, errors.New("Use tournament record write to submit to a tournament")
+	}
+
+	if len(groupID) != 0 && caller != uuid.Nil {
+		member, err := leaderboardGroupMember(db, groupID, caller)
+		if err != nil {
+			logger.Error("Could not check leaderboard group membership", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+		if !member {
+			return nil, BAD_INPUT, errors.New("Leaderboard is restricted to group members")
+		}
+	}
+
+	if op == "metadata" {
+		return leaderboardRecordMetadataUpdate(logger, db, rankCache, leaderboardID, ownerID, expiresAt, metadata)
+	}
+
+	// Each operator is applied inside the upsert itself, so concurrent submissions for the same owner never lose updates.
 	var scoreOpSql string
+	// Only a changed score moves the record's position among equal scores.
+	updatedAtSql := "updated_at = $13, updated_at_inverse = $14"
 	var scoreDelta int64
 	var scoreAbs int64
 	switch op {
@@ -530,13 +802,18 @@ func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller uuid.UUID, leaderb
 		scoreDelta = value
 		scoreAbs = value
 	case "best":
+		var improvedSql string
 		if sortOrder == 0 {
 			// Lower score is better.
 			scoreOpSql = "score = ((leaderboard_record.score + $17::BIGINT - abs(leaderboard_record.score - $17::BIGINT)) / 2)::BIGINT"
+			improvedSql = "$17::BIGINT < leaderboard_record.score"
 		} else {
 			// Higher score is better.
 			scoreOpSql = "score = ((leaderboard_record.score + $17::BIGINT + abs(leaderboard_record.score - $17::BIGINT)) / 2)::BIGINT"
+			improvedSql = "$17::BIGINT > leaderboard_record.score"
 		}
+		updatedAtSql = "updated_at = CASE WHEN " + improvedSql + " THEN $13 ELSE leaderboard_record.updated_at END, " +
+			"updated_at_inverse = CASE WHEN " + improvedSql + " THEN $14 ELSE leaderboard_record.updated_at_inverse END"
 		scoreDelta = value
 		scoreAbs = value
 	default:
@@ -564,49 +841,86 @@ func leaderboardSubmit(logger *zap.Logger, db *sql.DB, caller uuid.UUID, leaderb
 
 	query = `INSERT INTO leaderboard_record (id, leaderboard_id, owner_id, handle, lang, location, timezone,
 				rank_value, score, num_score, metadata, ranked_at, updated_at, updated_at_inverse, expires_at, banned_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, '{}'), $12, $13, $14, $15, $16)
+			SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11, '{}'), $12, $13, $14, $15, $16
+			WHERE EXISTS (SELECT id FROM leaderboard WHERE id = $2)
 			ON CONFLICT (leaderboard_id, expires_at, owner_id)
 			DO UPDATE SET handle = $4, lang = $5, location = COALESCE($6, leaderboard_record.location),
 			  timezone = COALESCE($7, leaderboard_record.timezone), ` + scoreOpSql + `, num_score = leaderboard_record.num_score + 1,
-			  metadata = COALESCE($11, leaderboard_record.metadata), updated_at = $13`
+			  metadata = COALESCE($11, leaderboard_record.metadata), ` + updatedAtSql + `
+			RETURNING id, location, timezone, rank_value, score, num_score, metadata, ranked_at, updated_at`
 	logger.Debug("Leaderboard record write", zap.String("query", query))
-	res, err := db.Exec(query, params...)
-	if err != nil {
+
+	// The resulting record is returned by the same statement, so it reflects exactly this submission.
+	var recordID []byte
+	var resultLocation sql.NullString
+	var resultTimezone sql.NullString
+	var rankValue int64
+	var score int64
+	var numScore int64
+	var resultMetadata []byte
+	var rankedAt int64
+	err = db.QueryRow(query, params...).
+		Scan(&recordID, &resultLocation, &resultTimezone, &rankValue, &score, &numScore, &resultMetadata, &rankedAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		// The leaderboard was deleted since it was looked up.
+		return nil, BAD_INPUT, errors.New("Leaderboard not found")
+	} else if err != nil {
 		logger.Error("Could not execute leaderboard record write query", zap.Error(err))
 		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
 	}
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		logger.Error("Unexpected row count from leaderboard record write query")
-		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
-	}
 
-	record, err := leaderboardQueryRecords(logger, db, leaderboardID, ownerID, handle, lang, expiresAt, updatedAt)
-	if err != nil {
-		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	if rank := rankCache.Set(leaderboardID, expiresAt, sortOrder, ownerID.Bytes(), recordID, score, updatedAt, numScore); rank != 0 {
+		rankValue = rank
 	}
-	return record, 0, nil
+
+	return &LeaderboardRecord{
+		LeaderboardId: leaderboardID,
+		OwnerId:       ownerID.Bytes(),
+		Handle:        handle,
+		Lang:          lang,
+		Location:      resultLocation.String,
+		Timezone:      resultTimezone.String,
+		Rank:          rankValue,
+		Score:         score,
+		NumScore:      numScore,
+		Metadata:      resultMetadata,
+		RankedAt:      rankedAt,
+		UpdatedAt:     updatedAt,
+		ExpiresAt:     expiresAt,
+	}, 0, nil
 }
 
-func leaderboardQueryRecords(logger *zap.Logger, db *sql.DB, leaderboardID []byte, ownerID uuid.UUID, handle string, lang string, expiresAt int64, updatedAt int64) (*LeaderboardRecord, error) {
+// leaderboardRecordMetadataUpdate replaces the metadata of the owner's record in the current period. It never creates
+// a record, and leaves the score and update time untouched so the record keeps its rank.
+func leaderboardRecordMetadataUpdate(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, leaderboardID []byte, ownerID uuid.UUID, expiresAt int64, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
+	if len(metadata) == 0 {
+		return nil, BAD_INPUT, errors.New("Metadata must be present")
+	}
+
+	var handle string
+	var lang string
 	var location sql.NullString
 	var timezone sql.NullString
 	var rankValue int64
 	var score int64
 	var numScore int64
-	var metadata []byte
 	var rankedAt int64
-	var bannedAt int64
-	query := `SELECT location, timezone, rank_value, score, num_score, metadata, ranked_at, banned_at
-		FROM leaderboard_record
-		WHERE leaderboard_id = $1
-		AND expires_at = $2
-		AND owner_id = $3`
-	logger.Debug("Leaderboard record read", zap.String("query", query))
-	err := db.QueryRow(query, leaderboardID, expiresAt, ownerID.Bytes()).
-		Scan(&location, &timezone, &rankValue, &score, &numScore, &metadata, &rankedAt, &bannedAt)
-	if err != nil {
-		logger.Error("Could not execute leaderboard record read query", zap.Error(err))
-		return nil, err
+	var updatedAt int64
+	query := `UPDATE leaderboard_record SET metadata = $4
+		WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3
+		RETURNING handle, lang, location, timezone, rank_value, score, num_score, metadata, ranked_at, updated_at`
+	logger.Debug("Leaderboard record metadata update", zap.String("query", query))
+	err := db.QueryRow(query, leaderboardID, expiresAt, ownerID.Bytes(), metadata).
+		Scan(&handle, &lang, &location, &timezone, &rankValue, &score, &numScore, &metadata, &rankedAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, BAD_INPUT, errors.New("Leaderboard record not found")
+	} else if err != nil {
+		logger.Error("Could not execute leaderboard record metadata update query", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+
+	if rank := rankCache.Get(leaderboardID, expiresAt, ownerID.Bytes()); rank != 0 {
+		rankValue = rank
 	}
 
 	return &LeaderboardRecord{
@@ -623,5 +937,458 @@ func leaderboardQueryRecords(logger *zap.Logger, db *sql.DB, leaderboardID []byt
 		RankedAt:      rankedAt,
 		UpdatedAt:     updatedAt,
 		ExpiresAt:     expiresAt,
-	}, nil
+	}, 0, nil
+}
+
+// Number of records removed in each transaction by leaderboard deletes and prunes, to avoid holding long locks.
+const leaderboardDeleteBatchSize = 1000
+
+// leaderboardRecordsDeleteBatched repeatedly deletes batches of records matching the given condition until none are left.
+// The condition may refer to the leaderboard ID as $1, and to the given params from $2 onwards.
+func leaderboardRecordsDeleteBatched(db *sql.DB, rankCache *LeaderboardRankCache, leaderboardID []byte, condition string, params ...interface{}) (int64, error) {
+	batchParams := append([]interface{}{leaderboardID}, params...)
+	batchParams = append(batchParams, leaderboardDeleteBatchSize)
+	query := `DELETE FROM leaderboard_record WHERE id IN (
+	SELECT id FROM leaderboard_record WHERE leaderboard_id = $1 AND ` + condition + ` LIMIT $` + strconv.Itoa(len(batchParams)) + `)
+RETURNING owner_id, expires_at`
+
+	var total int64
+	for {
+		rows, err := db.Query(query, batchParams...)
+		if err != nil {
+			return total, err
+		}
+		var count int64
+		for rows.Next() {
+			var ownerID []byte
+			var expiresAt int64
+			if err = rows.Scan(&ownerID, &expiresAt); err != nil {
+				rows.Close()
+				return total, err
+			}
+			rankCache.Delete(leaderboardID, expiresAt, ownerID)
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return total, err
+		}
+
+		total += count
+		if count < leaderboardDeleteBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// leaderboardDelete removes a leaderboard with all its records, archived seasons and tournament data. The leaderboard
+// itself goes first, so submissions are turned away before its records are swept. If the sweep fails, deleting the
+// leaderboard again removes the records left behind.
+func leaderboardDelete(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, leaderboardID []byte) error {
+	found, err := leaderboardDeleteRow(logger, db, leaderboardID)
+	if err != nil {
+		return err
+	}
+	rankCache.DeleteLeaderboard(leaderboardID)
+
+	deleted, err := leaderboardRecordsDeleteBatched(db, rankCache, leaderboardID, "TRUE")
+	if err != nil {
+		logger.Error("Could not delete leaderboard records", zap.Error(err))
+		return err
+	}
+
+	// Archived records are removed in batches too, the remaining rows are small.
+	var archived int64
+	for {
+		res, err := db.Exec(`DELETE FROM leaderboard_record_archive WHERE id IN (
+	SELECT id FROM leaderboard_record_archive WHERE leaderboard_id = $1 LIMIT $2)`, leaderboardID, leaderboardDeleteBatchSize)
+		if err != nil {
+			logger.Error("Could not delete leaderboard archived records", zap.Error(err))
+			return err
+		}
+		rowsAffected, _ := res.RowsAffected()
+		archived += rowsAffected
+		if rowsAffected < leaderboardDeleteBatchSize {
+			break
+		}
+	}
+
+	if !found && deleted == 0 && archived == 0 {
+		return errors.New("Leaderboard not found")
+	}
+	logger.Info("Deleted leaderboard", zap.String("id", string(leaderboardID)), zap.Int64("records", deleted))
+	return nil
+}
+
+// leaderboardDeleteRow deletes the leaderboard along with its seasons and tournament data, and reports whether it
+// still existed.
+func leaderboardDeleteRow(logger *zap.Logger, db *sql.DB, leaderboardID []byte) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not delete leaderboard, begin error", zap.Error(err))
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not delete leaderboard, rollback error", zap.Error(e))
+			}
+		} else {
+			if err = tx.Commit(); err != nil {
+				logger.Error("Could not delete leaderboard, commit error", zap.Error(err))
+			}
+		}
+	}()
+
+	for _, query := range []string{
+		"DELETE FROM leaderboard_season WHERE leaderboard_id = $1",
+		"DELETE FROM tournament_member WHERE tournament_id = $1",
+		"DELETE FROM tournament WHERE id = $1",
+		"UPDATE leaderboard SET next_id = NULL WHERE next_id = $1",
+		"UPDATE leaderboard SET prev_id = NULL WHERE prev_id = $1",
+	} {
+		if _, err = tx.Exec(query, leaderboardID); err != nil {
+			logger.Error("Could not delete leaderboard", zap.Error(err))
+			return false, err
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM leaderboard WHERE id = $1", leaderboardID)
+	if err != nil {
+		logger.Error("Could not delete leaderboard", zap.Error(err))
+		return false, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected != 0, nil
+}
+
+// leaderboardRecordsPrune deletes records last updated before olderThan, and records in the current period ranked
+// worse than belowRank. Either condition is skipped if 0.
+func leaderboardRecordsPrune(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, leaderboardID []byte, olderThan int64, belowRank int64) (int64, error) {
+	if olderThan < 0 || belowRank < 0 {
+		return 0, errors.New("Prune thresholds must be 0 or greater")
+	}
+
+	var sortOrder int64
+	var resetSchedule sql.NullString
+	err := db.QueryRow("SELECT sort_order, reset_schedule FROM leaderboard WHERE id = $1", leaderboardID).Scan(&sortOrder, &resetSchedule)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("Leaderboard not found")
+	} else if err != nil {
+		logger.Error("Could not look up leaderboard to prune", zap.Error(err))
+		return 0, err
+	}
+
+	var total int64
+	if olderThan > 0 {
+		deleted, err := leaderboardRecordsDeleteBatched(db, rankCache, leaderboardID, "updated_at < $2", olderThan)
+		total += deleted
+		if err != nil {
+			logger.Error("Could not prune old leaderboard records", zap.Error(err))
+			return total, err
+		}
+	}
+
+	if belowRank > 0 {
+		currentExpiresAt := int64(0)
+		if resetSchedule.Valid {
+			expr, err := cronexpr.Parse(resetSchedule.String)
+			if err != nil {
+				logger.Error("Could not parse leaderboard reset schedule", zap.Error(err))
+				return total, err
+			}
+			currentExpiresAt = timeToMs(expr.Next(now()))
+		}
+
+		// Find the last record that is kept, everything ranked after it is removed.
+		var worse string
+		var order string
+		if sortOrder == 0 {
+			worse = "expires_at = $2 AND (score, updated_at, id) > ($3, $4, $5)"
+			order = "score ASC, updated_at ASC, id ASC"
+		} else {
+			worse = "expires_at = $2 AND (score, updated_at_inverse, id) < ($3, $4, $5)"
+			order = "score DESC, updated_at_inverse DESC, id DESC"
+		}
+		var score int64
+		var updatedAt int64
+		var id []byte
+		err = db.QueryRow(`SELECT score, updated_at, id FROM leaderboard_record
+WHERE leaderboard_id = $1 AND expires_at = $2
+ORDER BY `+order+` LIMIT 1 OFFSET $3`, leaderboardID, currentExpiresAt, belowRank-1).Scan(&score, &updatedAt, &id)
+		if err == sql.ErrNoRows {
+			// Fewer records than the rank threshold.
+			return total, nil
+		} else if err != nil {
+			logger.Error("Could not find leaderboard prune rank boundary", zap.Error(err))
+			return total, err
+		}
+
+		if sortOrder != 0 {
+			updatedAt = invertMs(updatedAt)
+		}
+		deleted, err := leaderboardRecordsDeleteBatched(db, rankCache, leaderboardID, worse, currentExpiresAt, score, updatedAt, id)
+		total += deleted
+		if err != nil {
+			logger.Error("Could not prune low ranked leaderboard records", zap.Error(err))
+			return total, err
+		}
+	}
+
+	logger.Info("Pruned leaderboard records", zap.String("id", string(leaderboardID)), zap.Int64("records", total))
+	return total, nil
+}
+
+// leaderboardLimitsSet configures the submission bounds used to screen client score submissions.
+func leaderboardLimitsSet(logger *zap.Logger, db *sql.DB, leaderboardID []byte, minDelta *int64, maxDelta *int64, maxSubmitRate int64) error {
+	if minDelta != nil && maxDelta != nil && *minDelta > *maxDelta {
+		return errors.New("Minimum delta must not be greater than maximum delta")
+	}
+
+	res, err := db.Exec("UPDATE leaderboard SET min_delta = $2, max_delta = $3, max_submit_rate = $4 WHERE id = $1",
+		leaderboardID, minDelta, maxDelta, maxSubmitRate)
+	if err != nil {
+		logger.Error("Could not set leaderboard limits", zap.Error(err))
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return errors.New("Leaderboard not found")
+	}
+	return nil
+}
+
+// leaderboardSubmitScreen checks a client score submission against the leaderboard's submission bounds, rate limit and
+// the runtime submit function. Rejected submissions are logged for review.
+func leaderboardSubmitScreen(logger *zap.Logger, db *sql.DB, runtime *Runtime, session *session, leaderboardID []byte, op string, value int64) (Error_Code, error) {
+	var minDelta sql.NullInt64
+	var maxDelta sql.NullInt64
+	var maxSubmitRate int64
+	var resetSchedule sql.NullString
+	var sortOrder int64
+	err := db.QueryRow("SELECT min_delta, max_delta, max_submit_rate, reset_schedule, sort_order FROM leaderboard WHERE id = $1", leaderboardID).
+		Scan(&minDelta, &maxDelta, &maxSubmitRate, &resetSchedule, &sortOrder)
+	if err == sql.ErrNoRows {
+		// Let the submission itself report the missing leaderboard.
+		return 0, nil
+	} else if err != nil {
+		logger.Error("Could not load leaderboard submission limits", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+	}
+
+	var currentScore int64
+	hasRecord := false
+	if minDelta.Valid || maxDelta.Valid || runtime.GetRuntimeCallback(LEADERBOARD_SUBMIT, "") != nil {
+		expiresAt := int64(0)
+		if resetSchedule.Valid {
+			expr, err := cronexpr.Parse(resetSchedule.String)
+			if err != nil {
+				logger.Error("Could not parse leaderboard reset schedule", zap.Error(err))
+				return RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+			}
+			expiresAt = timeToMs(expr.Next(now()))
+		}
+		err = db.QueryRow("SELECT score FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2 AND owner_id = $3",
+			leaderboardID, expiresAt, session.userID.Bytes()).Scan(&currentScore)
+		if err != nil && err != sql.ErrNoRows {
+			logger.Error("Could not load current leaderboard record score", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+		hasRecord = err == nil
+	}
+
+	delta := value
+	switch op {
+	case "decr":
+		delta = 0 - value
+	case "set", "best":
+		delta = value - currentScore
+	}
+	// A best score submission that does not beat the current best leaves the stored score alone, so it can't be out of bounds.
+	unchanged := op == "best" && hasRecord && ((sortOrder == 0 && value >= currentScore) || (sortOrder != 0 && value <= currentScore))
+	if !unchanged && ((minDelta.Valid && delta < minDelta.Int64) || (maxDelta.Valid && delta > maxDelta.Int64)) {
+		return leaderboardSubmitReject(logger, db, leaderboardID, session.userID, op, value, "Score change out of bounds")
+	}
+
+	if maxSubmitRate > 0 {
+		// Count submissions in fixed one minute windows, starting a new window once the previous one is over.
+		ts := nowMs()
+		var count int64
+		err = db.QueryRow(`
+INSERT INTO leaderboard_submit_rate (leaderboard_id, owner_id, window_start, count) VALUES ($1, $2, $3, 1)
+ON CONFLICT (leaderboard_id, owner_id) DO UPDATE SET
+	count = CASE WHEN leaderboard_submit_rate.window_start <= $3 - 60000 THEN 1 ELSE leaderboard_submit_rate.count + 1 END,
+	window_start = CASE WHEN leaderboard_submit_rate.window_start <= $3 - 60000 THEN $3 ELSE leaderboard_submit_rate.window_start END
+RETURNING count`, leaderboardID, session.userID.Bytes(), ts).Scan(&count)
+		if err != nil {
+			logger.Error("Could not update leaderboard submission rate", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+		if count > maxSubmitRate {
+			return leaderboardSubmitReject(logger, db, leaderboardID, session.userID, op, value, "Too many submissions")
+		}
+	}
+
+	if fn := runtime.GetRuntimeCallback(LEADERBOARD_SUBMIT, ""); fn != nil {
+		accepted, err := runtime.InvokeFunctionLeaderboardSubmit(fn, session.userID, session.handle.Load(), session.expiry.Load(), map[string]interface{}{
+			"LeaderboardId": string(leaderboardID),
+			"OwnerId":       session.userID.String(),
+			"Op":            op,
+			"Value":         value,
+			"CurrentScore":  currentScore,
+		})
+		if err != nil {
+			logger.Error("Runtime leaderboard submit function caused an error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Error writing leaderboard record")
+		}
+		if !accepted {
+			return leaderboardSubmitReject(logger, db, leaderboardID, session.userID, op, value, "Rejected by runtime")
+		}
+	}
+
+	return 0, nil
+}
+
+// leaderboardSubmitReject records a rejected submission for review and returns the rejection error.
+func leaderboardSubmitReject(logger *zap.Logger, db *sql.DB, leaderboardID []byte, ownerID uuid.UUID, op string, value int64, reason string) (Error_Code, error) {
+	logger.Warn("Rejected leaderboard score submission", zap.String("leaderboard_id", string(leaderboardID)),
+		zap.String("owner_id", ownerID.String()), zap.String("op", op), zap.Int64("value", value), zap.String("reason", reason))
+
+	_, err := db.Exec(`
+INSERT INTO leaderboard_record_flag (id, leaderboard_id, owner_id, op, value, reason, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, uuid.NewV4().Bytes(), leaderboardID, ownerID.Bytes(), op, value, reason, nowMs())
+	if err != nil {
+		logger.Error("Could not record rejected leaderboard score submission", zap.Error(err))
+	}
+
+	return LEADERBOARD_SCORE_REJECTED, errors.New(reason)
+}
+
+// leaderboardGroupMember checks if the user is an active member or admin of the group that owns a leaderboard.
+func leaderboardGroupMember(db *sql.DB, groupID []byte, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := db.QueryRow(`
+SELECT COUNT(source_id) FROM group_edge
+WHERE
+	source_id = $1 AND destination_id = $2 AND state IN (0, 1)
+AND
+	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)`, groupID, userID.Bytes()).Scan(&count)
+	return count != 0, err
+}
+
+// leaderboardsGroupRemove deletes all leaderboards and records scoped to a group that is being removed.
+func leaderboardsGroupRemove(tx *sql.Tx, groupID []byte) error {
+	_, err := tx.Exec("DELETE FROM leaderboard_record WHERE leaderboard_id IN (SELECT id FROM leaderboard WHERE group_id = $1)", groupID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM leaderboard_record_archive WHERE leaderboard_id IN (SELECT id FROM leaderboard WHERE group_id = $1)", groupID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM leaderboard_season WHERE leaderboard_id IN (SELECT id FROM leaderboard WHERE group_id = $1)", groupID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM leaderboard WHERE group_id = $1", groupID)
+	return err
+}
+
+// LeaderboardsList returns a page of leaderboards in ID order, optionally only those with the given IDs. Group
+// leaderboards are only listed if the caller is a member of the group, a nil caller means the runtime and sees all.
+func LeaderboardsList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, filterIDs [][]byte, limit int64, cursor []byte) ([]*Leaderboard, []byte, Error_Code, error) {
+	query := "SELECT id, authoritative, sort_order, count, reset_schedule, metadata, next_id, prev_id, group_id FROM leaderboard WHERE true"
+	params := []interface{}{}
+
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		query += " AND (group_id IS NULL OR EXISTS (SELECT source_id FROM group_edge WHERE source_id = leaderboard.group_id AND destination_id = $1 AND state IN (0, 1)))"
+	}
+
+	if len(cursor) != 0 {
+		var incomingCursor leaderboardCursor
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(&incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		params = append(params, incomingCursor.Id)
+		query += " AND id > $" + strconv.Itoa(len(params))
+	}
+
+	if len(filterIDs) != 0 {
+		statements := make([]string, 0, len(filterIDs))
+		for _, filterID := range filterIDs {
+			params = append(params, filterID)
+			statements = append(statements, "$"+strconv.Itoa(len(params)))
+		}
+		query += " AND id IN (" + strings.Join(statements, ", ") + ")"
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY id LIMIT $" + strconv.Itoa(len(params))
+
+	logger.Debug("Leaderboards list", zap.String("query", query))
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not execute leaderboards list query", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list leaderboards")
+	}
+	defer rows.Close()
+
+	leaderboards := []*Leaderboard{}
+	var outgoingCursor []byte
+
+	var id []byte
+	var authoritative bool
+	var sortOrder int64
+	var count int64
+	var resetSchedule sql.NullString
+	var metadata []byte
+	var nextId []byte
+	var prevId []byte
+	var groupId []byte
+	for rows.Next() {
+		if int64(len(leaderboards)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&leaderboardCursor{Id: id}); err != nil {
+				logger.Error("Error creating leaderboards list cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list leaderboards")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		if err = rows.Scan(&id, &authoritative, &sortOrder, &count, &resetSchedule, &metadata, &nextId, &prevId, &groupId); err != nil {
+			logger.Error("Could not scan leaderboards list query results", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list leaderboards")
+		}
+
+		leaderboards = append(leaderboards, &Leaderboard{
+			Id:            id,
+			Authoritative: authoritative,
+			Sort:          sortOrder,
+			Count:         count,
+			ResetSchedule: resetSchedule.String,
+			Metadata:      metadata,
+			NextId:        nextId,
+			PrevId:        prevId,
+			GroupId:       groupId,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not process leaderboards list query results", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list leaderboards")
+	}
+
+	return leaderboards, outgoingCursor, 0, nil
+}
+
+// LeaderboardAuthoritativeSet changes whether only the runtime may submit records to the leaderboard, rather than
+// clients. It returns false if the leaderboard does not exist.
+func LeaderboardAuthoritativeSet(db *sql.DB, id []byte, authoritative bool) (bool, error) {
+	res, err := db.Exec("UPDATE leaderboard SET authoritative = $2 WHERE id = $1", id, authoritative)
+	if err != nil {
+		return false, err
+	}
+	count, _ := res.RowsAffected()
+	return count == 1, nil
 }
@@ -0,0 +1,171 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+type matchReplayCursor struct {
+	CreatedAt int64
+	MatchID   []byte
+}
+
+type matchReplayFrameCursor struct {
+	Seq int64
+}
+
+// MatchReplayList lists replays of recorded matches the user was in, most recent first.
+func MatchReplayList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, limit int64, cursor []byte) ([]*MatchReplay, []byte, Error_Code, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	query := `
+SELECT r.id, r.creator_id, r.frame_count, r.created_at, r.updated_at
+FROM match_replay_user u
+JOIN match_replay r ON r.id = u.match_id
+WHERE u.user_id = $1`
+	params := []interface{}{caller.Bytes()}
+
+	if len(cursor) != 0 {
+		incomingCursor := &matchReplayCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		query += " AND (u.created_at, u.match_id) < ($2, $3)"
+		params = append(params, incomingCursor.CreatedAt, incomingCursor.MatchID)
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY u.created_at DESC, u.match_id DESC LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not list match replays, query error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list match replays")
+	}
+	defer rows.Close()
+
+	replays := make([]*MatchReplay, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		if int64(len(replays)) >= limit {
+			last := replays[len(replays)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&matchReplayCursor{CreatedAt: last.CreatedAt, MatchID: last.MatchId}); err != nil {
+				logger.Error("Could not create match replay cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list match replays")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		replay := &MatchReplay{}
+		if err = rows.Scan(&replay.MatchId, &replay.CreatorId, &replay.FrameCount, &replay.CreatedAt, &replay.UpdatedAt); err != nil {
+			logger.Error("Could not list match replays, scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list match replays")
+		}
+		replays = append(replays, replay)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not list match replays, rows error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list match replays")
+	}
+
+	return replays, outgoingCursor, 0, nil
+}
+
+// MatchReplayDownload fetches a page of a match replay's frames in the order they were relayed. Only users who were
+// in the match may download its replay.
+func MatchReplayDownload(logger *zap.Logger, db *sql.DB, caller uuid.UUID, matchID uuid.UUID, limit int64, cursor []byte) ([]*MatchReplayFrame, []byte, Error_Code, error) {
+	replayLogger := logger.With(zap.String("match_id", matchID.String()))
+
+	if limit == 0 {
+		limit = 100
+	} else if limit < 10 || limit > 1000 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 1000")
+	}
+
+	// If the caller is not the script runtime, only users who were in the match may download the replay.
+	if caller != uuid.Nil {
+		var userCount int64
+		err := db.QueryRow("SELECT COUNT(user_id) FROM match_replay_user WHERE match_id = $1 AND user_id = $2", matchID.Bytes(), caller.Bytes()).Scan(&userCount)
+		if err != nil {
+			replayLogger.Error("Could not download match replay, user query error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not download match replay")
+		}
+		if userCount == 0 {
+			return nil, nil, MATCH_NOT_FOUND, errors.New("Match replay not found")
+		}
+	}
+
+	var seq int64
+	if len(cursor) != 0 {
+		incomingCursor := &matchReplayFrameCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		seq = incomingCursor.Seq
+	}
+
+	rows, err := db.Query(`
+SELECT seq, user_id, session_id, handle, op_code, data, created_at
+FROM match_replay_frame
+WHERE match_id = $1 AND seq >= $2
+ORDER BY seq ASC
+LIMIT $3`, matchID.Bytes(), seq, limit+1)
+	if err != nil {
+		replayLogger.Error("Could not download match replay, query error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not download match replay")
+	}
+	defer rows.Close()
+
+	frames := make([]*MatchReplayFrame, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		frame := &MatchReplayFrame{Presence: &UserPresence{}}
+		if err = rows.Scan(&seq, &frame.Presence.UserId, &frame.Presence.SessionId, &frame.Presence.Handle, &frame.OpCode, &frame.Data, &frame.CreatedAt); err != nil {
+			replayLogger.Error("Could not download match replay, scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not download match replay")
+		}
+
+		if int64(len(frames)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&matchReplayFrameCursor{Seq: seq}); err != nil {
+				replayLogger.Error("Could not create match replay cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not download match replay")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+		frames = append(frames, frame)
+	}
+	if err = rows.Err(); err != nil {
+		replayLogger.Error("Could not download match replay, rows error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not download match replay")
+	}
+
+	return frames, outgoingCursor, 0, nil
+}
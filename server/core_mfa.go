@@ -0,0 +1,268 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Codes are TOTP as in RFC 6238, the parameters most authenticator apps assume.
+const (
+	mfaStepMs        = 30000
+	mfaSecretBytes   = 20
+	mfaRecoveryCount = 10
+	// 5 bytes encode to 8 base32 characters without padding.
+	mfaRecoveryBytes = 5
+)
+
+var errorInvalidMfaCode = errors.New("Invalid multi-factor authentication code")
+
+// mfaCode returns the 6 digit code for the time step.
+func mfaCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// mfaMatch returns the time step the code belongs to, allowing for a step of clock drift either way, or -1 if it does
+// not match.
+func mfaMatch(secret []byte, code string, ts int64) int64 {
+	counter := ts / mfaStepMs
+	for _, c := range []int64{counter, counter - 1, counter + 1} {
+		if subtle.ConstantTimeCompare([]byte(mfaCode(secret, c)), []byte(code)) == 1 {
+			return c
+		}
+	}
+	return -1
+}
+
+// mfaNormalize strips the spaces and dashes apps and users add to codes, and lowercases recovery codes.
+func mfaNormalize(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// MfaEnroll starts enrolling the user in multi-factor authentication, returning the base32 secret and an otpauth URI
+// for authenticator apps. Logins are not asked for codes until the enrollment is confirmed.
+func MfaEnroll(logger *zap.Logger, db *sql.DB, userID uuid.UUID, issuer string, accountName string) (string, string, Error_Code, error) {
+	secret := make([]byte, mfaSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error("Could not enroll in multi-factor authentication, secret error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not enroll in multi-factor authentication")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not enroll in multi-factor authentication, transaction error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not enroll in multi-factor authentication")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not enroll in multi-factor authentication, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	// An enrollment that was never confirmed is replaced, a confirmed one must be disabled first.
+	var enabledAt int64
+	if err = tx.QueryRow("SELECT enabled_at FROM user_mfa WHERE user_id = $1", userID.Bytes()).Scan(&enabledAt); err != nil && err != sql.ErrNoRows {
+		logger.Error("Could not enroll in multi-factor authentication, query error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not enroll in multi-factor authentication")
+	}
+	if enabledAt != 0 {
+		err = errors.New("Multi-factor authentication is already enabled")
+		return "", "", BAD_INPUT, err
+	}
+	if _, err = tx.Exec(`
+INSERT INTO user_mfa (user_id, secret, created_at) VALUES ($1, $2, $3)
+ON CONFLICT (user_id) DO UPDATE SET secret = $2, created_at = $3`, userID.Bytes(), secret, nowMs()); err != nil {
+		logger.Error("Could not enroll in multi-factor authentication, insert error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not enroll in multi-factor authentication")
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not enroll in multi-factor authentication, commit error", zap.Error(err))
+		return "", "", RUNTIME_EXCEPTION, errors.New("Could not enroll in multi-factor authentication")
+	}
+
+	encoded := base32.StdEncoding.EncodeToString(secret)
+	params := url.Values{}
+	params.Set("secret", encoded)
+	params.Set("issuer", issuer)
+	uri := &url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + accountName, RawQuery: params.Encode()}
+	return encoded, uri.String(), 0, nil
+}
+
+// MfaConfirm enables multi-factor authentication for the user once they show a code from their app, returning a new
+// set of recovery codes.
+func MfaConfirm(logger *zap.Logger, db *sql.DB, userID uuid.UUID, code string) ([]string, Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not confirm multi-factor authentication, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not confirm multi-factor authentication")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not confirm multi-factor authentication, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	var secret []byte
+	var enabledAt int64
+	if err = tx.QueryRow("SELECT secret, enabled_at FROM user_mfa WHERE user_id = $1", userID.Bytes()).Scan(&secret, &enabledAt); err == sql.ErrNoRows {
+		return nil, BAD_INPUT, errors.New("Multi-factor authentication enrollment not started")
+	} else if err != nil {
+		logger.Error("Could not confirm multi-factor authentication, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not confirm multi-factor authentication")
+	}
+	if enabledAt != 0 {
+		err = errors.New("Multi-factor authentication is already enabled")
+		return nil, BAD_INPUT, err
+	}
+
+	ts := nowMs()
+	counter := mfaMatch(secret, mfaNormalize(code), ts)
+	if counter < 0 {
+		err = errorInvalidMfaCode
+		return nil, MFA_INVALID, err
+	}
+	if _, err = tx.Exec("UPDATE user_mfa SET enabled_at = $2, last_counter = $3 WHERE user_id = $1", userID.Bytes(), ts, counter); err != nil {
+		logger.Error("Could not confirm multi-factor authentication, update error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not confirm multi-factor authentication")
+	}
+
+	codes, err := mfaRecoveryCreate(tx, userID.Bytes())
+	if err != nil {
+		logger.Error("Could not confirm multi-factor authentication, recovery code error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not confirm multi-factor authentication")
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not confirm multi-factor authentication, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not confirm multi-factor authentication")
+	}
+	return codes, 0, nil
+}
+
+// MfaDisable removes the user's multi-factor authentication secret and recovery codes, if the code they give is
+// valid.
+func MfaDisable(logger *zap.Logger, db *sql.DB, userID uuid.UUID, code string) (Error_Code, error) {
+	valid, err := mfaVerify(db, userID.Bytes(), code)
+	if err == sql.ErrNoRows {
+		return BAD_INPUT, errors.New("Multi-factor authentication is not enabled")
+	} else if err != nil {
+		logger.Error("Could not disable multi-factor authentication, verify error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not disable multi-factor authentication")
+	}
+	if !valid {
+		return MFA_INVALID, errorInvalidMfaCode
+	}
+
+	if err = mfaRemove(db, userID.Bytes()); err != nil {
+		logger.Error("Could not disable multi-factor authentication", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not disable multi-factor authentication")
+	}
+	logger.Info("Disabled multi-factor authentication", zap.String("user_id", userID.String()))
+	return 0, nil
+}
+
+// mfaEnabled returns true if the user confirmed their enrollment in multi-factor authentication.
+func mfaEnabled(db *sql.DB, userID []byte) (bool, error) {
+	var enabledAt int64
+	err := db.QueryRow("SELECT enabled_at FROM user_mfa WHERE user_id = $1", userID).Scan(&enabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabledAt != 0, err
+}
+
+// mfaVerify checks a code from the user's app, or else one of their recovery codes, using it up so it is not accepted
+// again. Returns sql.ErrNoRows if the user has not enabled multi-factor authentication.
+func mfaVerify(db *sql.DB, userID []byte, code string) (bool, error) {
+	code = mfaNormalize(code)
+
+	var secret []byte
+	var lastCounter int64
+	err := db.QueryRow("SELECT secret, last_counter FROM user_mfa WHERE user_id = $1 AND enabled_at > 0", userID).Scan(&secret, &lastCounter)
+	if err != nil {
+		return false, err
+	}
+
+	if counter := mfaMatch(secret, code, nowMs()); counter > lastCounter {
+		// Two logins racing with the same code only get one success.
+		res, err := db.Exec("UPDATE user_mfa SET last_counter = $2 WHERE user_id = $1 AND last_counter < $2", userID, counter)
+		if err != nil {
+			return false, err
+		}
+		count, _ := res.RowsAffected()
+		return count == 1, nil
+	}
+
+	res, err := db.Exec("DELETE FROM user_mfa_recovery WHERE user_id = $1 AND code_hash = $2", userID, tokenHash(code))
+	if err != nil {
+		return false, err
+	}
+	count, _ := res.RowsAffected()
+	return count == 1, nil
+}
+
+// mfaRecoveryCreate replaces the user's recovery codes with new ones, returning the codes to show them.
+func mfaRecoveryCreate(tx *sql.Tx, userID []byte) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_mfa_recovery WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, mfaRecoveryCount)
+	b := make([]byte, mfaRecoveryBytes)
+	for i := 0; i < mfaRecoveryCount; i++ {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		if _, err := tx.Exec("INSERT INTO user_mfa_recovery (user_id, code_hash) VALUES ($1, $2)", userID, tokenHash(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// mfaRemove deletes the user's secret and recovery codes.
+func mfaRemove(db *sql.DB, userID []byte) error {
+	if _, err := db.Exec("DELETE FROM user_mfa WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM user_mfa_recovery WHERE user_id = $1", userID)
+	return err
+}
@@ -15,6 +15,7 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 
 	"bytes"
@@ -35,6 +36,10 @@ const (
 	NOTIFICATION_GROUP_ADD          int64 = 4
 	NOTIFICATION_GROUP_JOIN_REQUEST int64 = 5
 	NOTIFICATION_FRIEND_JOIN_GAME   int64 = 6
+	NOTIFICATION_GROUP_INVITE       int64 = 7
+	NOTIFICATION_DM_MESSAGE         int64 = 8
+	NOTIFICATION_TURN_MATCH_TURN    int64 = 9
+	NOTIFICATION_TURN_MATCH_ENDED   int64 = 10
 )
 
 type notificationResumableCursor struct {
@@ -59,20 +64,28 @@ type NotificationService struct {
 	db            *sql.DB
 	tracker       Tracker
 	messageRouter MessageRouter
+	metrics       *Metrics
+	tracer        *Tracer
 	expiryMs      int64
 }
 
-func NewNotificationService(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, config *NotificationConfig) *NotificationService {
+func NewNotificationService(logger *zap.Logger, db *sql.DB, tracker Tracker, messageRouter MessageRouter, metrics *Metrics, tracer *Tracer, config *NotificationConfig) *NotificationService {
 	return &NotificationService{
 		logger:        logger,
 		db:            db,
 		tracker:       tracker,
 		messageRouter: messageRouter,
+		metrics:       metrics,
+		tracer:        tracer,
 		expiryMs:      config.ExpiryMs,
 	}
 }
 
-func (n *NotificationService) NotificationSend(notifications []*NNotification) error {
+func (n *NotificationService) NotificationSend(ctx context.Context, notifications []*NNotification) error {
+	ctx, span := n.tracer.StartSpan(ctx, "notification send")
+	defer span.End()
+	span.SetAttribute("nakama.notification_count", len(notifications))
+
 	persistentNotifications := make([]*NNotification, 0)
 	notificationsByUser := make(map[uuid.UUID][]*NNotification)
 	for _, n := range notifications {
@@ -91,14 +104,17 @@ func (n *NotificationService) NotificationSend(notifications []*NNotification) e
 	}
 
 	if len(persistentNotifications) > 0 {
-		if err := n.notificationsSave(persistentNotifications); err != nil {
+		if err := n.notificationsSave(ctx, persistentNotifications); err != nil {
+			span.SetError(err)
 			return err
 		}
 	}
 
+	delivered := 0
 	for userID, ns := range notificationsByUser {
 		presences := n.tracker.ListByTopicUser("notifications", userID)
 		if len(presences) != 0 {
+			delivered += len(ns)
 			envelope := &Envelope{
 				Payload: &Envelope_LiveNotifications{
 					LiveNotifications: convertNotifications(ns),
@@ -107,6 +123,7 @@ func (n *NotificationService) NotificationSend(notifications []*NNotification) e
 			n.messageRouter.Send(n.logger, presences, envelope)
 		}
 	}
+	n.metrics.ObserveNotifications(len(notifications), delivered)
 
 	return nil
 }
@@ -202,7 +219,7 @@ func (n *NotificationService) NotificationsRemove(userID uuid.UUID, notification
 	return nil
 }
 
-func (n *NotificationService) notificationsSave(notifications []*NNotification) error {
+func (n *NotificationService) notificationsSave(ctx context.Context, notifications []*NNotification) error {
 	createdAt := nowMs()
 	expiresAt := createdAt + n.expiryMs
 
@@ -236,7 +253,7 @@ func (n *NotificationService) notificationsSave(notifications []*NNotification)
 	query := "INSERT INTO notification (id, user_id, subject, content, code, sender_id, created_at, expires_at) VALUES " + strings.Join(statements, ", ")
 	n.logger.Debug("notification save query", zap.String("query", query))
 
-	_, err := n.db.Exec(query, params...)
+	_, err := n.db.ExecContext(ctx, query, params...)
 	if err != nil {
 		n.logger.Error("Could not save notifications", zap.Error(err))
 		return errors.New("Could not save notifications.")
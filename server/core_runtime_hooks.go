@@ -25,9 +25,12 @@ import (
 	"go.uber.org/zap"
 )
 
+// RuntimeBeforeHook runs the before hook registered for the message type, if any, returning the message to process in
+// its place. A hookRejectedError means the hook turned the message away.
 func RuntimeBeforeHook(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, messageType string, envelope *Envelope, session *session) (*Envelope, error) {
+	gf := runtime.GetRuntimeGoBefore(messageType)
 	fn := runtime.GetRuntimeCallback(BEFORE, messageType)
-	if fn == nil {
+	if gf == nil && fn == nil {
 		return envelope, nil
 	}
 
@@ -37,27 +40,21 @@ func RuntimeBeforeHook(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, json
 	if session != nil {
 		userId = session.userID
 		handle = session.handle.Load()
-		expiry = session.expiry
+		expiry = session.expiry.Load()
 	}
 
+	if gf != nil {
+		return runtime.InvokeGoFunctionBefore(gf, userId, handle, expiry, envelope)
+	}
 	return runtime.InvokeFunctionBefore(fn, userId, handle, expiry, jsonpbMarshaler, jsonpbUnmarshaler, envelope)
 }
 
-func RuntimeAfterHook(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, messageType string, envelope *Envelope, session *session) {
+// RuntimeAfterHook runs the after hook registered for the message type, if any, with the message that was processed
+// and the response sent to the client, which is nil if there was none.
+func RuntimeAfterHook(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, messageType string, envelope *Envelope, response *Envelope, session *session) {
+	gf := runtime.GetRuntimeGoAfter(messageType)
 	fn := runtime.GetRuntimeCallback(AFTER, messageType)
-	if fn == nil {
-		return
-	}
-
-	strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
-	if err != nil {
-		logger.Error("Failed to convert proto message to protoJSON in After invocation", zap.String("message", messageType), zap.Error(err))
-		return
-	}
-
-	var jsonEnvelope map[string]interface{}
-	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
-		logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
+	if gf == nil && fn == nil {
 		return
 	}
 
@@ -67,21 +64,36 @@ func RuntimeAfterHook(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jso
 	if session != nil {
 		userId = session.userID
 		handle = session.handle.Load()
-		expiry = session.expiry
+		expiry = session.expiry.Load()
 	}
 
-	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope); fnErr != nil {
-		logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+	if gf != nil {
+		if fnErr := runtime.InvokeGoFunctionAfter(gf, userId, handle, expiry, envelope, response); fnErr != nil {
+			logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+		}
+		return
 	}
-}
 
-func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, envelope *AuthenticateRequest) (*AuthenticateRequest, error) {
-	messageType := RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope.Id)]
-	fn := runtime.GetRuntimeCallback(BEFORE, messageType)
-	if fn == nil {
-		return envelope, nil
+	jsonEnvelope, err := envelopeToMap(jsonpbMarshaler, envelope)
+	if err != nil {
+		logger.Error("Failed to convert message in After invocation", zap.String("message", messageType), zap.Error(err))
+		return
+	}
+	var jsonResponse map[string]interface{}
+	if response != nil {
+		if jsonResponse, err = envelopeToMap(jsonpbMarshaler, response); err != nil {
+			logger.Error("Failed to convert response in After invocation", zap.String("message", messageType), zap.Error(err))
+			return
+		}
 	}
 
+	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope, jsonResponse); fnErr != nil {
+		logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+	}
+}
+
+// envelopeToMap converts the envelope to the map of its protoJSON form.
+func envelopeToMap(jsonpbMarshaler *jsonpb.Marshaler, envelope *Envelope) (map[string]interface{}, error) {
 	strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
 	if err != nil {
 		return nil, err
@@ -91,49 +103,106 @@ func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.M
 	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
 		return nil, err
 	}
+	return jsonEnvelope, nil
+}
 
-	userId := uuid.Nil
-	handle := ""
-	expiry := int64(0)
+// hookRejectedError is returned when a before hook turns a client message away, with the message for the client.
+type hookRejectedError struct {
+	message string
+}
 
-	result, fnErr := runtime.InvokeFunctionBeforeAuthentication(fn, userId, handle, expiry, jsonEnvelope)
-	if fnErr != nil {
-		return nil, fnErr
-	}
+func (e *hookRejectedError) Error() string {
+	return e.message
+}
 
-	bytesEnvelope, err := json.Marshal(result)
-	if err != nil {
-		return nil, err
-	}
+// authDeniedError is returned when a before authentication hook turns the request away, with the message for the client.
+type authDeniedError struct {
+	message string
+}
 
-	authenticationResult := &AuthenticateRequest{}
-	if err = jsonpbUnmarshaler.Unmarshal(bytes.NewReader(bytesEnvelope), authenticationResult); err != nil {
-		return nil, err
-	}
+func (e *authDeniedError) Error() string {
+	return e.message
+}
 
-	return authenticationResult, nil
+// RuntimeBeforeHookAuthentication runs the before hook registered for the request's login method, then the one
+// registered for all authentication requests. Either may substitute the credentials, or deny the request with an
+// authDeniedError. The endpoint is "login", "register" or "refresh".
+func RuntimeBeforeHookAuthentication(runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, envelope *AuthenticateRequest, endpoint string, clientIP string) (*AuthenticateRequest, error) {
+	for _, messageType := range []string{RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope.Id)], RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope)]} {
+		if gf := runtime.GetRuntimeGoBeforeAuthentication(messageType); gf != nil {
+			result, fnErr := runtime.InvokeGoFunctionBeforeAuthentication(gf, endpoint, clientIP, envelope)
+			if fnErr != nil {
+				return nil, fnErr
+			}
+			envelope = result
+			continue
+		}
+
+		fn := runtime.GetRuntimeCallback(BEFORE, messageType)
+		if fn == nil {
+			continue
+		}
+
+		strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
+		if err != nil {
+			return nil, err
+		}
+
+		var jsonEnvelope map[string]interface{}
+		if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
+			return nil, err
+		}
+
+		result, fnErr := runtime.InvokeFunctionBeforeAuthentication(fn, endpoint, clientIP, jsonEnvelope)
+		if fnErr != nil {
+			return nil, fnErr
+		}
+
+		bytesEnvelope, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticationResult := &AuthenticateRequest{}
+		if err = jsonpbUnmarshaler.Unmarshal(bytes.NewReader(bytesEnvelope), authenticationResult); err != nil {
+			return nil, err
+		}
+		envelope = authenticationResult
+	}
+
+	return envelope, nil
 }
 
+// RuntimeAfterHookAuthentication runs the after hook registered for the request's login method, then the one
+// registered for all authentication requests.
 func RuntimeAfterHookAuthentication(logger *zap.Logger, runtime *Runtime, jsonpbMarshaler *jsonpb.Marshaler, envelope *AuthenticateRequest, userId uuid.UUID, handle string, expiry int64) {
-	messageType := RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope.Id)]
-	fn := runtime.GetRuntimeCallback(AFTER, messageType)
-	if fn == nil {
-		return
-	}
-
-	strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
-	if err != nil {
-		logger.Error("Failed to convert proto message to protoJSON in After invocation", zap.String("message", messageType), zap.Error(err))
-		return
-	}
-
-	var jsonEnvelope map[string]interface{}
-	if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
-		logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
-		return
-	}
-
-	if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope); fnErr != nil {
-		logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+	for _, messageType := range []string{RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope.Id)], RUNTIME_MESSAGES[fmt.Sprintf("%T", envelope)]} {
+		if gf := runtime.GetRuntimeGoAfterAuthentication(messageType); gf != nil {
+			if fnErr := runtime.InvokeGoFunctionAfterAuthentication(gf, userId, handle, expiry, envelope); fnErr != nil {
+				logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+			}
+			continue
+		}
+
+		fn := runtime.GetRuntimeCallback(AFTER, messageType)
+		if fn == nil {
+			continue
+		}
+
+		strEnvelope, err := jsonpbMarshaler.MarshalToString(envelope)
+		if err != nil {
+			logger.Error("Failed to convert proto message to protoJSON in After invocation", zap.String("message", messageType), zap.Error(err))
+			return
+		}
+
+		var jsonEnvelope map[string]interface{}
+		if err = json.Unmarshal([]byte(strEnvelope), &jsonEnvelope); err != nil {
+			logger.Error("Failed to convert protoJSON message to Map in After invocation", zap.String("message", messageType), zap.Error(err))
+			return
+		}
+
+		if fnErr := runtime.InvokeFunctionAfter(fn, userId, handle, expiry, jsonEnvelope, nil); fnErr != nil {
+			logger.Error("Runtime after function caused an error", zap.String("message", messageType), zap.Error(fnErr))
+		}
 	}
 }
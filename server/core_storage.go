@@ -21,6 +21,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"encoding/gob"
 	"nakama/pkg/jsonpatch"
@@ -29,6 +32,17 @@ import (
 	"go.uber.org/zap"
 )
 
+// Most conditions a single storage write may have.
+const storageMaxConditions = 10
+
+// The most removes and writes combined in one storage batch.
+const storageMaxBatchSize = 100
+
+// The stored value as JSON, for conditions to inspect.
+const storageValueJSON = "convert_from(value, 'UTF8')::JSONB"
+
+var storageConditionFieldPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
 type storageListCursor struct {
 	Bucket     string
 	Collection string
@@ -58,12 +72,37 @@ type StorageData struct {
 	CreatedAt       int64
 	UpdatedAt       int64
 	ExpiresAt       int64
+	// Only write if there is an existing record whose value passes all these checks.
+	Conditions []*StorageCondition
 }
 
+// StorageCondition is a check on a field of the stored JSON object that must pass for a conditional write to go
+// ahead. Fields that are missing or of a different type than the value fail the check.
+type StorageCondition struct {
+	// Dot separated path to the field, for example "wallet.coins".
+	Field string
+	// One of "=", "!=", ">", ">=", "<" or "<=". Booleans only support "=" and "!=".
+	Op string
+	// A float64, int64, string or bool.
+	Value interface{}
+}
+
+// StorageKeyStatus is the outcome of fetching a single key.
+type StorageKeyStatus int
+
+const (
+	StorageKeyFound StorageKeyStatus = iota
+	// The record exists but the caller cannot read it.
+	StorageKeyDenied
+	// No such record, or it has expired.
+	StorageKeyMissing
+)
+
 type StorageKeyUpdate struct {
 	Key             *StorageKey
 	PermissionRead  int64
 	PermissionWrite int64
+	ExpiresAt       int64
 	Patch           jsonpatch.ExtendedPatch
 }
 
@@ -177,9 +216,15 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte
 		// If listing by user first, and the caller is the user listing their own data.
 		query += " AND read >= 1"
 	} else {
-		query += " AND read >= 2"
+		// Other users' data is listed if it's public, or shared with the caller.
+		params = append(params, caller.Bytes())
+		query += fmt.Sprintf(" AND (read >= 2 OR (read = 1 AND %v))", storageAclClause("read", "storage.id", fmt.Sprintf("$%v", len(params))))
 	}
 
+	// Expired records are not listed, even if they have not been swept yet.
+	params = append(params, nowMs())
+	query += fmt.Sprintf(" AND (expires_at = 0 OR expires_at > $%v)", len(params))
+
 	params = append(params, limit+1)
 	query += fmt.Sprintf(" LIMIT $%v", len(params))
 
@@ -260,29 +305,41 @@ func StorageList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte
 }
 
 func StorageFetch(logger *zap.Logger, db *sql.DB, caller uuid.UUID, keys []*StorageKey) ([]*StorageData, Error_Code, error) {
+	data, _, code, err := StorageFetchStatus(logger, db, caller, keys)
+	return data, code, err
+}
+
+// StorageFetchStatus fetches records of any owners in one query, like StorageFetch, and also returns whether each key
+// was found, denied to the caller, or missing, in the order of the keys. Values of denied records are never read.
+func StorageFetchStatus(logger *zap.Logger, db *sql.DB, caller uuid.UUID, keys []*StorageKey) ([]*StorageData, []StorageKeyStatus, Error_Code, error) {
 	// Ensure there is at least one key requested.
 	if len(keys) == 0 {
-		return nil, BAD_INPUT, errors.New("At least one fetch key is required")
+		return nil, nil, BAD_INPUT, errors.New("At least one fetch key is required")
 	}
 
+	readable := "TRUE"
+	params := []interface{}{nowMs()}
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		readable = "(read = 2 OR (read = 1 AND (user_id = $2 OR " + storageAclClause("read", "storage.id", "$2") + ")))"
+	}
 	query := `
-SELECT user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, expires_at
+SELECT user_id, bucket, collection, record, CASE WHEN ` + readable + ` THEN value ELSE NULL END, version, read, write, created_at, updated_at, expires_at, ` + readable + `
 FROM storage
 WHERE `
-	params := make([]interface{}, 0)
 
 	// Accumulate the query clauses and corresponding parameters.
 	for i, key := range keys {
 		// Check the storage identifiers.
 		if key.Bucket == "" || key.Collection == "" || key.Record == "" {
-			return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+			return nil, nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
 		}
 
 		// If a user ID is provided, validate the format.
 		owner := []byte{}
 		if len(key.UserId) != 0 {
 			if uid, err := uuid.FromBytes(key.UserId); err != nil {
-				return nil, BAD_INPUT, errors.New("Invalid user ID")
+				return nil, nil, BAD_INPUT, errors.New("Invalid user ID")
 			} else {
 				owner = uid.Bytes()
 			}
@@ -292,24 +349,21 @@ WHERE `
 			query += " OR "
 		}
 		l := len(params)
-		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND user_id = $%v AND record = $%v AND deleted_at = 0", l+1, l+2, l+3, l+4)
+		// Unreadable records are selected too, so they can be told apart from missing ones.
+		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND user_id = $%v AND record = $%v AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $1))", l+1, l+2, l+3, l+4)
 		params = append(params, key.Bucket, key.Collection, owner, key.Record)
-		if caller != uuid.Nil {
-			query += fmt.Sprintf(" AND (read = 2 OR (read = 1 AND user_id = $%v))", len(params)+1)
-			params = append(params, caller.Bytes())
-		}
-		query += ")"
 	}
 
 	// Execute the query.
 	rows, err := db.Query(query, params...)
 	if err != nil {
 		logger.Error("Error in storage fetch", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, err
+		return nil, nil, RUNTIME_EXCEPTION, err
 	}
 	defer rows.Close()
 
 	storageData := make([]*StorageData, 0)
+	denied := make(map[string]bool)
 
 	// Parse the results.
 	for rows.Next() {
@@ -324,12 +378,17 @@ WHERE `
 		var createdAt sql.NullInt64
 		var updatedAt sql.NullInt64
 		var expiresAt sql.NullInt64
+		var canRead bool
 
 		err := rows.Scan(&userID, &bucket, &collection, &record, &value, &version,
-			&read, &write, &createdAt, &updatedAt, &expiresAt)
+			&read, &write, &createdAt, &updatedAt, &expiresAt, &canRead)
 		if err != nil {
 			logger.Error("Could not execute storage fetch query", zap.Error(err))
-			return nil, RUNTIME_EXCEPTION, err
+			return nil, nil, RUNTIME_EXCEPTION, err
+		}
+		if !canRead {
+			denied[storageKeyID(bucket.String, collection.String, userID, record.String)] = true
+			continue
 		}
 
 		// Potentially coerce zero-length global owner field.
@@ -354,67 +413,131 @@ WHERE `
 	}
 	if err = rows.Err(); err != nil {
 		logger.Error("Could not execute storage fetch query", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, err
+		return nil, nil, RUNTIME_EXCEPTION, err
 	}
 
-	return storageData, 0, nil
+	found := make(map[string]bool, len(storageData))
+	for _, d := range storageData {
+		found[storageKeyID(d.Bucket, d.Collection, d.UserId, d.Record)] = true
+	}
+	statuses := make([]StorageKeyStatus, len(keys))
+	for i, key := range keys {
+		id := storageKeyID(key.Bucket, key.Collection, key.UserId, key.Record)
+		if found[id] {
+			statuses[i] = StorageKeyFound
+		} else if denied[id] {
+			statuses[i] = StorageKeyDenied
+		} else {
+			statuses[i] = StorageKeyMissing
+		}
+	}
+
+	return storageData, statuses, 0, nil
+}
+
+// storageKeyID identifies a record within the results of a single fetch.
+func storageKeyID(bucket string, collection string, userID []byte, record string) string {
+	return fmt.Sprintf("%q %q %x %q", bucket, collection, userID, record)
 }
 
-func StorageWrite(logger *zap.Logger, db *sql.DB, caller uuid.UUID, data []*StorageData) ([]*StorageKey, Error_Code, error) {
+func StorageWrite(logger *zap.Logger, db *sql.DB, config *StorageConfig, caller uuid.UUID, data []*StorageData) ([]*StorageKey, Error_Code, error) {
 	// Ensure there is at least one value requested.
 	if len(data) == 0 {
 		return nil, BAD_INPUT, errors.New("At least one write value is required")
 	}
 
 	// Validate all input before starting DB operations.
+	if code, err := storageWriteValidate(caller, data); err != nil {
+		return nil, code, err
+	}
+
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not write storage, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	}
+
+	// Use same timestamp for all operations in this batch.
+	keys, code, err := storageWrite(logger, tx, config, caller, data, nowMs())
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not write storage, rollback error", zap.Error(e))
+		}
+		return nil, code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not write storage, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	}
+
+	return keys, 0, nil
+}
+
+func storageWriteValidate(caller uuid.UUID, data []*StorageData) (Error_Code, error) {
 	for _, d := range data {
 		// Check the storage identifiers.
 		if d.Bucket == "" || d.Collection == "" || d.Record == "" {
-			return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+			return BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
 		}
 
 		// Check the read permission value.
 		if d.PermissionRead != 0 && d.PermissionRead != 1 && d.PermissionRead != 2 {
-			return nil, BAD_INPUT, errors.New("Invalid read permission value")
+			return BAD_INPUT, errors.New("Invalid read permission value")
 		}
 
 		// Check the write permission value.
 		if d.PermissionWrite != 0 && d.PermissionWrite != 1 {
-			return nil, BAD_INPUT, errors.New("Invalid write permission value")
+			return BAD_INPUT, errors.New("Invalid write permission value")
 		}
 
 		// If a user ID is provided, validate the format.
 		if len(d.UserId) != 0 {
 			if uid, err := uuid.FromBytes(d.UserId); err != nil {
-				return nil, BAD_INPUT, errors.New("Invalid user ID")
-			} else if caller != uuid.Nil && caller != uid {
-				// If the caller is a client, only allow them to write their own data.
-				return nil, BAD_INPUT, errors.New("A client can only write their own records")
+				return BAD_INPUT, errors.New("Invalid user ID")
+			} else if caller != uuid.Nil && caller != uid && bytes.Equal(d.Version, []byte("*")) {
+				// A client can write records of other users that are shared with them, but not create them.
+				return BAD_INPUT, errors.New("A client can only create their own records")
 			}
 		} else if caller != uuid.Nil {
 			// If the caller is a client, do not allow them to write global data.
-			return nil, BAD_INPUT, errors.New("A client cannot write global records")
+			return BAD_INPUT, errors.New("A client cannot write global records")
 		}
 
 		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
 		var maybeJSON map[string]interface{}
 		if json.Unmarshal(d.Value, &maybeJSON) != nil {
-			return nil, BAD_INPUT, errors.New("All values must be valid JSON objects")
+			return BAD_INPUT, errors.New("All values must be valid JSON objects")
+		}
+
+		if d.ExpiresAt != 0 && d.ExpiresAt <= nowMs() {
+			return BAD_INPUT, errors.New("Expiry time must be in the future")
+		}
+
+		// Conditions check an existing record, so can't be combined with if-none-match.
+		if len(d.Conditions) > storageMaxConditions {
+			return BAD_INPUT, fmt.Errorf("At most %v conditions are allowed on each write", storageMaxConditions)
+		}
+		if len(d.Conditions) != 0 && bytes.Equal(d.Version, []byte("*")) {
+			return BAD_INPUT, errors.New("Conditions cannot be used when writing only if the record does not exist")
+		}
+		for _, c := range d.Conditions {
+			if err := storageConditionValidate(c); err != nil {
+				return BAD_INPUT, err
+			}
 		}
 	}
 
+	return 0, nil
+}
+
+// storageWrite executes validated writes in the transaction. The caller must roll back the transaction on error.
+func storageWrite(logger *zap.Logger, tx *sql.Tx, config *StorageConfig, caller uuid.UUID, data []*StorageData, ts int64) ([]*StorageKey, Error_Code, error) {
 	// Prepare response structure, expect to return as many keys as we're writing.
 	keys := make([]*StorageKey, len(data))
-
-	// Use same timestamp for all operations in this batch.
-	ts := nowMs()
-
-	// Start a transaction.
-	tx, err := db.Begin()
-	if err != nil {
-		logger.Error("Could not write storage, transaction error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
-	}
+	schemas := storageSchemaCache{}
 
 	// Execute each storage write.
 	for i, d := range data {
@@ -427,56 +550,107 @@ func StorageWrite(logger *zap.Logger, db *sql.DB, caller uuid.UUID, data []*Stor
 		if len(d.UserId) != 0 {
 			owner = d.UserId
 		}
+		// A client writing another user's record needs write access through the record's ACL.
+		shared := caller != uuid.Nil && !bytes.Equal(owner, caller.Bytes())
+
+		if code, err := schemas.validate(logger, tx, d.Bucket, d.Collection, d.Value); err != nil {
+			return nil, code, err
+		}
+
+		// Note the size of the value being replaced, for the owner's storage usage.
+		existing := int64(0)
+		if len(owner) != 0 {
+			var err error
+			if existing, err = storageExistingSize(tx, d.Bucket, d.Collection, owner, d.Record); err != nil {
+				logger.Error("Could not write storage, size error", zap.Error(err))
+				return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+			}
+		}
 
 		query := `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
-		params := []interface{}{id, owner, d.Bucket, d.Collection, d.Record, d.Value, version, d.PermissionRead, d.PermissionWrite, ts}
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at, expires_at)
+SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0, $11`
+		params := []interface{}{id, owner, d.Bucket, d.Collection, d.Record, d.Value, version, d.PermissionRead, d.PermissionWrite, ts, d.ExpiresAt}
 
-		if len(d.Version) == 0 {
+		if !shared && len(d.Version) == 0 && len(d.Conditions) == 0 {
 			// Simple write.
 			// If needed use an additional clause to enforce permissions.
 			if caller != uuid.Nil {
-				query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND write = 0)"
+				query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $10) AND write = 0)"
 			}
 			query += `
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10, expires_at = $11`
 		} else if bytes.Equal(d.Version, []byte("*")) {
 			// if-none-match
-			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0)"
+			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $10))"
 			// No additional clause needed to enforce permissions.
 			// Any existing record, no matter its write permission, will cause this operation to be rejected.
+			// An expired record that has not been swept yet is replaced.
+			query += `
+ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+DO UPDATE SET id = $1, value = $6::BYTEA, version = $7, read = $8, write = $9, created_at = $10, updated_at = $10, expires_at = $11
+WHERE storage.expires_at > 0 AND storage.expires_at <= $10`
 		} else {
-			// if-match
-			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND version = $11"
+			// if-match, and/or conditional on the existing value.
+			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $10)"
+			if len(d.Version) != 0 {
+				params = append(params, d.Version)
+				query += " AND version = $" + strconv.Itoa(len(params))
+			}
+			for _, c := range d.Conditions {
+				var clause string
+				clause, params = storageConditionClause(c, params)
+				query += " AND " + clause
+			}
 			// If needed use an additional clause to enforce permissions.
 			if caller != uuid.Nil {
 				query += " AND write = 1"
 			}
-			query += `)
+			if shared {
+				params = append(params, caller.Bytes())
+				query += " AND " + storageAclClause("write", "storage.id", "$"+strconv.Itoa(len(params)))
+				// Only the owner sets permissions and expiry.
+				query += `)
+ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+DO UPDATE SET value = $6::BYTEA, version = $7, updated_at = $10`
+			} else {
+				query += `)
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
-			params = append(params, d.Version)
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10, expires_at = $11`
+			}
 		}
 
 		// Execute the query.
 		res, err := tx.Exec(query, params...)
 		if err != nil {
 			logger.Error("Could not write storage, exec error", zap.Error(err))
-			if e := tx.Rollback(); e != nil {
-				logger.Error("Could not write storage, rollback error", zap.Error(e))
-			}
 			return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 		}
 
 		// Check there was exactly 1 row affected.
 		if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not write storage, rollback error", zap.Error(err))
+			if shared {
+				if writable, err := storageAclWritable(tx, caller, owner, d.Bucket, d.Collection, d.Record, ts); err != nil {
+					logger.Error("Could not write storage, access check error", zap.Error(err))
+					return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+				} else if !writable {
+					return nil, STORAGE_REJECTED, errors.New("A client can only write their own records, or records shared with them")
+				}
 			}
-			return nil, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version check failed, or permission denied")
+			return nil, STORAGE_REJECTED, errors.New("Storage write rejected: not found, version or condition check failed, or permission denied")
+		}
+
+		if len(owner) != 0 {
+			if code, err := storageUsageWrite(logger, tx, config, caller, owner, int64(len(d.Value)), existing); err != nil {
+				return nil, code, err
+			}
+		}
+
+		// Keep any indexed fields of the record in step with its new value.
+		if err = storageIndexUpdate(tx, d.Bucket, d.Collection, owner, d.Record); err != nil {
+			logger.Error("Could not write storage, index error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
 		}
 
 		keys[i] = &StorageKey{
@@ -488,16 +662,53 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		logger.Error("Could not write storage, commit error", zap.Error(err))
-		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage")
+	return keys, 0, nil
+}
+
+func storageConditionValidate(c *StorageCondition) error {
+	if !storageConditionFieldPattern.MatchString(c.Field) {
+		return errors.New("Condition fields must be dot separated names of letters, digits, _ or -")
 	}
+	switch c.Op {
+	case "=", "!=":
+	case ">", ">=", "<", "<=":
+		if _, ok := c.Value.(bool); ok {
+			return errors.New("Boolean conditions only support = and !=")
+		}
+	default:
+		return errors.New("Condition operator must be one of =, !=, >, >=, < or <=")
+	}
+	switch c.Value.(type) {
+	case float64, int64, string, bool:
+	default:
+		return errors.New("Condition values must be a number, string or boolean")
+	}
+	return nil
+}
 
-	return keys, 0, nil
+// storageConditionClause builds a SQL clause checking the stored value passes the condition, appending its
+// parameters. The condition must be valid.
+func storageConditionClause(c *StorageCondition, params []interface{}) (string, []interface{}) {
+	params = append(params, "{"+strings.Replace(c.Field, ".", ",", -1)+"}")
+	path := "$" + strconv.Itoa(len(params)) + "::TEXT[]"
+	params = append(params, c.Value)
+	value := "$" + strconv.Itoa(len(params))
+
+	var jsonType, field string
+	switch c.Value.(type) {
+	case float64, int64:
+		jsonType, field, value = "number", "("+storageValueJSON+" #>> "+path+")::DECIMAL", value+"::DECIMAL"
+	case string:
+		jsonType, field, value = "string", "("+storageValueJSON+" #>> "+path+")", value+"::TEXT"
+	case bool:
+		jsonType, field, value = "boolean", "("+storageValueJSON+" #>> "+path+")::BOOLEAN", value+"::BOOLEAN"
+	}
+
+	// Only compare once the field is known to have the right type, so casts can't fail.
+	return "CASE WHEN jsonb_typeof(" + storageValueJSON + " #> " + path + ") = '" + jsonType + "' THEN " + field + " " + c.Op + " " + value + " ELSE FALSE END", params
 }
 
-func StorageUpdate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, updates []*StorageKeyUpdate) ([]*StorageKey, Error_Code, error) {
+func StorageUpdate(logger *zap.Logger, db *sql.DB, config *StorageConfig, caller uuid.UUID, updates []*StorageKeyUpdate) ([]*StorageKey, Error_Code, error) {
 	// Ensure there is at least one update requested.
 	if len(updates) == 0 {
 		return nil, BAD_INPUT, errors.New("At least one update is required")
@@ -505,6 +716,7 @@ func StorageUpdate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, updates []*
 
 	// Prepare response structure, expect to return as many keys as we're updating.
 	keys := make([]*StorageKey, len(updates))
+	schemas := storageSchemaCache{}
 
 	// Use the same timestamp for all operations.
 	ts := nowMs()
@@ -547,10 +759,15 @@ func StorageUpdate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, updates []*
 			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: A client cannot write global records", i))
 		}
 
+		if update.ExpiresAt != 0 && update.ExpiresAt <= ts {
+			return nil, BAD_INPUT, errors.New(fmt.Sprintf("Invalid update index %v: Expiry time must be in the future", i))
+		}
+
+		// Expired records that have not been swept yet are treated as not found.
 		query := `
 SELECT user_id, bucket, collection, record, value, version, write
 FROM storage
-WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0`
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $5)`
 
 		// Query and decode the row.
 		var userID []byte
@@ -560,7 +777,7 @@ WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND delet
 		var value []byte
 		var version []byte
 		var write sql.NullInt64
-		err = tx.QueryRow(query, update.Key.Bucket, update.Key.Collection, owner, update.Key.Record).
+		err = tx.QueryRow(query, update.Key.Bucket, update.Key.Collection, owner, update.Key.Record, ts).
 			Scan(&userID, &bucket, &collection, &record, &value, &version, &write)
 		if err != nil && err != sql.ErrNoRows {
 			// Only fail on critical database or row scan errors.
@@ -599,25 +816,47 @@ WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND delet
 			}
 			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: %v", i, err.Error()))
 		}
+		if code, err := schemas.validate(logger, tx, update.Key.Bucket, update.Key.Collection, newValue); err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not update storage, rollback error", zap.Error(e))
+			}
+			return nil, code, fmt.Errorf("Storage update index %v rejected: %v", i, err.Error())
+		}
 		newVersion := []byte(fmt.Sprintf("%x", sha256.Sum256(newValue)))
 
+		// Note the size of the value being replaced, including any expired record, for the owner's storage usage.
+		existing := int64(0)
+		if len(owner) != 0 {
+			if existing, err = storageExistingSize(tx, update.Key.Bucket, update.Key.Collection, owner, update.Key.Record); err != nil {
+				logger.Error("Could not update storage, size error", zap.Error(err))
+				if e := tx.Rollback(); e != nil {
+					logger.Error("Could not update storage, rollback error", zap.Error(e))
+				}
+				return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+			}
+		}
+
 		query = `
-INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at)
-SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0`
-		params := []interface{}{uuid.NewV4().Bytes(), owner, update.Key.Bucket, update.Key.Collection, update.Key.Record, newValue, newVersion, update.PermissionRead, update.PermissionWrite, ts}
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, read, write, created_at, updated_at, deleted_at, expires_at)
+SELECT $1, $2, $3, $4, $5, $6::BYTEA, $7, $8, $9, $10, $10, 0, $11`
+		params := []interface{}{uuid.NewV4().Bytes(), owner, update.Key.Bucket, update.Key.Collection, update.Key.Record, newValue, newVersion, update.PermissionRead, update.PermissionWrite, ts, update.ExpiresAt}
 		if len(version) == 0 {
-			// Treat this as an if-none-match.
-			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0)"
+			// Treat this as an if-none-match, replacing an expired record that has not been swept yet.
+			query += " WHERE NOT EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $10))"
+			query += `
+ON CONFLICT (bucket, collection, user_id, record, deleted_at)
+DO UPDATE SET id = $1, value = $6::BYTEA, version = $7, read = $8, write = $9, created_at = $10, updated_at = $10, expires_at = $11
+WHERE storage.expires_at > 0 AND storage.expires_at <= $10`
 		} else {
 			// if-match
-			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND version = $11"
+			query += " WHERE EXISTS (SELECT record FROM storage WHERE user_id = $2 AND bucket = $3 AND collection = $4 AND record = $5 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $10) AND version = $12"
 			// If needed use an additional clause to enforce permissions.
 			if caller != uuid.Nil {
 				query += " AND write = 1"
 			}
 			query += `)
 ON CONFLICT (bucket, collection, user_id, record, deleted_at)
-DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10`
+DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at = $10, expires_at = $11`
 			params = append(params, version)
 		}
 
@@ -640,6 +879,24 @@ DO UPDATE SET value = $6::BYTEA, version = $7, read = $8, write = $9, updated_at
 			return nil, STORAGE_REJECTED, errors.New(fmt.Sprintf("Storage update index %v rejected: not found, version check failed, or permission denied", i))
 		}
 
+		if len(owner) != 0 {
+			if code, err := storageUsageWrite(logger, tx, config, caller, owner, int64(len(newValue)), existing); err != nil {
+				if e := tx.Rollback(); e != nil {
+					logger.Error("Could not update storage, rollback error", zap.Error(e))
+				}
+				return nil, code, err
+			}
+		}
+
+		// Keep any indexed fields of the record in step with its new value.
+		if err = storageIndexUpdate(tx, update.Key.Bucket, update.Key.Collection, owner, update.Key.Record); err != nil {
+			logger.Error("Could not update storage, index error", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not update storage, rollback error", zap.Error(e))
+			}
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not update storage")
+		}
+
 		keys[i] = &StorageKey{
 			Bucket:     update.Key.Bucket,
 			Collection: update.Key.Collection,
@@ -665,10 +922,83 @@ func StorageRemove(logger *zap.Logger, db *sql.DB, caller uuid.UUID, keys []*Sto
 		return BAD_INPUT, errors.New("At least one remove key is required")
 	}
 
+	// Start a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not remove storage, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+	}
+
+	if code, err := storageRemove(logger, tx, caller, keys, nowMs()); err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not remove storage, rollback error", zap.Error(e))
+		}
+		return code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not remove storage, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
+	}
+
+	return 0, nil
+}
+
+// StorageBatch removes and writes records across any collections in a single transaction. Either every remove and
+// write passes its version, condition and permission checks and the whole batch is committed, or nothing changes.
+// Removes are applied before writes.
+func StorageBatch(logger *zap.Logger, db *sql.DB, config *StorageConfig, caller uuid.UUID, writes []*StorageData, removes []*StorageKey) ([]*StorageKey, Error_Code, error) {
+	if len(writes) == 0 && len(removes) == 0 {
+		return nil, BAD_INPUT, errors.New("At least one write or remove is required")
+	}
+	if len(writes)+len(removes) > storageMaxBatchSize {
+		return nil, BAD_INPUT, fmt.Errorf("At most %v writes and removes are allowed in a batch", storageMaxBatchSize)
+	}
+
+	// Validate all writes before starting DB operations.
+	if code, err := storageWriteValidate(caller, writes); err != nil {
+		return nil, code, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not write storage batch, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage batch")
+	}
+
+	// Use the same timestamp for all operations in the batch.
+	ts := nowMs()
+	keys := make([]*StorageKey, 0)
+	code := Error_Code(0)
+	if len(removes) != 0 {
+		code, err = storageRemove(logger, tx, caller, removes, ts)
+	}
+	if err == nil && len(writes) != 0 {
+		keys, code, err = storageWrite(logger, tx, config, caller, writes, ts)
+	}
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not write storage batch, rollback error", zap.Error(e))
+		}
+		return nil, code, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error("Could not write storage batch, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not write storage batch")
+	}
+
+	return keys, 0, nil
+}
+
+// storageRemove removes the records in the transaction. The caller must roll back the transaction on error.
+func storageRemove(logger *zap.Logger, tx *sql.Tx, caller uuid.UUID, keys []*StorageKey, ts int64) (Error_Code, error) {
 	query := `
 UPDATE storage SET deleted_at = $1, updated_at = $1
 WHERE `
-	params := []interface{}{nowMs()}
+	params := []interface{}{ts}
 
 	// Accumulate the query clauses and corresponding parameters.
 	for i, key := range keys {
@@ -697,7 +1027,7 @@ WHERE `
 			query += " OR "
 		}
 		l := len(params)
-		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND user_id = $%v AND record = $%v AND deleted_at = 0", l+1, l+2, l+3, l+4)
+		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND user_id = $%v AND record = $%v AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $1)", l+1, l+2, l+3, l+4)
 		params = append(params, key.Bucket, key.Collection, owner, key.Record)
 		// Permission.
 		if caller != uuid.Nil {
@@ -712,34 +1042,22 @@ WHERE `
 		query += ")"
 	}
 
-	// Start a transaction.
-	tx, err := db.Begin()
+	// Execute the query, noting the removed values for their owners' storage usage.
+	rows, err := tx.Query(query+" RETURNING user_id, length(value)", params...)
 	if err != nil {
-		logger.Error("Could not remove storage, transaction error", zap.Error(err))
+		logger.Error("Could not remove storage, exec error", zap.Error(err))
 		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
-
-	// Execute the query.
-	res, err := tx.Exec(query, params...)
+	rowsAffected, err := storageUsageRemove(tx, rows)
 	if err != nil {
-		logger.Error("Could not remove storage, exec error", zap.Error(err))
+		logger.Error("Could not remove storage, usage error", zap.Error(err))
 		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
 	}
 
-	// If not all keys resulted in a delete, rollback and return an error an error.
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected != int64(len(keys)) {
-		err = tx.Rollback()
-		if err != nil {
-			logger.Error("Could not remove storage, rollback error", zap.Error(err))
-		}
+	// If not all keys resulted in a delete, reject.
+	if rowsAffected != int64(len(keys)) {
 		return STORAGE_REJECTED, errors.New("Storage remove rejected: not found, version check failed, or permission denied")
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		logger.Error("Could not remove storage, commit error", zap.Error(err))
-		return RUNTIME_EXCEPTION, errors.New("Could not remove storage")
-	}
-
 	return 0, nil
 }
@@ -0,0 +1,192 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// The most ACL entries a stored record can have.
+const storageMaxAclEntries = 50
+
+// StorageAcl grants a user, or the admins and members of a group, access to a stored record beyond its read and
+// write permissions. Grants only apply to records with a read or write permission of 1, and never allow creating or
+// removing records.
+type StorageAcl struct {
+	UserId  []byte
+	GroupId []byte
+	Read    bool
+	Write   bool
+}
+
+// storageAclClause builds a SQL clause checking the user in the caller parameter is granted "read" or "write" on the
+// stored row with the given ID, directly or through a group.
+func storageAclClause(access string, storageID string, caller string) string {
+	return "EXISTS (SELECT grantee_id FROM storage_acl WHERE storage_id = " + storageID + " AND can_" + access + " = TRUE" +
+		" AND (grantee_id = " + caller + " OR (is_group = TRUE AND EXISTS (SELECT source_id FROM group_edge WHERE source_id = grantee_id AND destination_id = " + caller + " AND (state = 0 OR state = 1)))))"
+}
+
+// storageAclWritable reports whether a client may write another user's live record through its ACL, so a write
+// rejected for lack of access can be told apart from one that failed its version or condition checks.
+func storageAclWritable(tx *sql.Tx, caller uuid.UUID, owner []byte, bucket string, collection string, record string, ts int64) (bool, error) {
+	var writable bool
+	err := tx.QueryRow(`
+SELECT EXISTS (SELECT record FROM storage WHERE user_id = $1 AND bucket = $2 AND collection = $3 AND record = $4
+AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $5) AND write = 1 AND `+storageAclClause("write", "storage.id", "$6")+`)`,
+		owner, bucket, collection, record, ts, caller.Bytes()).Scan(&writable)
+	return writable, err
+}
+
+// StorageAclSet replaces the ACL of a record. Only the record owner or the script runtime can change it.
+func StorageAclSet(logger *zap.Logger, db *sql.DB, caller uuid.UUID, key *StorageKey, entries []*StorageAcl) (code Error_Code, err error) {
+	if len(entries) > storageMaxAclEntries {
+		return BAD_INPUT, fmt.Errorf("At most %v ACL entries are allowed", storageMaxAclEntries)
+	}
+	for _, e := range entries {
+		if (len(e.UserId) == 0) == (len(e.GroupId) == 0) {
+			return BAD_INPUT, errors.New("Each ACL entry must have either a user ID or a group ID")
+		}
+		if _, err := uuid.FromBytes(e.UserId); len(e.UserId) != 0 && err != nil {
+			return BAD_INPUT, errors.New("Invalid ACL entry user ID")
+		}
+		if _, err := uuid.FromBytes(e.GroupId); len(e.GroupId) != 0 && err != nil {
+			return BAD_INPUT, errors.New("Invalid ACL entry group ID")
+		}
+		if !e.Read && !e.Write {
+			return BAD_INPUT, errors.New("Each ACL entry must grant read, write, or both")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not set storage ACL, begin error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not set storage ACL")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not set storage ACL, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				logger.Error("Could not set storage ACL, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not set storage ACL")
+			}
+		}
+	}()
+
+	storageID, code, err := storageAclRecord(logger, tx, caller, key)
+	if err != nil {
+		return code, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM storage_acl WHERE storage_id = $1", storageID); err != nil {
+		logger.Error("Could not set storage ACL, delete error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not set storage ACL")
+	}
+	for _, e := range entries {
+		granteeID, isGroup := e.UserId, false
+		if len(e.GroupId) != 0 {
+			granteeID, isGroup = e.GroupId, true
+		}
+		_, err = tx.Exec(`
+INSERT INTO storage_acl (storage_id, grantee_id, is_group, can_read, can_write)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (storage_id, grantee_id) DO UPDATE SET is_group = $3, can_read = $4, can_write = $5`, storageID, granteeID, isGroup, e.Read, e.Write)
+		if err != nil {
+			logger.Error("Could not set storage ACL, insert error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not set storage ACL")
+		}
+	}
+
+	return 0, nil
+}
+
+// StorageAclFetch lists the ACL of a record. Only the record owner or the script runtime can see it.
+func StorageAclFetch(logger *zap.Logger, db *sql.DB, caller uuid.UUID, key *StorageKey) ([]*StorageAcl, Error_Code, error) {
+	storageID, code, err := storageAclRecord(logger, db, caller, key)
+	if err != nil {
+		return nil, code, err
+	}
+
+	rows, err := db.Query("SELECT grantee_id, is_group, can_read, can_write FROM storage_acl WHERE storage_id = $1", storageID)
+	if err != nil {
+		logger.Error("Could not fetch storage ACL", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not fetch storage ACL")
+	}
+	defer rows.Close()
+
+	entries := make([]*StorageAcl, 0)
+	for rows.Next() {
+		var granteeID []byte
+		var isGroup bool
+		e := &StorageAcl{}
+		if err = rows.Scan(&granteeID, &isGroup, &e.Read, &e.Write); err != nil {
+			logger.Error("Could not fetch storage ACL, scan error", zap.Error(err))
+			return nil, RUNTIME_EXCEPTION, errors.New("Could not fetch storage ACL")
+		}
+		if isGroup {
+			e.GroupId = granteeID
+		} else {
+			e.UserId = granteeID
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not fetch storage ACL, rows error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not fetch storage ACL")
+	}
+
+	return entries, 0, nil
+}
+
+// storageAclRecord finds the ID of the live stored row for the key, checking the caller owns the record.
+func storageAclRecord(logger *zap.Logger, q queryer, caller uuid.UUID, key *StorageKey) ([]byte, Error_Code, error) {
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+	owner := []byte{}
+	if len(key.UserId) != 0 {
+		if uid, err := uuid.FromBytes(key.UserId); err != nil {
+			return nil, BAD_INPUT, errors.New("Invalid user ID")
+		} else if caller != uuid.Nil && caller != uid {
+			return nil, BAD_INPUT, errors.New("A client can only manage the ACL of their own records")
+		} else {
+			owner = uid.Bytes()
+		}
+	} else if caller != uuid.Nil {
+		return nil, BAD_INPUT, errors.New("A client cannot manage the ACL of global records")
+	}
+
+	var storageID []byte
+	err := q.QueryRow(`
+SELECT id FROM storage
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $5)`,
+		key.Bucket, key.Collection, owner, key.Record, nowMs()).Scan(&storageID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, STORAGE_REJECTED, errors.New("Storage record not found")
+		}
+		logger.Error("Could not find storage record for ACL", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not find storage record")
+	}
+	return storageID, 0, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// StorageIncrement atomically adds delta to a numeric field of an existing stored JSON object, returning the updated
+// record and the new value of the field. A missing field starts at 0, but the object holding it must exist. The
+// increment only goes ahead if the record passes any version check and all the conditions, so a decrement can be
+// stopped from taking a balance below zero with a condition such as "coins >= 10".
+func StorageIncrement(logger *zap.Logger, db *sql.DB, config *StorageConfig, caller uuid.UUID, key *StorageKey, field string, delta float64, conditions []*StorageCondition) (*StorageData, float64, Error_Code, error) {
+	if key.Bucket == "" || key.Collection == "" || key.Record == "" {
+		return nil, 0, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+	if !storageConditionFieldPattern.MatchString(field) {
+		return nil, 0, BAD_INPUT, errors.New("Field must be dot separated names of letters, digits, _ or -")
+	}
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return nil, 0, BAD_INPUT, errors.New("Invalid increment")
+	}
+	if len(conditions) > storageMaxConditions {
+		return nil, 0, BAD_INPUT, errors.New("Too many conditions")
+	}
+	for _, c := range conditions {
+		if err := storageConditionValidate(c); err != nil {
+			return nil, 0, BAD_INPUT, err
+		}
+	}
+
+	owner := []byte{}
+	if len(key.UserId) != 0 {
+		uid, err := uuid.FromBytes(key.UserId)
+		if err != nil {
+			return nil, 0, BAD_INPUT, errors.New("Invalid user ID")
+		}
+		owner = uid.Bytes()
+	} else if caller != uuid.Nil {
+		return nil, 0, BAD_INPUT, errors.New("A client cannot write global records")
+	}
+	// A client incrementing another user's record needs write access through the record's ACL.
+	shared := caller != uuid.Nil && !bytes.Equal(owner, caller.Bytes())
+
+	ts := nowMs()
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not increment storage, transaction error", zap.Error(err))
+		return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+	}
+
+	data, value, code, err := storageIncrement(logger, tx, config, caller, key, owner, shared, field, delta, conditions, ts)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not increment storage, rollback error", zap.Error(e))
+		}
+		return nil, 0, code, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not increment storage, commit error", zap.Error(err))
+		return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+	}
+
+	return data, value, 0, nil
+}
+
+func storageIncrement(logger *zap.Logger, tx *sql.Tx, config *StorageConfig, caller uuid.UUID, key *StorageKey, owner []byte, shared bool, field string, delta float64, conditions []*StorageCondition, ts int64) (*StorageData, float64, Error_Code, error) {
+	// Note the size of the value being replaced, for the owner's storage usage.
+	existing := int64(0)
+	if len(owner) != 0 {
+		var err error
+		if existing, err = storageExistingSize(tx, key.Bucket, key.Collection, owner, key.Record); err != nil {
+			logger.Error("Could not increment storage, size error", zap.Error(err))
+			return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+		}
+	}
+
+	// The new value and its version are both computed from the stored value in the same statement, so concurrent
+	// increments never overwrite each other.
+	newValue := "jsonb_set(" + storageValueJSON + ", $6::TEXT[], (COALESCE((" + storageValueJSON + " #>> $6::TEXT[])::DECIMAL, 0) + $7::DECIMAL)::TEXT::JSONB)::TEXT"
+	query := `
+UPDATE storage SET value = convert_to(` + newValue + `, 'UTF8'), version = convert_to(sha256(` + newValue + `), 'UTF8'), updated_at = $5
+WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $5)
+AND jsonb_typeof(` + storageValueJSON + `) = 'object' AND COALESCE(jsonb_typeof(` + storageValueJSON + ` #> $6::TEXT[]), 'number') = 'number'`
+	params := []interface{}{key.Bucket, key.Collection, owner, key.Record, ts, "{" + strings.Replace(field, ".", ",", -1) + "}", delta}
+	if len(key.Version) != 0 {
+		params = append(params, key.Version)
+		query += " AND version = $" + strconv.Itoa(len(params))
+	}
+	for _, c := range conditions {
+		var clause string
+		clause, params = storageConditionClause(c, params)
+		query += " AND " + clause
+	}
+	// If needed use an additional clause to enforce permissions.
+	if caller != uuid.Nil {
+		query += " AND write = 1"
+	}
+	if shared {
+		params = append(params, caller.Bytes())
+		query += " AND " + storageAclClause("write", "storage.id", "$"+strconv.Itoa(len(params)))
+	}
+	query += `
+RETURNING value, version, read, write, created_at, expires_at, ` + storageValueJSON + ` #>> $6::TEXT[]`
+
+	data := &StorageData{
+		Bucket:     key.Bucket,
+		Collection: key.Collection,
+		Record:     key.Record,
+		UserId:     key.UserId,
+		UpdatedAt:  ts,
+	}
+	var result sql.NullString
+	err := tx.QueryRow(query, params...).Scan(&data.Value, &data.Version, &data.PermissionRead, &data.PermissionWrite, &data.CreatedAt, &data.ExpiresAt, &result)
+	if err == sql.ErrNoRows {
+		if shared {
+			if writable, err := storageAclWritable(tx, caller, owner, key.Bucket, key.Collection, key.Record, ts); err != nil {
+				logger.Error("Could not increment storage, access check error", zap.Error(err))
+				return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+			} else if !writable {
+				return nil, 0, STORAGE_REJECTED, errors.New("A client can only write their own records, or records shared with them")
+			}
+		}
+		return nil, 0, STORAGE_REJECTED, errors.New("Storage increment rejected: not found, not a number, version or condition check failed, or permission denied")
+	} else if err != nil {
+		logger.Error("Could not increment storage, query error", zap.Error(err))
+		return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+	}
+	// The object that should hold the field is missing, so nothing was set.
+	if !result.Valid {
+		return nil, 0, STORAGE_REJECTED, errors.New("Storage increment rejected: field parent not found")
+	}
+	value, err := strconv.ParseFloat(result.String, 64)
+	if err != nil {
+		logger.Error("Could not increment storage, result error", zap.Error(err))
+		return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+	}
+
+	schemas := storageSchemaCache{}
+	if code, err := schemas.validate(logger, tx, key.Bucket, key.Collection, data.Value); err != nil {
+		return nil, 0, code, err
+	}
+
+	if len(owner) != 0 {
+		if code, err := storageUsageWrite(logger, tx, config, caller, owner, int64(len(data.Value)), existing); err != nil {
+			return nil, 0, code, err
+		}
+	}
+
+	// Keep any indexed fields of the record in step with its new value.
+	if err = storageIndexUpdate(tx, key.Bucket, key.Collection, owner, key.Record); err != nil {
+		logger.Error("Could not increment storage, index error", zap.Error(err))
+		return nil, 0, RUNTIME_EXCEPTION, errors.New("Could not increment storage")
+	}
+
+	return data, value, 0, nil
+}
@@ -0,0 +1,337 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Indexed field values extracted from the stored object s, for the indexed field f.
+const (
+	storageIndexStringValue = "CASE WHEN jsonb_typeof(convert_from(s.value, 'UTF8')::JSONB #> f.path::TEXT[]) = 'string' THEN convert_from(s.value, 'UTF8')::JSONB #>> f.path::TEXT[] END"
+	storageIndexNumberValue = "CASE WHEN jsonb_typeof(convert_from(s.value, 'UTF8')::JSONB #> f.path::TEXT[]) = 'number' THEN (convert_from(s.value, 'UTF8')::JSONB #>> f.path::TEXT[])::DECIMAL END"
+)
+
+type storageQueryCursor struct {
+	SortValue string
+	UserID    []byte
+	Record    string
+}
+
+// StorageIndexesSync makes the indexed fields match the config, indexing existing objects in newly indexed fields and
+// dropping the index of fields that are no longer configured. Index entries of removed objects are cleaned up too.
+func StorageIndexesSync(logger *zap.Logger, db *sql.DB, config *StorageConfig) (err error) {
+	type indexField struct {
+		bucket     string
+		collection string
+		field      string
+	}
+	configured := make(map[indexField]bool)
+	for _, index := range config.Indexes {
+		if index.Bucket == "" || index.Collection == "" {
+			return errors.New("Storage indexes must have a bucket and collection")
+		}
+		for _, field := range index.Fields {
+			if !storageConditionFieldPattern.MatchString(field) {
+				return fmt.Errorf("Invalid storage index field %q, must be dot separated names of letters, digits, _ or -", field)
+			}
+			configured[indexField{index.Bucket, index.Collection, field}] = true
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not sync storage indexes, rollback error", zap.Error(e))
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	rows, err := tx.Query("SELECT bucket, collection, field FROM storage_index_field")
+	if err != nil {
+		return err
+	}
+	existing := make(map[indexField]bool)
+	for rows.Next() {
+		f := indexField{}
+		if err = rows.Scan(&f.bucket, &f.collection, &f.field); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[f] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for f := range existing {
+		if configured[f] {
+			continue
+		}
+		if _, err = tx.Exec("DELETE FROM storage_index WHERE bucket = $1 AND collection = $2 AND field = $3", f.bucket, f.collection, f.field); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM storage_index_field WHERE bucket = $1 AND collection = $2 AND field = $3", f.bucket, f.collection, f.field); err != nil {
+			return err
+		}
+		logger.Info("Dropped storage index", zap.String("bucket", f.bucket), zap.String("collection", f.collection), zap.String("field", f.field))
+	}
+
+	for f := range configured {
+		if existing[f] {
+			continue
+		}
+		path := "{" + strings.Replace(f.field, ".", ",", -1) + "}"
+		if _, err = tx.Exec("INSERT INTO storage_index_field (bucket, collection, field, path) VALUES ($1, $2, $3, $4)", f.bucket, f.collection, f.field, path); err != nil {
+			return err
+		}
+		res, e := tx.Exec(`
+INSERT INTO storage_index (bucket, collection, user_id, record, field, string_value, number_value)
+SELECT s.bucket, s.collection, s.user_id, s.record, f.field, `+storageIndexStringValue+`, `+storageIndexNumberValue+`
+FROM storage_index_field f, storage s
+WHERE f.bucket = $1 AND f.collection = $2 AND f.field = $3 AND s.bucket = $1 AND s.collection = $2 AND s.deleted_at = 0`, f.bucket, f.collection, f.field)
+		if e != nil {
+			err = e
+			return err
+		}
+		count, _ := res.RowsAffected()
+		logger.Info("Created storage index", zap.String("bucket", f.bucket), zap.String("collection", f.collection), zap.String("field", f.field), zap.Int64("count", count))
+	}
+
+	_, err = tx.Exec(`
+DELETE FROM storage_index
+WHERE NOT EXISTS (SELECT record FROM storage s WHERE s.bucket = storage_index.bucket AND s.collection = storage_index.collection AND s.user_id = storage_index.user_id AND s.record = storage_index.record AND s.deleted_at = 0)`)
+	return err
+}
+
+// storageIndexUpdate replaces the index entries of a stored object with the current values of the indexed fields of
+// its collection, if it has any.
+func storageIndexUpdate(tx *sql.Tx, bucket string, collection string, userID []byte, record string) error {
+	_, err := tx.Exec("DELETE FROM storage_index WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4", bucket, collection, userID, record)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+INSERT INTO storage_index (bucket, collection, user_id, record, field, string_value, number_value)
+SELECT s.bucket, s.collection, s.user_id, s.record, f.field, `+storageIndexStringValue+`, `+storageIndexNumberValue+`
+FROM storage_index_field f, storage s
+WHERE f.bucket = $1 AND f.collection = $2 AND s.bucket = $1 AND s.collection = $2 AND s.user_id = $3 AND s.record = $4 AND s.deleted_at = 0`, bucket, collection, userID, record)
+	return err
+}
+
+// StorageQuery lists objects in a collection whose indexed fields pass all the filters, optionally sorted by an
+// indexed number field. Objects without a number in the sort field are not listed when sorting.
+func StorageQuery(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID []byte, bucket string, collection string, filters []*StorageCondition, sortField string, sortDescending bool, limit int64, cursor []byte) ([]*StorageData, []byte, Error_Code, error) {
+	if bucket == "" || collection == "" {
+		return nil, nil, BAD_INPUT, errors.New("Bucket and collection are required")
+	}
+
+	owner := uuid.Nil
+	if len(userID) != 0 {
+		if uid, err := uuid.FromBytes(userID); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid user ID")
+		} else {
+			owner = uid
+		}
+	}
+
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	if len(filters) > storageMaxConditions {
+		return nil, nil, BAD_INPUT, fmt.Errorf("At most %v filters are allowed", storageMaxConditions)
+	}
+	for _, f := range filters {
+		if err := storageConditionValidate(f); err != nil {
+			return nil, nil, BAD_INPUT, err
+		}
+		if _, ok := f.Value.(bool); ok {
+			return nil, nil, BAD_INPUT, errors.New("Only string and number fields can be filtered on")
+		}
+	}
+
+	var incomingCursor *storageQueryCursor
+	if len(cursor) != 0 {
+		incomingCursor = &storageQueryCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+	}
+
+	// Only fields declared as indexed can be filtered or sorted on, so the query never scans the collection.
+	rows, err := db.Query("SELECT field FROM storage_index_field WHERE bucket = $1 AND collection = $2", bucket, collection)
+	if err != nil {
+		logger.Error("Could not query storage, index query error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+	}
+	indexed := make(map[string]bool)
+	for rows.Next() {
+		var field string
+		if err = rows.Scan(&field); err != nil {
+			rows.Close()
+			logger.Error("Could not query storage, index scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+		}
+		indexed[field] = true
+	}
+	rows.Close()
+	for _, f := range filters {
+		if !indexed[f.Field] {
+			return nil, nil, BAD_INPUT, fmt.Errorf("Field %q is not indexed in this collection", f.Field)
+		}
+	}
+	if sortField != "" && !indexed[sortField] {
+		return nil, nil, BAD_INPUT, fmt.Errorf("Field %q is not indexed in this collection", sortField)
+	}
+
+	query := "SELECT s.user_id, s.bucket, s.collection, s.record, s.value, s.version, s.read, s.write, s.created_at, s.updated_at, s.expires_at"
+	if sortField != "" {
+		query += ", o.number_value"
+	}
+	query += " FROM storage s"
+	params := []interface{}{bucket, collection}
+
+	join := func(alias string, field string) {
+		params = append(params, field)
+		query += fmt.Sprintf(" JOIN storage_index %v ON %v.bucket = s.bucket AND %v.collection = s.collection AND %v.user_id = s.user_id AND %v.record = s.record AND %v.field = $%v", alias, alias, alias, alias, alias, alias, len(params))
+	}
+	for i, f := range filters {
+		alias := fmt.Sprintf("f%v", i)
+		join(alias, f.Field)
+		params = append(params, f.Value)
+		switch f.Value.(type) {
+		case string:
+			query += fmt.Sprintf(" AND %v.string_value %v $%v", alias, f.Op, len(params))
+		default:
+			query += fmt.Sprintf(" AND %v.number_value %v $%v::DECIMAL", alias, f.Op, len(params))
+		}
+	}
+	if sortField != "" {
+		join("o", sortField)
+		query += " AND o.number_value IS NOT NULL"
+	}
+
+	params = append(params, nowMs())
+	query += fmt.Sprintf(" WHERE s.bucket = $1 AND s.collection = $2 AND s.deleted_at = 0 AND (s.expires_at = 0 OR s.expires_at > $%v)", len(params))
+	if owner != uuid.Nil {
+		params = append(params, owner.Bytes())
+		query += fmt.Sprintf(" AND s.user_id = $%v", len(params))
+	}
+
+	// Apply permissions as needed.
+	if caller == uuid.Nil {
+		// Script runtime can list all data regardless of read permission.
+		query += " AND s.read >= 0"
+	} else if owner != uuid.Nil && caller == owner {
+		// The caller is listing their own data.
+		query += " AND s.read >= 1"
+	} else {
+		// Other users' data is listed if it's public, or shared with the caller.
+		params = append(params, caller.Bytes())
+		query += fmt.Sprintf(" AND (s.read >= 2 OR (s.read = 1 AND %v))", storageAclClause("read", "s.id", fmt.Sprintf("$%v", len(params))))
+	}
+
+	direction, comparison := "ASC", ">"
+	if sortDescending {
+		direction, comparison = "DESC", "<"
+	}
+	if incomingCursor != nil {
+		if sortField != "" {
+			params = append(params, incomingCursor.SortValue, incomingCursor.UserID, incomingCursor.Record)
+			query += fmt.Sprintf(" AND (o.number_value, s.user_id, s.record) %v ($%v::DECIMAL, $%v, $%v)", comparison, len(params)-2, len(params)-1, len(params))
+		} else {
+			params = append(params, incomingCursor.UserID, incomingCursor.Record)
+			query += fmt.Sprintf(" AND (s.user_id, s.record) %v ($%v, $%v)", comparison, len(params)-1, len(params))
+		}
+	}
+	if sortField != "" {
+		query += fmt.Sprintf(" ORDER BY o.number_value %v, s.user_id %v, s.record %v", direction, direction, direction)
+	} else {
+		query += fmt.Sprintf(" ORDER BY s.user_id %v, s.record %v", direction, direction)
+	}
+
+	params = append(params, limit+1)
+	query += fmt.Sprintf(" LIMIT $%v", len(params))
+
+	rows, err = db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not query storage", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+	}
+	defer rows.Close()
+
+	storageData := make([]*StorageData, 0)
+	var outgoingCursor []byte
+	var sortValue sql.NullString
+	for rows.Next() {
+		if int64(len(storageData)) >= limit {
+			last := storageData[len(storageData)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&storageQueryCursor{SortValue: sortValue.String, UserID: storageOwner(last.UserId), Record: last.Record}); err != nil {
+				logger.Error("Could not create storage query cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		d := &StorageData{}
+		dest := []interface{}{&d.UserId, &d.Bucket, &d.Collection, &d.Record, &d.Value, &d.Version, &d.PermissionRead, &d.PermissionWrite, &d.CreatedAt, &d.UpdatedAt, &d.ExpiresAt}
+		if sortField != "" {
+			dest = append(dest, &sortValue)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			logger.Error("Could not query storage, scan error", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+		}
+		// Potentially coerce zero-length global owner field.
+		if len(d.UserId) == 0 {
+			d.UserId = nil
+		}
+		storageData = append(storageData, d)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not query storage, rows error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not query storage")
+	}
+
+	return storageData, outgoingCursor, 0, nil
+}
+
+// storageOwner is the user ID a record is stored under, an empty ID for global records.
+func storageOwner(userID []byte) []byte {
+	if len(userID) == 0 {
+		return []byte{}
+	}
+	return userID
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// storageUsageAdd changes the bytes stored by a user, returning their new usage and quota. A quota of 0 means none.
+func storageUsageAdd(tx *sql.Tx, config *StorageConfig, owner []byte, delta int64) (int64, int64, error) {
+	var used int64
+	var quota sql.NullInt64
+	err := tx.QueryRow(`
+INSERT INTO storage_usage (user_id, bytes) VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET bytes = storage_usage.bytes + $2
+RETURNING bytes, quota_bytes`, owner, delta).Scan(&used, &quota)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !quota.Valid {
+		return used, config.UserQuotaBytes, nil
+	}
+	return used, quota.Int64, nil
+}
+
+// storageExistingSize returns the size of the value of a user's record that a write would replace, expired or not.
+func storageExistingSize(tx *sql.Tx, bucket string, collection string, owner []byte, record string) (int64, error) {
+	var size int64
+	err := tx.QueryRow("SELECT length(value) FROM storage WHERE bucket = $1 AND collection = $2 AND user_id = $3 AND record = $4 AND deleted_at = 0",
+		bucket, collection, owner, record).Scan(&size)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return size, nil
+}
+
+// storageUsageWrite accounts for a value of a user's record replacing one of the existing size. Clients are rejected
+// if the write takes the user over their quota, but can always shrink what they store. The caller must roll back the
+// transaction on error.
+func storageUsageWrite(logger *zap.Logger, tx *sql.Tx, config *StorageConfig, caller uuid.UUID, owner []byte, size int64, existing int64) (Error_Code, error) {
+	used, quota, err := storageUsageAdd(tx, config, owner, size-existing)
+	if err != nil {
+		logger.Error("Could not update storage usage", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not update storage usage")
+	}
+	if caller != uuid.Nil && quota != 0 && used > quota && size > existing {
+		return STORAGE_QUOTA_EXCEEDED, fmt.Errorf("Storage quota of %v bytes exceeded", quota)
+	}
+	return 0, nil
+}
+
+// storageUsageRemove accounts for removed records, reading the owner and value size of each from the rows.
+func storageUsageRemove(tx *sql.Tx, rows *sql.Rows) (int64, error) {
+	count := int64(0)
+	removed := make(map[string]int64)
+	for rows.Next() {
+		var owner []byte
+		var size int64
+		if err := rows.Scan(&owner, &size); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		count++
+		if len(owner) != 0 {
+			removed[string(owner)] += size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	for owner, size := range removed {
+		if _, err := tx.Exec("UPDATE storage_usage SET bytes = bytes - $2 WHERE user_id = $1", []byte(owner), size); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// StorageUsageFetch returns the bytes a user stores, and their quota. A quota of 0 means none.
+func StorageUsageFetch(logger *zap.Logger, db *sql.DB, config *StorageConfig, userID uuid.UUID) (int64, int64, Error_Code, error) {
+	var used int64
+	var quota sql.NullInt64
+	err := db.QueryRow("SELECT bytes, quota_bytes FROM storage_usage WHERE user_id = $1", userID.Bytes()).Scan(&used, &quota)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Could not fetch storage usage", zap.Error(err))
+		return 0, 0, RUNTIME_EXCEPTION, errors.New("Could not fetch storage usage")
+	}
+	if !quota.Valid {
+		return used, config.UserQuotaBytes, 0, nil
+	}
+	return used, quota.Int64, 0, nil
+}
+
+// StorageQuotaSet overrides the storage quota of a user. A quota of 0 means none, and a negative quota restores the
+// configured quota. Records already stored are kept even if the user is over the new quota.
+func StorageQuotaSet(logger *zap.Logger, db *sql.DB, userID uuid.UUID, quota int64) error {
+	value := sql.NullInt64{Int64: quota, Valid: quota >= 0}
+	_, err := db.Exec(`
+INSERT INTO storage_usage (user_id, quota_bytes) VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE SET quota_bytes = $2`, userID.Bytes(), value)
+	if err != nil {
+		logger.Error("Could not set storage quota", zap.Error(err))
+		return errors.New("Could not set storage quota")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"nakama/pkg/jsonschema"
+
+	"go.uber.org/zap"
+)
+
+// StorageSchemasSync stores the schemas from the config, and drops schemas of collections that are no longer in the
+// config. Schemas the script runtime set for other collections are left in place.
+func StorageSchemasSync(logger *zap.Logger, db *sql.DB, config *StorageConfig) (err error) {
+	type collection struct {
+		bucket     string
+		collection string
+	}
+	configured := make(map[collection]bool)
+	for _, s := range config.Schemas {
+		if s.Bucket == "" || s.Collection == "" {
+			return errors.New("Storage schemas must have a bucket and collection")
+		}
+		if _, err := jsonschema.Parse([]byte(s.Schema)); err != nil {
+			return fmt.Errorf("Invalid storage schema for bucket %q collection %q: %v", s.Bucket, s.Collection, err)
+		}
+		configured[collection{s.Bucket, s.Collection}] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not sync storage schemas, rollback error", zap.Error(e))
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	rows, err := tx.Query("SELECT bucket, collection FROM storage_schema WHERE from_config = TRUE")
+	if err != nil {
+		return err
+	}
+	existing := make([]collection, 0)
+	for rows.Next() {
+		c := collection{}
+		if err = rows.Scan(&c.bucket, &c.collection); err != nil {
+			rows.Close()
+			return err
+		}
+		existing = append(existing, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range existing {
+		if configured[c] {
+			continue
+		}
+		if _, err = tx.Exec("DELETE FROM storage_schema WHERE bucket = $1 AND collection = $2", c.bucket, c.collection); err != nil {
+			return err
+		}
+		logger.Info("Dropped storage schema", zap.String("bucket", c.bucket), zap.String("collection", c.collection))
+	}
+
+	for _, s := range config.Schemas {
+		_, err = tx.Exec(`
+INSERT INTO storage_schema (bucket, collection, schema, from_config) VALUES ($1, $2, $3, TRUE)
+ON CONFLICT (bucket, collection) DO UPDATE SET schema = $3, from_config = TRUE`, s.Bucket, s.Collection, []byte(s.Schema))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StorageSchemaSet sets the JSON Schema that values written to a collection must match, or removes it if the schema
+// is empty. Values already stored are not checked.
+func StorageSchemaSet(logger *zap.Logger, db *sql.DB, bucket string, collection string, schema []byte) (Error_Code, error) {
+	if bucket == "" || collection == "" {
+		return BAD_INPUT, errors.New("Invalid values for bucket or collection")
+	}
+
+	if len(schema) == 0 {
+		if _, err := db.Exec("DELETE FROM storage_schema WHERE bucket = $1 AND collection = $2", bucket, collection); err != nil {
+			logger.Error("Could not remove storage schema", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not remove storage schema")
+		}
+		return 0, nil
+	}
+
+	if _, err := jsonschema.Parse(schema); err != nil {
+		return BAD_INPUT, fmt.Errorf("Invalid storage schema: %v", err)
+	}
+	_, err := db.Exec(`
+INSERT INTO storage_schema (bucket, collection, schema, from_config) VALUES ($1, $2, $3, FALSE)
+ON CONFLICT (bucket, collection) DO UPDATE SET schema = $3, from_config = FALSE`, bucket, collection, schema)
+	if err != nil {
+		logger.Error("Could not set storage schema", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not set storage schema")
+	}
+	return 0, nil
+}
+
+// storageSchemaCache holds the schemas looked up during one storage operation, nil for collections without one.
+type storageSchemaCache map[[2]string]*jsonschema.Schema
+
+// validate checks a value matches the schema of its collection, if it has one.
+func (c storageSchemaCache) validate(logger *zap.Logger, q queryer, bucket string, collection string, value []byte) (Error_Code, error) {
+	schema, ok := c[[2]string{bucket, collection}]
+	if !ok {
+		var raw []byte
+		err := q.QueryRow("SELECT schema FROM storage_schema WHERE bucket = $1 AND collection = $2", bucket, collection).Scan(&raw)
+		if err != nil && err != sql.ErrNoRows {
+			logger.Error("Could not look up storage schema", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not look up storage schema")
+		}
+		if err == nil {
+			if schema, err = jsonschema.Parse(raw); err != nil {
+				logger.Error("Could not parse storage schema", zap.String("bucket", bucket), zap.String("collection", collection), zap.Error(err))
+				return RUNTIME_EXCEPTION, errors.New("Could not look up storage schema")
+			}
+		}
+		c[[2]string{bucket, collection}] = schema
+	}
+
+	if schema == nil {
+		return 0, nil
+	}
+	if err := schema.Validate(value); err != nil {
+		return BAD_INPUT, fmt.Errorf("Value does not match the schema of collection %q: %v", collection, err)
+	}
+	return 0, nil
+}
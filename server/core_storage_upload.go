@@ -0,0 +1,211 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// The largest value that can be stored, matching the database constraint.
+const storageMaxValueSize = 4194304
+
+// storageUploadMaxSize returns the largest value that can be uploaded in chunks to the collection.
+func storageUploadMaxSize(config *StorageConfig, bucket string, collection string) int64 {
+	max := config.UploadMaxSizeBytes
+	for _, l := range config.UploadLimits {
+		if l.Bucket == bucket && l.Collection == collection {
+			max = l.MaxSizeBytes
+			break
+		}
+	}
+	if max > storageMaxValueSize {
+		max = storageMaxValueSize
+	}
+	return max
+}
+
+// StorageUploadBegin starts an upload of a value of the given size, to be written to one of the user's records when
+// the upload is committed. The value in the data is ignored, and the version is checked when the upload is committed.
+func StorageUploadBegin(logger *zap.Logger, db *sql.DB, config *StorageConfig, userID uuid.UUID, data *StorageData, size int64) ([]byte, Error_Code, error) {
+	if data.Bucket == "" || data.Collection == "" || data.Record == "" {
+		return nil, BAD_INPUT, errors.New("Invalid values for bucket, collection, or record")
+	}
+	if data.PermissionRead != 0 && data.PermissionRead != 1 && data.PermissionRead != 2 {
+		return nil, BAD_INPUT, errors.New("Invalid read permission value")
+	}
+	if data.PermissionWrite != 0 && data.PermissionWrite != 1 {
+		return nil, BAD_INPUT, errors.New("Invalid write permission value")
+	}
+	if size <= 0 {
+		return nil, BAD_INPUT, errors.New("Upload size must be greater than 0")
+	}
+	if max := storageUploadMaxSize(config, data.Bucket, data.Collection); size > max {
+		return nil, BAD_INPUT, fmt.Errorf("Upload size must be at most %v bytes", max)
+	}
+
+	// Only start the upload if the user's unfinished uploads, including this one, stay within the quota.
+	uploadID := uuid.NewV4().Bytes()
+	ts := nowMs()
+	res, err := db.Exec(`
+INSERT INTO storage_upload (id, user_id, bucket, collection, record, version, read, write, size, created_at)
+SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+WHERE (SELECT COALESCE(SUM(size), 0) FROM storage_upload WHERE user_id = $2 AND created_at > $11) + $9 <= $12`,
+		uploadID, userID.Bytes(), data.Bucket, data.Collection, data.Record, data.Version, data.PermissionRead, data.PermissionWrite, size, ts,
+		ts-config.UploadExpiryMs, config.UploadUserQuotaBytes)
+	if err != nil {
+		logger.Error("Could not begin storage upload", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not begin storage upload")
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return nil, STORAGE_REJECTED, fmt.Errorf("Unfinished uploads can be at most %v bytes in total", config.UploadUserQuotaBytes)
+	}
+
+	return uploadID, 0, nil
+}
+
+// StorageUploadAppend adds a chunk to one of the user's uploads. The offset must match the bytes received so far,
+// which are returned with the error otherwise so the client can resume.
+func StorageUploadAppend(logger *zap.Logger, db *sql.DB, config *StorageConfig, userID uuid.UUID, uploadID []byte, offset int64, chunk []byte) (int64, Error_Code, error) {
+	if len(chunk) == 0 {
+		return 0, BAD_INPUT, errors.New("Upload chunk must not be empty")
+	}
+
+	expiry := nowMs() - config.UploadExpiryMs
+	var received int64
+	err := db.QueryRow(`
+UPDATE storage_upload SET value = value || $1
+WHERE id = $2 AND user_id = $3 AND created_at > $4 AND length(value) = $5 AND length(value) + $6 <= size
+RETURNING length(value)`, chunk, uploadID, userID.Bytes(), expiry, offset, len(chunk)).Scan(&received)
+	if err == nil {
+		return received, 0, nil
+	} else if err != sql.ErrNoRows {
+		logger.Error("Could not append to storage upload", zap.Error(err))
+		return 0, RUNTIME_EXCEPTION, errors.New("Could not append to storage upload")
+	}
+
+	// Find out why the chunk was not added.
+	var size int64
+	err = db.QueryRow("SELECT length(value), size FROM storage_upload WHERE id = $1 AND user_id = $2 AND created_at > $3",
+		uploadID, userID.Bytes(), expiry).Scan(&received, &size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, STORAGE_REJECTED, errors.New("Storage upload not found")
+		}
+		logger.Error("Could not append to storage upload, select error", zap.Error(err))
+		return 0, RUNTIME_EXCEPTION, errors.New("Could not append to storage upload")
+	}
+	if offset != received {
+		return received, STORAGE_REJECTED, fmt.Errorf("Upload chunk offset must be %v", received)
+	}
+	return received, BAD_INPUT, fmt.Errorf("Upload chunk exceeds the upload size of %v bytes", size)
+}
+
+// StorageUploadCommit writes a completed upload to the user's record, and discards the upload.
+func StorageUploadCommit(logger *zap.Logger, db *sql.DB, config *StorageConfig, userID uuid.UUID, uploadID []byte) (*StorageData, *StorageKey, Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not commit storage upload, begin error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not commit storage upload")
+	}
+
+	data, key, code, err := storageUploadCommit(logger, tx, config, userID, uploadID)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			logger.Error("Could not commit storage upload, rollback error", zap.Error(e))
+		}
+		return nil, nil, code, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not commit storage upload, commit error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not commit storage upload")
+	}
+
+	return data, key, 0, nil
+}
+
+// storageUploadCommit writes the upload in the transaction. The caller must roll back the transaction on error.
+func storageUploadCommit(logger *zap.Logger, tx *sql.Tx, config *StorageConfig, userID uuid.UUID, uploadID []byte) (*StorageData, *StorageKey, Error_Code, error) {
+	var size int64
+	data := &StorageData{UserId: userID.Bytes()}
+	err := tx.QueryRow(`
+SELECT bucket, collection, record, version, read, write, size, value FROM storage_upload
+WHERE id = $1 AND user_id = $2 AND created_at > $3`, uploadID, userID.Bytes(), nowMs()-config.UploadExpiryMs).
+		Scan(&data.Bucket, &data.Collection, &data.Record, &data.Version, &data.PermissionRead, &data.PermissionWrite, &size, &data.Value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, STORAGE_REJECTED, errors.New("Storage upload not found")
+		}
+		logger.Error("Could not commit storage upload, select error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not commit storage upload")
+	}
+	if int64(len(data.Value)) != size {
+		return nil, nil, BAD_INPUT, fmt.Errorf("Upload is incomplete, %v of %v bytes received", len(data.Value), size)
+	}
+
+	if code, err := storageWriteValidate(userID, []*StorageData{data}); err != nil {
+		return nil, nil, code, err
+	}
+	keys, code, err := storageWrite(logger, tx, config, userID, []*StorageData{data}, nowMs())
+	if err != nil {
+		return nil, nil, code, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM storage_upload WHERE id = $1", uploadID); err != nil {
+		logger.Error("Could not commit storage upload, delete error", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not commit storage upload")
+	}
+
+	return data, keys[0], 0, nil
+}
+
+// StorageFetchRange reads part of a stored value, returning the record with only that part of its value and the full
+// size of the value. A length of 0 reads to the end of the value. If the key has a version, the read is rejected
+// once the record has changed, so a value downloaded in several ranges is consistent.
+func StorageFetchRange(logger *zap.Logger, db *sql.DB, caller uuid.UUID, key *StorageKey, offset int64, length int64) (*StorageData, int64, Error_Code, error) {
+	if offset < 0 || length < 0 {
+		return nil, 0, BAD_INPUT, errors.New("Offset and length must not be negative")
+	}
+
+	data, code, err := StorageFetch(logger, db, caller, []*StorageKey{key})
+	if err != nil {
+		return nil, 0, code, err
+	}
+	if len(data) == 0 {
+		return nil, 0, STORAGE_REJECTED, errors.New("Storage record not found")
+	}
+	d := data[0]
+	if len(key.Version) != 0 && !bytes.Equal(key.Version, d.Version) {
+		return nil, 0, STORAGE_REJECTED, errors.New("Storage record version does not match")
+	}
+
+	size := int64(len(d.Value))
+	if offset > size {
+		return nil, 0, BAD_INPUT, errors.New("Offset is past the end of the value")
+	}
+	end := size
+	if length != 0 && offset+length < size {
+		end = offset + length
+	}
+	d.Value = d.Value[offset:end]
+
+	return d, size, 0, nil
+}
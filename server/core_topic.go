@@ -0,0 +1,191 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// topicModerator checks if the user can moderate the topic. Only group topics have moderators, which are the group admins.
+func topicModerator(db *sql.DB, topic *TopicId, userID uuid.UUID) (bool, error) {
+	groupID := topic.GetGroupId()
+	if groupID == nil {
+		return false, nil
+	}
+
+	var count int64
+	err := db.QueryRow("SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0", groupID, userID.Bytes()).Scan(&count)
+	return count != 0, err
+}
+
+// topicModerationReserve checks if the user is allowed to send a message to the topic now. When slow mode is enabled
+// this also records the message time, so concurrent messages from the same user cannot bypass it.
+func topicModerationReserve(db *sql.DB, userID uuid.UUID, topicBytes []byte, topicType int64, ts int64) (Error_Code, error) {
+	var slowModeMs int64
+	var mutedUntil int64
+	err := db.QueryRow(`
+SELECT
+	COALESCE((SELECT slow_mode_ms FROM topic_setting WHERE topic = $1 AND topic_type = $2), 0),
+	COALESCE((SELECT muted_until FROM topic_user WHERE topic = $1 AND topic_type = $2 AND user_id = $3), 0)`,
+		topicBytes, topicType, userID.Bytes()).Scan(&slowModeMs, &mutedUntil)
+	if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+
+	if mutedUntil > ts {
+		return CHAT_USER_MUTED, errors.New("You are muted in this topic")
+	}
+	if slowModeMs == 0 {
+		return 0, nil
+	}
+
+	res, err := db.Exec(`
+INSERT INTO topic_user (topic, topic_type, user_id, last_message_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (topic, topic_type, user_id)
+DO UPDATE SET last_message_at = $4 WHERE topic_user.last_message_at <= $5`,
+		topicBytes, topicType, userID.Bytes(), ts, ts-slowModeMs)
+	if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return CHAT_SLOW_MODE, errors.New("Slow mode is enabled in this topic, wait before sending another message")
+	}
+	return 0, nil
+}
+
+// TopicUserMute prevents a user from sending messages to the topic for the given duration. A duration of 0 unmutes the user.
+func TopicUserMute(logger *zap.Logger, db *sql.DB, caller uuid.UUID, topic *TopicId, userID uuid.UUID, durationMs int64) (Error_Code, error) {
+	topicLogger := logger.With(zap.String("user_id", userID.String()))
+
+	if durationMs < 0 {
+		return BAD_INPUT, errors.New("Mute duration must not be negative")
+	}
+
+	// If the caller is not the script runtime, apply moderator checks.
+	if caller != uuid.Nil {
+		if caller == userID {
+			return BAD_INPUT, errors.New("You can't mute yourself")
+		}
+		moderator, err := topicModerator(db, topic, caller)
+		if err != nil {
+			topicLogger.Error("Could not mute topic user, moderator query error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not mute topic user")
+		}
+		if !moderator {
+			return BAD_INPUT, errors.New("Cannot mute topic user - Make sure you are a group admin")
+		}
+	}
+
+	mutedUntil := int64(0)
+	if durationMs != 0 {
+		mutedUntil = nowMs() + durationMs
+	}
+
+	topicBytes, topicType := topicStorageKey(topic)
+	_, err := db.Exec(`
+INSERT INTO topic_user (topic, topic_type, user_id, muted_until) VALUES ($1, $2, $3, $4)
+ON CONFLICT (topic, topic_type, user_id) DO UPDATE SET muted_until = $4`,
+		topicBytes, topicType, userID.Bytes(), mutedUntil)
+	if err != nil {
+		topicLogger.Error("Could not mute topic user, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not mute topic user")
+	}
+
+	topicLogger.Info("Muted topic user", zap.Int64("muted_until", mutedUntil))
+	return 0, nil
+}
+
+// TopicMessagePin pins or unpins a chat message in the topic.
+func TopicMessagePin(logger *zap.Logger, db *sql.DB, caller uuid.UUID, topic *TopicId, messageID []byte, pin bool) (Error_Code, error) {
+	// If the caller is not the script runtime, apply moderator checks.
+	if caller != uuid.Nil {
+		moderator, err := topicModerator(db, topic, caller)
+		if err != nil {
+			logger.Error("Could not pin topic message, moderator query error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not pin topic message")
+		}
+		if !moderator {
+			return BAD_INPUT, errors.New("Cannot pin topic message - Make sure you are a group admin")
+		}
+	}
+
+	topicBytes, topicType := topicStorageKey(topic)
+
+	if !pin {
+		res, err := db.Exec("DELETE FROM topic_pin WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, messageID)
+		if err != nil {
+			logger.Error("Could not unpin topic message, exec error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not unpin topic message")
+		}
+		if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+			return BAD_INPUT, errors.New("Message is not pinned")
+		}
+		return 0, nil
+	}
+
+	res, err := db.Exec(`
+INSERT INTO topic_pin (topic, topic_type, message_id, pinned_by, created_at)
+SELECT $1, $2, $3, $4, $5
+WHERE
+	EXISTS (SELECT message_id FROM message WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND type = 0 AND deleted_at = 0)
+AND
+	(SELECT COUNT(message_id) FROM topic_pin WHERE topic = $1 AND topic_type = $2) < 25
+ON CONFLICT (topic, topic_type, message_id) DO NOTHING`,
+		topicBytes, topicType, messageID, caller.Bytes(), nowMs())
+	if err != nil {
+		logger.Error("Could not pin topic message, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not pin topic message")
+	}
+	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+		return BAD_INPUT, errors.New("Could not pin topic message. Message may not exist, may already be pinned, or the topic has 25 pinned messages")
+	}
+	return 0, nil
+}
+
+// TopicSlowModeSet sets the minimum time between messages from each user in the topic. An interval of 0 disables slow mode.
+func TopicSlowModeSet(logger *zap.Logger, db *sql.DB, caller uuid.UUID, topic *TopicId, intervalMs int64) (Error_Code, error) {
+	if intervalMs < 0 {
+		return BAD_INPUT, errors.New("Slow mode interval must not be negative")
+	}
+
+	// If the caller is not the script runtime, apply moderator checks.
+	if caller != uuid.Nil {
+		moderator, err := topicModerator(db, topic, caller)
+		if err != nil {
+			logger.Error("Could not set topic slow mode, moderator query error", zap.Error(err))
+			return RUNTIME_EXCEPTION, errors.New("Could not set topic slow mode")
+		}
+		if !moderator {
+			return BAD_INPUT, errors.New("Cannot set topic slow mode - Make sure you are a group admin")
+		}
+	}
+
+	topicBytes, topicType := topicStorageKey(topic)
+	_, err := db.Exec(`
+INSERT INTO topic_setting (topic, topic_type, slow_mode_ms) VALUES ($1, $2, $3)
+ON CONFLICT (topic, topic_type) DO UPDATE SET slow_mode_ms = $3`,
+		topicBytes, topicType, intervalMs)
+	if err != nil {
+		logger.Error("Could not set topic slow mode, exec error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not set topic slow mode")
+	}
+
+	logger.Info("Set topic slow mode", zap.Int64("interval_ms", intervalMs))
+	return 0, nil
+}
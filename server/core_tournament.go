@@ -0,0 +1,354 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Maximum number of final standings passed to the tournament end runtime function.
+const tournamentStandingsMax = 1000
+
+type tournamentCursor struct {
+	EndTime int64
+	Id      []byte
+}
+
+// tournamentCreate creates a leaderboard and the tournament window that extends it.
+func tournamentCreate(logger *zap.Logger, db *sql.DB, id []byte, sort string, metadata string, authoritative bool, title string, description string, startTime int64, endTime int64, maxSize int64, joinRequired bool) error {
+	if startTime <= 0 {
+		return errors.New("Tournament start time must be set")
+	}
+	if endTime <= startTime {
+		return errors.New("Tournament end time must be after start time")
+	}
+	if endTime <= nowMs() {
+		return errors.New("Tournament end time must be in the future")
+	}
+	if maxSize < 0 {
+		return errors.New("Tournament max size must be 0 or greater")
+	}
+
+	if _, err := leaderboardCreate(logger, db, id, sort, "", metadata, authoritative, nil); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`
+INSERT INTO tournament (id, title, description, start_time, end_time, max_size, join_required)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`, id, title, description, startTime, endTime, maxSize, joinRequired)
+	if err != nil {
+		logger.Error("Error creating tournament", zap.Error(err))
+		// Don't leave behind a plain leaderboard if the tournament could not be created.
+		if _, e := db.Exec("DELETE FROM leaderboard WHERE id = $1", id); e != nil {
+			logger.Error("Error removing leaderboard after failed tournament create", zap.Error(e))
+		}
+		return err
+	}
+
+	logger.Info("Created tournament", zap.String("id", string(id)), zap.Int64("start_time", startTime), zap.Int64("end_time", endTime))
+	return nil
+}
+
+// tournamentMemberAdd adds the user to the tournament if it has not ended and is not full. Existing members are left as they are.
+func tournamentMemberAdd(tx *sql.Tx, tournamentID []byte, userID uuid.UUID) (Error_Code, error) {
+	var endTime int64
+	var endedAt int64
+	var member bool
+	err := tx.QueryRow(`
+SELECT end_time, ended_at, EXISTS (SELECT user_id FROM tournament_member WHERE tournament_id = $1 AND user_id = $2)
+FROM tournament WHERE id = $1`, tournamentID, userID.Bytes()).Scan(&endTime, &endedAt, &member)
+	if err == sql.ErrNoRows {
+		return BAD_INPUT, errors.New("Tournament not found")
+	} else if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+
+	ts := nowMs()
+	if endedAt != 0 || ts >= endTime {
+		return TOURNAMENT_NOT_ACTIVE, errors.New("Tournament has ended")
+	}
+	if member {
+		return 0, nil
+	}
+
+	res, err := tx.Exec("UPDATE tournament SET size = size + 1 WHERE id = $1 AND (max_size = 0 OR size < max_size)", tournamentID)
+	if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return TOURNAMENT_FULL, errors.New("Tournament is full")
+	}
+
+	if _, err = tx.Exec("INSERT INTO tournament_member (tournament_id, user_id, joined_at) VALUES ($1, $2, $3)", tournamentID, userID.Bytes(), ts); err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+	return 0, nil
+}
+
+func TournamentJoin(logger *zap.Logger, db *sql.DB, caller uuid.UUID, tournamentID []byte) (code Error_Code, err error) {
+	tournamentLogger := logger.With(zap.String("tournament_id", string(tournamentID)), zap.String("user_id", caller.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		tournamentLogger.Error("Could not join tournament, begin error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not join tournament")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			tournamentLogger.Warn("Could not join tournament", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				tournamentLogger.Error("Could not join tournament, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				tournamentLogger.Error("Could not join tournament, commit error", zap.Error(e))
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not join tournament")
+			}
+		}
+	}()
+
+	code, err = tournamentMemberAdd(tx, tournamentID, caller)
+	if err != nil {
+		if code == RUNTIME_EXCEPTION {
+			tournamentLogger.Error("Could not join tournament", zap.Error(err))
+			err = errors.New("Could not join tournament")
+		}
+		return code, err
+	}
+
+	tournamentLogger.Info("User joined tournament")
+	return code, err
+}
+
+// tournamentSubmit checks the tournament window and membership, then writes the record to the tournament leaderboard.
+// Users are added as members on their first submission unless the tournament requires an explicit join.
+func tournamentSubmit(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, caller uuid.UUID, tournamentID []byte, ownerID uuid.UUID, handle string, lang string, op string, value int64, location string, timezone string, metadata []byte) (*LeaderboardRecord, Error_Code, error) {
+	var authoritative bool
+	var startTime int64
+	var endTime int64
+	var endedAt int64
+	var joinRequired bool
+	var member bool
+	err := db.QueryRow(`
+SELECT l.authoritative, t.start_time, t.end_time, t.ended_at, t.join_required,
+	EXISTS (SELECT user_id FROM tournament_member WHERE tournament_id = $1 AND user_id = $2)
+FROM leaderboard l, tournament t
+WHERE l.id = $1 AND t.id = $1`, tournamentID, ownerID.Bytes()).
+		Scan(&authoritative, &startTime, &endTime, &endedAt, &joinRequired, &member)
+	if err == sql.ErrNoRows {
+		return nil, BAD_INPUT, errors.New("Tournament not found")
+	} else if err != nil {
+		logger.Error("Could not execute tournament record write metadata query", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Error writing tournament record")
+	}
+
+	if authoritative && caller != uuid.Nil {
+		return nil, BAD_INPUT, errors.New("Cannot submit to authoritative tournament")
+	}
+
+	ts := nowMs()
+	if endedAt != 0 || ts < startTime || ts >= endTime {
+		return nil, TOURNAMENT_NOT_ACTIVE, errors.New("Tournament is not active")
+	}
+
+	if !member {
+		if joinRequired {
+			return nil, BAD_INPUT, errors.New("Must join tournament before submitting records")
+		}
+		if code, err := TournamentJoin(logger, db, ownerID, tournamentID); err != nil {
+			return nil, code, err
+		}
+	}
+
+	// Tournament checks are done, so write to the underlying leaderboard as the runtime.
+	return leaderboardSubmit(logger, db, rankCache, uuid.Nil, tournamentID, ownerID, handle, lang, op, value, location, timezone, metadata)
+}
+
+func tournamentsList(logger *zap.Logger, db *sql.DB, limit int64, cursor []byte) ([]*Tournament, []byte, Error_Code, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	query := `
+SELECT t.id, t.title, t.description, l.sort_order, l.metadata, t.start_time, t.end_time, t.max_size, t.size, t.join_required, t.ended_at
+FROM tournament t, leaderboard l
+WHERE t.id = l.id AND t.ended_at = 0`
+	params := []interface{}{}
+
+	if len(cursor) != 0 {
+		incomingCursor := &tournamentCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		query += " AND (t.end_time, t.id) > ($1, $2)"
+		params = append(params, incomingCursor.EndTime, incomingCursor.Id)
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY t.end_time ASC, t.id ASC LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Could not execute tournaments list query", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list tournaments")
+	}
+	defer rows.Close()
+
+	tournaments := make([]*Tournament, 0)
+	var outgoingCursor []byte
+	for rows.Next() {
+		if int64(len(tournaments)) >= limit {
+			last := tournaments[len(tournaments)-1]
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&tournamentCursor{EndTime: last.EndTime, Id: last.Id}); err != nil {
+				logger.Error("Error creating tournaments list cursor", zap.Error(err))
+				return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list tournaments")
+			}
+			outgoingCursor = cursorBuf.Bytes()
+			break
+		}
+
+		tournament, err := extractTournament(rows)
+		if err != nil {
+			logger.Error("Could not scan tournaments list query results", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list tournaments")
+		}
+		tournaments = append(tournaments, tournament)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not process tournaments list query results", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list tournaments")
+	}
+
+	return tournaments, outgoingCursor, 0, nil
+}
+
+func extractTournament(r scanner) (*Tournament, error) {
+	t := &Tournament{}
+	err := r.Scan(&t.Id, &t.Title, &t.Description, &t.Sort, &t.Metadata, &t.StartTime, &t.EndTime, &t.MaxSize, &t.Size, &t.JoinRequired, &t.EndedAt)
+	return t, err
+}
+
+// tournamentEnd marks a tournament as ended and returns it with its final standings, or nil if it was already ended.
+func tournamentEnd(db *sql.DB, tournamentID []byte) (*Tournament, []*LeaderboardRecord, error) {
+	res, err := db.Exec("UPDATE tournament SET ended_at = $2 WHERE id = $1 AND ended_at = 0", tournamentID, nowMs())
+	if err != nil {
+		return nil, nil, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		// Another node already ended this tournament.
+		return nil, nil, nil
+	}
+
+	tournament, err := extractTournament(db.QueryRow(`
+SELECT t.id, t.title, t.description, l.sort_order, l.metadata, t.start_time, t.end_time, t.max_size, t.size, t.join_required, t.ended_at
+FROM tournament t, leaderboard l
+WHERE t.id = $1 AND l.id = $1`, tournamentID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order := "score ASC, updated_at ASC, id ASC"
+	if tournament.Sort != 0 {
+		order = "score DESC, updated_at_inverse DESC, id DESC"
+	}
+	rows, err := db.Query(`
+SELECT owner_id, handle, lang, location, timezone, score, num_score, metadata, updated_at
+FROM leaderboard_record
+WHERE leaderboard_id = $1 AND expires_at = 0
+ORDER BY `+order+` LIMIT $2`, tournamentID, tournamentStandingsMax)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*LeaderboardRecord, 0)
+	for rows.Next() {
+		record := &LeaderboardRecord{LeaderboardId: tournamentID}
+		var location sql.NullString
+		var timezone sql.NullString
+		if err = rows.Scan(&record.OwnerId, &record.Handle, &record.Lang, &location, &timezone, &record.Score, &record.NumScore, &record.Metadata, &record.UpdatedAt); err != nil {
+			return nil, nil, err
+		}
+		record.Location = location.String
+		record.Timezone = timezone.String
+		record.Rank = int64(len(records) + 1)
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return tournament, records, nil
+}
+
+// tournamentToMap converts a tournament and its standings into the payload for the tournament end runtime function.
+func tournamentToMap(tournament *Tournament, records []*LeaderboardRecord) (map[string]interface{}, error) {
+	tournamentMetadata := make(map[string]interface{})
+	if err := json.Unmarshal(tournament.Metadata, &tournamentMetadata); err != nil {
+		return nil, err
+	}
+
+	standings := make([]interface{}, 0, len(records))
+	for _, r := range records {
+		recordMetadata := make(map[string]interface{})
+		if err := json.Unmarshal(r.Metadata, &recordMetadata); err != nil {
+			return nil, err
+		}
+		ownerID, _ := uuid.FromBytes(r.OwnerId)
+		standings = append(standings, map[string]interface{}{
+			"OwnerId":   ownerID.String(),
+			"Handle":    r.Handle,
+			"Lang":      r.Lang,
+			"Location":  r.Location,
+			"Timezone":  r.Timezone,
+			"Rank":      r.Rank,
+			"Score":     r.Score,
+			"NumScore":  r.NumScore,
+			"Metadata":  recordMetadata,
+			"UpdatedAt": r.UpdatedAt,
+		})
+	}
+
+	return map[string]interface{}{
+		"Tournament": map[string]interface{}{
+			"Id":           string(tournament.Id),
+			"Title":        tournament.Title,
+			"Description":  tournament.Description,
+			"Sort":         tournament.Sort,
+			"Metadata":     tournamentMetadata,
+			"StartTime":    tournament.StartTime,
+			"EndTime":      tournament.EndTime,
+			"MaxSize":      tournament.MaxSize,
+			"Size":         tournament.Size,
+			"JoinRequired": tournament.JoinRequired,
+			"EndedAt":      tournament.EndedAt,
+		},
+		"Records": standings,
+	}, nil
+}
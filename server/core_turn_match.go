@@ -0,0 +1,561 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const turnMatchColumns = "m.id, m.creator_id, m.state, m.turn, m.turn_user_id, m.turn_timeout_sec, m.turn_expires_at, m.ended, m.winner_id, m.created_at, m.updated_at"
+
+type turnMatchCursor struct {
+	UpdatedAt int64
+	MatchID   []byte
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// TurnMatchCreate starts a turn-based match between the caller and the given users. The caller moves first, then the
+// users in the order given.
+func TurnMatchCreate(logger *zap.Logger, db *sql.DB, config *MatchConfig, caller uuid.UUID, userIDs []uuid.UUID, turnTimeoutSec int64, state []byte) (match *TurnMatch, code Error_Code, err error) {
+	if len(userIDs) == 0 {
+		return nil, BAD_INPUT, errors.New("At least one other user is required")
+	}
+	if int64(len(userIDs))+1 > config.TurnMaxUsers {
+		return nil, BAD_INPUT, errors.New("Too many users, at most " + strconv.FormatInt(config.TurnMaxUsers, 10) + " may play")
+	}
+	if int64(len(state)) > config.TurnStateMaxSizeBytes {
+		return nil, BAD_INPUT, errors.New("State must be at most " + strconv.FormatInt(config.TurnStateMaxSizeBytes, 10) + " bytes")
+	}
+	if turnTimeoutSec < 0 {
+		return nil, BAD_INPUT, errors.New("Turn timeout must be >= 0")
+	} else if turnTimeoutSec == 0 {
+		turnTimeoutSec = config.TurnTimeoutSec
+	}
+
+	seen := map[uuid.UUID]bool{caller: true}
+	statements := make([]string, 0, len(userIDs))
+	params := make([]interface{}, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			return nil, BAD_INPUT, errors.New("Users must be distinct and not include the current user")
+		}
+		seen[userID] = true
+		params = append(params, userID.Bytes())
+		statements = append(statements, "$"+strconv.Itoa(len(params)))
+	}
+
+	var userCount int
+	err = db.QueryRow("SELECT COUNT(id) FROM users WHERE disabled_at = 0 AND id IN ("+strings.Join(statements, ", ")+")", params...).Scan(&userCount)
+	if err != nil {
+		logger.Error("Could not create turn match, user query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not create turn match")
+	}
+	if userCount != len(userIDs) {
+		return nil, USER_NOT_FOUND, errors.New("User not found")
+	}
+
+	ts := nowMs()
+	match = &TurnMatch{
+		MatchId:        uuid.NewV4().Bytes(),
+		CreatorId:      caller.Bytes(),
+		Users:          []*TurnMatch_User{&TurnMatch_User{UserId: caller.Bytes()}},
+		State:          state,
+		TurnUserId:     caller.Bytes(),
+		TurnTimeoutSec: turnTimeoutSec,
+		CreatedAt:      ts,
+		UpdatedAt:      ts,
+	}
+	for _, userID := range userIDs {
+		match.Users = append(match.Users, &TurnMatch_User{UserId: userID.Bytes()})
+	}
+	if turnTimeoutSec > 0 {
+		match.TurnExpiresAt = ts + turnTimeoutSec*1000
+	}
+	if match.State == nil {
+		match.State = []byte{}
+	}
+
+	matchLogger := logger.With(zap.String("match_id", uuid.FromBytesOrNil(match.MatchId).String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		matchLogger.Error("Could not create turn match, begin error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not create turn match")
+	}
+	defer func() {
+		if err != nil {
+			matchLogger.Error("Could not create turn match", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				matchLogger.Error("Could not create turn match, rollback error", zap.Error(e))
+			}
+			match = nil
+			code = RUNTIME_EXCEPTION
+			err = errors.New("Could not create turn match")
+		} else {
+			if e := tx.Commit(); e != nil {
+				matchLogger.Error("Could not create turn match, commit error", zap.Error(e))
+				match = nil
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not create turn match")
+			}
+		}
+	}()
+
+	_, err = tx.Exec(`
+INSERT INTO turn_match (id, creator_id, state, turn_user_id, turn_timeout_sec, turn_expires_at, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`, match.MatchId, match.CreatorId, match.State, match.TurnUserId, match.TurnTimeoutSec, match.TurnExpiresAt, ts)
+	if err != nil {
+		return
+	}
+	for position, user := range match.Users {
+		_, err = tx.Exec("INSERT INTO turn_match_user (match_id, position, user_id) VALUES ($1, $2, $3)", match.MatchId, position, user.UserId)
+		if err != nil {
+			return
+		}
+	}
+
+	matchLogger.Info("Created turn match")
+	return match, 0, nil
+}
+
+// TurnMatchesFetch fetches turn-based matches by ID. Unless the caller is the script runtime, only matches the caller
+// is in are returned.
+func TurnMatchesFetch(logger *zap.Logger, db *sql.DB, caller uuid.UUID, matchIDs []uuid.UUID) ([]*TurnMatch, Error_Code, error) {
+	if len(matchIDs) == 0 {
+		return nil, BAD_INPUT, errors.New("At least one match ID is required")
+	}
+
+	statements := make([]string, 0, len(matchIDs))
+	params := make([]interface{}, 0, len(matchIDs)+1)
+	for _, matchID := range matchIDs {
+		params = append(params, matchID.Bytes())
+		statements = append(statements, "$"+strconv.Itoa(len(params)))
+	}
+	query := "SELECT " + turnMatchColumns + " FROM turn_match m WHERE m.id IN (" + strings.Join(statements, ", ") + ")"
+	if caller != uuid.Nil {
+		params = append(params, caller.Bytes())
+		query += " AND EXISTS (SELECT match_id FROM turn_match_user WHERE match_id = m.id AND user_id = $" + strconv.Itoa(len(params)) + ")"
+	}
+
+	matches, err := turnMatchesQuery(db, query, params...)
+	if err != nil {
+		logger.Error("Could not fetch turn matches", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not fetch turn matches")
+	}
+	return matches, 0, nil
+}
+
+// TurnMatchesList lists the turn-based matches the caller is in, most recently updated first.
+func TurnMatchesList(logger *zap.Logger, db *sql.DB, caller uuid.UUID, active bool, limit int64, cursor []byte) ([]*TurnMatch, []byte, Error_Code, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+
+	query := "SELECT " + turnMatchColumns + " FROM turn_match_user u JOIN turn_match m ON m.id = u.match_id WHERE u.user_id = $1"
+	params := []interface{}{caller.Bytes()}
+	if active {
+		query += " AND m.ended = FALSE"
+	}
+
+	if len(cursor) != 0 {
+		incomingCursor := &turnMatchCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(cursor)).Decode(incomingCursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor data")
+		}
+		query += " AND (m.updated_at, m.id) < ($2, $3)"
+		params = append(params, incomingCursor.UpdatedAt, incomingCursor.MatchID)
+	}
+
+	params = append(params, limit+1)
+	query += " ORDER BY m.updated_at DESC, m.id DESC LIMIT $" + strconv.Itoa(len(params))
+
+	matches, err := turnMatchesQuery(db, query, params...)
+	if err != nil {
+		logger.Error("Could not list turn matches", zap.Error(err))
+		return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list turn matches")
+	}
+
+	var outgoingCursor []byte
+	if int64(len(matches)) > limit {
+		matches = matches[:limit]
+		last := matches[len(matches)-1]
+		cursorBuf := new(bytes.Buffer)
+		if err = gob.NewEncoder(cursorBuf).Encode(&turnMatchCursor{UpdatedAt: last.UpdatedAt, MatchID: last.MatchId}); err != nil {
+			logger.Error("Could not create turn match cursor", zap.Error(err))
+			return nil, nil, RUNTIME_EXCEPTION, errors.New("Could not list turn matches")
+		}
+		outgoingCursor = cursorBuf.Bytes()
+	}
+
+	return matches, outgoingCursor, 0, nil
+}
+
+// TurnMatchMove makes the caller's move on the given turn, replacing the match state and passing the turn on to the
+// next user who has not forfeited. If the move ends the match it may name a winner.
+func TurnMatchMove(logger *zap.Logger, db *sql.DB, config *MatchConfig, caller uuid.UUID, matchID uuid.UUID, turn int64, state []byte, end bool, winnerID uuid.UUID) (match *TurnMatch, code Error_Code, err error) {
+	if int64(len(state)) > config.TurnStateMaxSizeBytes {
+		return nil, BAD_INPUT, errors.New("State must be at most " + strconv.FormatInt(config.TurnStateMaxSizeBytes, 10) + " bytes")
+	}
+	if !end && winnerID != uuid.Nil {
+		return nil, BAD_INPUT, errors.New("A winner can only be set by the move that ends the match")
+	}
+
+	matchLogger := logger.With(zap.String("match_id", matchID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		matchLogger.Error("Could not make turn match move, begin error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not make turn match move")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			matchLogger.Warn("Could not make turn match move", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				matchLogger.Error("Could not make turn match move, rollback error", zap.Error(e))
+			}
+			match = nil
+		} else {
+			if e := tx.Commit(); e != nil {
+				matchLogger.Error("Could not make turn match move, commit error", zap.Error(e))
+				match = nil
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not make turn match move")
+			}
+		}
+	}()
+
+	match, err = turnMatchLoad(tx, matchID)
+	if err != nil {
+		return nil, code, err
+	}
+	if match == nil || turnMatchUser(match, caller.Bytes()) == nil {
+		code = MATCH_NOT_FOUND
+		err = errors.New("Turn match not found")
+		return nil, code, err
+	}
+	if match.Ended || match.Turn != turn || !bytes.Equal(match.TurnUserId, caller.Bytes()) {
+		code = TURN_MATCH_MOVE_REJECTED
+		err = errors.New("It is not your turn")
+		return nil, code, err
+	}
+	if winnerID != uuid.Nil && turnMatchUser(match, winnerID.Bytes()) == nil {
+		code = BAD_INPUT
+		err = errors.New("Winner must be a user in the match")
+		return nil, code, err
+	}
+
+	match.State = state
+	if match.State == nil {
+		match.State = []byte{}
+	}
+	if end {
+		turnMatchEnd(match)
+		if winnerID != uuid.Nil {
+			match.WinnerId = winnerID.Bytes()
+		}
+	} else {
+		turnMatchNext(match, nowMs())
+	}
+
+	code, err = turnMatchUpdate(tx, match, turn)
+	if err != nil {
+		return nil, code, err
+	}
+
+	matchLogger.Debug("Made turn match move", zap.Int64("turn", turn))
+	return match, 0, nil
+}
+
+// TurnMatchForfeit forfeits the match for the caller. If it was the caller's turn it passes to the next user, and if
+// only one user is left who has not forfeited the match ends with them as the winner.
+func TurnMatchForfeit(logger *zap.Logger, db *sql.DB, caller uuid.UUID, matchID uuid.UUID) (match *TurnMatch, code Error_Code, err error) {
+	matchLogger := logger.With(zap.String("match_id", matchID.String()))
+
+	tx, err := db.Begin()
+	if err != nil {
+		matchLogger.Error("Could not forfeit turn match, begin error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not forfeit turn match")
+	}
+
+	code = RUNTIME_EXCEPTION
+	defer func() {
+		if err != nil {
+			matchLogger.Warn("Could not forfeit turn match", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				matchLogger.Error("Could not forfeit turn match, rollback error", zap.Error(e))
+			}
+			match = nil
+		} else {
+			if e := tx.Commit(); e != nil {
+				matchLogger.Error("Could not forfeit turn match, commit error", zap.Error(e))
+				match = nil
+				code = RUNTIME_EXCEPTION
+				err = errors.New("Could not forfeit turn match")
+			}
+		}
+	}()
+
+	match, err = turnMatchLoad(tx, matchID)
+	if err != nil {
+		return nil, code, err
+	}
+	if match == nil || turnMatchUser(match, caller.Bytes()) == nil {
+		code = MATCH_NOT_FOUND
+		err = errors.New("Turn match not found")
+		return nil, code, err
+	}
+	if match.Ended {
+		code = TURN_MATCH_MOVE_REJECTED
+		err = errors.New("Turn match has already ended")
+		return nil, code, err
+	}
+
+	code, err = turnMatchForfeit(tx, match, caller.Bytes(), nowMs())
+	if err != nil {
+		return nil, code, err
+	}
+
+	matchLogger.Info("Forfeited turn match")
+	return match, 0, nil
+}
+
+// turnMatchForfeit marks the user as having forfeited the loaded match and saves it, passing the turn on or ending
+// the match as needed.
+func turnMatchForfeit(tx *sql.Tx, match *TurnMatch, userID []byte, ts int64) (Error_Code, error) {
+	user := turnMatchUser(match, userID)
+	if user.Forfeited {
+		return TURN_MATCH_MOVE_REJECTED, errors.New("User has already forfeited")
+	}
+	user.Forfeited = true
+	_, err := tx.Exec("UPDATE turn_match_user SET forfeited = TRUE WHERE match_id = $1 AND user_id = $2", match.MatchId, userID)
+	if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+
+	turn := match.Turn
+	var remaining *TurnMatch_User
+	remainingCount := 0
+	for _, u := range match.Users {
+		if !u.Forfeited {
+			remaining = u
+			remainingCount++
+		}
+	}
+	if remainingCount <= 1 {
+		turnMatchEnd(match)
+		if remaining != nil {
+			match.WinnerId = remaining.UserId
+		}
+	} else if bytes.Equal(match.TurnUserId, userID) {
+		turnMatchNext(match, ts)
+	}
+
+	return turnMatchUpdate(tx, match, turn)
+}
+
+// turnMatchNext passes the turn to the next user in turn order who has not forfeited.
+func turnMatchNext(match *TurnMatch, ts int64) {
+	current := 0
+	for i, u := range match.Users {
+		if bytes.Equal(u.UserId, match.TurnUserId) {
+			current = i
+			break
+		}
+	}
+	for i := 1; i <= len(match.Users); i++ {
+		next := match.Users[(current+i)%len(match.Users)]
+		if !next.Forfeited {
+			match.TurnUserId = next.UserId
+			break
+		}
+	}
+
+	match.Turn++
+	match.TurnExpiresAt = 0
+	if match.TurnTimeoutSec > 0 {
+		match.TurnExpiresAt = ts + match.TurnTimeoutSec*1000
+	}
+}
+
+func turnMatchEnd(match *TurnMatch) {
+	match.Ended = true
+	match.Turn++
+	match.TurnUserId = nil
+	match.TurnExpiresAt = 0
+}
+
+// turnMatchUpdate saves the match's changes, as long as no other change was saved since it was loaded on the given
+// turn.
+func turnMatchUpdate(tx *sql.Tx, match *TurnMatch, turn int64) (Error_Code, error) {
+	match.UpdatedAt = nowMs()
+	res, err := tx.Exec(`
+UPDATE turn_match SET state = $3, turn = $4, turn_user_id = $5, turn_expires_at = $6, ended = $7, winner_id = $8, updated_at = $9
+WHERE id = $1 AND turn = $2 AND ended = FALSE`,
+		match.MatchId, turn, match.State, match.Turn, match.TurnUserId, match.TurnExpiresAt, match.Ended, match.WinnerId, match.UpdatedAt)
+	if err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return TURN_MATCH_MOVE_REJECTED, errors.New("Turn match changed, fetch it and try again")
+	}
+	return 0, nil
+}
+
+func turnMatchUser(match *TurnMatch, userID []byte) *TurnMatch_User {
+	for _, u := range match.Users {
+		if bytes.Equal(u.UserId, userID) {
+			return u
+		}
+	}
+	return nil
+}
+
+// turnMatchLoad loads a match, or returns nil if there is no match with the given ID.
+func turnMatchLoad(q queryer, matchID uuid.UUID) (*TurnMatch, error) {
+	matches, err := turnMatchesQuery(q, "SELECT "+turnMatchColumns+" FROM turn_match m WHERE m.id = $1", matchID.Bytes())
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	return matches[0], nil
+}
+
+// turnMatchesQuery runs a query selecting turnMatchColumns from turn_match aliased as m, then loads the users of the
+// matches found.
+func turnMatchesQuery(q queryer, query string, params ...interface{}) ([]*TurnMatch, error) {
+	rows, err := q.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make([]*TurnMatch, 0)
+	matchesByID := make(map[string]*TurnMatch)
+	for rows.Next() {
+		match := &TurnMatch{Users: make([]*TurnMatch_User, 0)}
+		if err = rows.Scan(&match.MatchId, &match.CreatorId, &match.State, &match.Turn, &match.TurnUserId, &match.TurnTimeoutSec, &match.TurnExpiresAt, &match.Ended, &match.WinnerId, &match.CreatedAt, &match.UpdatedAt); err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+		matchesByID[string(match.MatchId)] = match
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(matches) == 0 {
+		return matches, nil
+	}
+
+	statements := make([]string, 0, len(matches))
+	userParams := make([]interface{}, 0, len(matches))
+	for _, match := range matches {
+		userParams = append(userParams, match.MatchId)
+		statements = append(statements, "$"+strconv.Itoa(len(userParams)))
+	}
+	userRows, err := q.Query("SELECT match_id, user_id, forfeited FROM turn_match_user WHERE match_id IN ("+strings.Join(statements, ", ")+") ORDER BY match_id, position", userParams...)
+	if err != nil {
+		return nil, err
+	}
+	defer userRows.Close()
+
+	for userRows.Next() {
+		var matchID []byte
+		user := &TurnMatch_User{}
+		if err = userRows.Scan(&matchID, &user.UserId, &user.Forfeited); err != nil {
+			return nil, err
+		}
+		if match, ok := matchesByID[string(matchID)]; ok {
+			match.Users = append(match.Users, user)
+		}
+	}
+	if err = userRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// turnMatchNotify sends persistent notifications for a change to a match: to the user whose turn it now is, or to
+// every user but the sender if the match has ended. The sender is nil if the server made the change.
+func turnMatchNotify(logger *zap.Logger, ns *NotificationService, match *TurnMatch, senderID []byte) {
+	content, err := json.Marshal(map[string]interface{}{
+		"match_id": uuid.FromBytesOrNil(match.MatchId).String(),
+		"turn":     match.Turn,
+	})
+	if err != nil {
+		logger.Warn("Failed to send turn match notification", zap.Error(err))
+		return
+	}
+
+	ts := nowMs()
+	notifications := make([]*NNotification, 0, len(match.Users))
+	if match.Ended {
+		for _, u := range match.Users {
+			if bytes.Equal(u.UserId, senderID) {
+				continue
+			}
+			notifications = append(notifications, &NNotification{
+				Id:         uuid.NewV4().Bytes(),
+				UserID:     u.UserId,
+				Subject:    "A turn-based match you are in has ended",
+				Content:    content,
+				Code:       NOTIFICATION_TURN_MATCH_ENDED,
+				SenderID:   senderID,
+				CreatedAt:  ts,
+				ExpiresAt:  ts + ns.expiryMs,
+				Persistent: true,
+			})
+		}
+	} else if !bytes.Equal(match.TurnUserId, senderID) {
+		notifications = append(notifications, &NNotification{
+			Id:         uuid.NewV4().Bytes(),
+			UserID:     match.TurnUserId,
+			Subject:    "It's your turn",
+			Content:    content,
+			Code:       NOTIFICATION_TURN_MATCH_TURN,
+			SenderID:   senderID,
+			CreatedAt:  ts,
+			ExpiresAt:  ts + ns.expiryMs,
+			Persistent: true,
+		})
+	}
+
+	if len(notifications) == 0 {
+		return
+	}
+	if err = ns.NotificationSend(context.Background(), notifications); err != nil {
+		logger.Warn("Failed to send turn match notification", zap.Error(err))
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
@@ -97,7 +98,7 @@ func UsersFetchIds(logger *zap.Logger, db *sql.DB, userIds [][]byte) ([]*User, e
 		return nil, errors.New("No valid user IDs received")
 	}
 
-	query := "WHERE users.id IN (" + strings.Join(statements, ", ") + ")"
+	query := "WHERE users.deleted_at = 0 AND users.id IN (" + strings.Join(statements, ", ") + ")"
 	users, err := querySocialGraph(logger, db, query, params)
 	if err != nil {
 		return nil, errors.New("Could not retrieve users")
@@ -118,7 +119,7 @@ func UsersFetchHandle(logger *zap.Logger, db *sql.DB, handles []string) ([]*User
 		params = append(params, handle)
 	}
 
-	query := "WHERE users.handle IN (" + strings.Join(statements, ", ") + ")"
+	query := "WHERE users.deleted_at = 0 AND users.handle IN (" + strings.Join(statements, ", ") + ")"
 	users, err := querySocialGraph(logger, db, query, params)
 	if err != nil {
 		return nil, errors.New("Could not retrieve users")
@@ -146,7 +147,8 @@ func UsersFetchIdsHandles(logger *zap.Logger, db *sql.DB, userIds [][]byte, hand
 		params = append(params, handle)
 	}
 
-	query := "WHERE "
+	// Users who deleted their account are hidden.
+	query := "WHERE users.deleted_at = 0 AND ("
 	if len(userIds) > 0 {
 		query += "users.id IN (" + strings.Join(idStatements, ", ") + ")"
 	}
@@ -157,6 +159,7 @@ func UsersFetchIdsHandles(logger *zap.Logger, db *sql.DB, userIds [][]byte, hand
 		}
 		query += "users.handle IN (" + strings.Join(handleStatements, ", ") + ")"
 	}
+	query += ")"
 
 	users, err := querySocialGraph(logger, db, query, params)
 	if err != nil {
@@ -166,12 +169,13 @@ func UsersFetchIdsHandles(logger *zap.Logger, db *sql.DB, userIds [][]byte, hand
 	return users, nil
 }
 
-func UsersBan(logger *zap.Logger, db *sql.DB, userIds [][]byte, handles []string) error {
+// UsersBan permanently bans users by ID or handle, returning the IDs of the users banned.
+func UsersBan(logger *zap.Logger, db *sql.DB, userIds [][]byte, handles []string) ([]uuid.UUID, error) {
 	idStatements := make([]string, 0)
 	handleStatements := make([]string, 0)
-	params := []interface{}{nowMs()} // $1
+	params := make([]interface{}, 0)
 
-	counter := 2
+	counter := 1
 	for _, userID := range userIds {
 		statement := "$" + strconv.Itoa(counter)
 		idStatements = append(idStatements, statement)
@@ -185,7 +189,7 @@ func UsersBan(logger *zap.Logger, db *sql.DB, userIds [][]byte, handles []string
 		counter++
 	}
 
-	query := "UPDATE users SET disabled_at = $1 WHERE "
+	query := "SELECT id FROM users WHERE "
 	if len(userIds) > 0 {
 		query += "users.id IN (" + strings.Join(idStatements, ", ") + ")"
 	}
@@ -198,10 +202,51 @@ func UsersBan(logger *zap.Logger, db *sql.DB, userIds [][]byte, handles []string
 	}
 
 	logger.Debug("ban user query", zap.String("query", query))
-	_, err := db.Exec(query, params...)
+	tx, err := db.Begin()
 	if err != nil {
 		logger.Error("Failed to ban users", zap.Error(err))
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Failed to ban users, rollback error", zap.Error(e))
+			}
+		}
+	}()
 
-	return err
+	rows, err := tx.Query(query, params...)
+	if err != nil {
+		logger.Error("Failed to ban users", zap.Error(err))
+		return nil, err
+	}
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			logger.Error("Failed to ban users", zap.Error(err))
+			return nil, err
+		}
+		ids = append(ids, uuid.FromBytesOrNil(id))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		logger.Error("Failed to ban users", zap.Error(err))
+		return nil, err
+	}
+
+	ts := nowMs()
+	for _, id := range ids {
+		if err = userBanInsert(tx, uuid.Nil, id.Bytes(), "", ts, 0); err != nil {
+			logger.Error("Failed to ban users", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Failed to ban users", zap.Error(err))
+		return nil, err
+	}
+	return ids, nil
 }
@@ -0,0 +1,238 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// UserBan is a ban or suspension of a user, as recorded in the audit table.
+type UserBan struct {
+	UserID    uuid.UUID
+	CreatedAt int64
+	// CreatedBy is uuid.Nil when the ban was made by the server runtime.
+	CreatedBy uuid.UUID
+	Reason    string
+	// ExpiresAt is 0 for a permanent ban.
+	ExpiresAt int64
+	LiftedAt  int64
+	LiftedBy  uuid.UUID
+}
+
+// Message is the authentication error shown to a banned user.
+func (b *UserBan) Message() string {
+	message := "Banned"
+	if b.ExpiresAt != 0 {
+		message = "Suspended until " + time.Unix(0, b.ExpiresAt*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+	}
+	if b.Reason != "" {
+		message += ": " + b.Reason
+	}
+	return message
+}
+
+func userBanScan(rows *sql.Rows) (*UserBan, error) {
+	var userID []byte
+	var createdBy []byte
+	var liftedBy []byte
+	ban := &UserBan{}
+	if err := rows.Scan(&userID, &ban.CreatedAt, &createdBy, &ban.Reason, &ban.ExpiresAt, &ban.LiftedAt, &liftedBy); err != nil {
+		return nil, err
+	}
+	ban.UserID = uuid.FromBytesOrNil(userID)
+	ban.CreatedBy = uuid.FromBytesOrNil(createdBy)
+	ban.LiftedBy = uuid.FromBytesOrNil(liftedBy)
+	return ban, nil
+}
+
+// nullableUserID stores uuid.Nil as NULL, for changes made by the server runtime.
+func nullableUserID(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id.Bytes()
+}
+
+// userBanActive returns the ban in force for the user, preferring permanent bans and then the longest suspension, or
+// nil if there is none. Users whose suspensions have all ended are enabled again, unless they deleted their account.
+func userBanActive(db *sql.DB, userID []byte) (*UserBan, error) {
+	ts := nowMs()
+	rows, err := db.Query(`
+SELECT user_id, created_at, created_by, reason, expires_at, lifted_at, lifted_by
+FROM user_ban
+WHERE user_id = $1 AND lifted_at = 0 AND (expires_at = 0 OR expires_at > $2)
+ORDER BY expires_at = 0 DESC, expires_at DESC
+LIMIT 1`, userID, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return userBanScan(rows)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+UPDATE users SET disabled_at = 0
+WHERE id = $1 AND disabled_at > 0 AND deleted_at = 0
+AND NOT EXISTS (SELECT user_id FROM user_ban WHERE user_id = $1 AND lifted_at = 0 AND (expires_at = 0 OR expires_at > $2))`,
+		userID, ts)
+	return nil, err
+}
+
+// userBanInsert records a ban and disables the user, so they can no longer authenticate or refresh a session.
+func userBanInsert(tx *sql.Tx, caller uuid.UUID, userID []byte, reason string, ts int64, expiresAt int64) error {
+	if _, err := tx.Exec("UPDATE users SET disabled_at = $2 WHERE id = $1", userID, ts); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO user_ban (user_id, created_at, created_by, reason, expires_at)
+VALUES ($1, $2, $3, $4, $5)`, userID, ts, nullableUserID(caller), reason, expiresAt); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM user_refresh_token WHERE user_id = $1", userID)
+	return err
+}
+
+// UserBanCreate bans the user, or suspends them when the duration is greater than 0. The caller is recorded as the
+// author of the ban, and is uuid.Nil for the server runtime.
+func UserBanCreate(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID uuid.UUID, reason string, durationMs int64) (*UserBan, Error_Code, error) {
+	if len(reason) > 255 {
+		return nil, BAD_INPUT, errors.New("Reason must be 255 characters or fewer")
+	}
+	if durationMs < 0 {
+		return nil, BAD_INPUT, errors.New("Duration must not be negative")
+	}
+
+	ts := nowMs()
+	ban := &UserBan{
+		UserID:    userID,
+		CreatedAt: ts,
+		CreatedBy: caller,
+		Reason:    reason,
+	}
+	if durationMs > 0 {
+		ban.ExpiresAt = ts + durationMs
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not ban user, transaction error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not ban user")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not ban user, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	var exists int
+	if err = tx.QueryRow("SELECT 1 FROM users WHERE id = $1", userID.Bytes()).Scan(&exists); err == sql.ErrNoRows {
+		return nil, USER_NOT_FOUND, errors.New("User not found")
+	} else if err != nil {
+		logger.Error("Could not ban user, query error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not ban user")
+	}
+
+	if err = userBanInsert(tx, caller, userID.Bytes(), reason, ts, ban.ExpiresAt); err != nil {
+		logger.Error("Could not ban user, insert error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not ban user")
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not ban user, commit error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not ban user")
+	}
+	return ban, 0, nil
+}
+
+// UserBanLift ends all bans and suspensions in force for the user and enables them again. The bans are kept with the
+// time they were lifted and who lifted them.
+func UserBanLift(logger *zap.Logger, db *sql.DB, caller uuid.UUID, userID uuid.UUID) (Error_Code, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Could not lift user ban, transaction error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not lift user ban")
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not lift user ban, rollback error", zap.Error(e))
+			}
+		}
+	}()
+
+	ts := nowMs()
+	res, err := tx.Exec(`
+UPDATE user_ban SET lifted_at = $2, lifted_by = $3
+WHERE user_id = $1 AND lifted_at = 0 AND (expires_at = 0 OR expires_at > $2)`,
+		userID.Bytes(), ts, nullableUserID(caller))
+	if err != nil {
+		logger.Error("Could not lift user ban, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not lift user ban")
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = errors.New("User is not banned")
+		return BAD_INPUT, err
+	}
+	if _, err = tx.Exec("UPDATE users SET disabled_at = 0 WHERE id = $1 AND deleted_at = 0", userID.Bytes()); err != nil {
+		logger.Error("Could not lift user ban, update error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not lift user ban")
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error("Could not lift user ban, commit error", zap.Error(err))
+		return RUNTIME_EXCEPTION, errors.New("Could not lift user ban")
+	}
+	return 0, nil
+}
+
+// UserBansList returns every ban and suspension of the user, newest first, including ones that have ended.
+func UserBansList(logger *zap.Logger, db *sql.DB, userID uuid.UUID) ([]*UserBan, error) {
+	rows, err := db.Query(`
+SELECT user_id, created_at, created_by, reason, expires_at, lifted_at, lifted_by
+FROM user_ban
+WHERE user_id = $1
+ORDER BY created_at DESC`, userID.Bytes())
+	if err != nil {
+		logger.Error("Could not list user bans", zap.Error(err))
+		return nil, errors.New("Could not list user bans")
+	}
+	defer rows.Close()
+
+	bans := make([]*UserBan, 0)
+	for rows.Next() {
+		ban, err := userBanScan(rows)
+		if err != nil {
+			logger.Error("Could not list user bans, scan error", zap.Error(err))
+			return nil, errors.New("Could not list user bans")
+		}
+		bans = append(bans, ban)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Could not list user bans, row error", zap.Error(err))
+		return nil, errors.New("Could not list user bans")
+	}
+	return bans, nil
+}
@@ -40,7 +40,7 @@ type dashboardService struct {
 }
 
 // NewDashboardService creates a new dashboardService
-func NewDashboardService(logger *zap.Logger, multiLogger *zap.Logger, version string, config Config, statsService StatsService) *dashboardService {
+func NewDashboardService(logger *zap.Logger, multiLogger *zap.Logger, version string, config Config, statsService StatsService, metrics *Metrics) *dashboardService {
 	service := &dashboardService{
 		logger:       logger,
 		version:      version,
@@ -57,6 +57,9 @@ func NewDashboardService(logger *zap.Logger, multiLogger *zap.Logger, version st
 	service.mux.HandleFunc("/v0/cluster/stats", service.statusHandler).Methods("GET")
 	service.mux.HandleFunc("/v0/config", service.configHandler).Methods("GET")
 	service.mux.HandleFunc("/v0/info", service.infoHandler).Methods("GET")
+	if metrics.Enabled() {
+		service.mux.Handle("/metrics", metrics).Methods("GET")
+	}
 	service.mux.PathPrefix("/").Handler(http.FileServer(service.dashboardFilesystem)).Methods("GET") // Needs to be last.
 
 	go func() {
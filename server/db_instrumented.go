@@ -0,0 +1,263 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+// RegisterInstrumentedDriver registers a database driver that records metrics and trace spans of queries made through
+// the named driver, and returns the name it is registered under. It must only be called once per driver name.
+func RegisterInstrumentedDriver(name string, metrics *Metrics, tracer *Tracer) (string, error) {
+	// Opening does not connect, it only looks up the driver.
+	db, err := sql.Open(name, "")
+	if err != nil {
+		return "", err
+	}
+	base := db.Driver()
+	db.Close()
+
+	instrumentedName := name + "-instrumented"
+	sql.Register(instrumentedName, &instrumentedDriver{driver: base, metrics: metrics, tracer: tracer})
+	return instrumentedName, nil
+}
+
+type instrumentedDriver struct {
+	driver  driver.Driver
+	metrics *Metrics
+	tracer  *Tracer
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn: conn, metrics: d.metrics, tracer: d.tracer}, nil
+}
+
+// instrumentedConn passes everything through to the driver's connection, timing queries on the way. Optional
+// interfaces the connection does not implement are reported as skipped, so database/sql falls back as it would
+// without instrumentation. Queries are traced when their context carries a span.
+type instrumentedConn struct {
+	conn    driver.Conn
+	metrics *Metrics
+	tracer  *Tracer
+}
+
+// instrumentQuery starts timing a query, returning a function to call with its outcome once results start arriving.
+func instrumentQuery(ctx context.Context, metrics *Metrics, tracer *Tracer, query string) func(err error) {
+	start := time.Now()
+	_, span := tracer.startClientSpan(ctx, "db "+metricsStatement(query))
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", query)
+	return func(err error) {
+		// Skipped queries are retried by database/sql as prepared statements, and recorded then.
+		if err == driver.ErrSkip {
+			return
+		}
+		metrics.ObserveQuery(query, start, err)
+		span.SetError(err)
+		span.End()
+	}
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt: stmt, query: query, metrics: c.metrics, tracer: c.tracer}, nil
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := c.conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Prepare(query)
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt: stmt, query: query, metrics: c.metrics, tracer: c.tracer}, nil
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("sql: driver does not support transaction options")
+	}
+	return c.conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.exec(context.Background(), query, args)
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		values, err := instrumentedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return c.exec(ctx, query, values)
+	}
+	done := instrumentQuery(ctx, c.metrics, c.tracer, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	done(err)
+	return result, err
+}
+
+func (c *instrumentedConn) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	execer, ok := c.conn.(driver.Execer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	done := instrumentQuery(ctx, c.metrics, c.tracer, query)
+	result, err := execer.Exec(query, args)
+	done(err)
+	return result, err
+}
+
+func (c *instrumentedConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.query(context.Background(), query, args)
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		values, err := instrumentedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return c.query(ctx, query, values)
+	}
+	done := instrumentQuery(ctx, c.metrics, c.tracer, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	done(err)
+	return rows, err
+}
+
+func (c *instrumentedConn) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.Queryer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	done := instrumentQuery(ctx, c.metrics, c.tracer, query)
+	rows, err := queryer.Query(query, args)
+	done(err)
+	return rows, err
+}
+
+type instrumentedStmt struct {
+	stmt    driver.Stmt
+	query   string
+	metrics *Metrics
+	tracer  *Tracer
+}
+
+func (s *instrumentedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *instrumentedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(context.Background(), args)
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := instrumentedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.exec(ctx, values)
+	}
+	done := instrumentQuery(ctx, s.metrics, s.tracer, s.query)
+	result, err := execer.ExecContext(ctx, args)
+	done(err)
+	return result, err
+}
+
+func (s *instrumentedStmt) exec(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	done := instrumentQuery(ctx, s.metrics, s.tracer, s.query)
+	result, err := s.stmt.Exec(args)
+	done(err)
+	return result, err
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.queryRows(context.Background(), args)
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := instrumentedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.queryRows(ctx, values)
+	}
+	done := instrumentQuery(ctx, s.metrics, s.tracer, s.query)
+	rows, err := queryer.QueryContext(ctx, args)
+	done(err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) queryRows(ctx context.Context, args []driver.Value) (driver.Rows, error) {
+	done := instrumentQuery(ctx, s.metrics, s.tracer, s.query)
+	rows, err := s.stmt.Query(args)
+	done(err)
+	return rows, err
+}
+
+// instrumentedValues converts arguments for drivers without context support, which do not take named arguments.
+func instrumentedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
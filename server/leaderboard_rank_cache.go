@@ -0,0 +1,500 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"math/rand"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	leaderboardRankMaxLevel    = 24
+	leaderboardRankProbability = 0.25
+
+	leaderboardRankSet               = "set"
+	leaderboardRankDelete            = "delete"
+	leaderboardRankDeletePeriod      = "delete_period"
+	leaderboardRankDeleteLeaderboard = "delete_leaderboard"
+)
+
+type leaderboardRankKey struct {
+	leaderboardID string
+	expiresAt     int64
+}
+
+type leaderboardRankEntry struct {
+	ownerID   string
+	recordID  []byte
+	score     int64
+	updatedAt int64
+	// Number of submissions the record had, which orders updates to the same record.
+	numScore int64
+}
+
+// leaderboardRankChange is one change to the rank cache. Changes are passed to listeners, so other nodes in a cluster
+// can apply them to their own caches.
+type leaderboardRankChange struct {
+	Op            string `json:"op"`
+	LeaderboardID []byte `json:"leaderboard_id"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+	SortOrder     int64  `json:"sort_order,omitempty"`
+	OwnerID       []byte `json:"owner_id,omitempty"`
+	RecordID      []byte `json:"record_id,omitempty"`
+	Score         int64  `json:"score,omitempty"`
+	UpdatedAt     int64  `json:"updated_at,omitempty"`
+	NumScore      int64  `json:"num_score,omitempty"`
+}
+
+type leaderboardRankNode struct {
+	entry leaderboardRankEntry
+	next  []*leaderboardRankNode
+	// Number of positions skipped by following next at each level.
+	span []int64
+}
+
+// leaderboardRankIndex is an indexable skip list of the records in one leaderboard period, ordered from best to
+// worst with the same tie-breaks as the database queries.
+type leaderboardRankIndex struct {
+	sortOrder int64
+	head      *leaderboardRankNode
+	level     int
+	length    int64
+	owners    map[string]*leaderboardRankNode
+}
+
+func newLeaderboardRankIndex(sortOrder int64) *leaderboardRankIndex {
+	return &leaderboardRankIndex{
+		sortOrder: sortOrder,
+		head: &leaderboardRankNode{
+			next: make([]*leaderboardRankNode, leaderboardRankMaxLevel),
+			span: make([]int64, leaderboardRankMaxLevel),
+		},
+		level:  1,
+		owners: make(map[string]*leaderboardRankNode),
+	}
+}
+
+// better reports if a ranks strictly ahead of b.
+func (idx *leaderboardRankIndex) better(a, b *leaderboardRankEntry) bool {
+	if a.score != b.score {
+		if idx.sortOrder == 0 {
+			return a.score < b.score
+		}
+		return a.score > b.score
+	}
+	if a.updatedAt != b.updatedAt {
+		return a.updatedAt < b.updatedAt
+	}
+	if idx.sortOrder == 0 {
+		return bytes.Compare(a.recordID, b.recordID) < 0
+	}
+	return bytes.Compare(a.recordID, b.recordID) > 0
+}
+
+// set inserts or replaces the owner's entry and returns its new rank.
+func (idx *leaderboardRankIndex) set(entry leaderboardRankEntry) int64 {
+	if node, ok := idx.owners[entry.ownerID]; ok {
+		idx.remove(node)
+	}
+
+	update := make([]*leaderboardRankNode, leaderboardRankMaxLevel)
+	rank := make([]int64, leaderboardRankMaxLevel)
+	x := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		if i != idx.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.next[i] != nil && idx.better(&x.next[i].entry, &entry) {
+			rank[i] += x.span[i]
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	level := 1
+	for level < leaderboardRankMaxLevel && rand.Float64() < leaderboardRankProbability {
+		level++
+	}
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = idx.head
+			update[i].span[i] = idx.length
+		}
+		idx.level = level
+	}
+
+	node := &leaderboardRankNode{
+		entry: entry,
+		next:  make([]*leaderboardRankNode, level),
+		span:  make([]int64, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+		node.span[i] = update[i].span[i] - (rank[0] - rank[i])
+		update[i].span[i] = rank[0] - rank[i] + 1
+	}
+	for i := level; i < idx.level; i++ {
+		update[i].span[i]++
+	}
+
+	idx.length++
+	idx.owners[entry.ownerID] = node
+	return rank[0] + 1
+}
+
+func (idx *leaderboardRankIndex) remove(node *leaderboardRankNode) {
+	update := make([]*leaderboardRankNode, leaderboardRankMaxLevel)
+	x := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && idx.better(&x.next[i].entry, &node.entry) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	for i := 0; i < idx.level; i++ {
+		if update[i].next[i] == node {
+			update[i].span[i] += node.span[i] - 1
+			update[i].next[i] = node.next[i]
+		} else {
+			update[i].span[i]--
+		}
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+
+	idx.length--
+	delete(idx.owners, node.entry.ownerID)
+}
+
+func (idx *leaderboardRankIndex) rank(ownerID string) int64 {
+	node, ok := idx.owners[ownerID]
+	if !ok {
+		return 0
+	}
+
+	var rank int64
+	x := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && !idx.better(&node.entry, &x.next[i].entry) {
+			rank += x.span[i]
+			x = x.next[i]
+		}
+		if x == node {
+			return rank
+		}
+	}
+	return 0
+}
+
+// LeaderboardRankCache keeps the exact rank of every record in the active period of each leaderboard, so ranks can
+// be looked up and maintained in O(log n) rather than counted from the database.
+type LeaderboardRankCache struct {
+	sync.RWMutex
+	enabled    bool
+	maxRecords int64
+	indexes    map[leaderboardRankKey]*leaderboardRankIndex
+	// Leaderboard periods that grew past the configured maximum size and are no longer cached.
+	skipped   map[leaderboardRankKey]bool
+	listeners []func(*leaderboardRankChange)
+	logger    *zap.Logger
+	db        *sql.DB
+	// While reloading, changes are also kept to be applied again to the reloaded indexes.
+	reloading   bool
+	reloadAgain bool
+	pending     []*leaderboardRankChange
+}
+
+// NewLeaderboardRankCache creates a new empty LeaderboardRankCache. Use Load to populate it from the database.
+func NewLeaderboardRankCache(config *LeaderboardConfig) *LeaderboardRankCache {
+	return &LeaderboardRankCache{
+		enabled:    config.RankCache,
+		maxRecords: config.RankCacheMaxRecords,
+		indexes:    make(map[leaderboardRankKey]*leaderboardRankIndex),
+		skipped:    make(map[leaderboardRankKey]bool),
+		listeners:  make([]func(*leaderboardRankChange), 0),
+	}
+}
+
+// Load rebuilds the cache from the records of all active leaderboard periods.
+func (c *LeaderboardRankCache) Load(logger *zap.Logger, db *sql.DB) error {
+	if c == nil || !c.enabled {
+		return nil
+	}
+
+	c.Lock()
+	c.logger = logger
+	c.db = db
+	c.Unlock()
+
+	loaded, count, err := c.load()
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.indexes = loaded.indexes
+	c.skipped = loaded.skipped
+	c.Unlock()
+
+	logger.Info("Loaded leaderboard rank cache", zap.Int64("records", count), zap.Int("leaderboards", len(loaded.indexes)))
+	return nil
+}
+
+// load reads the records of all active leaderboard periods into a new cache.
+func (c *LeaderboardRankCache) load() (*LeaderboardRankCache, int64, error) {
+	loaded := &LeaderboardRankCache{
+		enabled:    true,
+		maxRecords: c.maxRecords,
+		indexes:    make(map[leaderboardRankKey]*leaderboardRankIndex),
+		skipped:    make(map[leaderboardRankKey]bool),
+	}
+
+	rows, err := c.db.Query(`
+SELECT l.sort_order, lr.leaderboard_id, lr.expires_at, lr.owner_id, lr.id, lr.score, lr.updated_at, lr.num_score
+FROM leaderboard l, leaderboard_record lr
+WHERE lr.leaderboard_id = l.id AND (lr.expires_at = 0 OR lr.expires_at > $1)`, nowMs())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		change := &leaderboardRankChange{Op: leaderboardRankSet}
+		if err = rows.Scan(&change.SortOrder, &change.LeaderboardID, &change.ExpiresAt, &change.OwnerID, &change.RecordID, &change.Score, &change.UpdatedAt, &change.NumScore); err != nil {
+			return nil, 0, err
+		}
+		loaded.apply(change)
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return loaded, count, nil
+}
+
+// reload rebuilds the cache from the database in the background, for when changes from other nodes may have been
+// missed. Changes made while it runs are applied again once it is done. Calls during a reload run it once more after.
+func (c *LeaderboardRankCache) reload() {
+	if c == nil || !c.enabled {
+		return
+	}
+
+	c.Lock()
+	if c.db == nil {
+		c.Unlock()
+		return
+	}
+	if c.reloading {
+		c.reloadAgain = true
+		c.Unlock()
+		return
+	}
+	c.reloading = true
+	c.Unlock()
+
+	go func() {
+		for {
+			loaded, count, err := c.load()
+			c.Lock()
+			if err == nil {
+				c.indexes = loaded.indexes
+				c.skipped = loaded.skipped
+			}
+			for _, change := range c.pending {
+				c.apply(change)
+			}
+			c.pending = nil
+			again := c.reloadAgain
+			c.reloadAgain = false
+			c.reloading = again
+			c.Unlock()
+
+			if err != nil {
+				c.logger.Error("Could not reload leaderboard rank cache", zap.Error(err))
+			} else {
+				c.logger.Info("Reloaded leaderboard rank cache", zap.Int64("records", count))
+			}
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+func (c *LeaderboardRankCache) addChangeListener(f func(*leaderboardRankChange)) {
+	if c == nil || !c.enabled {
+		return
+	}
+	c.Lock()
+	c.listeners = append(c.listeners, f)
+	c.Unlock()
+}
+
+// Get returns the owner's rank in the given leaderboard period, or 0 if it is not cached.
+func (c *LeaderboardRankCache) Get(leaderboardID []byte, expiresAt int64, ownerID []byte) int64 {
+	if c == nil || !c.enabled {
+		return 0
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	idx, ok := c.indexes[leaderboardRankKey{string(leaderboardID), expiresAt}]
+	if !ok {
+		return 0
+	}
+	return idx.rank(string(ownerID))
+}
+
+// Has reports if the given leaderboard period is in the cache.
+func (c *LeaderboardRankCache) Has(leaderboardID []byte, expiresAt int64) bool {
+	if c == nil || !c.enabled {
+		return false
+	}
+
+	c.RLock()
+	_, ok := c.indexes[leaderboardRankKey{string(leaderboardID), expiresAt}]
+	c.RUnlock()
+	return ok
+}
+
+// Set inserts or updates the owner's record and returns its new rank, or 0 if the leaderboard period is not cached.
+// Writes are applied after their transaction commits, possibly out of order, so an update to the same record with
+// fewer submissions than the cached one is stale and leaves the cache as it is.
+func (c *LeaderboardRankCache) Set(leaderboardID []byte, expiresAt int64, sortOrder int64, ownerID []byte, recordID []byte, score int64, updatedAt int64, numScore int64) int64 {
+	return c.change(&leaderboardRankChange{
+		Op:            leaderboardRankSet,
+		LeaderboardID: leaderboardID,
+		ExpiresAt:     expiresAt,
+		SortOrder:     sortOrder,
+		OwnerID:       ownerID,
+		RecordID:      recordID,
+		Score:         score,
+		UpdatedAt:     updatedAt,
+		NumScore:      numScore,
+	})
+}
+
+// Delete removes the owner's record from the given leaderboard period.
+func (c *LeaderboardRankCache) Delete(leaderboardID []byte, expiresAt int64, ownerID []byte) {
+	c.change(&leaderboardRankChange{Op: leaderboardRankDelete, LeaderboardID: leaderboardID, ExpiresAt: expiresAt, OwnerID: ownerID})
+}
+
+// DeletePeriod drops all cached ranks for the given leaderboard period, for example once it has been archived.
+func (c *LeaderboardRankCache) DeletePeriod(leaderboardID []byte, expiresAt int64) {
+	c.change(&leaderboardRankChange{Op: leaderboardRankDeletePeriod, LeaderboardID: leaderboardID, ExpiresAt: expiresAt})
+}
+
+// DeleteLeaderboard drops all cached ranks for every period of the given leaderboard.
+func (c *LeaderboardRankCache) DeleteLeaderboard(leaderboardID []byte) {
+	c.change(&leaderboardRankChange{Op: leaderboardRankDeleteLeaderboard, LeaderboardID: leaderboardID})
+}
+
+// change applies a change made on this node and passes it to listeners. Returns the owner's new rank for sets.
+func (c *LeaderboardRankCache) change(change *leaderboardRankChange) int64 {
+	if c == nil || !c.enabled {
+		return 0
+	}
+
+	c.Lock()
+	rank := c.applyLocked(change)
+	listeners := c.listeners
+	c.Unlock()
+
+	for _, f := range listeners {
+		f(change)
+	}
+	return rank
+}
+
+// applyRemote applies a change made on another node.
+func (c *LeaderboardRankCache) applyRemote(change *leaderboardRankChange) {
+	if c == nil || !c.enabled {
+		return
+	}
+
+	c.Lock()
+	c.applyLocked(change)
+	c.Unlock()
+}
+
+// applyLocked must be called with the lock held.
+func (c *LeaderboardRankCache) applyLocked(change *leaderboardRankChange) int64 {
+	if c.reloading {
+		c.pending = append(c.pending, change)
+	}
+	return c.apply(change)
+}
+
+func (c *LeaderboardRankCache) apply(change *leaderboardRankChange) int64 {
+	key := leaderboardRankKey{string(change.LeaderboardID), change.ExpiresAt}
+	switch change.Op {
+	case leaderboardRankSet:
+		if c.skipped[key] {
+			return 0
+		}
+		idx, ok := c.indexes[key]
+		if !ok {
+			idx = newLeaderboardRankIndex(change.SortOrder)
+			c.indexes[key] = idx
+		}
+		ownerID := string(change.OwnerID)
+		if node, ok := idx.owners[ownerID]; ok && bytes.Equal(node.entry.recordID, change.RecordID) && node.entry.numScore > change.NumScore {
+			return idx.rank(ownerID)
+		}
+		rank := idx.set(leaderboardRankEntry{
+			ownerID:   ownerID,
+			recordID:  change.RecordID,
+			score:     change.Score,
+			updatedAt: change.UpdatedAt,
+			numScore:  change.NumScore,
+		})
+		if c.maxRecords > 0 && idx.length > c.maxRecords {
+			// Huge leaderboards fall back to database rank queries.
+			delete(c.indexes, key)
+			c.skipped[key] = true
+			return 0
+		}
+		return rank
+	case leaderboardRankDelete:
+		if idx, ok := c.indexes[key]; ok {
+			if node, ok := idx.owners[string(change.OwnerID)]; ok {
+				idx.remove(node)
+			}
+		}
+	case leaderboardRankDeletePeriod:
+		delete(c.indexes, key)
+		delete(c.skipped, key)
+	case leaderboardRankDeleteLeaderboard:
+		for k := range c.indexes {
+			if k.leaderboardID == key.leaderboardID {
+				delete(c.indexes, k)
+			}
+		}
+		for k := range c.skipped {
+			if k.leaderboardID == key.leaderboardID {
+				delete(c.skipped, k)
+			}
+		}
+	}
+	return 0
+}
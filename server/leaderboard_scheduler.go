@@ -0,0 +1,191 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often the scheduler looks for leaderboard seasons that have ended.
+const leaderboardSchedulerInterval = 10 * time.Second
+
+// LeaderboardScheduler rolls leaderboards with a reset schedule over to a new season, moves the records of
+// seasons that have ended into the archive, and ends tournaments once their window closes.
+type LeaderboardScheduler struct {
+	logger    *zap.Logger
+	db        *sql.DB
+	rankCache *LeaderboardRankCache
+	runtime   *Runtime
+	ticker    *time.Ticker
+	stopCh    chan bool
+}
+
+// NewLeaderboardScheduler creates a new LeaderboardScheduler and starts it.
+func NewLeaderboardScheduler(logger *zap.Logger, db *sql.DB, rankCache *LeaderboardRankCache, runtime *Runtime) *LeaderboardScheduler {
+	s := &LeaderboardScheduler{
+		logger:    logger,
+		db:        db,
+		rankCache: rankCache,
+		runtime:   runtime,
+		ticker:    time.NewTicker(leaderboardSchedulerInterval),
+		stopCh:    make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.archiveEnded()
+				s.endTournaments()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *LeaderboardScheduler) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+func (s *LeaderboardScheduler) archiveEnded() {
+	// Records are partitioned by the season end time, so any records with an expiry in the past belong to an ended season.
+	rows, err := s.db.Query(`
+SELECT DISTINCT lr.leaderboard_id, lr.expires_at
+FROM leaderboard l, leaderboard_record lr
+WHERE l.reset_schedule IS NOT NULL AND lr.leaderboard_id = l.id AND lr.expires_at > 0 AND lr.expires_at <= $1`, nowMs())
+	if err != nil {
+		s.logger.Error("Could not find ended leaderboard seasons", zap.Error(err))
+		return
+	}
+
+	type season struct {
+		leaderboardID []byte
+		expiresAt     int64
+	}
+	seasons := make([]*season, 0)
+	for rows.Next() {
+		se := &season{}
+		if err = rows.Scan(&se.leaderboardID, &se.expiresAt); err != nil {
+			s.logger.Error("Could not scan ended leaderboard seasons", zap.Error(err))
+			rows.Close()
+			return
+		}
+		seasons = append(seasons, se)
+	}
+	rows.Close()
+
+	for _, se := range seasons {
+		if err = leaderboardSeasonArchive(s.db, se.leaderboardID, se.expiresAt); err != nil {
+			s.logger.Error("Could not archive leaderboard season", zap.Binary("leaderboard_id", se.leaderboardID), zap.Int64("expires_at", se.expiresAt), zap.Error(err))
+			continue
+		}
+		s.rankCache.DeletePeriod(se.leaderboardID, se.expiresAt)
+		s.logger.Info("Archived leaderboard season", zap.Binary("leaderboard_id", se.leaderboardID), zap.Int64("expires_at", se.expiresAt))
+	}
+}
+
+// leaderboardSeasonArchive moves all records of an ended season into the archive.
+func leaderboardSeasonArchive(db *sql.DB, leaderboardID []byte, expiresAt int64) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if e := tx.Rollback(); e != nil {
+				err = errors.New(err.Error() + ", rollback error: " + e.Error())
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	res, err := tx.Exec(`
+INSERT INTO leaderboard_record_archive (id, leaderboard_id, owner_id, handle, lang, location, timezone,
+	score, num_score, metadata, updated_at, updated_at_inverse, expires_at)
+SELECT id, leaderboard_id, owner_id, handle, lang, location, timezone,
+	score, num_score, metadata, updated_at, updated_at_inverse, expires_at
+FROM leaderboard_record
+WHERE leaderboard_id = $1 AND expires_at = $2
+ON CONFLICT (leaderboard_id, expires_at, owner_id) DO NOTHING`, leaderboardID, expiresAt)
+	if err != nil {
+		return err
+	}
+	count, _ := res.RowsAffected()
+
+	if _, err = tx.Exec("DELETE FROM leaderboard_record WHERE leaderboard_id = $1 AND expires_at = $2", leaderboardID, expiresAt); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+INSERT INTO leaderboard_season (leaderboard_id, expires_at, archived_at, count) VALUES ($1, $2, $3, $4)
+ON CONFLICT (leaderboard_id, expires_at) DO UPDATE SET archived_at = $3, count = leaderboard_season.count + $4`,
+		leaderboardID, expiresAt, nowMs(), count)
+	return err
+}
+
+func (s *LeaderboardScheduler) endTournaments() {
+	rows, err := s.db.Query("SELECT id FROM tournament WHERE ended_at = 0 AND end_time <= $1", nowMs())
+	if err != nil {
+		s.logger.Error("Could not find ended tournaments", zap.Error(err))
+		return
+	}
+
+	tournamentIDs := make([][]byte, 0)
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			s.logger.Error("Could not scan ended tournaments", zap.Error(err))
+			rows.Close()
+			return
+		}
+		tournamentIDs = append(tournamentIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range tournamentIDs {
+		tournamentLogger := s.logger.With(zap.String("tournament_id", string(id)))
+		tournament, records, err := tournamentEnd(s.db, id)
+		if err != nil {
+			tournamentLogger.Error("Could not end tournament", zap.Error(err))
+			continue
+		}
+		if tournament == nil {
+			continue
+		}
+		tournamentLogger.Info("Ended tournament", zap.Int("standings", len(records)))
+
+		fn := s.runtime.GetRuntimeCallback(TOURNAMENT_END, "")
+		if fn == nil {
+			continue
+		}
+		payload, err := tournamentToMap(tournament, records)
+		if err != nil {
+			tournamentLogger.Error("Could not convert tournament standings", zap.Error(err))
+			continue
+		}
+		if err = s.runtime.InvokeFunctionTournamentEnd(fn, payload); err != nil {
+			tournamentLogger.Error("Runtime tournament end function caused an error", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Mailer delivers email to users, such as address verification and password reset links.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailer creates a Mailer sending through the configured SMTP server, or one that only logs when no server is set.
+func NewMailer(logger *zap.Logger, config *MailConfig) Mailer {
+	if config.SMTPAddress == "" {
+		return &logMailer{logger: logger}
+	}
+	return &smtpMailer{config: config}
+}
+
+type smtpMailer struct {
+	config *MailConfig
+}
+
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		host, _, err := net.SplitHostPort(m.config.SMTPAddress)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, host)
+	}
+
+	// Headers must not contain line breaks, or they could inject more headers.
+	replacer := strings.NewReplacer("\r", "", "\n", "")
+	message := "From: " + replacer.Replace(m.config.From) + "\r\n" +
+		"To: " + replacer.Replace(to) + "\r\n" +
+		"Subject: " + replacer.Replace(subject) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.config.SMTPAddress, auth, m.config.From, []string{to}, []byte(message))
+}
+
+// logMailer is used when no SMTP server is configured. Messages are dropped, as they may contain secret tokens.
+type logMailer struct {
+	logger *zap.Logger
+}
+
+func (m *logMailer) Send(to string, subject string, body string) error {
+	m.logger.Warn("Email not sent, no SMTP server configured", zap.String("subject", subject))
+	return nil
+}
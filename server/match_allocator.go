@@ -0,0 +1,145 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Wait before the first retry of a failed allocation, doubling for each later retry.
+const matchAllocatorRetryBackoff = 250 * time.Millisecond
+
+type matchAllocationUser struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+	Handle    string `json:"handle"`
+}
+
+type matchAllocationRequest struct {
+	MatchID string                 `json:"match_id"`
+	Region  string                 `json:"region,omitempty"`
+	Users   []*matchAllocationUser `json:"users"`
+}
+
+type matchAllocationResponse struct {
+	Address string `json:"address"`
+	Port    int64  `json:"port"`
+	Token   string `json:"token"`
+}
+
+// MatchAllocator asks a fleet manager to allocate a dedicated game server for each new match the matchmaker makes.
+// The fleet manager is sent a JSON POST with the match ID, region and users, and must answer with the address and
+// port of the allocated server, and optionally a token the server expects from the users.
+type MatchAllocator struct {
+	logger  *zap.Logger
+	url     string
+	key     string
+	retries int
+	client  *http.Client
+}
+
+// NewMatchAllocator creates a new MatchAllocator
+func NewMatchAllocator(logger *zap.Logger, config *MatchmakerConfig) *MatchAllocator {
+	return &MatchAllocator{
+		logger:  logger,
+		url:     config.AllocatorUrl,
+		key:     config.AllocatorKey,
+		retries: config.AllocatorRetries,
+		client:  &http.Client{Timeout: time.Duration(config.AllocatorTimeoutMs) * time.Millisecond},
+	}
+}
+
+// Allocate returns the dedicated server allocated for the match, or nil if no fleet manager is configured or it could
+// not allocate one, in which case the users fall back to a relayed match.
+func (a *MatchAllocator) Allocate(matchID uuid.UUID, region string, selected map[MatchmakerKey]*MatchmakerProfile) *MatchServer {
+	if a == nil || a.url == "" {
+		return nil
+	}
+
+	request := &matchAllocationRequest{
+		MatchID: matchID.String(),
+		Region:  region,
+		Users:   make([]*matchAllocationUser, 0, len(selected)),
+	}
+	for mk, mp := range selected {
+		request.Users = append(request.Users, &matchAllocationUser{UserID: mk.UserID.String(), SessionID: mk.ID.SessionID.String(), Handle: mp.Meta.Handle})
+		for _, member := range mp.Members {
+			request.Users = append(request.Users, &matchAllocationUser{UserID: member.UserID.String(), SessionID: member.ID.SessionID.String(), Handle: member.Meta.Handle})
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		a.logger.Error("Could not encode match allocation request", zap.Error(err))
+		return nil
+	}
+
+	backoff := matchAllocatorRetryBackoff
+	for attempt := 0; ; attempt++ {
+		server, err := a.allocate(body)
+		if err == nil {
+			return server
+		}
+		if attempt >= a.retries {
+			a.logger.Warn("Could not allocate dedicated server, falling back to relayed match", zap.String("match_id", matchID.String()), zap.Int("attempts", attempt+1), zap.Error(err))
+			return nil
+		}
+		a.logger.Debug("Match allocation failed, retrying", zap.String("match_id", matchID.String()), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (a *MatchAllocator) allocate(body []byte) (*MatchServer, error) {
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.key != "" {
+		req.Header.Set("Authorization", "Bearer "+a.key)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fleet manager responded with status %v", resp.StatusCode)
+	}
+
+	allocation := &matchAllocationResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(allocation); err != nil {
+		return nil, err
+	}
+	if allocation.Address == "" || allocation.Port <= 0 {
+		return nil, errors.New("fleet manager response has no address or port")
+	}
+
+	return &MatchServer{
+		Address: allocation.Address,
+		Port:    allocation.Port,
+		Token:   allocation.Token,
+	}, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+type matchDataWindow struct {
+	start time.Time
+	count int64
+}
+
+// matchDataLimiter tracks how much match data a single session sends to each match it is in.
+type matchDataLimiter struct {
+	sync.Mutex
+	windows     map[uuid.UUID]*matchDataWindow
+	warnings    int64
+	lastWarning time.Time
+}
+
+func newMatchDataLimiter() *matchDataLimiter {
+	return &matchDataLimiter{
+		windows: make(map[uuid.UUID]*matchDataWindow),
+	}
+}
+
+// Allow reports whether a match data message of the given size may be sent to the match. When it may not, the
+// rejection counts as a warning and disconnect is true once the configured number of warnings is exceeded. Warnings
+// are forgotten once the session has gone the configured reset time without one.
+func (l *matchDataLimiter) Allow(config *MatchConfig, matchID uuid.UUID, size int, now time.Time) (allowed bool, disconnect bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if config.DataMaxSizeBytes > 0 && int64(size) > config.DataMaxSizeBytes {
+		return false, l.warn(config, now)
+	}
+
+	if config.DataRateLimit > 0 {
+		w, ok := l.windows[matchID]
+		if !ok || now.Sub(w.start) >= time.Second {
+			// Drop windows for matches this session has stopped sending to.
+			for id, other := range l.windows {
+				if now.Sub(other.start) >= time.Second {
+					delete(l.windows, id)
+				}
+			}
+			w = &matchDataWindow{start: now}
+			l.windows[matchID] = w
+		}
+		if w.count >= config.DataRateLimit {
+			return false, l.warn(config, now)
+		}
+		w.count++
+	}
+
+	return true, false
+}
+
+func (l *matchDataLimiter) warn(config *MatchConfig, now time.Time) bool {
+	if config.DataWarningResetSec > 0 && now.Sub(l.lastWarning) >= time.Duration(config.DataWarningResetSec)*time.Second {
+		l.warnings = 0
+	}
+	l.lastWarning = now
+	l.warnings++
+	return config.DataMaxWarnings > 0 && l.warnings > config.DataMaxWarnings
+}
@@ -0,0 +1,522 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+const (
+	matchDefaultTickRate = 10
+	matchMaxTickRate     = 30
+	// Client messages waiting for the next tick beyond this are dropped.
+	matchInputQueueSize = 128
+)
+
+// MatchHandler runs the loop of one authoritative match. All calls into the match's runtime handlers happen on the
+// match's own goroutine, so the handlers see joins, leaves and client messages in order between ticks.
+type MatchHandler struct {
+	logger        *zap.Logger
+	registry      *MatchRegistry
+	tracker       Tracker
+	messageRouter MessageRouter
+
+	ID       uuid.UUID
+	Name     string
+	TickRate int
+	// Label returned by match_init, the registry keeps the current label.
+	initLabel string
+
+	vm         *lua.LState
+	vmCancel   context.CancelFunc
+	handlers   *lua.LTable
+	ctx        *lua.LTable
+	dispatcher *lua.LTable
+	state      lua.LValue
+	tick       int64
+
+	// Set in place of the Lua fields for matches whose handler is registered by a Go module.
+	goMatch RuntimeGoMatch
+	goCtx   *RuntimeGoContext
+	goState interface{}
+
+	ticker   *time.Ticker
+	callCh   chan func()
+	inputCh  chan *matchInput
+	stopCh   chan bool
+	stopOnce sync.Once
+}
+
+type matchInput struct {
+	presence Presence
+	opCode   int64
+	data     []byte
+}
+
+func newMatchHandler(logger *zap.Logger, registry *MatchRegistry, runtime *Runtime, matchID uuid.UUID, name string, params map[string]interface{}) (*MatchHandler, error) {
+	mh := &MatchHandler{
+		logger:        logger.With(zap.String("mid", matchID.String())),
+		registry:      registry,
+		tracker:       registry.tracker,
+		messageRouter: registry.messageRouter,
+
+		ID:   matchID,
+		Name: name,
+
+		callCh:  make(chan func(), matchInputQueueSize),
+		inputCh: make(chan *matchInput, matchInputQueueSize),
+		stopCh:  make(chan bool),
+	}
+
+	var err error
+	if match := runtime.GetRuntimeGoMatch(name); match != nil {
+		err = mh.initGo(runtime, match, params)
+	} else {
+		err = mh.initLua(runtime, params)
+	}
+	if err != nil {
+		mh.close()
+		return nil, err
+	}
+	if mh.TickRate == 0 {
+		mh.TickRate = matchDefaultTickRate
+	} else if mh.TickRate < 1 || mh.TickRate > matchMaxTickRate {
+		mh.close()
+		return nil, errors.New("Match tick rate must be between 1 and 30")
+	}
+	mh.ticker = time.NewTicker(time.Second / time.Duration(mh.TickRate))
+
+	go mh.run()
+
+	return mh, nil
+}
+
+func (mh *MatchHandler) initLua(runtime *Runtime, params map[string]interface{}) error {
+	handlers := runtime.GetRuntimeMatchHandlers(mh.Name)
+	if handlers == nil {
+		return errors.New("Match handler not found")
+	}
+
+	mh.vm, mh.vmCancel = runtime.NewStateThread()
+	mh.handlers = handlers
+	mh.ctx = NewLuaContext(mh.vm, runtime.luaEnv, MATCH, uuid.Nil, "", 0)
+	mh.ctx.RawSetString(__CTX_MATCH_ID, lua.LString(mh.ID.String()))
+	mh.dispatcher = mh.vm.SetFuncs(mh.vm.NewTable(), map[string]lua.LGFunction{
+		"broadcast_message":  mh.broadcastMessage,
+		"match_kick":         mh.matchKick,
+		"match_label_update": mh.matchLabelUpdate,
+	})
+
+	var paramsTable lua.LValue = lua.LNil
+	if params != nil {
+		paramsTable = ConvertMap(mh.vm, params)
+	}
+	rets, err := mh.call("match_init", 3, mh.ctx, paramsTable)
+	if err != nil {
+		return err
+	} else if rets == nil {
+		return errors.New("Match handler has no match_init function")
+	}
+	if rets[0] == lua.LNil {
+		return errors.New("Match init function must return an initial state")
+	}
+	mh.state = rets[0]
+
+	if rate, ok := rets[1].(lua.LNumber); ok {
+		if rate < 1 || rate > matchMaxTickRate {
+			return errors.New("Match tick rate must be between 1 and 30")
+		}
+		mh.TickRate = int(rate)
+	}
+	if label, ok := rets[2].(lua.LString); ok {
+		mh.initLabel = string(label)
+	}
+	return nil
+}
+
+func (mh *MatchHandler) initGo(runtime *Runtime, match RuntimeGoMatch, params map[string]interface{}) error {
+	mh.goMatch = match
+	mh.goCtx = runtime.goContext(MATCH, uuid.Nil, "", 0)
+	mh.goCtx.MatchID = mh.ID
+
+	return runtimeGoCall(func() error {
+		state, tickRate, label, err := match.MatchInit(mh.goCtx, params)
+		if err != nil {
+			return err
+		} else if state == nil {
+			return errors.New("Match init function must return an initial state")
+		}
+		mh.goState = state
+		mh.TickRate = tickRate
+		mh.initLabel = label
+		return nil
+	})
+}
+
+func (mh *MatchHandler) run() {
+	// Only this goroutine uses the match's state, so it's the one to close it.
+	defer mh.close()
+
+	for {
+		select {
+		case <-mh.ticker.C:
+			mh.loop()
+		case fn := <-mh.callCh:
+			fn()
+		case <-mh.stopCh:
+			return
+		}
+	}
+}
+
+func (mh *MatchHandler) loop() {
+	if mh.goMatch != nil {
+		mh.loopGo()
+		return
+	}
+
+	// Drain the client messages received since the last tick.
+	messages := mh.vm.NewTable()
+	for i := 1; ; i++ {
+		var input *matchInput
+		select {
+		case input = <-mh.inputCh:
+		default:
+		}
+		if input == nil {
+			break
+		}
+		message := mh.presenceToTable(input.presence)
+		message.RawSetString("OpCode", lua.LNumber(input.opCode))
+		message.RawSetString("Data", lua.LString(input.data))
+		messages.RawSetInt(i, message)
+	}
+
+	rets, err := mh.call("match_loop", 1, mh.ctx, mh.dispatcher, lua.LNumber(mh.tick), mh.state, messages)
+	if err != nil {
+		mh.logger.Error("Match loop function caused an error, stopping match", zap.Error(err))
+		mh.Stop()
+		return
+	}
+	if rets == nil || rets[0] == lua.LNil {
+		// No state returned, the match is over.
+		mh.Stop()
+		return
+	}
+	mh.state = rets[0]
+	mh.tick++
+}
+
+func (mh *MatchHandler) loopGo() {
+	messages := make([]*RuntimeGoMatchMessage, 0)
+	for {
+		var input *matchInput
+		select {
+		case input = <-mh.inputCh:
+		default:
+		}
+		if input == nil {
+			break
+		}
+		messages = append(messages, &RuntimeGoMatchMessage{Presence: input.presence, OpCode: input.opCode, Data: input.data})
+	}
+
+	var state interface{}
+	err := runtimeGoCall(func() error {
+		state = mh.goMatch.MatchLoop(mh.goCtx, mh, mh.tick, mh.goState, messages)
+		return nil
+	})
+	if err != nil {
+		mh.logger.Error("Match loop function caused an error, stopping match", zap.Error(err))
+		mh.Stop()
+		return
+	}
+	if state == nil {
+		// No state returned, the match is over.
+		mh.Stop()
+		return
+	}
+	mh.goState = state
+	mh.tick++
+}
+
+// JoinAttempt asks the match whether the presence may join. If accepted the presence is tracked and the match is
+// told of the join before any other input. Returns a reason when the join is rejected.
+func (mh *MatchHandler) JoinAttempt(presence Presence) (bool, string) {
+	type result struct {
+		accepted bool
+		reason   string
+	}
+	resultCh := make(chan result, 1)
+
+	fn := func() {
+		accepted, reason, err := mh.callJoinAttempt(presence)
+		if err != nil {
+			mh.logger.Error("Match join attempt function caused an error", zap.Error(err))
+			resultCh <- result{false, "Match join attempt failed"}
+			return
+		}
+		if !accepted {
+			resultCh <- result{false, reason}
+			return
+		}
+
+		// Rejoining with a presence already in the match is accepted, but is not a new join.
+		if mh.tracker.Track(presence.ID.SessionID, "match:"+mh.ID.String(), presence.UserID, presence.Meta) {
+			mh.callPresences("match_join", []Presence{presence})
+		}
+		resultCh <- result{true, ""}
+	}
+
+	select {
+	case mh.callCh <- fn:
+	case <-mh.stopCh:
+		return false, "Match has ended"
+	}
+
+	select {
+	case r := <-resultCh:
+		return r.accepted, r.reason
+	case <-mh.stopCh:
+		return false, "Match has ended"
+	}
+}
+
+// Leave tells the match of presences that have left.
+func (mh *MatchHandler) Leave(leaves []Presence) {
+	fn := func() {
+		mh.callPresences("match_leave", leaves)
+	}
+
+	select {
+	case mh.callCh <- fn:
+	case <-mh.stopCh:
+	}
+}
+
+// QueueData passes a client message to the match's next tick. Messages are dropped if the match falls behind.
+func (mh *MatchHandler) QueueData(presence Presence, opCode int64, data []byte) {
+	select {
+	case mh.inputCh <- &matchInput{presence: presence, opCode: opCode, data: data}:
+	default:
+		mh.logger.Warn("Match input queue full, dropping message", zap.String("sid", presence.ID.SessionID.String()))
+	}
+}
+
+// Stop ends the match, removing all its presences.
+func (mh *MatchHandler) Stop() {
+	mh.stopOnce.Do(func() {
+		close(mh.stopCh)
+		mh.ticker.Stop()
+		mh.registry.remove(mh.ID)
+
+		topic := "match:" + mh.ID.String()
+		for _, presence := range mh.tracker.ListByTopic(topic) {
+			mh.tracker.Untrack(presence.ID.SessionID, topic, presence.UserID)
+		}
+	})
+}
+
+func (mh *MatchHandler) close() {
+	if mh.vm != nil {
+		mh.vmCancel()
+		mh.vm.Close()
+	}
+}
+
+// callJoinAttempt asks the match handler whether the presence may join, accepting it if the handler does not say.
+func (mh *MatchHandler) callJoinAttempt(presence Presence) (bool, string, error) {
+	accepted := true
+	reason := ""
+	if mh.goMatch != nil {
+		err := runtimeGoCall(func() error {
+			var state interface{}
+			state, accepted, reason = mh.goMatch.MatchJoinAttempt(mh.goCtx, mh, mh.tick, mh.goState, presence)
+			if state != nil {
+				mh.goState = state
+			}
+			return nil
+		})
+		return accepted, reason, err
+	}
+
+	rets, err := mh.call("match_join_attempt", 3, mh.ctx, mh.dispatcher, lua.LNumber(mh.tick), mh.state, mh.presenceToTable(presence))
+	if err != nil {
+		return false, "", err
+	} else if rets != nil {
+		if rets[0] != lua.LNil {
+			mh.state = rets[0]
+		}
+		accepted = lua.LVAsBool(rets[1])
+		reason = lua.LVAsString(rets[2])
+	}
+	return accepted, reason, nil
+}
+
+// callPresences calls the match_join or match_leave handler, which returns only a new state. The current state is
+// kept if it returns nothing.
+func (mh *MatchHandler) callPresences(fnName string, presences []Presence) {
+	if mh.goMatch != nil {
+		err := runtimeGoCall(func() error {
+			var state interface{}
+			if fnName == "match_join" {
+				state = mh.goMatch.MatchJoin(mh.goCtx, mh, mh.tick, mh.goState, presences)
+			} else {
+				state = mh.goMatch.MatchLeave(mh.goCtx, mh, mh.tick, mh.goState, presences)
+			}
+			if state != nil {
+				mh.goState = state
+			}
+			return nil
+		})
+		if err != nil {
+			mh.logger.Error("Match function caused an error", zap.String("function", fnName), zap.Error(err))
+		}
+		return
+	}
+
+	presencesTable := mh.vm.NewTable()
+	for i, presence := range presences {
+		presencesTable.RawSetInt(i+1, mh.presenceToTable(presence))
+	}
+	rets, err := mh.call(fnName, 1, mh.ctx, mh.dispatcher, lua.LNumber(mh.tick), mh.state, presencesTable)
+	if err != nil {
+		mh.logger.Error("Match function caused an error", zap.String("function", fnName), zap.Error(err))
+		return
+	}
+	if rets != nil && rets[0] != lua.LNil {
+		mh.state = rets[0]
+	}
+}
+
+// call invokes the named handler if the match defines it, returning nil results if it does not.
+func (mh *MatchHandler) call(fnName string, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	fn := mh.handlers.RawGetString(fnName)
+	if fn.Type() != lua.LTFunction {
+		return nil, nil
+	}
+
+	mh.vm.Push(fn)
+	for _, arg := range args {
+		mh.vm.Push(arg)
+	}
+	if err := mh.vm.PCall(len(args), nret, nil); err != nil {
+		return nil, err
+	}
+
+	rets := make([]lua.LValue, nret)
+	for i := 0; i < nret; i++ {
+		rets[i] = mh.vm.Get(i - nret)
+	}
+	mh.vm.Pop(nret)
+	return rets, nil
+}
+
+func (mh *MatchHandler) presenceToTable(presence Presence) *lua.LTable {
+	lt := mh.vm.NewTable()
+	lt.RawSetString("UserId", lua.LString(presence.UserID.String()))
+	lt.RawSetString("SessionId", lua.LString(presence.ID.SessionID.String()))
+	lt.RawSetString("Handle", lua.LString(presence.Meta.Handle))
+	lt.RawSetString("Spectator", lua.LBool(presence.Meta.Spectator))
+	return lt
+}
+
+// presencesFromTable picks the match presences listed by user and session ID in a Lua table.
+func (mh *MatchHandler) presencesFromTable(l *lua.LState, lt *lua.LTable) []Presence {
+	all := mh.tracker.ListByTopic("match:" + mh.ID.String())
+	ps := make([]Presence, 0)
+	lt.ForEach(func(_ lua.LValue, v lua.LValue) {
+		pt, ok := v.(*lua.LTable)
+		if !ok {
+			l.ArgError(1, "expects each presence to be a table")
+			return
+		}
+		userID := lua.LVAsString(pt.RawGetString("UserId"))
+		sessionID := lua.LVAsString(pt.RawGetString("SessionId"))
+		for _, presence := range all {
+			if presence.UserID.String() == userID && presence.ID.SessionID.String() == sessionID {
+				ps = append(ps, presence)
+				break
+			}
+		}
+	})
+	return ps
+}
+
+// BroadcastMessage sends data to the given presences, or to everyone in the match if presences is nil.
+func (mh *MatchHandler) BroadcastMessage(opCode int64, data []byte, presences []Presence) {
+	if presences == nil {
+		presences = mh.tracker.ListByTopic("match:" + mh.ID.String())
+	}
+	if len(presences) == 0 {
+		return
+	}
+
+	mh.messageRouter.Send(mh.logger, presences, &Envelope{Payload: &Envelope_MatchData{MatchData: &MatchData{
+		MatchId: mh.ID.Bytes(),
+		OpCode:  opCode,
+		Data:    data,
+	}}})
+}
+
+// MatchKick removes the presences from the match.
+func (mh *MatchHandler) MatchKick(presences []Presence) {
+	topic := "match:" + mh.ID.String()
+	for _, presence := range presences {
+		mh.tracker.Untrack(presence.ID.SessionID, topic, presence.UserID)
+	}
+}
+
+// MatchLabelUpdate replaces the match's label.
+func (mh *MatchHandler) MatchLabelUpdate(label string) error {
+	_, err := mh.registry.UpdateLabel(mh.ID, uuid.Nil, label)
+	return err
+}
+
+func (mh *MatchHandler) broadcastMessage(l *lua.LState) int {
+	opCode := l.CheckInt64(1)
+	data := l.OptString(2, "")
+	presencesTable := l.OptTable(3, nil)
+
+	var to []Presence
+	if presencesTable != nil {
+		// An empty list sends to no one, unlike no list at all.
+		to = mh.presencesFromTable(l, presencesTable)
+		if len(to) == 0 {
+			return 0
+		}
+	}
+	mh.BroadcastMessage(opCode, []byte(data), to)
+	return 0
+}
+
+func (mh *MatchHandler) matchKick(l *lua.LState) int {
+	mh.MatchKick(mh.presencesFromTable(l, l.CheckTable(1)))
+	return 0
+}
+
+func (mh *MatchHandler) matchLabelUpdate(l *lua.LState) int {
+	if err := mh.MatchLabelUpdate(l.CheckString(1)); err != nil {
+		l.RaiseError("error updating match label: %v", err.Error())
+	}
+	return 0
+}
@@ -0,0 +1,257 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// How often buffered replay frames are written to the database.
+const matchRecorderFlushInterval = 1 * time.Second
+
+type matchReplayFrame struct {
+	matchID   uuid.UUID
+	seq       int64
+	presence  Presence
+	opCode    int64
+	data      []byte
+	createdAt int64
+}
+
+type matchReplayUser struct {
+	matchID   uuid.UUID
+	userID    uuid.UUID
+	createdAt int64
+}
+
+type matchRecording struct {
+	createdAt int64
+	seq       int64
+	users     map[uuid.UUID]struct{}
+}
+
+// MatchRecorder records the data relayed in matches created with recording enabled, so users who were in them can
+// download a replay later. Frames are buffered and written in batches.
+type MatchRecorder struct {
+	sync.Mutex
+	logger     *zap.Logger
+	db         *sql.DB
+	config     *MatchConfig
+	tracker    Tracker
+	recordings map[uuid.UUID]*matchRecording
+	frames     []*matchReplayFrame
+	users      []*matchReplayUser
+	ticker     *time.Ticker
+	stopCh     chan bool
+	doneCh     chan bool
+}
+
+// NewMatchRecorder creates a new MatchRecorder
+func NewMatchRecorder(logger *zap.Logger, db *sql.DB, config *MatchConfig, tracker Tracker) *MatchRecorder {
+	r := &MatchRecorder{
+		logger:     logger,
+		db:         db,
+		config:     config,
+		tracker:    tracker,
+		recordings: make(map[uuid.UUID]*matchRecording),
+		frames:     make([]*matchReplayFrame, 0),
+		users:      make([]*matchReplayUser, 0),
+		ticker:     time.NewTicker(matchRecorderFlushInterval),
+		stopCh:     make(chan bool),
+		doneCh:     make(chan bool),
+	}
+
+	go func() {
+		defer close(r.doneCh)
+		for {
+			select {
+			case <-r.ticker.C:
+				r.flush()
+			case <-r.stopCh:
+				r.flush()
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// Stop writes any buffered frames and stops recording.
+func (r *MatchRecorder) Stop() {
+	r.ticker.Stop()
+	close(r.stopCh)
+	<-r.doneCh
+}
+
+// Start begins recording a new relayed match. It must be called before anyone is tracked in the match.
+func (r *MatchRecorder) Start(matchID uuid.UUID, creatorID uuid.UUID) error {
+	ts := nowMs()
+	_, err := r.db.Exec(`
+INSERT INTO match_replay (id, creator_id, created_at, updated_at)
+VALUES ($1, $2, $3, $3)`, matchID.Bytes(), creatorID.Bytes(), ts)
+	if err != nil {
+		r.logger.Error("Could not start match replay", zap.Error(err))
+		return err
+	}
+
+	r.Lock()
+	r.recordings[matchID] = &matchRecording{
+		createdAt: ts,
+		users:     make(map[uuid.UUID]struct{}),
+	}
+	r.Unlock()
+	return nil
+}
+
+// Recording reports whether the match is being recorded.
+func (r *MatchRecorder) Recording(matchID uuid.UUID) bool {
+	r.Lock()
+	_, ok := r.recordings[matchID]
+	r.Unlock()
+	return ok
+}
+
+// Record buffers a frame of data relayed in the match, if the match is being recorded.
+func (r *MatchRecorder) Record(matchID uuid.UUID, presence Presence, opCode int64, data []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	recording, ok := r.recordings[matchID]
+	if !ok {
+		return
+	}
+	if r.config.ReplayMaxFrames > 0 && recording.seq >= r.config.ReplayMaxFrames {
+		r.logger.Warn("Match replay reached maximum frames, recording stopped", zap.String("match_id", matchID.String()))
+		delete(r.recordings, matchID)
+		return
+	}
+
+	r.frames = append(r.frames, &matchReplayFrame{
+		matchID:   matchID,
+		seq:       recording.seq,
+		presence:  presence,
+		opCode:    opCode,
+		data:      data,
+		createdAt: nowMs(),
+	})
+	recording.seq++
+}
+
+// HandleDiff records who was in each recorded match, and stops recording matches once everyone has left.
+func (r *MatchRecorder) HandleDiff(joins, leaves []Presence) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, presence := range joins {
+		matchID, ok := r.recordedMatchID(presence.Topic)
+		if !ok {
+			continue
+		}
+		recording := r.recordings[matchID]
+		if _, ok := recording.users[presence.UserID]; ok {
+			continue
+		}
+		recording.users[presence.UserID] = struct{}{}
+		r.users = append(r.users, &matchReplayUser{matchID: matchID, userID: presence.UserID, createdAt: recording.createdAt})
+	}
+
+	for _, presence := range leaves {
+		matchID, ok := r.recordedMatchID(presence.Topic)
+		if ok && len(r.tracker.ListByTopic(presence.Topic)) == 0 {
+			delete(r.recordings, matchID)
+		}
+	}
+}
+
+func (r *MatchRecorder) recordedMatchID(topic string) (uuid.UUID, bool) {
+	splitTopic := strings.SplitN(topic, ":", 2)
+	if splitTopic[0] != "match" || len(splitTopic) != 2 {
+		return uuid.Nil, false
+	}
+	matchID, err := uuid.FromString(splitTopic[1])
+	if err != nil {
+		return uuid.Nil, false
+	}
+	_, ok := r.recordings[matchID]
+	return matchID, ok
+}
+
+func (r *MatchRecorder) flush() {
+	r.Lock()
+	frames := r.frames
+	users := r.users
+	r.frames = make([]*matchReplayFrame, 0)
+	r.users = make([]*matchReplayUser, 0)
+	r.Unlock()
+
+	if len(frames) == 0 && len(users) == 0 {
+		return
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		r.logger.Error("Could not write match replays, begin error", zap.Error(err))
+		return
+	}
+	defer func() {
+		if err != nil {
+			r.logger.Error("Could not write match replays", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				r.logger.Error("Could not write match replays, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				r.logger.Error("Could not write match replays, commit error", zap.Error(e))
+			}
+		}
+	}()
+
+	for _, u := range users {
+		_, err = tx.Exec(`
+INSERT INTO match_replay_user (user_id, match_id, created_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (match_id, user_id) DO NOTHING`, u.userID.Bytes(), u.matchID.Bytes(), u.createdAt)
+		if err != nil {
+			return
+		}
+	}
+
+	frameCounts := make(map[uuid.UUID]int64)
+	for _, f := range frames {
+		_, err = tx.Exec(`
+INSERT INTO match_replay_frame (match_id, seq, user_id, session_id, handle, op_code, data, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			f.matchID.Bytes(), f.seq, f.presence.UserID.Bytes(), f.presence.ID.SessionID.Bytes(), f.presence.Meta.Handle, f.opCode, f.data, f.createdAt)
+		if err != nil {
+			return
+		}
+		frameCounts[f.matchID] = f.seq + 1
+	}
+
+	ts := nowMs()
+	for matchID, count := range frameCounts {
+		_, err = tx.Exec("UPDATE match_replay SET frame_count = $2, updated_at = $3 WHERE id = $1", matchID.Bytes(), count, ts)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// MatchRegistry keeps the authoritative matches running on this node. Relayed matches exist as presences on a
+// "match:<id>" topic, the registry only keeps track of their host and label. In a cluster each match is held by the
+// node it was created on, and only sessions on that node may join it.
+type MatchRegistry struct {
+	sync.RWMutex
+	logger        *zap.Logger
+	name          string
+	config        *MatchConfig
+	tracker       Tracker
+	messageRouter MessageRouter
+	cluster       *ClusterService
+	matches       map[uuid.UUID]*MatchHandler
+	hosts         map[uuid.UUID]*matchHost
+	labels        map[uuid.UUID]*matchLabel
+}
+
+// matchHost is the host of a relayed match. The rejoin timer is set while a disconnected host may still rejoin.
+type matchHost struct {
+	presence    Presence
+	rejoinTimer *time.Timer
+}
+
+// matchLabel is a match's label, along with its fields as matchmaker properties if it is a JSON object so match
+// listings can query them.
+type matchLabel struct {
+	value      string
+	properties map[string]interface{}
+}
+
+func newMatchLabel(value string) *matchLabel {
+	l := &matchLabel{value: value, properties: make(map[string]interface{})}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return l
+	}
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			l.properties[k] = []string{v}
+		case bool:
+			l.properties[k] = v
+		case float64:
+			if v == math.Trunc(v) {
+				l.properties[k] = int64(v)
+			}
+		case []interface{}:
+			terms := make([]string, 0, len(v))
+			for _, term := range v {
+				if s, ok := term.(string); ok {
+					terms = append(terms, s)
+				}
+			}
+			l.properties[k] = terms
+		}
+	}
+	return l
+}
+
+// NewMatchRegistry creates a new MatchRegistry
+func NewMatchRegistry(logger *zap.Logger, name string, config *MatchConfig, tracker Tracker, messageRouter MessageRouter, cluster *ClusterService) *MatchRegistry {
+	return &MatchRegistry{
+		logger:        logger,
+		name:          name,
+		config:        config,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+		cluster:       cluster,
+		matches:       make(map[uuid.UUID]*MatchHandler),
+		hosts:         make(map[uuid.UUID]*matchHost),
+		labels:        make(map[uuid.UUID]*matchLabel),
+	}
+}
+
+// Create starts a new authoritative match run by the named runtime match handler and returns its ID.
+func (r *MatchRegistry) Create(runtime *Runtime, name string, params map[string]interface{}) (uuid.UUID, error) {
+	matchID := uuid.NewV4()
+	mh, err := newMatchHandler(r.logger, r, runtime, matchID, name, params)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	r.Lock()
+	r.matches[matchID] = mh
+	r.labels[matchID] = newMatchLabel(mh.initLabel)
+	r.Unlock()
+	r.cluster.Claim("match:" + matchID.String())
+
+	r.logger.Info("Created authoritative match", zap.String("mid", matchID.String()), zap.String("handler", name), zap.Int("tick_rate", mh.TickRate))
+	return matchID, nil
+}
+
+// Get returns the authoritative match with the given ID, or nil if there is no such match on this node.
+func (r *MatchRegistry) Get(matchID uuid.UUID) *MatchHandler {
+	r.RLock()
+	mh := r.matches[matchID]
+	r.RUnlock()
+	return mh
+}
+
+// Remote returns the other node in the cluster holding a match, if it's not held by this node.
+func (r *MatchRegistry) Remote(matchID uuid.UUID) (string, bool) {
+	r.RLock()
+	_, running := r.matches[matchID]
+	_, hosted := r.hosts[matchID]
+	r.RUnlock()
+	if running || hosted {
+		return "", false
+	}
+	return r.cluster.Owner("match:" + matchID.String())
+}
+
+// List returns running authoritative matches, and relayed matches whose host has given them a label, matching all
+// the given filters, ordered by match ID. A label or handler of "", a nil query and sizes of 0 match any value. The
+// query is matched against the fields of labels that are JSON objects. The cursor is the ID of the last match on the
+// previous page.
+func (r *MatchRegistry) List(limit int64, cursor []byte, label string, handler string, query *MatchmakerQuery, minSize int64, maxSize int64) ([]*Match, []byte, Error_Code, error) {
+	if limit == 0 {
+		limit = 10
+	} else if limit < 10 || limit > 100 {
+		return nil, nil, BAD_INPUT, errors.New("Limit must be between 10 and 100")
+	}
+	if len(cursor) != 0 {
+		if _, err := uuid.FromBytes(cursor); err != nil {
+			return nil, nil, BAD_INPUT, errors.New("Invalid cursor")
+		}
+	}
+
+	type listed struct {
+		matchID uuid.UUID
+		handler string
+		label   *matchLabel
+	}
+
+	r.RLock()
+	candidates := make([]*listed, 0, len(r.labels))
+	for matchID, l := range r.labels {
+		if len(cursor) != 0 && bytes.Compare(matchID.Bytes(), cursor) <= 0 {
+			continue
+		}
+		if label != "" && l.value != label {
+			continue
+		}
+		if query != nil && !query.Match(l.properties) {
+			continue
+		}
+		c := &listed{matchID: matchID, label: l}
+		if mh, ok := r.matches[matchID]; ok {
+			c.handler = mh.Name
+		}
+		if handler != "" && c.handler != handler {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	r.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i].matchID.Bytes(), candidates[j].matchID.Bytes()) < 0
+	})
+
+	matches := make([]*Match, 0)
+	var nextCursor []byte
+	for _, c := range candidates {
+		var size, spectators int64
+		for _, presence := range r.tracker.ListByTopic("match:" + c.matchID.String()) {
+			if presence.Meta.Spectator {
+				spectators++
+			} else {
+				size++
+			}
+		}
+		if (minSize > 0 && size < minSize) || (maxSize > 0 && size > maxSize) {
+			continue
+		}
+		if int64(len(matches)) >= limit {
+			nextCursor = matches[len(matches)-1].MatchId
+			break
+		}
+		match := &Match{
+			MatchId:       c.matchID.Bytes(),
+			Authoritative: c.handler != "",
+			Label:         c.label.value,
+			Size:          size,
+			Handler:       c.handler,
+			Spectators:    spectators,
+		}
+		if host, ok := r.Host(c.matchID); ok {
+			match.Host = &UserPresence{
+				UserId:    host.UserID.Bytes(),
+				SessionId: host.ID.SessionID.Bytes(),
+				Handle:    host.Meta.Handle,
+			}
+		}
+		matches = append(matches, match)
+	}
+
+	return matches, nextCursor, 0, nil
+}
+
+// Label returns the current label of a match, or "" if it has none.
+func (r *MatchRegistry) Label(matchID uuid.UUID) string {
+	r.RLock()
+	defer r.RUnlock()
+	if l, ok := r.labels[matchID]; ok {
+		return l.value
+	}
+	return ""
+}
+
+// UpdateLabel replaces the label of a running match and tells everyone in the match. For relayed matches only the
+// current host may do this, authoritative matches update their label from their match handler.
+func (r *MatchRegistry) UpdateLabel(matchID uuid.UUID, sessionID uuid.UUID, label string) (Error_Code, error) {
+	if maxSize := r.config.LabelMaxSizeBytes; maxSize > 0 && int64(len(label)) > maxSize {
+		return BAD_INPUT, fmt.Errorf("Match label must be at most %v bytes", maxSize)
+	}
+
+	r.Lock()
+	if _, ok := r.matches[matchID]; ok {
+		if sessionID != uuid.Nil {
+			r.Unlock()
+			return BAD_INPUT, errors.New("Authoritative match labels can only be updated by their match handler")
+		}
+	} else {
+		h, ok := r.hosts[matchID]
+		if !ok {
+			r.Unlock()
+			return MATCH_NOT_FOUND, errors.New("Match not found")
+		}
+		if h.presence.ID.SessionID != sessionID {
+			r.Unlock()
+			return BAD_INPUT, errors.New("Only the match host can update the label")
+		}
+	}
+	if label == "" && r.matches[matchID] == nil {
+		// Relayed matches without a label are not listed.
+		delete(r.labels, matchID)
+	} else {
+		r.labels[matchID] = newMatchLabel(label)
+	}
+	r.Unlock()
+
+	if r.messageRouter != nil {
+		to := r.tracker.ListByTopic("match:" + matchID.String())
+		r.messageRouter.Send(r.logger, to, &Envelope{Payload: &Envelope_MatchLabel{MatchLabel: &MatchLabel{
+			MatchId: matchID.Bytes(),
+			Label:   label,
+		}}})
+	}
+	return 0, nil
+}
+
+// SetHost records the host of a new relayed match, and its label if it has one.
+func (r *MatchRegistry) SetHost(matchID uuid.UUID, presence Presence, label string) {
+	r.Lock()
+	r.hosts[matchID] = &matchHost{presence: presence}
+	if label != "" {
+		r.labels[matchID] = newMatchLabel(label)
+	}
+	r.Unlock()
+	r.cluster.Claim("match:" + matchID.String())
+}
+
+// Host returns the current host of a relayed match, if it has one.
+func (r *MatchRegistry) Host(matchID uuid.UUID) (Presence, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if h, ok := r.hosts[matchID]; ok {
+		return h.presence, true
+	}
+	return Presence{}, false
+}
+
+// CanRejoin checks if the user is the disconnected host of a relayed match who may still rejoin it.
+func (r *MatchRegistry) CanRejoin(matchID uuid.UUID, userID uuid.UUID) bool {
+	r.RLock()
+	defer r.RUnlock()
+	h, ok := r.hosts[matchID]
+	return ok && h.rejoinTimer != nil && h.presence.UserID == userID
+}
+
+// Joined records a presence joining a relayed match. The first presence to join a match with no host becomes its
+// host, and a disconnected host who rejoins in time is restored as host with their new presence.
+func (r *MatchRegistry) Joined(matchID uuid.UUID, presence Presence) {
+	r.Lock()
+	h, ok := r.hosts[matchID]
+	if !ok {
+		r.hosts[matchID] = &matchHost{presence: presence}
+		r.Unlock()
+		r.cluster.Claim("match:" + matchID.String())
+		return
+	}
+	if h.rejoinTimer == nil || h.presence.UserID != presence.UserID {
+		r.Unlock()
+		return
+	}
+	h.rejoinTimer.Stop()
+	h.rejoinTimer = nil
+	h.presence = presence
+	r.Unlock()
+
+	r.notifyHost(matchID, presence)
+}
+
+// HostLeave elects a new host straight away if the host of a relayed match leaves it deliberately.
+func (r *MatchRegistry) HostLeave(matchID uuid.UUID, sessionID uuid.UUID) {
+	r.RLock()
+	h, ok := r.hosts[matchID]
+	isHost := ok && h.presence.ID.SessionID == sessionID
+	r.RUnlock()
+
+	if isHost {
+		r.electHost(matchID, sessionID, false)
+	}
+}
+
+// HandleDiff tells authoritative matches of presences that have left them, whether by leaving or disconnecting,
+// and gives the disconnected host of a relayed match a grace period to rejoin before a new host is elected.
+func (r *MatchRegistry) HandleDiff(joins, leaves []Presence) {
+	matchLeaves := make(map[uuid.UUID][]Presence)
+	for _, presence := range leaves {
+		splitTopic := strings.SplitN(presence.Topic, ":", 2)
+		if splitTopic[0] != "match" || len(splitTopic) != 2 {
+			continue
+		}
+		matchID, err := uuid.FromString(splitTopic[1])
+		if err != nil {
+			continue
+		}
+		matchLeaves[matchID] = append(matchLeaves[matchID], presence)
+	}
+
+	for matchID, ps := range matchLeaves {
+		if mh := r.Get(matchID); mh != nil {
+			mh.Leave(ps)
+			continue
+		}
+
+		for _, presence := range ps {
+			r.hostDisconnected(matchID, presence.ID.SessionID)
+		}
+	}
+}
+
+func (r *MatchRegistry) hostDisconnected(matchID uuid.UUID, sessionID uuid.UUID) {
+	grace := time.Duration(r.config.HostRejoinGraceSec) * time.Second
+
+	r.Lock()
+	h, ok := r.hosts[matchID]
+	if !ok || h.rejoinTimer != nil || h.presence.ID.SessionID != sessionID {
+		r.Unlock()
+		return
+	}
+	if grace > 0 {
+		h.rejoinTimer = time.AfterFunc(grace, func() {
+			r.electHost(matchID, uuid.Nil, true)
+		})
+		r.Unlock()
+		return
+	}
+	r.Unlock()
+
+	r.electHost(matchID, uuid.Nil, false)
+}
+
+// electHost promotes a remaining presence to host of a relayed match and tells the match, or forgets the match if
+// nobody is left. When the rejoin grace period has ended it only proceeds if the host has not rejoined meanwhile.
+func (r *MatchRegistry) electHost(matchID uuid.UUID, excludeSessionID uuid.UUID, graceEnded bool) {
+	r.Lock()
+	h, ok := r.hosts[matchID]
+	if !ok || (graceEnded && h.rejoinTimer == nil) {
+		r.Unlock()
+		return
+	}
+	if h.rejoinTimer != nil {
+		h.rejoinTimer.Stop()
+		h.rejoinTimer = nil
+	}
+
+	ps := r.tracker.ListByTopic("match:" + matchID.String())
+	candidates := make([]Presence, 0, len(ps))
+	for _, presence := range ps {
+		// Spectators never host.
+		if presence.ID.SessionID != excludeSessionID && !presence.Meta.Spectator {
+			candidates = append(candidates, presence)
+		}
+	}
+	if len(candidates) == 0 {
+		delete(r.hosts, matchID)
+		delete(r.labels, matchID)
+		r.Unlock()
+		r.cluster.Release("match:" + matchID.String())
+		return
+	}
+
+	// Any remaining presence will do, pick the same one however the tracker orders them.
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i].ID.SessionID.Bytes(), candidates[j].ID.SessionID.Bytes()) < 0
+	})
+	host := candidates[0]
+	h.presence = host
+	r.Unlock()
+
+	r.notifyHost(matchID, host)
+}
+
+func (r *MatchRegistry) notifyHost(matchID uuid.UUID, host Presence) {
+	to := r.tracker.ListByTopic("match:" + matchID.String())
+	r.messageRouter.Send(r.logger, to, &Envelope{Payload: &Envelope_MatchHost{MatchHost: &MatchHost{
+		MatchId: matchID.Bytes(),
+		Host: &UserPresence{
+			UserId:    host.UserID.Bytes(),
+			SessionId: host.ID.SessionID.Bytes(),
+			Handle:    host.Meta.Handle,
+		},
+	}}})
+}
+
+// Count returns the number of authoritative matches running on this node.
+func (r *MatchRegistry) Count() int {
+	r.RLock()
+	count := len(r.matches)
+	r.RUnlock()
+	return count
+}
+
+// Stop ends all authoritative matches.
+func (r *MatchRegistry) Stop() {
+	r.RLock()
+	mhs := make([]*MatchHandler, 0, len(r.matches))
+	for _, mh := range r.matches {
+		mhs = append(mhs, mh)
+	}
+	r.RUnlock()
+
+	for _, mh := range mhs {
+		mh.Stop()
+	}
+}
+
+func (r *MatchRegistry) remove(matchID uuid.UUID) {
+	r.Lock()
+	delete(r.matches, matchID)
+	delete(r.labels, matchID)
+	r.Unlock()
+	r.cluster.Release("match:" + matchID.String())
+}
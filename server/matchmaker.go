@@ -16,7 +16,10 @@ package server
 
 import (
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
@@ -26,14 +29,30 @@ type Matchmaker interface {
 	Remove(sessionID uuid.UUID, userID uuid.UUID, ticket uuid.UUID) error
 	RemoveAll(sessionID uuid.UUID)
 	UpdateAll(sessionID uuid.UUID, meta PresenceMeta)
+	AddMatchListener(func(map[MatchmakerKey]*MatchmakerProfile, []*MatchmakerAcceptedProperty))
+	AddTimeoutListener(func(MatchmakerKey, *MatchmakerProfile))
+	AddBackfillListener(func(uuid.UUID, MatchmakerKey, *MatchmakerProfile))
+	Backfill(matchID uuid.UUID, backfill *MatchmakerBackfill)
+	Status(sessionID uuid.UUID, userID uuid.UUID, ticket uuid.UUID) (*MatchmakerStatus, error)
+	CountBySession(sessionID uuid.UUID) int
+	Count() int
+	Sweep()
+	Stop()
 }
 
+// How often waiting tickets with expanding range filters are matched again, and timed out tickets removed.
+const matchmakerSweepInterval = 1 * time.Second
+
+// Weight of each newly matched ticket's wait in the running average used for wait estimates.
+const matchmakerWaitAverageWeight = 0.1
+
 type Filter int
 
 const (
 	BOOL Filter = iota
 	RANGE
 	TERM
+	EXPANDING_RANGE
 )
 
 type MatchmakerFilter interface {
@@ -58,6 +77,32 @@ func (*MatchmakerRangeFilter) Type() Filter {
 	return RANGE
 }
 
+// MatchmakerExpandingRangeFilter is a range filter that widens both bounds by Step for every
+// Interval the ticket has been waiting, up to at most Limit in total. A Limit of 0 means no limit.
+type MatchmakerExpandingRangeFilter struct {
+	MatchmakerRangeFilter
+	Step     int64
+	Interval time.Duration
+	Limit    int64
+}
+
+func (*MatchmakerExpandingRangeFilter) Type() Filter {
+	return EXPANDING_RANGE
+}
+
+// Bounds returns the range accepted by the filter once a ticket has been waiting for the given duration.
+func (f *MatchmakerExpandingRangeFilter) Bounds(waited time.Duration) (int64, int64) {
+	if f.Step <= 0 || f.Interval <= 0 || waited < f.Interval {
+		return f.LowerBound, f.UpperBound
+	}
+
+	expand := int64(waited/f.Interval) * f.Step
+	if f.Limit > 0 && expand > f.Limit {
+		expand = f.Limit
+	}
+	return f.LowerBound - expand, f.UpperBound + expand
+}
+
 type MatchmakerBoolFilter struct {
 	Value bool
 }
@@ -70,6 +115,7 @@ type MatchmakerAcceptedProperty struct {
 	UserID     uuid.UUID
 	Properties map[string]interface{}
 	Filters    map[string]MatchmakerFilter
+	Query      *MatchmakerQuery
 }
 
 type MatchmakerKey struct {
@@ -83,43 +129,451 @@ type MatchmakerProfile struct {
 	RequiredCount int
 	Properties    map[string]interface{}
 	Filters       map[string]MatchmakerFilter
+	// Optional query other tickets' properties must match, as well as the filters.
+	Query *MatchmakerQuery
+	// When the ticket was added, used to widen expanding range filters. Set on Add if empty.
+	CreatedAt time.Time
+	// Other party members matchmaking as one unit with the ticket's user, each taking up a place in the match.
+	Members []Presence
+	// The ticket is removed if not matched within this time, 0 for no timeout.
+	Timeout time.Duration
+	// Round trip times in milliseconds the user measured to each region. Tickets with latencies are only matched
+	// with others who share a region, in the region with the lowest worst round trip.
+	Latencies map[string]int64
+	// Largest acceptable difference between the best and worst round trip in the chosen region, 0 for no limit.
+	MaxRttSpread int64
+	// Split the match into this many teams of equal size, 0 or 1 for no teams. Tickets are only matched with others
+	// asking for the same teams, and never assigned to a backfill.
+	TeamCount int
+	// Integer property the teams are balanced on, so each team's total is as close as possible. Each party member
+	// counts as having the ticket's value.
+	TeamProperty string
+}
+
+// MatchmakerBackfill describes open places in a match that is already running. Waiting tickets are assigned to
+// them before being matched with each other.
+type MatchmakerBackfill struct {
+	// The session that registered the backfill, which is removed when they leave the match.
+	SessionID     uuid.UUID
+	RequiredCount int
+	OpenSlots     int
+	Properties    map[string]interface{}
+	Filters       map[string]MatchmakerFilter
+	Query         *MatchmakerQuery
+	// When the backfill was registered, used to widen expanding range filters. Set on Backfill if empty.
+	CreatedAt time.Time
 }
 
+// profile lets the backfill be checked against tickets like any other profile.
+func (b *MatchmakerBackfill) profile() *MatchmakerProfile {
+	return &MatchmakerProfile{
+		RequiredCount: b.RequiredCount,
+		Properties:    b.Properties,
+		Filters:       b.Filters,
+		Query:         b.Query,
+		CreatedAt:     b.CreatedAt,
+	}
+}
+
+// MatchmakerStatus describes a waiting ticket's progress.
+type MatchmakerStatus struct {
+	// Position among waiting tickets for the same match size, oldest first, starting at 1.
+	Position int
+	// Number of tickets waiting for the same match size.
+	Waiting int
+	// How long the ticket has been waiting.
+	Elapsed time.Duration
+	// Average wait of recently matched tickets, 0 if there is no estimate yet.
+	EstimatedWait time.Duration
+}
+
+// seats is the number of places in a match the profile takes up.
+func (p *MatchmakerProfile) seats() int {
+	return 1 + len(p.Members)
+}
+
+// bestRtt is the profile's lowest round trip time to any region, or 0 if it has no latencies.
+func (p *MatchmakerProfile) bestRtt() int64 {
+	var best int64
+	for _, rtt := range p.Latencies {
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	return best
+}
+
+func (p *MatchmakerProfile) expanding() bool {
+	for _, filter := range p.Filters {
+		if filter.Type() == EXPANDING_RANGE {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchmakerService holds the tickets of sessions on this node. In a cluster tickets are only matched with other
+// tickets on the same node, the pool is not shared between nodes.
 type MatchmakerService struct {
 	sync.Mutex
-	name   string
-	values map[MatchmakerKey]*MatchmakerProfile
+	name              string
+	matchListeners    []func(map[MatchmakerKey]*MatchmakerProfile, []*MatchmakerAcceptedProperty)
+	timeoutListeners  []func(MatchmakerKey, *MatchmakerProfile)
+	backfillListeners []func(uuid.UUID, MatchmakerKey, *MatchmakerProfile)
+	values            map[MatchmakerKey]*MatchmakerProfile
+	backfills         map[uuid.UUID]*MatchmakerBackfill
+	waitAverage       time.Duration
+	ticker            *time.Ticker
+	stopCh            chan bool
 }
 
 func NewMatchmakerService(name string) *MatchmakerService {
-	return &MatchmakerService{
-		name:   name,
-		values: make(map[MatchmakerKey]*MatchmakerProfile),
+	m := &MatchmakerService{
+		name:              name,
+		matchListeners:    make([]func(map[MatchmakerKey]*MatchmakerProfile, []*MatchmakerAcceptedProperty), 0),
+		timeoutListeners:  make([]func(MatchmakerKey, *MatchmakerProfile), 0),
+		backfillListeners: make([]func(uuid.UUID, MatchmakerKey, *MatchmakerProfile), 0),
+		values:            make(map[MatchmakerKey]*MatchmakerProfile),
+		backfills:         make(map[uuid.UUID]*MatchmakerBackfill),
+		ticker:            time.NewTicker(matchmakerSweepInterval),
+		stopCh:            make(chan bool),
 	}
+
+	go func() {
+		for {
+			select {
+			case <-m.ticker.C:
+				m.Sweep()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+// AddMatchListener registers a function to be called with matches found by a sweep rather than by Add.
+func (m *MatchmakerService) AddMatchListener(f func(map[MatchmakerKey]*MatchmakerProfile, []*MatchmakerAcceptedProperty)) {
+	m.Lock()
+	m.matchListeners = append(m.matchListeners, f)
+	m.Unlock()
+}
+
+// AddTimeoutListener registers a function to be called with tickets removed because they timed out.
+func (m *MatchmakerService) AddTimeoutListener(f func(MatchmakerKey, *MatchmakerProfile)) {
+	m.Lock()
+	m.timeoutListeners = append(m.timeoutListeners, f)
+	m.Unlock()
+}
+
+// AddBackfillListener registers a function to be called with each ticket assigned to a running match's backfill.
+func (m *MatchmakerService) AddBackfillListener(f func(uuid.UUID, MatchmakerKey, *MatchmakerProfile)) {
+	m.Lock()
+	m.backfillListeners = append(m.backfillListeners, f)
+	m.Unlock()
+}
+
+func (m *MatchmakerService) Stop() {
+	m.ticker.Stop()
+	close(m.stopCh)
 }
 
 func (m *MatchmakerService) Add(sessionID uuid.UUID, userID uuid.UUID, incomingProfile *MatchmakerProfile) (uuid.UUID, map[MatchmakerKey]*MatchmakerProfile, []*MatchmakerAcceptedProperty) {
 	ticket := uuid.NewV4()
-	candidates := make(map[MatchmakerKey]*MatchmakerProfile, incomingProfile.RequiredCount-1)
 	requestKey := MatchmakerKey{ID: PresenceID{SessionID: sessionID, Node: m.name}, UserID: userID, Ticket: ticket}
 
+	now := time.Now().UTC()
+	if incomingProfile.CreatedAt.IsZero() {
+		incomingProfile.CreatedAt = now
+	}
+
+	m.Lock()
+	if matchID, ok := m.assignBackfill(requestKey, incomingProfile, now); ok {
+		backfillListeners := m.backfillListeners
+		m.Unlock()
+		// Let the caller hand out the ticket before the user hears which match they were assigned to.
+		go func() {
+			for _, f := range backfillListeners {
+				f(matchID, requestKey, incomingProfile)
+			}
+		}()
+		return ticket, nil, nil
+	}
+
+	matches := m.match(requestKey, incomingProfile, now)
+	if matches == nil {
+		m.values[requestKey] = incomingProfile
+		m.Unlock()
+		return ticket, nil, nil
+	}
+	m.Unlock()
+
+	return ticket, matches, m.calculateAcceptedProperties(matches)
+}
+
+// Backfill registers open places in a running match, replacing any the match had registered before, and fills
+// them from waiting tickets straight away where possible. Open slots of 0 removes the match's backfill.
+func (m *MatchmakerService) Backfill(matchID uuid.UUID, backfill *MatchmakerBackfill) {
+	now := time.Now().UTC()
+	if backfill.CreatedAt.IsZero() {
+		backfill.CreatedAt = now
+	}
+	assigned := make(map[MatchmakerKey]*MatchmakerProfile)
+
+	m.Lock()
+	delete(m.backfills, matchID)
+	if backfill.OpenSlots > 0 {
+		m.backfills[matchID] = backfill
+
+		// Tickets that have waited longest get the first pick of places.
+		keys := make([]MatchmakerKey, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return m.values[keys[i]].CreatedAt.Before(m.values[keys[j]].CreatedAt)
+		})
+
+		for _, key := range keys {
+			if backfill.OpenSlots == 0 {
+				break
+			}
+			profile := m.values[key]
+			if m.checkBackfill(backfill, key, profile, now) {
+				m.fillBackfill(matchID, backfill, key, profile)
+				assigned[key] = profile
+			}
+		}
+	}
+	backfillListeners := m.backfillListeners
+	m.Unlock()
+
+	for key, profile := range assigned {
+		for _, f := range backfillListeners {
+			f(matchID, key, profile)
+		}
+	}
+}
+
+// Sweep removes tickets that have timed out, assigns waiting tickets to running matches with open places, then
+// matches waiting tickets again whose expanding range filters may have widened enough to find a match since they
+// were added. Timed out tickets, backfilled tickets and matches found are passed to the respective listeners.
+func (m *MatchmakerService) Sweep() {
+	now := time.Now().UTC()
+	expired := make(map[MatchmakerKey]*MatchmakerProfile)
+	found := make([]map[MatchmakerKey]*MatchmakerProfile, 0)
+
+	backfilled := make(map[MatchmakerKey]*MatchmakerProfile)
+	backfilledMatchIDs := make(map[MatchmakerKey]uuid.UUID)
+
+	m.Lock()
+	keys := make([]MatchmakerKey, 0)
+	for key, profile := range m.values {
+		if profile.Timeout > 0 && now.Sub(profile.CreatedAt) >= profile.Timeout {
+			expired[key] = profile
+			delete(m.values, key)
+		} else if profile.expanding() || len(m.backfills) != 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	// Tickets that have waited longest get the first pick of candidates.
+	sort.Slice(keys, func(i, j int) bool {
+		return m.values[keys[i]].CreatedAt.Before(m.values[keys[j]].CreatedAt)
+	})
+
+	for _, key := range keys {
+		profile, ok := m.values[key]
+		if !ok {
+			// Already matched with an earlier ticket in this sweep.
+			continue
+		}
+		// Running matches with open places are filled before new matches are made.
+		delete(m.values, key)
+		if matchID, ok := m.assignBackfill(key, profile, now); ok {
+			backfilled[key] = profile
+			backfilledMatchIDs[key] = matchID
+			continue
+		}
+		m.values[key] = profile
+		if !profile.expanding() {
+			continue
+		}
+		if matches := m.match(key, profile, now); matches != nil {
+			found = append(found, matches)
+		}
+	}
+	matchListeners := m.matchListeners
+	timeoutListeners := m.timeoutListeners
+	backfillListeners := m.backfillListeners
+	m.Unlock()
+
+	for key, profile := range expired {
+		for _, f := range timeoutListeners {
+			f(key, profile)
+		}
+	}
+	for key, profile := range backfilled {
+		for _, f := range backfillListeners {
+			f(backfilledMatchIDs[key], key, profile)
+		}
+	}
+	for _, matches := range found {
+		props := m.calculateAcceptedProperties(matches)
+		for _, f := range matchListeners {
+			f(matches, props)
+		}
+	}
+}
+
+// assignBackfill looks for a running match with open places the profile fits into, oldest backfill first. If found
+// the places are taken and the match ID is returned. The profile must not be in the queue.
+func (m *MatchmakerService) assignBackfill(key MatchmakerKey, profile *MatchmakerProfile, now time.Time) (uuid.UUID, bool) {
+	if len(m.backfills) == 0 {
+		return uuid.Nil, false
+	}
+
+	matchIDs := make([]uuid.UUID, 0, len(m.backfills))
+	for matchID, backfill := range m.backfills {
+		if m.checkBackfill(backfill, key, profile, now) {
+			matchIDs = append(matchIDs, matchID)
+		}
+	}
+	if len(matchIDs) == 0 {
+		return uuid.Nil, false
+	}
+
+	sort.Slice(matchIDs, func(i, j int) bool {
+		return m.backfills[matchIDs[i]].CreatedAt.Before(m.backfills[matchIDs[j]].CreatedAt)
+	})
+	m.fillBackfill(matchIDs[0], m.backfills[matchIDs[0]], key, profile)
+	return matchIDs[0], true
+}
+
+// checkBackfill reports whether the profile fits into the backfill's open places and both accept each other.
+func (m *MatchmakerService) checkBackfill(backfill *MatchmakerBackfill, key MatchmakerKey, profile *MatchmakerProfile, now time.Time) bool {
+	if key.ID.SessionID == backfill.SessionID || profile.seats() > backfill.OpenSlots {
+		return false
+	}
+	backfillProfile := backfill.profile()
+	return m.checkFilter(backfillProfile, profile, now) && m.checkFilter(profile, backfillProfile, now)
+}
+
+// fillBackfill takes places in the backfill for the profile, removing its ticket from the queue if waiting, and
+// the backfill once it has no open places left.
+func (m *MatchmakerService) fillBackfill(matchID uuid.UUID, backfill *MatchmakerBackfill, key MatchmakerKey, profile *MatchmakerProfile) {
+	backfill.OpenSlots -= profile.seats()
+	if backfill.OpenSlots <= 0 {
+		delete(m.backfills, matchID)
+	}
+	delete(m.values, key)
+}
+
+// HandleDiff removes backfills registered by sessions that have since left the match.
+func (m *MatchmakerService) HandleDiff(joins, leaves []Presence) {
+	m.Lock()
+	for _, presence := range leaves {
+		splitTopic := strings.SplitN(presence.Topic, ":", 2)
+		if splitTopic[0] != "match" || len(splitTopic) != 2 {
+			continue
+		}
+		matchID, err := uuid.FromString(splitTopic[1])
+		if err != nil {
+			continue
+		}
+		if backfill, ok := m.backfills[matchID]; ok && backfill.SessionID == presence.ID.SessionID {
+			delete(m.backfills, matchID)
+		}
+	}
+	m.Unlock()
+}
+
+// Status reports the progress of a waiting ticket.
+func (m *MatchmakerService) Status(sessionID uuid.UUID, userID uuid.UUID, ticket uuid.UUID) (*MatchmakerStatus, error) {
+	mk := MatchmakerKey{ID: PresenceID{SessionID: sessionID, Node: m.name}, UserID: userID, Ticket: ticket}
+	now := time.Now().UTC()
+
 	m.Lock()
 	defer m.Unlock()
 
+	profile, ok := m.values[mk]
+	if !ok {
+		return nil, errors.New("ticket not found")
+	}
+
+	status := &MatchmakerStatus{
+		Position:      1,
+		Elapsed:       now.Sub(profile.CreatedAt),
+		EstimatedWait: m.waitAverage,
+	}
+	for _, other := range m.values {
+		if other.RequiredCount != profile.RequiredCount {
+			continue
+		}
+		status.Waiting++
+		if other.CreatedAt.Before(profile.CreatedAt) {
+			status.Position++
+		}
+	}
+	return status, nil
+}
+
+// CountBySession returns the number of tickets the session has waiting.
+func (m *MatchmakerService) CountBySession(sessionID uuid.UUID) int {
+	id := PresenceID{SessionID: sessionID, Node: m.name}
+	count := 0
+	m.Lock()
+	for key := range m.values {
+		if key.ID == id {
+			count++
+		}
+	}
+	m.Unlock()
+	return count
+}
+
+// Count returns the number of tickets waiting on this node.
+func (m *MatchmakerService) Count() int {
+	m.Lock()
+	count := len(m.values)
+	m.Unlock()
+	return count
+}
+
+// match looks for enough compatible queued profiles to complete a match with the request. If found the
+// matched profiles are removed from the queue and returned along with the request, otherwise nil.
+func (m *MatchmakerService) match(requestKey MatchmakerKey, incomingProfile *MatchmakerProfile, now time.Time) map[MatchmakerKey]*MatchmakerProfile {
+	requiredSeats := incomingProfile.RequiredCount - incomingProfile.seats()
+	if requiredSeats < 0 {
+		return nil
+	}
+	candidates := make(map[MatchmakerKey]*MatchmakerProfile, requiredSeats)
+
 	// find list of suitable candidates
 	for key, profile := range m.values {
 		// if queued users match the current user, then skip
-		if key.ID.SessionID == sessionID || key.UserID == userID {
+		if key.ID.SessionID == requestKey.ID.SessionID || key.UserID == requestKey.UserID {
+			continue
+		}
+
+		// parties are matched whole, so skip any that could not fit
+		if profile.seats() > requiredSeats {
 			continue
 		}
 
 		// compatible with the request's filter
-		if !m.checkFilter(incomingProfile, profile) {
+		if !m.checkFilter(incomingProfile, profile, now) {
 			continue
 		}
 
 		// compatible with the profile's filter
-		if !m.checkFilter(profile, incomingProfile) {
+		if !m.checkFilter(profile, incomingProfile, now) {
+			continue
+		}
+
+		// shares a region with acceptable latency
+		if _, ok := MatchmakerRegion([]*MatchmakerProfile{incomingProfile, profile}); !ok {
 			continue
 		}
 
@@ -128,52 +582,79 @@ func (m *MatchmakerService) Add(sessionID uuid.UUID, userID uuid.UUID, incomingP
 
 	// cross match all previously selected profiles
 	// to see if they are compatible with each other as well
-	matches := m.crossmatchCandidates(candidates, incomingProfile.RequiredCount-1)
+	matches := m.crossmatchCandidates(candidates, requiredSeats, now, []*MatchmakerProfile{incomingProfile})
 
 	// not enough profiles, bail out early
-	if len(matches) < int(incomingProfile.RequiredCount-1) {
-		m.values[requestKey] = incomingProfile
-		return ticket, nil, nil
+	if matches == nil {
+		return nil
 	}
 
 	// remove the matched profiles from the queue
 	for mk, _ := range matches {
 		delete(m.values, mk)
 	}
+	delete(m.values, requestKey)
 
 	// add the incoming profile to the final list
 	matches[requestKey] = incomingProfile
 
-	return ticket, matches, m.calculateAcceptedProperties(matches)
+	// keep a running average of how long matched tickets waited, for wait estimates
+	for _, profile := range matches {
+		wait := now.Sub(profile.CreatedAt)
+		if m.waitAverage == 0 {
+			m.waitAverage = wait
+		} else {
+			m.waitAverage += time.Duration(float64(wait-m.waitAverage) * matchmakerWaitAverageWeight)
+		}
+	}
+
+	return matches
 }
 
-func (m *MatchmakerService) crossmatchCandidates(candidates map[MatchmakerKey]*MatchmakerProfile, requiredCount int) map[MatchmakerKey]*MatchmakerProfile {
-	if requiredCount == 0 {
+// crossmatchCandidates looks for a set of mutually compatible candidates taking up exactly the required number of
+// seats, who together with the profiles already chosen share a region with acceptable latency.
+func (m *MatchmakerService) crossmatchCandidates(candidates map[MatchmakerKey]*MatchmakerProfile, requiredSeats int, now time.Time, chosen []*MatchmakerProfile) map[MatchmakerKey]*MatchmakerProfile {
+	if requiredSeats == 0 {
+		if _, ok := MatchmakerRegion(chosen); !ok {
+			return nil
+		}
+		if chosen[0].TeamCount > 1 && matchmakerTeams(chosen) == nil {
+			return nil
+		}
 		return map[MatchmakerKey]*MatchmakerProfile{}
 	}
 
-	if requiredCount > len(candidates) {
-		return nil
-	}
-
 	keys := make([]MatchmakerKey, 0)
 	values := make([]*MatchmakerProfile, 0)
+	availableSeats := 0
 	for key, value := range candidates {
 		keys = append(keys, key)
 		values = append(values, value)
+		availableSeats += value.seats()
+	}
+
+	if requiredSeats > availableSeats {
+		return nil
 	}
 
+	// Try candidates with the lowest latency first, so groups tend towards the lowest worst round trip.
+	sort.Sort(&matchmakerCandidatesByRtt{keys, values})
+
 	for i := 0; i < len(keys); i++ {
 		s := values[i]
+		if s.seats() > requiredSeats {
+			continue
+		}
+
 		tempCandidates := make(map[MatchmakerKey]*MatchmakerProfile, 0)
 		for j := i + 1; j < len(keys); j++ {
 			p := values[j]
-			if m.checkFilter(s, p) && m.checkFilter(p, s) {
+			if m.checkFilter(s, p, now) && m.checkFilter(p, s, now) {
 				tempCandidates[keys[j]] = p
 			}
 		}
 
-		findCandidateResult := m.crossmatchCandidates(tempCandidates, requiredCount-1)
+		findCandidateResult := m.crossmatchCandidates(tempCandidates, requiredSeats-s.seats(), now, append(chosen[:len(chosen):len(chosen)], s))
 		if findCandidateResult != nil {
 			findCandidateResult[keys[i]] = s
 			return findCandidateResult
@@ -182,10 +663,205 @@ func (m *MatchmakerService) crossmatchCandidates(candidates map[MatchmakerKey]*M
 	return nil
 }
 
-func (m *MatchmakerService) checkFilter(requestProfile, queuedProfile *MatchmakerProfile) bool {
+type matchmakerCandidatesByRtt struct {
+	keys   []MatchmakerKey
+	values []*MatchmakerProfile
+}
+
+func (c *matchmakerCandidatesByRtt) Len() int {
+	return len(c.keys)
+}
+
+func (c *matchmakerCandidatesByRtt) Less(i, j int) bool {
+	return c.values[i].bestRtt() < c.values[j].bestRtt()
+}
+
+func (c *matchmakerCandidatesByRtt) Swap(i, j int) {
+	c.keys[i], c.keys[j] = c.keys[j], c.keys[i]
+	c.values[i], c.values[j] = c.values[j], c.values[i]
+}
+
+// MatchmakerRegion picks the region with the lowest worst round trip time among the regions every profile with
+// latencies reported, skipping regions where the spread of round trips is larger than any profile accepts. Profiles
+// without latencies fit any region. Returns "" if no profile has latencies, and false if there is no suitable region.
+func MatchmakerRegion(profiles []*MatchmakerProfile) (string, bool) {
+	var regions map[string]int64
+	for _, profile := range profiles {
+		if len(profile.Latencies) == 0 {
+			continue
+		}
+		if regions == nil {
+			regions = make(map[string]int64, len(profile.Latencies))
+			for region := range profile.Latencies {
+				regions[region] = 0
+			}
+		}
+		for region := range regions {
+			if _, ok := profile.Latencies[region]; !ok {
+				delete(regions, region)
+			}
+		}
+	}
+	if regions == nil {
+		return "", true
+	}
+
+	bestRegion := ""
+	var bestWorst int64
+	for region := range regions {
+		var lowest, highest int64 = -1, 0
+		var maxSpread int64
+		for _, profile := range profiles {
+			rtt, ok := profile.Latencies[region]
+			if !ok {
+				continue
+			}
+			if lowest == -1 || rtt < lowest {
+				lowest = rtt
+			}
+			if rtt > highest {
+				highest = rtt
+			}
+			if profile.MaxRttSpread > 0 && (maxSpread == 0 || profile.MaxRttSpread < maxSpread) {
+				maxSpread = profile.MaxRttSpread
+			}
+		}
+		if maxSpread > 0 && highest-lowest > maxSpread {
+			continue
+		}
+		// Ties go to the region that sorts first, so the choice is the same each time.
+		if bestRegion == "" || highest < bestWorst || (highest == bestWorst && region < bestRegion) {
+			bestRegion = region
+			bestWorst = highest
+		}
+	}
+
+	return bestRegion, bestRegion != ""
+}
+
+// MatchmakerTeams splits matched tickets into the teams they asked for, balancing the team property. Returns nil if
+// the tickets did not ask for teams, or parties can't be split into teams of equal size.
+func MatchmakerTeams(selected map[MatchmakerKey]*MatchmakerProfile) [][]MatchmakerKey {
+	keys := make([]MatchmakerKey, 0, len(selected))
+	profiles := make([]*MatchmakerProfile, 0, len(selected))
+	for key, profile := range selected {
+		keys = append(keys, key)
+		profiles = append(profiles, profile)
+	}
+	if len(profiles) == 0 || profiles[0].TeamCount < 2 {
+		return nil
+	}
+
+	teams := matchmakerTeams(profiles)
+	if teams == nil {
+		return nil
+	}
+	keyTeams := make([][]MatchmakerKey, len(teams))
+	for t, team := range teams {
+		keyTeams[t] = make([]MatchmakerKey, 0, len(team))
+		for _, i := range team {
+			keyTeams[t] = append(keyTeams[t], keys[i])
+		}
+	}
+	return keyTeams
+}
+
+// MatchmakerTeamTotal is the team property summed over each seat the profile takes up.
+func MatchmakerTeamTotal(profile *MatchmakerProfile) int64 {
+	value, _ := profile.Properties[profile.TeamProperty].(int64)
+	return value * int64(profile.seats())
+}
+
+// matchmakerTeams splits profiles into teams of equal size, returning the profiles' indexes in each team. Profiles are
+// placed largest party and highest total first, each in the team with room that has the lowest total so far, then
+// profiles with the same number of seats are swapped between teams while that narrows the gap. Returns nil if the
+// parties don't fit.
+func matchmakerTeams(profiles []*MatchmakerProfile) [][]int {
+	teamCount := profiles[0].TeamCount
+	seats := 0
+	for _, profile := range profiles {
+		seats += profile.seats()
+	}
+	if seats%teamCount != 0 {
+		return nil
+	}
+	capacity := seats / teamCount
+
+	order := make([]int, len(profiles))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		pa, pb := profiles[order[a]], profiles[order[b]]
+		if pa.seats() != pb.seats() {
+			return pa.seats() > pb.seats()
+		}
+		return MatchmakerTeamTotal(pa) > MatchmakerTeamTotal(pb)
+	})
+
+	teams := make([][]int, teamCount)
+	totals := make([]int64, teamCount)
+	used := make([]int, teamCount)
+	for _, i := range order {
+		best := -1
+		for t := range teams {
+			if used[t]+profiles[i].seats() > capacity {
+				continue
+			}
+			if best == -1 || totals[t] < totals[best] || (totals[t] == totals[best] && used[t] < used[best]) {
+				best = t
+			}
+		}
+		if best == -1 {
+			return nil
+		}
+		teams[best] = append(teams[best], i)
+		totals[best] += MatchmakerTeamTotal(profiles[i])
+		used[best] += profiles[i].seats()
+	}
+
+	for improved := true; improved; {
+		improved = false
+		for a := 0; a < teamCount; a++ {
+			for b := a + 1; b < teamCount; b++ {
+				for x, i := range teams[a] {
+					for y, j := range teams[b] {
+						if profiles[i].seats() != profiles[j].seats() {
+							continue
+						}
+						gap := totals[a] - totals[b]
+						shift := MatchmakerTeamTotal(profiles[i]) - MatchmakerTeamTotal(profiles[j])
+						if abs64(gap-2*shift) >= abs64(gap) {
+							continue
+						}
+						teams[a][x], teams[b][y] = j, i
+						totals[a] -= shift
+						totals[b] += shift
+						i = j
+						improved = true
+					}
+				}
+			}
+		}
+	}
+
+	return teams
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (m *MatchmakerService) checkFilter(requestProfile, queuedProfile *MatchmakerProfile, now time.Time) bool {
 	if queuedProfile.RequiredCount != requestProfile.RequiredCount {
 		return false
 	}
+	if queuedProfile.TeamCount != requestProfile.TeamCount || queuedProfile.TeamProperty != requestProfile.TeamProperty {
+		return false
+	}
 
 	for filterName, filter := range requestProfile.Filters {
 		propertyValue := queuedProfile.Properties[filterName]
@@ -215,6 +891,14 @@ func (m *MatchmakerService) checkFilter(requestProfile, queuedProfile *Matchmake
 			if !ok || propertyInt < rangeFilter.LowerBound || propertyInt > rangeFilter.UpperBound {
 				return false
 			}
+		} else if filter.Type() == EXPANDING_RANGE {
+			rangeFilter := filter.(*MatchmakerExpandingRangeFilter)
+			propertyInt, ok := propertyValue.(int64)
+			lowerBound, upperBound := rangeFilter.Bounds(now.Sub(requestProfile.CreatedAt))
+
+			if !ok || propertyInt < lowerBound || propertyInt > upperBound {
+				return false
+			}
 		} else if filter.Type() == BOOL {
 			boolFilter := filter.(*MatchmakerBoolFilter)
 			propertyBool, ok := propertyValue.(bool)
@@ -224,6 +908,10 @@ func (m *MatchmakerService) checkFilter(requestProfile, queuedProfile *Matchmake
 		}
 	}
 
+	if requestProfile.Query != nil && !requestProfile.Query.Match(queuedProfile.Properties) {
+		return false
+	}
+
 	return true
 }
 
@@ -234,6 +922,7 @@ func (m *MatchmakerService) calculateAcceptedProperties(matched map[MatchmakerKe
 			UserID:     key.UserID,
 			Properties: profile.Properties,
 			Filters:    profile.Filters,
+			Query:      profile.Query,
 		}
 		props = append(props, prop)
 	}
@@ -277,6 +966,11 @@ func (m *MatchmakerService) RemoveAll(sessionID uuid.UUID) {
 			delete(m.values, mk)
 		}
 	}
+	for matchID, backfill := range m.backfills {
+		if backfill.SessionID == sessionID {
+			delete(m.backfills, matchID)
+		}
+	}
 	m.Unlock()
 }
 
@@ -0,0 +1,79 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// MatchmakerNotifier delivers matches the matchmaker finds outside of a matchmake add request, ticket timeouts, and
+// tickets assigned to running matches.
+type MatchmakerNotifier struct {
+	logger         *zap.Logger
+	hmacSecretByte []byte
+	tracker        Tracker
+	messageRouter  MessageRouter
+	allocator      *MatchAllocator
+}
+
+// NewMatchmakerNotifier creates a new MatchmakerNotifier
+func NewMatchmakerNotifier(logger *zap.Logger, config Config, tracker Tracker, messageRouter MessageRouter, allocator *MatchAllocator) *MatchmakerNotifier {
+	return &MatchmakerNotifier{
+		logger:         logger,
+		hmacSecretByte: []byte(config.GetSession().EncryptionKey),
+		tracker:        tracker,
+		messageRouter:  messageRouter,
+		allocator:      allocator,
+	}
+}
+
+// HandleMatched notifies each matched user of the match.
+func (mn *MatchmakerNotifier) HandleMatched(selected map[MatchmakerKey]*MatchmakerProfile, props []*MatchmakerAcceptedProperty) {
+	mn.logger.Debug("Processing matchmaker match", zap.Int("count", len(selected)))
+	// Dedicated server allocation may take a while, don't hold up the matchmaker.
+	go matchmakeMatched(mn.logger, mn.hmacSecretByte, mn.messageRouter, mn.allocator, uuid.NewV4(), matchmakeRegion(selected), selected, props)
+}
+
+// HandleBackfill gives the ticket's user, and any party members sharing the ticket, a token to join the running
+// match they were assigned to, and tells the users already in the match who is coming.
+func (mn *MatchmakerNotifier) HandleBackfill(matchID uuid.UUID, key MatchmakerKey, profile *MatchmakerProfile) {
+	mn.logger.Debug("Processing matchmaker backfill", zap.String("match_id", matchID.String()), zap.String("ticket", key.Ticket.String()))
+	selected := map[MatchmakerKey]*MatchmakerProfile{key: profile}
+	props := []*MatchmakerAcceptedProperty{&MatchmakerAcceptedProperty{
+		UserID:     key.UserID,
+		Properties: profile.Properties,
+		Filters:    profile.Filters,
+		Query:      profile.Query,
+	}}
+	// The match is already running, so its region and any dedicated server were chosen when it was created.
+	matchmakeMatched(mn.logger, mn.hmacSecretByte, mn.messageRouter, nil, matchID, "", selected, props)
+
+	ps := matchmakeProfilePresences(key, profile)
+	to := mn.tracker.ListByTopic("match:" + matchID.String())
+	mn.messageRouter.Send(mn.logger, to, &Envelope{Payload: &Envelope_MatchBackfill{MatchBackfill: &MatchBackfill{
+		MatchId:   matchID.Bytes(),
+		Presences: ps,
+	}}})
+}
+
+// HandleTimeout tells the ticket's user, and any party members sharing the ticket, that the search timed out.
+func (mn *MatchmakerNotifier) HandleTimeout(key MatchmakerKey, profile *MatchmakerProfile) {
+	mn.logger.Debug("Processing matchmaker timeout", zap.String("ticket", key.Ticket.String()))
+	to := append([]Presence{Presence{ID: key.ID, UserID: key.UserID, Meta: profile.Meta}}, profile.Members...)
+	mn.messageRouter.Send(mn.logger, to, &Envelope{Payload: &Envelope_MatchmakeTimeout{MatchmakeTimeout: &MatchmakeTimeout{
+		Ticket: key.Ticket.Bytes(),
+	}}})
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Longest matchmaker query accepted, in bytes.
+const matchmakerQueryMaxLength = 1024
+
+// MatchmakerQuery is a parsed matchmaker query, matched against the properties of other tickets. A query is a list
+// of whitespace separated clauses which must all match:
+//
+//	region:eu            a string set property containing "eu", or a bool or integer property equal to the value
+//	mode:ranked|casual   any one of several values
+//	rank:>=10 rank:<20   integer property comparisons, using >, >=, < or <=
+//	rank:10..20          an inclusive integer range
+//	-mode:practice       a clause prefixed with - must not match
+//
+// A clause never matches a missing property, so a negated clause always does.
+type MatchmakerQuery struct {
+	Query   string
+	clauses []*matchmakerQueryClause
+}
+
+type matchmakerQueryClause struct {
+	field  string
+	negate bool
+	// Any of the terms must match, unless the clause is a comparison.
+	terms   []string
+	compare func(int64) bool
+}
+
+// ParseMatchmakerQuery parses a matchmaker query, returning nil for an empty query.
+func ParseMatchmakerQuery(query string) (*MatchmakerQuery, error) {
+	if len(query) > matchmakerQueryMaxLength {
+		return nil, fmt.Errorf("Query must be at most %v bytes", matchmakerQueryMaxLength)
+	}
+
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	q := &MatchmakerQuery{Query: query, clauses: make([]*matchmakerQueryClause, 0, len(fields))}
+	for _, field := range fields {
+		clause, err := parseMatchmakerQueryClause(field)
+		if err != nil {
+			return nil, err
+		}
+		q.clauses = append(q.clauses, clause)
+	}
+	return q, nil
+}
+
+func parseMatchmakerQueryClause(s string) (*matchmakerQueryClause, error) {
+	clause := &matchmakerQueryClause{}
+	if strings.HasPrefix(s, "-") {
+		clause.negate = true
+		s = s[1:]
+	}
+
+	split := strings.SplitN(s, ":", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return nil, fmt.Errorf("Query clause '%v' must be in the form field:value", s)
+	}
+	clause.field = split[0]
+	value := split[1]
+
+	var err error
+	switch {
+	case strings.HasPrefix(value, ">="):
+		clause.compare, err = matchmakerQueryCompare(value[2:], func(v, n int64) bool { return v >= n })
+	case strings.HasPrefix(value, ">"):
+		clause.compare, err = matchmakerQueryCompare(value[1:], func(v, n int64) bool { return v > n })
+	case strings.HasPrefix(value, "<="):
+		clause.compare, err = matchmakerQueryCompare(value[2:], func(v, n int64) bool { return v <= n })
+	case strings.HasPrefix(value, "<"):
+		clause.compare, err = matchmakerQueryCompare(value[1:], func(v, n int64) bool { return v < n })
+	case strings.Contains(value, ".."):
+		bounds := strings.SplitN(value, "..", 2)
+		lower, lowerErr := strconv.ParseInt(bounds[0], 10, 64)
+		upper, upperErr := strconv.ParseInt(bounds[1], 10, 64)
+		if lowerErr != nil || upperErr != nil {
+			return nil, fmt.Errorf("Query range '%v' must be two integers", value)
+		}
+		if lower > upper {
+			return nil, fmt.Errorf("Query range '%v' must not have a lower bound above its upper bound", value)
+		}
+		clause.compare = func(v int64) bool { return v >= lower && v <= upper }
+	default:
+		clause.terms = strings.Split(value, "|")
+		for _, term := range clause.terms {
+			if term == "" {
+				return nil, fmt.Errorf("Query clause '%v' must not have empty values", s)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+func matchmakerQueryCompare(value string, compare func(v, n int64) bool) (func(int64) bool, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.New("Query comparisons must be against an integer")
+	}
+	if n == math.MinInt64 || n == math.MaxInt64 {
+		return nil, errors.New("Query comparison value out of range")
+	}
+	return func(v int64) bool { return compare(v, n) }, nil
+}
+
+// Match reports whether the properties satisfy every clause of the query.
+func (q *MatchmakerQuery) Match(properties map[string]interface{}) bool {
+	for _, clause := range q.clauses {
+		if clause.match(properties[clause.field]) == clause.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *matchmakerQueryClause) match(property interface{}) bool {
+	switch v := property.(type) {
+	case int64:
+		if c.compare != nil {
+			return c.compare(v)
+		}
+		return c.anyTerm(strconv.FormatInt(v, 10))
+	case bool:
+		return c.compare == nil && c.anyTerm(strconv.FormatBool(v))
+	case []string:
+		if c.compare != nil {
+			return false
+		}
+		for _, value := range v {
+			if c.anyTerm(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *matchmakerQueryClause) anyTerm(value string) bool {
+	for _, term := range c.terms {
+		if term == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	messageBusNATS  = "nats"
+	messageBusRedis = "redis"
+
+	messageBusDialTimeout = 5 * time.Second
+	// Wait between attempts to reconnect to the broker after losing the connection.
+	messageBusReconnectInterval = time.Second
+)
+
+// MessageBus carries messages between nodes through an external broker. Messages published to a subject are
+// delivered to every subscriber of that subject, in the order they were published by each node. Delivery is best
+// effort, messages published while a subscriber is disconnected may be lost.
+type MessageBus interface {
+	Publish(subject string, data []byte) error
+	// Subscribe calls the handler for every message published to the subject from now on. Handlers are called one
+	// message at a time.
+	Subscribe(subject string, handler func(data []byte)) error
+	Close()
+}
+
+// NewMessageBus connects to the broker selected in the config.
+func NewMessageBus(logger *zap.Logger, config *MessageBusConfig) (MessageBus, error) {
+	switch config.Backend {
+	case messageBusNATS:
+		return newNATSBus(logger, config)
+	case messageBusRedis:
+		return newRedisBus(logger, config)
+	default:
+		return nil, fmt.Errorf("unknown message bus backend %v", config.Backend)
+	}
+}
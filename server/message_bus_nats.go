@@ -0,0 +1,254 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// natsBus publishes and subscribes through a NATS server, speaking its text protocol over a single connection. It
+// reconnects and subscribes again when the connection is lost.
+type natsBus struct {
+	sync.Mutex
+	logger     *zap.Logger
+	config     *MessageBusConfig
+	conn       net.Conn
+	writer     *bufio.Writer
+	maxPayload int
+	handlers   map[string]func([]byte) // By subscription ID.
+	subjects   map[string]string       // By subscription ID.
+	nextSID    int
+	closed     bool
+}
+
+func newNATSBus(logger *zap.Logger, config *MessageBusConfig) (*natsBus, error) {
+	b := &natsBus{
+		logger:   logger,
+		config:   config,
+		handlers: make(map[string]func([]byte)),
+		subjects: make(map[string]string),
+	}
+	b.Lock()
+	defer b.Unlock()
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect must be called with the lock held.
+func (b *natsBus) connect() error {
+	conn, err := net.DialTimeout("tcp", b.config.Address, messageBusDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(messageBusDialTimeout))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	line, err := natsReadLine(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	b.maxPayload = natsMaxPayload(line)
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "nakama"}
+	if b.config.Password != "" {
+		connect["auth_token"] = b.config.Password
+	}
+	options, _ := json.Marshal(connect)
+	fmt.Fprintf(writer, "CONNECT %s\r\nPING\r\n", options)
+	for sid, subject := range b.subjects {
+		fmt.Fprintf(writer, "SUB %s %s\r\n", subject, sid)
+	}
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		if line, err = natsReadLine(reader); err != nil {
+			conn.Close()
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("nats: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.conn = conn
+	b.writer = writer
+	go b.read(conn, reader)
+	return nil
+}
+
+func (b *natsBus) subject(subject string) string {
+	return b.config.Prefix + "." + subject
+}
+
+func (b *natsBus) Publish(subject string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.conn == nil {
+		return errors.New("nats: not connected")
+	}
+	if b.maxPayload > 0 && len(data) > b.maxPayload {
+		return fmt.Errorf("nats: message of %v bytes is over the server maximum of %v", len(data), b.maxPayload)
+	}
+	fmt.Fprintf(b.writer, "PUB %s %d\r\n", b.subject(subject), len(data))
+	b.writer.Write(data)
+	b.writer.WriteString("\r\n")
+	return b.writer.Flush()
+}
+
+func (b *natsBus) Subscribe(subject string, handler func(data []byte)) error {
+	b.Lock()
+	defer b.Unlock()
+	b.nextSID++
+	sid := strconv.Itoa(b.nextSID)
+	b.handlers[sid] = handler
+	b.subjects[sid] = b.subject(subject)
+	if b.conn == nil {
+		// Subscribed on reconnect.
+		return nil
+	}
+	fmt.Fprintf(b.writer, "SUB %s %s\r\n", b.subjects[sid], sid)
+	return b.writer.Flush()
+}
+
+func (b *natsBus) Close() {
+	b.Lock()
+	b.closed = true
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	b.Unlock()
+}
+
+func (b *natsBus) read(conn net.Conn, reader *bufio.Reader) {
+	err := b.readMessages(conn, reader)
+
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.logger.Warn("Lost connection to NATS, reconnecting", zap.Error(err))
+	conn.Close()
+	b.conn = nil
+	go b.reconnect()
+}
+
+func (b *natsBus) readMessages(conn net.Conn, reader *bufio.Reader) error {
+	for {
+		line, err := natsReadLine(reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return fmt.Errorf("nats: bad message %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("nats: bad message %q", line)
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return err
+			}
+			b.Lock()
+			handler := b.handlers[fields[2]]
+			b.Unlock()
+			if handler != nil {
+				handler(data[:size])
+			}
+		case line == "PING":
+			b.Lock()
+			b.writer.WriteString("PONG\r\n")
+			err := b.writer.Flush()
+			b.Unlock()
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			b.logger.Warn("NATS error", zap.String("error", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		case strings.HasPrefix(line, "INFO "):
+			if maxPayload := natsMaxPayload(line); maxPayload > 0 {
+				b.Lock()
+				b.maxPayload = maxPayload
+				b.Unlock()
+			}
+		}
+	}
+}
+
+func (b *natsBus) reconnect() {
+	for {
+		time.Sleep(messageBusReconnectInterval)
+		b.Lock()
+		if b.closed {
+			b.Unlock()
+			return
+		}
+		err := b.connect()
+		b.Unlock()
+		if err == nil {
+			b.logger.Info("Reconnected to NATS")
+			return
+		}
+		b.logger.Debug("Could not reconnect to NATS", zap.Error(err))
+	}
+}
+
+func natsReadLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func natsMaxPayload(info string) int {
+	var options struct {
+		MaxPayload int `json:"max_payload"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(info, "INFO ")), &options)
+	return options.MaxPayload
+}
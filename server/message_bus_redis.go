@@ -0,0 +1,295 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// How long each read of a stream blocks waiting for new entries.
+	redisBusBlockMs = 1000
+	// The field of each stream entry holding the message.
+	redisBusField = "d"
+)
+
+// redisBus publishes messages as entries appended to Redis Streams, one stream per subject, trimmed to about the
+// configured length. Each subscription reads its stream on its own connection, starting from the entries added after
+// it subscribed.
+type redisBus struct {
+	sync.Mutex // Guards the publishing connection.
+	logger     *zap.Logger
+	config     *MessageBusConfig
+	conn       *redisConn
+	stopCh     chan struct{}
+	stopOnce   sync.Once
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisBus(logger *zap.Logger, config *MessageBusConfig) (*redisBus, error) {
+	conn, err := dialRedis(config)
+	if err != nil {
+		return nil, err
+	}
+	return &redisBus{
+		logger: logger,
+		config: config,
+		conn:   conn,
+		stopCh: make(chan struct{}),
+	}, nil
+}
+
+func (b *redisBus) key(subject string) string {
+	return b.config.Prefix + "." + subject
+}
+
+func (b *redisBus) Publish(subject string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.conn == nil {
+		conn, err := dialRedis(b.config)
+		if err != nil {
+			return err
+		}
+		b.conn = conn
+	}
+	b.conn.conn.SetDeadline(time.Now().Add(messageBusDialTimeout))
+	_, err := b.conn.do("XADD", b.key(subject), "MAXLEN", "~", strconv.Itoa(b.config.StreamMaxLen), "*", redisBusField, string(data))
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection is in an unknown state, dial again on the next publish.
+		b.conn.close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *redisBus) Subscribe(subject string, handler func(data []byte)) error {
+	conn, err := dialRedis(b.config)
+	if err != nil {
+		return err
+	}
+	key := b.key(subject)
+	// Start after the latest entry, so messages published once this returns are not missed.
+	lastID := "0-0"
+	reply, err := conn.do("XREVRANGE", key, "+", "-", "COUNT", "1")
+	if err != nil {
+		conn.close()
+		return err
+	}
+	if entries, ok := reply.([]interface{}); ok && len(entries) != 0 {
+		if id, _, ok := redisStreamEntry(entries[0]); ok {
+			lastID = id
+		}
+	}
+
+	go b.read(conn, key, lastID, handler)
+	return nil
+}
+
+func (b *redisBus) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
+	b.Lock()
+	if b.conn != nil {
+		b.conn.close()
+		b.conn = nil
+	}
+	b.Unlock()
+}
+
+func (b *redisBus) stopped() bool {
+	select {
+	case <-b.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *redisBus) read(conn *redisConn, key, lastID string, handler func(data []byte)) {
+	for {
+		if b.stopped() {
+			if conn != nil {
+				conn.close()
+			}
+			return
+		}
+		if conn == nil {
+			time.Sleep(messageBusReconnectInterval)
+			var err error
+			if conn, err = dialRedis(b.config); err != nil {
+				b.logger.Debug("Could not reconnect to Redis", zap.Error(err))
+				conn = nil
+				continue
+			}
+			b.logger.Info("Reconnected to Redis", zap.String("stream", key))
+		}
+
+		conn.conn.SetReadDeadline(time.Now().Add(redisBusBlockMs*time.Millisecond + messageBusDialTimeout))
+		reply, err := conn.do("XREAD", "BLOCK", strconv.Itoa(redisBusBlockMs), "STREAMS", key, lastID)
+		if err != nil {
+			if !b.stopped() {
+				b.logger.Warn("Lost connection to Redis, reconnecting", zap.String("stream", key), zap.Error(err))
+			}
+			conn.close()
+			conn = nil
+			continue
+		}
+		// Replies are a list of streams, each a key and its list of entries. Nothing new gives no reply.
+		streams, _ := reply.([]interface{})
+		for _, stream := range streams {
+			parts, ok := stream.([]interface{})
+			if !ok || len(parts) != 2 {
+				continue
+			}
+			entries, _ := parts[1].([]interface{})
+			for _, entry := range entries {
+				id, data, ok := redisStreamEntry(entry)
+				if !ok {
+					continue
+				}
+				lastID = id
+				if data != nil {
+					handler(data)
+				}
+			}
+		}
+	}
+}
+
+// redisStreamEntry returns the ID of a stream entry and its message, if it has one.
+func redisStreamEntry(entry interface{}) (string, []byte, bool) {
+	parts, ok := entry.([]interface{})
+	if !ok || len(parts) != 2 {
+		return "", nil, false
+	}
+	id, ok := parts[0].(string)
+	if !ok {
+		return "", nil, false
+	}
+	fields, _ := parts[1].([]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if field, _ := fields[i].(string); field == redisBusField {
+			if value, ok := fields[i+1].(string); ok {
+				return id, []byte(value), true
+			}
+		}
+	}
+	return id, nil, true
+}
+
+func dialRedis(config *MessageBusConfig) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", config.Address, messageBusDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if config.Password != "" {
+		conn.SetDeadline(time.Now().Add(messageBusDialTimeout))
+		if _, err := c.do("AUTH", config.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return c, nil
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
+
+// do sends a command and reads its reply. Errors returned by Redis are redisError, others are connection errors.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis protocol error")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, errors.New("redis protocol error")
+	}
+}
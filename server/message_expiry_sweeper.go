@@ -0,0 +1,149 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MessageExpirySweeper periodically removes topic messages whose expiry time has passed, along with their reactions,
+// previous versions and pins. Until they are swept, expired messages are already left out of topic history.
+type MessageExpirySweeper struct {
+	logger    *zap.Logger
+	db        *sql.DB
+	batchSize int
+	ticker    *time.Ticker
+	stopCh    chan bool
+}
+
+// NewMessageExpirySweeper creates a new MessageExpirySweeper and starts it.
+func NewMessageExpirySweeper(logger *zap.Logger, db *sql.DB, config *ChatConfig) *MessageExpirySweeper {
+	s := &MessageExpirySweeper{
+		logger:    logger,
+		db:        db,
+		batchSize: config.ExpirySweepBatchSize,
+		ticker:    time.NewTicker(time.Duration(config.ExpirySweepIntervalMs) * time.Millisecond),
+		stopCh:    make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.sweep()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *MessageExpirySweeper) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+// sweep removes expired messages in batches, until a batch comes up short or the sweeper is stopped.
+func (s *MessageExpirySweeper) sweep() {
+	ts := nowMs()
+	total := int64(0)
+	for {
+		count, err := s.sweepBatch(ts)
+		if err != nil {
+			s.logger.Error("Could not remove expired topic messages", zap.Error(err))
+			return
+		}
+		total += count
+		if count < int64(s.batchSize) {
+			break
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+	}
+
+	if total != 0 {
+		s.logger.Debug("Removed expired topic messages", zap.Int64("count", total))
+	}
+}
+
+// sweepBatch removes a batch of expired messages and everything kept about them.
+func (s *MessageExpirySweeper) sweepBatch(ts int64) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+DELETE FROM message
+WHERE (topic, topic_type, message_id) IN (
+  SELECT topic, topic_type, message_id FROM message@message_expires_at_idx
+  WHERE expires_at > 0 AND expires_at <= $1
+  LIMIT $2
+)
+RETURNING topic, topic_type, message_id`, ts, s.batchSize)
+	if err != nil {
+		s.rollback(tx)
+		return 0, err
+	}
+	keys := make([]string, 0, s.batchSize)
+	params := make([]interface{}, 0, s.batchSize*3)
+	for rows.Next() {
+		var topic []byte
+		var topicType int64
+		var messageID []byte
+		if err := rows.Scan(&topic, &topicType, &messageID); err != nil {
+			rows.Close()
+			s.rollback(tx)
+			return 0, err
+		}
+		l := len(params)
+		keys = append(keys, fmt.Sprintf("($%v, $%v, $%v)", l+1, l+2, l+3))
+		params = append(params, topic, topicType, messageID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		s.rollback(tx)
+		return 0, err
+	}
+
+	if len(keys) != 0 {
+		in := strings.Join(keys, ", ")
+		for _, table := range []string{"message_reaction", "message_version", "topic_pin"} {
+			if _, err = tx.Exec("DELETE FROM "+table+" WHERE (topic, topic_type, message_id) IN ("+in+")", params...); err != nil {
+				s.rollback(tx)
+				return 0, err
+			}
+		}
+	}
+
+	return int64(len(keys)), tx.Commit()
+}
+
+func (s *MessageExpirySweeper) rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil {
+		s.logger.Error("Could not remove expired topic messages, rollback error", zap.Error(err))
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/atomic"
+)
+
+// Interval in milliseconds between sweeps for buckets that have filled up again.
+const messageRateLimitPruneMs = 10000
+
+type messageRateLimitKey struct {
+	sessionID   uuid.UUID
+	messageType string
+}
+
+type messageRateLimitBucket struct {
+	tokens    float64
+	updatedAt int64
+	fullAt    int64
+}
+
+// MessageRateLimiter keeps a token bucket for each session and message type with a configured rate limit, so one
+// client flooding the server with chat messages or storage writes can't take up all of the database. gRPC calls each
+// get a new session, so their buckets are kept per user and client IP instead, see messageRateLimitID.
+type MessageRateLimiter struct {
+	sync.Mutex
+	limits   map[string]*MessageRateLimitConfig
+	buckets  map[messageRateLimitKey]*messageRateLimitBucket
+	prunedAt int64
+	rejected *atomic.Int64
+	byType   map[string]int64
+}
+
+// NewMessageRateLimiter creates a new MessageRateLimiter. Limits are keyed by message names as used by runtime hooks.
+func NewMessageRateLimiter(limits map[string]*MessageRateLimitConfig) *MessageRateLimiter {
+	return &MessageRateLimiter{
+		limits:   limits,
+		buckets:  make(map[messageRateLimitKey]*messageRateLimitBucket),
+		rejected: atomic.NewInt64(0),
+		byType:   make(map[string]int64),
+	}
+}
+
+// Allow takes a token from the session's bucket for the message type, reporting whether the message may be processed.
+// Message types without a limit are always allowed.
+func (l *MessageRateLimiter) Allow(sessionID uuid.UUID, messageType string, now int64) bool {
+	limit, ok := l.limits[messageType]
+	if !ok {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune(now)
+	key := messageRateLimitKey{sessionID: sessionID, messageType: messageType}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &messageRateLimitBucket{tokens: float64(limit.Burst), updatedAt: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(now-b.updatedAt)*limit.Rate/1000)
+		b.updatedAt = now
+	}
+
+	if b.tokens < 1 {
+		l.rejected.Inc()
+		l.byType[messageType]++
+		return false
+	}
+	b.tokens--
+	b.fullAt = now + int64(math.Ceil((float64(limit.Burst)-b.tokens)*1000/limit.Rate))
+	return true
+}
+
+// Stats returns the number of messages rejected since the server started, in total and by message type.
+func (l *MessageRateLimiter) Stats() (int64, map[string]int64) {
+	l.Lock()
+	byType := make(map[string]int64, len(l.byType))
+	for messageType, count := range l.byType {
+		byType[messageType] = count
+	}
+	l.Unlock()
+	return l.rejected.Load(), byType
+}
+
+// messageRateLimitID returns the ID the session's buckets are kept under. Sessions for single gRPC calls share buckets
+// with every other call by the same user from the same client IP.
+func messageRateLimitID(session *session) uuid.UUID {
+	if session.call {
+		return uuid.NewV5(session.userID, session.clientIP)
+	}
+	return session.id
+}
+
+// prune drops buckets that have filled up again, as they are no different from new ones. It runs at most once per
+// prune interval.
+func (l *MessageRateLimiter) prune(now int64) {
+	if l.prunedAt+messageRateLimitPruneMs > now {
+		return
+	}
+	l.prunedAt = now
+	for key, b := range l.buckets {
+		if b.fullAt <= now {
+			delete(l.buckets, key)
+		}
+	}
+}
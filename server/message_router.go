@@ -15,22 +15,32 @@
 package server
 
 import (
+	"sync"
+
 	"github.com/gogo/protobuf/proto"
 	"go.uber.org/zap"
 )
 
+// Deliveries to more sessions than this are split across goroutines, so one slow
+// connection only delays the sessions in its own shard.
+const messageRouterShardSize = 256
+
 // MessageRouter is responsible for sending a message to a list of presences
 type MessageRouter interface {
 	Send(*zap.Logger, []Presence, proto.Message)
 }
 
 type messageRouterService struct {
+	name     string
 	registry *SessionRegistry
+	cluster  *ClusterService
 }
 
-func NewMessageRouterService(registry *SessionRegistry) *messageRouterService {
+func NewMessageRouterService(registry *SessionRegistry, cluster *ClusterService) *messageRouterService {
 	return &messageRouterService{
+		name:     registry.config.GetName(),
 		registry: registry,
+		cluster:  cluster,
 	}
 }
 
@@ -39,21 +49,93 @@ func (m *messageRouterService) Send(logger *zap.Logger, ps []Presence, msg proto
 		return
 	}
 
+	// Serialize once and reuse the same payload for every recipient.
 	payload, err := proto.Marshal(msg)
 	if err != nil {
 		logger.Error("Could not marshall message to byte[]", zap.Error(err))
 		return
 	}
 
+	// Batch presences by node. Only sessions on this node can be delivered to directly, others go through the
+	// cluster to the node they are on.
+	local := make([]Presence, 0, len(ps))
+	var remote map[string][]Presence
 	for _, p := range ps {
-		session := m.registry.Get(p.ID.SessionID)
-		if session != nil {
-			err := session.SendBytes(payload)
-			if err != nil {
-				logger.Error("Failed to route to", zap.Any("p", p), zap.Error(err))
+		if p.ID.Node == m.name {
+			local = append(local, p)
+			continue
+		}
+		if remote == nil {
+			remote = make(map[string][]Presence)
+		}
+		remote[p.ID.Node] = append(remote[p.ID.Node], p)
+	}
+	if len(remote) != 0 {
+		_, isEnvelope := msg.(*Envelope)
+		for node, nodePresences := range remote {
+			if !isEnvelope || !m.cluster.Route(node, nodePresences, payload) {
+				logger.Warn("No route to node", zap.String("node", node), zap.Int("count", len(nodePresences)))
+			}
+		}
+	}
+
+	sessions, missing := m.registry.getLocal(local)
+	for _, p := range missing {
+		logger.Warn("No session to route to", zap.Any("p", p))
+	}
+
+	// Sessions using JSON share one JSON payload, only made if there are any.
+	var jsonPayload []byte
+	for _, session := range sessions {
+		if session.format == sessionFormatJSON {
+			if jsonPayload, err = marshalEnvelope(sessionFormatJSON, msg); err != nil {
+				logger.Error("Could not marshall message to JSON", zap.Error(err))
+				return
+			}
+			break
+		}
+	}
+
+	// Match data goes as a datagram to sessions bound to the datagram transport.
+	var matchData *MatchData
+	if envelope, ok := msg.(*Envelope); ok {
+		matchData = envelope.GetMatchData()
+	}
+
+	if len(sessions) <= messageRouterShardSize {
+		m.sendBytes(logger, sessions, payload, jsonPayload, matchData)
+		return
+	}
+
+	// Wait for all shards so messages to the same session stay in order across calls.
+	wg := &sync.WaitGroup{}
+	for start := 0; start < len(sessions); start += messageRouterShardSize {
+		end := start + messageRouterShardSize
+		if end > len(sessions) {
+			end = len(sessions)
+		}
+		wg.Add(1)
+		go func(shard []*session) {
+			m.sendBytes(logger, shard, payload, jsonPayload, matchData)
+			wg.Done()
+		}(sessions[start:end])
+	}
+	wg.Wait()
+}
+
+func (m *messageRouterService) sendBytes(logger *zap.Logger, sessions []*session, payload []byte, jsonPayload []byte, matchData *MatchData) {
+	for _, session := range sessions {
+		p := payload
+		if session.format == sessionFormatJSON {
+			p = jsonPayload
+		}
+		if matchData != nil {
+			if peer := session.datagramPeer(); peer != nil && peer.send(p, matchData.OpCode) {
+				continue
 			}
-		} else {
-			logger.Warn("No session to route to", zap.Any("p", p))
+		}
+		if err := session.sendBytes(p, matchData != nil); err != nil {
+			logger.Error("Failed to route to", zap.String("sid", session.id.String()), zap.Error(err))
 		}
 	}
 }
@@ -0,0 +1,274 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// Label value that counts together values over the cardinality limits.
+const metricsOtherLabel = "other"
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics collects counters, gauges and latency histograms, and serves them in the Prometheus text format. Labels
+// are limited to the configured values, and to a maximum number of values per metric, so a misbehaving client
+// cannot grow the output without bound.
+type Metrics struct {
+	sync.RWMutex
+	config                 *MetricsConfig
+	messages               *metricsFamily
+	dbQueries              *metricsFamily
+	dbErrors               *metricsFamily
+	notificationsSent      *atomic.Int64
+	notificationsDelivered *atomic.Int64
+	registry               *SessionRegistry
+	tracker                Tracker
+	matchmaker             Matchmaker
+	msgLimit               *MessageRateLimiter
+}
+
+// metricsFamily is a counter or, with buckets, a histogram, labelled by a single label.
+type metricsFamily struct {
+	sync.Mutex
+	name      string
+	help      string
+	label     string
+	buckets   []float64 // Upper bounds in seconds, only set for histograms.
+	allowed   map[string]bool
+	maxValues int
+	series    map[string]*metricsSeries
+}
+
+type metricsSeries struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewMetrics creates a new Metrics. Nothing is collected unless metrics are enabled.
+func NewMetrics(config *MetricsConfig) *Metrics {
+	buckets := make([]float64, len(config.LatencyBucketsMs))
+	for i, bucketMs := range config.LatencyBucketsMs {
+		buckets[i] = bucketMs / 1000
+	}
+	var messageTypes map[string]bool
+	if len(config.MessageTypes) != 0 {
+		messageTypes = make(map[string]bool, len(config.MessageTypes))
+		for _, messageType := range config.MessageTypes {
+			messageTypes[messageType] = true
+		}
+	}
+
+	m := &Metrics{
+		config:                 config,
+		notificationsSent:      atomic.NewInt64(0),
+		notificationsDelivered: atomic.NewInt64(0),
+	}
+	m.messages = m.newFamily("message_duration_seconds", "Time taken to process received messages, by message type.", "type", buckets, messageTypes)
+	m.dbQueries = m.newFamily("db_query_duration_seconds", "Time taken by database queries until results start arriving, by statement.", "statement", buckets, nil)
+	m.dbErrors = m.newFamily("db_query_errors_total", "Database queries that failed, by statement.", "statement", nil, nil)
+	return m
+}
+
+func (m *Metrics) newFamily(name, help, label string, buckets []float64, allowed map[string]bool) *metricsFamily {
+	return &metricsFamily{
+		name:      m.config.Namespace + "_" + name,
+		help:      help,
+		label:     label,
+		buckets:   buckets,
+		allowed:   allowed,
+		maxValues: m.config.MaxLabelValues,
+		series:    make(map[string]*metricsSeries),
+	}
+}
+
+// Enabled reports whether metrics are collected and served.
+func (m *Metrics) Enabled() bool {
+	return m.config.Enabled
+}
+
+// Watch registers the services whose sizes are read as gauges each time metrics are scraped.
+func (m *Metrics) Watch(registry *SessionRegistry, tracker Tracker, matchmaker Matchmaker, msgLimit *MessageRateLimiter) {
+	m.Lock()
+	m.registry = registry
+	m.tracker = tracker
+	m.matchmaker = matchmaker
+	m.msgLimit = msgLimit
+	m.Unlock()
+}
+
+// ObserveMessage records a received message of a type, as named by runtime hooks, processed since start.
+func (m *Metrics) ObserveMessage(messageType string, start time.Time) {
+	if !m.config.Enabled {
+		return
+	}
+	m.messages.observe(messageType, time.Since(start).Seconds())
+}
+
+// ObserveQuery records a database query run since start. Queries are labelled by their leading keyword only.
+func (m *Metrics) ObserveQuery(query string, start time.Time, err error) {
+	if !m.config.Enabled {
+		return
+	}
+	statement := metricsStatement(query)
+	m.dbQueries.observe(statement, time.Since(start).Seconds())
+	if err != nil {
+		m.dbErrors.observe(statement, 1)
+	}
+}
+
+// ObserveNotifications records notifications sent, and how many of them were delivered live to online users.
+func (m *Metrics) ObserveNotifications(sent, delivered int) {
+	if !m.config.Enabled {
+		return
+	}
+	m.notificationsSent.Add(int64(sent))
+	m.notificationsDelivered.Add(int64(delivered))
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	m.messages.write(buf)
+	m.dbQueries.write(buf)
+	m.dbErrors.write(buf)
+	m.writeCounter(buf, "notifications_sent_total", "Notifications sent, stored or not.", m.notificationsSent.Load())
+	m.writeCounter(buf, "notifications_delivered_total", "Notifications delivered live to online users.", m.notificationsDelivered.Load())
+	m.writeGauge(buf, "goroutines", "Goroutines currently running.", runtime.NumGoroutine())
+
+	m.RLock()
+	if m.registry != nil {
+		queued, _, _, _ := m.registry.QueueStats()
+		m.writeGauge(buf, "sessions", "Sessions connected to this node.", m.registry.count())
+		m.writeGauge(buf, "socket_outgoing_queued", "Messages waiting to be written to sockets.", queued)
+	}
+	if m.tracker != nil {
+		m.writeGauge(buf, "presences", "Presences tracked, on this node and replicated from other nodes.", m.tracker.Count())
+	}
+	if m.matchmaker != nil {
+		m.writeGauge(buf, "matchmaker_tickets", "Matchmaker tickets waiting for a match.", m.matchmaker.Count())
+	}
+	if m.msgLimit != nil {
+		_, byType := m.msgLimit.Stats()
+		limited := &metricsFamily{
+			name:      m.config.Namespace + "_messages_rate_limited_total",
+			help:      "Messages rejected by rate limits, by message type.",
+			label:     "type",
+			maxValues: m.config.MaxLabelValues,
+			series:    make(map[string]*metricsSeries),
+		}
+		for messageType, count := range byType {
+			limited.observe(messageType, float64(count))
+		}
+		limited.write(buf)
+	}
+	m.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (m *Metrics) writeCounter(buf *bytes.Buffer, name, help string, value int64) {
+	name = m.config.Namespace + "_" + name
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func (m *Metrics) writeGauge(buf *bytes.Buffer, name, help string, value int) {
+	name = m.config.Namespace + "_" + name
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// observe adds a value to a histogram, or to the total of a counter.
+func (f *metricsFamily) observe(labelValue string, value float64) {
+	f.Lock()
+	if f.allowed != nil && !f.allowed[labelValue] {
+		labelValue = metricsOtherLabel
+	}
+	s, ok := f.series[labelValue]
+	if !ok && len(f.series) >= f.maxValues {
+		labelValue = metricsOtherLabel
+		s, ok = f.series[labelValue]
+	}
+	if !ok {
+		s = &metricsSeries{buckets: make([]uint64, len(f.buckets))}
+		f.series[labelValue] = s
+	}
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+	f.Unlock()
+}
+
+func (f *metricsFamily) write(buf *bytes.Buffer) {
+	f.Lock()
+	defer f.Unlock()
+	kind := "counter"
+	if f.buckets != nil {
+		kind = "histogram"
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, kind)
+
+	labelValues := make([]string, 0, len(f.series))
+	for labelValue := range f.series {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		s := f.series[labelValue]
+		label := fmt.Sprintf(`%s="%s"`, f.label, metricsLabelEscaper.Replace(labelValue))
+		if f.buckets == nil {
+			fmt.Fprintf(buf, "%s{%s} %s\n", f.name, label, strconv.FormatFloat(s.sum, 'g', -1, 64))
+			continue
+		}
+		// Each bucket counts observations at or below its bound, so they are cumulative already.
+		for i, bound := range f.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, label, strconv.FormatFloat(bound, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, label, s.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", f.name, label, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", f.name, label, s.count)
+	}
+}
+
+// metricsStatement returns the leading keyword of a query, such as SELECT or INSERT.
+func metricsStatement(query string) string {
+	query = strings.TrimLeft(query, " \t\r\n(")
+	end := 0
+	for end < len(query) && end < 16 {
+		c := query[end]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			break
+		}
+		end++
+	}
+	if end == 0 {
+		return metricsOtherLabel
+	}
+	return strings.ToUpper(query[:end])
+}
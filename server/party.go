@@ -0,0 +1,313 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// PartyRegistry holds the state of parties on this node. Party membership is tracked as presences on a
+// "party:<id>" topic, the registry keeps the leader, ready states, pending invites and matchmaking ticket. In a
+// cluster each party is held by the node it was created on, and only sessions on that node may join it.
+type PartyRegistry struct {
+	sync.Mutex
+	logger        *zap.Logger
+	name          string
+	tracker       Tracker
+	matchmaker    Matchmaker
+	messageRouter MessageRouter
+	cluster       *ClusterService
+	parties       map[uuid.UUID]*party
+}
+
+type party struct {
+	leader  Presence
+	maxSize int
+	ready   map[uuid.UUID]bool     // Session ID of each member to their ready state.
+	invites map[uuid.UUID]struct{} // User IDs invited to join.
+	ticket  uuid.UUID              // Matchmaking ticket, if the party is in the matchmaker.
+}
+
+// NewPartyRegistry creates a new PartyRegistry
+func NewPartyRegistry(logger *zap.Logger, name string, tracker Tracker, matchmaker Matchmaker, messageRouter MessageRouter, cluster *ClusterService) *PartyRegistry {
+	return &PartyRegistry{
+		logger:        logger,
+		name:          name,
+		tracker:       tracker,
+		matchmaker:    matchmaker,
+		messageRouter: messageRouter,
+		cluster:       cluster,
+		parties:       make(map[uuid.UUID]*party),
+	}
+}
+
+func partyTopic(partyID uuid.UUID) string {
+	return "party:" + partyID.String()
+}
+
+// Create a new party led by the given user and returns its ID.
+func (r *PartyRegistry) Create(sessionID uuid.UUID, userID uuid.UUID, handle string, maxSize int) uuid.UUID {
+	partyID := uuid.NewV4()
+	meta := PresenceMeta{Handle: handle}
+
+	r.Lock()
+	r.parties[partyID] = &party{
+		leader:  Presence{ID: PresenceID{Node: r.name, SessionID: sessionID}, UserID: userID, Topic: partyTopic(partyID), Meta: meta},
+		maxSize: maxSize,
+		ready:   map[uuid.UUID]bool{sessionID: false},
+		invites: make(map[uuid.UUID]struct{}),
+	}
+	r.Unlock()
+
+	r.cluster.Claim(partyTopic(partyID))
+	r.tracker.Track(sessionID, partyTopic(partyID), userID, meta)
+	return partyID
+}
+
+// Remote returns the other node in the cluster holding a party, if it's not held by this node.
+func (r *PartyRegistry) Remote(partyID uuid.UUID) (string, bool) {
+	r.Lock()
+	_, ok := r.parties[partyID]
+	r.Unlock()
+	if ok {
+		return "", false
+	}
+	return r.cluster.Owner(partyTopic(partyID))
+}
+
+// Invite a user to the party. Only the party leader may invite users.
+func (r *PartyRegistry) Invite(partyID uuid.UUID, sessionID uuid.UUID, userID uuid.UUID, inviteeID uuid.UUID) (Error_Code, error) {
+	r.Lock()
+	p, ok := r.parties[partyID]
+	if !ok || !p.isMember(sessionID) {
+		r.Unlock()
+		return PARTY_NOT_FOUND, errors.New("Party not found")
+	}
+	if p.leader.ID.SessionID != sessionID {
+		r.Unlock()
+		return BAD_INPUT, errors.New("Only the party leader can invite users")
+	}
+	p.invites[inviteeID] = struct{}{}
+	inviter := p.leader
+	r.Unlock()
+
+	// Let the invitee know straight away if they're online.
+	to := r.tracker.ListByTopicUser("notifications", inviteeID)
+	r.messageRouter.Send(r.logger, to, &Envelope{Payload: &Envelope_PartyInvitation{PartyInvitation: &PartyInvitation{
+		PartyId: partyID.Bytes(),
+		Inviter: &UserPresence{
+			UserId:    inviter.UserID.Bytes(),
+			SessionId: inviter.ID.SessionID.Bytes(),
+			Handle:    inviter.Meta.Handle,
+		},
+	}}})
+
+	return 0, nil
+}
+
+// Join a party the user has been invited to. Returns the party leader and maximum size.
+func (r *PartyRegistry) Join(partyID uuid.UUID, sessionID uuid.UUID, userID uuid.UUID, handle string) (Presence, int, Error_Code, error) {
+	r.Lock()
+	p, ok := r.parties[partyID]
+	if !ok {
+		r.Unlock()
+		return Presence{}, 0, PARTY_NOT_FOUND, errors.New("Party not found")
+	}
+	if !p.isMember(sessionID) {
+		if _, ok := p.invites[userID]; !ok {
+			r.Unlock()
+			return Presence{}, 0, PARTY_NOT_FOUND, errors.New("Party not found")
+		}
+		if p.maxSize > 0 && len(p.ready) >= p.maxSize {
+			r.Unlock()
+			return Presence{}, 0, PARTY_FULL, errors.New("Party is full")
+		}
+		delete(p.invites, userID)
+		p.ready[sessionID] = false
+		// The party has changed, so any search in progress no longer represents it.
+		r.cancelTicket(p)
+	}
+	leader := p.leader
+	maxSize := p.maxSize
+	r.Unlock()
+
+	r.tracker.Track(sessionID, partyTopic(partyID), userID, PresenceMeta{Handle: handle})
+	return leader, maxSize, 0, nil
+}
+
+// Leave a party. If the leader leaves another member is promoted, and the party ends when the last member leaves.
+func (r *PartyRegistry) Leave(partyID uuid.UUID, sessionID uuid.UUID, userID uuid.UUID) (Error_Code, error) {
+	r.Lock()
+	p, ok := r.parties[partyID]
+	if !ok || !p.isMember(sessionID) {
+		r.Unlock()
+		return PARTY_NOT_FOUND, errors.New("Party not found")
+	}
+	r.Unlock()
+
+	r.tracker.Untrack(sessionID, partyTopic(partyID), userID)
+	r.remove(partyID, sessionID)
+	return 0, nil
+}
+
+// SetReady marks a member as ready, or not, to matchmake with the party.
+func (r *PartyRegistry) SetReady(partyID uuid.UUID, sessionID uuid.UUID, userID uuid.UUID, handle string, ready bool) (Error_Code, error) {
+	r.Lock()
+	p, ok := r.parties[partyID]
+	if !ok || !p.isMember(sessionID) {
+		r.Unlock()
+		return PARTY_NOT_FOUND, errors.New("Party not found")
+	}
+	p.ready[sessionID] = ready
+	if !ready {
+		r.cancelTicket(p)
+	}
+	r.Unlock()
+
+	r.messageRouter.Send(r.logger, r.tracker.ListByTopic(partyTopic(partyID)), &Envelope{Payload: &Envelope_PartyReady{PartyReady: &PartyReady{
+		PartyId: partyID.Bytes(),
+		Presence: &UserPresence{
+			UserId:    userID.Bytes(),
+			SessionId: sessionID.Bytes(),
+			Handle:    handle,
+		},
+		Ready: ready,
+	}}})
+	return 0, nil
+}
+
+// MatchmakeMembers checks the party can enter the matchmaker and returns every member other than the leader.
+// Only the party leader may do this, once all other members are ready. Any previous search is cancelled.
+func (r *PartyRegistry) MatchmakeMembers(partyID uuid.UUID, sessionID uuid.UUID, userID uuid.UUID) ([]Presence, Error_Code, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	p, ok := r.parties[partyID]
+	if !ok || !p.isMember(sessionID) {
+		return nil, PARTY_NOT_FOUND, errors.New("Party not found")
+	}
+	if p.leader.ID.SessionID != sessionID {
+		return nil, BAD_INPUT, errors.New("Only the party leader can matchmake for the party")
+	}
+	for memberSessionID, ready := range p.ready {
+		if !ready && memberSessionID != sessionID {
+			return nil, PARTY_NOT_READY, errors.New("Not all party members are ready")
+		}
+	}
+	r.cancelTicket(p)
+
+	members := make([]Presence, 0, len(p.ready)-1)
+	for _, presence := range r.tracker.ListByTopic(partyTopic(partyID)) {
+		if presence.ID.SessionID != sessionID {
+			members = append(members, presence)
+		}
+	}
+	return members, 0, nil
+}
+
+// SetTicket records the matchmaking ticket the party is searching with.
+func (r *PartyRegistry) SetTicket(partyID uuid.UUID, ticket uuid.UUID) {
+	r.Lock()
+	if p, ok := r.parties[partyID]; ok {
+		p.ticket = ticket
+	}
+	r.Unlock()
+}
+
+// HandleDiff removes members from their parties when their presence leaves, for example on disconnect.
+func (r *PartyRegistry) HandleDiff(joins, leaves []Presence) {
+	for _, presence := range leaves {
+		splitTopic := strings.SplitN(presence.Topic, ":", 2)
+		if splitTopic[0] != "party" || len(splitTopic) != 2 {
+			continue
+		}
+		partyID, err := uuid.FromString(splitTopic[1])
+		if err != nil {
+			continue
+		}
+		r.remove(partyID, presence.ID.SessionID)
+	}
+}
+
+func (r *PartyRegistry) remove(partyID uuid.UUID, sessionID uuid.UUID) {
+	r.Lock()
+	p, ok := r.parties[partyID]
+	if !ok || !p.isMember(sessionID) {
+		r.Unlock()
+		return
+	}
+	delete(p.ready, sessionID)
+	r.cancelTicket(p)
+
+	if len(p.ready) == 0 {
+		delete(r.parties, partyID)
+		r.Unlock()
+		r.cluster.Release(partyTopic(partyID))
+		return
+	}
+	if p.leader.ID.SessionID != sessionID {
+		r.Unlock()
+		return
+	}
+
+	// Promote a remaining member to leader.
+	ps := r.tracker.ListByTopic(partyTopic(partyID))
+	promoted := false
+	for _, presence := range ps {
+		if p.isMember(presence.ID.SessionID) {
+			p.leader = presence
+			promoted = true
+			break
+		}
+	}
+	if !promoted {
+		// Remaining members are not tracked, so the party can't continue.
+		delete(r.parties, partyID)
+		r.Unlock()
+		r.cluster.Release(partyTopic(partyID))
+		return
+	}
+	leader := p.leader
+	r.Unlock()
+
+	r.messageRouter.Send(r.logger, ps, &Envelope{Payload: &Envelope_PartyLeader{PartyLeader: &PartyLeader{
+		PartyId: partyID.Bytes(),
+		Leader: &UserPresence{
+			UserId:    leader.UserID.Bytes(),
+			SessionId: leader.ID.SessionID.Bytes(),
+			Handle:    leader.Meta.Handle,
+		},
+	}}})
+}
+
+// cancelTicket removes the party from the matchmaker, if it's searching. Must be called with the registry locked.
+func (r *PartyRegistry) cancelTicket(p *party) {
+	if p.ticket == uuid.Nil {
+		return
+	}
+	// The ticket may already have been matched, so it's fine if it's no longer found.
+	r.matchmaker.Remove(p.leader.ID.SessionID, p.leader.UserID, p.ticket)
+	p.ticket = uuid.Nil
+}
+
+func (p *party) isMember(sessionID uuid.UUID) bool {
+	_, ok := p.ready[sessionID]
+	return ok
+}
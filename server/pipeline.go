@@ -15,8 +15,10 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"nakama/pkg/social"
 
@@ -25,19 +27,31 @@ import (
 )
 
 type pipeline struct {
-	config              Config
-	db                  *sql.DB
-	tracker             Tracker
-	matchmaker          Matchmaker
-	hmacSecretByte      []byte
-	messageRouter       MessageRouter
-	sessionRegistry     *SessionRegistry
-	socialClient        *social.Client
-	runtime             *Runtime
-	purchaseService     *PurchaseService
-	notificationService *NotificationService
-	jsonpbMarshaler     *jsonpb.Marshaler
-	jsonpbUnmarshaler   *jsonpb.Unmarshaler
+	config               Config
+	db                   *sql.DB
+	tracker              Tracker
+	matchmaker           Matchmaker
+	partyRegistry        *PartyRegistry
+	matchRegistry        *MatchRegistry
+	matchRecorder        *MatchRecorder
+	matchAllocator       *MatchAllocator
+	hmacSecretByte       []byte
+	messageRouter        MessageRouter
+	sessionRegistry      *SessionRegistry
+	socialClient         *social.Client
+	runtime              *Runtime
+	chatFilter           *ChatFilter
+	leaderboardRankCache *LeaderboardRankCache
+	purchaseService      *PurchaseService
+	notificationService  *NotificationService
+	storageFeed          *StorageFeed
+	mailer               Mailer
+	datagramServer       *DatagramServer
+	messageRateLimiter   *MessageRateLimiter
+	metrics              *Metrics
+	tracer               *Tracer
+	jsonpbMarshaler      *jsonpb.Marshaler
+	jsonpbUnmarshaler    *jsonpb.Unmarshaler
 }
 
 // NewPipeline creates a new Pipeline
@@ -45,24 +59,48 @@ func NewPipeline(config Config,
 	db *sql.DB,
 	tracker Tracker,
 	matchmaker Matchmaker,
+	partyRegistry *PartyRegistry,
+	matchRegistry *MatchRegistry,
+	matchRecorder *MatchRecorder,
+	matchAllocator *MatchAllocator,
 	messageRouter MessageRouter,
 	registry *SessionRegistry,
 	socialClient *social.Client,
 	runtime *Runtime,
+	chatFilter *ChatFilter,
+	leaderboardRankCache *LeaderboardRankCache,
 	purchaseService *PurchaseService,
-	notificationService *NotificationService) *pipeline {
+	notificationService *NotificationService,
+	storageFeed *StorageFeed,
+	mailer Mailer,
+	datagramServer *DatagramServer,
+	messageRateLimiter *MessageRateLimiter,
+	metrics *Metrics,
+	tracer *Tracer) *pipeline {
 	return &pipeline{
-		config:              config,
-		db:                  db,
-		tracker:             tracker,
-		matchmaker:          matchmaker,
-		hmacSecretByte:      []byte(config.GetSession().EncryptionKey),
-		messageRouter:       messageRouter,
-		sessionRegistry:     registry,
-		socialClient:        socialClient,
-		runtime:             runtime,
-		purchaseService:     purchaseService,
-		notificationService: notificationService,
+		config:               config,
+		db:                   db,
+		tracker:              tracker,
+		matchmaker:           matchmaker,
+		partyRegistry:        partyRegistry,
+		matchRegistry:        matchRegistry,
+		matchRecorder:        matchRecorder,
+		matchAllocator:       matchAllocator,
+		hmacSecretByte:       []byte(config.GetSession().EncryptionKey),
+		messageRouter:        messageRouter,
+		sessionRegistry:      registry,
+		socialClient:         socialClient,
+		runtime:              runtime,
+		chatFilter:           chatFilter,
+		leaderboardRankCache: leaderboardRankCache,
+		purchaseService:      purchaseService,
+		notificationService:  notificationService,
+		storageFeed:          storageFeed,
+		mailer:               mailer,
+		datagramServer:       datagramServer,
+		messageRateLimiter:   messageRateLimiter,
+		metrics:              metrics,
+		tracer:               tracer,
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
 			EmitDefaults: false,
@@ -84,17 +122,66 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 	messageType := fmt.Sprintf("%T", originalEnvelope.Payload)
 	logger.Debug("Received message", zap.String("type", messageType))
 
+	// Once the session token expires only a refreshed token or a logout are accepted.
+	if session.expiry.Load() <= now().Unix() {
+		switch originalEnvelope.Payload.(type) {
+		case *Envelope_SessionRefresh, *Envelope_Logout:
+		default:
+			session.Send(ErrorMessage(originalEnvelope.CollationId, AUTH_ERROR, "Session token expired"))
+			return
+		}
+	}
+
 	messageType = RUNTIME_MESSAGES[messageType]
+	if !p.messageRateLimiter.Allow(messageRateLimitID(session), messageType, nowMs()) {
+		logger.Debug("Message rate limited", zap.String("message", messageType))
+		session.Send(ErrorMessage(originalEnvelope.CollationId, MESSAGE_RATE_LIMITED, "Too many messages of this type, try again later"))
+		return
+	}
+	defer p.metrics.ObserveMessage(messageType, time.Now())
+
+	// Work done for the request picks up its span from the session.
+	ctx, span := p.tracer.StartTrace(context.Background(), "pipeline "+messageType)
+	span.SetAttribute("nakama.session_id", session.id.String())
+	span.SetAttribute("nakama.user_id", session.userID.String())
+	span.SetAttribute("nakama.collation_id", originalEnvelope.CollationId)
+	previousCtx := session.setRequestContext(ctx)
+	defer func() {
+		session.setRequestContext(previousCtx)
+		span.End()
+	}()
+
+	var hookSpan *Span
+	if p.runtime.GetRuntimeGoBefore(messageType) != nil || p.runtime.GetRuntimeCallback(BEFORE, messageType) != nil {
+		_, hookSpan = p.tracer.StartSpan(ctx, "runtime before "+messageType)
+	}
 	envelope, fnErr := RuntimeBeforeHook(p.runtime, p.jsonpbMarshaler, p.jsonpbUnmarshaler, messageType, originalEnvelope, session)
-	if fnErr != nil {
+	hookSpan.SetError(fnErr)
+	hookSpan.End()
+	if rejected, ok := fnErr.(*hookRejectedError); ok {
+		logger.Debug("Runtime before function rejected message", zap.String("message", messageType), zap.String("reason", rejected.message))
+		session.Send(ErrorMessage(originalEnvelope.CollationId, RUNTIME_REQUEST_REJECTED, rejected.message))
+		return
+	} else if fnErr != nil {
 		logger.Error("Runtime before function caused an error", zap.String("message", messageType), zap.Error(fnErr))
 		session.Send(ErrorMessage(originalEnvelope.CollationId, RUNTIME_FUNCTION_EXCEPTION, fmt.Sprintf("Runtime before function caused an error: %s", fnErr.Error())))
 		return
 	}
 
+	// Only record the response if an after hook will look at it.
+	hasAfterHook := p.runtime.GetRuntimeGoAfter(messageType) != nil || p.runtime.GetRuntimeCallback(AFTER, messageType) != nil
+	if hasAfterHook {
+		session.captureResponse(envelope.CollationId)
+	}
+
 	switch envelope.Payload.(type) {
 	case *Envelope_Logout:
 		// TODO Store JWT into a blacklist until remaining JWT expiry.
+		if refreshID := session.refreshID.Load(); refreshID != "" {
+			if err := RefreshTokenRevoke(p.db, session.userID, refreshID); err != nil {
+				logger.Warn("Could not revoke refresh token", zap.Error(err))
+			}
+		}
 		p.sessionRegistry.remove(session)
 		session.close()
 
@@ -107,6 +194,30 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.selfFetch(logger, session, envelope)
 	case *Envelope_SelfUpdate:
 		p.selfUpdate(logger, session, envelope)
+	case *Envelope_EmailVerificationSend:
+		p.emailVerificationSend(logger, session, envelope)
+	case *Envelope_SessionRefresh:
+		p.sessionRefresh(logger, session, envelope)
+	case *Envelope_SessionsList:
+		p.sessionsList(logger, session, envelope)
+	case *Envelope_SessionLogout:
+		p.sessionLogout(logger, session, envelope)
+	case *Envelope_SessionDebug:
+		p.sessionDebug(logger, session, envelope)
+	case *Envelope_AccountMerge:
+		p.accountMerge(logger, session, envelope)
+	case *Envelope_SelfDelete:
+		p.selfDelete(logger, session, envelope)
+	case *Envelope_MfaEnroll:
+		p.mfaEnroll(logger, session, envelope)
+	case *Envelope_MfaConfirm:
+		p.mfaConfirm(logger, session, envelope)
+	case *Envelope_MfaDisable:
+		p.mfaDisable(logger, session, envelope)
+	case *Envelope_AuthHistoryList:
+		p.authHistoryList(logger, session, envelope)
+	case *Envelope_GuestUpgrade:
+		p.guestUpgrade(logger, session, envelope)
 	case *Envelope_UsersFetch:
 		p.usersFetch(logger, session, envelope)
 
@@ -143,6 +254,30 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.groupUserKick(logger, session, envelope)
 	case *Envelope_GroupUsersPromote:
 		p.groupUserPromote(logger, session, envelope)
+	case *Envelope_GroupUsersBan:
+		p.groupUserBan(logger, session, envelope)
+	case *Envelope_GroupUsersUnban:
+		p.groupUserUnban(logger, session, envelope)
+	case *Envelope_GroupUsersBannedList:
+		p.groupUsersBannedList(logger, session, envelope)
+	case *Envelope_GroupTransferOwnership:
+		p.groupTransferOwnership(logger, session, envelope)
+	case *Envelope_GroupHistoryList:
+		p.groupHistoryList(logger, session, envelope)
+	case *Envelope_GroupUsersInvite:
+		p.groupUserInvite(logger, session, envelope)
+	case *Envelope_GroupInviteAccept:
+		p.groupInviteAccept(logger, session, envelope)
+	case *Envelope_AllianceCreate:
+		p.allianceCreate(logger, session, envelope)
+	case *Envelope_AllianceJoin:
+		p.allianceJoin(logger, session, envelope)
+	case *Envelope_AllianceLeave:
+		p.allianceLeave(logger, session, envelope)
+	case *Envelope_AllianceGroupsList:
+		p.allianceGroupsList(logger, session, envelope)
+	case *Envelope_AllianceUsersList:
+		p.allianceUsersList(logger, session, envelope)
 
 	case *Envelope_TopicsJoin:
 		p.topicJoin(logger, session, envelope)
@@ -150,8 +285,30 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.topicLeave(logger, session, envelope)
 	case *Envelope_TopicMessageSend:
 		p.topicMessageSend(logger, session, envelope)
+	case *Envelope_TopicMessageUpdate:
+		p.topicMessageUpdate(logger, session, envelope)
+	case *Envelope_TopicMessageDelete:
+		p.topicMessageDelete(logger, session, envelope)
 	case *Envelope_TopicMessagesList:
 		p.topicMessagesList(logger, session, envelope)
+	case *Envelope_TopicMessagePin:
+		p.topicMessagePin(logger, session, envelope)
+	case *Envelope_TopicMessageUnpin:
+		p.topicMessageUnpin(logger, session, envelope)
+	case *Envelope_TopicPinsList:
+		p.topicPinsList(logger, session, envelope)
+	case *Envelope_TopicMarkRead:
+		p.topicMarkRead(logger, session, envelope)
+	case *Envelope_TopicsUnreadList:
+		p.topicsUnreadList(logger, session, envelope)
+	case *Envelope_TopicUserMute:
+		p.topicUserMute(logger, session, envelope)
+	case *Envelope_TopicSlowModeSet:
+		p.topicSlowModeSet(logger, session, envelope)
+	case *Envelope_TopicMessageReact:
+		p.topicMessageReact(logger, session, envelope)
+	case *Envelope_TopicEphemeralSend:
+		p.topicEphemeralSend(logger, session, envelope)
 
 	case *Envelope_MatchCreate:
 		p.matchCreate(logger, session, envelope)
@@ -161,22 +318,82 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.matchLeave(logger, session, envelope)
 	case *Envelope_MatchDataSend:
 		p.matchDataSend(logger, session, envelope)
+	case *Envelope_DatagramBind:
+		p.datagramBind(logger, session, envelope)
+	case *Envelope_MatchesList:
+		p.matchesList(logger, session, envelope)
+	case *Envelope_MatchLabelUpdate:
+		p.matchLabelUpdate(logger, session, envelope)
+	case *Envelope_MatchReplayList:
+		p.matchReplayList(logger, session, envelope)
+	case *Envelope_MatchReplayDownload:
+		p.matchReplayDownload(logger, session, envelope)
+
+	case *Envelope_TurnMatchCreate:
+		p.turnMatchCreate(logger, session, envelope)
+	case *Envelope_TurnMatchesFetch:
+		p.turnMatchesFetch(logger, session, envelope)
+	case *Envelope_TurnMatchesList:
+		p.turnMatchesList(logger, session, envelope)
+	case *Envelope_TurnMatchMove:
+		p.turnMatchMove(logger, session, envelope)
+	case *Envelope_TurnMatchForfeit:
+		p.turnMatchForfeit(logger, session, envelope)
 
 	case *Envelope_MatchmakeAdd:
 		p.matchmakeAdd(logger, session, envelope)
 	case *Envelope_MatchmakeRemove:
 		p.matchmakeRemove(logger, session, envelope)
+	case *Envelope_MatchmakeStatus:
+		p.matchmakeStatus(logger, session, envelope)
+	case *Envelope_MatchmakeBackfill:
+		p.matchmakeBackfill(logger, session, envelope)
+
+	case *Envelope_PartyCreate:
+		p.partyCreate(logger, session, envelope)
+	case *Envelope_PartyInvite:
+		p.partyInvite(logger, session, envelope)
+	case *Envelope_PartyJoin:
+		p.partyJoin(logger, session, envelope)
+	case *Envelope_PartyLeave:
+		p.partyLeave(logger, session, envelope)
+	case *Envelope_PartyReadySet:
+		p.partyReadySet(logger, session, envelope)
 
 	case *Envelope_StorageList:
 		p.storageList(logger, session, envelope)
+	case *Envelope_StorageQuery:
+		p.storageQuery(logger, session, envelope)
 	case *Envelope_StorageFetch:
 		p.storageFetch(logger, session, envelope)
 	case *Envelope_StorageWrite:
 		p.storageWrite(logger, session, envelope)
 	case *Envelope_StorageUpdate:
 		p.storageUpdate(logger, session, envelope)
+	case *Envelope_StorageBatch:
+		p.storageBatch(logger, session, envelope)
+	case *Envelope_StorageAclSet:
+		p.storageAclSet(logger, session, envelope)
+	case *Envelope_StorageAclFetch:
+		p.storageAclFetch(logger, session, envelope)
+	case *Envelope_StorageSubscribe:
+		p.storageSubscribe(logger, session, envelope)
+	case *Envelope_StorageUnsubscribe:
+		p.storageUnsubscribe(logger, session, envelope)
 	case *Envelope_StorageRemove:
 		p.storageRemove(logger, session, envelope)
+	case *Envelope_StorageUploadBegin:
+		p.storageUploadBegin(logger, session, envelope)
+	case *Envelope_StorageUploadAppend:
+		p.storageUploadAppend(logger, session, envelope)
+	case *Envelope_StorageUploadCommit:
+		p.storageUploadCommit(logger, session, envelope)
+	case *Envelope_StorageFetchRange:
+		p.storageFetchRange(logger, session, envelope)
+	case *Envelope_StorageUsageFetch:
+		p.storageUsageFetch(logger, session, envelope)
+	case *Envelope_StorageIncrement:
+		p.storageIncrement(logger, session, envelope)
 
 	case *Envelope_LeaderboardsList:
 		p.leaderboardsList(logger, session, envelope)
@@ -186,6 +403,14 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 		p.leaderboardRecordsFetch(logger, session, envelope)
 	case *Envelope_LeaderboardRecordsList:
 		p.leaderboardRecordsList(logger, session, envelope)
+	case *Envelope_LeaderboardRecordsListArchive:
+		p.leaderboardRecordsListArchive(logger, session, envelope)
+	case *Envelope_TournamentsList:
+		p.tournamentsList(logger, session, envelope)
+	case *Envelope_TournamentJoin:
+		p.tournamentJoin(logger, session, envelope)
+	case *Envelope_TournamentRecordWrite:
+		p.tournamentRecordWrite(logger, session, envelope)
 
 	case *Envelope_Rpc:
 		p.rpc(logger, session, envelope)
@@ -200,10 +425,60 @@ func (p *pipeline) processRequest(logger *zap.Logger, session *session, original
 
 	default:
 		session.Send(ErrorMessage(envelope.CollationId, UNRECOGNIZED_PAYLOAD, "Unrecognized payload"))
+		if hasAfterHook {
+			session.capturedResponse()
+		}
 		return
 	}
 
-	RuntimeAfterHook(logger, p.runtime, p.jsonpbMarshaler, messageType, envelope, session)
+	if hasAfterHook {
+		_, hookSpan := p.tracer.StartSpan(ctx, "runtime after "+messageType)
+		RuntimeAfterHook(logger, p.runtime, p.jsonpbMarshaler, messageType, envelope, session.capturedResponse(), session)
+		hookSpan.End()
+	}
+}
+
+// call processes a request made without a socket, returning its response. It goes through the same hooks and
+// handlers as socket requests, but only requests that get a single response and don't need the session to stay
+// connected are accepted.
+func (p *pipeline) call(logger *zap.Logger, session *session, envelope *Envelope) *Envelope {
+	if envelope.Payload != nil && !pipelineCallable(envelope) {
+		return ErrorMessage(envelope.CollationId, UNRECOGNIZED_PAYLOAD, "Message can only be sent over a socket")
+	}
+
+	p.processRequest(logger, session, envelope)
+
+	session.Lock()
+	response := session.callResponse
+	session.callResponse = nil
+	session.Unlock()
+	if response == nil {
+		response = &Envelope{CollationId: envelope.CollationId}
+	}
+	return response
+}
+
+func pipelineCallable(envelope *Envelope) bool {
+	switch envelope.Payload.(type) {
+	case *Envelope_SelfFetch, *Envelope_SelfUpdate, *Envelope_UsersFetch:
+	case *Envelope_FriendsAdd, *Envelope_FriendsRemove, *Envelope_FriendsBlock, *Envelope_FriendsList:
+	case *Envelope_GroupsCreate, *Envelope_GroupsUpdate, *Envelope_GroupsRemove, *Envelope_GroupsFetch,
+		*Envelope_GroupsList, *Envelope_GroupsSelfList, *Envelope_GroupUsersList, *Envelope_GroupsJoin,
+		*Envelope_GroupsLeave, *Envelope_GroupUsersAdd, *Envelope_GroupUsersKick, *Envelope_GroupUsersPromote,
+		*Envelope_GroupUsersBan, *Envelope_GroupUsersUnban, *Envelope_GroupUsersBannedList,
+		*Envelope_GroupTransferOwnership, *Envelope_GroupHistoryList, *Envelope_GroupUsersInvite,
+		*Envelope_GroupInviteAccept:
+	case *Envelope_StorageList, *Envelope_StorageQuery, *Envelope_StorageFetch, *Envelope_StorageWrite,
+		*Envelope_StorageUpdate, *Envelope_StorageBatch, *Envelope_StorageAclSet, *Envelope_StorageAclFetch,
+		*Envelope_StorageRemove, *Envelope_StorageFetchRange, *Envelope_StorageUsageFetch,
+		*Envelope_StorageIncrement:
+	case *Envelope_LeaderboardsList, *Envelope_LeaderboardRecordsWrite, *Envelope_LeaderboardRecordsFetch,
+		*Envelope_LeaderboardRecordsList, *Envelope_LeaderboardRecordsListArchive, *Envelope_TournamentsList,
+		*Envelope_TournamentJoin, *Envelope_TournamentRecordWrite:
+	default:
+		return false
+	}
+	return true
 }
 
 func ErrorMessageRuntimeException(collationID string, message string) *Envelope {
@@ -0,0 +1,92 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) accountMerge(logger *zap.Logger, session *session, envelope *Envelope) {
+	var provider string
+	var query string
+	var profileID string
+
+	switch id := envelope.GetAccountMerge().Id.(type) {
+	case *TAccountMerge_Facebook:
+		if id.Facebook == "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"))
+			return
+		} else if invalidCharsRegex.MatchString(id.Facebook) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Facebook access token, no spaces or control characters allowed"))
+			return
+		}
+		fbProfile, err := p.socialClient.GetFacebookProfile(id.Facebook)
+		if err != nil {
+			logger.Warn("Could not get Facebook profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Facebook profile"))
+			return
+		}
+		provider = "Facebook"
+		query = "SELECT id FROM users WHERE facebook_id = $1"
+		profileID = fbProfile.ID
+	case *TAccountMerge_Google:
+		if id.Google == "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Access token is required"))
+			return
+		} else if invalidCharsRegex.MatchString(id.Google) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Google access token, no spaces or control characters allowed"))
+			return
+		}
+		googleProfile, err := p.socialClient.GetGoogleProfile(id.Google)
+		if err != nil {
+			logger.Warn("Could not get Google profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Google profile"))
+			return
+		}
+		provider = "Google"
+		query = "SELECT id FROM users WHERE google_id = $1"
+		profileID = googleProfile.ID
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
+		return
+	}
+
+	var sourceBytes []byte
+	err := p.db.QueryRowContext(session.requestContext(), query, profileID).Scan(&sourceBytes)
+	if err == sql.ErrNoRows {
+		session.Send(ErrorMessage(envelope.CollationId, USER_NOT_FOUND, provider+" ID is not in use, link it instead"))
+		return
+	} else if err != nil {
+		logger.Error("Could not merge accounts, query error", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not merge accounts"))
+		return
+	}
+	source := uuid.FromBytesOrNil(sourceBytes)
+	if source == session.userID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, provider+" ID is already linked to this account"))
+		return
+	}
+
+	if code, err := AccountMerge(logger, p.db, p.leaderboardRankCache, session.userID, source); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+	p.sessionRegistry.disconnectUser(source, sessionCloseMerged, "Account merged into another account")
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) allianceCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAllianceCreate()
+
+	groupID, err := uuid.FromBytes(e.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
+
+	if e.Name == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Alliance name is mandatory."))
+		return
+	}
+
+	if len(e.Metadata) != 0 {
+		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
+		var maybeJSON map[string]interface{}
+		if json.Unmarshal(e.Metadata, &maybeJSON) != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
+			return
+		}
+	}
+
+	alliance, code, err := AllianceCreate(logger, p.db, session.userID, groupID, &GroupCreateParam{
+		Name:        e.Name,
+		Description: e.Description,
+		AvatarURL:   e.AvatarUrl,
+		Lang:        e.Lang,
+		Metadata:    e.Metadata,
+		Private:     e.Private,
+	})
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Groups{Groups: &TGroups{Groups: []*Group{alliance}}}})
+}
+
+func (p *pipeline) allianceJoin(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAllianceJoin()
+
+	allianceID, err := uuid.FromBytes(e.AllianceId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Alliance ID is not valid"))
+		return
+	}
+
+	groupID, err := uuid.FromBytes(e.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
+
+	code, err := AllianceJoin(logger, p.db, session.userID, allianceID, groupID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) allianceLeave(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAllianceLeave()
+
+	allianceID, err := uuid.FromBytes(e.AllianceId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Alliance ID is not valid"))
+		return
+	}
+
+	groupID, err := uuid.FromBytes(e.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
+
+	code, err := AllianceLeave(logger, p.db, session.userID, allianceID, groupID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) allianceGroupsList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAllianceGroupsList()
+
+	allianceID, err := uuid.FromBytes(e.AllianceId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Alliance ID is not valid"))
+		return
+	}
+
+	groups, code, err := AllianceGroupsList(logger, p.db, allianceID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Groups{Groups: &TGroups{Groups: groups}}})
+}
+
+func (p *pipeline) allianceUsersList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAllianceUsersList()
+
+	allianceID, err := uuid.FromBytes(e.AllianceId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Alliance ID is not valid"))
+		return
+	}
+
+	users, code, err := AllianceUsersList(logger, p.db, allianceID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_GroupUsers{GroupUsers: &TGroupUsers{Users: users}}})
+}
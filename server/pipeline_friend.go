@@ -15,11 +15,13 @@
 package server
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 
 	"encoding/json"
 	"fmt"
+	"strconv"
+
 	"github.com/lib/pq"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
@@ -83,6 +85,36 @@ FROM users ` + filterQuery
 }
 
 func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle string, fbid string, accessToken string) {
+	fbFriends, err := p.socialClient.GetFacebookFriends(accessToken)
+	if err != nil {
+		logger.Error("Could not import friends from Facebook", zap.Error(err))
+		return
+	}
+
+	friendIDs := make([]string, len(fbFriends))
+	for i, fbFriend := range fbFriends {
+		friendIDs[i] = fbFriend.ID
+	}
+	p.importFriends(logger, userID, "Facebook", "facebook_id", friendIDs, map[string]interface{}{"handle": handle, "facebook_id": fbid})
+}
+
+func (p *pipeline) addSteamFriends(logger *zap.Logger, userID []byte, handle string, steamID uint64) {
+	steamFriends, err := p.socialClient.GetSteamFriends(p.config.GetSocial().Steam.PublisherKey, steamID)
+	if err != nil {
+		logger.Error("Could not import friends from Steam", zap.Error(err))
+		return
+	}
+
+	friendIDs := make([]string, len(steamFriends))
+	for i, steamFriend := range steamFriends {
+		friendIDs[i] = strconv.FormatUint(steamFriend.SteamID, 10)
+	}
+	p.importFriends(logger, userID, "Steam", "steam_id", friendIDs, map[string]interface{}{"handle": handle, "steam_id": strconv.FormatUint(steamID, 10)})
+}
+
+// importFriends adds friend edges between the user and the users with the given social provider IDs, then notifies
+// them their friend has joined the game. The column names the provider's ID in the users table.
+func (p *pipeline) importFriends(logger *zap.Logger, userID []byte, provider string, column string, friendIDs []string, content map[string]interface{}) {
 	var tx *sql.Tx
 	var err error
 
@@ -90,7 +122,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 	friendUserIDs := make([]interface{}, 0)
 	defer func() {
 		if err != nil {
-			logger.Error("Could not import friends from Facebook", zap.Error(err))
+			logger.Error("Could not import friends from "+provider, zap.Error(err))
 			if tx != nil {
 				err = tx.Rollback()
 				if err != nil {
@@ -103,13 +135,13 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 				if err != nil {
 					logger.Error("Could not commit transaction", zap.Error(err))
 				} else {
-					logger.Debug("Imported friends from Facebook")
+					logger.Debug("Imported friends from " + provider)
 
 					// Send out notifications.
 					if len(friendUserIDs) != 0 {
-						content, err := json.Marshal(map[string]interface{}{"handle": handle, "facebook_id": fbid})
+						contentBytes, err := json.Marshal(content)
 						if err != nil {
-							logger.Warn("Failed to send Facebook friend join notifications", zap.Error(err))
+							logger.Warn("Failed to send "+provider+" friend join notifications", zap.Error(err))
 							return
 						}
 						subject := "Your friend has just joined the game"
@@ -122,7 +154,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 								Id:         uuid.NewV4().Bytes(),
 								UserID:     fid,
 								Subject:    subject,
-								Content:    content,
+								Content:    contentBytes,
 								Code:       NOTIFICATION_FRIEND_JOIN_GAME,
 								SenderID:   userID,
 								CreatedAt:  ts,
@@ -131,9 +163,9 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 							}
 						}
 
-						err = p.notificationService.NotificationSend(notifications)
+						err = p.notificationService.NotificationSend(context.Background(), notifications)
 						if err != nil {
-							logger.Warn("Failed to send Facebook friend join notifications", zap.Error(err))
+							logger.Warn("Failed to send "+provider+" friend join notifications", zap.Error(err))
 						}
 					}
 				}
@@ -141,11 +173,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 		}
 	}()
 
-	fbFriends, err := p.socialClient.GetFacebookFriends(accessToken)
-	if err != nil {
-		return
-	}
-	if len(fbFriends) == 0 {
+	if len(friendIDs) == 0 {
 		return
 	}
 
@@ -154,14 +182,15 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 		return
 	}
 
-	query := "SELECT id FROM users WHERE facebook_id IN ("
-	friends := make([]interface{}, len(fbFriends))
-	for i, fbFriend := range fbFriends {
+	// Users who already have an edge with the user, as a friend or otherwise, are left as they are.
+	query := "SELECT id FROM users WHERE id != $1 AND id NOT IN (SELECT destination_id FROM user_edge WHERE source_id = $1) AND " + column + " IN ("
+	friends := []interface{}{userID}
+	for i, friendID := range friendIDs {
 		if i != 0 {
 			query += ", "
 		}
-		query += fmt.Sprintf("$%v", i+1)
-		friends[i] = fbFriend.ID
+		friends = append(friends, friendID)
+		query += fmt.Sprintf("$%v", len(friends))
 	}
 	query += ")"
 	rows, err := tx.Query(query, friends...)
@@ -199,7 +228,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 	}
 	queryEdgeMetadata += ")"
 
-	// Check if any Facebook friends are already users, if not there are no new edges to handle.
+	// Check if any friends are already users, if not there are no new edges to handle.
 	if len(paramsEdge) <= 2 {
 		return
 	}
@@ -215,7 +244,7 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 		return
 	}
 	// Update edge metadata for current user to bump count by number of new friends.
-	_, err = tx.Exec(`UPDATE user_edge_metadata SET count = $1, updated_at = $2 WHERE source_id = $3`, len(paramsEdge)-2, ts, userID)
+	_, err = tx.Exec(`UPDATE user_edge_metadata SET count = count + $1, updated_at = $2 WHERE source_id = $3`, len(paramsEdge)-2, ts, userID)
 	if err != nil {
 		return
 	}
@@ -224,61 +253,6 @@ func (p *pipeline) addFacebookFriends(logger *zap.Logger, userID []byte, handle
 	friendUserIDs = paramsEdge[2:]
 }
 
-func (p *pipeline) getFriends(filterQuery string, userID []byte) ([]*Friend, error) {
-	query := `
-SELECT id, handle, fullname, avatar_url,
-	lang, location, timezone, metadata,
-	created_at, users.updated_at, last_online_at, state
-FROM users, user_edge ` + filterQuery
-
-	rows, err := p.db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	friends := make([]*Friend, 0)
-
-	for rows.Next() {
-		var id []byte
-		var handle sql.NullString
-		var fullname sql.NullString
-		var avatarURL sql.NullString
-		var lang sql.NullString
-		var location sql.NullString
-		var timezone sql.NullString
-		var metadata []byte
-		var createdAt sql.NullInt64
-		var updatedAt sql.NullInt64
-		var lastOnlineAt sql.NullInt64
-		var state sql.NullInt64
-
-		err = rows.Scan(&id, &handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata, &createdAt, &updatedAt, &lastOnlineAt, &state)
-		if err != nil {
-			return nil, err
-		}
-
-		friends = append(friends, &Friend{
-			User: &User{
-				Id:           id,
-				Handle:       handle.String,
-				Fullname:     fullname.String,
-				AvatarUrl:    avatarURL.String,
-				Lang:         lang.String,
-				Location:     location.String,
-				Timezone:     timezone.String,
-				Metadata:     metadata,
-				CreatedAt:    createdAt.Int64,
-				UpdatedAt:    updatedAt.Int64,
-				LastOnlineAt: lastOnlineAt.Int64,
-			},
-			State: state.Int64,
-		})
-	}
-
-	return friends, nil
-}
-
 func (p *pipeline) friendAdd(l *zap.Logger, session *session, envelope *Envelope) {
 	e := envelope.GetFriendsAdd()
 
@@ -375,50 +349,14 @@ func (p *pipeline) friendRemove(l *zap.Logger, session *session, envelope *Envel
 		return
 	}
 
-	tx, err := p.db.Begin()
-	if err != nil {
+	if err = friendRemove(logger, p.db, session.userID.Bytes(), friendIDBytes); err != nil {
 		logger.Error("Could not remove friend", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"))
 		return
 	}
-	defer func() {
-		if err != nil {
-			logger.Error("Could not remove friend", zap.Error(err))
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"))
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to remove friend"))
-			} else {
-				logger.Info("Removed friend")
-				session.Send(&Envelope{CollationId: envelope.CollationId})
-			}
-		}
-	}()
-
-	updatedAt := nowMs()
-
-	res, err := tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", session.userID.Bytes(), friendIDBytes)
-	rowsAffected, _ := res.RowsAffected()
-	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", session.userID.Bytes(), updatedAt)
-	}
-
-	if err != nil {
-		return
-	}
-
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2", friendIDBytes, session.userID.Bytes())
-	rowsAffected, _ = res.RowsAffected()
-	if err == nil && rowsAffected > 0 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", friendIDBytes, updatedAt)
-	}
+	logger.Info("Removed friend")
+	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
 func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelope) {
@@ -452,64 +390,22 @@ func (p *pipeline) friendBlock(l *zap.Logger, session *session, envelope *Envelo
 		return
 	}
 
-	tx, err := p.db.Begin()
-	if err != nil {
-		logger.Error("Could not block user", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to block friend"))
-		return
-	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not block user", zap.Error(err))
-			} else {
-				logger.Warn("Could not block user", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
-
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"))
+	if err = friendBlock(logger, p.db, session.userID.Bytes(), userIDBytes); err != nil {
+		if _, ok := err.(*pq.Error); ok {
+			logger.Error("Could not block user", zap.Error(err))
 		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"))
-			} else {
-				logger.Info("User blocked")
-				session.Send(&Envelope{CollationId: envelope.CollationId})
-			}
+			logger.Warn("Could not block user", zap.Error(err))
 		}
-	}()
-
-	res, err := tx.Exec("UPDATE user_edge SET state = 3, updated_at = $3 WHERE source_id = $1 AND destination_id = $2",
-		session.userID.Bytes(), userIDBytes, nowMs())
-
-	if err != nil {
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not block user"))
 		return
 	}
 
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
-		err = errors.New("Could not block user. User ID may not exist")
-		return
-	}
-
-	// Delete opposite relationship if user hasn't blocked you already
-	res, err = tx.Exec("DELETE FROM user_edge WHERE source_id = $1 AND destination_id = $2 AND state != 3",
-		userIDBytes, session.userID.Bytes())
-
-	if err != nil {
-		return
-	}
-
-	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
-		_, err = tx.Exec("UPDATE user_edge_metadata SET count = count - 1, updated_at = $2 WHERE source_id = $1", userIDBytes, nowMs())
-	}
+	logger.Info("User blocked")
+	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
 func (p *pipeline) friendsList(logger *zap.Logger, session *session, envelope *Envelope) {
-	friends, err := p.getFriends("WHERE id = destination_id AND source_id = $1", session.userID.Bytes())
+	friends, err := friendsList(p.db, session.userID.Bytes())
 	if err != nil {
 		logger.Error("Could not get friends", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get friends"))
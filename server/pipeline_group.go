@@ -24,7 +24,6 @@ import (
 	"strings"
 
 	"fmt"
-	"github.com/lib/pq"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
@@ -33,6 +32,10 @@ type scanner interface {
 	Scan(dest ...interface{}) error
 }
 
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 type groupCursor struct {
 	Primary   interface{}
 	Secondary int64
@@ -54,10 +57,14 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group name is mandatory."))
 		return
 	}
+	if g.MaxCount < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group max count must be greater than 0."))
+		return
+	}
 
 	var group *Group
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(session.requestContext(), nil)
 	if err != nil {
 		logger.Error("Could not create group", zap.Error(err))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Could not create group"))
@@ -138,10 +145,16 @@ func (p *pipeline) groupCreate(logger *zap.Logger, session *session, envelope *E
 		values = append(values, g.Metadata)
 	}
 
-	r := tx.QueryRow(`
+	if g.MaxCount != 0 {
+		columns = append(columns, "max_count")
+		params = append(params, "$"+strconv.Itoa(len(values)+1))
+		values = append(values, g.MaxCount)
+	}
+
+	r := tx.QueryRowContext(session.requestContext(), `
 INSERT INTO groups (id, creator_id, name, state, count, created_at, updated_at, `+strings.Join(columns, ", ")+")"+`
 VALUES ($1, $2, $3, $4, 1, $5, $5, `+strings.Join(params, ",")+")"+`
-RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
+RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at, max_count
 `, values...)
 
 	group, err = extractGroup(r)
@@ -149,7 +162,7 @@ RETURNING id, creator_id, name, description, avatar_url, lang, utc_offset_ms, me
 		return
 	}
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(session.requestContext(), `
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 VALUES ($1, $2, $2, $3, 0), ($3, $2, $2, $1, 0)`,
 		group.Id, updatedAt, session.userID.Bytes())
@@ -195,6 +208,11 @@ func (p *pipeline) groupUpdate(l *zap.Logger, session *session, envelope *Envelo
 		return
 	}
 
+	if g.MaxCount < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group max count must be greater than 0."))
+		return
+	}
+
 	code, err := GroupsUpdate(l, p.db, session.userID, []*TGroupsUpdate_GroupUpdate{g})
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
@@ -225,7 +243,7 @@ func (p *pipeline) groupRemove(l *zap.Logger, session *session, envelope *Envelo
 	logger := l.With(zap.String("group_id", groupID.String()))
 	failureReason := "Failed to remove group"
 
-	tx, err := p.db.Begin()
+	tx, err := p.db.BeginTx(session.requestContext(), nil)
 	if err != nil {
 		logger.Error("Could not remove group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
@@ -251,7 +269,7 @@ func (p *pipeline) groupRemove(l *zap.Logger, session *session, envelope *Envelo
 		}
 	}()
 
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(session.requestContext(), `
 DELETE FROM groups
 WHERE
 	id = $1
@@ -273,7 +291,52 @@ AND
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID.Bytes())
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_edge WHERE source_id = $1 OR destination_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_cooldown WHERE group_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_ban WHERE group_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_invite WHERE group_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_history WHERE group_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM group_relation WHERE parent_id = $1 OR child_id = $1", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM topic_setting WHERE topic = $1 AND topic_type = 2", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM topic_user WHERE topic = $1 AND topic_type = 2", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "DELETE FROM topic_pin WHERE topic = $1 AND topic_type = 2", groupID.Bytes())
+	if err != nil {
+		return
+	}
+
+	err = leaderboardsGroupRemove(tx, groupID.Bytes())
 }
 
 func (p *pipeline) groupsFetch(logger *zap.Logger, session *session, envelope *Envelope) {
@@ -315,8 +378,8 @@ func (p *pipeline) groupsFetch(logger *zap.Logger, session *session, envelope *E
 		return
 	}
 
-	rows, err := p.db.Query(
-		`SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
+	rows, err := p.db.QueryContext(session.requestContext(),
+		`SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at, max_count
 FROM groups WHERE disabled_at = 0 AND ( `+strings.Join(statements, " OR ")+" )",
 		params...)
 	if err != nil {
@@ -399,12 +462,12 @@ func (p *pipeline) groupsList(logger *zap.Logger, session *session, envelope *En
 
 	params = append(params, limit+1)
 	query := `
-SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at
+SELECT id, creator_id, name, description, avatar_url, lang, utc_offset_ms, metadata, state, count, created_at, updated_at, max_count
 FROM groups WHERE ` + cursorQuery + " " + filterQuery + " disabled_at = 0" + `
 ORDER BY count ` + orderBy + " " + `
 LIMIT $` + strconv.Itoa(len(params))
 
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(session.requestContext(), query, params...)
 	if err != nil {
 		logger.Error("Could not list groups", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list groups"))
@@ -506,7 +569,9 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 	privateGroup := false
 	adminUserIDs := make([][]byte, 0)
 
-	tx, err := p.db.Begin()
+	code := RUNTIME_EXCEPTION
+	failureReason := "Could not join group"
+	tx, err := p.db.BeginTx(session.requestContext(), nil)
 	if err != nil {
 		logger.Error("Could not add user to group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
@@ -520,7 +585,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 				logger.Error("Could not rollback transaction", zap.Error(err))
 			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not join group"))
+			session.Send(ErrorMessage(envelope.CollationId, code, failureReason))
 		} else {
 			err = tx.Commit()
 			if err != nil {
@@ -564,7 +629,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 						}
 					}
 
-					err = p.notificationService.NotificationSend(notifications)
+					err = p.notificationService.NotificationSend(session.requestContext(), notifications)
 					if err != nil {
 						logger.Warn("Failed to send group join request notification", zap.Error(err))
 					}
@@ -574,7 +639,7 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 	}()
 
 	var groupState sql.NullInt64
-	err = tx.QueryRow("SELECT state, name FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupState, &groupName)
+	err = tx.QueryRowContext(session.requestContext(), "SELECT state, name FROM groups WHERE id = $1 AND disabled_at = 0", groupID.Bytes()).Scan(&groupState, &groupName)
 	if err != nil {
 		return
 	}
@@ -585,7 +650,30 @@ func (p *pipeline) groupJoin(l *zap.Logger, session *session, envelope *Envelope
 		userState = 2
 	}
 
-	res, err := tx.Exec(`
+	banned, err := groupUserBanned(tx, groupID.Bytes(), session.userID.Bytes())
+	if err != nil {
+		return
+	}
+	if banned {
+		code = GROUP_USER_BANNED
+		failureReason = "You are banned from this group"
+		err = errors.New("User is banned from group")
+		return
+	}
+
+	// Users who recently left or were kicked must wait for their cooldown to expire.
+	cooldown, err := groupCooldownActive(tx, groupID.Bytes(), session.userID.Bytes(), ts)
+	if err != nil {
+		return
+	}
+	if cooldown {
+		code = GROUP_JOIN_COOLDOWN
+		failureReason = "Cannot rejoin group yet, please wait for the cooldown to expire"
+		err = errors.New("Cannot rejoin group yet, cooldown is active")
+		return
+	}
+
+	res, err := tx.ExecContext(session.requestContext(), `
 INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
 VALUES ($1, $2, $2, $3, $4), ($3, $2, $2, $1, $4)`,
 		groupID.Bytes(), ts, session.userID.Bytes(), userState)
@@ -601,15 +689,26 @@ VALUES ($1, $2, $2, $3, $4), ($3, $2, $2, $1, $4)`,
 
 	// If the group is not private and the user joined directly, increase the group count.
 	if !privateGroup {
-		_, err = tx.Exec("UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1", groupID.Bytes(), ts)
-	}
-	if err != nil {
-		return
+		res, err = tx.ExecContext(session.requestContext(), "UPDATE groups SET count = count + 1, updated_at = $2 WHERE id = $1 AND count < max_count", groupID.Bytes(), ts)
+		if err != nil {
+			return
+		}
+		if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
+			code = GROUP_FULL
+			failureReason = "Group has reached its maximum member count"
+			err = errors.New("Group has reached its maximum member count")
+			return
+		}
+
+		err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_JOIN, session.userID.Bytes(), session.userID.Bytes(), nil, ts)
+		if err != nil {
+			return
+		}
 	}
 
 	// If group is private, look up admin user IDs to notify about a new user requesting to join.
 	if privateGroup {
-		rows, e := tx.Query("SELECT destination_id FROM group_edge WHERE source_id = $1 AND state = 0", groupID.Bytes())
+		rows, e := tx.QueryContext(session.requestContext(), "SELECT destination_id FROM group_edge WHERE source_id = $1 AND state = 0", groupID.Bytes())
 		if e != nil {
 			logger.Warn("Failed to send group join request notification", zap.Error(e))
 			return
@@ -649,7 +748,9 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 
 	code := RUNTIME_EXCEPTION
 	failureReason := "Could not leave group"
-	tx, err := p.db.Begin()
+	var promotedID []byte
+	var promotedHandle string
+	tx, err := p.db.BeginTx(session.requestContext(), nil)
 	if err != nil {
 		logger.Error("Could not leave group", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
@@ -677,6 +778,15 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 				if err != nil {
 					logger.Error("Error handling group user leave notification topic message", zap.Error(err))
 				}
+
+				if promotedID != nil {
+					uid, _ := uuid.FromBytes(promotedID)
+					data, _ := json.Marshal(map[string]string{"user_id": uid.String(), "handle": promotedHandle})
+					err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 5, data)
+					if err != nil {
+						logger.Error("Error handling group user promoted notification topic message", zap.Error(err))
+					}
+				}
 			}
 		}
 	}()
@@ -685,7 +795,7 @@ func (p *pipeline) groupLeave(l *zap.Logger, session *session, envelope *Envelop
 	// and if this wasn't an invitation then
 	// look to see if the user is an admin
 	// and remove the user from group and update group count
-	res, err := tx.Exec(`
+	res, err := tx.ExecContext(session.requestContext(), `
 DELETE FROM group_edge
 WHERE
 	(source_id = $1 AND destination_id = $2 AND state = 2)
@@ -702,29 +812,7 @@ OR
 		return
 	}
 
-	var adminCount sql.NullInt64
-	err = tx.QueryRow(`
-SELECT COUNT(source_id)	FROM group_edge
-WHERE
-	source_id = $1 AND state = 0
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0)`,
-		groupID.Bytes(), session.userID.Bytes()).Scan(&adminCount)
-
-	if err != nil {
-		return
-	}
-
-	if adminCount.Int64 == 1 {
-		code = GROUP_LAST_ADMIN
-		failureReason = "Cannot leave group when you are the last group admin"
-		err = errors.New("Cannot leave group when you are the last group admin")
-		return
-	}
-
-	res, err = tx.Exec(`
+	res, err = tx.ExecContext(session.requestContext(), `
 DELETE FROM group_edge
 WHERE
 	(source_id = $1 AND destination_id = $2)
@@ -742,10 +830,24 @@ OR
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
+	ts := nowMs()
+	_, err = tx.ExecContext(session.requestContext(), `UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, ts, groupID.Bytes())
 	if err != nil {
 		return
 	}
+
+	err = groupCooldownStart(tx, groupID.Bytes(), session.userID.Bytes(), ts, p.config.GetSocial().Group.RejoinCooldownMs)
+	if err != nil {
+		return
+	}
+
+	err = groupHistoryAdd(tx, groupID.Bytes(), GROUP_HISTORY_LEAVE, session.userID.Bytes(), session.userID.Bytes(), nil, ts)
+	if err != nil {
+		return
+	}
+
+	// If the last admin just left, hand the group over to the next member in line.
+	promotedID, promotedHandle, err = groupAdminSuccession(tx, groupID.Bytes(), ts)
 }
 
 func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envelope) {
@@ -772,117 +874,131 @@ func (p *pipeline) groupUserAdd(l *zap.Logger, session *session, envelope *Envel
 	}
 
 	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
-	ts := nowMs()
-	var handle string
-	var name string
 
-	tx, err := p.db.Begin()
+	handle, name, code, err := GroupUsersAdd(logger, p.db, session.userID, groupID, userID)
 	if err != nil {
-		logger.Error("Could not add user to group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not add user to group", zap.Error(err))
-			} else {
-				logger.Warn("Could not add user to group", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not add user to group"))
-			} else {
-				logger.Info("Added user to the group")
-				session.Send(&Envelope{CollationId: envelope.CollationId})
+	session.Send(&Envelope{CollationId: envelope.CollationId})
 
-				data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 2, data)
-				if err != nil {
-					logger.Error("Error handling group user added notification topic message", zap.Error(err))
-					return
-				}
+	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 2, data)
+	if err != nil {
+		logger.Error("Error handling group user added notification topic message", zap.Error(err))
+		return
+	}
 
-				adminHandle := session.handle.Load()
-				content, err := json.Marshal(map[string]string{"handle": adminHandle, "name": name})
-				if err != nil {
-					logger.Warn("Failed to send group add notification", zap.Error(err))
-					return
-				}
-				err = p.notificationService.NotificationSend([]*NNotification{
-					&NNotification{
-						Id:         uuid.NewV4().Bytes(),
-						UserID:     userID.Bytes(),
-						Subject:    fmt.Sprintf("%v has added you to group %v", adminHandle, name),
-						Content:    content,
-						Code:       NOTIFICATION_GROUP_ADD,
-						SenderID:   session.userID.Bytes(),
-						CreatedAt:  ts,
-						ExpiresAt:  ts + p.notificationService.expiryMs,
-						Persistent: true,
-					},
-				})
-				if err != nil {
-					logger.Warn("Failed to send group add notification", zap.Error(err))
-				}
-			}
-		}
-	}()
+	adminHandle := session.handle.Load()
+	content, err := json.Marshal(map[string]string{"handle": adminHandle, "name": name})
+	if err != nil {
+		logger.Warn("Failed to send group add notification", zap.Error(err))
+		return
+	}
+	ts := nowMs()
+	err = p.notificationService.NotificationSend(session.requestContext(), []*NNotification{
+		&NNotification{
+			Id:         uuid.NewV4().Bytes(),
+			UserID:     userID.Bytes(),
+			Subject:    fmt.Sprintf("%v has added you to group %v", adminHandle, name),
+			Content:    content,
+			Code:       NOTIFICATION_GROUP_ADD,
+			SenderID:   session.userID.Bytes(),
+			CreatedAt:  ts,
+			ExpiresAt:  ts + p.notificationService.expiryMs,
+			Persistent: true,
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to send group add notification", zap.Error(err))
+	}
+}
+
+func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Envelope) {
+	// TODO Force kick the user out.
+	e := envelope.GetGroupUsersKick()
 
-	// Look up the user being added.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&handle)
+	if len(e.GroupUsers) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one item must be present"))
+		return
+	} else if len(e.GroupUsers) > 1 {
+		l.Warn("There are more than one item passed to the request - only processing the first item.")
+	}
+
+	g := e.GroupUsers[0]
+
+	groupID, err := uuid.FromBytes(g.GroupId)
 	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
 		return
 	}
 
-	// Look up the name of the group.
-	err = tx.QueryRow("SELECT name FROM groups WHERE id = $1", groupID.Bytes()).Scan(&name)
+	userID, err := uuid.FromBytes(g.UserId)
 	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is not valid"))
 		return
 	}
 
-	res, err := tx.Exec(`
-INSERT INTO group_edge (source_id, position, updated_at, destination_id, state)
-SELECT data.id, data.position, data.updated_at, data.destination, data.state
-FROM (
-  SELECT $1::BYTEA AS id, $2::INT AS position, $2::INT AS updated_at, $3::BYTEA AS destination, 1 AS state
-  UNION ALL
-  SELECT $3::BYTEA AS id, $2::INT AS position, $2::INT AS updated_at, $1::BYTEA AS destination, 1 AS state
-) AS data
-WHERE
-  EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1::BYTEA AND destination_id = $4::BYTEA AND state = 0)
-AND
-  EXISTS (SELECT id FROM groups WHERE id = $1::BYTEA AND disabled_at = 0)
-ON CONFLICT (source_id, destination_id)
-DO UPDATE SET state = 1, updated_at = $2::INT`,
-		groupID.Bytes(), ts, userID.Bytes(), session.userID.Bytes())
+	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
 
+	handle, code, err := GroupUsersKick(logger, p.db, session.userID, groupID, userID, p.config.GetSocial().Group.RejoinCooldownMs)
 	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	if affectedRows, _ := res.RowsAffected(); affectedRows == 0 {
-		err = errors.New("Could not add user to group. Group may not exists or you may not be group admin")
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 4, data)
+	if err != nil {
+		logger.Error("Error handling group user kicked notification topic message", zap.Error(err))
+	}
+}
+
+func (p *pipeline) groupUserPromote(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupUsersPromote()
+
+	if len(e.GroupUsers) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one item must be present"))
+		return
+	} else if len(e.GroupUsers) > 1 {
+		l.Warn("There are more than one item passed to the request - only processing the first item.")
+	}
+
+	g := e.GroupUsers[0]
+	groupID, err := uuid.FromBytes(g.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
+
+	userID, err := uuid.FromBytes(g.UserId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is not valid"))
 		return
 	}
 
-	_, err = tx.Exec(`UPDATE groups SET count = count + 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
+	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	handle, code, err := GroupUsersPromote(logger, p.db, session.userID, groupID, userID)
 	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
+
+	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 5, data)
+	if err != nil {
+		logger.Error("Error handling group user promoted notification topic message", zap.Error(err))
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
-func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Envelope) {
-	// TODO Force kick the user out.
-	e := envelope.GetGroupUsersKick()
+func (p *pipeline) groupUserBan(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupUsersBan()
 
 	if len(e.GroupUsers) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one item must be present"))
@@ -892,7 +1008,46 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Enve
 	}
 
 	g := e.GroupUsers[0]
+	groupID, err := uuid.FromBytes(g.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
 
+	userID, err := uuid.FromBytes(g.UserId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is not valid"))
+		return
+	}
+
+	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	handle, code, err := GroupUsersBan(logger, p.db, session.userID, groupID, userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 6, data)
+	if err != nil {
+		logger.Error("Error handling group user banned notification topic message", zap.Error(err))
+	}
+}
+
+func (p *pipeline) groupUserUnban(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupUsersUnban()
+
+	if len(e.GroupUsers) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one item must be present"))
+		return
+	} else if len(e.GroupUsers) > 1 {
+		l.Warn("There are more than one item passed to the request - only processing the first item.")
+	}
+
+	g := e.GroupUsers[0]
 	groupID, err := uuid.FromBytes(g.GroupId)
 	if err != nil {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
@@ -905,96 +1060,88 @@ func (p *pipeline) groupUserKick(l *zap.Logger, session *session, envelope *Enve
 		return
 	}
 
-	if userID == session.userID {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "You can't kick yourself from the group"))
+	code, err := GroupUsersUnban(l, p.db, session.userID, groupID, userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
-	var handle string
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) groupUsersBannedList(logger *zap.Logger, session *session, envelope *Envelope) {
+	g := envelope.GetGroupUsersBannedList()
 
-	failureReason := "Could not kick user from group"
-	tx, err := p.db.Begin()
+	groupID, err := uuid.FromBytes(g.GroupId)
 	if err != nil {
-		logger.Error("Could not kick user from group", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
 		return
 	}
-	defer func() {
-		if err != nil {
-			if _, ok := err.(*pq.Error); ok {
-				logger.Error("Could not kick user from group", zap.Error(err))
-			} else {
-				logger.Warn("Could not kick user from group", zap.Error(err))
-			}
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("Could not rollback transaction", zap.Error(err))
-			}
 
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				logger.Error("Could not commit transaction", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
-			} else {
-				logger.Info("Kicked user from group")
-				session.Send(&Envelope{CollationId: envelope.CollationId})
+	users, code, err := GroupBannedUsersList(logger, p.db, session.userID, groupID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
 
-				data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-				err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 4, data)
-				if err != nil {
-					logger.Error("Error handling group user kicked notification topic message", zap.Error(err))
-				}
-			}
-		}
-	}()
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_GroupBannedUsers{GroupBannedUsers: &TGroupBannedUsers{Users: users}}})
+}
 
-	// Check the user's group_edge state. If it's a pending join request being rejected then no need to decrement the group count.
-	var userState int64
-	err = tx.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", groupID.Bytes(), userID.Bytes()).Scan(&userState)
+func (p *pipeline) groupTransferOwnership(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupTransferOwnership()
 
-	res, err := tx.Exec(`
-DELETE FROM group_edge
-WHERE
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	(
-		(source_id = $1 AND destination_id = $2)
-	OR
-		(source_id = $2 AND destination_id = $1)
-	)`, groupID.Bytes(), userID.Bytes(), session.userID.Bytes())
+	groupID, err := uuid.FromBytes(e.GroupId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
+		return
+	}
 
+	userID, err := uuid.FromBytes(e.UserId)
 	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is not valid"))
 		return
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		failureReason = "Cannot kick from group - Make sure user is part of the group and is admin or group exists"
-		err = errors.New("Cannot kick from group - Make sure user is part of the group and is admin or group exists")
+	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+
+	handle, code, err := GroupTransferOwnership(logger, p.db, session.userID, groupID, userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	// Join requests aren't reflected in group count.
-	if userState != 2 {
-		_, err = tx.Exec(`UPDATE groups SET count = count - 1, updated_at = $1 WHERE id = $2`, nowMs(), groupID.Bytes())
-		if err != nil {
-			return
-		}
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 7, data)
+	if err != nil {
+		logger.Error("Error handling group ownership transfer notification topic message", zap.Error(err))
 	}
+}
+
+func (p *pipeline) groupHistoryList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupHistoryList()
 
-	// Look up the user being kicked. Allow kicking disabled users.
-	err = tx.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+	groupID, err := uuid.FromBytes(e.GroupId)
 	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
 		return
 	}
+
+	entries, cursor, code, err := GroupHistoryList(logger, p.db, session.userID, groupID, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_GroupHistory{GroupHistory: &TGroupHistory{
+		Entries: entries,
+		Cursor:  cursor,
+	}}})
 }
 
-func (p *pipeline) groupUserPromote(l *zap.Logger, session *session, envelope *Envelope) {
-	e := envelope.GetGroupUsersPromote()
+func (p *pipeline) groupUserInvite(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupUsersInvite()
 
 	if len(e.GroupUsers) == 0 {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one item must be present"))
@@ -1016,50 +1163,64 @@ func (p *pipeline) groupUserPromote(l *zap.Logger, session *session, envelope *E
 		return
 	}
 
-	if userID == session.userID {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "You can't promote yourself"))
-		return
-	}
-
 	logger := l.With(zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
 
-	res, err := p.db.Exec(`
-UPDATE group_edge SET state = 0, updated_at = $4
-WHERE
-	EXISTS (SELECT source_id FROM group_edge WHERE source_id = $1 AND destination_id = $3 AND state = 0)
-AND
-	EXISTS (SELECT id FROM groups WHERE id = $1 AND disabled_at = 0)
-AND
-	(
-		(source_id = $1 AND destination_id = $2)
-	OR
-		(source_id = $2 AND destination_id = $1)
-	)`, groupID.Bytes(), userID.Bytes(), session.userID.Bytes(), nowMs())
-
+	expiryMs := p.config.GetSocial().Group.InviteExpiryMs
+	name, code, err := GroupUsersInvite(logger, p.db, session.userID, groupID, userID, expiryMs)
 	if err != nil {
-		logger.Warn("Could not promote user", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not promote user"))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		logger.Warn("Could not promote user - Make sure user is part of the group or group exists")
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not promote user - Make sure user is part of the group or group exists"))
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	adminHandle := session.handle.Load()
+	content, err := json.Marshal(map[string]string{"handle": adminHandle, "name": name, "group_id": groupID.String()})
+	if err != nil {
+		logger.Warn("Failed to send group invite notification", zap.Error(err))
 		return
 	}
+	ts := nowMs()
+	err = p.notificationService.NotificationSend(session.requestContext(), []*NNotification{
+		&NNotification{
+			Id:         uuid.NewV4().Bytes(),
+			UserID:     userID.Bytes(),
+			Subject:    fmt.Sprintf("%v has invited you to join group %v", adminHandle, name),
+			Content:    content,
+			Code:       NOTIFICATION_GROUP_INVITE,
+			SenderID:   session.userID.Bytes(),
+			CreatedAt:  ts,
+			ExpiresAt:  ts + expiryMs,
+			Persistent: true,
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to send group invite notification", zap.Error(err))
+	}
+}
 
-	// Look up the user being promoted. Allow promoting disabled users as long as they're still part of the group.
-	var handle string
-	err = p.db.QueryRow("SELECT handle FROM users WHERE id = $1", userID.Bytes()).Scan(&handle)
+func (p *pipeline) groupInviteAccept(l *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGroupInviteAccept()
+
+	groupID, err := uuid.FromBytes(e.GroupId)
 	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID is not valid"))
 		return
 	}
 
-	data, _ := json.Marshal(map[string]string{"user_id": userID.String(), "handle": handle})
-	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 5, data)
+	logger := l.With(zap.String("group_id", groupID.String()))
+
+	code, err := GroupInviteAccept(logger, p.db, session.userID, groupID)
 	if err != nil {
-		logger.Error("Error handling group user promoted notification topic message", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
 	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	data, _ := json.Marshal(map[string]string{"user_id": session.userID.String(), "handle": session.handle.Load()})
+	err = p.storeAndDeliverMessage(logger, session, &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}, 2, data)
+	if err != nil {
+		logger.Error("Error handling group user added notification topic message", zap.Error(err))
+	}
 }
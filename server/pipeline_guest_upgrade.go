@@ -0,0 +1,177 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (p *pipeline) guestUpgrade(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetGuestUpgrade()
+
+	// Check the login with its provider first, the same as a link would.
+	var provider string
+	var providerID string
+	var password []byte
+	var afterUpgrade func()
+	switch e.Id.(type) {
+	case *TGuestUpgrade_Email:
+		email := e.GetEmail()
+		if email == nil || email.Email == "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Email address is required"))
+			return
+		} else if invalidCharsRegex.MatchString(email.Email) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid email address, no spaces or control characters allowed"))
+			return
+		} else if !emailRegex.MatchString(email.Email) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid email address format"))
+			return
+		} else if len(email.Email) < 10 || len(email.Email) > 255 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid email address, must be 10-255 bytes"))
+			return
+		} else if len(email.Password) < 8 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Password must be longer than 8 characters"))
+			return
+		}
+		provider = "email"
+		providerID = strings.ToLower(email.Email)
+		password, _ = bcrypt.GenerateFromPassword([]byte(email.Password), bcrypt.DefaultCost)
+		afterUpgrade = func() {
+			// Sent in the background so a slow mail server does not hold up the session.
+			go func() {
+				if _, err := EmailVerificationSend(logger, p.db, p.config, p.mailer, session.userID); err != nil {
+					logger.Warn("Could not send email verification", zap.Error(err))
+				}
+			}()
+		}
+	case *TGuestUpgrade_Facebook:
+		accessToken := e.GetFacebook()
+		if accessToken == "" || invalidCharsRegex.MatchString(accessToken) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Facebook access token, no spaces or control characters allowed"))
+			return
+		}
+		fbProfile, err := p.socialClient.GetFacebookProfile(accessToken)
+		if err != nil {
+			logger.Warn("Could not get Facebook profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Facebook profile"))
+			return
+		}
+		provider = "facebook"
+		providerID = fbProfile.ID
+		afterUpgrade = func() {
+			p.addFacebookFriends(logger, session.userID.Bytes(), session.handle.Load(), fbProfile.ID, accessToken)
+		}
+	case *TGuestUpgrade_Google:
+		accessToken := e.GetGoogle()
+		if accessToken == "" || invalidCharsRegex.MatchString(accessToken) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Google access token, no spaces or control characters allowed"))
+			return
+		}
+		googleProfile, err := p.socialClient.GetGoogleProfile(accessToken)
+		if err != nil {
+			logger.Warn("Could not get Google profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Google profile"))
+			return
+		}
+		provider = "google"
+		providerID = googleProfile.ID
+	case *TGuestUpgrade_GameCenter:
+		gc := e.GetGameCenter()
+		if gc == nil || gc.PlayerId == "" || gc.BundleId == "" || gc.Timestamp == 0 || gc.Salt == "" || gc.Signature == "" || gc.PublicKeyUrl == "" {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Game Center credentials required"))
+			return
+		}
+		if _, err := p.socialClient.CheckGameCenterID(gc.PlayerId, gc.BundleId, gc.Timestamp, gc.Salt, gc.Signature, gc.PublicKeyUrl); err != nil {
+			logger.Warn("Could not get Game Center profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Game Center profile"))
+			return
+		}
+		provider = "gamecenter"
+		providerID = gc.PlayerId
+	case *TGuestUpgrade_Steam:
+		steamConfig := p.config.GetSocial().Steam
+		if steamConfig.PublisherKey == "" || steamConfig.AppID == 0 {
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Steam link not available"))
+			return
+		}
+		ticket := e.GetSteam()
+		if ticket == "" || invalidCharsRegex.MatchString(ticket) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Steam ticket, no spaces or control characters allowed"))
+			return
+		}
+		steamProfile, err := p.socialClient.GetSteamProfile(steamConfig.PublisherKey, steamConfig.AppID, ticket)
+		if err != nil {
+			logger.Warn("Could not get Steam profile", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not get Steam profile"))
+			return
+		}
+		provider = "steam"
+		providerID = strconv.FormatUint(steamProfile.SteamID, 10)
+		if steamConfig.ImportFriends {
+			afterUpgrade = func() {
+				p.addSteamFriends(logger, session.userID.Bytes(), session.handle.Load(), steamProfile.SteamID)
+			}
+		}
+	case *TGuestUpgrade_Custom:
+		customID := e.GetCustom()
+		if invalidCharsRegex.MatchString(customID) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid custom ID, no spaces or control characters allowed"))
+			return
+		} else if len(customID) < 10 || len(customID) > 128 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid custom ID, must be 10-128 bytes"))
+			return
+		}
+		provider = "custom"
+		providerID = customID
+	case *TGuestUpgrade_Apple:
+		if p.config.GetSocial().Apple.BundleID == "" {
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Apple link not available"))
+			return
+		}
+		token := e.GetApple()
+		if token == "" || invalidCharsRegex.MatchString(token) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Apple identity token, no spaces or control characters allowed"))
+			return
+		}
+		appleProfile, err := p.socialClient.CheckAppleToken(p.config.GetSocial().Apple.BundleID, token)
+		if err != nil {
+			logger.Warn("Could not check Apple identity token", zap.Error(err))
+			session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not check Apple identity token"))
+			return
+		}
+		provider = "apple"
+		providerID = appleProfile.ID
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "A login to link is required"))
+		return
+	}
+
+	if code, err := GuestUpgrade(logger, p.db, session.userID, e.Handle, provider, providerID, password); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.handle.Store(e.Handle)
+	if afterUpgrade != nil {
+		afterUpgrade()
+	}
+
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, provider)
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
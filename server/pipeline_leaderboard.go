@@ -40,6 +40,13 @@ type leaderboardRecordListCursor struct {
 	Id        []byte
 }
 
+type leaderboardRecordArchiveCursor struct {
+	Score     int64
+	UpdatedAt int64
+	Id        []byte
+	Rank      int64
+}
+
 func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardsList()
 
@@ -51,93 +58,9 @@ func (p *pipeline) leaderboardsList(logger *zap.Logger, session *session, envelo
 		return
 	}
 
-	query := "SELECT id, authoritative, sort_order, count, reset_schedule, metadata, next_id, prev_id FROM leaderboard"
-	params := []interface{}{}
-
-	if len(incoming.Cursor) != 0 {
-		var incomingCursor leaderboardCursor
-		if err := gob.NewDecoder(bytes.NewReader(incoming.Cursor)).Decode(&incomingCursor); err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid cursor data"))
-			return
-		}
-		query += " WHERE id > $1"
-		params = append(params, incomingCursor.Id)
-	}
-
-	if len(incoming.GetFilterLeaderboardId()) != 0 {
-		statements := make([]string, 0)
-		for _, filterId := range incoming.GetFilterLeaderboardId() {
-			params = append(params, filterId)
-			statement := "$" + strconv.Itoa(len(params))
-			statements = append(statements, statement)
-		}
-
-		if len(incoming.Cursor) != 0 {
-			query += " AND "
-		}
-
-		query += " WHERE id IN (" + strings.Join(statements, ", ") + ")"
-	}
-
-	params = append(params, limit+1)
-	query += " LIMIT $" + strconv.Itoa(len(params))
-
-	logger.Debug("Leaderboards list", zap.String("query", query))
-	rows, err := p.db.Query(query, params...)
+	leaderboards, outgoingCursor, code, err := LeaderboardsList(logger, p.db, session.userID, incoming.GetFilterLeaderboardId(), limit, incoming.Cursor)
 	if err != nil {
-		logger.Error("Could not execute leaderboards list query", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list leaderboards"))
-		return
-	}
-	defer rows.Close()
-
-	leaderboards := []*Leaderboard{}
-	var outgoingCursor []byte
-
-	var id []byte
-	var authoritative bool
-	var sortOrder int64
-	var count int64
-	var resetSchedule sql.NullString
-	var metadata []byte
-	var nextId []byte
-	var prevId []byte
-	for rows.Next() {
-		if int64(len(leaderboards)) >= limit {
-			cursorBuf := new(bytes.Buffer)
-			newCursor := &leaderboardCursor{
-				Id: id,
-			}
-			if gob.NewEncoder(cursorBuf).Encode(newCursor); err != nil {
-				logger.Error("Error creating leaderboards list cursor", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list leaderboards"))
-				return
-			}
-			outgoingCursor = cursorBuf.Bytes()
-			break
-		}
-
-		err = rows.Scan(&id, &authoritative, &sortOrder, &count, &resetSchedule, &metadata, &nextId, &prevId)
-		if err != nil {
-			logger.Error("Could not scan leaderboards list query results", zap.Error(err))
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list leaderboards"))
-			return
-		}
-
-		leaderboards = append(leaderboards, &Leaderboard{
-			Id:            id,
-			Authoritative: authoritative,
-			Sort:          sortOrder,
-			Count:         count,
-			ResetSchedule: resetSchedule.String,
-			Metadata:      metadata,
-			NextId:        nextId,
-			PrevId:        prevId,
-		})
-	}
-	if err = rows.Err(); err != nil {
-		logger.Error("Could not process leaderboards list query results", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list leaderboards"))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
@@ -188,6 +111,12 @@ func (p *pipeline) leaderboardRecordWrite(logger *zap.Logger, session *session,
 	case *TLeaderboardRecordsWrite_LeaderboardRecordWrite_Best:
 		op = "best"
 		value = incoming.GetBest()
+	case *TLeaderboardRecordsWrite_LeaderboardRecordWrite_MetadataOnly:
+		if !incoming.GetMetadataOnly() {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata only flag must be set"))
+			return
+		}
+		op = "metadata"
 	case nil:
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "No leaderboard record write operator found"))
 		return
@@ -196,7 +125,14 @@ func (p *pipeline) leaderboardRecordWrite(logger *zap.Logger, session *session,
 		return
 	}
 
-	record, code, err := leaderboardSubmit(logger, p.db, session.userID, incoming.LeaderboardId, session.userID, session.handle.Load(), session.lang, op, value, incoming.Location, incoming.Timezone, incoming.Metadata)
+	if op != "metadata" {
+		if code, err := leaderboardSubmitScreen(logger, p.db, p.runtime, session, incoming.LeaderboardId, op, value); err != nil {
+			session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+			return
+		}
+	}
+
+	record, code, err := leaderboardSubmit(logger, p.db, p.leaderboardRankCache, session.userID, incoming.LeaderboardId, session.userID, session.handle.Load(), session.lang, op, value, incoming.Location, incoming.Timezone, incoming.Metadata)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
@@ -262,7 +198,7 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 	query += " LIMIT $" + strconv.Itoa(len(params))
 
 	logger.Debug("Leaderboard records fetch", zap.String("query", query))
-	rows, err := p.db.Query(query, params...)
+	rows, err := p.db.QueryContext(session.requestContext(), query, params...)
 	if err != nil {
 		logger.Error("Could not execute leaderboard records fetch query", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error loading leaderboard records"))
@@ -326,6 +262,9 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 			UpdatedAt:     updatedAt,
 			ExpiresAt:     expiresAt,
 		})
+		if rank := p.leaderboardRankCache.Get(leaderboardId, expiresAt, ownerId); rank != 0 {
+			leaderboardRecords[len(leaderboardRecords)-1].Rank = rank
+		}
 	}
 	if err = rows.Err(); err != nil {
 		logger.Error("Could not process leaderboard records fetch query results", zap.Error(err))
@@ -342,7 +281,22 @@ func (p *pipeline) leaderboardRecordsFetch(logger *zap.Logger, session *session,
 func (p *pipeline) leaderboardRecordsList(logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetLeaderboardRecordsList()
 
-	leaderboardRecords, outgoingCursor, code, err := leaderboardRecordsList(logger, p.db, session.userID, incoming)
+	leaderboardRecords, outgoingCursor, code, err := leaderboardRecordsList(logger, p.db, p.leaderboardRankCache, session.userID, incoming)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{LeaderboardRecords: &TLeaderboardRecords{
+		Records: leaderboardRecords,
+		Cursor:  outgoingCursor,
+	}}})
+}
+
+func (p *pipeline) leaderboardRecordsListArchive(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetLeaderboardRecordsListArchive()
+
+	leaderboardRecords, outgoingCursor, code, err := leaderboardRecordsListArchive(logger, p.db, session.userID, incoming)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
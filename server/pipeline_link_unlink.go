@@ -40,6 +40,8 @@ func (p *pipeline) linkID(logger *zap.Logger, session *session, envelope *Envelo
 		p.linkEmail(logger, session, envelope)
 	case *TLink_Custom:
 		p.linkCustom(logger, session, envelope)
+	case *TLink_Apple:
+		p.linkApple(logger, session, envelope)
 	default:
 		logger.Error("Could not link", zap.String("error", "Invalid payload"))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
@@ -60,7 +62,7 @@ func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
-	txn, err := p.db.Begin()
+	txn, err := p.db.BeginTx(session.requestContext(), nil)
 	if err != nil {
 		logger.Warn("Could not link, transaction begin error", zap.Error(err))
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not link"))
@@ -114,6 +116,7 @@ func (p *pipeline) linkDevice(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "device")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -136,7 +139,7 @@ func (p *pipeline) linkFacebook(logger *zap.Logger, session *session, envelope *
 
 	userID := session.userID.Bytes()
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET facebook_id = $2, updated_at = $3
 WHERE id = $1
@@ -157,6 +160,7 @@ AND NOT EXISTS
 
 	p.addFacebookFriends(logger, userID, session.handle.Load(), fbProfile.ID, accessToken)
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "facebook")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -177,7 +181,7 @@ func (p *pipeline) linkGoogle(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET google_id = $2, updated_at = $3
 WHERE id = $1
@@ -198,6 +202,7 @@ AND NOT EXISTS
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "google")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -215,7 +220,7 @@ func (p *pipeline) linkGameCenter(logger *zap.Logger, session *session, envelope
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET gamecenter_id = $2, updated_at = $3
 WHERE id = $1
@@ -236,6 +241,7 @@ AND NOT EXISTS
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "gamecenter")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -261,7 +267,7 @@ func (p *pipeline) linkSteam(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET steam_id = $2, updated_at = $3
 WHERE id = $1
@@ -282,6 +288,58 @@ AND NOT EXISTS
 		return
 	}
 
+	if p.config.GetSocial().Steam.ImportFriends {
+		p.addSteamFriends(logger, session.userID.Bytes(), session.handle.Load(), steamProfile.SteamID)
+	}
+
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "steam")
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) linkApple(logger *zap.Logger, session *session, envelope *Envelope) {
+	if p.config.GetSocial().Apple.BundleID == "" {
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Apple link not available"))
+		return
+	}
+
+	token := envelope.GetLink().GetApple()
+	if token == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Apple identity token is required"))
+		return
+	} else if invalidCharsRegex.MatchString(token) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid Apple identity token, no spaces or control characters allowed"))
+		return
+	}
+
+	appleProfile, err := p.socialClient.CheckAppleToken(p.config.GetSocial().Apple.BundleID, token)
+	if err != nil {
+		logger.Warn("Could not check Apple identity token", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_PROVIDER_UNAVAILABLE, "Could not check Apple identity token"))
+		return
+	}
+
+	res, err := p.db.ExecContext(session.requestContext(), `
+UPDATE users
+SET apple_id = $2, updated_at = $3
+WHERE id = $1
+AND NOT EXISTS
+    (SELECT id
+     FROM users
+     WHERE apple_id = $2)`,
+		session.userID.Bytes(),
+		appleProfile.ID,
+		nowMs())
+
+	if err != nil {
+		logger.Warn("Could not link", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not link"))
+		return
+	} else if count, _ := res.RowsAffected(); count == 0 {
+		session.Send(ErrorMessage(envelope.CollationId, USER_LINK_INUSE, "Apple ID in use"))
+		return
+	}
+
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "apple")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -309,7 +367,7 @@ func (p *pipeline) linkEmail(logger *zap.Logger, session *session, envelope *Env
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(email.Password), bcrypt.DefaultCost)
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET email = $2, password = $3, updated_at = $4
 WHERE id = $1
@@ -331,7 +389,15 @@ AND NOT EXISTS
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "email")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	// Sent in the background so a slow mail server does not hold up the session.
+	go func() {
+		if _, err := EmailVerificationSend(logger, p.db, p.config, p.mailer, session.userID); err != nil {
+			logger.Warn("Could not send email verification", zap.Error(err))
+		}
+	}()
 }
 
 func (p *pipeline) linkCustom(logger *zap.Logger, session *session, envelope *Envelope) {
@@ -347,7 +413,7 @@ func (p *pipeline) linkCustom(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
-	res, err := p.db.Exec(`
+	res, err := p.db.ExecContext(session.requestContext(), `
 UPDATE users
 SET custom_id = $2, updated_at = $3
 WHERE id = $1
@@ -368,6 +434,7 @@ AND NOT EXISTS
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_LINK, "custom")
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
@@ -375,9 +442,10 @@ func (p *pipeline) unlinkID(logger *zap.Logger, session *session, envelope *Enve
 	// Select correct unlink query
 	var query string
 	var param interface{}
+	var provider string
 	switch envelope.GetUnlink().Id.(type) {
 	case *TUnlink_Device:
-		txn, err := p.db.Begin()
+		txn, err := p.db.BeginTx(session.requestContext(), nil)
 		if err != nil {
 			logger.Warn("Could not unlink, transaction begin error", zap.Error(err))
 			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not unlink"))
@@ -391,7 +459,8 @@ AND (EXISTS (SELECT id FROM users WHERE id = $1 AND
        OR gamecenter_id IS NOT NULL
        OR steam_id IS NOT NULL
        OR email IS NOT NULL
-       OR custom_id IS NOT NULL))
+       OR custom_id IS NOT NULL
+       OR apple_id IS NOT NULL))
      OR EXISTS (SELECT id FROM user_device WHERE user_id = $1 AND id <> $2))`,
 			session.userID.Bytes(),
 			envelope.GetUnlink().GetDevice())
@@ -437,6 +506,7 @@ AND (EXISTS (SELECT id FROM users WHERE id = $1 AND
 			return
 		}
 
+		p.authHistoryAdd(logger, session, AUTH_HISTORY_UNLINK, "device")
 		session.Send(&Envelope{CollationId: envelope.CollationId})
 		return
 	case *TUnlink_Facebook:
@@ -447,10 +517,12 @@ AND ((google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetFacebook()
+		provider = "facebook"
 	case *TUnlink_Google:
 		query = `UPDATE users SET google_id = NULL, updated_at = $3
 WHERE id = $1
@@ -459,10 +531,12 @@ AND ((facebook_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetGoogle()
+		provider = "google"
 	case *TUnlink_GameCenter:
 		query = `UPDATE users SET gamecenter_id = NULL, updated_at = $3
 WHERE id = $1
@@ -471,10 +545,12 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR steam_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetGameCenter()
+		provider = "gamecenter"
 	case *TUnlink_Steam:
 		query = `UPDATE users SET steam_id = NULL, updated_at = $3
 WHERE id = $1
@@ -483,10 +559,12 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR email IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetSteam()
+		provider = "steam"
 	case *TUnlink_Email:
 		query = `UPDATE users SET email = NULL, password = NULL, updated_at = $3
 WHERE id = $1
@@ -495,10 +573,12 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
-      OR custom_id IS NOT NULL)
+      OR custom_id IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = strings.ToLower(envelope.GetUnlink().GetEmail())
+		provider = "email"
 	case *TUnlink_Custom:
 		query = `UPDATE users SET custom_id = NULL, updated_at = $3
 WHERE id = $1
@@ -507,17 +587,33 @@ AND ((facebook_id IS NOT NULL
       OR google_id IS NOT NULL
       OR gamecenter_id IS NOT NULL
       OR steam_id IS NOT NULL
-      OR email IS NOT NULL)
+      OR email IS NOT NULL
+      OR apple_id IS NOT NULL)
      OR
      EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
 		param = envelope.GetUnlink().GetCustom()
+		provider = "custom"
+	case *TUnlink_Apple:
+		query = `UPDATE users SET apple_id = NULL, updated_at = $3
+WHERE id = $1
+AND apple_id = $2
+AND ((facebook_id IS NOT NULL
+      OR google_id IS NOT NULL
+      OR gamecenter_id IS NOT NULL
+      OR steam_id IS NOT NULL
+      OR email IS NOT NULL
+      OR custom_id IS NOT NULL)
+     OR
+     EXISTS (SELECT id FROM user_device WHERE user_id = $1 LIMIT 1))`
+		param = envelope.GetUnlink().GetApple()
+		provider = "apple"
 	default:
 		logger.Error("Could not unlink", zap.String("error", "Invalid payload"))
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid payload"))
 		return
 	}
 
-	res, err := p.db.Exec(query, session.userID.Bytes(), param, nowMs())
+	res, err := p.db.ExecContext(session.requestContext(), query, session.userID.Bytes(), param, nowMs())
 
 	if err != nil {
 		logger.Warn("Could not unlink", zap.Error(err))
@@ -528,5 +624,14 @@ AND ((facebook_id IS NOT NULL
 		return
 	}
 
+	p.authHistoryAdd(logger, session, AUTH_HISTORY_UNLINK, provider)
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
+
+// authHistoryAdd records a link or unlink made over the session's socket. Failures are only logged, the change itself
+// has already been made.
+func (p *pipeline) authHistoryAdd(logger *zap.Logger, session *session, eventType int64, provider string) {
+	if err := authHistoryAdd(p.db, session.userID.Bytes(), eventType, provider, session.clientIP, session.userAgent, nowMs()); err != nil {
+		logger.Warn("Could not add auth history", zap.Error(err))
+	}
+}
@@ -16,6 +16,7 @@ package server
 
 import (
 	"fmt"
+	"time"
 	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
@@ -29,13 +30,39 @@ type matchDataFilter struct {
 }
 
 func (p *pipeline) matchCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMatchCreate()
+	if maxSize := p.config.GetMatch().LabelMaxSizeBytes; maxSize > 0 && int64(len(e.Label)) > maxSize {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, fmt.Sprintf("Match label must be at most %v bytes", maxSize)))
+		return
+	}
+
+	_, matches, _ := p.sessionCounts(session)
+	if sessionLimitReached(session, envelope, matches, p.config.GetSession().MaxMatches, "matches") {
+		return
+	}
+
 	matchID := uuid.NewV4()
 
+	// Recording must start before the creator is tracked, so they are recorded as being in the match.
+	record := e.Record
+	if record {
+		if err := p.matchRecorder.Start(matchID, session.userID); err != nil {
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not start match recording"))
+			return
+		}
+	}
+
 	handle := session.handle.Load()
 
 	p.tracker.Track(session.id, "match:"+matchID.String(), session.userID, PresenceMeta{
 		Handle: handle,
 	})
+	p.matchRegistry.SetHost(matchID, Presence{
+		ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+		UserID: session.userID,
+		Topic:  "match:" + matchID.String(),
+		Meta:   PresenceMeta{Handle: handle},
+	}, e.Label)
 
 	self := &UserPresence{
 		UserId:    session.userID.Bytes(),
@@ -45,8 +72,11 @@ func (p *pipeline) matchCreate(logger *zap.Logger, session *session, envelope *E
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Match{Match: &TMatch{Match: &Match{
 		MatchId:   matchID.Bytes(),
+		Host:      self,
 		Presences: []*UserPresence{self},
 		Self:      self,
+		Recording: record,
+		Label:     e.Label,
 	}}}})
 }
 
@@ -112,42 +142,112 @@ func (p *pipeline) matchJoin(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 
-	topic := "match:" + matchID.String()
-
-	ps := p.tracker.ListByTopic(topic)
-	if !allowEmpty && len(ps) == 0 {
-		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
+	if node, ok := p.matchRegistry.Remote(matchID); ok {
+		session.Send(ErrorMessage(envelope.CollationId, WRONG_NODE, fmt.Sprintf("Match is held by node %v", node)))
 		return
 	}
 
-	handle := session.handle.Load()
+	topic := "match:" + matchID.String()
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, topic, session.userID) {
+		_, matches, _ := p.sessionCounts(session)
+		if sessionLimitReached(session, envelope, matches, p.config.GetSession().MaxMatches, "matches") {
+			return
+		}
+	}
 
-	p.tracker.Track(session.id, topic, session.userID, PresenceMeta{
-		Handle: handle,
-	})
+	meta := PresenceMeta{Handle: session.handle.Load(), Spectator: e.Spectator}
+
+	var ps []Presence
+	if mh := p.matchRegistry.Get(matchID); mh != nil {
+		// Authoritative matches decide for themselves who may join, and track the presence if accepted.
+		accepted, reason := mh.JoinAttempt(Presence{
+			ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+			UserID: session.userID,
+			Topic:  topic,
+			Meta:   meta,
+		})
+		if !accepted {
+			if reason == "" {
+				reason = "Match join rejected"
+			}
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_JOIN_REJECTED, reason))
+			return
+		}
+
+		// List everyone else in the match, the joining user is added below.
+		for _, presence := range p.tracker.ListByTopic(topic) {
+			if presence.ID.SessionID != session.id {
+				ps = append(ps, presence)
+			}
+		}
+	} else {
+		ps = p.tracker.ListByTopic(topic)
+		// A disconnected host may rejoin their match even if everyone else has left, spectators may not.
+		if !allowEmpty && len(ps) == 0 && (e.Spectator || !p.matchRegistry.CanRejoin(matchID, session.userID)) {
+			session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
+			return
+		}
+
+		p.tracker.Track(session.id, topic, session.userID, meta)
+		if !e.Spectator {
+			p.matchRegistry.Joined(matchID, Presence{
+				ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+				UserID: session.userID,
+				Topic:  topic,
+				Meta:   meta,
+			})
+		}
+	}
 
 	userPresences := make([]*UserPresence, len(ps)+1)
+	var size, spectators int64
 	for i := 0; i < len(ps); i++ {
 		p := ps[i]
 		userPresences[i] = &UserPresence{
 			UserId:    p.UserID.Bytes(),
 			SessionId: p.ID.SessionID.Bytes(),
 			Handle:    p.Meta.Handle,
+			Spectator: p.Meta.Spectator,
+		}
+		if p.Meta.Spectator {
+			spectators++
+		} else {
+			size++
 		}
 	}
 	self := &UserPresence{
 		UserId:    session.userID.Bytes(),
 		SessionId: session.id.Bytes(),
-		Handle:    handle,
+		Handle:    meta.Handle,
+		Spectator: meta.Spectator,
 	}
 	userPresences[len(ps)] = self
+	if meta.Spectator {
+		spectators++
+	} else {
+		size++
+	}
+
+	var host *UserPresence
+	if h, ok := p.matchRegistry.Host(matchID); ok {
+		host = &UserPresence{
+			UserId:    h.UserID.Bytes(),
+			SessionId: h.ID.SessionID.Bytes(),
+			Handle:    h.Meta.Handle,
+		}
+	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Matches{Matches: &TMatches{
 		Matches: []*Match{
 			&Match{
-				MatchId:   matchID.Bytes(),
-				Presences: userPresences,
-				Self:      self,
+				MatchId:    matchID.Bytes(),
+				Presences:  userPresences,
+				Self:       self,
+				Host:       host,
+				Size:       size,
+				Spectators: spectators,
+				Recording:  p.matchRecorder.Recording(matchID),
+				Label:      p.matchRegistry.Label(matchID),
 			},
 		},
 	}}})
@@ -191,11 +291,39 @@ func (p *pipeline) matchLeave(logger *zap.Logger, session *session, envelope *En
 		return
 	}
 
+	// Leaving deliberately hands over hosting straight away, there is no grace period to rejoin.
+	p.matchRegistry.HostLeave(matchID, session.id)
 	p.tracker.Untrack(session.id, topic, session.userID)
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
+func (p *pipeline) matchesList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMatchesList()
+
+	if e.MinSize < 0 || e.MaxSize < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Size filters must be >= 0"))
+		return
+	}
+
+	query, err := ParseMatchmakerQuery(e.Query)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	matches, cursor, code, err := p.matchRegistry.List(e.Limit, e.Cursor, e.Label, e.Handler, query, e.MinSize, e.MaxSize)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Matches{Matches: &TMatches{
+		Matches: matches,
+		Cursor:  cursor,
+	}}})
+}
+
 func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetMatchDataSend()
 	matchIDBytes := incoming.MatchId
@@ -204,6 +332,30 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 		return
 	}
 	topic := "match:" + matchID.String()
+
+	if allowed, disconnect := session.matchData.Allow(p.config.GetMatch(), matchID, len(incoming.Data), time.Now()); !allowed {
+		if disconnect {
+			logger.Warn("Disconnecting session for repeatedly exceeding match data limits", zap.String("match_id", matchID.String()))
+			p.sessionRegistry.remove(session)
+			session.close()
+			return
+		}
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_DATA_REJECTED, "Match data exceeds size or rate limit"))
+		return
+	}
+
+	if mh := p.matchRegistry.Get(matchID); mh != nil {
+		// Authoritative matches receive client data on their next tick rather than relaying it. Spectators can't
+		// send data to the match handler.
+		for _, presence := range p.tracker.ListByTopicUser(topic, session.userID) {
+			if presence.ID.SessionID == session.id && !presence.Meta.Spectator {
+				mh.QueueData(presence, incoming.OpCode, incoming.Data)
+				break
+			}
+		}
+		return
+	}
+
 	filterPresences := false
 	var filters []*matchDataFilter
 	if len(incoming.Presences) != 0 {
@@ -230,6 +382,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 	}
 
 	senderFound := false
+	senderSpectator := false
 	for i := 0; i < len(ps); i++ {
 		p := ps[i]
 		if p.ID.SessionID == session.id && p.UserID == session.userID {
@@ -237,6 +390,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 			ps[i] = ps[len(ps)-1]
 			ps = ps[:len(ps)-1]
 			senderFound = true
+			senderSpectator = p.Meta.Spectator
 			if !filterPresences {
 				break
 			} else {
@@ -268,6 +422,24 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 		return
 	}
 
+	p.matchRecorder.Record(matchID, Presence{
+		ID:     PresenceID{Node: p.config.GetName(), SessionID: session.id},
+		UserID: session.userID,
+		Topic:  topic,
+		Meta:   PresenceMeta{Handle: session.handle.Load(), Spectator: senderSpectator},
+	}, incoming.OpCode, incoming.Data)
+
+	// Spectators may only talk among themselves.
+	if senderSpectator {
+		spectators := make([]Presence, 0, len(ps))
+		for _, presence := range ps {
+			if presence.Meta.Spectator {
+				spectators = append(spectators, presence)
+			}
+		}
+		ps = spectators
+	}
+
 	// Check if there are any recipients left.
 	if len(ps) == 0 {
 		return
@@ -281,6 +453,7 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 					UserId:    session.userID.Bytes(),
 					SessionId: session.id.Bytes(),
 					Handle:    session.handle.Load(),
+					Spectator: senderSpectator,
 				},
 				OpCode: incoming.OpCode,
 				Data:   incoming.Data,
@@ -290,3 +463,78 @@ func (p *pipeline) matchDataSend(logger *zap.Logger, session *session, envelope
 
 	p.messageRouter.Send(logger, ps, outgoing)
 }
+
+func (p *pipeline) datagramBind(logger *zap.Logger, session *session, envelope *Envelope) {
+	if !p.datagramServer.enabled() {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Datagrams are not enabled"))
+		return
+	}
+
+	binding, err := p.datagramServer.bind(session, envelope.GetDatagramBind().ReliableOpCodes, p.processRequest)
+	if err != nil {
+		logger.Error("Could not bind session to datagrams", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_EXCEPTION, "Could not bind session to datagrams"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_DatagramBinding{DatagramBinding: binding}})
+}
+
+func (p *pipeline) matchLabelUpdate(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMatchLabelUpdate()
+
+	matchID, err := uuid.FromBytes(e.MatchId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+		return
+	}
+
+	if node, ok := p.matchRegistry.Remote(matchID); ok {
+		session.Send(ErrorMessage(envelope.CollationId, WRONG_NODE, fmt.Sprintf("Match is held by node %v", node)))
+		return
+	}
+
+	if code, err := p.matchRegistry.UpdateLabel(matchID, session.id, e.Label); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) matchReplayList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMatchReplayList()
+
+	replays, cursor, code, err := MatchReplayList(logger, p.db, session.userID, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchReplays{MatchReplays: &TMatchReplays{
+		Replays: replays,
+		Cursor:  cursor,
+	}}})
+}
+
+func (p *pipeline) matchReplayDownload(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMatchReplayDownload()
+
+	matchID, err := uuid.FromBytes(e.MatchId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+		return
+	}
+
+	frames, cursor, code, err := MatchReplayDownload(logger, p.db, session.userID, matchID, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchReplayFrames{MatchReplayFrames: &TMatchReplayFrames{
+		MatchId: e.MatchId,
+		Frames:  frames,
+		Cursor:  cursor,
+	}}})
+}
@@ -15,6 +15,8 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -22,6 +24,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// Most regions a matchmaking ticket may give latencies for.
+const matchmakeMaxLatencies = 32
+
 func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *Envelope) {
 	matchmakeAdd := envelope.GetMatchmakeAdd()
 	requiredCount := matchmakeAdd.RequiredCount
@@ -30,8 +35,105 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 		return
 	}
 
+	properties := matchmakeProperties(matchmakeAdd.Properties)
+	filters, err := matchmakeFilters(matchmakeAdd.Filters)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+	query, err := ParseMatchmakerQuery(matchmakeAdd.Query)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	if len(matchmakeAdd.Latencies) > matchmakeMaxLatencies {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, fmt.Sprintf("At most %v latencies may be given", matchmakeMaxLatencies)))
+		return
+	}
+	var latencies map[string]int64
+	for _, latency := range matchmakeAdd.Latencies {
+		if latency.Region == "" || latency.RttMs < 0 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Latencies must have a region and a round trip time >= 0"))
+			return
+		}
+		if latencies == nil {
+			latencies = make(map[string]int64, len(matchmakeAdd.Latencies))
+		}
+		latencies[latency.Region] = latency.RttMs
+	}
+
+	teamCount := matchmakeAdd.TeamCount
+	if teamCount < 0 || teamCount > requiredCount || (teamCount > 1 && requiredCount%teamCount != 0) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Team count must evenly divide the required count"))
+		return
+	}
+
+	timeoutSec := matchmakeAdd.TimeoutSec
+	if timeoutSec < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Timeout must be >= 0"))
+		return
+	}
+	if maxTimeoutSec := p.config.GetMatchmaker().TicketTimeoutSec; maxTimeoutSec > 0 && (timeoutSec == 0 || timeoutSec > maxTimeoutSec) {
+		timeoutSec = maxTimeoutSec
+	}
+
+	matchmakerProfile := &MatchmakerProfile{
+		Meta:          PresenceMeta{Handle: session.handle.Load()},
+		RequiredCount: int(requiredCount),
+		Properties:    properties,
+		Filters:       filters,
+		Query:         query,
+		Timeout:       time.Duration(timeoutSec) * time.Second,
+		Latencies:     latencies,
+		MaxRttSpread:  p.config.GetMatchmaker().MaxRttSpreadMs,
+		TeamCount:     int(teamCount),
+		TeamProperty:  matchmakeAdd.TeamProperty,
+	}
+
+	var partyID uuid.UUID
+	if len(matchmakeAdd.PartyId) != 0 {
+		partyID, err = uuid.FromBytes(matchmakeAdd.PartyId)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid party ID"))
+			return
+		}
+		members, code, err := p.partyRegistry.MatchmakeMembers(partyID, session.id, session.userID)
+		if err != nil {
+			session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+			return
+		}
+		if int64(len(members)+1) > requiredCount {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Party has more members than the required count"))
+			return
+		}
+		matchmakerProfile.Members = members
+	}
+
+	if sessionLimitReached(session, envelope, p.matchmaker.CountBySession(session.id), p.config.GetSession().MaxMatchmakerTickets, "matchmaker tickets") {
+		return
+	}
+
+	ticket, selected, props := p.matchmaker.Add(session.id, session.userID, matchmakerProfile)
+	if partyID != uuid.Nil && selected == nil {
+		p.partyRegistry.SetTicket(partyID, ticket)
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchmakeTicket{MatchmakeTicket: &TMatchmakeTicket{
+		Ticket: ticket.Bytes(),
+	}}})
+
+	if selected == nil {
+		return
+	}
+
+	// Dedicated server allocation may take a while, don't hold up the session.
+	go matchmakeMatched(logger, p.hmacSecretByte, p.messageRouter, p.matchAllocator, uuid.NewV4(), matchmakeRegion(selected), selected, props)
+}
+
+func matchmakeProperties(pairs []*PropertyPair) map[string]interface{} {
 	properties := make(map[string]interface{}, 0)
-	for _, pair := range matchmakeAdd.Properties {
+	for _, pair := range pairs {
 		switch v := pair.Value.(type) {
 		case *PropertyPair_BoolValue:
 			properties[pair.Key] = v.BoolValue
@@ -41,51 +143,87 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 			properties[pair.Key] = uniqueList(v.StringSet.Values)
 		}
 	}
+	return properties
+}
 
+func matchmakeFilters(matchmakeFilters []*MatchmakeFilter) (map[string]MatchmakerFilter, error) {
 	filters := make(map[string]MatchmakerFilter)
-	for _, filter := range matchmakeAdd.Filters {
+	for _, filter := range matchmakeFilters {
 		switch v := filter.Value.(type) {
 		case *MatchmakeFilter_Check:
 			filters[filter.Name] = &MatchmakerBoolFilter{v.Check}
 		case *MatchmakeFilter_Range:
-			filters[filter.Name] = &MatchmakerRangeFilter{v.Range.LowerBound, v.Range.UpperBound}
+			if v.Range.ExpandStep < 0 || v.Range.ExpandIntervalSec < 0 || v.Range.ExpandLimit < 0 {
+				return nil, errors.New("Range filter expansion values must be >= 0")
+			}
+			if v.Range.ExpandStep > 0 && v.Range.ExpandIntervalSec > 0 {
+				filters[filter.Name] = &MatchmakerExpandingRangeFilter{
+					MatchmakerRangeFilter: MatchmakerRangeFilter{v.Range.LowerBound, v.Range.UpperBound},
+					Step:                  v.Range.ExpandStep,
+					Interval:              time.Duration(v.Range.ExpandIntervalSec) * time.Second,
+					Limit:                 v.Range.ExpandLimit,
+				}
+			} else {
+				filters[filter.Name] = &MatchmakerRangeFilter{v.Range.LowerBound, v.Range.UpperBound}
+			}
 		case *MatchmakeFilter_Term:
 			filters[filter.Name] = &MatchmakerTermFilter{uniqueList(v.Term.Terms), v.Term.MatchAllTerms}
 		}
 	}
+	return filters, nil
+}
 
-	matchmakerProfile := &MatchmakerProfile{
-		Meta:          PresenceMeta{Handle: session.handle.Load()},
-		RequiredCount: int(requiredCount),
-		Properties:    properties,
-		Filters:       filters,
+// matchmakeRegion picks the region for a new match from the matched users' latencies.
+func matchmakeRegion(selected map[MatchmakerKey]*MatchmakerProfile) string {
+	profiles := make([]*MatchmakerProfile, 0, len(selected))
+	for _, profile := range selected {
+		profiles = append(profiles, profile)
 	}
-	ticket, selected, props := p.matchmaker.Add(session.id, session.userID, matchmakerProfile)
-
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchmakeTicket{MatchmakeTicket: &TMatchmakeTicket{
-		Ticket: ticket.Bytes(),
-	}}})
+	region, _ := MatchmakerRegion(profiles)
+	return region
+}
 
-	if selected == nil {
-		return
+// matchmakeProfilePresences lists the ticket's user and any party members matchmaking with them.
+func matchmakeProfilePresences(mk MatchmakerKey, mp *MatchmakerProfile) []*UserPresence {
+	ps := []*UserPresence{&UserPresence{
+		UserId:    mk.UserID.Bytes(),
+		SessionId: mk.ID.SessionID.Bytes(),
+		Handle:    mp.Meta.Handle,
+	}}
+	for _, member := range mp.Members {
+		ps = append(ps, &UserPresence{
+			UserId:    member.UserID.Bytes(),
+			SessionId: member.ID.SessionID.Bytes(),
+			Handle:    member.Meta.Handle,
+		})
 	}
+	return ps
+}
+
+// matchmakeMatched sends each matched user a notification with a token they can use to join the match, and the
+// dedicated server hosting it if the allocator could get one.
+func matchmakeMatched(logger *zap.Logger, hmacSecretByte []byte, messageRouter MessageRouter, allocator *MatchAllocator, matchID uuid.UUID, region string, selected map[MatchmakerKey]*MatchmakerProfile, props []*MatchmakerAcceptedProperty) {
+	server := allocator.Allocate(matchID, region, selected)
 
-	matchID := uuid.NewV4()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"mid": matchID.String(),
 		"exp": time.Now().UTC().Add(30 * time.Second).Unix(),
 	})
-	signedToken, _ := token.SignedString(p.hmacSecretByte)
+	signedToken, _ := token.SignedString(hmacSecretByte)
 
-	idx := 0
-	ps := make([]*UserPresence, len(selected))
+	ps := make([]*UserPresence, 0, len(selected))
 	for mk, mp := range selected {
-		ps[idx] = &UserPresence{
-			UserId:    mk.UserID.Bytes(),
-			SessionId: mk.ID.SessionID.Bytes(),
-			Handle:    mp.Meta.Handle,
+		ps = append(ps, matchmakeProfilePresences(mk, mp)...)
+	}
+
+	var teams []*MatchmakeMatched_Team
+	for _, keys := range MatchmakerTeams(selected) {
+		team := &MatchmakeMatched_Team{Presences: make([]*UserPresence, 0, len(keys))}
+		for _, mk := range keys {
+			team.Presences = append(team.Presences, matchmakeProfilePresences(mk, selected[mk])...)
+			team.Total += MatchmakerTeamTotal(selected[mk])
 		}
-		idx++
+		teams = append(teams, team)
 	}
 
 	protoProps := make([]*MatchmakeMatched_UserProperty, 0)
@@ -95,6 +233,9 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 			Properties: make([]*PropertyPair, 0),
 			Filters:    make([]*MatchmakeFilter, 0),
 		}
+		if prop.Query != nil {
+			protoProp.Query = prop.Query.Query
+		}
 		protoProps = append(protoProps, protoProp)
 
 		for userPropertyKey, userPropertyValue := range prop.Properties {
@@ -119,7 +260,16 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 				filter.Value = &MatchmakeFilter_Term{&MatchmakeFilter_TermFilter{f.Terms, f.AllTerms}}
 			case RANGE:
 				f := userFilterValue.(*MatchmakerRangeFilter)
-				filter.Value = &MatchmakeFilter_Range{&MatchmakeFilter_RangeFilter{f.LowerBound, f.UpperBound}}
+				filter.Value = &MatchmakeFilter_Range{&MatchmakeFilter_RangeFilter{LowerBound: f.LowerBound, UpperBound: f.UpperBound}}
+			case EXPANDING_RANGE:
+				f := userFilterValue.(*MatchmakerExpandingRangeFilter)
+				filter.Value = &MatchmakeFilter_Range{&MatchmakeFilter_RangeFilter{
+					LowerBound:        f.LowerBound,
+					UpperBound:        f.UpperBound,
+					ExpandStep:        f.Step,
+					ExpandIntervalSec: int64(f.Interval / time.Second),
+					ExpandLimit:       f.Limit,
+				}}
 			case BOOL:
 				f := userFilterValue.(*MatchmakerBoolFilter)
 				filter.Value = &MatchmakeFilter_Check{f.Value}
@@ -132,6 +282,9 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 		Token:      []byte(signedToken),
 		Presences:  ps,
 		Properties: protoProps,
+		Region:     region,
+		Server:     server,
+		Teams:      teams,
 		// Self:   ..., // Set individually below for each recipient.
 	}}}
 	for mk, mp := range selected {
@@ -150,7 +303,18 @@ func (p *pipeline) matchmakeAdd(logger *zap.Logger, session *session, envelope *
 			Handle:    mp.Meta.Handle,
 		}
 
-		p.messageRouter.Send(logger, to, outgoing)
+		messageRouter.Send(logger, to, outgoing)
+
+		// Party members share the ticket of the member who entered the party into the matchmaker.
+		for _, member := range mp.Members {
+			outgoing.GetMatchmakeMatched().Self = &UserPresence{
+				UserId:    member.UserID.Bytes(),
+				SessionId: member.ID.SessionID.Bytes(),
+				Handle:    member.Meta.Handle,
+			}
+
+			messageRouter.Send(logger, []Presence{member}, outgoing)
+		}
 	}
 }
 
@@ -171,6 +335,86 @@ func (p *pipeline) matchmakeRemove(logger *zap.Logger, session *session, envelop
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
 
+func (p *pipeline) matchmakeStatus(logger *zap.Logger, session *session, envelope *Envelope) {
+	ticketBytes := envelope.GetMatchmakeStatus().Ticket
+	ticket, err := uuid.FromBytes(ticketBytes)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid ticket"))
+		return
+	}
+
+	status, err := p.matchmaker.Status(session.id, session.userID, ticket)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Ticket not found, matchmaking may already be done"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MatchmakeProgress{MatchmakeProgress: &TMatchmakeProgress{
+		Ticket:           ticketBytes,
+		Position:         int64(status.Position),
+		Waiting:          int64(status.Waiting),
+		ElapsedSec:       int64(status.Elapsed / time.Second),
+		EstimatedWaitSec: int64(status.EstimatedWait / time.Second),
+	}}})
+}
+
+func (p *pipeline) matchmakeBackfill(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetMatchmakeBackfill()
+	matchID, err := uuid.FromBytes(incoming.MatchId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+		return
+	}
+	if incoming.OpenSlots < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Open slots must be >= 0"))
+		return
+	}
+	if incoming.OpenSlots > 0 && incoming.RequiredCount < 2 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Required count must be >= 2"))
+		return
+	}
+
+	filters, err := matchmakeFilters(incoming.Filters)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+	query, err := ParseMatchmakerQuery(incoming.Query)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	// Spectators can't fill the match, and relayed matches are looked after by their host.
+	topic := "match:" + matchID.String()
+	player := false
+	for _, presence := range p.tracker.ListByTopicUser(topic, session.userID) {
+		if presence.ID.SessionID == session.id && !presence.Meta.Spectator {
+			player = true
+			break
+		}
+	}
+	if !player {
+		session.Send(ErrorMessage(envelope.CollationId, MATCH_NOT_FOUND, "Match not found"))
+		return
+	}
+	if host, ok := p.matchRegistry.Host(matchID); ok && host.ID.SessionID != session.id {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Only the match host can backfill a relayed match"))
+		return
+	}
+
+	p.matchmaker.Backfill(matchID, &MatchmakerBackfill{
+		SessionID:     session.id,
+		RequiredCount: int(incoming.RequiredCount),
+		OpenSlots:     int(incoming.OpenSlots),
+		Properties:    matchmakeProperties(incoming.Properties),
+		Filters:       filters,
+		Query:         query,
+	})
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
 func uniqueList(values []string) []string {
 	m := make(map[string]struct{})
 	set := make([]string, 0)
@@ -0,0 +1,59 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "go.uber.org/zap"
+
+func (p *pipeline) mfaEnroll(logger *zap.Logger, session *session, envelope *Envelope) {
+	secret, uri, code, err := MfaEnroll(logger, p.db, session.userID, p.config.GetSession().MfaIssuer, session.handle.Load())
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MfaSecret{MfaSecret: &TMfaSecret{Secret: secret, Uri: uri}}})
+}
+
+func (p *pipeline) mfaConfirm(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMfaConfirm()
+	if e.Code == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Code is required"))
+		return
+	}
+
+	codes, code, err := MfaConfirm(logger, p.db, session.userID, e.Code)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	logger.Info("Enabled multi-factor authentication")
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_MfaRecoveryCodes{MfaRecoveryCodes: &TMfaRecoveryCodes{Codes: codes}}})
+}
+
+func (p *pipeline) mfaDisable(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetMfaDisable()
+	if e.Code == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Code is required"))
+		return
+	}
+
+	if code, err := MfaDisable(logger, p.db, session.userID, e.Code); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
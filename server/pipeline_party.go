@@ -0,0 +1,152 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) partyCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+	maxSize := envelope.GetPartyCreate().MaxSize
+	if maxSize < 0 || maxSize == 1 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Max size must be 0 or >= 2"))
+		return
+	}
+
+	handle := session.handle.Load()
+	partyID := p.partyRegistry.Create(session.id, session.userID, handle, int(maxSize))
+
+	self := &UserPresence{
+		UserId:    session.userID.Bytes(),
+		SessionId: session.id.Bytes(),
+		Handle:    handle,
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Party{Party: &TParty{Party: &Party{
+		PartyId:   partyID.Bytes(),
+		Leader:    self,
+		Presences: []*UserPresence{self},
+		Self:      self,
+		MaxSize:   maxSize,
+	}}}})
+}
+
+func (p *pipeline) partyInvite(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetPartyInvite()
+	partyID, err := uuid.FromBytes(e.PartyId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid party ID"))
+		return
+	}
+	userID, err := uuid.FromBytes(e.UserId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid user ID"))
+		return
+	}
+	if userID == session.userID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot invite self"))
+		return
+	}
+
+	code, err := p.partyRegistry.Invite(partyID, session.id, session.userID, userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) partyJoin(logger *zap.Logger, session *session, envelope *Envelope) {
+	partyID, err := uuid.FromBytes(envelope.GetPartyJoin().PartyId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid party ID"))
+		return
+	}
+
+	if node, ok := p.partyRegistry.Remote(partyID); ok {
+		session.Send(ErrorMessage(envelope.CollationId, WRONG_NODE, fmt.Sprintf("Party is held by node %v", node)))
+		return
+	}
+
+	handle := session.handle.Load()
+	leader, maxSize, code, err := p.partyRegistry.Join(partyID, session.id, session.userID, handle)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	ps := p.tracker.ListByTopic(partyTopic(partyID))
+	userPresences := make([]*UserPresence, len(ps))
+	for i, p := range ps {
+		userPresences[i] = &UserPresence{
+			UserId:    p.UserID.Bytes(),
+			SessionId: p.ID.SessionID.Bytes(),
+			Handle:    p.Meta.Handle,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Party{Party: &TParty{Party: &Party{
+		PartyId: partyID.Bytes(),
+		Leader: &UserPresence{
+			UserId:    leader.UserID.Bytes(),
+			SessionId: leader.ID.SessionID.Bytes(),
+			Handle:    leader.Meta.Handle,
+		},
+		Presences: userPresences,
+		Self: &UserPresence{
+			UserId:    session.userID.Bytes(),
+			SessionId: session.id.Bytes(),
+			Handle:    handle,
+		},
+		MaxSize: int64(maxSize),
+	}}}})
+}
+
+func (p *pipeline) partyLeave(logger *zap.Logger, session *session, envelope *Envelope) {
+	partyID, err := uuid.FromBytes(envelope.GetPartyLeave().PartyId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid party ID"))
+		return
+	}
+
+	code, err := p.partyRegistry.Leave(partyID, session.id, session.userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) partyReadySet(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetPartyReadySet()
+	partyID, err := uuid.FromBytes(e.PartyId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid party ID"))
+		return
+	}
+
+	code, err := p.partyRegistry.SetReady(partyID, session.id, session.userID, session.handle.Load(), e.Ready)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
@@ -27,13 +27,19 @@ func (p *pipeline) rpc(logger *zap.Logger, session *session, envelope *Envelope)
 		return
 	}
 
-	lf := p.runtime.GetRuntimeCallback(RPC, rpcMessage.Id)
-	if lf == nil {
-		session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_NOT_FOUND, "RPC function not found"))
-		return
+	var lf *lua.LFunction
+	var result []byte
+	var fnErr error
+	if gf := p.runtime.GetRuntimeGoRPC(rpcMessage.Id); gf != nil {
+		result, fnErr = p.runtime.InvokeGoFunctionRPC(gf, session.userID, session.handle.Load(), session.expiry.Load(), rpcMessage.Payload)
+	} else {
+		lf = p.runtime.GetRuntimeCallback(RPC, rpcMessage.Id)
+		if lf == nil {
+			session.Send(ErrorMessage(envelope.CollationId, RUNTIME_FUNCTION_NOT_FOUND, "RPC function not found"))
+			return
+		}
+		result, fnErr = p.runtime.InvokeFunctionRPC(lf, session.userID, session.handle.Load(), session.expiry.Load(), rpcMessage.Payload)
 	}
-
-	result, fnErr := p.runtime.InvokeFunctionRPC(lf, session.userID, session.handle.Load(), session.expiry, rpcMessage.Payload)
 	if fnErr != nil {
 		logger.Error("Runtime RPC function caused an error", zap.String("id", rpcMessage.Id), zap.Error(fnErr))
 		if apiErr, ok := fnErr.(*lua.ApiError); ok && !p.config.GetLog().Verbose {
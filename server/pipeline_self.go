@@ -30,6 +30,7 @@ func (p *pipeline) selfFetch(logger *zap.Logger, session *session, envelope *Env
 	var gamecenter sql.NullString
 	var steam sql.NullString
 	var customID sql.NullString
+	var appleID sql.NullString
 	var timezone sql.NullString
 	var location sql.NullString
 	var lang sql.NullString
@@ -42,9 +43,9 @@ func (p *pipeline) selfFetch(logger *zap.Logger, session *session, envelope *Env
 
 	deviceIDs := make([]string, 0)
 
-	rows, err := p.db.Query(`
+	rows, err := p.db.QueryContext(session.requestContext(), `
 SELECT u.handle, u.fullname, u.avatar_url, u.lang, u.location, u.timezone, u.metadata,
-	u.email, u.facebook_id, u.google_id, u.gamecenter_id, u.steam_id, u.custom_id,
+	u.email, u.facebook_id, u.google_id, u.gamecenter_id, u.steam_id, u.custom_id, u.apple_id,
 	u.created_at, u.updated_at, u.verified_at, u.last_online_at,
 	ud.id
 FROM users u
@@ -61,7 +62,7 @@ WHERE u.id = $1`,
 	for rows.Next() {
 		var deviceID sql.NullString
 		err = rows.Scan(&handle, &fullname, &avatarURL, &lang, &location, &timezone, &metadata,
-			&email, &facebook, &google, &gamecenter, &steam, &customID,
+			&email, &facebook, &google, &gamecenter, &steam, &customID, &appleID,
 			&createdAt, &updatedAt, &verifiedAt, &lastOnlineAt, &deviceID)
 		if err != nil {
 			logger.Error("Error reading user profile", zap.Error(err))
@@ -99,12 +100,22 @@ WHERE u.id = $1`,
 		GamecenterId: gamecenter.String,
 		SteamId:      steam.String,
 		CustomId:     customID.String,
+		AppleId:      appleID.String,
 		Verified:     verifiedAt.Int64 > 0,
 	}
 
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Self{Self: &TSelf{Self: s}}})
 }
 
+func (p *pipeline) emailVerificationSend(logger *zap.Logger, session *session, envelope *Envelope) {
+	if code, err := EmailVerificationSend(logger, p.db, p.config, p.mailer, session.userID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
 func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *Envelope) {
 	update := envelope.GetSelfUpdate()
 
@@ -145,3 +156,28 @@ func (p *pipeline) selfUpdate(logger *zap.Logger, session *session, envelope *En
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
+
+func (p *pipeline) selfDelete(logger *zap.Logger, session *session, envelope *Envelope) {
+	if code, err := AccountDelete(logger, p.db, session.userID); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+	p.sessionRegistry.disconnectUser(session.userID, sessionCloseDeleted, "Account deleted")
+}
+
+func (p *pipeline) authHistoryList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetAuthHistoryList()
+
+	entries, cursor, code, err := AuthHistoryList(logger, p.db, session.userID, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_AuthHistory{AuthHistory: &TAuthHistory{
+		Entries: entries,
+		Cursor:  cursor,
+	}}})
+}
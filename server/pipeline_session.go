@@ -0,0 +1,128 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) sessionRefresh(logger *zap.Logger, session *session, envelope *Envelope) {
+	token := envelope.GetSessionRefresh().Token
+	if token == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Session token is required"))
+		return
+	}
+
+	uid, _, exp, refreshID, err := sessionTokenParse(p.hmacSecretByte, token)
+	if err != nil {
+		logger.Warn("Session token invalid", zap.Error(err))
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Invalid session token"))
+		return
+	}
+	if uid != session.userID {
+		session.Send(ErrorMessage(envelope.CollationId, AUTH_ERROR, "Session token is for another user"))
+		return
+	}
+
+	session.expiry.Store(exp)
+	session.refreshID.Store(refreshID)
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) sessionsList(logger *zap.Logger, session *session, envelope *Envelope) {
+	userSessions := p.sessionRegistry.userSessions(session.userID)
+	sessions := make([]*TSessions_Session, 0, len(userSessions))
+	for _, s := range userSessions {
+		sessions = append(sessions, &TSessions_Session{
+			SessionId:   s.id.Bytes(),
+			Current:     s.id == session.id,
+			Lang:        s.lang,
+			ConnectedAt: s.connectedAt,
+		})
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Sessions{Sessions: &TSessions{Sessions: sessions}}})
+}
+
+func (p *pipeline) sessionLogout(logger *zap.Logger, session *session, envelope *Envelope) {
+	sessionID, err := uuid.FromBytes(envelope.GetSessionLogout().SessionId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid session ID"))
+		return
+	}
+	if sessionID == session.id {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Use logout to end the current session"))
+		return
+	}
+
+	other := p.sessionRegistry.Get(sessionID)
+	if other == nil || other.userID != session.userID {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Session not found"))
+		return
+	}
+
+	if refreshID := other.refreshID.Load(); refreshID != "" {
+		if err := RefreshTokenRevoke(p.db, session.userID, refreshID); err != nil {
+			logger.Error("Could not revoke refresh token", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not log out session"))
+			return
+		}
+	}
+	p.sessionRegistry.disconnect(other, sessionCloseLogout, "Session logged out remotely")
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) sessionDebug(logger *zap.Logger, session *session, envelope *Envelope) {
+	topics, matches, tickets := p.sessionCounts(session)
+	config := p.config.GetSession()
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_SessionDebugInfo{SessionDebugInfo: &TSessionDebugInfo{
+		Topics:               int64(topics),
+		MaxTopics:            int64(config.MaxTopics),
+		Matches:              int64(matches),
+		MaxMatches:           int64(config.MaxMatches),
+		MatchmakerTickets:    int64(tickets),
+		MaxMatchmakerTickets: int64(config.MaxMatchmakerTickets),
+	}}})
+}
+
+// sessionCounts returns how many chat topics and matches the session is in, and how many matchmaker tickets it has
+// waiting.
+func (p *pipeline) sessionCounts(session *session) (int, int, int) {
+	var topics, matches int
+	for _, presence := range p.tracker.ListLocalBySession(session.id) {
+		switch {
+		case strings.HasPrefix(presence.Topic, "match:"):
+			matches++
+		case strings.HasPrefix(presence.Topic, "dm:"), strings.HasPrefix(presence.Topic, "room:"), strings.HasPrefix(presence.Topic, "group:"):
+			topics++
+		}
+	}
+	return topics, matches, p.matchmaker.CountBySession(session.id)
+}
+
+// sessionLimitReached reports whether the session already holds as many as the limit allows, sending the error
+// response if so. A limit of 0 disables the check.
+func sessionLimitReached(session *session, envelope *Envelope, count int, limit int, what string) bool {
+	if limit <= 0 || count < limit {
+		return false
+	}
+	session.Send(ErrorMessage(envelope.CollationId, SESSION_LIMIT_REACHED, fmt.Sprintf("Session may hold at most %v %s at once", limit, what)))
+	return true
+}
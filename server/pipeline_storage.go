@@ -53,6 +53,35 @@ func (p *pipeline) storageList(logger *zap.Logger, session *session, envelope *E
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor}}})
 }
 
+func (p *pipeline) storageQuery(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageQuery()
+
+	data, cursor, code, err := StorageQuery(logger, p.db, session.userID, incoming.UserId, incoming.Bucket, incoming.Collection, storageConditions(incoming.Filters), incoming.SortField, incoming.SortDescending, incoming.Limit, incoming.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	storageData := make([]*TStorageData_StorageData, len(data))
+	for i, d := range data {
+		storageData[i] = &TStorageData_StorageData{
+			Bucket:          d.Bucket,
+			Collection:      d.Collection,
+			Record:          d.Record,
+			UserId:          d.UserId,
+			Value:           d.Value,
+			Version:         d.Version,
+			PermissionRead:  int32(d.PermissionRead),
+			PermissionWrite: int32(d.PermissionWrite),
+			CreatedAt:       d.CreatedAt,
+			UpdatedAt:       d.UpdatedAt,
+			ExpiresAt:       d.ExpiresAt,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Cursor: cursor}}})
+}
+
 func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *Envelope) {
 	incoming := envelope.GetStorageFetch()
 	if len(incoming.Keys) == 0 {
@@ -70,7 +99,7 @@ func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *
 		}
 	}
 
-	data, code, err := StorageFetch(logger, p.db, session.userID, keys)
+	data, statuses, code, err := StorageFetchStatus(logger, p.db, session.userID, keys)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
@@ -93,7 +122,12 @@ func (p *pipeline) storageFetch(logger *zap.Logger, session *session, envelope *
 		}
 	}
 
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData}}})
+	keyStatuses := make([]TStorageData_Status, len(statuses))
+	for i, s := range statuses {
+		keyStatuses[i] = storageKeyStatuses[s]
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageData{StorageData: &TStorageData{Data: storageData, Statuses: keyStatuses}}})
 }
 
 func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *Envelope) {
@@ -109,19 +143,22 @@ func (p *pipeline) storageWrite(logger *zap.Logger, session *session, envelope *
 			Bucket:          d.Bucket,
 			Collection:      d.Collection,
 			Record:          d.Record,
-			UserId:          session.userID.Bytes(),
+			UserId:          storageWriteOwner(session, d.UserId),
 			Value:           d.Value,
 			Version:         d.Version,
 			PermissionRead:  int64(d.PermissionRead),
 			PermissionWrite: int64(d.PermissionWrite),
+			Conditions:      storageConditions(d.Conditions),
+			ExpiresAt:       d.ExpiresAt,
 		}
 	}
 
-	keys, code, err := StorageWrite(logger, p.db, session.userID, data)
+	keys, code, err := StorageWrite(logger, p.db, p.config.GetStorage(), session.userID, data)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
+	p.storageFeed.Publish(storageWriteChanges(session.userID, data, keys))
 
 	storageKeys := make([]*TStorageKeys_StorageKey, len(keys))
 	for i, key := range keys {
@@ -159,6 +196,7 @@ func (p *pipeline) storageRemove(logger *zap.Logger, session *session, envelope
 		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
+	p.storageFeed.Publish(storageRemoveChanges(keys))
 
 	session.Send(&Envelope{CollationId: envelope.CollationId})
 }
@@ -175,6 +213,7 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session *session, envelope
 		keyUpdate := &StorageKeyUpdate{
 			PermissionRead:  int64(update.PermissionRead),
 			PermissionWrite: int64(update.PermissionWrite),
+			ExpiresAt:       update.ExpiresAt,
 			Key: &StorageKey{
 				Bucket:     update.Key.Bucket,
 				Collection: update.Key.Collection,
@@ -246,11 +285,12 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session *session, envelope
 		keyUpdates[i] = keyUpdate
 	}
 
-	updatedKeys, errCode, err := StorageUpdate(logger, p.db, session.userID, keyUpdates)
+	updatedKeys, errCode, err := StorageUpdate(logger, p.db, p.config.GetStorage(), session.userID, keyUpdates)
 	if err != nil {
 		session.Send(ErrorMessage(envelope.CollationId, errCode, err.Error()))
 		return
 	}
+	p.storageFeed.Publish(storageUpdateChanges(keyUpdates, updatedKeys))
 
 	storageKeys := make([]*TStorageKeys_StorageKey, len(updatedKeys))
 	for i, key := range updatedKeys {
@@ -263,3 +303,310 @@ func (p *pipeline) storageUpdate(logger *zap.Logger, session *session, envelope
 	}
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}})
 }
+
+func (p *pipeline) storageBatch(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageBatch()
+	if len(incoming.Writes) == 0 && len(incoming.Removes) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "At least one write or remove is required"))
+		return
+	}
+
+	writes := make([]*StorageData, len(incoming.Writes))
+	for i, d := range incoming.Writes {
+		writes[i] = &StorageData{
+			Bucket:          d.Bucket,
+			Collection:      d.Collection,
+			Record:          d.Record,
+			UserId:          storageWriteOwner(session, d.UserId),
+			Value:           d.Value,
+			Version:         d.Version,
+			PermissionRead:  int64(d.PermissionRead),
+			PermissionWrite: int64(d.PermissionWrite),
+			Conditions:      storageConditions(d.Conditions),
+			ExpiresAt:       d.ExpiresAt,
+		}
+	}
+
+	removes := make([]*StorageKey, len(incoming.Removes))
+	for i, key := range incoming.Removes {
+		removes[i] = &StorageKey{
+			Bucket:     key.Bucket,
+			Collection: key.Collection,
+			Record:     key.Record,
+			UserId:     session.userID.Bytes(),
+			Version:    key.Version,
+		}
+	}
+
+	keys, code, err := StorageBatch(logger, p.db, p.config.GetStorage(), session.userID, writes, removes)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+	p.storageFeed.Publish(append(storageRemoveChanges(removes), storageWriteChanges(session.userID, writes, keys)...))
+
+	storageKeys := make([]*TStorageKeys_StorageKey, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = &TStorageKeys_StorageKey{
+			Bucket:     key.Bucket,
+			Collection: key.Collection,
+			Record:     key.Record,
+			Version:    key.Version,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}})
+}
+
+func (p *pipeline) storageAclSet(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageAclSet()
+
+	entries := make([]*StorageAcl, len(incoming.Entries))
+	for i, e := range incoming.Entries {
+		entries[i] = &StorageAcl{
+			UserId:  e.UserId,
+			GroupId: e.GroupId,
+			Read:    e.Read,
+			Write:   e.Write,
+		}
+	}
+
+	key := &StorageKey{
+		Bucket:     incoming.Bucket,
+		Collection: incoming.Collection,
+		Record:     incoming.Record,
+		UserId:     session.userID.Bytes(),
+	}
+	code, err := StorageAclSet(logger, p.db, session.userID, key, entries)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) storageAclFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageAclFetch()
+
+	key := &StorageKey{
+		Bucket:     incoming.Bucket,
+		Collection: incoming.Collection,
+		Record:     incoming.Record,
+		UserId:     session.userID.Bytes(),
+	}
+	entries, code, err := StorageAclFetch(logger, p.db, session.userID, key)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	aclEntries := make([]*TStorageAcl_Entry, len(entries))
+	for i, e := range entries {
+		aclEntries[i] = &TStorageAcl_Entry{
+			UserId:  e.UserId,
+			GroupId: e.GroupId,
+			Read:    e.Read,
+			Write:   e.Write,
+		}
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageAcl{StorageAcl: &TStorageAcl{Entries: aclEntries}}})
+}
+
+func (p *pipeline) storageSubscribe(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageSubscribe()
+	if incoming.Bucket == "" || incoming.Collection == "" {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Bucket and collection are required"))
+		return
+	}
+
+	if incoming.Record != "" {
+		// Subscribing to a record needs read access to it, if it exists.
+		keys := []*StorageKey{&StorageKey{Bucket: incoming.Bucket, Collection: incoming.Collection, Record: incoming.Record, UserId: incoming.UserId}}
+		_, statuses, code, err := StorageFetchStatus(logger, p.db, session.userID, keys)
+		if err != nil {
+			session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+			return
+		}
+		if statuses[0] == StorageKeyDenied {
+			session.Send(ErrorMessage(envelope.CollationId, STORAGE_REJECTED, "Storage record cannot be read"))
+			return
+		}
+	}
+
+	p.storageFeed.Subscribe(session.id, session.userID, session.handle.Load(), incoming.Bucket, incoming.Collection, incoming.UserId, incoming.Record)
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) storageUnsubscribe(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageUnsubscribe()
+
+	p.storageFeed.Unsubscribe(session.id, session.userID, incoming.Bucket, incoming.Collection, incoming.UserId, incoming.Record)
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) storageUploadBegin(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageUploadBegin()
+
+	data := &StorageData{
+		Bucket:          incoming.Bucket,
+		Collection:      incoming.Collection,
+		Record:          incoming.Record,
+		Version:         incoming.Version,
+		PermissionRead:  int64(incoming.PermissionRead),
+		PermissionWrite: int64(incoming.PermissionWrite),
+	}
+	uploadID, code, err := StorageUploadBegin(logger, p.db, p.config.GetStorage(), session.userID, data, incoming.Size)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageUpload{StorageUpload: &TStorageUpload{UploadId: uploadID}}})
+}
+
+func (p *pipeline) storageUploadAppend(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageUploadAppend()
+
+	received, code, err := StorageUploadAppend(logger, p.db, p.config.GetStorage(), session.userID, incoming.UploadId, incoming.Offset, incoming.Data)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageUpload{StorageUpload: &TStorageUpload{UploadId: incoming.UploadId, Received: received}}})
+}
+
+func (p *pipeline) storageUploadCommit(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageUploadCommit()
+
+	data, key, code, err := StorageUploadCommit(logger, p.db, p.config.GetStorage(), session.userID, incoming.UploadId)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+	p.storageFeed.Publish(storageWriteChanges(session.userID, []*StorageData{data}, []*StorageKey{key}))
+
+	storageKeys := []*TStorageKeys_StorageKey{&TStorageKeys_StorageKey{
+		Bucket:     key.Bucket,
+		Collection: key.Collection,
+		Record:     key.Record,
+		Version:    key.Version,
+	}}
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageKeys{StorageKeys: &TStorageKeys{Keys: storageKeys}}})
+}
+
+func (p *pipeline) storageFetchRange(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageFetchRange()
+
+	key := &StorageKey{
+		Bucket:     incoming.Bucket,
+		Collection: incoming.Collection,
+		Record:     incoming.Record,
+		UserId:     incoming.UserId,
+		Version:    incoming.Version,
+	}
+	d, size, code, err := StorageFetchRange(logger, p.db, session.userID, key, incoming.Offset, incoming.Length)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	storageData := &TStorageData_StorageData{
+		Bucket:          d.Bucket,
+		Collection:      d.Collection,
+		Record:          d.Record,
+		UserId:          d.UserId,
+		Value:           d.Value,
+		Version:         d.Version,
+		PermissionRead:  int32(d.PermissionRead),
+		PermissionWrite: int32(d.PermissionWrite),
+		CreatedAt:       d.CreatedAt,
+		UpdatedAt:       d.UpdatedAt,
+		ExpiresAt:       d.ExpiresAt,
+	}
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageRange{StorageRange: &TStorageRange{Data: storageData, Size: size}}})
+}
+
+func (p *pipeline) storageUsageFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+	used, quota, code, err := StorageUsageFetch(logger, p.db, p.config.GetStorage(), session.userID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageUsage{StorageUsage: &TStorageUsage{Bytes: used, QuotaBytes: quota}}})
+}
+
+func (p *pipeline) storageIncrement(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetStorageIncrement()
+
+	key := &StorageKey{
+		Bucket:     incoming.Bucket,
+		Collection: incoming.Collection,
+		Record:     incoming.Record,
+		UserId:     storageWriteOwner(session, incoming.UserId),
+		Version:    incoming.Version,
+	}
+	data, value, code, err := StorageIncrement(logger, p.db, p.config.GetStorage(), session.userID, key, incoming.Field, incoming.Delta, storageConditions(incoming.Conditions))
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+	p.storageFeed.Publish(storageIncrementChanges(session.userID, data))
+
+	storageKey := &TStorageKeys_StorageKey{
+		Bucket:     data.Bucket,
+		Collection: data.Collection,
+		Record:     data.Record,
+		Version:    data.Version,
+	}
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_StorageCounter{StorageCounter: &TStorageCounter{Key: storageKey, Value: value}}})
+}
+
+// storageWriteOwner is the owner of a record the client writes, their own unless they are writing a record shared
+// with them.
+func storageWriteOwner(session *session, userID []byte) []byte {
+	if len(userID) != 0 {
+		return userID
+	}
+	return session.userID.Bytes()
+}
+
+var storageKeyStatuses = map[StorageKeyStatus]TStorageData_Status{
+	StorageKeyFound:   TStorageData_FOUND,
+	StorageKeyDenied:  TStorageData_DENIED,
+	StorageKeyMissing: TStorageData_MISSING,
+}
+
+var storageConditionOps = map[TStorageWrite_Condition_Op]string{
+	TStorageWrite_Condition_EQUAL:            "=",
+	TStorageWrite_Condition_NOT_EQUAL:        "!=",
+	TStorageWrite_Condition_GREATER:          ">",
+	TStorageWrite_Condition_GREATER_OR_EQUAL: ">=",
+	TStorageWrite_Condition_LESS:             "<",
+	TStorageWrite_Condition_LESS_OR_EQUAL:    "<=",
+}
+
+// storageConditions converts write conditions or query filters from the client. Unknown operators and missing values
+// are left for StorageWrite or StorageQuery to reject.
+func storageConditions(incoming []*TStorageWrite_Condition) []*StorageCondition {
+	if len(incoming) == 0 {
+		return nil
+	}
+	conditions := make([]*StorageCondition, 0, len(incoming))
+	for _, c := range incoming {
+		condition := &StorageCondition{Field: c.Field, Op: storageConditionOps[c.Op]}
+		switch v := c.Value.(type) {
+		case *TStorageWrite_Condition_NumberValue:
+			condition.Value = v.NumberValue
+		case *TStorageWrite_Condition_StringValue:
+			condition.Value = v.StringValue
+		case *TStorageWrite_Condition_BoolValue:
+			condition.Value = v.BoolValue
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions
+}
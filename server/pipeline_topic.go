@@ -19,7 +19,10 @@ import (
 	"database/sql"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"regexp"
+	"strconv"
+	"strings"
 	"unicode/utf8"
 
 	"fmt"
@@ -135,6 +138,13 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		return
 	}
 
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
+		topics, _, _ := p.sessionCounts(session)
+		if sessionLimitReached(session, envelope, topics, p.config.GetSession().MaxTopics, "topics") {
+			return
+		}
+	}
+
 	handle := session.handle.Load()
 
 	// Track the presence, and gather current member list.
@@ -159,7 +169,7 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 			if e != nil {
 				logger.Warn("Failed to send topic direct message notification", zap.Error(e))
 			} else {
-				if e := p.notificationService.NotificationSend([]*NNotification{
+				if e := p.notificationService.NotificationSend(session.requestContext(), []*NNotification{
 					&NNotification{
 						Id:         uuid.NewV4().Bytes(),
 						UserID:     dmOtherUserID.Bytes(),
@@ -178,6 +188,21 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 		}
 	}
 
+	topicBytes, topicType := topicStorageKey(topic)
+	unreadCount, lastReadMessageID, err := topicUnreadCount(p.db, session.userID, topicBytes, topicType)
+	if err != nil {
+		// Unread counts are informational, don't fail the join.
+		logger.Warn("Could not count unread topic messages", zap.Error(err))
+	}
+
+	// Joining a direct message topic shows its history, so it counts as reading it. The join still reports what was
+	// unread before.
+	if dmOtherUserID != uuid.Nil {
+		if err := topicReadMarkLatest(p.db, session.userID, topicBytes, topicType); err != nil {
+			logger.Warn("Could not mark topic as read", zap.Error(err))
+		}
+	}
+
 	userPresences := make([]*UserPresence, len(presences))
 	for i := 0; i < len(presences); i++ {
 		userPresences[i] = &UserPresence{
@@ -197,6 +222,8 @@ func (p *pipeline) topicJoin(logger *zap.Logger, session *session, envelope *Env
 					SessionId: session.id.Bytes(),
 					Handle:    handle,
 				},
+				UnreadCount:       unreadCount,
+				LastReadMessageId: lastReadMessageID,
 			},
 		},
 	}}})
@@ -317,93 +344,52 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 		return
 	}
 
-	var trackerTopic string
-	switch topic.Id.(type) {
-	case *TopicId_Dm:
-		// Check input is valid DM topic.
-		bothUserIDBytes := topic.GetDm()
-		if bothUserIDBytes == nil || len(bothUserIDBytes) != 32 {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"))
-			return
-		}
-
-		// Check the DM topic components are valid UUIDs.
-		userID1Bytes := bothUserIDBytes[:16]
-		userID2Bytes := bothUserIDBytes[16:]
-		userID1, err := uuid.FromBytes(userID1Bytes)
-		if err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"))
-			return
-		}
-		userID2, err := uuid.FromBytes(userID2Bytes)
-		if err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"))
-			return
-		}
-
-		// Check the IDs are ordered correctly.
-		userID1String := userID1.String()
-		userID2String := userID2.String()
-		if userID1String > userID2String {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"))
-			return
-		}
+	attachments := envelope.GetTopicMessageSend().Attachments
+	if maxAttachments := p.config.GetSocial().Chat.MaxAttachments; len(attachments) > maxAttachments {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, fmt.Sprintf("At most %v attachments are allowed", maxAttachments)))
+		return
+	}
 
-		// Check one of the users in this DM topic is the current one.
-		if userID1 != session.userID && userID2 != session.userID {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic not valid"))
-			return
-		}
+	trackerTopic, err := validateTopic(session, topic)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
 
-		// Check the DM topic is between two different users.
-		if userID1 == userID2 {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot chat to self"))
-			return
-		}
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before sending messages"))
+		return
+	}
 
-		trackerTopic = "dm:" + userID1String + ":" + userID2String
-	case *TopicId_Room:
-		// Check input is valid room name.
-		room := topic.GetRoom()
-		if room == nil || len(room) < 1 || len(room) > 64 {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name is required and must be 1-64 chars"))
-			return
-		}
-		if controlCharsRegex.Match(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must not contain control chars"))
-			return
-		}
-		if !utf8.Valid(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must only contain valid UTF-8 bytes"))
+	if len(attachments) != 0 {
+		if code, err := p.attachmentsCheck(session.userID, attachments); err != nil {
+			if code == RUNTIME_EXCEPTION {
+				logger.Error("Could not check message attachments", zap.Error(err))
+				err = errors.New("Could not check message attachments")
+			}
+			session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 			return
 		}
+	}
 
-		trackerTopic = "room:" + string(room)
-	case *TopicId_GroupId:
-		// Check input is valid ID.
-		groupIDBytes := topic.GetGroupId()
-		groupID, err := uuid.FromBytes(groupIDBytes)
-		if err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID not valid"))
-			return
+	topicBytes, topicType := topicStorageKey(topic)
+	if code, err := topicModerationReserve(p.db, session.userID, topicBytes, topicType, nowMs()); err != nil {
+		if code == RUNTIME_EXCEPTION {
+			logger.Error("Could not check topic moderation", zap.Error(err))
+			err = errors.New("Could not store message")
 		}
-
-		trackerTopic = "group:" + groupID.String()
-	case nil:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "No topic ID found"))
-		return
-	default:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unrecognized topic ID"))
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
-	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before sending messages"))
+	data, code, err := p.filterMessage(logger, session, trackerTopic, data)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
 		return
 	}
 
 	// Store message to history.
-	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, 0, data)
+	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, 0, data, attachments)
 	if err != nil {
 		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not store message"))
 		return
@@ -419,193 +405,783 @@ func (p *pipeline) topicMessageSend(logger *zap.Logger, session *session, envelo
 	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessageAck{TopicMessageAck: ack}})
 
 	// Deliver message to topic.
-	p.deliverMessage(logger, session, topic, 0, data, messageID, handle, createdAt, expiresAt)
+	p.deliverMessage(logger, session, topic, 0, data, attachments, messageID, handle, createdAt, expiresAt)
+
+	if _, ok := topic.Id.(*TopicId_Dm); ok {
+		p.directMessageSent(logger, session, topic, messageID, createdAt, data)
+	}
 }
 
-func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envelope *Envelope) {
-	input := envelope.GetTopicMessagesList()
-	if input.Id == nil {
+// topicReadMark records that the user has read the topic up to the given message. The read position only moves
+// forward, along with the last read message.
+func topicReadMark(db *sql.DB, userID uuid.UUID, topicBytes []byte, topicType int64, readAt int64, messageID []byte) error {
+	_, err := db.Exec(`
+INSERT INTO topic_read (user_id, topic, topic_type, read_at, message_id) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id, topic_type, topic) DO UPDATE SET read_at = GREATEST(topic_read.read_at, $4),
+message_id = CASE WHEN topic_read.read_at < $4 THEN $5 ELSE topic_read.message_id END`,
+		userID.Bytes(), topicBytes, topicType, readAt, messageID)
+	return err
+}
+
+// topicReadMarkLatest records that the user has read the topic up to its newest message, if it has any.
+func topicReadMarkLatest(db *sql.DB, userID uuid.UUID, topicBytes []byte, topicType int64) error {
+	var createdAt int64
+	var messageID []byte
+	err := db.QueryRow("SELECT created_at, message_id FROM message WHERE topic = $1 AND topic_type = $2 ORDER BY created_at DESC, message_id DESC LIMIT 1", topicBytes, topicType).
+		Scan(&createdAt, &messageID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return topicReadMark(db, userID, topicBytes, topicType, createdAt, messageID)
+}
+
+// topicUnreadCount counts messages from other users after the user's read position, and returns the last read message.
+func topicUnreadCount(db *sql.DB, userID uuid.UUID, topicBytes []byte, topicType int64) (int64, []byte, error) {
+	var readAt int64
+	var messageID []byte
+	err := db.QueryRow("SELECT read_at, message_id FROM topic_read WHERE user_id = $1 AND topic = $2 AND topic_type = $3", userID.Bytes(), topicBytes, topicType).
+		Scan(&readAt, &messageID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+
+	var count int64
+	err = db.QueryRow(`
+SELECT COUNT(message_id) FROM message
+WHERE topic = $1 AND topic_type = $2 AND created_at > $3
+AND user_id <> $4 AND type = 0 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $5)`,
+		topicBytes, topicType, readAt, userID.Bytes(), nowMs()).Scan(&count)
+	if err != nil {
+		return 0, nil, err
+	}
+	return count, messageID, nil
+}
+
+func (p *pipeline) topicMarkRead(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMarkRead()
+	if e.Topic == nil {
 		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
 		return
 	}
-	limit := input.Limit
-	if limit == 0 {
-		limit = 10
+	if len(e.MessageId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"))
+		return
 	}
-	if limit < 10 || limit > 100 {
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Limit must be 10-100"))
+	if _, err := validateTopic(session, e.Topic); err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
 		return
 	}
 
-	var topic *TopicId
-	var topicBytes []byte
-	var topicType int64
-	switch input.Id.(type) {
-	case *TTopicMessagesList_UserId:
-		// Check input is valid ID.
-		otherUserIDBytes := input.GetUserId()
-		otherUserID, err := uuid.FromBytes(otherUserIDBytes)
-		if err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid User ID"))
-			return
-		}
+	topicBytes, topicType := topicStorageKey(e.Topic)
+	var createdAt int64
+	err := p.db.QueryRowContext(session.requestContext(), "SELECT created_at FROM message WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, e.MessageId).
+		Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message not found in topic"))
+		return
+	} else if err != nil {
+		logger.Error("Could not look up topic message", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not mark topic as read"))
+		return
+	}
 
-		// Don't allow chat to self.
-		if session.userID == otherUserID {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot chat to self"))
-			return
-		}
+	// Only moves the read position forward, marking an older message again is a no-op.
+	if err = topicReadMark(p.db, session.userID, topicBytes, topicType, createdAt, e.MessageId); err != nil {
+		logger.Error("Could not mark topic as read", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not mark topic as read"))
+		return
+	}
 
-		userIDString := session.userID.String()
-		otherUserIDString := otherUserID.String()
-		if userIDString < otherUserIDString {
-			topicBytes = append(session.userID.Bytes(), otherUserIDBytes...)
-		} else {
-			topicBytes = append(otherUserIDBytes, session.userID.Bytes()...)
-		}
-		topic = &TopicId{Id: &TopicId_Dm{Dm: topicBytes}}
-		topicType = 0
-	case *TTopicMessagesList_Room:
-		// Check input is valid room name.
-		room := input.GetRoom()
-		if room == nil || len(room) < 1 || len(room) > 64 {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name is required and must be 1-64 chars"))
-			return
-		}
-		if controlCharsRegex.Match(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must not contain control chars"))
-			return
-		}
-		if !utf8.Valid(room) {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must only contain valid UTF-8 bytes"))
-			return
-		}
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
 
-		topic = &TopicId{Id: &TopicId_Room{Room: room}}
-		topicBytes = room
-		topicType = 1
-	case *TTopicMessagesList_GroupId:
-		// Check input is valid ID.
-		groupIDBytes := input.GetGroupId()
-		_, err := uuid.FromBytes(groupIDBytes)
-		if err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID not valid"))
-			return
-		}
+// directMessageSent updates read state for both users in a direct message topic, and notifies the recipient if they
+// are not connected so they learn about the message on their next login.
+func (p *pipeline) directMessageSent(logger *zap.Logger, session *session, topic *TopicId, messageID []byte, createdAt int64, data []byte) {
+	topicBytes, topicType := topicStorageKey(topic)
+	otherUserID := uuid.FromBytesOrNil(topicBytes[:16])
+	if otherUserID == session.userID {
+		otherUserID = uuid.FromBytesOrNil(topicBytes[16:])
+	}
 
-		// Check if group exists and user is a member.
-		member, err := p.isGroupMember(session.userID, groupIDBytes)
-		if err != nil {
-			logger.Error("Could not check if user is group member", zap.Error(err))
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up group membership"))
-			return
-		} else if !member {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group not found, or not a member"))
-			return
-		}
+	if err := topicReadMark(p.db, session.userID, topicBytes, topicType, createdAt, messageID); err != nil {
+		logger.Warn("Could not mark topic as read", zap.Error(err))
+	}
+	// Make sure the topic is listed for the recipient, without changing what they have read.
+	if err := topicReadMark(p.db, otherUserID, topicBytes, topicType, 0, nil); err != nil {
+		logger.Warn("Could not add topic read state", zap.Error(err))
+	}
 
-		topic = &TopicId{Id: &TopicId_GroupId{GroupId: groupIDBytes}}
-		topicBytes = groupIDBytes
-		topicType = 2
-	case nil:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "No topic ID found"))
-		return
-	default:
-		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unrecognized topic ID"))
+	if len(p.tracker.ListByTopicUser("notifications", otherUserID)) != 0 {
 		return
 	}
 
-	query := "SELECT message_id, user_id, created_at, expires_at, handle, type, data FROM message WHERE topic = $2 AND topic_type = $3"
-	params := []interface{}{limit + 1, topicBytes, topicType}
-
-	// Only paginate if all cursor components are available.
-	if input.Cursor != nil {
-		var c messageCursor
-		if err := gob.NewDecoder(bytes.NewReader(input.Cursor)).Decode(&c); err != nil {
-			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid cursor data"))
-			return
-		}
-		op := "<"
-		if input.Forward {
-			op = ">"
-		}
-		query += " AND (created_at, message_id, user_id) " + op + " ($4, $5, $6)"
-		params = append(params, c.CreatedAt, c.MessageID, c.UserID)
+	handle := session.handle.Load()
+	content, err := json.Marshal(map[string]interface{}{
+		"handle":     handle,
+		"message_id": messageID,
+		"preview":    json.RawMessage(data),
+	})
+	if err != nil {
+		logger.Warn("Failed to send direct message notification", zap.Error(err))
+		return
 	}
-
-	if input.Forward {
-		query += " ORDER BY created_at ASC"
-	} else {
-		query += " ORDER BY created_at DESC"
+	ts := nowMs()
+	err = p.notificationService.NotificationSend(session.requestContext(), []*NNotification{
+		&NNotification{
+			Id:         uuid.NewV4().Bytes(),
+			UserID:     otherUserID.Bytes(),
+			Subject:    fmt.Sprintf("%v sent you a message", handle),
+			Content:    content,
+			Code:       NOTIFICATION_DM_MESSAGE,
+			SenderID:   session.userID.Bytes(),
+			CreatedAt:  ts,
+			ExpiresAt:  ts + p.notificationService.expiryMs,
+			Persistent: true,
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to send direct message notification", zap.Error(err))
 	}
-	query += " LIMIT $1"
+}
 
-	rows, err := p.db.Query(query, params...)
+func (p *pipeline) topicsUnreadList(logger *zap.Logger, session *session, envelope *Envelope) {
+	rows, err := p.db.QueryContext(session.requestContext(), `
+SELECT r.topic, COUNT(m.message_id)
+FROM topic_read r, message m
+WHERE r.user_id = $1 AND r.topic_type = 0
+AND m.topic = r.topic AND m.topic_type = r.topic_type AND m.created_at > r.read_at
+AND m.user_id <> $1 AND m.type = 0 AND m.deleted_at = 0 AND (m.expires_at = 0 OR m.expires_at > $2)
+GROUP BY r.topic`, session.userID.Bytes(), nowMs())
 	if err != nil {
-		logger.Error("Could not get topic messages list", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic messages list"))
+		logger.Error("Could not list unread topics", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list unread topics"))
 		return
 	}
 	defer rows.Close()
 
-	messages := make([]*TopicMessage, 0)
-	var cursor []byte
-	var messageID []byte
-	var userID []byte
-	var createdAt int64
-	var expiresAt int64
-	var handle string
-	var msgType int64
-	var data []byte
+	unread := make([]*TTopicsUnread_Unread, 0)
 	for rows.Next() {
-		if int64(len(messages)) >= limit {
-			cursorBuf := new(bytes.Buffer)
-			if gob.NewEncoder(cursorBuf).Encode(&messageCursor{MessageID: messageID, UserID: userID, CreatedAt: createdAt}); err != nil {
-				logger.Error("Error creating topic messages list cursor", zap.Error(err))
-				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not create topic messages list cursor"))
-			}
-			cursor = cursorBuf.Bytes()
-			break
-		}
-		err = rows.Scan(&messageID, &userID, &createdAt, &expiresAt, &handle, &msgType, &data)
-		if err != nil {
-			logger.Error("Error scanning topic messages list", zap.Error(err))
-			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error scanning topic messages list"))
+		var topicBytes []byte
+		var count int64
+		if err = rows.Scan(&topicBytes, &count); err != nil {
+			logger.Error("Could not scan unread topics", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list unread topics"))
 			return
 		}
-
-		message := &TopicMessage{
-			Topic:     topic,
-			UserId:    userID,
-			MessageId: messageID,
-			CreatedAt: createdAt,
-			ExpiresAt: expiresAt,
-			Handle:    handle,
-			Type:      msgType,
-			Data:      data,
-		}
-		messages = append(messages, message)
+		unread = append(unread, &TTopicsUnread_Unread{
+			Topic: &TopicId{Id: &TopicId_Dm{Dm: topicBytes}},
+			Count: count,
+		})
 	}
 	if err = rows.Err(); err != nil {
-		logger.Error("Error reading topic history", zap.Error(err))
-		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not read topic history"))
+		logger.Error("Could not read unread topics", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not list unread topics"))
 		return
 	}
 
-	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages, Cursor: cursor}}})
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicsUnread{TopicsUnread: &TTopicsUnread{Topics: unread}}})
 }
 
-func (p *pipeline) isGroupMember(userID uuid.UUID, groupID []byte) (bool, error) {
-	var state int64
-	err := p.db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID.Bytes(), groupID).Scan(&state)
+// messageReactionsLoad populates aggregated reaction counts for a page of messages from the same topic.
+func (p *pipeline) messageReactionsLoad(topicBytes []byte, topicType int64, messages []*TopicMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*TopicMessage, len(messages))
+	statements := make([]string, 0, len(messages))
+	params := []interface{}{topicBytes, topicType}
+	for _, message := range messages {
+		byID[string(message.MessageId)] = message
+		params = append(params, message.MessageId)
+		statements = append(statements, "$"+strconv.Itoa(len(params)))
+	}
+
+	rows, err := p.db.Query(`
+SELECT message_id, reaction, COUNT(user_id) FROM message_reaction
+WHERE topic = $1 AND topic_type = $2 AND message_id IN (`+strings.Join(statements, ", ")+`)
+GROUP BY message_id, reaction
+ORDER BY message_id, reaction`, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var messageID []byte
+	var reaction string
+	var count int64
+	for rows.Next() {
+		if err = rows.Scan(&messageID, &reaction, &count); err != nil {
+			return err
+		}
+		if message, ok := byID[string(messageID)]; ok {
+			message.Reactions = append(message.Reactions, &TopicMessage_Reaction{Reaction: reaction, Count: count})
+		}
+	}
+	return rows.Err()
+}
+
+func (p *pipeline) topicMessageReact(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMessageReact()
+	if e.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if len(e.MessageId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"))
+		return
+	}
+	if e.Reaction == "" || utf8.RuneCountInString(e.Reaction) > 32 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Reaction is required and must be 1-32 chars"))
+		return
+	}
+	if !utf8.ValidString(e.Reaction) || controlCharsRegex.MatchString(e.Reaction) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Reaction must only contain valid UTF-8 and no control chars"))
+		return
+	}
+
+	trackerTopic, err := validateTopic(session, e.Topic)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before reacting to messages"))
+		return
+	}
+
+	topicBytes, topicType := topicStorageKey(e.Topic)
+	ts := nowMs()
+
+	var res sql.Result
+	if e.Remove {
+		res, err = p.db.ExecContext(session.requestContext(), "DELETE FROM message_reaction WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND reaction = $4 AND user_id = $5",
+			topicBytes, topicType, e.MessageId, e.Reaction, session.userID.Bytes())
+	} else {
+		// Only chat messages that are still visible in the topic can receive reactions.
+		res, err = p.db.ExecContext(session.requestContext(), `
+INSERT INTO message_reaction (topic, topic_type, message_id, reaction, user_id, created_at)
+SELECT $1, $2, $3, $4, $5, $6
+WHERE EXISTS (
+	SELECT message_id FROM message
+	WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND type = 0 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $6)
+)
+ON CONFLICT (topic, topic_type, message_id, reaction, user_id) DO NOTHING`,
+			topicBytes, topicType, e.MessageId, e.Reaction, session.userID.Bytes(), ts)
+	}
+	if err != nil {
+		logger.Error("Could not update message reaction", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not update message reaction"))
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		// Nothing changed, either the reaction already matches what was requested or the message is not available.
+		if !e.Remove {
+			var exists int64
+			err = p.db.QueryRowContext(session.requestContext(), "SELECT COUNT(message_id) FROM message WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND type = 0 AND deleted_at = 0",
+				topicBytes, topicType, e.MessageId).Scan(&exists)
+			if err != nil {
+				logger.Error("Could not look up message", zap.Error(err))
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not update message reaction"))
+				return
+			}
+			if exists == 0 {
+				session.Send(ErrorMessageBadInput(envelope.CollationId, "Message not found in topic"))
+				return
+			}
+		}
+		session.Send(&Envelope{CollationId: envelope.CollationId})
+		return
+	}
+
+	var count int64
+	err = p.db.QueryRowContext(session.requestContext(), "SELECT COUNT(user_id) FROM message_reaction WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND reaction = $4",
+		topicBytes, topicType, e.MessageId, e.Reaction).Scan(&count)
+	if err != nil {
+		logger.Error("Could not count message reactions", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not update message reaction"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+
+	data, err := json.Marshal(map[string]interface{}{"reaction": e.Reaction, "count": count, "removed": e.Remove})
+	if err != nil {
+		logger.Error("Could not encode message reaction", zap.Error(err))
+		return
+	}
+	p.deliverMessage(logger, session, e.Topic, 8, data, nil, e.MessageId, session.handle.Load(), ts, 0)
+}
+
+func (p *pipeline) topicMessagePin(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMessagePin()
+	p.topicMessagePinSet(logger, session, envelope.CollationId, e.Topic, e.MessageId, true)
+}
+
+func (p *pipeline) topicMessageUnpin(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMessageUnpin()
+	p.topicMessagePinSet(logger, session, envelope.CollationId, e.Topic, e.MessageId, false)
+}
+
+func (p *pipeline) topicMessagePinSet(logger *zap.Logger, session *session, collationID string, topic *TopicId, messageID []byte, pin bool) {
+	if topic == nil {
+		session.Send(ErrorMessageBadInput(collationID, "Topic ID is required"))
+		return
+	}
+	if len(messageID) == 0 {
+		session.Send(ErrorMessageBadInput(collationID, "Message ID is required"))
+		return
+	}
+	if _, err := validateTopic(session, topic); err != nil {
+		session.Send(ErrorMessageBadInput(collationID, err.Error()))
+		return
+	}
+
+	code, err := TopicMessagePin(logger, p.db, session.userID, topic, messageID, pin)
+	if err != nil {
+		session.Send(ErrorMessage(collationID, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: collationID})
+
+	data, err := json.Marshal(map[string]bool{"pinned": pin})
+	if err != nil {
+		logger.Error("Could not encode message pin", zap.Error(err))
+		return
+	}
+	p.deliverMessage(logger, session, topic, 9, data, nil, messageID, session.handle.Load(), nowMs(), 0)
+}
+
+func (p *pipeline) topicPinsList(logger *zap.Logger, session *session, envelope *Envelope) {
+	topic := envelope.GetTopicPinsList().Topic
+	if topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if _, err := validateTopic(session, topic); err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	topicBytes, topicType := topicStorageKey(topic)
+	if topicType == 2 {
+		// Check if group exists and user is a member.
+		member, err := p.isGroupMember(session.userID, topicBytes)
+		if err != nil {
+			logger.Error("Could not check if user is group member", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up group membership"))
+			return
+		} else if !member {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group not found, or not a member"))
+			return
+		}
+	}
+
+	rows, err := p.db.QueryContext(session.requestContext(), `
+SELECT m.message_id, m.user_id, m.created_at, m.expires_at, m.handle, m.type, m.data, m.updated_at, m.deleted_at, m.attachments
+FROM topic_pin tp, message m
+WHERE tp.topic = $1 AND tp.topic_type = $2
+AND m.topic = tp.topic AND m.topic_type = tp.topic_type AND m.message_id = tp.message_id
+AND (m.expires_at = 0 OR m.expires_at > $3)
+ORDER BY tp.created_at DESC`, topicBytes, topicType, nowMs())
 	if err != nil {
+		logger.Error("Could not get topic pins list", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic pins list"))
+		return
+	}
+	defer rows.Close()
+
+	messages := make([]*TopicMessage, 0)
+	for rows.Next() {
+		message := &TopicMessage{Topic: topic}
+		var attachmentsJSON []byte
+		err = rows.Scan(&message.MessageId, &message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type,
+			&message.Data, &message.UpdatedAt, &message.DeletedAt, &attachmentsJSON)
+		if err == nil && len(attachmentsJSON) != 0 {
+			err = json.Unmarshal(attachmentsJSON, &message.Attachments)
+		}
+		if err != nil {
+			logger.Error("Error scanning topic pins list", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic pins list"))
+			return
+		}
+		messages = append(messages, message)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Error reading topic pins list", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic pins list"))
+		return
+	}
+
+	if err = p.messageReactionsLoad(topicBytes, topicType, messages); err != nil {
+		logger.Error("Could not get topic message reactions", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic pins list"))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages}}})
+}
+
+func (p *pipeline) topicUserMute(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicUserMute()
+	if e.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	userID, err := uuid.FromBytes(e.UserId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "User ID is not valid"))
+		return
+	}
+	if _, err = validateTopic(session, e.Topic); err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	code, err := TopicUserMute(logger, p.db, session.userID, e.Topic, userID, e.DurationMs)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) topicSlowModeSet(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicSlowModeSet()
+	if e.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if _, err := validateTopic(session, e.Topic); err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	code, err := TopicSlowModeSet(logger, p.db, session.userID, e.Topic, e.IntervalMs)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) topicEphemeralSend(logger *zap.Logger, session *session, envelope *Envelope) {
+	incoming := envelope.GetTopicEphemeralSend()
+	if incoming.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if incoming.Type < 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Type must be a non-negative number"))
+		return
+	}
+	if len(incoming.Data) != 0 {
+		if len(incoming.Data) > 1000 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Data must be at most 1000 JSON bytes"))
+			return
+		}
+		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
+		var maybeJSON map[string]interface{}
+		if json.Unmarshal(incoming.Data, &maybeJSON) != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Data must be a valid JSON object"))
+			return
+		}
+	}
+
+	trackerTopic, err := validateTopic(session, incoming.Topic)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	// Presences are listed once and checked for the sender, events never touch the database.
+	ps := p.tracker.ListByTopic(trackerTopic)
+	senderFound := false
+	for i := 0; i < len(ps); i++ {
+		if ps[i].ID.SessionID == session.id {
+			// Don't echo back to sender.
+			ps[i] = ps[len(ps)-1]
+			ps = ps[:len(ps)-1]
+			senderFound = true
+			break
+		}
+	}
+	if !senderFound {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before sending events"))
+		return
+	}
+	if len(ps) == 0 {
+		return
+	}
+
+	outgoing := &Envelope{
+		Payload: &Envelope_TopicEphemeral{
+			TopicEphemeral: &TopicEphemeral{
+				Topic:  incoming.Topic,
+				UserId: session.userID.Bytes(),
+				Handle: session.handle.Load(),
+				Type:   incoming.Type,
+				Data:   incoming.Data,
+			},
+		},
+	}
+
+	p.messageRouter.Send(logger, ps, outgoing)
+}
+
+func (p *pipeline) topicMessagesList(logger *zap.Logger, session *session, envelope *Envelope) {
+	input := envelope.GetTopicMessagesList()
+	if input.Id == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	limit := input.Limit
+	if limit == 0 {
+		limit = 10
+	}
+	if limit < 10 || limit > 100 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Limit must be 10-100"))
+		return
+	}
+
+	var topic *TopicId
+	var topicBytes []byte
+	var topicType int64
+	switch input.Id.(type) {
+	case *TTopicMessagesList_UserId:
+		// Check input is valid ID.
+		otherUserIDBytes := input.GetUserId()
+		otherUserID, err := uuid.FromBytes(otherUserIDBytes)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid User ID"))
+			return
+		}
+
+		// Don't allow chat to self.
+		if session.userID == otherUserID {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Cannot chat to self"))
+			return
+		}
+
+		userIDString := session.userID.String()
+		otherUserIDString := otherUserID.String()
+		if userIDString < otherUserIDString {
+			topicBytes = append(session.userID.Bytes(), otherUserIDBytes...)
+		} else {
+			topicBytes = append(otherUserIDBytes, session.userID.Bytes()...)
+		}
+		topic = &TopicId{Id: &TopicId_Dm{Dm: topicBytes}}
+		topicType = 0
+	case *TTopicMessagesList_Room:
+		// Check input is valid room name.
+		room := input.GetRoom()
+		if room == nil || len(room) < 1 || len(room) > 64 {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name is required and must be 1-64 chars"))
+			return
+		}
+		if controlCharsRegex.Match(room) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must not contain control chars"))
+			return
+		}
+		if !utf8.Valid(room) {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Room name must only contain valid UTF-8 bytes"))
+			return
+		}
+
+		topic = &TopicId{Id: &TopicId_Room{Room: room}}
+		topicBytes = room
+		topicType = 1
+	case *TTopicMessagesList_GroupId:
+		// Check input is valid ID.
+		groupIDBytes := input.GetGroupId()
+		_, err := uuid.FromBytes(groupIDBytes)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group ID not valid"))
+			return
+		}
+
+		// Check if group exists and user is a member.
+		member, err := p.isGroupMember(session.userID, groupIDBytes)
+		if err != nil {
+			logger.Error("Could not check if user is group member", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Failed to look up group membership"))
+			return
+		} else if !member {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Group not found, or not a member"))
+			return
+		}
+
+		topic = &TopicId{Id: &TopicId_GroupId{GroupId: groupIDBytes}}
+		topicBytes = groupIDBytes
+		topicType = 2
+	case nil:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "No topic ID found"))
+		return
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unrecognized topic ID"))
+		return
+	}
+
+	query := "SELECT message_id, user_id, created_at, expires_at, handle, type, data, updated_at, deleted_at, attachments FROM message WHERE topic = $2 AND topic_type = $3"
+	params := []interface{}{limit + 1, topicBytes, topicType}
+
+	// Only paginate if all cursor components are available. Clients may also resume from a known message instead.
+	var start *messageCursor
+	if input.Cursor != nil {
+		start = &messageCursor{}
+		if err := gob.NewDecoder(bytes.NewReader(input.Cursor)).Decode(start); err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid cursor data"))
+			return
+		}
+	} else if len(input.MessageId) != 0 {
+		start = &messageCursor{MessageID: input.MessageId}
+		err := p.db.QueryRowContext(session.requestContext(), "SELECT user_id, created_at FROM message WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, input.MessageId).
+			Scan(&start.UserID, &start.CreatedAt)
 		if err == sql.ErrNoRows {
-			return false, nil
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Message not found in topic"))
+			return
+		} else if err != nil {
+			logger.Error("Could not look up topic message", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic messages list"))
+			return
+		}
+	}
+	if start != nil {
+		op := "<"
+		if input.Forward {
+			op = ">"
+		}
+		query += " AND (created_at, message_id, user_id) " + op + " ($4, $5, $6)"
+		params = append(params, start.CreatedAt, start.MessageID, start.UserID)
+	}
+
+	// Messages past the retention window are no longer part of the topic history.
+	params = append(params, nowMs())
+	query += " AND (expires_at = 0 OR expires_at > $" + strconv.Itoa(len(params)) + ")"
+
+	if input.Forward {
+		query += " ORDER BY created_at ASC, message_id ASC, user_id ASC"
+	} else {
+		query += " ORDER BY created_at DESC, message_id DESC, user_id DESC"
+	}
+	query += " LIMIT $1"
+
+	rows, err := p.db.QueryContext(session.requestContext(), query, params...)
+	if err != nil {
+		logger.Error("Could not get topic messages list", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic messages list"))
+		return
+	}
+	defer rows.Close()
+
+	messages := make([]*TopicMessage, 0)
+	var cursor []byte
+	var messageID []byte
+	var userID []byte
+	var createdAt int64
+	var expiresAt int64
+	var handle string
+	var msgType int64
+	var data []byte
+	var updatedAt int64
+	var deletedAt int64
+	var attachmentsJSON []byte
+	for rows.Next() {
+		if int64(len(messages)) >= limit {
+			cursorBuf := new(bytes.Buffer)
+			if err = gob.NewEncoder(cursorBuf).Encode(&messageCursor{MessageID: messageID, UserID: userID, CreatedAt: createdAt}); err != nil {
+				logger.Error("Error creating topic messages list cursor", zap.Error(err))
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not create topic messages list cursor"))
+				return
+			}
+			cursor = cursorBuf.Bytes()
+			break
+		}
+		err = rows.Scan(&messageID, &userID, &createdAt, &expiresAt, &handle, &msgType, &data, &updatedAt, &deletedAt, &attachmentsJSON)
+		if err != nil {
+			logger.Error("Error scanning topic messages list", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error scanning topic messages list"))
+			return
+		}
+		var attachments []*TopicAttachment
+		if len(attachmentsJSON) != 0 {
+			if err = json.Unmarshal(attachmentsJSON, &attachments); err != nil {
+				logger.Error("Error decoding topic message attachments", zap.Error(err))
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Error scanning topic messages list"))
+				return
+			}
+		}
+
+		message := &TopicMessage{
+			Topic:       topic,
+			UserId:      userID,
+			MessageId:   messageID,
+			CreatedAt:   createdAt,
+			ExpiresAt:   expiresAt,
+			Handle:      handle,
+			Type:        msgType,
+			Data:        data,
+			UpdatedAt:   updatedAt,
+			DeletedAt:   deletedAt,
+			Attachments: attachments,
 		}
+		messages = append(messages, message)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("Error reading topic history", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not read topic history"))
+		return
+	}
+
+	if err = p.messageReactionsLoad(topicBytes, topicType, messages); err != nil {
+		logger.Error("Could not get topic message reactions", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not get topic messages list"))
+		return
+	}
+
+	// Allow paging back in the opposite direction from the first message in this page.
+	var reverseCursor []byte
+	if len(messages) != 0 {
+		first := messages[0]
+		cursorBuf := new(bytes.Buffer)
+		if err = gob.NewEncoder(cursorBuf).Encode(&messageCursor{MessageID: first.MessageId, UserID: first.UserId, CreatedAt: first.CreatedAt}); err != nil {
+			logger.Error("Error creating topic messages list reverse cursor", zap.Error(err))
+			session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not create topic messages list cursor"))
+			return
+		}
+		reverseCursor = cursorBuf.Bytes()
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessages{TopicMessages: &TTopicMessages{Messages: messages, Cursor: cursor, ReverseCursor: reverseCursor}}})
+}
+
+func (p *pipeline) isGroupMember(userID uuid.UUID, groupID []byte) (bool, error) {
+	var state int64
+	err := p.db.QueryRow("SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2", userID.Bytes(), groupID).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && (state == 0 || state == 1) {
+		return true, nil
+	}
 
+	// Members of any group in an alliance share the alliance topic.
+	var count int64
+	err = p.db.QueryRow(`
+SELECT COUNT(ge.source_id) FROM group_edge ge, group_relation gr
+WHERE gr.parent_id = $2 AND ge.destination_id = gr.child_id AND ge.source_id = $1 AND ge.state IN (0, 1)`,
+		userID.Bytes(), groupID).Scan(&count)
+	if err != nil {
 		return false, err
 	}
-	return state == 0 || state == 1, nil
+	return count != 0, nil
 }
 
 func (p *pipeline) userExistsAndDoesNotBlock(checkUserID []byte, blocksUserID []byte) (bool, error) {
@@ -621,29 +1197,137 @@ WHERE id = $1 AND NOT EXISTS (
 	return count != 0, err
 }
 
-// Assumes `topic` has already been validated, or was constructed internally.
-func (p *pipeline) storeMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) ([]byte, string, int64, int64, error) {
-	var topicBytes []byte
-	var topicType int64
+// validateTopic checks a topic ID sent by a client and returns the matching tracker topic.
+func validateTopic(session *session, topic *TopicId) (string, error) {
 	switch topic.Id.(type) {
 	case *TopicId_Dm:
-		topicBytes = topic.GetDm()
-		topicType = 0
+		// Check input is valid DM topic.
+		bothUserIDBytes := topic.GetDm()
+		if bothUserIDBytes == nil || len(bothUserIDBytes) != 32 {
+			return "", errors.New("Topic not valid")
+		}
+
+		// Check the DM topic components are valid UUIDs.
+		userID1Bytes := bothUserIDBytes[:16]
+		userID2Bytes := bothUserIDBytes[16:]
+		userID1, err := uuid.FromBytes(userID1Bytes)
+		if err != nil {
+			return "", errors.New("Topic not valid")
+		}
+		userID2, err := uuid.FromBytes(userID2Bytes)
+		if err != nil {
+			return "", errors.New("Topic not valid")
+		}
+
+		// Check the IDs are ordered correctly.
+		userID1String := userID1.String()
+		userID2String := userID2.String()
+		if userID1String > userID2String {
+			return "", errors.New("Topic not valid")
+		}
+
+		// Check one of the users in this DM topic is the current one.
+		if userID1 != session.userID && userID2 != session.userID {
+			return "", errors.New("Topic not valid")
+		}
+
+		// Check the DM topic is between two different users.
+		if userID1 == userID2 {
+			return "", errors.New("Cannot chat to self")
+		}
+
+		return "dm:" + userID1String + ":" + userID2String, nil
 	case *TopicId_Room:
-		topicBytes = topic.GetRoom()
-		topicType = 1
+		// Check input is valid room name.
+		room := topic.GetRoom()
+		if room == nil || len(room) < 1 || len(room) > 64 {
+			return "", errors.New("Room name is required and must be 1-64 chars")
+		}
+		if controlCharsRegex.Match(room) {
+			return "", errors.New("Room name must not contain control chars")
+		}
+		if !utf8.Valid(room) {
+			return "", errors.New("Room name must only contain valid UTF-8 bytes")
+		}
+
+		return "room:" + string(room), nil
 	case *TopicId_GroupId:
-		topicBytes = topic.GetGroupId()
-		topicType = 2
+		// Check input is valid ID.
+		groupIDBytes := topic.GetGroupId()
+		groupID, err := uuid.FromBytes(groupIDBytes)
+		if err != nil {
+			return "", errors.New("Group ID not valid")
+		}
+
+		return "group:" + groupID.String(), nil
+	case nil:
+		return "", errors.New("No topic ID found")
+	default:
+		return "", errors.New("Unrecognized topic ID")
+	}
+}
+
+// filterMessage runs chat message data through the configured content filter, then the runtime chat filter function
+// if one is registered. Returns the data to store, which may have been rewritten.
+func (p *pipeline) filterMessage(logger *zap.Logger, session *session, trackerTopic string, data []byte) ([]byte, Error_Code, error) {
+	data, ok := p.chatFilter.Apply(data)
+	if !ok {
+		return nil, CHAT_MESSAGE_BLOCKED, errors.New("Message blocked by content filter")
+	}
+
+	fn := p.runtime.GetRuntimeCallback(CHAT_FILTER, "")
+	if fn == nil {
+		return data, 0, nil
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, BAD_INPUT, errors.New("Data must be a valid JSON object")
+	}
+
+	result, err := p.runtime.InvokeFunctionChatFilter(fn, session.userID, session.handle.Load(), session.expiry.Load(), trackerTopic, content)
+	if err != nil {
+		logger.Error("Runtime chat filter function caused an error", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not filter message")
+	}
+	if result == nil {
+		return nil, CHAT_MESSAGE_BLOCKED, errors.New("Message blocked by content filter")
+	}
+
+	data, err = json.Marshal(result)
+	if err != nil {
+		logger.Error("Could not encode filtered message", zap.Error(err))
+		return nil, RUNTIME_EXCEPTION, errors.New("Could not filter message")
+	}
+	if len(data) > 1000 {
+		return nil, CHAT_MESSAGE_BLOCKED, errors.New("Filtered message exceeds 1000 JSON bytes")
+	}
+	return data, 0, nil
+}
+
+// Assumes `topic` has already been validated, or was constructed internally.
+func (p *pipeline) storeMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte, attachments []*TopicAttachment) ([]byte, string, int64, int64, error) {
+	var attachmentsJSON []byte
+	if len(attachments) != 0 {
+		var err error
+		if attachmentsJSON, err = json.Marshal(attachments); err != nil {
+			logger.Error("Failed to encode message attachments", zap.Error(err))
+			return nil, "", 0, 0, err
+		}
 	}
+
+	topicBytes, topicType := topicStorageKey(topic)
 	createdAt := nowMs()
 	messageID := uuid.NewV4().Bytes()
 	expiresAt := int64(0)
+	if retentionMs := p.config.GetSocial().Chat.RetentionMs; retentionMs > 0 {
+		expiresAt = createdAt + retentionMs
+	}
 	handle := session.handle.Load()
-	_, err := p.db.Exec(`
-INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		topicBytes, topicType, messageID, session.userID.Bytes(), createdAt, expiresAt, handle, msgType, data)
+	_, err := p.db.ExecContext(session.requestContext(), `
+INSERT INTO message (topic, topic_type, message_id, user_id, created_at, expires_at, handle, type, data, attachments)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		topicBytes, topicType, messageID, session.userID.Bytes(), createdAt, expiresAt, handle, msgType, data, attachmentsJSON)
 	if err != nil {
 		logger.Error("Failed to insert new message", zap.Error(err))
 		return nil, "", 0, 0, err
@@ -652,45 +1336,315 @@ VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
 	return messageID, handle, createdAt, expiresAt, nil
 }
 
-func (p *pipeline) deliverMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte, messageID []byte, handle string, createdAt int64, expiresAt int64) {
-	var trackerTopic string
+// topicStorageKey returns the topic and topic type values used to store messages for a topic.
+func topicStorageKey(topic *TopicId) ([]byte, int64) {
+	switch topic.Id.(type) {
+	case *TopicId_Dm:
+		return topic.GetDm(), 0
+	case *TopicId_Room:
+		return topic.GetRoom(), 1
+	case *TopicId_GroupId:
+		return topic.GetGroupId(), 2
+	}
+	return nil, 0
+}
+
+// topicTrackerName returns the tracker topic for a topic ID that has already been validated.
+func topicTrackerName(topic *TopicId) string {
 	switch topic.Id.(type) {
 	case *TopicId_Dm:
 		bothUserIDBytes := topic.GetDm()
 		userID1 := uuid.FromBytesOrNil(bothUserIDBytes[:16])
 		userID2 := uuid.FromBytesOrNil(bothUserIDBytes[16:])
 
-		trackerTopic = "dm:" + userID1.String() + ":" + userID2.String()
+		return "dm:" + userID1.String() + ":" + userID2.String()
 	case *TopicId_Room:
-		trackerTopic = "room:" + string(topic.GetRoom())
+		return "room:" + string(topic.GetRoom())
 	case *TopicId_GroupId:
-		trackerTopic = "group:" + uuid.FromBytesOrNil(topic.GetGroupId()).String()
+		return "group:" + uuid.FromBytesOrNil(topic.GetGroupId()).String()
 	}
+	return ""
+}
 
-	outgoing := &Envelope{
-		Payload: &Envelope_TopicMessage{
-			TopicMessage: &TopicMessage{
-				Topic:     topic,
-				UserId:    session.userID.Bytes(),
-				MessageId: messageID,
-				CreatedAt: createdAt,
-				ExpiresAt: expiresAt,
-				Handle:    handle,
-				Type:      msgType,
-				Data:      data,
-			},
-		},
+func (p *pipeline) deliverMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte, attachments []*TopicAttachment, messageID []byte, handle string, createdAt int64, expiresAt int64) {
+	p.deliverTopicMessage(logger, &TopicMessage{
+		Topic:       topic,
+		UserId:      session.userID.Bytes(),
+		MessageId:   messageID,
+		CreatedAt:   createdAt,
+		ExpiresAt:   expiresAt,
+		Handle:      handle,
+		Type:        msgType,
+		Data:        data,
+		Attachments: attachments,
+	})
+}
+
+// attachmentsCheck verifies that every attached storage record exists, belongs to the user, and can be read by
+// the other users in the topic.
+func (p *pipeline) attachmentsCheck(userID uuid.UUID, attachments []*TopicAttachment) (Error_Code, error) {
+	query := "SELECT COUNT(record) FROM storage WHERE user_id = $1 AND read = 2 AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $2) AND ("
+	params := []interface{}{userID.Bytes(), nowMs()}
+	type attachmentKey struct {
+		bucket     string
+		collection string
+		record     string
+		userID     string
 	}
+	unique := make(map[attachmentKey]bool, len(attachments))
+	for _, a := range attachments {
+		if a.Bucket == "" || a.Collection == "" || a.Record == "" {
+			return BAD_INPUT, errors.New("Invalid values for attachment bucket, collection, or record")
+		}
+		if !uuid.Equal(uuid.FromBytesOrNil(a.UserId), userID) {
+			return BAD_INPUT, errors.New("Attachments must be storage records owned by the sender")
+		}
+		key := attachmentKey{bucket: a.Bucket, collection: a.Collection, record: a.Record, userID: string(a.UserId)}
+		if unique[key] {
+			continue
+		}
+		unique[key] = true
 
-	presences := p.tracker.ListByTopic(trackerTopic)
+		if len(params) > 2 {
+			query += " OR "
+		}
+		l := len(params)
+		query += fmt.Sprintf("(bucket = $%v AND collection = $%v AND record = $%v)", l+1, l+2, l+3)
+		params = append(params, a.Bucket, a.Collection, a.Record)
+	}
+	query += ")"
+
+	var count int
+	if err := p.db.QueryRow(query, params...).Scan(&count); err != nil {
+		return RUNTIME_EXCEPTION, err
+	}
+	if count != len(unique) {
+		return BAD_INPUT, errors.New("Attachments must be existing, publicly readable storage records owned by the sender")
+	}
+	return 0, nil
+}
+
+func (p *pipeline) deliverTopicMessage(logger *zap.Logger, message *TopicMessage) {
+	outgoing := &Envelope{Payload: &Envelope_TopicMessage{TopicMessage: message}}
+
+	presences := p.tracker.ListByTopic(topicTrackerName(message.Topic))
 	p.messageRouter.Send(logger, presences, outgoing)
 }
 
 func (p *pipeline) storeAndDeliverMessage(logger *zap.Logger, session *session, topic *TopicId, msgType int64, data []byte) error {
-	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, msgType, data)
+	messageID, handle, createdAt, expiresAt, err := p.storeMessage(logger, session, topic, msgType, data, nil)
 	if err != nil {
 		return err
 	}
-	p.deliverMessage(logger, session, topic, msgType, data, messageID, handle, createdAt, expiresAt)
+	p.deliverMessage(logger, session, topic, msgType, data, nil, messageID, handle, createdAt, expiresAt)
 	return nil
 }
+
+func (p *pipeline) topicMessageUpdate(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMessageUpdate()
+	if e.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if len(e.MessageId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"))
+		return
+	}
+	if len(e.Data) == 0 || len(e.Data) > 1000 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Data is required and must be 1-1000 JSON bytes"))
+		return
+	}
+	// Make this `var js interface{}` if we want to allow top-level JSON arrays.
+	var maybeJSON map[string]interface{}
+	if json.Unmarshal(e.Data, &maybeJSON) != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Data must be a valid JSON object"))
+		return
+	}
+
+	trackerTopic, err := validateTopic(session, e.Topic)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before updating messages"))
+		return
+	}
+
+	data, code, err := p.filterMessage(logger, session, trackerTopic, e.Data)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	topicBytes, topicType := topicStorageKey(e.Topic)
+	message := &TopicMessage{Topic: e.Topic, MessageId: e.MessageId}
+	failureCode := RUNTIME_EXCEPTION
+	failureReason := "Could not update message"
+
+	tx, err := p.db.BeginTx(session.requestContext(), nil)
+	if err != nil {
+		logger.Error("Could not update message", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, failureReason))
+		return
+	}
+	defer func() {
+		if err != nil {
+			logger.Warn("Could not update message", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				logger.Error("Could not rollback transaction", zap.Error(e))
+			}
+			session.Send(ErrorMessage(envelope.CollationId, failureCode, failureReason))
+		} else {
+			if err = tx.Commit(); err != nil {
+				logger.Error("Could not commit transaction", zap.Error(err))
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not update message"))
+				return
+			}
+
+			session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TopicMessageAck{TopicMessageAck: &TTopicMessageAck{
+				MessageId: message.MessageId,
+				CreatedAt: message.CreatedAt,
+				ExpiresAt: message.ExpiresAt,
+				Handle:    message.Handle,
+				UpdatedAt: message.UpdatedAt,
+			}}})
+			p.deliverTopicMessage(logger, message)
+		}
+	}()
+
+	var oldData []byte
+	var updatedAt int64
+	var deletedAt int64
+	var attachmentsJSON []byte
+	err = tx.QueryRowContext(session.requestContext(), `
+SELECT user_id, created_at, expires_at, handle, type, data, updated_at, deleted_at, attachments FROM message
+WHERE topic = $1 AND topic_type = $2 AND message_id = $3`, topicBytes, topicType, e.MessageId).
+		Scan(&message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type, &oldData, &updatedAt, &deletedAt, &attachmentsJSON)
+	if err == sql.ErrNoRows {
+		failureCode = BAD_INPUT
+		failureReason = "Message not found in topic"
+		err = errors.New(failureReason)
+		return
+	} else if err != nil {
+		return
+	}
+
+	if !uuid.Equal(uuid.FromBytesOrNil(message.UserId), session.userID) || message.Type != 0 || deletedAt != 0 {
+		failureCode = BAD_INPUT
+		failureReason = "Only your own chat messages can be updated"
+		err = errors.New(failureReason)
+		return
+	}
+	if len(attachmentsJSON) != 0 {
+		if err = json.Unmarshal(attachmentsJSON, &message.Attachments); err != nil {
+			return
+		}
+	}
+
+	// Keep the superseded content as a version of the message.
+	message.UpdatedAt = nowMs()
+	_, err = tx.ExecContext(session.requestContext(), `
+INSERT INTO message_version (topic, topic_type, message_id, data, updated_at)
+VALUES ($1, $2, $3, $4, $5)`, topicBytes, topicType, e.MessageId, oldData, message.UpdatedAt)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(session.requestContext(), "UPDATE message SET data = $4, updated_at = $5 WHERE topic = $1 AND topic_type = $2 AND message_id = $3",
+		topicBytes, topicType, e.MessageId, data, message.UpdatedAt)
+	if err != nil {
+		return
+	}
+	message.Data = data
+}
+
+func (p *pipeline) topicMessageDelete(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTopicMessageDelete()
+	if e.Topic == nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Topic ID is required"))
+		return
+	}
+	if len(e.MessageId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message ID is required"))
+		return
+	}
+
+	trackerTopic, err := validateTopic(session, e.Topic)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, err.Error()))
+		return
+	}
+
+	if !p.tracker.CheckLocalByIDTopicUser(session.id, trackerTopic, session.userID) {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Must join topic before deleting messages"))
+		return
+	}
+
+	topicBytes, topicType := topicStorageKey(e.Topic)
+	message := &TopicMessage{Topic: e.Topic, MessageId: e.MessageId, Data: []byte("{}")}
+
+	var msgData []byte
+	err = p.db.QueryRowContext(session.requestContext(), `
+SELECT user_id, created_at, expires_at, handle, type, data, updated_at FROM message
+WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND deleted_at = 0`, topicBytes, topicType, e.MessageId).
+		Scan(&message.UserId, &message.CreatedAt, &message.ExpiresAt, &message.Handle, &message.Type, &msgData, &message.UpdatedAt)
+	if err == sql.ErrNoRows {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message not found in topic"))
+		return
+	} else if err != nil {
+		logger.Error("Could not look up message", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not delete message"))
+		return
+	}
+
+	// Group admins can moderate any message in the group topic.
+	if !uuid.Equal(uuid.FromBytesOrNil(message.UserId), session.userID) {
+		admin := false
+		if _, ok := e.Topic.Id.(*TopicId_GroupId); ok {
+			var count int64
+			err = p.db.QueryRowContext(session.requestContext(), "SELECT COUNT(source_id) FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND state = 0", topicBytes, session.userID.Bytes()).Scan(&count)
+			if err != nil {
+				logger.Error("Could not check group admin", zap.Error(err))
+				session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not delete message"))
+				return
+			}
+			admin = count != 0
+		}
+		if !admin {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Only your own messages can be deleted"))
+			return
+		}
+	}
+
+	message.DeletedAt = nowMs()
+	res, err := p.db.ExecContext(session.requestContext(), "UPDATE message SET data = '{}', attachments = NULL, deleted_at = $4 WHERE topic = $1 AND topic_type = $2 AND message_id = $3 AND deleted_at = 0",
+		topicBytes, topicType, e.MessageId, message.DeletedAt)
+	if err != nil {
+		logger.Error("Could not delete message", zap.Error(err))
+		session.Send(ErrorMessageRuntimeException(envelope.CollationId, "Could not delete message"))
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Message not found in topic"))
+		return
+	}
+
+	// Deleted content should not survive in old versions either.
+	_, err = p.db.ExecContext(session.requestContext(), "DELETE FROM message_version WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, e.MessageId)
+	if err != nil {
+		logger.Warn("Could not delete message versions", zap.Error(err))
+	}
+	_, err = p.db.ExecContext(session.requestContext(), "DELETE FROM message_reaction WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, e.MessageId)
+	if err != nil {
+		logger.Warn("Could not delete message reactions", zap.Error(err))
+	}
+	_, err = p.db.ExecContext(session.requestContext(), "DELETE FROM topic_pin WHERE topic = $1 AND topic_type = $2 AND message_id = $3", topicBytes, topicType, e.MessageId)
+	if err != nil {
+		logger.Warn("Could not unpin deleted message", zap.Error(err))
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+	p.deliverTopicMessage(logger, message)
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) tournamentsList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTournamentsList()
+
+	tournaments, cursor, code, err := tournamentsList(logger, p.db, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_Tournaments{Tournaments: &TTournaments{
+		Tournaments: tournaments,
+		Cursor:      cursor,
+	}}})
+}
+
+func (p *pipeline) tournamentJoin(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTournamentJoin()
+
+	if len(e.TournamentId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Tournament ID must be present"))
+		return
+	}
+
+	code, err := TournamentJoin(logger, p.db, session.userID, e.TournamentId)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId})
+}
+
+func (p *pipeline) tournamentRecordWrite(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTournamentRecordWrite()
+
+	if len(e.TournamentId) == 0 {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Tournament ID must be present"))
+		return
+	}
+
+	if len(e.Metadata) != 0 {
+		// Make this `var js interface{}` if we want to allow top-level JSON arrays.
+		var maybeJSON map[string]interface{}
+		if json.Unmarshal(e.Metadata, &maybeJSON) != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Metadata must be a valid JSON object"))
+			return
+		}
+	}
+
+	var op string
+	var value int64
+	switch e.Op.(type) {
+	case *TTournamentRecordWrite_Incr:
+		op = "incr"
+		value = e.GetIncr()
+	case *TTournamentRecordWrite_Decr:
+		op = "decr"
+		value = e.GetDecr()
+	case *TTournamentRecordWrite_Set:
+		op = "set"
+		value = e.GetSet()
+	case *TTournamentRecordWrite_Best:
+		op = "best"
+		value = e.GetBest()
+	case nil:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "No tournament record write operator found"))
+		return
+	default:
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Unknown tournament record write operator"))
+		return
+	}
+
+	if code, err := leaderboardSubmitScreen(logger, p.db, p.runtime, session, e.TournamentId, op, value); err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	record, code, err := tournamentSubmit(logger, p.db, p.leaderboardRankCache, session.userID, e.TournamentId, session.userID, session.handle.Load(), session.lang, op, value, e.Location, e.Timezone, e.Metadata)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_LeaderboardRecords{LeaderboardRecords: &TLeaderboardRecords{
+		Records: []*LeaderboardRecord{record},
+	}}})
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+func (p *pipeline) turnMatchCreate(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTurnMatchCreate()
+
+	userIDs := make([]uuid.UUID, 0, len(e.UserIds))
+	for _, id := range e.UserIds {
+		userID, err := uuid.FromBytes(id)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid user ID"))
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	match, code, err := TurnMatchCreate(logger, p.db, p.config.GetMatch(), session.userID, userIDs, e.TurnTimeoutSec, e.State)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TurnMatches{TurnMatches: &TTurnMatches{
+		TurnMatches: []*TurnMatch{match},
+	}}})
+}
+
+func (p *pipeline) turnMatchesFetch(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTurnMatchesFetch()
+
+	matchIDs := make([]uuid.UUID, 0, len(e.MatchIds))
+	for _, id := range e.MatchIds {
+		matchID, err := uuid.FromBytes(id)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+			return
+		}
+		matchIDs = append(matchIDs, matchID)
+	}
+
+	matches, code, err := TurnMatchesFetch(logger, p.db, session.userID, matchIDs)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TurnMatches{TurnMatches: &TTurnMatches{
+		TurnMatches: matches,
+	}}})
+}
+
+func (p *pipeline) turnMatchesList(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTurnMatchesList()
+
+	matches, cursor, code, err := TurnMatchesList(logger, p.db, session.userID, e.Active, e.Limit, e.Cursor)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TurnMatches{TurnMatches: &TTurnMatches{
+		TurnMatches: matches,
+		Cursor:      cursor,
+	}}})
+}
+
+func (p *pipeline) turnMatchMove(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTurnMatchMove()
+
+	matchID, err := uuid.FromBytes(e.MatchId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+		return
+	}
+	winnerID := uuid.Nil
+	if len(e.WinnerId) != 0 {
+		winnerID, err = uuid.FromBytes(e.WinnerId)
+		if err != nil {
+			session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid winner ID"))
+			return
+		}
+	}
+
+	match, code, err := TurnMatchMove(logger, p.db, p.config.GetMatch(), session.userID, matchID, e.Turn, e.State, e.End, winnerID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TurnMatches{TurnMatches: &TTurnMatches{
+		TurnMatches: []*TurnMatch{match},
+	}}})
+
+	turnMatchNotify(logger, p.notificationService, match, session.userID.Bytes())
+}
+
+func (p *pipeline) turnMatchForfeit(logger *zap.Logger, session *session, envelope *Envelope) {
+	e := envelope.GetTurnMatchForfeit()
+
+	matchID, err := uuid.FromBytes(e.MatchId)
+	if err != nil {
+		session.Send(ErrorMessageBadInput(envelope.CollationId, "Invalid match ID"))
+		return
+	}
+
+	match, code, err := TurnMatchForfeit(logger, p.db, session.userID, matchID)
+	if err != nil {
+		session.Send(ErrorMessage(envelope.CollationId, code, err.Error()))
+		return
+	}
+
+	session.Send(&Envelope{CollationId: envelope.CollationId, Payload: &Envelope_TurnMatches{TurnMatches: &TTurnMatches{
+		TurnMatches: []*TurnMatch{match},
+	}}})
+
+	turnMatchNotify(logger, p.notificationService, match, session.userID.Bytes())
+}
@@ -47,8 +47,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 
 	// Group joins and leaves by topic.
 	for _, p := range joins {
-		// The "notifications" topic is a special case that does not generate presence notifications.
-		if p.Topic == "notifications" {
+		// The "notifications" topic and storage subscriptions are special cases that do not generate presence notifications.
+		if p.Topic == "notifications" || strings.HasPrefix(p.Topic, "storage:") {
 			continue
 		}
 
@@ -60,8 +60,8 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 		}
 	}
 	for _, p := range leaves {
-		// The "notifications" topic is a special case that does not generate presence notifications.
-		if p.Topic == "notifications" {
+		// The "notifications" topic and storage subscriptions are special cases that do not generate presence notifications.
+		if p.Topic == "notifications" || strings.HasPrefix(p.Topic, "storage:") {
 			continue
 		}
 
@@ -97,6 +97,15 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 			} else {
 				pn.handleDiffMatch(matchID, to, tjs, nil)
 			}
+		case "party":
+			partyID := uuid.FromStringOrNil(splitTopic[1]).Bytes()
+			if tls, ok := topicLeaves[topic]; ok {
+				// Make sure leaves aren't also processed separately if we were able to pair them here.
+				delete(topicLeaves, topic)
+				pn.handleDiffParty(partyID, to, tjs, tls)
+			} else {
+				pn.handleDiffParty(partyID, to, tjs, nil)
+			}
 		case "dm":
 			users := strings.SplitN(splitTopic[1], ":", 2)
 			userID1 := uuid.FromStringOrNil(users[0]).Bytes()
@@ -149,6 +158,9 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 		case "match":
 			matchID := uuid.FromStringOrNil(splitTopic[1]).Bytes()
 			pn.handleDiffMatch(matchID, to, nil, tls)
+		case "party":
+			partyID := uuid.FromStringOrNil(splitTopic[1]).Bytes()
+			pn.handleDiffParty(partyID, to, nil, tls)
 		case "dm":
 			users := strings.SplitN(splitTopic[1], ":", 2)
 			userID1 := uuid.FromStringOrNil(users[0]).Bytes()
@@ -167,6 +179,39 @@ func (pn *presenceNotifier) HandleDiff(joins, leaves []Presence) {
 	}
 }
 
+func (pn *presenceNotifier) handleDiffParty(partyID []byte, to, joins, leaves []Presence) {
+	// Tie together the joins and leaves for the same topic.
+	msg := &PartyPresence{
+		PartyId: partyID,
+	}
+	if joins != nil {
+		muJoins := make([]*UserPresence, len(joins))
+		for i := 0; i < len(joins); i++ {
+			muJoins[i] = &UserPresence{
+				UserId:    joins[i].UserID.Bytes(),
+				SessionId: joins[i].ID.SessionID.Bytes(),
+				Handle:    joins[i].Meta.Handle,
+			}
+		}
+		msg.Joins = muJoins
+	}
+	if leaves != nil {
+		muLeaves := make([]*UserPresence, len(leaves))
+		for i := 0; i < len(leaves); i++ {
+			muLeaves[i] = &UserPresence{
+				UserId:    leaves[i].UserID.Bytes(),
+				SessionId: leaves[i].ID.SessionID.Bytes(),
+				Handle:    leaves[i].Meta.Handle,
+			}
+		}
+		msg.Leaves = muLeaves
+	}
+	pn.logger.Debug("Routing party diff", zap.Any("to", to), zap.Any("msg", msg))
+
+	// Send the presence notification.
+	pn.messageRouter.Send(pn.logger, to, &Envelope{Payload: &Envelope_PartyPresence{PartyPresence: msg}})
+}
+
 func (pn *presenceNotifier) handleDiffMatch(matchID []byte, to, joins, leaves []Presence) {
 	// Tie together the joins and leaves for the same topic.
 	msg := &MatchPresence{
@@ -179,6 +224,7 @@ func (pn *presenceNotifier) handleDiffMatch(matchID []byte, to, joins, leaves []
 				UserId:    joins[i].UserID.Bytes(),
 				SessionId: joins[i].ID.SessionID.Bytes(),
 				Handle:    joins[i].Meta.Handle,
+				Spectator: joins[i].Meta.Spectator,
 			}
 		}
 		msg.Joins = muJoins
@@ -190,6 +236,7 @@ func (pn *presenceNotifier) handleDiffMatch(matchID []byte, to, joins, leaves []
 				UserId:    leaves[i].UserID.Bytes(),
 				SessionId: leaves[i].ID.SessionID.Bytes(),
 				Handle:    leaves[i].Meta.Handle,
+				Spectator: leaves[i].Meta.Spectator,
 			}
 		}
 		msg.Leaves = muLeaves
@@ -0,0 +1,206 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RegistrationChallenge is a check clients must pass before a new user is registered, to slow down bot sign ups.
+type RegistrationChallenge interface {
+	// Issue returns a challenge for the client to solve, or an empty string if the client gets one from the provider.
+	Issue() (string, error)
+	// Verify checks the client's answer to a challenge, returning an error if it does not pass.
+	Verify(answer string, remoteIP string) error
+}
+
+// NewRegistrationChallenge creates the configured challenge, or one that always passes when no provider is set.
+func NewRegistrationChallenge(logger *zap.Logger, config *ChallengeConfig, secret []byte) (RegistrationChallenge, error) {
+	switch config.Provider {
+	case "":
+		return &noRegistrationChallenge{}, nil
+	case "pow":
+		if config.Difficulty < 1 || config.Difficulty > 64 {
+			return nil, errors.New("proof of work difficulty must be 1-64")
+		}
+		return &powChallenge{
+			secret:     secret,
+			difficulty: config.Difficulty,
+			expiryMs:   config.ExpiryMs,
+			used:       make(map[string]int64),
+		}, nil
+	case "recaptcha":
+		return newCaptchaChallenge(logger, config, "https://www.google.com/recaptcha/api/siteverify")
+	case "hcaptcha":
+		return newCaptchaChallenge(logger, config, "https://hcaptcha.com/siteverify")
+	default:
+		return nil, fmt.Errorf("unknown registration challenge provider %q", config.Provider)
+	}
+}
+
+type noRegistrationChallenge struct{}
+
+func (c *noRegistrationChallenge) Issue() (string, error) {
+	return "", nil
+}
+
+func (c *noRegistrationChallenge) Verify(answer string, remoteIP string) error {
+	return nil
+}
+
+// powChallenge is a proof of work. Clients are issued a signed challenge, and must find a nonce so the SHA-256 hash
+// of "challenge:nonce" starts with the configured number of zero bits. The answer is "challenge:nonce", and each
+// challenge can only be used once.
+type powChallenge struct {
+	sync.Mutex
+	secret     []byte
+	difficulty int
+	expiryMs   int64
+	// Challenges already used, with when they expire.
+	used map[string]int64
+}
+
+func (c *powChallenge) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *powChallenge) Issue() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(nowMs()+c.expiryMs, 10) + "." + hex.EncodeToString(random)
+	return payload + "." + c.sign(payload), nil
+}
+
+func (c *powChallenge) Verify(answer string, remoteIP string) error {
+	i := strings.LastIndex(answer, ":")
+	if i == -1 {
+		return errors.New("Challenge answer is required")
+	}
+	challenge := answer[:i]
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(c.sign(parts[0]+"."+parts[1]))) {
+		return errors.New("Invalid challenge")
+	}
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	ts := nowMs()
+	if err != nil || expiresAt <= ts {
+		return errors.New("Challenge expired")
+	}
+
+	// Count leading zero bits of the hash.
+	hash := sha256.Sum256([]byte(answer))
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			for ; b&0x80 == 0; b <<= 1 {
+				zeros++
+			}
+			break
+		}
+		zeros += 8
+	}
+	if zeros < c.difficulty {
+		return errors.New("Challenge not solved")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for k, exp := range c.used {
+		if exp <= ts {
+			delete(c.used, k)
+		}
+	}
+	if _, ok := c.used[challenge]; ok {
+		return errors.New("Challenge already used")
+	}
+	c.used[challenge] = expiresAt
+	return nil
+}
+
+// captchaChallenge checks a CAPTCHA response token with a provider using the reCAPTCHA site verify API, which
+// hCaptcha shares. Clients get their challenge from the provider's widget.
+type captchaChallenge struct {
+	logger    *zap.Logger
+	client    *http.Client
+	secret    string
+	verifyURL string
+}
+
+type captchaVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func newCaptchaChallenge(logger *zap.Logger, config *ChallengeConfig, verifyURL string) (*captchaChallenge, error) {
+	if config.Secret == "" {
+		return nil, fmt.Errorf("%v registration challenge requires a secret", config.Provider)
+	}
+	return &captchaChallenge{
+		logger:    logger,
+		client:    &http.Client{Timeout: time.Duration(config.TimeoutMs) * time.Millisecond},
+		secret:    config.Secret,
+		verifyURL: verifyURL,
+	}, nil
+}
+
+func (c *captchaChallenge) Issue() (string, error) {
+	return "", nil
+}
+
+func (c *captchaChallenge) Verify(answer string, remoteIP string) error {
+	if answer == "" {
+		return errors.New("Challenge answer is required")
+	}
+
+	form := url.Values{"secret": {c.secret}, "response": {answer}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	resp, err := c.client.PostForm(c.verifyURL, form)
+	if err != nil {
+		c.logger.Warn("Could not verify challenge", zap.Error(err))
+		return errors.New("Could not verify challenge")
+	}
+	defer resp.Body.Close()
+
+	var result captchaVerifyResponse
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		c.logger.Warn("Could not verify challenge, decode error", zap.Error(err))
+		return errors.New("Could not verify challenge")
+	}
+	if !result.Success {
+		return fmt.Errorf("Challenge not solved: %v", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
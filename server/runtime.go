@@ -21,6 +21,8 @@ import (
 	"errors"
 
 	"strings"
+	"sync"
+	"time"
 
 	"database/sql"
 
@@ -42,12 +44,23 @@ type BuiltinModule interface {
 }
 
 type Runtime struct {
-	logger *zap.Logger
-	vm     *lua.LState
-	luaEnv *lua.LTable
+	sync.RWMutex
+	logger          *zap.Logger
+	multiLogger     *zap.Logger
+	config          *RuntimeConfig
+	vm              *lua.LState
+	luaEnv          *lua.LTable
+	env             map[string]interface{}
+	goModules       *runtimeGo
+	limits          *RuntimeLimits
+	nakamaModule    func(vm *lua.LState) *NakamaModule
+	reloadMutex     sync.Mutex
+	reloadListeners []func()
+	watcherTicker   *time.Ticker
+	watcherStopCh   chan bool
 }
 
-func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config *RuntimeConfig, notificationService *NotificationService) (*Runtime, error) {
+func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config *RuntimeConfig, notificationService *NotificationService, leaderboardRankCache *LeaderboardRankCache, matchRegistry *MatchRegistry, storageFeed *StorageFeed, storageConfig *StorageConfig, sessionRegistry *SessionRegistry, cache *RuntimeCache, limits *RuntimeLimits) (*Runtime, error) {
 	if err := os.MkdirAll(config.Path, os.ModePerm); err != nil {
 		return nil, err
 	}
@@ -57,9 +70,50 @@ func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config
 	lua.LuaPathDefault = lua.LuaLDir + "/?.lua;" + lua.LuaLDir + "/?/init.lua"
 	os.Setenv(lua.LuaPath, lua.LuaPathDefault)
 
+	// Go modules are set up first, their functions take the place of any Lua functions registered for the same use.
+	goModules, err := loadRuntimeGo(logger, multiLogger, db, config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newRuntimeHTTPClient(config.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Runtime{
+		logger:          logger,
+		multiLogger:     multiLogger,
+		config:          config,
+		env:             config.Environment,
+		goModules:       goModules,
+		limits:          limits,
+		reloadListeners: make([]func(), 0),
+	}
+	r.nakamaModule = func(vm *lua.LState) *NakamaModule {
+		return NewNakamaModule(logger, db, vm, notificationService, leaderboardRankCache, matchRegistry, storageFeed, storageConfig, sessionRegistry, r, config.HTTPClient, httpClient, cache)
+	}
+
+	vm, err := r.newVM()
+	if err != nil {
+		return nil, err
+	}
+	r.vm = vm
+	r.luaEnv = ConvertMap(vm, config.Environment)
+
+	if config.ReloadIntervalMs > 0 {
+		r.startWatcher(time.Duration(config.ReloadIntervalMs) * time.Millisecond)
+	}
+
+	return r, nil
+}
+
+// newVM creates a Lua state with the standard libraries and the nakama module, then loads and evaluates all Lua
+// modules found in the runtime path into it. Any error loading or evaluating a module is returned.
+func (r *Runtime) newVM() (*lua.LState, error) {
 	vm := lua.NewState(lua.Options{
-		CallStackSize:       1024,
-		RegistrySize:        1024,
+		CallStackSize:       r.config.Limits.CallStackSize,
+		RegistrySize:        r.config.Limits.RegistrySize,
 		SkipOpenLibs:        true,
 		IncludeGoStackTrace: true,
 	})
@@ -77,21 +131,33 @@ func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config
 		vm.Push(lua.LString(name))
 		vm.Call(1, 0)
 	}
+	limitLibraryBytes(vm)
 
-	nakamaModule := NewNakamaModule(logger, db, vm, notificationService)
-	vm.PreloadModule("nakama", nakamaModule.Loader)
+	vm.PreloadModule("nakama", r.nakamaModule(vm).Loader)
 
-	r := &Runtime{
-		logger: logger,
-		vm:     vm,
-		luaEnv: ConvertMap(vm, config.Environment),
+	r.logger.Info("Initialising modules", zap.String("path", lua.LuaLDir))
+	modules, err := listModules(lua.LuaLDir)
+	if err != nil {
+		r.logger.Error("Failed to list modules", zap.Error(err))
+		vm.Close()
+		return nil, err
+	}
+
+	r.multiLogger.Info("Evaluating modules", zap.Int("count", len(modules)), zap.Strings("modules", modules))
+	if err = r.loadModules(vm, lua.LuaLDir, modules); err != nil {
+		vm.Close()
+		return nil, err
 	}
+	r.multiLogger.Info("Modules loaded")
 
-	logger.Info("Initialising modules", zap.String("path", lua.LuaLDir))
+	return vm, nil
+}
+
+// listModules returns the paths of all Lua modules under the given path.
+func listModules(luaPath string) ([]string, error) {
 	modules := make([]string, 0)
-	err := filepath.Walk(lua.LuaLDir, func(path string, f os.FileInfo, err error) error {
+	err := filepath.Walk(luaPath, func(path string, f os.FileInfo, err error) error {
 		if err != nil {
-			logger.Error("Could not read module", zap.Error(err))
 			return err
 		} else if !f.IsDir() {
 			if strings.ToLower(filepath.Ext(path)) == ".lua" {
@@ -100,21 +166,10 @@ func NewRuntime(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, config
 		}
 		return nil
 	})
-	if err != nil {
-		logger.Error("Failed to list modules", zap.Error(err))
-		return nil, err
-	}
-
-	multiLogger.Info("Evaluating modules", zap.Int("count", len(modules)), zap.Strings("modules", modules))
-	if err = r.loadModules(lua.LuaLDir, modules); err != nil {
-		return nil, err
-	}
-	multiLogger.Info("Modules loaded")
-
-	return r, nil
+	return modules, err
 }
 
-func (r *Runtime) loadModules(luaPath string, modules []string) error {
+func (r *Runtime) loadModules(vm *lua.LState, luaPath string, modules []string) error {
 	// `DoFile(..)` only parses and evaluates modules. Calling it multiple times, will load and eval the file multiple times.
 	// So to make sure that we only load and evaluate modules once, regardless of whether there is dependency between files, we load them all into `preload`.
 	// This is to make sure that modules are only loaded and evaluated once as `doFile()` does not (always) update _LOADED table.
@@ -146,10 +201,10 @@ func (r *Runtime) loadModules(luaPath string, modules []string) error {
 	//	}
 	//}
 
-	preload := r.vm.GetField(r.vm.GetField(r.vm.Get(lua.EnvironIndex), "package"), "preload")
+	preload := vm.GetField(vm.GetField(vm.Get(lua.EnvironIndex), "package"), "preload")
 	fns := make(map[string]*lua.LFunction)
 	for _, path := range modules {
-		f, err := r.vm.LoadFile(path)
+		f, err := vm.LoadFile(path)
 		if err != nil {
 			r.logger.Error("Could not load module", zap.String("name", path), zap.Error(err))
 			return err
@@ -157,21 +212,21 @@ func (r *Runtime) loadModules(luaPath string, modules []string) error {
 			relPath, _ := filepath.Rel(luaPath, path)
 			moduleName := strings.TrimSuffix(relPath, filepath.Ext(relPath))
 			moduleName = strings.Replace(moduleName, "/", ".", -1) //make paths Lua friendly
-			r.vm.SetField(preload, moduleName, f)
+			vm.SetField(preload, moduleName, f)
 			fns[moduleName] = f
 		}
 	}
 
 	for name, fn := range fns {
-		loaded := r.vm.GetField(r.vm.Get(lua.RegistryIndex), "_LOADED")
-		lv := r.vm.GetField(loaded, name)
+		loaded := vm.GetField(vm.Get(lua.RegistryIndex), "_LOADED")
+		lv := vm.GetField(loaded, name)
 		if lua.LVAsBool(lv) {
 			// Already evaluated module via `require(..)`
 			continue
 		}
 
-		r.vm.Push(fn)
-		fnErr := r.vm.PCall(0, -1, nil)
+		vm.Push(fn)
+		fnErr := vm.PCall(0, -1, nil)
 		if fnErr != nil {
 			r.logger.Error("Could not complete runtime invocation", zap.Error(fnErr))
 			return fnErr
@@ -182,11 +237,22 @@ func (r *Runtime) loadModules(luaPath string, modules []string) error {
 }
 
 func (r *Runtime) NewStateThread() (*lua.LState, context.CancelFunc) {
-	return r.vm.NewThread()
+	r.RLock()
+	vm := r.vm
+	r.RUnlock()
+	return vm.NewThread()
+}
+
+// callbacks returns the functions registered by the Lua modules currently loaded.
+func (r *Runtime) callbacks() *Callbacks {
+	r.RLock()
+	vm := r.vm
+	r.RUnlock()
+	return vm.Context().Value(CALLBACKS).(*Callbacks)
 }
 
 func (r *Runtime) GetRuntimeCallback(e ExecutionMode, key string) *lua.LFunction {
-	cp := r.vm.Context().Value(CALLBACKS).(*Callbacks)
+	cp := r.callbacks()
 	switch e {
 	case HTTP:
 		return cp.HTTP[key]
@@ -196,16 +262,53 @@ func (r *Runtime) GetRuntimeCallback(e ExecutionMode, key string) *lua.LFunction
 		return cp.Before[key]
 	case AFTER:
 		return cp.After[key]
+	case CHAT_FILTER:
+		return cp.ChatFilter
+	case TOURNAMENT_END:
+		return cp.TournamentEnd
+	case LEADERBOARD_SUBMIT:
+		return cp.LeaderboardSubmit
+	case MFA:
+		return cp.Mfa
+	case TASK:
+		return cp.Task[key]
 	}
 
 	return nil
 }
 
+// GetRuntimeMatchHandlers returns the table of match handler functions registered under the given name, if any.
+func (r *Runtime) GetRuntimeMatchHandlers(name string) *lua.LTable {
+	cp := r.callbacks()
+	return cp.Match[name]
+}
+
+// GetRuntimeJobs returns the recurring jobs registered by runtime modules, keyed by job ID.
+func (r *Runtime) GetRuntimeJobs() map[string]*RuntimeJob {
+	cp := r.callbacks()
+	return cp.Job
+}
+
 func (r *Runtime) InvokeFunctionRPC(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload []byte) ([]byte, error) {
 	l, _ := r.NewStateThread()
 	defer l.Close()
 
 	ctx := NewLuaContext(l, r.luaEnv, RPC, uid, handle, sessionExpiry)
+	return r.invokeRPC(l, fn, ctx, payload)
+}
+
+// InvokeFunctionServerRPC calls an RPC function on behalf of a trusted backend rather than a user. The function sees
+// the name of the server key the backend authenticated with as the server caller.
+func (r *Runtime) InvokeFunctionServerRPC(fn *lua.LFunction, caller string, payload []byte) ([]byte, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, RPC, uuid.Nil, "", 0)
+	ctx.RawSetString(__CTX_SERVER_CALLER, lua.LString(caller))
+	return r.invokeRPC(l, fn, ctx, payload)
+}
+
+func (r *Runtime) invokeRPC(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, payload []byte) ([]byte, error) {
 	var lv lua.LValue
 	if payload != nil {
 		lv = lua.LString(payload)
@@ -225,6 +328,8 @@ func (r *Runtime) InvokeFunctionRPC(fn *lua.LFunction, uid uuid.UUID, handle str
 	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type String/Byte")
 }
 
+// InvokeFunctionBefore calls a before hook. It returns the message to process in place of the original, or a
+// hookRejectedError if the hook returned false, or a string giving the reason, instead.
 func (r *Runtime) InvokeFunctionBefore(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, jsonpbMarshaler *jsonpb.Marshaler, jsonpbUnmarshaler *jsonpb.Unmarshaler, envelope *Envelope) (*Envelope, error) {
 	l, _ := r.NewStateThread()
 	defer l.Close()
@@ -246,18 +351,30 @@ func (r *Runtime) InvokeFunctionBefore(fn *lua.LFunction, uid uuid.UUID, handle
 
 	if retValue == nil || retValue == lua.LNil {
 		return nil, errors.New("Runtime before hook did not return the payload")
-	} else if retValue.Type() == lua.LTTable {
+	}
+	switch retValue.Type() {
+	case lua.LTTable:
 		return ConvertLTableToEnvelope(l, jsonpbUnmarshaler, retValue.(*lua.LTable), envelope)
+	case lua.LTBool:
+		if retValue == lua.LFalse {
+			return nil, &hookRejectedError{message: "Message rejected"}
+		}
+	case lua.LTString:
+		return nil, &hookRejectedError{message: lua.LVAsString(retValue)}
 	}
 
-	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table, false or String")
 }
 
-func (r *Runtime) InvokeFunctionBeforeAuthentication(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
+// InvokeFunctionBeforeAuthentication calls a before authentication hook. It returns the credentials to go on with,
+// or an authDeniedError if the hook returned false, or a string giving the reason, instead.
+func (r *Runtime) InvokeFunctionBeforeAuthentication(fn *lua.LFunction, endpoint string, clientIP string, payload map[string]interface{}) (map[string]interface{}, error) {
 	l, _ := r.NewStateThread()
 	defer l.Close()
 
-	ctx := NewLuaContext(l, r.luaEnv, BEFORE, uid, handle, sessionExpiry)
+	ctx := NewLuaContext(l, r.luaEnv, BEFORE, uuid.Nil, "", 0)
+	ctx.RawSetString(__CTX_AUTH_ENDPOINT, lua.LString(endpoint))
+	ctx.RawSetString(__CTX_CLIENT_IP, lua.LString(clientIP))
 	var lv lua.LValue
 	if payload != nil {
 		lv = ConvertMap(l, payload)
@@ -270,14 +387,24 @@ func (r *Runtime) InvokeFunctionBeforeAuthentication(fn *lua.LFunction, uid uuid
 
 	if retValue == nil || retValue == lua.LNil {
 		return nil, errors.New("Runtime before hook did not return the payload")
-	} else if retValue.Type() == lua.LTTable {
+	}
+	switch retValue.Type() {
+	case lua.LTTable:
 		return ConvertLuaTable(retValue.(*lua.LTable)), nil
+	case lua.LTBool:
+		if retValue == lua.LFalse {
+			return nil, &authDeniedError{message: "Authentication denied"}
+		}
+	case lua.LTString:
+		return nil, &authDeniedError{message: lua.LVAsString(retValue)}
 	}
 
-	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table, false or String")
 }
 
-func (r *Runtime) InvokeFunctionAfter(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) error {
+// InvokeFunctionAfter calls an after hook with the message that was processed and the response sent to the client,
+// if there was one.
+func (r *Runtime) InvokeFunctionAfter(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}, response map[string]interface{}) error {
 	l, _ := r.NewStateThread()
 	defer l.Close()
 
@@ -286,11 +413,101 @@ func (r *Runtime) InvokeFunctionAfter(fn *lua.LFunction, uid uuid.UUID, handle s
 	if payload != nil {
 		lv = ConvertMap(l, payload)
 	}
+	var rv lua.LValue
+	if response != nil {
+		rv = ConvertMap(l, response)
+	}
 
-	_, err := r.invokeFunction(l, fn, ctx, lv)
+	_, err := r.invokeFunction(l, fn, ctx, lv, rv)
 	return err
 }
 
+// InvokeFunctionChatFilter passes a chat message to the filter function. A nil result means the message is rejected,
+// otherwise the result is the message data to store.
+func (r *Runtime) InvokeFunctionChatFilter(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, topic string, data map[string]interface{}) (map[string]interface{}, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, CHAT_FILTER, uid, handle, sessionExpiry)
+	lv := ConvertMap(l, map[string]interface{}{
+		"Topic": topic,
+		"Data":  data,
+	})
+
+	retValue, err := r.invokeFunction(l, fn, ctx, lv)
+	if err != nil {
+		return nil, err
+	}
+
+	if retValue == nil || retValue == lua.LNil {
+		return nil, nil
+	} else if retValue.Type() == lua.LTTable {
+		return ConvertLuaTable(retValue.(*lua.LTable)), nil
+	}
+
+	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
+}
+
+// InvokeFunctionTournamentEnd passes a tournament and its final standings to the tournament end function.
+func (r *Runtime) InvokeFunctionTournamentEnd(fn *lua.LFunction, payload map[string]interface{}) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, TOURNAMENT_END, uuid.Nil, "", 0)
+	_, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, payload))
+	return err
+}
+
+// InvokeFunctionJob runs a scheduled run of a recurring job function.
+func (r *Runtime) InvokeFunctionJob(fn *lua.LFunction, payload map[string]interface{}) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, JOB, uuid.Nil, "", 0)
+	_, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, payload))
+	return err
+}
+
+// InvokeFunctionTask passes a deferred task to its handler function.
+func (r *Runtime) InvokeFunctionTask(fn *lua.LFunction, payload map[string]interface{}) error {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, TASK, uuid.Nil, "", 0)
+	_, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, payload))
+	return err
+}
+
+// InvokeFunctionLeaderboardSubmit passes a client score submission to the leaderboard submit function. The submission
+// is rejected only if the function returns false.
+func (r *Runtime) InvokeFunctionLeaderboardSubmit(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (bool, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, LEADERBOARD_SUBMIT, uid, handle, sessionExpiry)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, payload))
+	if err != nil {
+		return false, err
+	}
+
+	return retValue != lua.LFalse, nil
+}
+
+// InvokeFunctionMfa asks the MFA function whether a login of a user enrolled in multi-factor authentication needs a
+// code. A code is asked for unless the function returns false.
+func (r *Runtime) InvokeFunctionMfa(fn *lua.LFunction, uid uuid.UUID, handle string, payload map[string]interface{}) (bool, error) {
+	l, _ := r.NewStateThread()
+	defer l.Close()
+
+	ctx := NewLuaContext(l, r.luaEnv, MFA, uid, handle, 0)
+	retValue, err := r.invokeFunction(l, fn, ctx, ConvertMap(l, payload))
+	if err != nil {
+		return true, err
+	}
+
+	return retValue != lua.LFalse, nil
+}
+
 func (r *Runtime) InvokeFunctionHTTP(fn *lua.LFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload map[string]interface{}) (map[string]interface{}, error) {
 	l, _ := r.NewStateThread()
 	defer l.Close()
@@ -315,20 +532,36 @@ func (r *Runtime) InvokeFunctionHTTP(fn *lua.LFunction, uid uuid.UUID, handle st
 	return nil, errors.New("Runtime function returned invalid data. Only allowed one return value of type Table")
 }
 
-func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, payload lua.LValue) (lua.LValue, error) {
+func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTable, args ...lua.LValue) (lua.LValue, error) {
 	l.Push(lua.LString(__nakamaReturnValue))
 	l.Push(fn)
 
 	nargs := 1
 	l.Push(ctx)
 
-	if payload != nil {
-		nargs = 2
-		l.Push(payload)
+	// Arguments are passed up to the last one given, with nil in place of any missing before it.
+	last := len(args) - 1
+	for last >= 0 && args[last] == nil {
+		last--
+	}
+	for _, arg := range args[:last+1] {
+		if arg == nil {
+			arg = lua.LNil
+		}
+		l.Push(arg)
+		nargs++
 	}
 
+	limitCtx, cancel := r.limits.newContext(l.Context())
+	defer cancel()
+	l.SetContext(limitCtx)
+
 	err := l.PCall(nargs, lua.MultRet, nil)
 	if err != nil {
+		if limitErr := r.limits.count(limitCtx); limitErr != nil {
+			r.logger.Warn("Runtime invocation aborted", zap.Error(limitErr))
+			return nil, limitErr
+		}
 		return nil, err
 	}
 
@@ -341,7 +574,13 @@ func (r *Runtime) invokeFunction(l *lua.LState, fn *lua.LFunction, ctx *lua.LTab
 }
 
 func (r *Runtime) Stop() {
+	if r.watcherTicker != nil {
+		r.watcherTicker.Stop()
+		close(r.watcherStopCh)
+	}
+	r.RLock()
 	r.vm.Close()
+	r.RUnlock()
 }
 
 func ConvertEnvelopeToLTable(l *lua.LState, jsonpbMarshaler *jsonpb.Marshaler, envelope *Envelope) (lua.LValue, error) {
@@ -0,0 +1,126 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+type runtimeCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt int64
+}
+
+// RuntimeCache is an in-memory cache shared by all runtime module invocations on this node, so values that are
+// expensive to look up such as configuration or catalogs need not be read from the database on every request. Values
+// are kept until they expire, or until the least recently used are evicted to keep within the size limit.
+type RuntimeCache struct {
+	sync.Mutex
+	config    *RuntimeCacheConfig
+	entries   map[string]*list.Element
+	order     *list.List
+	hits      *atomic.Int64
+	misses    *atomic.Int64
+	evictions *atomic.Int64
+}
+
+// NewRuntimeCache creates a new RuntimeCache.
+func NewRuntimeCache(config *RuntimeCacheConfig) *RuntimeCache {
+	return &RuntimeCache{
+		config:    config,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+		hits:      atomic.NewInt64(0),
+		misses:    atomic.NewInt64(0),
+		evictions: atomic.NewInt64(0),
+	}
+}
+
+// Get returns the value stored under the key, if there is one and it has not expired.
+func (c *RuntimeCache) Get(key string, now int64) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	e := el.Value.(*runtimeCacheEntry)
+	if e.expiresAt <= now {
+		c.remove(el)
+		c.misses.Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	c.hits.Inc()
+	return e.value, true
+}
+
+// Set stores the value under the key for the given time in milliseconds, or for the default time if 0. Values must
+// not be changed once stored, as they are handed out to every caller.
+func (c *RuntimeCache) Set(key string, value interface{}, ttlMs int64, now int64) {
+	if ttlMs == 0 {
+		ttlMs = c.config.DefaultTTLMs
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*runtimeCacheEntry)
+		e.value = value
+		e.expiresAt = now + ttlMs
+		c.order.MoveToFront(el)
+		return
+	}
+
+	for c.config.MaxEntries > 0 && c.order.Len() >= c.config.MaxEntries {
+		c.remove(c.order.Back())
+		c.evictions.Inc()
+	}
+	c.entries[key] = c.order.PushFront(&runtimeCacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: now + ttlMs,
+	})
+}
+
+// Delete removes any value stored under the key.
+func (c *RuntimeCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats returns the number of values held, and the number of hits, misses and evictions since the server started.
+func (c *RuntimeCache) Stats() (int, int64, int64, int64) {
+	c.Lock()
+	size := c.order.Len()
+	c.Unlock()
+	return size, c.hits.Load(), c.misses.Load(), c.evictions.Load()
+}
+
+func (c *RuntimeCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*runtimeCacheEntry).key)
+}
@@ -0,0 +1,397 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// RuntimeGoContext is passed to every Go module function, with the same information Lua functions find in their
+// context table. Fields that do not apply to the call are left empty.
+type RuntimeGoContext struct {
+	Env            map[string]interface{}
+	ExecutionMode  ExecutionMode
+	UserID         uuid.UUID
+	UserHandle     string
+	UserSessionExp int64
+	MatchID        uuid.UUID
+	AuthEndpoint   string
+	ClientIP       string
+	ServerCaller   string
+}
+
+// RuntimeGoRPCFunction handles a client RPC, returning the payload to send back.
+type RuntimeGoRPCFunction func(ctx *RuntimeGoContext, payload []byte) ([]byte, error)
+
+// RuntimeGoBeforeFunction runs before a client message is processed, returning the message to process in its place.
+// An error rejects the message, returning one from NewHookRejectedError sends the client its message.
+type RuntimeGoBeforeFunction func(ctx *RuntimeGoContext, envelope *Envelope) (*Envelope, error)
+
+// RuntimeGoAfterFunction runs after a client message has been processed, with the response sent to the client, which
+// is nil if there was none.
+type RuntimeGoAfterFunction func(ctx *RuntimeGoContext, envelope *Envelope, response *Envelope) error
+
+// RuntimeGoBeforeAuthenticationFunction runs before an authentication request, returning the credentials to use in
+// its place. Returning an error from NewAuthDeniedError turns the request away with that message.
+type RuntimeGoBeforeAuthenticationFunction func(ctx *RuntimeGoContext, request *AuthenticateRequest) (*AuthenticateRequest, error)
+
+// RuntimeGoAfterAuthenticationFunction runs after a successful authentication.
+type RuntimeGoAfterAuthenticationFunction func(ctx *RuntimeGoContext, request *AuthenticateRequest) error
+
+// RuntimeGoMatchMessage is a client message received by an authoritative match since its last tick.
+type RuntimeGoMatchMessage struct {
+	Presence Presence
+	OpCode   int64
+	Data     []byte
+}
+
+// RuntimeGoMatchDispatcher lets a Go match handler act on its match, as the dispatcher table does for Lua handlers.
+type RuntimeGoMatchDispatcher interface {
+	// BroadcastMessage sends data to the given presences, or to everyone in the match if presences is nil.
+	BroadcastMessage(opCode int64, data []byte, presences []Presence)
+	MatchKick(presences []Presence)
+	MatchLabelUpdate(label string) error
+}
+
+// RuntimeGoMatch is an authoritative match handler implemented in Go, with the same functions as a Lua match handler
+// table. A new value is made for each match, and all calls happen on the match's own goroutine. Returning a nil state
+// from MatchLoop ends the match.
+type RuntimeGoMatch interface {
+	// MatchInit returns the initial state, the tick rate, 0 for the default, and the match label.
+	MatchInit(ctx *RuntimeGoContext, params map[string]interface{}) (interface{}, int, string, error)
+	// MatchJoinAttempt returns the new state and whether the presence may join, with a reason if it may not.
+	MatchJoinAttempt(ctx *RuntimeGoContext, dispatcher RuntimeGoMatchDispatcher, tick int64, state interface{}, presence Presence) (interface{}, bool, string)
+	MatchJoin(ctx *RuntimeGoContext, dispatcher RuntimeGoMatchDispatcher, tick int64, state interface{}, presences []Presence) interface{}
+	MatchLeave(ctx *RuntimeGoContext, dispatcher RuntimeGoMatchDispatcher, tick int64, state interface{}, presences []Presence) interface{}
+	MatchLoop(ctx *RuntimeGoContext, dispatcher RuntimeGoMatchDispatcher, tick int64, state interface{}, messages []*RuntimeGoMatchMessage) interface{}
+}
+
+// RuntimeGoInitializer is handed to each Go module as it loads, to register its functions. Go functions take the
+// place of any Lua function registered for the same RPC ID, message or match name.
+type RuntimeGoInitializer interface {
+	RegisterRPC(id string, fn RuntimeGoRPCFunction) error
+	RegisterBefore(messageName string, fn RuntimeGoBeforeFunction) error
+	RegisterAfter(messageName string, fn RuntimeGoAfterFunction) error
+	RegisterBeforeAuthentication(messageName string, fn RuntimeGoBeforeAuthenticationFunction) error
+	RegisterAfterAuthentication(messageName string, fn RuntimeGoAfterAuthenticationFunction) error
+	RegisterMatch(name string, fn func() RuntimeGoMatch) error
+}
+
+// RuntimeGoInitFunction sets up a Go module. Plugins export one named InitModule.
+type RuntimeGoInitFunction func(logger *zap.Logger, db *sql.DB, initializer RuntimeGoInitializer) error
+
+var runtimeGoModules = struct {
+	sync.Mutex
+	fns map[string]RuntimeGoInitFunction
+}{fns: make(map[string]RuntimeGoInitFunction)}
+
+// RegisterRuntimeGoModule adds a Go module compiled into the server. Call it from the module's init function.
+func RegisterRuntimeGoModule(name string, fn RuntimeGoInitFunction) {
+	runtimeGoModules.Lock()
+	defer runtimeGoModules.Unlock()
+	if _, ok := runtimeGoModules.fns[name]; ok {
+		panic("Go runtime module registered twice: " + name)
+	}
+	runtimeGoModules.fns[name] = fn
+}
+
+// NewHookRejectedError returns the error a Go before function uses to turn a client message away.
+func NewHookRejectedError(message string) error {
+	return &hookRejectedError{message: message}
+}
+
+// NewAuthDeniedError returns the error a Go before authentication function uses to turn a request away.
+func NewAuthDeniedError(message string) error {
+	return &authDeniedError{message: message}
+}
+
+type runtimeGo struct {
+	rpc        map[string]RuntimeGoRPCFunction
+	before     map[string]RuntimeGoBeforeFunction
+	after      map[string]RuntimeGoAfterFunction
+	beforeAuth map[string]RuntimeGoBeforeAuthenticationFunction
+	afterAuth  map[string]RuntimeGoAfterAuthenticationFunction
+	match      map[string]func() RuntimeGoMatch
+}
+
+// loadRuntimeGo runs the Go modules compiled into the server, then the plugins found in the modules path.
+func loadRuntimeGo(logger *zap.Logger, multiLogger *zap.Logger, db *sql.DB, path string) (*runtimeGo, error) {
+	rg := &runtimeGo{
+		rpc:        make(map[string]RuntimeGoRPCFunction),
+		before:     make(map[string]RuntimeGoBeforeFunction),
+		after:      make(map[string]RuntimeGoAfterFunction),
+		beforeAuth: make(map[string]RuntimeGoBeforeAuthenticationFunction),
+		afterAuth:  make(map[string]RuntimeGoAfterAuthenticationFunction),
+		match:      make(map[string]func() RuntimeGoMatch),
+	}
+
+	runtimeGoModules.Lock()
+	names := make([]string, 0, len(runtimeGoModules.fns))
+	for name := range runtimeGoModules.fns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fns := make([]RuntimeGoInitFunction, 0, len(names))
+	for _, name := range names {
+		fns = append(fns, runtimeGoModules.fns[name])
+	}
+	runtimeGoModules.Unlock()
+
+	plugins := make([]string, 0)
+	err := filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			logger.Error("Could not read module", zap.Error(err))
+			return err
+		} else if !f.IsDir() && strings.ToLower(filepath.Ext(path)) == ".so" {
+			plugins = append(plugins, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to list Go modules", zap.Error(err))
+		return nil, err
+	}
+	for _, path := range plugins {
+		p, err := plugin.Open(path)
+		if err != nil {
+			logger.Error("Could not open Go module", zap.String("path", path), zap.Error(err))
+			return nil, err
+		}
+		sym, err := p.Lookup("InitModule")
+		if err != nil {
+			logger.Error("Go module has no InitModule function", zap.String("path", path), zap.Error(err))
+			return nil, err
+		}
+		fn, ok := sym.(func(*zap.Logger, *sql.DB, RuntimeGoInitializer) error)
+		if !ok {
+			logger.Error("Go module InitModule function has the wrong signature", zap.String("path", path))
+			return nil, errors.New("Go module InitModule function has the wrong signature")
+		}
+		names = append(names, path)
+		fns = append(fns, fn)
+	}
+
+	if len(fns) == 0 {
+		return rg, nil
+	}
+	multiLogger.Info("Initialising Go modules", zap.Int("count", len(fns)), zap.Strings("modules", names))
+	for i, fn := range fns {
+		if err = runtimeGoCall(func() error { return fn(logger, db, rg) }); err != nil {
+			logger.Error("Could not initialise Go module", zap.String("name", names[i]), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	return rg, nil
+}
+
+// runtimeGoCall runs Go module code, turning a panic into an error the way a Lua error would be reported.
+func runtimeGoCall(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Go runtime function panicked: %v", r)
+		}
+	}()
+	return fn()
+}
+
+func runtimeGoMessageName(messageName string) (string, error) {
+	messageName = strings.ToLower(messageName)
+	for _, v := range RUNTIME_MESSAGES {
+		if v == messageName {
+			return messageName, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid message name for register hook: %s", messageName)
+}
+
+func (rg *runtimeGo) RegisterRPC(id string, fn RuntimeGoRPCFunction) error {
+	if id == "" {
+		return errors.New("RPC ID is required")
+	} else if _, ok := rg.rpc[id]; ok {
+		return fmt.Errorf("RPC function already registered: %s", id)
+	}
+	rg.rpc[id] = fn
+	return nil
+}
+
+func (rg *runtimeGo) RegisterBefore(messageName string, fn RuntimeGoBeforeFunction) error {
+	messageName, err := runtimeGoMessageName(messageName)
+	if err != nil {
+		return err
+	} else if strings.HasPrefix(messageName, "authenticaterequest") {
+		return errors.New("Use RegisterBeforeAuthentication for authentication messages")
+	}
+	rg.before[messageName] = fn
+	return nil
+}
+
+func (rg *runtimeGo) RegisterAfter(messageName string, fn RuntimeGoAfterFunction) error {
+	messageName, err := runtimeGoMessageName(messageName)
+	if err != nil {
+		return err
+	} else if strings.HasPrefix(messageName, "authenticaterequest") {
+		return errors.New("Use RegisterAfterAuthentication for authentication messages")
+	}
+	rg.after[messageName] = fn
+	return nil
+}
+
+func (rg *runtimeGo) RegisterBeforeAuthentication(messageName string, fn RuntimeGoBeforeAuthenticationFunction) error {
+	messageName, err := runtimeGoMessageName(messageName)
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(messageName, "authenticaterequest") {
+		return errors.New("Use RegisterBefore for messages other than authentication")
+	}
+	rg.beforeAuth[messageName] = fn
+	return nil
+}
+
+func (rg *runtimeGo) RegisterAfterAuthentication(messageName string, fn RuntimeGoAfterAuthenticationFunction) error {
+	messageName, err := runtimeGoMessageName(messageName)
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(messageName, "authenticaterequest") {
+		return errors.New("Use RegisterAfter for messages other than authentication")
+	}
+	rg.afterAuth[messageName] = fn
+	return nil
+}
+
+func (rg *runtimeGo) RegisterMatch(name string, fn func() RuntimeGoMatch) error {
+	if name == "" {
+		return errors.New("Match name is required")
+	} else if _, ok := rg.match[name]; ok {
+		return fmt.Errorf("Match handler already registered: %s", name)
+	}
+	rg.match[name] = fn
+	return nil
+}
+
+func (r *Runtime) goContext(mode ExecutionMode, uid uuid.UUID, handle string, sessionExpiry int64) *RuntimeGoContext {
+	return &RuntimeGoContext{
+		Env:            r.env,
+		ExecutionMode:  mode,
+		UserID:         uid,
+		UserHandle:     handle,
+		UserSessionExp: sessionExpiry,
+	}
+}
+
+func (r *Runtime) GetRuntimeGoRPC(id string) RuntimeGoRPCFunction {
+	return r.goModules.rpc[id]
+}
+
+func (r *Runtime) GetRuntimeGoBefore(messageName string) RuntimeGoBeforeFunction {
+	return r.goModules.before[messageName]
+}
+
+func (r *Runtime) GetRuntimeGoAfter(messageName string) RuntimeGoAfterFunction {
+	return r.goModules.after[messageName]
+}
+
+func (r *Runtime) GetRuntimeGoBeforeAuthentication(messageName string) RuntimeGoBeforeAuthenticationFunction {
+	return r.goModules.beforeAuth[messageName]
+}
+
+func (r *Runtime) GetRuntimeGoAfterAuthentication(messageName string) RuntimeGoAfterAuthenticationFunction {
+	return r.goModules.afterAuth[messageName]
+}
+
+// GetRuntimeGoMatch returns a new handler for a match of the given name, or nil if no Go module registered the name.
+func (r *Runtime) GetRuntimeGoMatch(name string) RuntimeGoMatch {
+	if fn := r.goModules.match[name]; fn != nil {
+		return fn()
+	}
+	return nil
+}
+
+func (r *Runtime) InvokeGoFunctionRPC(fn RuntimeGoRPCFunction, uid uuid.UUID, handle string, sessionExpiry int64, payload []byte) ([]byte, error) {
+	var result []byte
+	err := runtimeGoCall(func() error {
+		var fnErr error
+		result, fnErr = fn(r.goContext(RPC, uid, handle, sessionExpiry), payload)
+		return fnErr
+	})
+	return result, err
+}
+
+// InvokeGoFunctionServerRPC calls an RPC function on behalf of a trusted backend rather than a user, identified by the
+// name of the server key it authenticated with.
+func (r *Runtime) InvokeGoFunctionServerRPC(fn RuntimeGoRPCFunction, caller string, payload []byte) ([]byte, error) {
+	var result []byte
+	err := runtimeGoCall(func() error {
+		ctx := r.goContext(RPC, uuid.Nil, "", 0)
+		ctx.ServerCaller = caller
+		var fnErr error
+		result, fnErr = fn(ctx, payload)
+		return fnErr
+	})
+	return result, err
+}
+
+func (r *Runtime) InvokeGoFunctionBefore(fn RuntimeGoBeforeFunction, uid uuid.UUID, handle string, sessionExpiry int64, envelope *Envelope) (*Envelope, error) {
+	var result *Envelope
+	err := runtimeGoCall(func() error {
+		var fnErr error
+		result, fnErr = fn(r.goContext(BEFORE, uid, handle, sessionExpiry), envelope)
+		return fnErr
+	})
+	if err == nil && result == nil {
+		return nil, errors.New("Runtime before hook did not return the payload")
+	}
+	return result, err
+}
+
+func (r *Runtime) InvokeGoFunctionAfter(fn RuntimeGoAfterFunction, uid uuid.UUID, handle string, sessionExpiry int64, envelope *Envelope, response *Envelope) error {
+	return runtimeGoCall(func() error {
+		return fn(r.goContext(AFTER, uid, handle, sessionExpiry), envelope, response)
+	})
+}
+
+func (r *Runtime) InvokeGoFunctionBeforeAuthentication(fn RuntimeGoBeforeAuthenticationFunction, endpoint string, clientIP string, request *AuthenticateRequest) (*AuthenticateRequest, error) {
+	ctx := r.goContext(BEFORE, uuid.Nil, "", 0)
+	ctx.AuthEndpoint = endpoint
+	ctx.ClientIP = clientIP
+
+	var result *AuthenticateRequest
+	err := runtimeGoCall(func() error {
+		var fnErr error
+		result, fnErr = fn(ctx, request)
+		return fnErr
+	})
+	if err == nil && result == nil {
+		return nil, errors.New("Runtime before hook did not return the payload")
+	}
+	return result, err
+}
+
+func (r *Runtime) InvokeGoFunctionAfterAuthentication(fn RuntimeGoAfterAuthenticationFunction, uid uuid.UUID, handle string, sessionExpiry int64, request *AuthenticateRequest) error {
+	return runtimeGoCall(func() error {
+		return fn(r.goContext(AFTER, uid, handle, sessionExpiry), request)
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newRuntimeHTTPClient creates the client shared by all HTTP requests runtime modules make, so connections to the
+// same external services are pooled and reused. The client sets no overall timeout, each request carries its own.
+func newRuntimeHTTPClient(config *RuntimeHTTPClientConfig) (*http.Client, error) {
+	if config.TimeoutMs <= 0 || config.MaxTimeoutMs < config.TimeoutMs {
+		return nil, errors.New("runtime HTTP client timeout must be positive and no more than the max timeout")
+	}
+	if config.MaxResponseBytes <= 0 {
+		return nil, errors.New("runtime HTTP client max response bytes must be positive")
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read runtime HTTP client CA certificate file: %s", err.Error())
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in runtime HTTP client CA certificate file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(config.TimeoutMs) * time.Millisecond,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(config.IdleConnTimeoutMs) * time.Millisecond,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"math/rand"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// How often the scheduler looks for runtime jobs that are due.
+const runtimeJobSchedulerInterval = 1 * time.Second
+
+const runtimeJobMaxError = 1024
+
+const (
+	RUNTIME_JOB_STATUS_NONE int64 = iota
+	RUNTIME_JOB_STATUS_RUNNING
+	RUNTIME_JOB_STATUS_SUCCEEDED
+	RUNTIME_JOB_STATUS_FAILED
+)
+
+// RuntimeJob is a function registered by a runtime module to run on a recurring cron schedule.
+type RuntimeJob struct {
+	ID         string
+	Schedule   string
+	Expression *cronexpr.Expression
+	JitterMs   int64
+	Fn         *lua.LFunction
+}
+
+// next returns the first scheduled time after the given one, delayed by a random amount of up to the job's jitter so
+// jobs on the same schedule do not all start at once. Returns 0 if the schedule has no more runs.
+func (j *RuntimeJob) next(after int64) int64 {
+	t := j.Expression.Next(time.Unix(0, after*int64(time.Millisecond)).UTC())
+	if t.IsZero() {
+		return 0
+	}
+	next := t.UnixNano() / int64(time.Millisecond)
+	if j.JitterMs > 0 {
+		next += rand.Int63n(j.JitterMs + 1)
+	}
+	return next
+}
+
+// RuntimeJobStatus is the schedule and outcome of the last run of a runtime job.
+type RuntimeJobStatus struct {
+	ID             string
+	Schedule       string
+	NextRunAt      int64
+	LastRunAt      int64
+	LastDurationMs int64
+	LastStatus     int64
+	LastError      string
+	LastNode       string
+	Runs           int64
+	Failures       int64
+}
+
+// RuntimeJobScheduler runs the jobs registered by runtime modules when they are due. Each run is claimed in the
+// database first, so it happens at most once across the cluster however many nodes have the job registered. Runs
+// missed while no node was up are not made up, the job next runs at its first scheduled time after it is noticed.
+type RuntimeJobScheduler struct {
+	logger   *zap.Logger
+	db       *sql.DB
+	node     string
+	runtime  *Runtime
+	jobs     map[string]*RuntimeJob
+	ticker   *time.Ticker
+	reloadCh chan bool
+	stopCh   chan bool
+}
+
+// NewRuntimeJobScheduler creates a new RuntimeJobScheduler, records the jobs' schedules and starts it.
+func NewRuntimeJobScheduler(logger *zap.Logger, db *sql.DB, node string, runtime *Runtime) (*RuntimeJobScheduler, error) {
+	s := &RuntimeJobScheduler{
+		logger:   logger,
+		db:       db,
+		node:     node,
+		runtime:  runtime,
+		jobs:     runtime.GetRuntimeJobs(),
+		reloadCh: make(chan bool, 1),
+		stopCh:   make(chan bool),
+	}
+
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+
+	// Reloaded modules may register different jobs.
+	runtime.AddReloadListener(func() {
+		select {
+		case s.reloadCh <- true:
+		default:
+		}
+	})
+
+	s.ticker = time.NewTicker(runtimeJobSchedulerInterval)
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.runDue()
+			case <-s.reloadCh:
+				s.jobs = s.runtime.GetRuntimeJobs()
+				if err := s.sync(); err != nil {
+					s.logger.Error("Could not schedule reloaded runtime jobs", zap.Error(err))
+				}
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *RuntimeJobScheduler) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+// sync records jobs seen for the first time, and reschedules jobs whose schedule has changed.
+func (s *RuntimeJobScheduler) sync() error {
+	now := nowMs()
+	for _, job := range s.jobs {
+		next := job.next(now)
+		if _, err := s.db.Exec(`
+INSERT INTO runtime_job (id, schedule, next_run_at) VALUES ($1, $2, $3)
+ON CONFLICT (id) DO NOTHING`, job.ID, job.Schedule, next); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec("UPDATE runtime_job SET schedule = $2, next_run_at = $3 WHERE id = $1 AND schedule != $2", job.ID, job.Schedule, next); err != nil {
+			return err
+		}
+		s.logger.Info("Scheduled runtime job", zap.String("job_id", job.ID), zap.String("schedule", job.Schedule))
+	}
+	return nil
+}
+
+func (s *RuntimeJobScheduler) runDue() {
+	if len(s.jobs) == 0 {
+		return
+	}
+
+	rows, err := s.db.Query("SELECT id, next_run_at FROM runtime_job WHERE next_run_at > 0 AND next_run_at <= $1", nowMs())
+	if err != nil {
+		s.logger.Error("Could not find due runtime jobs", zap.Error(err))
+		return
+	}
+
+	type run struct {
+		id          string
+		scheduledAt int64
+	}
+	runs := make([]*run, 0)
+	for rows.Next() {
+		r := &run{}
+		if err = rows.Scan(&r.id, &r.scheduledAt); err != nil {
+			s.logger.Error("Could not scan due runtime jobs", zap.Error(err))
+			rows.Close()
+			return
+		}
+		runs = append(runs, r)
+	}
+	rows.Close()
+
+	for _, r := range runs {
+		// Jobs only registered by modules on other nodes are left to those nodes.
+		if job, ok := s.jobs[r.id]; ok {
+			s.run(job, r.scheduledAt)
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// run claims a due run of the job by moving its next run time forward, then invokes the job function and records
+// the outcome. Nothing is invoked if another node claimed the run first.
+func (s *RuntimeJobScheduler) run(job *RuntimeJob, scheduledAt int64) {
+	jobLogger := s.logger.With(zap.String("job_id", job.ID))
+
+	startedAt := nowMs()
+	res, err := s.db.Exec(`
+UPDATE runtime_job SET next_run_at = $3, last_run_at = $4, last_status = $5, last_node = $6, runs = runs + 1
+WHERE id = $1 AND next_run_at = $2`, job.ID, scheduledAt, job.next(startedAt), startedAt, RUNTIME_JOB_STATUS_RUNNING, s.node)
+	if err != nil {
+		jobLogger.Error("Could not claim runtime job run", zap.Error(err))
+		return
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"Id":          job.ID,
+		"ScheduledAt": scheduledAt,
+	}
+	status := RUNTIME_JOB_STATUS_SUCCEEDED
+	lastError := ""
+	failures := 0
+	if err = s.runtime.InvokeFunctionJob(job.Fn, payload); err != nil {
+		jobLogger.Error("Runtime job function caused an error", zap.Error(err))
+		status = RUNTIME_JOB_STATUS_FAILED
+		lastError = err.Error()
+		if len(lastError) > runtimeJobMaxError {
+			lastError = lastError[:runtimeJobMaxError]
+		}
+		failures = 1
+	}
+	durationMs := nowMs() - startedAt
+
+	if _, err = s.db.Exec(`
+UPDATE runtime_job SET last_duration_ms = $4, last_status = $5, last_error = $6, failures = failures + $7
+WHERE id = $1 AND last_run_at = $2 AND last_node = $3`, job.ID, startedAt, s.node, durationMs, status, lastError, failures); err != nil {
+		jobLogger.Error("Could not record runtime job outcome", zap.Error(err))
+		return
+	}
+	jobLogger.Debug("Ran runtime job", zap.Int64("duration_ms", durationMs), zap.Int64("status", status))
+}
+
+// RuntimeJobsList returns the status of the given jobs, ordered by ID. Jobs not yet recorded by a scheduler are left out.
+func RuntimeJobsList(db *sql.DB, jobs map[string]*RuntimeJob) ([]*RuntimeJobStatus, error) {
+	rows, err := db.Query(`
+SELECT id, schedule, next_run_at, last_run_at, last_duration_ms, last_status, last_error, last_node, runs, failures
+FROM runtime_job ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make([]*RuntimeJobStatus, 0)
+	for rows.Next() {
+		st := &RuntimeJobStatus{}
+		if err = rows.Scan(&st.ID, &st.Schedule, &st.NextRunAt, &st.LastRunAt, &st.LastDurationMs, &st.LastStatus, &st.LastError, &st.LastNode, &st.Runs, &st.Failures); err != nil {
+			return nil, err
+		}
+		// Rows remain for jobs no longer registered by any module.
+		if _, ok := jobs[st.ID]; ok {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses, rows.Err()
+}
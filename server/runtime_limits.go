@@ -0,0 +1,211 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/atomic"
+	"golang.org/x/net/context"
+)
+
+var closedDoneCh = make(chan struct{})
+
+// Bytes charged for each entry added with table.insert, roughly the size of a Lua value in a table.
+const runtimeTableEntryBytes = 16
+
+// runtimeLibraryFunctions lists the string and table library functions whose results are charged to the library bytes
+// limit of the invocation calling them. The Lua VM has no allocation hooks, so this is not a memory limit: the ..
+// operator, table constructors and assignments are not counted.
+var runtimeLibraryFunctions = map[string][]string{
+	lua.StringLibName: []string{"rep", "format", "gsub", "sub", "upper", "lower", "reverse", "char"},
+	lua.TabLibName:    []string{"concat", "insert"},
+}
+
+func init() {
+	close(closedDoneCh)
+}
+
+// RuntimeLimits bounds the time, number of instructions and bytes created through library functions a single invocation
+// of a runtime function may use, so a runaway hook or RPC is aborted rather than holding up the pipeline. It counts the invocations aborted for each.
+type RuntimeLimits struct {
+	config            *RuntimeLimitsConfig
+	timeAborts        *atomic.Int64
+	instructionAborts *atomic.Int64
+	libraryAborts     *atomic.Int64
+}
+
+// NewRuntimeLimits creates a new RuntimeLimits.
+func NewRuntimeLimits(config *RuntimeLimitsConfig) *RuntimeLimits {
+	return &RuntimeLimits{
+		config:            config,
+		timeAborts:        atomic.NewInt64(0),
+		instructionAborts: atomic.NewInt64(0),
+		libraryAborts:     atomic.NewInt64(0),
+	}
+}
+
+// Stats returns the number of invocations aborted for going over the time limit, the instruction limit and the
+// library bytes limit.
+func (rl *RuntimeLimits) Stats() (int64, int64, int64) {
+	return rl.timeAborts.Load(), rl.instructionAborts.Load(), rl.libraryAborts.Load()
+}
+
+// newContext returns a context that ends once the invocation has run for longer than allowed, or has executed more
+// instructions or created more bytes through library functions than allowed, and the function to call when the invocation is done.
+func (rl *RuntimeLimits) newContext(parent context.Context) (*runtimeLimitContext, context.CancelFunc) {
+	c := &runtimeLimitContext{
+		maxExecutionMs:  rl.config.MaxExecutionMs,
+		maxInstructions: rl.config.MaxInstructions,
+		maxLibraryBytes: rl.config.MaxLibraryBytes,
+	}
+	var cancel context.CancelFunc
+	if c.maxExecutionMs > 0 {
+		c.Context, cancel = context.WithTimeout(parent, time.Duration(c.maxExecutionMs)*time.Millisecond)
+	} else {
+		c.Context, cancel = context.WithCancel(parent)
+	}
+	return c, cancel
+}
+
+// count records the invocation as aborted if it went over a limit, and returns the error describing which.
+func (rl *RuntimeLimits) count(c *runtimeLimitContext) error {
+	err := c.limitErr()
+	switch {
+	case err == nil:
+	case c.libraryBytesExceeded:
+		rl.libraryAborts.Inc()
+	case c.instructionsExceeded:
+		rl.instructionAborts.Inc()
+	default:
+		rl.timeAborts.Inc()
+	}
+	return err
+}
+
+// runtimeLimitContext is set on the Lua state running an invocation. The Lua VM checks Done before every instruction,
+// which is where instructions are counted.
+type runtimeLimitContext struct {
+	context.Context
+	maxExecutionMs       int64
+	maxInstructions      int64
+	maxLibraryBytes      int64
+	instructions         int64
+	instructionsExceeded bool
+	libraryBytes         int64
+	libraryBytesExceeded bool
+}
+
+func (c *runtimeLimitContext) Done() <-chan struct{} {
+	if c.libraryBytesExceeded {
+		// Keep failing every instruction, so a script can't carry on by catching the error with pcall.
+		return closedDoneCh
+	}
+	if c.maxInstructions > 0 {
+		c.instructions++
+		if c.instructions > c.maxInstructions {
+			c.instructionsExceeded = true
+			return closedDoneCh
+		}
+	}
+	return c.Context.Done()
+}
+
+func (c *runtimeLimitContext) Err() error {
+	if err := c.limitErr(); err != nil {
+		return err
+	}
+	return c.Context.Err()
+}
+
+// chargeLibraryBytes charges bytes created by a library function to the invocation, and reports false once it has
+// created more than allowed.
+func (c *runtimeLimitContext) chargeLibraryBytes(bytes int64) bool {
+	if c.maxLibraryBytes <= 0 {
+		return true
+	}
+	c.libraryBytes += bytes
+	if c.libraryBytes > c.maxLibraryBytes {
+		c.libraryBytesExceeded = true
+	}
+	return !c.libraryBytesExceeded
+}
+
+func (c *runtimeLimitContext) limitErr() error {
+	if c.libraryBytesExceeded {
+		return fmt.Errorf("runtime invocation aborted after string and table library functions created more than %v bytes", c.maxLibraryBytes)
+	}
+	if c.instructionsExceeded {
+		return fmt.Errorf("runtime invocation aborted after exceeding the limit of %v instructions", c.maxInstructions)
+	}
+	if c.Context.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("runtime invocation aborted after exceeding the limit of %v ms", c.maxExecutionMs)
+	}
+	return nil
+}
+
+// limitLibraryBytes replaces the string and table library functions that build strings or grow tables in the Lua state
+// with ones that charge what they create to the calling invocation. Calls outside of a limited invocation, such as module loading, are not
+// charged.
+func limitLibraryBytes(vm *lua.LState) {
+	for lib, names := range runtimeLibraryFunctions {
+		mod, ok := vm.GetGlobal(lib).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			if fn, ok := mod.RawGetString(name).(*lua.LFunction); ok && fn.IsG {
+				mod.RawSetString(name, vm.NewFunction(chargeLibraryCalls(name, fn.GFunction)))
+			}
+		}
+	}
+}
+
+func chargeLibraryCalls(name string, fn lua.LGFunction) lua.LGFunction {
+	return func(l *lua.LState) int {
+		c, ok := l.Context().(*runtimeLimitContext)
+		if !ok || c.maxLibraryBytes <= 0 {
+			return fn(l)
+		}
+
+		// Charge up front where the size is known, so a single huge string is never built.
+		switch name {
+		case "rep":
+			if n := l.CheckInt64(2); n > 0 && !c.chargeLibraryBytes(int64(len(l.CheckString(1)))*n) {
+				l.RaiseError(c.limitErr().Error())
+				return 0
+			}
+		case "insert":
+			if !c.chargeLibraryBytes(runtimeTableEntryBytes) {
+				l.RaiseError(c.limitErr().Error())
+				return 0
+			}
+		}
+
+		n := fn(l)
+		if name != "rep" && name != "insert" {
+			top := l.GetTop()
+			for i := top - n + 1; i <= top; i++ {
+				if s, ok := l.Get(i).(lua.LString); ok && !c.chargeLibraryBytes(int64(len(s))) {
+					l.RaiseError(c.limitErr().Error())
+					return 0
+				}
+			}
+		}
+		return n
+	}
+}
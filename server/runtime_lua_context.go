@@ -30,6 +30,12 @@ const (
 	HTTP
 	JOB
 	LEADERBOARD_RESET
+	CHAT_FILTER
+	TOURNAMENT_END
+	LEADERBOARD_SUBMIT
+	MATCH
+	MFA
+	TASK
 )
 
 func (e ExecutionMode) String() string {
@@ -46,6 +52,18 @@ func (e ExecutionMode) String() string {
 		return "job"
 	case LEADERBOARD_RESET:
 		return "leaderboard_reset"
+	case CHAT_FILTER:
+		return "chat_filter"
+	case TOURNAMENT_END:
+		return "tournament_end"
+	case LEADERBOARD_SUBMIT:
+		return "leaderboard_submit"
+	case MATCH:
+		return "match"
+	case MFA:
+		return "mfa"
+	case TASK:
+		return "task"
 	}
 
 	return ""
@@ -57,6 +75,10 @@ const (
 	__CTX_USER_ID          = "UserId"
 	__CTX_USER_HANDLE      = "UserHandle"
 	__CTX_USER_SESSION_EXP = "UserSessionExp"
+	__CTX_MATCH_ID         = "MatchId"
+	__CTX_AUTH_ENDPOINT    = "AuthEndpoint"
+	__CTX_CLIENT_IP        = "ClientIp"
+	__CTX_SERVER_CALLER    = "ServerCaller"
 )
 
 func NewLuaContext(l *lua.LState, env *lua.LTable, mode ExecutionMode, uid uuid.UUID, handle string, sessionExpiry int64) *lua.LTable {
@@ -15,56 +15,130 @@
 package server
 
 var RUNTIME_MESSAGES = map[string]string{
-	"*server.AuthenticateRequest_Device":       "authenticaterequest_device",
-	"*server.AuthenticateRequest_Custom":       "authenticaterequest_custom",
-	"*server.AuthenticateRequest_Email_":       "authenticaterequest_email",
-	"*server.AuthenticateRequest_Facebook":     "authenticaterequest_facebook",
-	"*server.AuthenticateRequest_Google":       "authenticaterequest_google",
-	"*server.AuthenticateRequest_Steam":        "authenticaterequest_steam",
-	"*server.AuthenticateRequest_GameCenter_":  "authenticaterequest_gamecenter",
-	"*server.Envelope_Logout":                  "logout",
-	"*server.Envelope_Link":                    "tlink",
-	"*server.Envelope_Unlink":                  "tunlink",
-	"*server.Envelope_SelfFetch":               "tselffetch",
-	"*server.Envelope_SelfUpdate":              "tselfupdate",
-	"*server.Envelope_UsersFetch":              "tusersfetch",
-	"*server.Envelope_FriendsAdd":              "tfriendsadd",
-	"*server.Envelope_FriendsRemove":           "tfriendsremove",
-	"*server.Envelope_FriendsBlock":            "tfriendsblock",
-	"*server.Envelope_FriendsList":             "tfriendslist",
-	"*server.Envelope_GroupsCreate":            "tgroupscreate",
-	"*server.Envelope_GroupsUpdate":            "tgroupsupdate",
-	"*server.Envelope_GroupsRemove":            "tgroupsremove",
-	"*server.Envelope_GroupsSelfList":          "tgroupsselflist",
-	"*server.Envelope_GroupsFetch":             "tgroupsfetch",
-	"*server.Envelope_GroupsList":              "tgroupslist",
-	"*server.Envelope_GroupUsersList":          "tgroupuserslist",
-	"*server.Envelope_GroupsJoin":              "tgroupsjoin",
-	"*server.Envelope_GroupsLeave":             "tgroupsleave",
-	"*server.Envelope_GroupUsersAdd":           "tgroupusersadd",
-	"*server.Envelope_GroupUsersKick":          "tgroupuserskick",
-	"*server.Envelope_GroupUsersPromote":       "tgroupuserspromote",
-	"*server.Envelope_TopicsJoin":              "ttopicsjoin",
-	"*server.Envelope_TopicsLeave":             "ttopicsleave",
-	"*server.Envelope_TopicMessageSend":        "ttopicmessagesend",
-	"*server.Envelope_TopicMessageAck":         "ttopicmessageack",
-	"*server.Envelope_TopicMessagesList":       "ttopicmessageslist",
-	"*server.Envelope_MatchmakeAdd":            "tmatchmakeadd",
-	"*server.Envelope_MatchmakeTicket":         "tmatchmaketicket",
-	"*server.Envelope_MatchmakeRemove":         "tmatchmakeremove",
-	"*server.Envelope_MatchCreate":             "tmatchcreate",
-	"*server.Envelope_MatchesJoin":             "tmatchesjoin",
-	"*server.Envelope_MatchDataSend":           "matchdatasend",
-	"*server.Envelope_MatchesLeave":            "tmatchesleave",
-	"*server.Envelope_StorageList":             "tstoragelist",
-	"*server.Envelope_StorageFetch":            "tstoragefetch",
-	"*server.Envelope_StorageWrite":            "tstoragewrite",
-	"*server.Envelope_StorageRemove":           "tstorageremove",
-	"*server.Envelope_LeaderboardsList":        "tleaderboardslist",
-	"*server.Envelope_LeaderboardRecordsWrite": "tleaderboardrecordswrite",
-	"*server.Envelope_LeaderboardRecordsFetch": "tleaderboardrecordsfetch",
-	"*server.Envelope_LeaderboardRecordsList":  "tleaderboardrecordslist",
-	"*server.Envelope_Rpc":                     "trpc",
-	"*server.Envelope_NotificationsList":       "tnotificationslist",
-	"*server.Envelope_NotificationsRemove":     "tnotificationsremove",
+	"*server.AuthenticateRequest":                    "authenticaterequest",
+	"*server.AuthenticateRequest_Device":             "authenticaterequest_device",
+	"*server.AuthenticateRequest_Custom":             "authenticaterequest_custom",
+	"*server.AuthenticateRequest_Email_":             "authenticaterequest_email",
+	"*server.AuthenticateRequest_Facebook":           "authenticaterequest_facebook",
+	"*server.AuthenticateRequest_Google":             "authenticaterequest_google",
+	"*server.AuthenticateRequest_Steam":              "authenticaterequest_steam",
+	"*server.AuthenticateRequest_GameCenter_":        "authenticaterequest_gamecenter",
+	"*server.AuthenticateRequest_Apple_":             "authenticaterequest_apple",
+	"*server.AuthenticateRequest_Refresh":            "authenticaterequest_refresh",
+	"*server.AuthenticateRequest_Oidc":               "authenticaterequest_oidc",
+	"*server.Envelope_Logout":                        "logout",
+	"*server.Envelope_Link":                          "tlink",
+	"*server.Envelope_Unlink":                        "tunlink",
+	"*server.Envelope_SelfFetch":                     "tselffetch",
+	"*server.Envelope_SelfUpdate":                    "tselfupdate",
+	"*server.Envelope_EmailVerificationSend":         "temailverificationsend",
+	"*server.Envelope_SessionRefresh":                "tsessionrefresh",
+	"*server.Envelope_SessionsList":                  "tsessionslist",
+	"*server.Envelope_SessionLogout":                 "tsessionlogout",
+	"*server.Envelope_SessionDebug":                  "tsessiondebug",
+	"*server.Envelope_AccountMerge":                  "taccountmerge",
+	"*server.Envelope_SelfDelete":                    "tselfdelete",
+	"*server.Envelope_MfaEnroll":                     "tmfaenroll",
+	"*server.Envelope_MfaConfirm":                    "tmfaconfirm",
+	"*server.Envelope_MfaDisable":                    "tmfadisable",
+	"*server.Envelope_AuthHistoryList":               "tauthhistorylist",
+	"*server.Envelope_GuestUpgrade":                  "tguestupgrade",
+	"*server.Envelope_UsersFetch":                    "tusersfetch",
+	"*server.Envelope_FriendsAdd":                    "tfriendsadd",
+	"*server.Envelope_FriendsRemove":                 "tfriendsremove",
+	"*server.Envelope_FriendsBlock":                  "tfriendsblock",
+	"*server.Envelope_FriendsList":                   "tfriendslist",
+	"*server.Envelope_GroupsCreate":                  "tgroupscreate",
+	"*server.Envelope_GroupsUpdate":                  "tgroupsupdate",
+	"*server.Envelope_GroupsRemove":                  "tgroupsremove",
+	"*server.Envelope_GroupsSelfList":                "tgroupsselflist",
+	"*server.Envelope_GroupsFetch":                   "tgroupsfetch",
+	"*server.Envelope_GroupsList":                    "tgroupslist",
+	"*server.Envelope_GroupUsersList":                "tgroupuserslist",
+	"*server.Envelope_GroupsJoin":                    "tgroupsjoin",
+	"*server.Envelope_GroupsLeave":                   "tgroupsleave",
+	"*server.Envelope_GroupUsersAdd":                 "tgroupusersadd",
+	"*server.Envelope_GroupUsersKick":                "tgroupuserskick",
+	"*server.Envelope_GroupUsersPromote":             "tgroupuserspromote",
+	"*server.Envelope_GroupUsersBan":                 "tgroupusersban",
+	"*server.Envelope_GroupUsersUnban":               "tgroupusersunban",
+	"*server.Envelope_GroupUsersBannedList":          "tgroupusersbannedlist",
+	"*server.Envelope_GroupTransferOwnership":        "tgrouptransferownership",
+	"*server.Envelope_GroupHistoryList":              "tgrouphistorylist",
+	"*server.Envelope_GroupUsersInvite":              "tgroupusersinvite",
+	"*server.Envelope_GroupInviteAccept":             "tgroupinviteaccept",
+	"*server.Envelope_AllianceCreate":                "talliancecreate",
+	"*server.Envelope_AllianceJoin":                  "talliancejoin",
+	"*server.Envelope_AllianceLeave":                 "tallianceleave",
+	"*server.Envelope_AllianceGroupsList":            "talliancegroupslist",
+	"*server.Envelope_AllianceUsersList":             "tallianceuserslist",
+	"*server.Envelope_TopicsJoin":                    "ttopicsjoin",
+	"*server.Envelope_TopicsLeave":                   "ttopicsleave",
+	"*server.Envelope_TopicMessageSend":              "ttopicmessagesend",
+	"*server.Envelope_TopicMessageUpdate":            "ttopicmessageupdate",
+	"*server.Envelope_TopicMessageDelete":            "ttopicmessagedelete",
+	"*server.Envelope_TopicMessageAck":               "ttopicmessageack",
+	"*server.Envelope_TopicMessagesList":             "ttopicmessageslist",
+	"*server.Envelope_TopicMessageReact":             "ttopicmessagereact",
+	"*server.Envelope_TopicMessagePin":               "ttopicmessagepin",
+	"*server.Envelope_TopicMessageUnpin":             "ttopicmessageunpin",
+	"*server.Envelope_TopicPinsList":                 "ttopicpinslist",
+	"*server.Envelope_TopicMarkRead":                 "ttopicmarkread",
+	"*server.Envelope_TopicsUnreadList":              "ttopicsunreadlist",
+	"*server.Envelope_TopicUserMute":                 "ttopicusermute",
+	"*server.Envelope_TopicSlowModeSet":              "ttopicslowmodeset",
+	"*server.Envelope_TopicEphemeralSend":            "ttopicephemeralsend",
+	"*server.Envelope_MatchmakeAdd":                  "tmatchmakeadd",
+	"*server.Envelope_MatchmakeTicket":               "tmatchmaketicket",
+	"*server.Envelope_MatchmakeRemove":               "tmatchmakeremove",
+	"*server.Envelope_MatchmakeStatus":               "tmatchmakestatus",
+	"*server.Envelope_MatchmakeBackfill":             "tmatchmakebackfill",
+	"*server.Envelope_MatchCreate":                   "tmatchcreate",
+	"*server.Envelope_MatchesJoin":                   "tmatchesjoin",
+	"*server.Envelope_MatchDataSend":                 "matchdatasend",
+	"*server.Envelope_MatchesLeave":                  "tmatchesleave",
+	"*server.Envelope_MatchesList":                   "tmatcheslist",
+	"*server.Envelope_MatchLabelUpdate":              "tmatchlabelupdate",
+	"*server.Envelope_MatchReplayList":               "tmatchreplaylist",
+	"*server.Envelope_MatchReplayDownload":           "tmatchreplaydownload",
+	"*server.Envelope_TurnMatchCreate":               "tturnmatchcreate",
+	"*server.Envelope_TurnMatchesFetch":              "tturnmatchesfetch",
+	"*server.Envelope_TurnMatchesList":               "tturnmatcheslist",
+	"*server.Envelope_TurnMatchMove":                 "tturnmatchmove",
+	"*server.Envelope_TurnMatchForfeit":              "tturnmatchforfeit",
+	"*server.Envelope_StorageUpdate":                 "tstorageupdate",
+	"*server.Envelope_StorageList":                   "tstoragelist",
+	"*server.Envelope_StorageQuery":                  "tstoragequery",
+	"*server.Envelope_StorageFetch":                  "tstoragefetch",
+	"*server.Envelope_StorageWrite":                  "tstoragewrite",
+	"*server.Envelope_StorageRemove":                 "tstorageremove",
+	"*server.Envelope_StorageBatch":                  "tstoragebatch",
+	"*server.Envelope_StorageAclSet":                 "tstorageaclset",
+	"*server.Envelope_StorageAclFetch":               "tstorageaclfetch",
+	"*server.Envelope_StorageSubscribe":              "tstoragesubscribe",
+	"*server.Envelope_StorageUnsubscribe":            "tstorageunsubscribe",
+	"*server.Envelope_StorageUploadBegin":            "tstorageuploadbegin",
+	"*server.Envelope_StorageUploadAppend":           "tstorageuploadappend",
+	"*server.Envelope_StorageUploadCommit":           "tstorageuploadcommit",
+	"*server.Envelope_StorageFetchRange":             "tstoragefetchrange",
+	"*server.Envelope_StorageUsageFetch":             "tstorageusagefetch",
+	"*server.Envelope_StorageIncrement":              "tstorageincrement",
+	"*server.Envelope_LeaderboardsList":              "tleaderboardslist",
+	"*server.Envelope_LeaderboardRecordsWrite":       "tleaderboardrecordswrite",
+	"*server.Envelope_LeaderboardRecordsFetch":       "tleaderboardrecordsfetch",
+	"*server.Envelope_LeaderboardRecordsList":        "tleaderboardrecordslist",
+	"*server.Envelope_LeaderboardRecordsListArchive": "tleaderboardrecordslistarchive",
+	"*server.Envelope_TournamentsList":               "ttournamentslist",
+	"*server.Envelope_TournamentJoin":                "ttournamentjoin",
+	"*server.Envelope_TournamentRecordWrite":         "ttournamentrecordwrite",
+	"*server.Envelope_PartyCreate":                   "tpartycreate",
+	"*server.Envelope_PartyInvite":                   "tpartyinvite",
+	"*server.Envelope_PartyJoin":                     "tpartyjoin",
+	"*server.Envelope_PartyLeave":                    "tpartyleave",
+	"*server.Envelope_PartyReadySet":                 "tpartyreadyset",
+	"*server.Envelope_Rpc":                           "trpc",
+	"*server.Envelope_Purchase":                      "tpurchasevalidation",
+	"*server.Envelope_NotificationsList":             "tnotificationslist",
+	"*server.Envelope_NotificationsRemove":           "tnotificationsremove",
+	"*server.Envelope_DatagramBind":                  "tdatagrambind",
 }
@@ -45,33 +45,57 @@ import (
 const CALLBACKS = "runtime_callbacks"
 
 type Callbacks struct {
-	HTTP   map[string]*lua.LFunction
-	RPC    map[string]*lua.LFunction
-	Before map[string]*lua.LFunction
-	After  map[string]*lua.LFunction
+	HTTP              map[string]*lua.LFunction
+	RPC               map[string]*lua.LFunction
+	Before            map[string]*lua.LFunction
+	After             map[string]*lua.LFunction
+	ChatFilter        *lua.LFunction
+	TournamentEnd     *lua.LFunction
+	LeaderboardSubmit *lua.LFunction
+	Match             map[string]*lua.LTable
+	Mfa               *lua.LFunction
+	Job               map[string]*RuntimeJob
+	Task              map[string]*lua.LFunction
 }
 
 type NakamaModule struct {
-	logger              *zap.Logger
-	db                  *sql.DB
-	notificationService *NotificationService
-	client              *http.Client
+	logger               *zap.Logger
+	db                   *sql.DB
+	notificationService  *NotificationService
+	leaderboardRankCache *LeaderboardRankCache
+	matchRegistry        *MatchRegistry
+	storageFeed          *StorageFeed
+	storageConfig        *StorageConfig
+	sessionRegistry      *SessionRegistry
+	runtime              *Runtime
+	httpConfig           *RuntimeHTTPClientConfig
+	client               *http.Client
+	cache                *RuntimeCache
 }
 
-func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState, notificationService *NotificationService) *NakamaModule {
+func NewNakamaModule(logger *zap.Logger, db *sql.DB, l *lua.LState, notificationService *NotificationService, leaderboardRankCache *LeaderboardRankCache, matchRegistry *MatchRegistry, storageFeed *StorageFeed, storageConfig *StorageConfig, sessionRegistry *SessionRegistry, runtime *Runtime, httpConfig *RuntimeHTTPClientConfig, client *http.Client, cache *RuntimeCache) *NakamaModule {
 	l.SetContext(context.WithValue(context.Background(), CALLBACKS, &Callbacks{
 		RPC:    make(map[string]*lua.LFunction),
 		Before: make(map[string]*lua.LFunction),
 		After:  make(map[string]*lua.LFunction),
 		HTTP:   make(map[string]*lua.LFunction),
+		Match:  make(map[string]*lua.LTable),
+		Job:    make(map[string]*RuntimeJob),
+		Task:   make(map[string]*lua.LFunction),
 	}))
 	return &NakamaModule{
-		logger:              logger,
-		db:                  db,
-		notificationService: notificationService,
-		client: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+		logger:               logger,
+		db:                   db,
+		notificationService:  notificationService,
+		leaderboardRankCache: leaderboardRankCache,
+		matchRegistry:        matchRegistry,
+		storageFeed:          storageFeed,
+		storageConfig:        storageConfig,
+		sessionRegistry:      sessionRegistry,
+		runtime:              runtime,
+		httpConfig:           httpConfig,
+		client:               client,
+		cache:                cache,
 	}
 }
 
@@ -83,6 +107,9 @@ func (n *NakamaModule) Loader(l *lua.LState) int {
 		"uuid_bytes_to_string":           n.uuidBytesToString,
 		"uuid_string_to_bytes":           n.uuidStringToBytes,
 		"http_request":                   n.httpRequest,
+		"cache_get":                      n.cacheGet,
+		"cache_set":                      n.cacheSet,
+		"cache_delete":                   n.cacheDelete,
 		"json_encode":                    n.jsonEncode,
 		"json_decode":                    n.jsonDecode,
 		"base64_encode":                  n.base64Encode,
@@ -90,6 +117,7 @@ func (n *NakamaModule) Loader(l *lua.LState) int {
 		"base16_encode":                  n.base16Encode,
 		"base16_decode":                  n.base16decode,
 		"cron_next":                      n.cronNext,
+		"logger_debug":                   n.loggerDebug,
 		"logger_info":                    n.loggerInfo,
 		"logger_warn":                    n.loggerWarn,
 		"logger_error":                   n.loggerError,
@@ -97,26 +125,75 @@ func (n *NakamaModule) Loader(l *lua.LState) int {
 		"register_before":                n.registerBefore,
 		"register_after":                 n.registerAfter,
 		"register_http":                  n.registerHTTP,
+		"register_chat_filter":           n.registerChatFilter,
+		"register_tournament_end":        n.registerTournamentEnd,
+		"register_leaderboard_submit":    n.registerLeaderboardSubmit,
+		"register_match":                 n.registerMatch,
+		"register_mfa":                   n.registerMfa,
+		"register_job":                   n.registerJob,
+		"jobs_list":                      n.jobsList,
+		"register_task":                  n.registerTask,
+		"task_enqueue":                   n.taskEnqueue,
+		"tasks_dead_list":                n.tasksDeadList,
+		"task_retry":                     n.taskRetry,
+		"match_create":                   n.matchCreate,
 		"users_fetch_id":                 n.usersFetchId,
 		"users_fetch_handle":             n.usersFetchHandle,
 		"users_update":                   n.usersUpdate,
 		"users_ban":                      n.usersBan,
+		"user_ban":                       n.userBan,
+		"user_ban_lift":                  n.userBanLift,
+		"user_bans_list":                 n.userBansList,
+		"user_delete":                    n.userDelete,
+		"user_delete_cancel":             n.userDeleteCancel,
+		"user_auth_history_list":         n.userAuthHistoryList,
+		"account_merge":                  n.accountMerge,
 		"storage_list":                   n.storageList,
+		"storage_query":                  n.storageQuery,
 		"storage_fetch":                  n.storageFetch,
 		"storage_write":                  n.storageWrite,
 		"storage_update":                 n.storageUpdate,
 		"storage_remove":                 n.storageRemove,
+		"storage_batch":                  n.storageBatch,
+		"storage_acl_set":                n.storageAclSet,
+		"storage_acl_fetch":              n.storageAclFetch,
+		"storage_usage":                  n.storageUsage,
+		"storage_quota_set":              n.storageQuotaSet,
+		"storage_schema_set":             n.storageSchemaSet,
+		"storage_increment":              n.storageIncrement,
 		"leaderboard_create":             n.leaderboardCreate,
+		"leaderboard_delete":             n.leaderboardDelete,
+		"leaderboard_limits_set":         n.leaderboardLimitsSet,
+		"leaderboard_authoritative_set":  n.leaderboardAuthoritativeSet,
+		"leaderboards_list":              n.leaderboardsList,
+		"leaderboard_records_prune":      n.leaderboardRecordsPrune,
 		"leaderboard_submit_incr":        n.leaderboardSubmitIncr,
 		"leaderboard_submit_decr":        n.leaderboardSubmitDecr,
 		"leaderboard_submit_set":         n.leaderboardSubmitSet,
 		"leaderboard_submit_best":        n.leaderboardSubmitBest,
+		"leaderboard_submit_metadata":    n.leaderboardSubmitMetadata,
 		"leaderboard_records_list_user":  n.leaderboardRecordsListUser,
 		"leaderboard_records_list_users": n.leaderboardRecordsListUsers,
+		"tournament_create":              n.tournamentCreate,
+		"friends_add":                    n.friendsAdd,
+		"friends_remove":                 n.friendsRemove,
+		"friends_block":                  n.friendsBlock,
+		"friends_list":                   n.friendsList,
 		"groups_create":                  n.groupsCreate,
 		"groups_update":                  n.groupsUpdate,
 		"group_users_list":               n.groupUsersList,
 		"groups_user_list":               n.groupsUserList,
+		"group_users_add":                n.groupUsersAdd,
+		"group_users_kick":               n.groupUsersKick,
+		"group_users_promote":            n.groupUsersPromote,
+		"group_users_ban":                n.groupUsersBan,
+		"group_users_unban":              n.groupUsersUnban,
+		"group_users_banned_list":        n.groupUsersBannedList,
+		"group_transfer_ownership":       n.groupTransferOwnership,
+		"group_announce":                 n.groupAnnounce,
+		"topic_user_mute":                n.topicUserMute,
+		"topic_slow_mode_set":            n.topicSlowModeSet,
+		"group_history_list":             n.groupHistoryList,
 		"notifications_send_id":          n.notificationsSendId,
 	})
 
@@ -130,23 +207,19 @@ func (n *NakamaModule) sqlExec(l *lua.LState) int {
 		l.ArgError(1, "expects query string")
 		return 0
 	}
-	paramsTable := l.OptTable(2, l.NewTable())
-	if paramsTable == nil {
-		l.ArgError(2, "expects params table")
+	params, ok := sqlParams(l, 2)
+	if !ok {
 		return 0
 	}
-	var params []interface{}
-	if paramsTable.Len() != 0 {
-		var ok bool
-		params, ok = convertLuaValue(paramsTable).([]interface{})
-		if !ok {
-			l.ArgError(2, "expects a list of params as a table")
-			return 0
-		}
-	}
 
-	result, err := n.db.Exec(query, params...)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.runtime.config.SQL.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	result, err := n.db.ExecContext(ctx, query, params...)
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			l.RaiseError("sql exec error: timed out after %v ms", n.runtime.config.SQL.TimeoutMs)
+			return 0
+		}
 		l.RaiseError("sql exec error: %v", err.Error())
 		return 0
 	}
@@ -166,23 +239,25 @@ func (n *NakamaModule) sqlQuery(l *lua.LState) int {
 		l.ArgError(1, "expects query string")
 		return 0
 	}
-	paramsTable := l.OptTable(2, l.NewTable())
-	if paramsTable == nil {
-		l.ArgError(2, "expects params table")
+	params, ok := sqlParams(l, 2)
+	if !ok {
 		return 0
 	}
-	var params []interface{}
-	if paramsTable.Len() != 0 {
-		var ok bool
-		params, ok = convertLuaValue(paramsTable).([]interface{})
-		if !ok {
-			l.ArgError(2, "expects a list of params as a table")
-			return 0
-		}
+	maxRows := n.runtime.config.SQL.MaxRows
+	limit := l.OptInt(3, maxRows)
+	if limit < 1 || limit > maxRows {
+		l.ArgError(3, fmt.Sprintf("expects limit between 1 and %v", maxRows))
+		return 0
 	}
 
-	rows, err := n.db.Query(query, params...)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.runtime.config.SQL.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	rows, err := n.db.QueryContext(ctx, query, params...)
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			l.RaiseError("sql query error: timed out after %v ms", n.runtime.config.SQL.TimeoutMs)
+			return 0
+		}
 		l.RaiseError("sql query error: %v", err.Error())
 		return 0
 	}
@@ -196,6 +271,10 @@ func (n *NakamaModule) sqlQuery(l *lua.LState) int {
 	resultColumnCount := len(resultColumns)
 	resultRows := make([][]interface{}, 0)
 	for rows.Next() {
+		if len(resultRows) == limit {
+			l.RaiseError("sql query error: returned more than %v rows", limit)
+			return 0
+		}
 		resultRowValues := make([]interface{}, resultColumnCount)
 		resultRowPointers := make([]interface{}, resultColumnCount)
 		for i, _ := range resultRowValues {
@@ -208,6 +287,10 @@ func (n *NakamaModule) sqlQuery(l *lua.LState) int {
 		resultRows = append(resultRows, resultRowValues)
 	}
 	if err = rows.Err(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			l.RaiseError("sql query error: timed out after %v ms", n.runtime.config.SQL.TimeoutMs)
+			return 0
+		}
 		l.RaiseError("sql query row scan error: %v", err.Error())
 		return 0
 	}
@@ -224,6 +307,40 @@ func (n *NakamaModule) sqlQuery(l *lua.LState) int {
 	return 1
 }
 
+// sqlParams reads the optional list of positional query parameters at the given index. Parameters are bound by
+// position to $1, $2 and so on, and must be strings, numbers, booleans or nil. Raises an argument error otherwise.
+func sqlParams(l *lua.LState, index int) ([]interface{}, bool) {
+	paramsTable := l.OptTable(index, l.NewTable())
+	if paramsTable == nil {
+		l.ArgError(index, "expects params table")
+		return nil, false
+	}
+
+	maxn := paramsTable.MaxN()
+	list := true
+	paramsTable.ForEach(func(k, v lua.LValue) {
+		if n, ok := k.(lua.LNumber); !ok || n < 1 || int(n) > maxn || lua.LNumber(int(n)) != n {
+			list = false
+		}
+	})
+	if !list {
+		l.ArgError(index, "expects a list of params as a table")
+		return nil, false
+	}
+
+	params := make([]interface{}, maxn)
+	for i := 1; i <= maxn; i++ {
+		switch v := paramsTable.RawGetInt(i); v.Type() {
+		case lua.LTNil, lua.LTBool, lua.LTNumber, lua.LTString:
+			params[i-1] = convertLuaValue(v)
+		default:
+			l.ArgError(index, "expects params to be strings, numbers, booleans or nil")
+			return nil, false
+		}
+	}
+	return params, true
+}
+
 func (n *NakamaModule) uuidV4(l *lua.LState) int {
 	// TODO ensure there were no arguments to the function
 	l.Push(lua.LString(uuid.NewV4().String()))
@@ -265,6 +382,7 @@ func (n *NakamaModule) httpRequest(l *lua.LState) int {
 	method := l.CheckString(2)
 	headers := l.CheckTable(3)
 	body := l.OptString(4, "")
+	timeoutMs := l.OptInt64(5, n.httpConfig.TimeoutMs)
 	if url == "" {
 		l.ArgError(1, "Expects URL string")
 		return 0
@@ -273,6 +391,10 @@ func (n *NakamaModule) httpRequest(l *lua.LState) int {
 		l.ArgError(2, "Expects method string")
 		return 0
 	}
+	if timeoutMs <= 0 || timeoutMs > n.httpConfig.MaxTimeoutMs {
+		l.ArgError(5, fmt.Sprintf("Expects timeout between 1 and %v milliseconds", n.httpConfig.MaxTimeoutMs))
+		return 0
+	}
 
 	// Prepare request body, if any.
 	var requestBody io.Reader
@@ -295,19 +417,31 @@ func (n *NakamaModule) httpRequest(l *lua.LState) int {
 			req.Header.Add(k, vs)
 		}
 	}
+	// The timeout covers the whole exchange, including reading the response body.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
 	// Execute the request.
-	resp, err := n.client.Do(req)
+	resp, err := n.client.Do(req.WithContext(ctx))
 	if err != nil {
 		l.RaiseError("HTTP request error: %v", err.Error())
 		return 0
 	}
-	// Read the response body.
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	if resp.ContentLength > n.httpConfig.MaxResponseBytes {
+		resp.Body.Close()
+		l.RaiseError("HTTP response body exceeds %v bytes", n.httpConfig.MaxResponseBytes)
+		return 0
+	}
+	// Read the response body, one byte past the limit to tell if it was exceeded.
+	responseBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, n.httpConfig.MaxResponseBytes+1))
 	resp.Body.Close()
 	if err != nil {
 		l.RaiseError("HTTP response body error: %v", err.Error())
 		return 0
 	}
+	if int64(len(responseBody)) > n.httpConfig.MaxResponseBytes {
+		l.RaiseError("HTTP response body exceeds %v bytes", n.httpConfig.MaxResponseBytes)
+		return 0
+	}
 	// Read the response headers.
 	responseHeaders := make(map[string]interface{}, len(resp.Header))
 	for k, vs := range resp.Header {
@@ -324,6 +458,55 @@ func (n *NakamaModule) httpRequest(l *lua.LState) int {
 	return 3
 }
 
+func (n *NakamaModule) cacheGet(l *lua.LState) int {
+	key := l.CheckString(1)
+	if key == "" {
+		l.ArgError(1, "Expects key string")
+		return 0
+	}
+
+	value, found := n.cache.Get(key, nowMs())
+	if !found {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(convertValue(l, value))
+	return 1
+}
+
+func (n *NakamaModule) cacheSet(l *lua.LState) int {
+	key := l.CheckString(1)
+	value := l.Get(2)
+	ttlMs := l.OptInt64(3, 0)
+	if key == "" {
+		l.ArgError(1, "Expects key string")
+		return 0
+	}
+	if value == lua.LNil {
+		l.ArgError(2, "Expects a non-nil value to cache")
+		return 0
+	}
+	if ttlMs < 0 {
+		l.ArgError(3, "Expects TTL to be 0 or more milliseconds")
+		return 0
+	}
+
+	// Values are copied out of the Lua state so they can be shared safely with other invocations.
+	n.cache.Set(key, convertLuaValue(value), ttlMs, nowMs())
+	return 0
+}
+
+func (n *NakamaModule) cacheDelete(l *lua.LState) int {
+	key := l.CheckString(1)
+	if key == "" {
+		l.ArgError(1, "Expects key string")
+		return 0
+	}
+
+	n.cache.Delete(key)
+	return 0
+}
+
 func (n *NakamaModule) jsonEncode(l *lua.LState) int {
 	jsonTable := l.Get(1)
 	if jsonTable == nil {
@@ -438,35 +621,48 @@ func (n *NakamaModule) cronNext(l *lua.LState) int {
 	return 1
 }
 
+func (n *NakamaModule) loggerDebug(l *lua.LState) int {
+	return n.log(l, n.logger.Debug)
+}
+
 func (n *NakamaModule) loggerInfo(l *lua.LState) int {
-	message := l.CheckString(1)
-	if message == "" {
-		l.ArgError(1, "expects message string")
-		return 0
-	}
-	n.logger.Info(message)
-	l.Push(lua.LString(message))
-	return 1
+	return n.log(l, n.logger.Info)
 }
 
 func (n *NakamaModule) loggerWarn(l *lua.LState) int {
-	message := l.CheckString(1)
-	if message == "" {
-		l.ArgError(1, "expects message string")
-		return 0
-	}
-	n.logger.Warn(message)
-	l.Push(lua.LString(message))
-	return 1
+	return n.log(l, n.logger.Warn)
 }
 
 func (n *NakamaModule) loggerError(l *lua.LState) int {
+	return n.log(l, n.logger.Error)
+}
+
+// log writes the message at the given level, with the key/value pairs of the optional fields table and the source,
+// line and function of the Lua code doing the logging.
+func (n *NakamaModule) log(l *lua.LState, logFn func(string, ...zap.Field)) int {
 	message := l.CheckString(1)
 	if message == "" {
 		l.ArgError(1, "expects message string")
 		return 0
 	}
-	n.logger.Error(message)
+	fieldsTable := l.OptTable(2, nil)
+
+	fields := make([]zap.Field, 0)
+	if dbg, ok := l.GetStack(1); ok {
+		if _, err := l.GetInfo("Sln", dbg, lua.LNil); err == nil {
+			fields = append(fields, zap.String("runtime_source", dbg.Source), zap.Int("runtime_line", dbg.CurrentLine))
+			if dbg.Name != "" {
+				fields = append(fields, zap.String("runtime_function", dbg.Name))
+			}
+		}
+	}
+	if fieldsTable != nil {
+		fieldsTable.ForEach(func(k lua.LValue, v lua.LValue) {
+			fields = append(fields, zap.Any(k.String(), convertLuaValue(v)))
+		})
+	}
+
+	logFn(message, fields...)
 	l.Push(lua.LString(message))
 	return 1
 }
@@ -570,6 +766,244 @@ func (n *NakamaModule) registerHTTP(l *lua.LState) int {
 	return 0
 }
 
+func (n *NakamaModule) registerChatFilter(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.ChatFilter = fn
+	n.logger.Info("Registered chat filter function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerTournamentEnd(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.TournamentEnd = fn
+	n.logger.Info("Registered tournament end function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerLeaderboardSubmit(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.LeaderboardSubmit = fn
+	n.logger.Info("Registered leaderboard submit function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerMfa(l *lua.LState) int {
+	fn := l.CheckFunction(1)
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Mfa = fn
+	n.logger.Info("Registered MFA function invocation")
+	return 0
+}
+
+func (n *NakamaModule) registerJob(l *lua.LState) int {
+	id := l.CheckString(1)
+	schedule := l.CheckString(2)
+	fn := l.CheckFunction(3)
+	jitterMs := l.OptInt64(4, 0)
+
+	if id == "" || len(id) > 128 {
+		l.ArgError(1, "expects ID between 1 and 128 characters")
+		return 0
+	}
+	expr, err := cronexpr.Parse(schedule)
+	if err != nil {
+		l.ArgError(2, "expects a valid cron string")
+		return 0
+	}
+	if jitterMs < 0 {
+		l.ArgError(4, "expects jitter to be 0 or more milliseconds")
+		return 0
+	}
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Job[id] = &RuntimeJob{
+		ID:         id,
+		Schedule:   schedule,
+		Expression: expr,
+		JitterMs:   jitterMs,
+		Fn:         fn,
+	}
+	n.logger.Info("Registered job function invocation", zap.String("id", id), zap.String("schedule", schedule))
+	return 0
+}
+
+func (n *NakamaModule) jobsList(l *lua.LState) int {
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	statuses, err := RuntimeJobsList(n.db, rc.Job)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list jobs: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, st := range statuses {
+		lv.RawSetInt(i+1, ConvertMap(l, map[string]interface{}{
+			"Id":             st.ID,
+			"Schedule":       st.Schedule,
+			"NextRunAt":      st.NextRunAt,
+			"LastRunAt":      st.LastRunAt,
+			"LastDurationMs": st.LastDurationMs,
+			"LastStatus":     st.LastStatus,
+			"LastError":      st.LastError,
+			"LastNode":       st.LastNode,
+			"Runs":           st.Runs,
+			"Failures":       st.Failures,
+		}))
+	}
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) registerTask(l *lua.LState) int {
+	handler := l.CheckString(1)
+	fn := l.CheckFunction(2)
+
+	if handler == "" || len(handler) > 128 {
+		l.ArgError(1, "expects handler name between 1 and 128 characters")
+		return 0
+	}
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Task[handler] = fn
+	n.logger.Info("Registered task function invocation", zap.String("handler", handler))
+	return 0
+}
+
+func (n *NakamaModule) taskEnqueue(l *lua.LState) int {
+	handler := l.CheckString(1)
+	payload := l.OptTable(2, nil)
+	runAt := l.OptInt64(3, 0)
+
+	if handler == "" || len(handler) > 128 {
+		l.ArgError(1, "expects handler name between 1 and 128 characters")
+		return 0
+	}
+	payloadBytes := []byte("{}")
+	if payload != nil {
+		var err error
+		if payloadBytes, err = json.Marshal(ConvertLuaTable(payload)); err != nil {
+			l.ArgError(2, fmt.Sprintf("expects a payload that can be encoded as JSON: %s", err.Error()))
+			return 0
+		}
+	}
+	if runAt < 0 {
+		l.ArgError(3, "expects run time to be 0 or a timestamp in milliseconds")
+		return 0
+	}
+
+	id, err := RuntimeTaskEnqueue(n.db, handler, payloadBytes, runAt)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to enqueue task: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LString(id.String()))
+	return 1
+}
+
+func (n *NakamaModule) tasksDeadList(l *lua.LState) int {
+	limit := l.OptInt(1, 100)
+	if limit < 1 || limit > 1000 {
+		l.ArgError(1, "expects limit between 1 and 1000")
+		return 0
+	}
+
+	tasks, err := RuntimeTasksDeadList(n.db, limit)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list dead tasks: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, t := range tasks {
+		payload := make(map[string]interface{})
+		if err = json.Unmarshal(t.Payload, &payload); err != nil {
+			l.RaiseError(fmt.Sprintf("failed to decode task payload: %s", err.Error()))
+			return 0
+		}
+		lv.RawSetInt(i+1, ConvertMap(l, map[string]interface{}{
+			"Id":        t.ID.String(),
+			"Handler":   t.Handler,
+			"Payload":   payload,
+			"Attempts":  t.Attempts,
+			"LastError": t.LastError,
+			"CreatedAt": t.CreatedAt,
+			"UpdatedAt": t.UpdatedAt,
+		}))
+	}
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) taskRetry(l *lua.LState) int {
+	id, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid task ID")
+		return 0
+	}
+
+	retried, err := RuntimeTaskRetry(n.db, id)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to retry task: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LBool(retried))
+	return 1
+}
+
+func (n *NakamaModule) registerMatch(l *lua.LState) int {
+	name := l.CheckString(1)
+	handlers := l.CheckTable(2)
+
+	if name == "" {
+		l.ArgError(1, "expects name")
+		return 0
+	}
+	for _, fnName := range []string{"match_init", "match_loop"} {
+		if handlers.RawGetString(fnName).Type() != lua.LTFunction {
+			l.ArgError(2, "expects handlers to include "+fnName+" function")
+			return 0
+		}
+	}
+
+	rc := l.Context().Value(CALLBACKS).(*Callbacks)
+	rc.Match[name] = handlers
+	n.logger.Info("Registered match handlers", zap.String("name", name))
+	return 0
+}
+
+func (n *NakamaModule) matchCreate(l *lua.LState) int {
+	name := l.CheckString(1)
+	params := l.OptTable(2, nil)
+
+	if n.matchRegistry == nil {
+		l.RaiseError("authoritative matches are not available")
+		return 0
+	}
+
+	var paramsMap map[string]interface{}
+	if params != nil {
+		paramsMap = ConvertLuaTable(params)
+	}
+
+	matchID, err := n.matchRegistry.Create(n.runtime, name, paramsMap)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create match: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LString(matchID.String()))
+	return 1
+}
+
 func (n *NakamaModule) usersFetchId(l *lua.LState) int {
 	lt := l.CheckTable(1)
 	userIds, ok := convertLuaValue(lt).([]interface{})
@@ -810,56 +1244,234 @@ func (n *NakamaModule) usersBan(l *lua.LState) int {
 		}
 	}
 
-	if err := UsersBan(n.logger, n.db, ids, handles); err != nil {
+	bannedIDs, err := UsersBan(n.logger, n.db, ids, handles)
+	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to ban users: %s", err.Error()))
+		return 0
+	}
+	if n.sessionRegistry != nil {
+		for _, id := range bannedIDs {
+			n.sessionRegistry.disconnectUser(id, sessionCloseBanned, "Banned")
+		}
 	}
 
 	return 0
 }
 
-func (n *NakamaModule) storageList(l *lua.LState) int {
-	var userID []byte
-	if us := l.OptString(1, ""); us != "" {
-		if uid, err := uuid.FromString(us); err != nil {
-			l.ArgError(1, "expects a valid user ID or nil")
-			return 0
-		} else {
-			userID = uid.Bytes()
-		}
+func (n *NakamaModule) userBan(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
 	}
-	bucket := l.OptString(2, "")
-	collection := l.OptString(3, "")
-	limit := l.CheckInt64(4)
-	var cursor []byte
-	if cs := l.OptString(5, ""); cs != "" {
-		cb, err := base64.StdEncoding.DecodeString(cs)
-		if err != nil {
-			l.ArgError(5, "cursor is invalid")
-			return 0
-		}
-		cursor = cb
+	reason := l.OptString(2, "")
+	durationMs := l.OptInt64(3, 0)
+	if durationMs < 0 {
+		l.ArgError(3, "expects a duration of 0 or more")
+		return 0
 	}
 
-	values, newCursor, _, err := StorageList(n.logger, n.db, uuid.Nil, userID, bucket, collection, limit, cursor)
+	ban, _, err := UserBanCreate(n.logger, n.db, uuid.Nil, userID, reason, durationMs)
 	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to list storage: %s", err.Error()))
+		l.RaiseError(fmt.Sprintf("failed to ban user: %s", err.Error()))
 		return 0
 	}
+	if n.sessionRegistry != nil {
+		n.sessionRegistry.disconnectUser(userID, sessionCloseBanned, ban.Message())
+	}
 
-	// Convert and push the values.
-	lv := l.NewTable()
-	for i, v := range values {
-		// Convert UUIDs to string representation if needed.
-		if len(v.UserId) != 0 {
-			uid, _ := uuid.FromBytes(v.UserId)
-			v.UserId = []byte(uid.String())
-		}
-		vm := structs.Map(v)
+	return 0
+}
 
-		valueMap := make(map[string]interface{})
-		err = json.Unmarshal(v.Value, &valueMap)
-		if err != nil {
-			l.RaiseError(fmt.Sprintf("failed to convert value to json: %s", err.Error()))
+func (n *NakamaModule) userBanLift(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err = UserBanLift(n.logger, n.db, uuid.Nil, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to lift user ban: %s", err.Error()))
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) userBansList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	bans, err := UserBansList(n.logger, n.db, userID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list user bans: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, b := range bans {
+		bt := l.NewTable()
+		bt.RawSetString("UserId", lua.LString(b.UserID.String()))
+		bt.RawSetString("CreatedAt", lua.LNumber(b.CreatedAt))
+		if b.CreatedBy != uuid.Nil {
+			bt.RawSetString("CreatedBy", lua.LString(b.CreatedBy.String()))
+		}
+		bt.RawSetString("Reason", lua.LString(b.Reason))
+		bt.RawSetString("ExpiresAt", lua.LNumber(b.ExpiresAt))
+		bt.RawSetString("LiftedAt", lua.LNumber(b.LiftedAt))
+		if b.LiftedBy != uuid.Nil {
+			bt.RawSetString("LiftedBy", lua.LString(b.LiftedBy.String()))
+		}
+		lv.RawSetInt(i+1, bt)
+	}
+	l.Push(lv)
+
+	return 1
+}
+
+func (n *NakamaModule) accountMerge(l *lua.LState) int {
+	target, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid target user ID")
+		return 0
+	}
+	source, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid source user ID")
+		return 0
+	}
+
+	if _, err = AccountMerge(n.logger, n.db, n.leaderboardRankCache, target, source); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to merge accounts: %s", err.Error()))
+		return 0
+	}
+	if n.sessionRegistry != nil {
+		n.sessionRegistry.disconnectUser(source, sessionCloseMerged, "Account merged into another account")
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) userDelete(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err = AccountDelete(n.logger, n.db, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to delete user: %s", err.Error()))
+		return 0
+	}
+	if n.sessionRegistry != nil {
+		n.sessionRegistry.disconnectUser(userID, sessionCloseDeleted, "Account deleted")
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) userDeleteCancel(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err = AccountDeleteCancel(n.logger, n.db, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to cancel user deletion: %s", err.Error()))
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) userAuthHistoryList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	limit := l.OptInt64(2, 10)
+	var cursor []byte
+	if cs := l.OptString(3, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(3, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	entries, newCursor, _, err := AuthHistoryList(n.logger, n.db, userID, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list user auth history: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, e := range entries {
+		id, _ := uuid.FromBytes(e.Id)
+		e.Id = []byte(id.String())
+		lv.RawSetInt(i+1, ConvertMap(l, structs.Map(e)))
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if len(newCursor) != 0 {
+		newCursorString := base64.StdEncoding.EncodeToString(newCursor)
+		l.Push(lua.LString(newCursorString))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) storageList(l *lua.LState) int {
+	var userID []byte
+	if us := l.OptString(1, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(1, "expects a valid user ID or nil")
+			return 0
+		} else {
+			userID = uid.Bytes()
+		}
+	}
+	bucket := l.OptString(2, "")
+	collection := l.OptString(3, "")
+	limit := l.CheckInt64(4)
+	var cursor []byte
+	if cs := l.OptString(5, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(5, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	values, newCursor, _, err := StorageList(n.logger, n.db, uuid.Nil, userID, bucket, collection, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list storage: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, v := range values {
+		// Convert UUIDs to string representation if needed.
+		if len(v.UserId) != 0 {
+			uid, _ := uuid.FromBytes(v.UserId)
+			v.UserId = []byte(uid.String())
+		}
+		vm := structs.Map(v)
+
+		valueMap := make(map[string]interface{})
+		err = json.Unmarshal(v.Value, &valueMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert value to json: %s", err.Error()))
 			return 0
 		}
 
@@ -880,6 +1492,88 @@ func (n *NakamaModule) storageList(l *lua.LState) int {
 	return 2
 }
 
+func (n *NakamaModule) storageQuery(l *lua.LState) int {
+	var userID []byte
+	if us := l.OptString(1, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(1, "expects a valid user ID or nil")
+			return 0
+		} else {
+			userID = uid.Bytes()
+		}
+	}
+	bucket := l.CheckString(2)
+	collection := l.CheckString(3)
+	var filters []*StorageCondition
+	if ft := l.OptTable(4, nil); ft != nil && ft.Len() != 0 {
+		fs, ok := convertLuaValue(ft).([]interface{})
+		if !ok {
+			l.ArgError(4, "expects a list of filter tables")
+			return 0
+		}
+		for _, fi := range fs {
+			fm, ok := fi.(map[string]interface{})
+			if !ok {
+				l.ArgError(4, "expects a list of filter tables")
+				return 0
+			}
+			field, _ := fm["Field"].(string)
+			op, _ := fm["Op"].(string)
+			filters = append(filters, &StorageCondition{Field: field, Op: op, Value: fm["Value"]})
+		}
+	}
+	sortField := l.OptString(5, "")
+	sortDescending := l.OptBool(6, false)
+	limit := l.OptInt64(7, 0)
+	var cursor []byte
+	if cs := l.OptString(8, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(8, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	values, newCursor, _, err := StorageQuery(n.logger, n.db, uuid.Nil, userID, bucket, collection, filters, sortField, sortDescending, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to query storage: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, v := range values {
+		// Convert UUIDs to string representation if needed.
+		if len(v.UserId) != 0 {
+			uid, _ := uuid.FromBytes(v.UserId)
+			v.UserId = []byte(uid.String())
+		}
+		vm := structs.Map(v)
+
+		valueMap := make(map[string]interface{})
+		err = json.Unmarshal(v.Value, &valueMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert value to json: %s", err.Error()))
+			return 0
+		}
+
+		lt := ConvertMap(l, vm)
+		lt.RawSetString("Value", ConvertMap(l, valueMap))
+		lv.RawSetInt(i+1, lt)
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if len(newCursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(newCursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
 func (n *NakamaModule) storageFetch(l *lua.LState) int {
 	keysTable := l.CheckTable(1)
 	if keysTable == nil || keysTable.Len() == 0 {
@@ -1006,158 +1700,43 @@ func (n *NakamaModule) storageWrite(l *lua.LState) int {
 		l.ArgError(1, "expects a valid set of data")
 		return 0
 	}
-	dataMap := make([]map[string]interface{}, 0)
-	for _, d := range dataRaw {
-		if m, ok := d.(map[string]interface{}); !ok {
-			l.ArgError(1, "expects a valid set of data")
-			return 0
-		} else {
-			dataMap = append(dataMap, m)
-		}
+	data := storageWriteData(l, 1, dataRaw)
+	if data == nil {
+		return 0
 	}
 
-	data := make([]*StorageData, len(dataMap))
-	idx := 0
-	for _, k := range dataMap {
-		var bucket string
-		if b, ok := k["Bucket"]; !ok {
-			l.ArgError(1, "expects a bucket in each key")
-			return 0
-		} else {
-			if bs, ok := b.(string); !ok {
-				l.ArgError(1, "bucket must be a string")
-				return 0
-			} else {
-				bucket = bs
-			}
-		}
-		var collection string
-		if c, ok := k["Collection"]; !ok {
-			l.ArgError(1, "expects a collection in each key")
-			return 0
-		} else {
-			if cs, ok := c.(string); !ok {
-				l.ArgError(1, "collection must be a string")
-				return 0
-			} else {
-				collection = cs
-			}
-		}
-		var record string
-		if r, ok := k["Record"]; !ok {
-			l.ArgError(1, "expects a record in each key")
-			return 0
-		} else {
-			if rs, ok := r.(string); !ok {
-				l.ArgError(1, "record must be a string")
-				return 0
-			} else {
-				record = rs
-			}
-		}
-		var value []byte
-		if v, ok := k["Value"]; !ok {
-			l.ArgError(1, "expects a value in each key")
-			return 0
-		} else {
-			if vs, ok := v.(map[string]interface{}); !ok {
-				l.ArgError(1, "value must be a table")
-				return 0
-			} else {
-				dataJson, err := json.Marshal(vs)
-				if err != nil {
-					l.RaiseError("could not convert value to JSON: %v", err.Error())
-					return 0
-				}
-				value = dataJson
-			}
-		}
-		var userID []byte
-		if u, ok := k["UserId"]; ok {
-			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each value, when provided")
-				return 0
-			} else {
-				uid, err := uuid.FromString(us)
-				if err != nil {
-					l.ArgError(1, "expects valid user IDs in each value, when provided")
-					return 0
-				}
-				userID = uid.Bytes()
-			}
-		}
-		var version []byte
-		if v, ok := k["Version"]; ok {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "version must be a string")
-				return 0
-			} else {
-				version = []byte(vs)
-			}
-		}
-		readPermission := int64(1)
-		if r, ok := k["PermissionRead"]; ok {
-			if rf, ok := r.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				readPermission = int64(rf)
-			}
-		}
-		writePermission := int64(1)
-		if w, ok := k["PermissionWrite"]; ok {
-			if wf, ok := w.(float64); !ok {
-				l.ArgError(1, "permission read must be a number")
-				return 0
-			} else {
-				writePermission = int64(wf)
-			}
-		}
-
-		data[idx] = &StorageData{
-			Bucket:          bucket,
-			Collection:      collection,
-			Record:          record,
-			UserId:          userID,
-			Value:           value,
-			Version:         version,
-			PermissionRead:  readPermission,
-			PermissionWrite: writePermission,
-		}
-		idx++
-	}
-
-	keys, _, err := StorageWrite(n.logger, n.db, uuid.Nil, data)
-	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to write storage: %s", err.Error()))
-		return 0
-	}
-
-	lv := l.NewTable()
-	for i, k := range keys {
-		km := structs.Map(k)
-		lv.RawSetInt(i+1, convertValue(l, km))
-	}
-
-	l.Push(lv)
-	return 1
-}
-
-func (n *NakamaModule) storageUpdate(l *lua.LState) int {
-	updatesTable := l.CheckTable(1)
-	if updatesTable == nil || updatesTable.Len() == 0 {
-		l.ArgError(1, "expects a valid set of user updates")
-		return 0
-	}
-
-	conversionError := ""
-	updates := make([]*StorageKeyUpdate, 0)
-
-	updatesTable.ForEach(func(i lua.LValue, u lua.LValue) {
-		updateTable, ok := u.(*lua.LTable)
-		if !ok {
-			conversionError = "expects a valid set of user updates"
-			return
+	keys, _, err := StorageWrite(n.logger, n.db, n.storageConfig, uuid.Nil, data)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to write storage: %s", err.Error()))
+		return 0
+	}
+	n.storageFeed.Publish(storageWriteChanges(uuid.Nil, data, keys))
+
+	lv := l.NewTable()
+	for i, k := range keys {
+		km := structs.Map(k)
+		lv.RawSetInt(i+1, convertValue(l, km))
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) storageUpdate(l *lua.LState) int {
+	updatesTable := l.CheckTable(1)
+	if updatesTable == nil || updatesTable.Len() == 0 {
+		l.ArgError(1, "expects a valid set of user updates")
+		return 0
+	}
+
+	conversionError := ""
+	updates := make([]*StorageKeyUpdate, 0)
+
+	updatesTable.ForEach(func(i lua.LValue, u lua.LValue) {
+		updateTable, ok := u.(*lua.LTable)
+		if !ok {
+			conversionError = "expects a valid set of user updates"
+			return
 		}
 
 		// Initialise fields where default values for their types are not the logical defaults needed.
@@ -1216,6 +1795,12 @@ func (n *NakamaModule) storageUpdate(l *lua.LState) int {
 					return
 				}
 				update.PermissionWrite = int64(lua.LVAsNumber(v))
+			case "ExpiresAt":
+				if v.Type() != lua.LTNumber {
+					conversionError = "expects valid expiry times in each update"
+					return
+				}
+				update.ExpiresAt = int64(lua.LVAsNumber(v))
 			case "Update":
 				if v.Type() != lua.LTTable {
 					conversionError = "expects valid patch op in each update"
@@ -1281,11 +1866,12 @@ func (n *NakamaModule) storageUpdate(l *lua.LState) int {
 		return 0
 	}
 
-	keys, _, err := StorageUpdate(n.logger, n.db, uuid.Nil, updates)
+	keys, _, err := StorageUpdate(n.logger, n.db, n.storageConfig, uuid.Nil, updates)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to update storage: %s", err.Error()))
 		return 0
 	}
+	n.storageFeed.Publish(storageUpdateChanges(updates, keys))
 
 	lv := l.NewTable()
 	for i, k := range keys {
@@ -1308,11 +1894,415 @@ func (n *NakamaModule) storageRemove(l *lua.LState) int {
 		l.ArgError(1, "expects a valid set of data")
 		return 0
 	}
+	keys := storageRemoveKeys(l, 1, keysRaw)
+	if keys == nil {
+		return 0
+	}
+
+	if _, err := StorageRemove(n.logger, n.db, uuid.Nil, keys); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to remove storage: %s", err.Error()))
+		return 0
+	}
+	n.storageFeed.Publish(storageRemoveChanges(keys))
+	return 0
+}
+
+func (n *NakamaModule) storageBatch(l *lua.LState) int {
+	var writes []*StorageData
+	if writesTable := l.OptTable(1, nil); writesTable != nil && writesTable.Len() != 0 {
+		writesRaw, ok := convertLuaValue(writesTable).([]interface{})
+		if !ok {
+			l.ArgError(1, "expects a valid set of data")
+			return 0
+		}
+		if writes = storageWriteData(l, 1, writesRaw); writes == nil {
+			return 0
+		}
+	}
+	var removes []*StorageKey
+	if removesTable := l.OptTable(2, nil); removesTable != nil && removesTable.Len() != 0 {
+		removesRaw, ok := convertLuaValue(removesTable).([]interface{})
+		if !ok {
+			l.ArgError(2, "expects a valid set of keys")
+			return 0
+		}
+		if removes = storageRemoveKeys(l, 2, removesRaw); removes == nil {
+			return 0
+		}
+	}
+
+	keys, _, err := StorageBatch(n.logger, n.db, n.storageConfig, uuid.Nil, writes, removes)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to write storage batch: %s", err.Error()))
+		return 0
+	}
+	n.storageFeed.Publish(append(storageRemoveChanges(removes), storageWriteChanges(uuid.Nil, writes, keys)...))
+
+	lv := l.NewTable()
+	for i, k := range keys {
+		km := structs.Map(k)
+		lv.RawSetInt(i+1, convertValue(l, km))
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) storageAclSet(l *lua.LState) int {
+	keys := storageRemoveKeys(l, 1, []interface{}{convertLuaValue(l.CheckTable(1))})
+	if keys == nil {
+		return 0
+	}
+	var entriesRaw []interface{}
+	if entriesTable := l.CheckTable(2); entriesTable.Len() != 0 {
+		raw, ok := convertLuaValue(entriesTable).([]interface{})
+		if !ok {
+			l.ArgError(2, "expects a valid set of ACL entries")
+			return 0
+		}
+		entriesRaw = raw
+	}
+
+	entries := make([]*StorageAcl, 0, len(entriesRaw))
+	for _, er := range entriesRaw {
+		em, ok := er.(map[string]interface{})
+		if !ok {
+			l.ArgError(2, "expects a valid set of ACL entries")
+			return 0
+		}
+		entry := &StorageAcl{}
+		if u, ok := em["UserId"]; ok {
+			us, _ := u.(string)
+			uid, err := uuid.FromString(us)
+			if err != nil {
+				l.ArgError(2, "expects valid user IDs in each ACL entry, when provided")
+				return 0
+			}
+			entry.UserId = uid.Bytes()
+		}
+		if g, ok := em["GroupId"]; ok {
+			gs, _ := g.(string)
+			gid, err := uuid.FromString(gs)
+			if err != nil {
+				l.ArgError(2, "expects valid group IDs in each ACL entry, when provided")
+				return 0
+			}
+			entry.GroupId = gid.Bytes()
+		}
+		entry.Read, _ = em["Read"].(bool)
+		entry.Write, _ = em["Write"].(bool)
+		entries = append(entries, entry)
+	}
+
+	if _, err := StorageAclSet(n.logger, n.db, uuid.Nil, keys[0], entries); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set storage ACL: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) storageAclFetch(l *lua.LState) int {
+	keys := storageRemoveKeys(l, 1, []interface{}{convertLuaValue(l.CheckTable(1))})
+	if keys == nil {
+		return 0
+	}
+
+	entries, _, err := StorageAclFetch(n.logger, n.db, uuid.Nil, keys[0])
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to fetch storage ACL: %s", err.Error()))
+		return 0
+	}
+
+	lv := l.NewTable()
+	for i, e := range entries {
+		et := l.NewTable()
+		if len(e.UserId) != 0 {
+			et.RawSetString("UserId", lua.LString(uuid.FromBytesOrNil(e.UserId).String()))
+		}
+		if len(e.GroupId) != 0 {
+			et.RawSetString("GroupId", lua.LString(uuid.FromBytesOrNil(e.GroupId).String()))
+		}
+		et.RawSetString("Read", lua.LBool(e.Read))
+		et.RawSetString("Write", lua.LBool(e.Write))
+		lv.RawSetInt(i+1, et)
+	}
+
+	l.Push(lv)
+	return 1
+}
+
+func (n *NakamaModule) storageUsage(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	used, quota, _, err := StorageUsageFetch(n.logger, n.db, n.storageConfig, userID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to fetch storage usage: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LNumber(used))
+	l.Push(lua.LNumber(quota))
+	return 2
+}
+
+func (n *NakamaModule) storageQuotaSet(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+
+	// A nil quota restores the configured quota.
+	quota := int64(-1)
+	if l.Get(2) != lua.LNil {
+		quota = l.CheckInt64(2)
+		if quota < 0 {
+			l.ArgError(2, "expects a quota of 0 or more bytes, or nil")
+			return 0
+		}
+	}
+
+	if err = StorageQuotaSet(n.logger, n.db, userID, quota); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set storage quota: %s", err.Error()))
+		return 0
+	}
+	return 0
+}
+
+func (n *NakamaModule) storageSchemaSet(l *lua.LState) int {
+	bucket := l.CheckString(1)
+	if bucket == "" {
+		l.ArgError(1, "expects a bucket")
+		return 0
+	}
+	collection := l.CheckString(2)
+	if collection == "" {
+		l.ArgError(2, "expects a collection")
+		return 0
+	}
+	// A nil schema removes the collection's schema.
+	schema := l.OptString(3, "")
+
+	if _, err := StorageSchemaSet(n.logger, n.db, bucket, collection, []byte(schema)); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set storage schema: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) storageIncrement(l *lua.LState) int {
+	var userID []byte
+	if us := l.OptString(1, ""); us != "" {
+		if uid, err := uuid.FromString(us); err != nil {
+			l.ArgError(1, "expects a valid user ID or nil")
+			return 0
+		} else {
+			userID = uid.Bytes()
+		}
+	}
+	key := &StorageKey{
+		Bucket:     l.CheckString(2),
+		Collection: l.CheckString(3),
+		Record:     l.CheckString(4),
+		UserId:     userID,
+	}
+	field := l.CheckString(5)
+	delta := float64(l.CheckNumber(6))
+	var conditions []*StorageCondition
+	if ct := l.OptTable(7, nil); ct != nil && ct.Len() != 0 {
+		cs, ok := convertLuaValue(ct).([]interface{})
+		if !ok {
+			l.ArgError(7, "expects a list of condition tables")
+			return 0
+		}
+		for _, ci := range cs {
+			cm, ok := ci.(map[string]interface{})
+			if !ok {
+				l.ArgError(7, "expects a list of condition tables")
+				return 0
+			}
+			field, _ := cm["Field"].(string)
+			op, _ := cm["Op"].(string)
+			conditions = append(conditions, &StorageCondition{Field: field, Op: op, Value: cm["Value"]})
+		}
+	}
+
+	data, value, _, err := StorageIncrement(n.logger, n.db, n.storageConfig, uuid.Nil, key, field, delta, conditions)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to increment storage: %s", err.Error()))
+		return 0
+	}
+	n.storageFeed.Publish(storageIncrementChanges(uuid.Nil, data))
+
+	l.Push(lua.LNumber(value))
+	l.Push(lua.LString(data.Version))
+	return 2
+}
+
+// storageWriteData converts a list of Lua tables, the function argument at the given position, into storage writes.
+func storageWriteData(l *lua.LState, arg int, dataRaw []interface{}) []*StorageData {
+	dataMap := make([]map[string]interface{}, 0)
+	for _, d := range dataRaw {
+		if m, ok := d.(map[string]interface{}); !ok {
+			l.ArgError(arg, "expects a valid set of data")
+			return nil
+		} else {
+			dataMap = append(dataMap, m)
+		}
+	}
+
+	data := make([]*StorageData, len(dataMap))
+	idx := 0
+	for _, k := range dataMap {
+		var bucket string
+		if b, ok := k["Bucket"]; !ok {
+			l.ArgError(arg, "expects a bucket in each key")
+			return nil
+		} else {
+			if bs, ok := b.(string); !ok {
+				l.ArgError(arg, "bucket must be a string")
+				return nil
+			} else {
+				bucket = bs
+			}
+		}
+		var collection string
+		if c, ok := k["Collection"]; !ok {
+			l.ArgError(arg, "expects a collection in each key")
+			return nil
+		} else {
+			if cs, ok := c.(string); !ok {
+				l.ArgError(arg, "collection must be a string")
+				return nil
+			} else {
+				collection = cs
+			}
+		}
+		var record string
+		if r, ok := k["Record"]; !ok {
+			l.ArgError(arg, "expects a record in each key")
+			return nil
+		} else {
+			if rs, ok := r.(string); !ok {
+				l.ArgError(arg, "record must be a string")
+				return nil
+			} else {
+				record = rs
+			}
+		}
+		var value []byte
+		if v, ok := k["Value"]; !ok {
+			l.ArgError(arg, "expects a value in each key")
+			return nil
+		} else {
+			if vs, ok := v.(map[string]interface{}); !ok {
+				l.ArgError(arg, "value must be a table")
+				return nil
+			} else {
+				dataJson, err := json.Marshal(vs)
+				if err != nil {
+					l.RaiseError("could not convert value to JSON: %v", err.Error())
+					return nil
+				}
+				value = dataJson
+			}
+		}
+		var userID []byte
+		if u, ok := k["UserId"]; ok {
+			if us, ok := u.(string); !ok {
+				l.ArgError(arg, "expects valid user IDs in each value, when provided")
+				return nil
+			} else {
+				uid, err := uuid.FromString(us)
+				if err != nil {
+					l.ArgError(arg, "expects valid user IDs in each value, when provided")
+					return nil
+				}
+				userID = uid.Bytes()
+			}
+		}
+		var version []byte
+		if v, ok := k["Version"]; ok {
+			if vs, ok := v.(string); !ok {
+				l.ArgError(arg, "version must be a string")
+				return nil
+			} else {
+				version = []byte(vs)
+			}
+		}
+		readPermission := int64(1)
+		if r, ok := k["PermissionRead"]; ok {
+			if rf, ok := r.(float64); !ok {
+				l.ArgError(arg, "permission read must be a number")
+				return nil
+			} else {
+				readPermission = int64(rf)
+			}
+		}
+		writePermission := int64(1)
+		if w, ok := k["PermissionWrite"]; ok {
+			if wf, ok := w.(float64); !ok {
+				l.ArgError(arg, "permission read must be a number")
+				return nil
+			} else {
+				writePermission = int64(wf)
+			}
+		}
+		expiresAt := int64(0)
+		if e, ok := k["ExpiresAt"]; ok {
+			if ef, ok := e.(float64); !ok {
+				l.ArgError(arg, "expires at must be a number")
+				return nil
+			} else {
+				expiresAt = int64(ef)
+			}
+		}
+		var conditions []*StorageCondition
+		if c, ok := k["Conditions"]; ok {
+			cs, ok := c.([]interface{})
+			if !ok {
+				l.ArgError(arg, "conditions must be a list of tables")
+				return nil
+			}
+			for _, ci := range cs {
+				cm, ok := ci.(map[string]interface{})
+				if !ok {
+					l.ArgError(arg, "conditions must be a list of tables")
+					return nil
+				}
+				field, _ := cm["Field"].(string)
+				op, _ := cm["Op"].(string)
+				conditions = append(conditions, &StorageCondition{Field: field, Op: op, Value: cm["Value"]})
+			}
+		}
+
+		data[idx] = &StorageData{
+			Bucket:          bucket,
+			Collection:      collection,
+			Record:          record,
+			UserId:          userID,
+			Value:           value,
+			Version:         version,
+			PermissionRead:  readPermission,
+			PermissionWrite: writePermission,
+			Conditions:      conditions,
+			ExpiresAt:       expiresAt,
+		}
+		idx++
+	}
+
+	return data
+}
+
+// storageRemoveKeys converts a list of Lua tables, the function argument at the given position, into storage keys.
+func storageRemoveKeys(l *lua.LState, arg int, keysRaw []interface{}) []*StorageKey {
 	keyMap := make([]map[string]interface{}, 0)
 	for _, d := range keysRaw {
 		if m, ok := d.(map[string]interface{}); !ok {
-			l.ArgError(1, "expects a valid set of data")
-			return 0
+			l.ArgError(arg, "expects a valid set of data")
+			return nil
 		} else {
 			keyMap = append(keyMap, m)
 		}
@@ -1323,85 +2313,269 @@ func (n *NakamaModule) storageRemove(l *lua.LState) int {
 	for _, k := range keyMap {
 		var bucket string
 		if b, ok := k["Bucket"]; !ok {
-			l.ArgError(1, "expects a bucket in each key")
-			return 0
+			l.ArgError(arg, "expects a bucket in each key")
+			return nil
 		} else {
 			if bs, ok := b.(string); !ok {
-				l.ArgError(1, "bucket must be a string")
-				return 0
+				l.ArgError(arg, "bucket must be a string")
+				return nil
 			} else {
 				bucket = bs
 			}
 		}
 		var collection string
 		if c, ok := k["Collection"]; !ok {
-			l.ArgError(1, "expects a collection in each key")
+			l.ArgError(arg, "expects a collection in each key")
+			return nil
+		} else {
+			if cs, ok := c.(string); !ok {
+				l.ArgError(arg, "collection must be a string")
+				return nil
+			} else {
+				collection = cs
+			}
+		}
+		var record string
+		if r, ok := k["Record"]; !ok {
+			l.ArgError(arg, "expects a record in each key")
+			return nil
+		} else {
+			if rs, ok := r.(string); !ok {
+				l.ArgError(arg, "record must be a string")
+				return nil
+			} else {
+				record = rs
+			}
+		}
+		var userID []byte
+		if u, ok := k["UserId"]; ok {
+			if us, ok := u.(string); !ok {
+				l.ArgError(arg, "expects valid user IDs in each key, when provided")
+				return nil
+			} else {
+				uid, err := uuid.FromString(us)
+				if err != nil {
+					l.ArgError(arg, "expects valid user IDs in each key, when provided")
+					return nil
+				}
+				userID = uid.Bytes()
+			}
+		}
+		var version []byte
+		if v, ok := k["Version"]; ok {
+			if vs, ok := v.(string); !ok {
+				l.ArgError(arg, "version must be a string")
+				return nil
+			} else {
+				version = []byte(vs)
+			}
+		}
+		keys[idx] = &StorageKey{
+			Bucket:     bucket,
+			Collection: collection,
+			Record:     record,
+			UserId:     userID,
+			Version:    version,
+		}
+		idx++
+	}
+
+	return keys
+}
+
+func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
+	id := l.CheckString(1)
+	sort := l.CheckString(2)
+	reset := l.OptString(3, "")
+	metadata := l.OptTable(4, l.NewTable())
+	authoritative := l.OptBool(5, false)
+	group := l.OptString(6, "")
+
+	if sort != "asc" && sort != "desc" {
+		l.ArgError(2, "invalid sort - only acceptable values are 'asc' and 'desc'")
+		return 0
+	}
+
+	var groupID []byte
+	if group != "" {
+		gid, err := uuid.FromString(group)
+		if err != nil {
+			l.ArgError(6, "expects group ID to be a valid identifier")
+			return 0
+		}
+		groupID = gid.Bytes()
+	}
+
+	metadataMap := ConvertLuaTable(metadata)
+	metadataBytes, err := json.Marshal(metadataMap)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert metadata: %s", err.Error()))
+		return 0
+	}
+
+	_, err = leaderboardCreate(n.logger, n.db, []byte(id), sort, reset, string(metadataBytes), authoritative, groupID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to create leaderboard: %s", err.Error()))
+	}
+
+	return 0
+}
+
+func (n *NakamaModule) leaderboardDelete(l *lua.LState) int {
+	id := l.CheckString(1)
+	if id == "" {
+		l.ArgError(1, "expects a valid leaderboard id")
+		return 0
+	}
+
+	if err := leaderboardDelete(n.logger, n.db, n.leaderboardRankCache, []byte(id)); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to delete leaderboard: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) leaderboardAuthoritativeSet(l *lua.LState) int {
+	id := l.CheckString(1)
+	if id == "" {
+		l.ArgError(1, "expects a valid leaderboard id")
+		return 0
+	}
+	authoritative := l.CheckBool(2)
+
+	found, err := LeaderboardAuthoritativeSet(n.db, []byte(id), authoritative)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set leaderboard authoritative: %s", err.Error()))
+		return 0
+	} else if !found {
+		l.RaiseError("failed to set leaderboard authoritative: leaderboard not found")
+		return 0
+	}
+	return 0
+}
+
+func (n *NakamaModule) leaderboardsList(l *lua.LState) int {
+	limit := l.OptInt64(1, 10)
+	if limit < 1 || limit > 100 {
+		l.ArgError(1, "expects limit between 1 and 100")
+		return 0
+	}
+	var cursor []byte
+	if cs := l.OptString(2, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(2, "cursor is invalid")
 			return 0
-		} else {
-			if cs, ok := c.(string); !ok {
-				l.ArgError(1, "collection must be a string")
-				return 0
-			} else {
-				collection = cs
-			}
 		}
-		var record string
-		if r, ok := k["Record"]; !ok {
-			l.ArgError(1, "expects a record in each key")
-			return 0
+		cursor = cb
+	}
+
+	leaderboards, newCursor, _, err := LeaderboardsList(n.logger, n.db, uuid.Nil, nil, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list leaderboards: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, lb := range leaderboards {
+		lt := l.NewTable()
+		lt.RawSetString("Id", lua.LString(lb.Id))
+		lt.RawSetString("Authoritative", lua.LBool(lb.Authoritative))
+		if lb.Sort == 0 {
+			lt.RawSetString("Sort", lua.LString("asc"))
 		} else {
-			if rs, ok := r.(string); !ok {
-				l.ArgError(1, "record must be a string")
-				return 0
-			} else {
-				record = rs
-			}
-		}
-		var userID []byte
-		if u, ok := k["UserId"]; ok {
-			if us, ok := u.(string); !ok {
-				l.ArgError(1, "expects valid user IDs in each key, when provided")
-				return 0
-			} else {
-				uid, err := uuid.FromString(us)
-				if err != nil {
-					l.ArgError(1, "expects valid user IDs in each key, when provided")
-					return 0
-				}
-				userID = uid.Bytes()
-			}
+			lt.RawSetString("Sort", lua.LString("desc"))
 		}
-		var version []byte
-		if v, ok := k["Version"]; ok {
-			if vs, ok := v.(string); !ok {
-				l.ArgError(1, "version must be a string")
-				return 0
-			} else {
-				version = []byte(vs)
-			}
+		lt.RawSetString("Count", lua.LNumber(lb.Count))
+		lt.RawSetString("ResetSchedule", lua.LString(lb.ResetSchedule))
+		if len(lb.GroupId) != 0 {
+			gid, _ := uuid.FromBytes(lb.GroupId)
+			lt.RawSetString("GroupId", lua.LString(gid.String()))
 		}
-		keys[idx] = &StorageKey{
-			Bucket:     bucket,
-			Collection: collection,
-			Record:     record,
-			UserId:     userID,
-			Version:    version,
+
+		metadataMap := make(map[string]interface{})
+		if err = json.Unmarshal(lb.Metadata, &metadataMap); err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert leaderboard metadata to json: %s", err.Error()))
+			return 0
 		}
-		idx++
+		lt.RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, lt)
 	}
+	l.Push(lv)
 
-	if _, err := StorageRemove(n.logger, n.db, uuid.Nil, keys); err != nil {
-		l.RaiseError(fmt.Sprintf("failed to remove storage: %s", err.Error()))
+	// Convert and push the new cursor, if any.
+	if len(newCursor) != 0 {
+		l.Push(lua.LString(base64.StdEncoding.EncodeToString(newCursor)))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) leaderboardLimitsSet(l *lua.LState) int {
+	id := l.CheckString(1)
+	if id == "" {
+		l.ArgError(1, "expects a valid leaderboard id")
+		return 0
+	}
+	// Bounds are optional, nil removes them.
+	var minDelta *int64
+	if l.Get(2) != lua.LNil {
+		v := l.CheckInt64(2)
+		minDelta = &v
+	}
+	var maxDelta *int64
+	if l.Get(3) != lua.LNil {
+		v := l.CheckInt64(3)
+		maxDelta = &v
+	}
+	maxSubmitRate := l.OptInt64(4, 0)
+	if maxSubmitRate < 0 {
+		l.ArgError(4, "expects a submission rate of 0 or greater")
+		return 0
+	}
+
+	if err := leaderboardLimitsSet(n.logger, n.db, []byte(id), minDelta, maxDelta, maxSubmitRate); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set leaderboard limits: %s", err.Error()))
 	}
 	return 0
 }
 
-func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
+func (n *NakamaModule) leaderboardRecordsPrune(l *lua.LState) int {
+	id := l.CheckString(1)
+	if id == "" {
+		l.ArgError(1, "expects a valid leaderboard id")
+		return 0
+	}
+	olderThan := l.OptInt64(2, 0)
+	belowRank := l.OptInt64(3, 0)
+	if olderThan == 0 && belowRank == 0 {
+		l.ArgError(2, "expects an update time or rank threshold")
+		return 0
+	}
+
+	count, err := leaderboardRecordsPrune(n.logger, n.db, n.leaderboardRankCache, []byte(id), olderThan, belowRank)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to prune leaderboard records: %s", err.Error()))
+		return 0
+	}
+
+	l.Push(lua.LNumber(count))
+	return 1
+}
+
+func (n *NakamaModule) tournamentCreate(l *lua.LState) int {
 	id := l.CheckString(1)
 	sort := l.CheckString(2)
-	reset := l.OptString(3, "")
-	metadata := l.OptTable(4, l.NewTable())
-	authoritative := l.OptBool(5, false)
+	startTime := l.CheckInt64(3)
+	endTime := l.CheckInt64(4)
+	maxSize := l.OptInt64(5, 0)
+	joinRequired := l.OptBool(6, false)
+	metadata := l.OptTable(7, l.NewTable())
+	title := l.OptString(8, "")
+	description := l.OptString(9, "")
+	authoritative := l.OptBool(10, false)
 
 	if sort != "asc" && sort != "desc" {
 		l.ArgError(2, "invalid sort - only acceptable values are 'asc' and 'desc'")
@@ -1415,9 +2589,9 @@ func (n *NakamaModule) leaderboardCreate(l *lua.LState) int {
 		return 0
 	}
 
-	_, err = leaderboardCreate(n.logger, n.db, []byte(id), sort, reset, string(metadataBytes), authoritative)
+	err = tournamentCreate(n.logger, n.db, []byte(id), sort, string(metadataBytes), authoritative, title, description, startTime, endTime, maxSize, joinRequired)
 	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to create leaderboard: %s", err.Error()))
+		l.RaiseError(fmt.Sprintf("failed to create tournament: %s", err.Error()))
 	}
 
 	return 0
@@ -1436,6 +2610,46 @@ func (n *NakamaModule) leaderboardSubmitBest(l *lua.LState) int {
 	return n.leaderboardSubmit(l, "best")
 }
 
+func (n *NakamaModule) leaderboardSubmitMetadata(l *lua.LState) int {
+	leaderboardID := l.CheckString(1)
+	oId := l.CheckString(2)
+	metadata := l.CheckTable(3)
+
+	ownerID, err := uuid.FromString(oId)
+	if err != nil {
+		l.ArgError(2, "invalid owner id")
+		return 0
+	}
+
+	metadataBytes, err := json.Marshal(ConvertLuaTable(metadata))
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert leaderboard record metadata: %s", err.Error()))
+		return 0
+	}
+
+	record, _, err := leaderboardSubmit(n.logger, n.db, n.leaderboardRankCache, uuid.Nil, []byte(leaderboardID), ownerID, "", "", "metadata", 0, "", "", metadataBytes)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to update leaderboard record metadata: %s", err.Error()))
+		return 0
+	}
+
+	oid, _ := uuid.FromBytes(record.OwnerId)
+	record.OwnerId = []byte(oid.String())
+	rm := structs.Map(record)
+
+	outgoingMetadataMap := make(map[string]interface{})
+	if err = json.Unmarshal(record.Metadata, &outgoingMetadataMap); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert leaderboard record metadata to json: %s", err.Error()))
+		return 0
+	}
+
+	lv := ConvertMap(l, rm)
+	lv.RawSetString("Metadata", ConvertMap(l, outgoingMetadataMap))
+
+	l.Push(lv)
+	return 1
+}
+
 func (n *NakamaModule) leaderboardSubmit(l *lua.LState, op string) int {
 	leaderboardID := l.CheckString(1)
 	value := l.CheckInt64(2)
@@ -1459,7 +2673,7 @@ func (n *NakamaModule) leaderboardSubmit(l *lua.LState, op string) int {
 		return 0
 	}
 
-	record, _, err := leaderboardSubmit(n.logger, n.db, uuid.Nil, []byte(leaderboardID), ownerID, handle, lang, op, value, location, timezone, metadataBytes)
+	record, _, err := leaderboardSubmit(n.logger, n.db, n.leaderboardRankCache, uuid.Nil, []byte(leaderboardID), ownerID, handle, lang, op, value, location, timezone, metadataBytes)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to submit leaderboard record: %s", err.Error()))
 		return 0
@@ -1514,7 +2728,95 @@ func (n *NakamaModule) leaderboardRecordsListUser(l *lua.LState) int {
 		Limit: limit,
 	}
 
-	records, newCursor, _, err := leaderboardRecordsList(n.logger, n.db, uuid.Nil, list)
+	records, newCursor, _, err := leaderboardRecordsList(n.logger, n.db, n.leaderboardRankCache, uuid.Nil, list)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list leadeboard records: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, r := range records {
+		// Convert UUIDs to string representation.
+		uid, _ := uuid.FromBytes(r.OwnerId)
+		r.OwnerId = []byte(uid.String())
+		rm := structs.Map(r)
+
+		metadataMap := make(map[string]interface{})
+		err = json.Unmarshal(r.Metadata, &metadataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
+			return 0
+		}
+
+		rt := ConvertMap(l, rm)
+		rt.RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, rt)
+	}
+	l.Push(lv)
+
+	if newCursor == nil {
+		l.Push(lua.LNil)
+	} else {
+		l.Push(lua.LString(newCursor))
+	}
+
+	return 2
+}
+
+func (n *NakamaModule) leaderboardRecordsListUsers(l *lua.LState) int {
+	leaderboardID := l.CheckString(1)
+	if leaderboardID == "" {
+		l.ArgError(1, "expects a valid leaderboard id")
+		return 0
+	}
+	users := l.CheckTable(2)
+	if users == nil {
+		l.ArgError(2, "expects a valid list of user ids")
+		return 0
+	}
+	limit := l.CheckInt64(3)
+	if limit == 0 {
+		l.ArgError(2, "expects a valid limit 10-100")
+		return 0
+	}
+	cursor := l.OptString(4, "")
+
+	// Construct the operation.
+	list := &TLeaderboardRecordsList{
+		LeaderboardId: []byte(leaderboardID),
+		Filter: &TLeaderboardRecordsList_OwnerIds{
+			OwnerIds: &TLeaderboardRecordsList_Owners{
+				OwnerIds: make([][]byte, 0),
+			},
+		},
+		Limit: limit,
+	}
+	if cursor != "" {
+		list.Cursor = []byte(cursor)
+	}
+
+	conversionError := ""
+	users.ForEach(func(k lua.LValue, v lua.LValue) {
+		if v.Type() != lua.LTString {
+			conversionError = "expects user ids to be strings"
+			return
+		}
+
+		u, err := uuid.FromString(v.String())
+		if err != nil {
+			conversionError = "expects user ids to be valid"
+			return
+		}
+		list.GetOwnerIds().OwnerIds = append(list.GetOwnerIds().OwnerIds, u.Bytes())
+	})
+
+	if conversionError != "" {
+		l.ArgError(2, conversionError)
+		return 0
+	}
+
+	records, newCursor, _, err := leaderboardRecordsList(n.logger, n.db, n.leaderboardRankCache, uuid.Nil, list)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to list leadeboard records: %s", err.Error()))
 		return 0
@@ -1550,92 +2852,119 @@ func (n *NakamaModule) leaderboardRecordsListUser(l *lua.LState) int {
 	return 2
 }
 
-func (n *NakamaModule) leaderboardRecordsListUsers(l *lua.LState) int {
-	leaderboardID := l.CheckString(1)
-	if leaderboardID == "" {
-		l.ArgError(1, "expects a valid leaderboard id")
+func (n *NakamaModule) friendsAdd(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	friendID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid friend ID")
+		return 0
+	}
+	if userID == friendID {
+		l.ArgError(2, "expects a friend ID different to the user ID")
+		return 0
+	}
+
+	if n.notificationService == nil {
+		l.RaiseError("notifications are not available")
+		return 0
+	}
+
+	var handle string
+	if err = n.db.QueryRow("SELECT handle FROM users WHERE id = $1 AND disabled_at = 0", userID.Bytes()).Scan(&handle); err != nil {
+		if err == sql.ErrNoRows {
+			l.RaiseError("failed to add friend: user not found")
+		} else {
+			l.RaiseError(fmt.Sprintf("failed to add friend: %s", err.Error()))
+		}
+		return 0
+	}
+
+	if err = friendAdd(n.logger, n.db, n.notificationService, userID.Bytes(), handle, friendID.Bytes()); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add friend: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) friendsRemove(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
+		return 0
+	}
+	friendID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid friend ID")
+		return 0
+	}
+
+	if err = friendRemove(n.logger, n.db, userID.Bytes(), friendID.Bytes()); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to remove friend: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) friendsBlock(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
 		return 0
 	}
-	users := l.CheckTable(2)
-	if users == nil {
-		l.ArgError(2, "expects a valid list of user ids")
+	blockedID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID to block")
 		return 0
 	}
-	limit := l.CheckInt64(3)
-	if limit == 0 {
-		l.ArgError(2, "expects a valid limit 10-100")
+	if userID == blockedID {
+		l.ArgError(2, "expects a user ID to block different to the user ID")
 		return 0
 	}
-	cursor := l.OptString(4, "")
 
-	// Construct the operation.
-	list := &TLeaderboardRecordsList{
-		LeaderboardId: []byte(leaderboardID),
-		Filter: &TLeaderboardRecordsList_OwnerIds{
-			OwnerIds: &TLeaderboardRecordsList_Owners{
-				OwnerIds: make([][]byte, 0),
-			},
-		},
-		Limit: limit,
-	}
-	if cursor != "" {
-		list.Cursor = []byte(cursor)
+	if err = friendBlock(n.logger, n.db, userID.Bytes(), blockedID.Bytes()); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to block user: %s", err.Error()))
 	}
+	return 0
+}
 
-	conversionError := ""
-	users.ForEach(func(k lua.LValue, v lua.LValue) {
-		if v.Type() != lua.LTString {
-			conversionError = "expects user ids to be strings"
-			return
-		}
-
-		u, err := uuid.FromString(v.String())
-		if err != nil {
-			conversionError = "expects user ids to be valid"
-			return
-		}
-		list.GetOwnerIds().OwnerIds = append(list.GetOwnerIds().OwnerIds, u.Bytes())
-	})
-
-	if conversionError != "" {
-		l.ArgError(2, conversionError)
+func (n *NakamaModule) friendsList(l *lua.LState) int {
+	userID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid user ID")
 		return 0
 	}
 
-	records, newCursor, _, err := leaderboardRecordsList(n.logger, n.db, uuid.Nil, list)
+	friends, err := friendsList(n.db, userID.Bytes())
 	if err != nil {
-		l.RaiseError(fmt.Sprintf("failed to list leadeboard records: %s", err.Error()))
+		l.RaiseError(fmt.Sprintf("failed to list friends: %s", err.Error()))
 		return 0
 	}
 
 	// Convert and push the values.
 	lv := l.NewTable()
-	for i, r := range records {
+	for i, f := range friends {
 		// Convert UUIDs to string representation.
-		uid, _ := uuid.FromBytes(r.OwnerId)
-		r.OwnerId = []byte(uid.String())
-		rm := structs.Map(r)
+		fid, _ := uuid.FromBytes(f.User.Id)
+		f.User.Id = []byte(fid.String())
+		fm := structs.Map(f)
 
 		metadataMap := make(map[string]interface{})
-		err = json.Unmarshal(r.Metadata, &metadataMap)
+		err = json.Unmarshal(f.User.Metadata, &metadataMap)
 		if err != nil {
 			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
 			return 0
 		}
 
-		rt := ConvertMap(l, rm)
-		rt.RawSetString("Metadata", ConvertMap(l, metadataMap))
-		lv.RawSetInt(i+1, rt)
+		ft := ConvertMap(l, fm)
+		ft.RawGetString("User").(*lua.LTable).RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, ft)
 	}
-	l.Push(lv)
 
-	if newCursor == nil {
-		l.Push(lua.LNil)
-	} else {
-		l.Push(lua.LString(newCursor))
-	}
+	l.Push(lv)
 
-	return 2
+	return 1
 }
 
 func (n *NakamaModule) groupsCreate(l *lua.LState) int {
@@ -1694,6 +3023,13 @@ func (n *NakamaModule) groupsCreate(l *lua.LState) int {
 					return
 				}
 				p.Private = lua.LVAsBool(v)
+			case "MaxCount":
+				if v.Type() != lua.LTNumber {
+					conversionError = true
+					l.ArgError(1, "expects MaxCount to be number")
+					return
+				}
+				p.MaxCount = int64(lua.LVAsNumber(v))
 			case "Metadata":
 				if v.Type() != lua.LTTable {
 					conversionError = true
@@ -1841,6 +3177,12 @@ func (n *NakamaModule) groupsUpdate(l *lua.LState) int {
 					return
 				}
 				p.Private = lua.LVAsBool(v)
+			case "MaxCount":
+				if v.Type() != lua.LTNumber {
+					conversionError = "expects MaxCount to be number"
+					return
+				}
+				p.MaxCount = int64(lua.LVAsNumber(v))
 			case "Metadata":
 				if v.Type() != lua.LTTable {
 					conversionError = "expects Metadata to be a table"
@@ -1930,6 +3272,299 @@ func (n *NakamaModule) groupUsersList(l *lua.LState) int {
 	return 1
 }
 
+func (n *NakamaModule) groupUsersAdd(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, _, _, err = GroupUsersAdd(n.logger, n.db, uuid.Nil, groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add group user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersKick(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+	cooldownMs := l.OptInt64(3, 0)
+	if cooldownMs < 0 {
+		l.ArgError(3, "expects rejoin cooldown to be 0 or more milliseconds")
+		return 0
+	}
+
+	if _, _, err = GroupUsersKick(n.logger, n.db, uuid.Nil, groupID, userID, cooldownMs); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to kick group user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersPromote(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, _, err = GroupUsersPromote(n.logger, n.db, uuid.Nil, groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to promote group user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersBan(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, _, err = GroupUsersBan(n.logger, n.db, uuid.Nil, groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to ban group user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersUnban(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, err = GroupUsersUnban(n.logger, n.db, uuid.Nil, groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to unban group user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupUsersBannedList(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	users, _, err := GroupBannedUsersList(n.logger, n.db, uuid.Nil, groupID)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list banned group users: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, u := range users {
+		// Convert UUIDs to string representation.
+		uid, _ := uuid.FromBytes(u.User.Id)
+		u.User.Id = []byte(uid.String())
+		if len(u.BannedBy) != 0 {
+			bid, _ := uuid.FromBytes(u.BannedBy)
+			u.BannedBy = []byte(bid.String())
+		}
+		um := structs.Map(u)
+
+		metadataMap := make(map[string]interface{})
+		err = json.Unmarshal(u.User.Metadata, &metadataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert metadata to json: %s", err.Error()))
+			return 0
+		}
+
+		ut := ConvertMap(l, um)
+		ut.RawGetString("User").(*lua.LTable).RawSetString("Metadata", ConvertMap(l, metadataMap))
+		lv.RawSetInt(i+1, ut)
+	}
+
+	l.Push(lv)
+
+	return 1
+}
+
+func (n *NakamaModule) groupTransferOwnership(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(2))
+	if err != nil {
+		l.ArgError(2, "expects a valid user ID")
+		return 0
+	}
+
+	if _, _, err = GroupTransferOwnership(n.logger, n.db, uuid.Nil, groupID, userID); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to transfer group ownership: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupAnnounce(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+
+	dataMap := ConvertLuaTable(l.CheckTable(2))
+	data, err := json.Marshal(dataMap)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to convert announcement data: %s", err.Error()))
+		return 0
+	}
+
+	if _, err = GroupAnnouncementAdd(n.logger, n.db, groupID, data); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to add group announcement: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) groupHistoryList(l *lua.LState) int {
+	groupID, err := uuid.FromString(l.CheckString(1))
+	if err != nil {
+		l.ArgError(1, "expects a valid group ID")
+		return 0
+	}
+	limit := l.OptInt64(2, 10)
+	var cursor []byte
+	if cs := l.OptString(3, ""); cs != "" {
+		cb, err := base64.StdEncoding.DecodeString(cs)
+		if err != nil {
+			l.ArgError(3, "cursor is invalid")
+			return 0
+		}
+		cursor = cb
+	}
+
+	entries, newCursor, _, err := GroupHistoryList(n.logger, n.db, uuid.Nil, groupID, limit, cursor)
+	if err != nil {
+		l.RaiseError(fmt.Sprintf("failed to list group history: %s", err.Error()))
+		return 0
+	}
+
+	// Convert and push the values.
+	lv := l.NewTable()
+	for i, e := range entries {
+		// Convert UUIDs to string representation if needed.
+		id, _ := uuid.FromBytes(e.Id)
+		e.Id = []byte(id.String())
+		e.GroupId = []byte(groupID.String())
+		if len(e.ActorId) != 0 {
+			aid, _ := uuid.FromBytes(e.ActorId)
+			e.ActorId = []byte(aid.String())
+		}
+		if len(e.UserId) != 0 {
+			uid, _ := uuid.FromBytes(e.UserId)
+			e.UserId = []byte(uid.String())
+		}
+		em := structs.Map(e)
+
+		dataMap := make(map[string]interface{})
+		err = json.Unmarshal(e.Data, &dataMap)
+		if err != nil {
+			l.RaiseError(fmt.Sprintf("failed to convert data to json: %s", err.Error()))
+			return 0
+		}
+
+		et := ConvertMap(l, em)
+		et.RawSetString("Data", ConvertMap(l, dataMap))
+		lv.RawSetInt(i+1, et)
+	}
+	l.Push(lv)
+
+	// Convert and push the new cursor, if any.
+	if len(newCursor) != 0 {
+		newCursorString := base64.StdEncoding.EncodeToString(newCursor)
+		l.Push(lua.LString(newCursorString))
+	} else {
+		l.Push(lua.LNil)
+	}
+
+	return 2
+}
+
+// checkTopicID reads a topic type ("room" or "group") and topic identifier from the given argument positions.
+func checkTopicID(l *lua.LState, typeIndex int, idIndex int) *TopicId {
+	topicType := l.CheckString(typeIndex)
+	id := l.CheckString(idIndex)
+	switch topicType {
+	case "room":
+		if id == "" || len(id) > 64 {
+			l.ArgError(idIndex, "expects a room name of 1-64 chars")
+			return nil
+		}
+		return &TopicId{Id: &TopicId_Room{Room: []byte(id)}}
+	case "group":
+		groupID, err := uuid.FromString(id)
+		if err != nil {
+			l.ArgError(idIndex, "expects a valid group ID")
+			return nil
+		}
+		return &TopicId{Id: &TopicId_GroupId{GroupId: groupID.Bytes()}}
+	}
+	l.ArgError(typeIndex, "expects topic type 'room' or 'group'")
+	return nil
+}
+
+func (n *NakamaModule) topicUserMute(l *lua.LState) int {
+	topic := checkTopicID(l, 1, 2)
+	if topic == nil {
+		return 0
+	}
+	userID, err := uuid.FromString(l.CheckString(3))
+	if err != nil {
+		l.ArgError(3, "expects a valid user ID")
+		return 0
+	}
+	durationMs := l.OptInt64(4, 0)
+
+	if _, err = TopicUserMute(n.logger, n.db, uuid.Nil, topic, userID, durationMs); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to mute topic user: %s", err.Error()))
+	}
+	return 0
+}
+
+func (n *NakamaModule) topicSlowModeSet(l *lua.LState) int {
+	topic := checkTopicID(l, 1, 2)
+	if topic == nil {
+		return 0
+	}
+	intervalMs := l.OptInt64(3, 0)
+
+	if _, err := TopicSlowModeSet(n.logger, n.db, uuid.Nil, topic, intervalMs); err != nil {
+		l.RaiseError(fmt.Sprintf("failed to set topic slow mode: %s", err.Error()))
+	}
+	return 0
+}
+
 func (n *NakamaModule) groupsUserList(l *lua.LState) int {
 	user := l.CheckString(1)
 	if user == "" {
@@ -2083,7 +3718,7 @@ func (n *NakamaModule) notificationsSendId(l *lua.LState) int {
 		return 0
 	}
 
-	err := n.notificationService.NotificationSend(notifications)
+	err := n.notificationService.NotificationSend(context.Background(), notifications)
 	if err != nil {
 		l.RaiseError(fmt.Sprintf("failed to send notifications: %s", err.Error()))
 	}
@@ -0,0 +1,111 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// Reload loads the Lua modules found in the runtime path again into a fresh Lua state, and swaps it in for the
+// current one if they all load and evaluate without error. Otherwise the error is returned and the modules
+// already loaded stay in use. Invocations and matches already running finish with the functions they started with,
+// sessions are not affected. Go modules are not reloaded.
+func (r *Runtime) Reload() error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	vm, err := r.newVM()
+	if err != nil {
+		r.logger.Error("Rejected runtime module reload", zap.Error(err))
+		return err
+	}
+
+	r.Lock()
+	// The previous state is not closed, functions from it may still be running. It is collected once they are done.
+	r.vm = vm
+	listeners := r.reloadListeners
+	r.Unlock()
+
+	r.multiLogger.Info("Runtime modules reloaded")
+	for _, f := range listeners {
+		f()
+	}
+	return nil
+}
+
+// AddReloadListener registers a function to be called each time the Lua modules are reloaded.
+func (r *Runtime) AddReloadListener(f func()) {
+	r.Lock()
+	r.reloadListeners = append(r.reloadListeners, f)
+	r.Unlock()
+}
+
+// startWatcher checks the runtime path for added, changed or removed Lua modules at the given interval, and reloads
+// them when there are any. A change that fails to load is not tried again until the modules change once more.
+func (r *Runtime) startWatcher(interval time.Duration) {
+	last, err := modulesFingerprint(lua.LuaLDir)
+	if err != nil {
+		r.logger.Warn("Could not check runtime modules for changes", zap.Error(err))
+	}
+
+	r.watcherTicker = time.NewTicker(interval)
+	r.watcherStopCh = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-r.watcherTicker.C:
+				fingerprint, err := modulesFingerprint(lua.LuaLDir)
+				if err != nil {
+					r.logger.Warn("Could not check runtime modules for changes", zap.Error(err))
+					continue
+				}
+				if fingerprint == last {
+					continue
+				}
+				last = fingerprint
+				r.logger.Info("Runtime modules changed, reloading")
+				r.Reload()
+			case <-r.watcherStopCh:
+				return
+			}
+		}
+	}()
+}
+
+// modulesFingerprint describes the Lua modules under the given path by their paths, sizes and modification times.
+func modulesFingerprint(luaPath string) (string, error) {
+	modules, err := listModules(luaPath)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(modules)
+
+	entries := make([]string, 0, len(modules))
+	for _, path := range modules {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, fmt.Sprintf("%v:%v:%v", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(entries, "\n"), nil
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+const runtimeTaskMaxError = 1024
+
+const (
+	RUNTIME_TASK_STATE_PENDING int64 = iota
+	RUNTIME_TASK_STATE_DEAD
+)
+
+// RuntimeTask is a call to a runtime task handler, deferred until its run time.
+type RuntimeTask struct {
+	ID        uuid.UUID
+	Handler   string
+	Payload   []byte
+	State     int64
+	RunAt     int64
+	Attempts  int
+	LastError string
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// RuntimeTaskEnqueue stores a task to be run by the named handler once the run time has passed. The payload must be
+// a JSON object.
+func RuntimeTaskEnqueue(db *sql.DB, handler string, payload []byte, runAt int64) (uuid.UUID, error) {
+	id := uuid.NewV4()
+	now := nowMs()
+	if runAt < now {
+		runAt = now
+	}
+	_, err := db.Exec(`
+INSERT INTO runtime_task (id, handler, payload, run_at, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $5)`, id.Bytes(), handler, payload, runAt, now)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// RuntimeTasksDeadList returns tasks that failed too many times, oldest first.
+func RuntimeTasksDeadList(db *sql.DB, limit int) ([]*RuntimeTask, error) {
+	rows, err := db.Query(`
+SELECT id, handler, payload, state, run_at, attempts, last_error, created_at, updated_at
+FROM runtime_task WHERE state = $1 ORDER BY run_at LIMIT $2`, RUNTIME_TASK_STATE_DEAD, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := make([]*RuntimeTask, 0)
+	for rows.Next() {
+		var id []byte
+		t := &RuntimeTask{}
+		if err = rows.Scan(&id, &t.Handler, &t.Payload, &t.State, &t.RunAt, &t.Attempts, &t.LastError, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		t.ID = uuid.FromBytesOrNil(id)
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// RuntimeTaskRetry makes a dead task pending again, with a fresh set of attempts. Returns false if there is no dead
+// task with the ID.
+func RuntimeTaskRetry(db *sql.DB, id uuid.UUID) (bool, error) {
+	now := nowMs()
+	res, err := db.Exec(`
+UPDATE runtime_task SET state = $2, run_at = $3, attempts = 0, last_error = '', updated_at = $3
+WHERE id = $1 AND state = $4`, id.Bytes(), RUNTIME_TASK_STATE_PENDING, now, RUNTIME_TASK_STATE_DEAD)
+	if err != nil {
+		return false, err
+	}
+	count, _ := res.RowsAffected()
+	return count == 1, nil
+}
+
+// RuntimeTaskWorker runs due tasks with a pool of workers. A task is claimed by moving its run time forward by the
+// lease, so other nodes leave it alone while it runs, and pick it up again if this node stops before finishing it.
+// Tasks that fail are tried again with a growing delay, and kept aside as dead letters once out of attempts.
+type RuntimeTaskWorker struct {
+	logger  *zap.Logger
+	db      *sql.DB
+	runtime *Runtime
+	config  *RuntimeTaskConfig
+	ticker  *time.Ticker
+	stopCh  chan bool
+}
+
+// NewRuntimeTaskWorker creates a new RuntimeTaskWorker and starts it.
+func NewRuntimeTaskWorker(logger *zap.Logger, db *sql.DB, runtime *Runtime, config *RuntimeTaskConfig) *RuntimeTaskWorker {
+	w := &RuntimeTaskWorker{
+		logger:  logger,
+		db:      db,
+		runtime: runtime,
+		config:  config,
+		ticker:  time.NewTicker(time.Duration(config.PollIntervalMs) * time.Millisecond),
+		stopCh:  make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-w.ticker.C:
+				w.runDue()
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *RuntimeTaskWorker) Stop() {
+	w.ticker.Stop()
+	close(w.stopCh)
+}
+
+// runDue hands a batch of due tasks to the workers and waits for them all to finish.
+func (w *RuntimeTaskWorker) runDue() {
+	tasks, err := w.due()
+	if err != nil {
+		w.logger.Error("Could not find due runtime tasks", zap.Error(err))
+		return
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	taskCh := make(chan *RuntimeTask)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < w.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range taskCh {
+				w.run(t)
+			}
+		}()
+	}
+
+dispatch:
+	for _, t := range tasks {
+		select {
+		case taskCh <- t:
+		case <-w.stopCh:
+			break dispatch
+		}
+	}
+	close(taskCh)
+	wg.Wait()
+}
+
+func (w *RuntimeTaskWorker) due() ([]*RuntimeTask, error) {
+	rows, err := w.db.Query(`
+SELECT id, handler, payload, run_at, attempts, created_at
+FROM runtime_task WHERE state = $1 AND run_at <= $2 ORDER BY run_at LIMIT $3`, RUNTIME_TASK_STATE_PENDING, nowMs(), w.config.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := make([]*RuntimeTask, 0)
+	for rows.Next() {
+		var id []byte
+		t := &RuntimeTask{}
+		if err = rows.Scan(&id, &t.Handler, &t.Payload, &t.RunAt, &t.Attempts, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.ID = uuid.FromBytesOrNil(id)
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// run claims the task and passes it to its handler. The task is deleted if the handler succeeds, otherwise it is
+// rescheduled or kept as a dead letter. Nothing is run if another node claimed the task first.
+func (w *RuntimeTaskWorker) run(t *RuntimeTask) {
+	taskLogger := w.logger.With(zap.String("task_id", t.ID.String()), zap.String("handler", t.Handler))
+
+	now := nowMs()
+	res, err := w.db.Exec(`
+UPDATE runtime_task SET run_at = $4, attempts = attempts + 1, updated_at = $5
+WHERE id = $1 AND state = $2 AND run_at = $3`, t.ID.Bytes(), RUNTIME_TASK_STATE_PENDING, t.RunAt, now+w.config.LeaseMs, now)
+	if err != nil {
+		taskLogger.Error("Could not claim runtime task", zap.Error(err))
+		return
+	}
+	if count, _ := res.RowsAffected(); count != 1 {
+		return
+	}
+	t.Attempts++
+
+	if err = w.invoke(t); err == nil {
+		if _, err = w.db.Exec("DELETE FROM runtime_task WHERE id = $1", t.ID.Bytes()); err != nil {
+			taskLogger.Error("Could not remove finished runtime task", zap.Error(err))
+		}
+		return
+	}
+
+	lastError := err.Error()
+	if len(lastError) > runtimeTaskMaxError {
+		lastError = lastError[:runtimeTaskMaxError]
+	}
+	now = nowMs()
+	if t.Attempts >= w.config.MaxAttempts {
+		taskLogger.Error("Runtime task failed on its last attempt, keeping it as a dead letter", zap.Int("attempts", t.Attempts), zap.Error(err))
+		_, err = w.db.Exec("UPDATE runtime_task SET state = $2, run_at = $3, last_error = $4, updated_at = $3 WHERE id = $1",
+			t.ID.Bytes(), RUNTIME_TASK_STATE_DEAD, now, lastError)
+	} else {
+		taskLogger.Warn("Runtime task failed, it will be tried again", zap.Int("attempts", t.Attempts), zap.Error(err))
+		_, err = w.db.Exec("UPDATE runtime_task SET run_at = $2, last_error = $3, updated_at = $4 WHERE id = $1",
+			t.ID.Bytes(), now+w.backoff(t.Attempts), lastError, now)
+	}
+	if err != nil {
+		taskLogger.Error("Could not record runtime task failure", zap.Error(err))
+	}
+}
+
+func (w *RuntimeTaskWorker) invoke(t *RuntimeTask) error {
+	fn := w.runtime.GetRuntimeCallback(TASK, t.Handler)
+	if fn == nil {
+		return errors.New("no task handler registered")
+	}
+
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(t.Payload, &payload); err != nil {
+		return err
+	}
+	return w.runtime.InvokeFunctionTask(fn, map[string]interface{}{
+		"Id":        t.ID.String(),
+		"Handler":   t.Handler,
+		"Payload":   payload,
+		"Attempts":  t.Attempts,
+		"CreatedAt": t.CreatedAt,
+	})
+}
+
+// backoff returns the delay before the next attempt, doubling with each failed attempt.
+func (w *RuntimeTaskWorker) backoff(attempts int) int64 {
+	if attempts > 16 {
+		attempts = 16
+	}
+	return w.config.RetryBackoffMs << uint(attempts-1)
+}
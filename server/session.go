@@ -15,11 +15,14 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"sync"
 	"time"
 
 	"fmt"
 
+	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
@@ -28,6 +31,52 @@ import (
 	"go.uber.org/zap"
 )
 
+// Close codes sent when the server ends a session the client did not close itself.
+const (
+	sessionCloseReplaced = 4001
+	sessionCloseLogout   = 4002
+	sessionCloseBanned   = 4003
+	sessionCloseMerged   = 4004
+	sessionCloseDeleted  = 4005
+	sessionCloseSlow     = 4006
+)
+
+// Formats a socket may exchange envelopes in, chosen by the client when it connects. They double as the names of
+// the WebSocket subprotocols clients may ask for.
+const (
+	sessionFormatProtobuf = "protobuf"
+	sessionFormatJSON     = "json"
+)
+
+var (
+	sessionJsonpbMarshaler = &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     false,
+	}
+	sessionJsonpbUnmarshaler = &jsonpb.Unmarshaler{
+		AllowUnknownFields: false,
+	}
+)
+
+// marshalEnvelope encodes the message in the given socket format.
+func marshalEnvelope(format string, msg proto.Message) ([]byte, error) {
+	if format == sessionFormatJSON {
+		payload, err := sessionJsonpbMarshaler.MarshalToString(msg)
+		return []byte(payload), err
+	}
+	return proto.Marshal(msg)
+}
+
+// unmarshalEnvelope decodes an envelope sent in the given socket format.
+func unmarshalEnvelope(format string, data []byte, envelope *Envelope) error {
+	if format == sessionFormatJSON {
+		return sessionJsonpbUnmarshaler.Unmarshal(bytes.NewReader(data), envelope)
+	}
+	return proto.Unmarshal(data, envelope)
+}
+
 type session struct {
 	sync.Mutex
 	logger           *zap.Logger
@@ -36,17 +85,40 @@ type session struct {
 	userID           uuid.UUID
 	handle           *atomic.String
 	lang             string
-	expiry           int64
+	connectedAt      int64
+	expiry           *atomic.Int64
+	refreshID        *atomic.String
+	clientIP         string
+	userAgent        string
+	format           string
+	batch            bool
 	stopped          bool
 	conn             *websocket.Conn
 	pingTicker       *time.Ticker
 	pingTickerStopCh chan (bool)
-	unregister       func(s *session)
+	unregister       func(s *session, resumable bool)
+	matchData        *matchDataLimiter
+	capturing        bool
+	captureID        string
+	captured         *Envelope
+	datagram         *datagramPeer
+	outgoing         []*sessionOutgoing
+	outgoingCh       chan struct{}
+	outgoingDone     chan struct{}
+	queueStats       *sessionQueueStats
+	closeData        []byte
+	closeGraceful    bool
+	resumeToken      string
+	detached         bool
+	resumedBy        *session
+	missedPongs      *atomic.Int32
+	call             bool
+	callResponse     *Envelope
+	requestCtx       context.Context
 }
 
 // NewSession creates a new session which encapsulates a socket connection
-func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle string, lang string, expiry int64, websocketConn *websocket.Conn, unregister func(s *session)) *session {
-	sessionID := uuid.NewV4()
+func NewSession(logger *zap.Logger, config Config, sessionID uuid.UUID, userID uuid.UUID, handle string, lang string, expiry int64, refreshID string, clientIP string, userAgent string, format string, batch bool, websocketConn *websocket.Conn, unregister func(s *session, resumable bool), queueStats *sessionQueueStats) *session {
 	sessionLogger := logger.With(zap.String("uid", userID.String()), zap.String("sid", sessionID.String()))
 
 	sessionLogger.Info("New session connected")
@@ -58,20 +130,64 @@ func NewSession(logger *zap.Logger, config Config, userID uuid.UUID, handle stri
 		userID:           userID,
 		handle:           atomic.NewString(handle),
 		lang:             lang,
-		expiry:           expiry,
+		connectedAt:      nowMs(),
+		expiry:           atomic.NewInt64(expiry),
+		refreshID:        atomic.NewString(refreshID),
+		clientIP:         clientIP,
+		userAgent:        userAgent,
+		format:           format,
+		batch:            batch,
 		conn:             websocketConn,
 		stopped:          false,
 		pingTicker:       time.NewTicker(time.Duration(config.GetSocket().PingPeriodMs) * time.Millisecond),
 		pingTickerStopCh: make(chan bool),
 		unregister:       unregister,
+		matchData:        newMatchDataLimiter(),
+		outgoing:         make([]*sessionOutgoing, 0, config.GetSocket().OutgoingQueueSize),
+		outgoingCh:       make(chan struct{}, 1),
+		outgoingDone:     make(chan struct{}),
+		queueStats:       queueStats,
+		resumeToken:      uuid.NewV4().String(),
+		missedPongs:      atomic.NewInt32(0),
+	}
+}
+
+// newCallSession creates a session for a single API call made without a socket. It is not registered, and the
+// response to the call is kept rather than written anywhere.
+func newCallSession(logger *zap.Logger, config Config, userID uuid.UUID, handle string, expiry int64, refreshID string, clientIP string, userAgent string) *session {
+	sessionID := uuid.NewV4()
+	return &session{
+		logger:      logger.With(zap.String("uid", userID.String()), zap.String("sid", sessionID.String())),
+		config:      config,
+		id:          sessionID,
+		userID:      userID,
+		handle:      atomic.NewString(handle),
+		lang:        "en",
+		connectedAt: nowMs(),
+		expiry:      atomic.NewInt64(expiry),
+		refreshID:   atomic.NewString(refreshID),
+		clientIP:    clientIP,
+		userAgent:   userAgent,
+		format:      sessionFormatProtobuf,
+		// Nothing can be written to it, and closing it does nothing.
+		stopped:     true,
+		matchData:   newMatchDataLimiter(),
+		queueStats:  newSessionQueueStats(),
+		missedPongs: atomic.NewInt32(0),
+		call:        true,
 	}
 }
 
 func (s *session) Consume(processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
-	defer s.cleanupClosedConnection()
+	// Only a client that closed its socket normally is done with the session.
+	resumable := true
+	defer func() {
+		s.cleanupClosedConnection(resumable)
+	}()
 	s.conn.SetReadLimit(s.config.GetSocket().MaxMessageSizeBytes)
 	s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetSocket().PongWaitMs) * time.Millisecond))
 	s.conn.SetPongHandler(func(string) error {
+		s.missedPongs.Store(0)
 		s.conn.SetReadDeadline(time.Now().Add(time.Duration(s.config.GetSocket().PongWaitMs) * time.Millisecond))
 		return nil
 	})
@@ -79,10 +195,12 @@ func (s *session) Consume(processRequest func(logger *zap.Logger, session *sessi
 	// Send an initial ping immediately, then at intervals.
 	s.pingNow()
 	go s.pingPeriodically()
+	go s.processOutgoing()
 
 	for {
 		_, data, err := s.conn.ReadMessage()
 		if err != nil {
+			resumable = !websocket.IsCloseError(err, websocket.CloseNormalClosure)
 			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
 				s.logger.Warn("Error reading message from client", zap.Error(err))
 			}
@@ -90,11 +208,23 @@ func (s *session) Consume(processRequest func(logger *zap.Logger, session *sessi
 		}
 
 		request := &Envelope{}
-		err = proto.Unmarshal(data, request)
+		err = unmarshalEnvelope(s.format, data, request)
 		if err != nil {
 			s.logger.Warn("Received malformed payload", zap.Any("data", data))
 			s.Send(ErrorMessage(request.CollationId, UNRECOGNIZED_PAYLOAD, "Unrecognized payload"))
-		} else {
+			continue
+		}
+
+		// A batch is processed as if each envelope in it had arrived on its own, in order.
+		requests := []*Envelope{request}
+		if batch := request.GetBatch(); batch != nil {
+			requests = batch.Envelopes
+		}
+		for _, request := range requests {
+			if _, nested := request.Payload.(*Envelope_Batch); nested {
+				s.Send(ErrorMessageBadInput(request.CollationId, "Batches can't be nested"))
+				continue
+			}
 			// TODO Add session-global context here to cancel in-progress operations when the session is closed.
 			requestLogger := s.logger.With(zap.String("cid", request.CollationId))
 			processRequest(requestLogger, s, request)
@@ -122,12 +252,13 @@ func (s *session) pingNow() bool {
 		s.Unlock()
 		return false
 	}
-	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetSocket().WriteWaitMs) * time.Millisecond))
-	err := s.conn.WriteMessage(websocket.PingMessage, []byte{})
 	s.Unlock()
+	s.missedPongs.Inc()
+	// Control messages may be written alongside the outgoing queue.
+	err := s.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Duration(s.config.GetSocket().WriteWaitMs)*time.Millisecond))
 	if err != nil {
 		s.logger.Warn("Could not send ping. Closing channel", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Error(err))
-		s.cleanupClosedConnection() // The connection has already failed
+		s.cleanupClosedConnection(true) // The connection has already failed
 		return false
 	}
 
@@ -143,45 +274,128 @@ func (s *session) pingNow() bool {
 func (s *session) Send(envelope *Envelope) error {
 	s.logger.Debug(fmt.Sprintf("Sending %T message", envelope.Payload), zap.String("cid", envelope.CollationId))
 
-	payload, err := proto.Marshal(envelope)
+	s.Lock()
+	if s.capturing && s.captured == nil && envelope.CollationId == s.captureID {
+		s.captured = envelope
+	}
+	if s.call {
+		if s.callResponse == nil {
+			s.callResponse = envelope
+		}
+		s.Unlock()
+		return nil
+	}
+	s.Unlock()
+
+	payload, err := marshalEnvelope(s.format, envelope)
 
 	if err != nil {
 		s.logger.Warn("Could not marshall Response to byte[]", zap.Error(err))
 		return err
 	}
 
-	return s.SendBytes(payload)
+	_, matchData := envelope.Payload.(*Envelope_MatchData)
+	return s.sendBytes(payload, matchData)
 }
 
-func (s *session) SendBytes(payload []byte) error {
-	// TODO Improve on mutex usage here.
+// captureResponse starts recording the first message sent with the given collation ID, the response to the request
+// being processed.
+func (s *session) captureResponse(collationID string) {
 	s.Lock()
-	defer s.Unlock()
-	if s.stopped {
-		return nil
+	s.capturing = true
+	s.captureID = collationID
+	s.captured = nil
+	s.Unlock()
+}
+
+// capturedResponse stops recording and returns the response recorded, if any.
+func (s *session) capturedResponse() *Envelope {
+	s.Lock()
+	response := s.captured
+	s.capturing = false
+	s.captured = nil
+	s.Unlock()
+	return response
+}
+
+// setRequestContext sets the context of the request being processed, returning the one it replaces.
+func (s *session) setRequestContext(ctx context.Context) context.Context {
+	s.Lock()
+	previous := s.requestCtx
+	s.requestCtx = ctx
+	s.Unlock()
+	return previous
+}
+
+// requestContext returns the context of the request being processed, which carries its trace span if it is traced.
+// Work done for the request passes it on so it becomes part of the trace.
+func (s *session) requestContext() context.Context {
+	s.Lock()
+	ctx := s.requestCtx
+	s.Unlock()
+	if ctx == nil {
+		return context.Background()
 	}
+	return ctx
+}
 
-	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.GetSocket().WriteWaitMs) * time.Millisecond))
-	err := s.conn.WriteMessage(websocket.BinaryMessage, payload)
-	if err != nil {
-		s.logger.Warn("Could not write message", zap.Error(err))
-		//TODO investigate whether we need to cleanupClosedConnection if write fails
+// setDatagramPeer binds the session to the datagram transport, returning the binding it replaces if any.
+func (s *session) setDatagramPeer(peer *datagramPeer) *datagramPeer {
+	s.Lock()
+	previous := s.datagram
+	s.datagram = peer
+	s.Unlock()
+	return previous
+}
+
+// clearDatagramPeer unbinds the session from the datagram transport, unless it has bound again since.
+func (s *session) clearDatagramPeer(peer *datagramPeer) {
+	s.Lock()
+	if s.datagram == peer {
+		s.datagram = nil
 	}
+	s.Unlock()
+}
+
+// dead reports whether the client has stopped answering pings.
+func (s *session) dead() bool {
+	return s.missedPongs.Load() > int32(s.config.GetSocket().MaxMissedPongs)
+}
 
-	return err
+// datagramPeer returns the session's datagram binding, or nil if it has none.
+func (s *session) datagramPeer() *datagramPeer {
+	s.Lock()
+	peer := s.datagram
+	s.Unlock()
+	return peer
 }
 
-func (s *session) cleanupClosedConnection() {
+func (s *session) isStopped() bool {
+	s.Lock()
+	stopped := s.stopped
+	s.Unlock()
+	return stopped
+}
+
+func (s *session) SendBytes(payload []byte) error {
+	return s.sendBytes(payload, false)
+}
+
+// cleanupClosedConnection stops a session whose connection failed or was closed by the client. A resumable session
+// is kept for the resume window if enabled, holding on to messages sent to it until the client comes back.
+func (s *session) cleanupClosedConnection(resumable bool) {
+	resumable = resumable && s.config.GetSocket().ResumeWindowMs > 0
 	s.Lock()
 	if s.stopped {
 		s.Unlock()
 		return
 	}
 	s.stopped = true
+	s.detached = resumable
 	s.Unlock()
 
-	s.logger.Info("Cleaning up closed client connection", zap.String("remoteAddress", s.conn.RemoteAddr().String()))
-	s.unregister(s)
+	s.logger.Info("Cleaning up closed client connection", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Bool("resumable", resumable))
+	s.unregister(s, resumable)
 	s.pingTicker.Stop()
 	close(s.pingTickerStopCh)
 	s.conn.Close()
@@ -189,17 +403,41 @@ func (s *session) cleanupClosedConnection() {
 }
 
 func (s *session) close() {
+	s.closeMessage([]byte{})
+}
+
+// closeWithReason tells the client why the server is closing the session before closing it.
+func (s *session) closeWithReason(code int, reason string) {
+	s.closeMessage(websocket.FormatCloseMessage(code, reason))
+}
+
+// closeMessage stops the session from queueing messages. Messages already queued are written before the close
+// message is sent and the connection closed.
+func (s *session) closeMessage(data []byte) {
 	s.Lock()
+	s.stopLocked(data)
+	s.Unlock()
+}
+
+// stopLocked is closeMessage for callers already holding the session lock.
+func (s *session) stopLocked(data []byte) {
 	if s.stopped {
-		s.Unlock()
 		return
 	}
 	s.stopped = true
-	s.Unlock()
-
+	s.closeData = data
+	s.closeGraceful = true
 	s.pingTicker.Stop()
 	close(s.pingTickerStopCh)
-	err := s.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Duration(s.config.GetSocket().WriteWaitMs)*time.Millisecond))
+}
+
+// closeNow writes the close message and closes the connection. It is called by the outgoing queue once it is done.
+func (s *session) closeNow() {
+	s.Lock()
+	data := s.closeData
+	s.Unlock()
+
+	err := s.conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(time.Duration(s.config.GetSocket().WriteWaitMs)*time.Millisecond))
 	if err != nil {
 		s.logger.Warn("Could not send close message. Closing prematurely.", zap.String("remoteAddress", s.conn.RemoteAddr().String()), zap.Error(err))
 	}
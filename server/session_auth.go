@@ -16,6 +16,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -23,6 +24,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"mime"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -31,7 +33,6 @@ import (
 
 	"nakama/pkg/social"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/handlers"
@@ -39,8 +40,10 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
 	"github.com/yuin/gopher-lua"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
 	"nakama/pkg/httputil"
 )
 
@@ -71,13 +74,19 @@ type authenticationService struct {
 	hmacSecretByte    []byte
 	upgrader          *websocket.Upgrader
 	socialClient      *social.Client
+	mailer            Mailer
+	challenge         RegistrationChallenge
+	rateLimiter       *AuthRateLimiter
+	clientIPFilter    *ClientIPFilter
 	random            *rand.Rand
+	draining          *atomic.Bool
+	grpcServer        *grpc.Server
 	jsonpbMarshaler   *jsonpb.Marshaler
 	jsonpbUnmarshaler *jsonpb.Unmarshaler
 }
 
 // NewAuthenticationService creates a new AuthenticationService
-func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, socialClient *social.Client, pipeline *pipeline, runtime *Runtime) *authenticationService {
+func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, statService StatsService, registry *SessionRegistry, socialClient *social.Client, pipeline *pipeline, runtime *Runtime, mailer Mailer, challenge RegistrationChallenge, rateLimiter *AuthRateLimiter, clientIPFilter *ClientIPFilter) *authenticationService {
 	a := &authenticationService{
 		logger:         logger,
 		config:         config,
@@ -87,12 +96,19 @@ func NewAuthenticationService(logger *zap.Logger, config Config, db *sql.DB, sta
 		pipeline:       pipeline,
 		runtime:        runtime,
 		socialClient:   socialClient,
+		mailer:         mailer,
+		challenge:      challenge,
+		rateLimiter:    rateLimiter,
+		clientIPFilter: clientIPFilter,
 		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		draining:       atomic.NewBool(false),
 		hmacSecretByte: []byte(config.GetSession().EncryptionKey),
 		upgrader: &websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			Subprotocols:      []string{sessionFormatProtobuf, sessionFormatJSON},
+			EnableCompression: config.GetSocket().Compression,
+			CheckOrigin:       func(r *http.Request) bool { return true },
 		},
 		jsonpbMarshaler: &jsonpb.Marshaler{
 			EnumsAsInts:  true,
@@ -126,14 +142,55 @@ func (a *authenticationService) configure() {
 		if r.Method == "OPTIONS" {
 			return
 		}
-		a.handleAuth(w, r, a.login)
+		a.handleAuth(w, r, AUTH_HISTORY_LOGIN, a.login)
 	}).Methods("POST", "OPTIONS")
 
 	a.mux.HandleFunc("/user/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "OPTIONS" {
 			return
 		}
-		a.handleAuth(w, r, a.register)
+		a.handleAuth(w, r, AUTH_HISTORY_REGISTER, a.registerChallenged(a.clientIPFilter.ClientIP(r)))
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/challenge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleChallenge(w, r)
+	}).Methods("GET", "OPTIONS")
+
+	a.mux.HandleFunc("/user/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleAuth(w, r, AUTH_HISTORY_REFRESH, a.refresh)
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/email/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleEmailToken(w, r, func(req *emailTokenRequest) (Error_Code, error) {
+			return EmailVerify(a.logger, a.db, req.Token)
+		})
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/password/reset/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleEmailToken(w, r, func(req *emailTokenRequest) (Error_Code, error) {
+			return PasswordResetSend(a.logger, a.db, a.config, a.mailer, req.Email)
+		})
+	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/user/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		a.handleEmailToken(w, r, func(req *emailTokenRequest) (Error_Code, error) {
+			return PasswordReset(a.logger, a.db, req.Token, req.Password)
+		})
 	}).Methods("POST", "OPTIONS")
 
 	a.mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
@@ -141,12 +198,28 @@ func (a *authenticationService) configure() {
 			return
 		}
 
+		if a.draining.Load() {
+			http.Error(w, "Server is shutting down", 503)
+			return
+		}
+
 		token := r.URL.Query().Get("token")
-		uid, handle, exp, auth := a.authenticateToken(token)
+		uid, handle, exp, refreshID, auth := a.authenticateToken(token)
 		if !auth {
 			http.Error(w, "Missing or invalid token", 401)
 			return
 		}
+		if message, code := a.checkSessionUser(uid); message != "" {
+			switch code {
+			case RUNTIME_EXCEPTION:
+				http.Error(w, message, 500)
+			case USER_BANNED:
+				http.Error(w, message, 403)
+			default:
+				http.Error(w, message, 401)
+			}
+			return
+		}
 
 		// TODO validate BCP 47 lang format
 		lang := r.URL.Query().Get("lang")
@@ -154,14 +227,34 @@ func (a *authenticationService) configure() {
 			lang = "en"
 		}
 
+		// Envelopes are Protobuf encoded unless the client asks for JSON, by query parameter or subprotocol.
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", sessionFormatProtobuf, sessionFormatJSON:
+		default:
+			http.Error(w, "Format must be protobuf or json", 400)
+			return
+		}
+
 		conn, err := a.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			// http.Error is invoked automatically from within the Upgrade func
 			a.logger.Warn("Could not upgrade to WebSocket", zap.Error(err))
 			return
 		}
+		if a.config.GetSocket().Compression {
+			if err := conn.SetCompressionLevel(a.config.GetSocket().CompressionLevel); err != nil {
+				a.logger.Warn("Could not set socket compression level", zap.Error(err))
+			}
+		}
+		if format == "" {
+			format = conn.Subprotocol()
+		}
+		if format == "" {
+			format = sessionFormatProtobuf
+		}
 
-		a.registry.add(uid, handle, lang, exp, conn, a.pipeline.processRequest)
+		a.registry.add(uid, handle, lang, exp, refreshID, a.clientIPFilter.ClientIP(r), r.UserAgent(), format, r.URL.Query().Get("batch") == "true", r.URL.Query().Get("resume"), conn, a.pipeline.processRequest)
 	}).Methods("GET", "OPTIONS")
 
 	a.mux.HandleFunc("/runtime/{path}", func(w http.ResponseWriter, r *http.Request) {
@@ -261,6 +354,146 @@ func (a *authenticationService) configure() {
 		w.Write(responseBytes)
 
 	}).Methods("POST", "OPTIONS")
+
+	a.mux.HandleFunc("/runtime/rpc/{id}", func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := a.serverCaller(r)
+		if !ok {
+			http.Error(w, "Invalid server key", 401)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, a.config.GetSocket().MaxMessageSizeBytes))
+		if err != nil {
+			http.Error(w, "Bad request data", 400)
+			return
+		}
+		if len(payload) == 0 {
+			payload = nil
+		}
+
+		id := mux.Vars(r)["id"]
+		logger := a.logger.With(zap.String("id", id), zap.String("caller", caller))
+		var lf *lua.LFunction
+		var result []byte
+		var fnErr error
+		if gf := a.runtime.GetRuntimeGoRPC(id); gf != nil {
+			result, fnErr = a.runtime.InvokeGoFunctionServerRPC(gf, caller, payload)
+		} else {
+			lf = a.runtime.GetRuntimeCallback(RPC, id)
+			if lf == nil {
+				http.Error(w, "RPC function not found", 404)
+				return
+			}
+			result, fnErr = a.runtime.InvokeFunctionServerRPC(lf, caller, payload)
+		}
+		if fnErr != nil {
+			logger.Error("Runtime RPC function caused an error", zap.Error(fnErr))
+			if apiErr, ok := fnErr.(*lua.ApiError); ok && lf != nil && !a.config.GetLog().Verbose {
+				msg := apiErr.Object.String()
+				if strings.HasPrefix(msg, lf.Proto.SourceName) {
+					msg = msg[len(lf.Proto.SourceName):]
+					msgParts := strings.SplitN(msg, ": ", 2)
+					if len(msgParts) == 2 {
+						msg = msgParts[1]
+					} else {
+						msg = msgParts[0]
+					}
+				}
+				http.Error(w, msg, 500)
+			} else {
+				http.Error(w, fnErr.Error(), 500)
+			}
+			return
+		}
+
+		logger.Debug("Runtime RPC function invoked by server")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(200)
+		w.Write(result)
+	}).Methods("POST")
+
+	a.mux.HandleFunc("/admin/runtime/reload", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key != a.config.GetRuntime().HTTPKey {
+			http.Error(w, fmt.Sprintf("Invalid runtime key: %s", key), 401)
+			return
+		}
+
+		if err := a.runtime.Reload(); err != nil {
+			http.Error(w, fmt.Sprintf("Runtime modules were not reloaded: %s", err.Error()), 400)
+			return
+		}
+		w.WriteHeader(200)
+	}).Methods("POST")
+
+	a.mux.HandleFunc("/admin/leaderboard/{id}/delete", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key != a.config.GetRuntime().HTTPKey {
+			http.Error(w, fmt.Sprintf("Invalid runtime key: %s", key), 401)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		if err := leaderboardDelete(a.logger, a.db, a.pipeline.leaderboardRankCache, []byte(id)); err != nil {
+			http.Error(w, fmt.Sprintf("Leaderboard was not deleted: %s", err.Error()), 400)
+			return
+		}
+		w.WriteHeader(200)
+	}).Methods("POST")
+
+	// Records are pruned by update time with older_than, a Unix time in milliseconds, and by rank with below_rank.
+	a.mux.HandleFunc("/admin/leaderboard/{id}/prune", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		key := query.Get("key")
+		if key != a.config.GetRuntime().HTTPKey {
+			http.Error(w, fmt.Sprintf("Invalid runtime key: %s", key), 401)
+			return
+		}
+
+		var olderThan, belowRank int64
+		var err error
+		if v := query.Get("older_than"); v != "" {
+			if olderThan, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "Invalid older_than value", 400)
+				return
+			}
+		}
+		if v := query.Get("below_rank"); v != "" {
+			if belowRank, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "Invalid below_rank value", 400)
+				return
+			}
+		}
+		if olderThan == 0 && belowRank == 0 {
+			http.Error(w, "An older_than or below_rank threshold is required", 400)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		count, err := leaderboardRecordsPrune(a.logger, a.db, a.pipeline.leaderboardRankCache, []byte(id), olderThan, belowRank)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Leaderboard records were not pruned: %s", err.Error()), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "{\"count\":%d}", count)
+	}).Methods("POST")
+}
+
+// serverCaller checks the request carries one of the configured server keys, given as the password in HTTP basic
+// authentication with the key's name as the username. It returns the name of the key.
+func (a *authenticationService) serverCaller(r *http.Request) (string, bool) {
+	name, key, ok := r.BasicAuth()
+	if !ok || key == "" {
+		return "", false
+	}
+	expected, found := a.config.GetRuntime().ServerKeys[name]
+	if !found || subtle.ConstantTimeCompare([]byte(key), []byte(expected)) != 1 {
+		return "", false
+	}
+	return name, true
 }
 
 func (a *authenticationService) StartServer(logger *zap.Logger) {
@@ -268,16 +501,21 @@ func (a *authenticationService) StartServer(logger *zap.Logger) {
 		CORSHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type"})
 		CORSOrigins := handlers.AllowedOrigins([]string{"*"})
 
-		handlerWithCORS := handlers.CORS(CORSHeaders, CORSOrigins)(a.mux)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", a.config.GetSocket().Port), handlerWithCORS)
+		handlerWithCORS := handlers.CORS(CORSHeaders, CORSOrigins)(a.clientIPFilter.Handler(a.mux))
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", a.config.GetSocket().Port))
+		if err != nil {
+			logger.Fatal("Client listener failed", zap.Error(err))
+		}
+		err = http.Serve(a.clientIPFilter.Listener(a.logger, listener), handlerWithCORS)
 		if err != nil {
 			logger.Fatal("Client listener failed", zap.Error(err))
 		}
 	}()
 	logger.Info("Client", zap.Int("port", a.config.GetSocket().Port))
+	a.startGRPCServer(logger)
 }
 
-func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Request,
+func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Request, eventType int64,
 	retrieveUserID func(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code)) {
 
 	w.Header().Set("Content-Type", "application/octet-stream")
@@ -322,48 +560,175 @@ func (a *authenticationService) handleAuth(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	ip := a.clientIPFilter.ClientIP(r)
+	authResponse, lockedMs, after := a.authenticate(authReq, eventType, strings.TrimPrefix(r.URL.Path, "/user/"), ip, r.UserAgent(), retrieveUserID)
+	if authError := authResponse.GetError(); authError != nil {
+		if lockedMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((lockedMs+999)/1000, 10))
+		}
+		a.sendAuthResponse(w, r, authErrorStatus(Error_Code(authError.Code)), authResponse)
+		return
+	}
+
+	a.sendAuthResponse(w, r, 200, authResponse)
+	after()
+}
+
+// authenticate runs an authentication request through the before hook, rate limiting and the given user lookup,
+// shared by the HTTP and gRPC APIs. On success it returns the session response and a function to run the after hook
+// once the response is sent. On failure it returns an error response, and how long the client is locked out for if
+// it has failed too often.
+func (a *authenticationService) authenticate(authReq *AuthenticateRequest, eventType int64, hookName string, ip string, userAgent string,
+	retrieveUserID func(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code)) (*AuthenticateResponse, int64, func()) {
+
 	messageType := fmt.Sprintf("%T", authReq.Id)
 	a.logger.Debug("Received message", zap.String("type", messageType))
-	authReq, fnErr := RuntimeBeforeHookAuthentication(a.runtime, a.jsonpbMarshaler, a.jsonpbUnmarshaler, authReq)
-	if fnErr != nil {
+	authReq, fnErr := RuntimeBeforeHookAuthentication(a.runtime, a.jsonpbMarshaler, a.jsonpbUnmarshaler, authReq, hookName, ip)
+	if denied, ok := fnErr.(*authDeniedError); ok {
+		return authErrorResponse(denied.message, AUTH_DENIED, nil), 0, nil
+	} else if fnErr != nil {
 		a.logger.Error("Runtime before function caused an error", zap.String("message", messageType), zap.Error(fnErr))
-		a.sendAuthError(w, r, "Runtime before function caused an error", RUNTIME_FUNCTION_EXCEPTION, authReq)
-		return
+		return authErrorResponse("Runtime before function caused an error", RUNTIME_FUNCTION_EXCEPTION, authReq), 0, nil
+	}
+
+	account := authRateLimitAccount(authReq)
+	if lockedMs := a.rateLimiter.Check(ip, account, nowMs()); lockedMs > 0 {
+		return authErrorResponse("Too many failed attempts, try again later", AUTH_RATE_LIMITED, authReq), lockedMs, nil
 	}
 
 	userID, handle, errString, errCode := retrieveUserID(authReq)
+	switch errCode {
+	case AUTH_ERROR, USER_NOT_FOUND, USER_REGISTER_INUSE, MFA_INVALID:
+		// Wrong credentials, unknown IDs and probing for IDs in use all count towards a lockout.
+		a.rateLimiter.Fail(ip, account, nowMs())
+	case 0:
+		a.rateLimiter.Succeed(account)
+	}
+	if errCode == USER_BANNED {
+		return a.authBanErrorResponse(errString, userID, authReq), 0, nil
+	}
 	if errString != "" {
 		a.logger.Debug("Could not retrieve user ID", zap.String("error", errString), zap.Int("code", int(errCode)))
-		a.sendAuthError(w, r, errString, errCode, authReq)
-		return
+		return authErrorResponse(errString, errCode, authReq), 0, nil
 	}
 
 	uid, _ := uuid.FromBytes(userID)
-	exp := time.Now().UTC().Add(time.Duration(a.config.GetSession().TokenExpiryMs) * time.Millisecond).Unix()
+	refreshID, refreshToken, err := refreshTokenCreate(a.db, userID, a.config.GetSession().RefreshTokenExpiryMs)
+	if err != nil {
+		a.logger.Error("Could not create refresh token", zap.Error(err))
+		return authErrorResponse("Could not create session", RUNTIME_EXCEPTION, authReq), 0, nil
+	}
+	signedToken, exp := sessionTokenCreate(a.hmacSecretByte, uid, handle, refreshID, a.config.GetSession().TokenExpiryMs)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"uid": uid.String(),
-		"exp": exp,
-		"han": handle,
-	})
-	signedToken, _ := token.SignedString(a.hmacSecretByte)
+	if err = authHistoryAdd(a.db, userID, eventType, authHistoryProvider(authReq), ip, userAgent, nowMs()); err != nil {
+		// The user is still let in, losing an audit entry is better than locking everyone out.
+		a.logger.Warn("Could not add auth history", zap.Error(err))
+	}
 
-	authResponse := &AuthenticateResponse{CollationId: authReq.CollationId, Id: &AuthenticateResponse_Session_{&AuthenticateResponse_Session{Token: signedToken}}}
-	a.sendAuthResponse(w, r, 200, authResponse)
+	authResponse := &AuthenticateResponse{CollationId: authReq.CollationId, Id: &AuthenticateResponse_Session_{&AuthenticateResponse_Session{Token: signedToken, RefreshToken: refreshToken}}}
+	return authResponse, 0, func() {
+		RuntimeAfterHookAuthentication(a.logger, a.runtime, a.jsonpbMarshaler, authReq, uid, handle, exp)
+	}
+}
+
+// registerChallenged checks the registration challenge answered from the client address before registering the user.
+func (a *authenticationService) registerChallenged(ip string) func(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code) {
+	return func(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code) {
+		// Checked before the user is written, so bots that fail cost no more than the check.
+		if err := a.challenge.Verify(authReq.Challenge, ip); err != nil {
+			return nil, "", err.Error(), USER_REGISTER_CHALLENGE_FAILED
+		}
+		return a.register(authReq)
+	}
+}
+
+// challengeResponse is the JSON body of registration challenge responses.
+type challengeResponse struct {
+	Provider   string `json:"provider"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+}
 
-	RuntimeAfterHookAuthentication(a.logger, a.runtime, a.jsonpbMarshaler, authReq, uid, handle, exp)
+// handleChallenge issues a registration challenge. Clients of CAPTCHA providers only learn which provider to show.
+func (a *authenticationService) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := r.BasicAuth()
+	if !ok || username != a.config.GetSocket().ServerKey {
+		http.Error(w, "Missing or invalid server key", 401)
+		return
+	}
+
+	challenge, err := a.challenge.Issue()
+	if err != nil {
+		a.logger.Error("Could not issue registration challenge", zap.Error(err))
+		http.Error(w, "Could not issue registration challenge", 500)
+		return
+	}
+
+	config := a.config.GetSession().Challenge
+	response := &challengeResponse{Provider: config.Provider, Challenge: challenge}
+	if config.Provider == "pow" {
+		response.Difficulty = config.Difficulty
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// emailTokenRequest is the JSON body of email verification and password reset requests.
+type emailTokenRequest struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// handleEmailToken serves email verification and password reset requests, which are not tied to a session but need
+// the server key like authentication requests.
+func (a *authenticationService) handleEmailToken(w http.ResponseWriter, r *http.Request, fn func(req *emailTokenRequest) (Error_Code, error)) {
+	username, _, ok := r.BasicAuth()
+	if !ok || username != a.config.GetSocket().ServerKey {
+		http.Error(w, "Missing or invalid server key", 401)
+		return
+	}
+
+	req := &emailTokenRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, a.config.GetSocket().MaxMessageSizeBytes)).Decode(req); err != nil {
+		a.logger.Warn("Could not decode body", zap.Error(err))
+		http.Error(w, "Could not decode body", 400)
+		return
+	}
+
+	if code, err := fn(req); err != nil {
+		httpCode := 500
+		switch code {
+		case BAD_INPUT:
+			httpCode = 400
+		case USER_NOT_FOUND:
+			httpCode = 404
+		}
+		http.Error(w, err.Error(), httpCode)
+		return
+	}
+	w.WriteHeader(200)
 }
 
 func (a *authenticationService) sendAuthError(w http.ResponseWriter, r *http.Request, error string, errorCode Error_Code, authRequest *AuthenticateRequest) {
+	a.sendAuthResponse(w, r, authErrorStatus(errorCode), authErrorResponse(error, errorCode, authRequest))
+}
+
+func authErrorResponse(error string, errorCode Error_Code, authRequest *AuthenticateRequest) *AuthenticateResponse {
 	var collationID string
 	if authRequest != nil {
 		collationID = authRequest.CollationId
 	}
-	authResponse := &AuthenticateResponse{CollationId: collationID, Id: &AuthenticateResponse_Error_{&AuthenticateResponse_Error{
+	return &AuthenticateResponse{CollationId: collationID, Id: &AuthenticateResponse_Error_{&AuthenticateResponse_Error{
 		Code:    int32(errorCode),
 		Message: error,
 		Request: authRequest,
 	}}}
+}
+
+// authErrorStatus returns the HTTP status code to send with an authentication error.
+func authErrorStatus(errorCode Error_Code) int {
 	httpCode := 500
 	switch errorCode {
 	case RUNTIME_EXCEPTION:
@@ -378,10 +743,39 @@ func (a *authenticationService) sendAuthError(w http.ResponseWriter, r *http.Req
 		httpCode = 401
 	case USER_REGISTER_INUSE:
 		httpCode = 401
+	case USER_REGISTER_CHALLENGE_FAILED:
+		httpCode = 403
+	case AUTH_RATE_LIMITED:
+		httpCode = 429
+	case USER_DELETED:
+		httpCode = 403
+	case USER_BANNED:
+		httpCode = 403
+	case MFA_REQUIRED:
+		httpCode = 401
+	case MFA_INVALID:
+		httpCode = 401
+	case AUTH_DENIED:
+		httpCode = 403
 	default:
 		httpCode = 500
 	}
-	a.sendAuthResponse(w, r, httpCode, authResponse)
+	return httpCode
+}
+
+func (a *authenticationService) authBanErrorResponse(error string, userID []byte, authRequest *AuthenticateRequest) *AuthenticateResponse {
+	authError := &AuthenticateResponse_Error{
+		Code:    int32(USER_BANNED),
+		Message: error,
+		Request: authRequest,
+	}
+	if ban, err := userBanActive(a.db, userID); err != nil {
+		a.logger.Error("Could not check user ban", zap.Error(err))
+	} else if ban != nil {
+		authError.BanReason = ban.Reason
+		authError.BanExpiresAt = ban.ExpiresAt
+	}
+	return &AuthenticateResponse{CollationId: authRequest.CollationId, Id: &AuthenticateResponse_Error_{authError}}
 }
 
 func (a *authenticationService) sendAuthResponse(w http.ResponseWriter, r *http.Request, code int, response *AuthenticateResponse) {
@@ -434,6 +828,10 @@ func (a *authenticationService) login(authReq *AuthenticateRequest) ([]byte, str
 		loginFunc = a.loginEmail
 	case *AuthenticateRequest_Custom:
 		loginFunc = a.loginCustom
+	case *AuthenticateRequest_Apple_:
+		loginFunc = a.loginApple
+	case *AuthenticateRequest_Oidc:
+		loginFunc = a.loginOIDC
 	default:
 		return nil, "", errorInvalidPayload, BAD_INPUT
 	}
@@ -441,10 +839,13 @@ func (a *authenticationService) login(authReq *AuthenticateRequest) ([]byte, str
 	userID, handle, disabledAt, message, errorCode := loginFunc(authReq)
 
 	if disabledAt != 0 {
-		return nil, "", "ID disabled", AUTH_ERROR
+		userID, handle, message, errorCode = a.checkBan(userID, handle)
+	}
+	if message != "" {
+		return userID, handle, message, errorCode
 	}
 
-	return userID, handle, message, errorCode
+	return a.checkMfa(authReq, userID, handle)
 }
 
 func (a *authenticationService) loginDevice(authReq *AuthenticateRequest) ([]byte, string, int64, string, Error_Code) {
@@ -671,6 +1072,219 @@ func (a *authenticationService) loginCustom(authReq *AuthenticateRequest) ([]byt
 	return userID, handle, disabledAt, "", 0
 }
 
+func (a *authenticationService) loginApple(authReq *AuthenticateRequest) ([]byte, string, int64, string, Error_Code) {
+	if a.config.GetSocial().Apple.BundleID == "" {
+		return nil, "", 0, "Apple login not available", AUTH_ERROR
+	}
+
+	apple := authReq.GetApple()
+	if apple == nil || apple.Token == "" {
+		return nil, "", 0, "Apple identity token is required", BAD_INPUT
+	} else if invalidCharsRegex.MatchString(apple.Token) {
+		return nil, "", 0, "Invalid Apple identity token, no spaces or control characters allowed", BAD_INPUT
+	}
+
+	appleProfile, err := a.socialClient.CheckAppleToken(a.config.GetSocial().Apple.BundleID, apple.Token)
+	if err != nil {
+		a.logger.Warn("Could not check Apple identity token", zap.Error(err))
+		return nil, "", 0, errorCouldNotLogin, AUTH_ERROR
+	}
+
+	var userID []byte
+	var handle string
+	var disabledAt int64
+	err = a.db.QueryRow("SELECT id, handle, disabled_at FROM users WHERE apple_id = $1",
+		appleProfile.ID).
+		Scan(&userID, &handle, &disabledAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", 0, errorIDNotFound, USER_NOT_FOUND
+		} else {
+			a.logger.Warn(errorCouldNotLogin, zap.String("profile", "apple"), zap.Error(err))
+			return nil, "", 0, errorCouldNotLogin, RUNTIME_EXCEPTION
+		}
+	}
+
+	return userID, handle, disabledAt, "", 0
+}
+
+// checkOIDCToken verifies an ID token from the configured identity provider, returning the custom ID and the handle
+// it maps to. The handle is empty if the token has none.
+func (a *authenticationService) checkOIDCToken(token string) (string, string, string, Error_Code) {
+	oidc := a.config.GetSocial().OIDC
+	if oidc.Issuer == "" {
+		return "", "", "OpenID Connect authentication not available", AUTH_ERROR
+	}
+	if token == "" {
+		return "", "", "ID token is required", BAD_INPUT
+	} else if invalidCharsRegex.MatchString(token) {
+		return "", "", "Invalid ID token, no spaces or control characters allowed", BAD_INPUT
+	}
+
+	claims, err := a.socialClient.CheckOIDCToken(oidc.Issuer, oidc.JwksURL, oidc.Audience, token)
+	if err != nil {
+		a.logger.Warn("Could not check ID token", zap.Error(err))
+		return "", "", "Invalid ID token", AUTH_ERROR
+	}
+
+	customID, _ := claims[oidc.IDClaim].(string)
+	if customID == "" || invalidCharsRegex.MatchString(customID) || len(customID) > 128 {
+		a.logger.Warn("Invalid ID token claim", zap.String("claim", oidc.IDClaim))
+		return "", "", "Invalid ID token", AUTH_ERROR
+	}
+	handle, _ := claims[oidc.HandleClaim].(string)
+	if invalidCharsRegex.MatchString(handle) || len(handle) > 128 {
+		handle = ""
+	}
+	return customID, handle, "", 0
+}
+
+func (a *authenticationService) loginOIDC(authReq *AuthenticateRequest) ([]byte, string, int64, string, Error_Code) {
+	customID, _, message, code := a.checkOIDCToken(authReq.GetOidc())
+	if message != "" {
+		return nil, "", 0, message, code
+	}
+
+	var userID []byte
+	var handle string
+	var disabledAt int64
+	err := a.db.QueryRow("SELECT id, handle, disabled_at FROM users WHERE custom_id = $1",
+		customID).
+		Scan(&userID, &handle, &disabledAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", 0, errorIDNotFound, USER_NOT_FOUND
+		} else {
+			a.logger.Warn(errorCouldNotLogin, zap.String("profile", "oidc"), zap.Error(err))
+			return nil, "", 0, errorCouldNotLogin, RUNTIME_EXCEPTION
+		}
+	}
+
+	return userID, handle, disabledAt, "", 0
+}
+
+// refresh exchanges a refresh token for the user it was issued to, as long as they have not been disabled since.
+func (a *authenticationService) refresh(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code) {
+	refreshToken := authReq.GetRefresh()
+	if refreshToken == "" {
+		return nil, "", "Refresh token is required", BAD_INPUT
+	}
+
+	userID, err := refreshTokenUse(a.db, refreshToken)
+	if err == sql.ErrNoRows {
+		return nil, "", "Invalid or expired refresh token", AUTH_ERROR
+	} else if err != nil {
+		a.logger.Warn("Could not use refresh token", zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+
+	var handle string
+	var disabledAt int64
+	err = a.db.QueryRow("SELECT handle, disabled_at FROM users WHERE id = $1", userID).Scan(&handle, &disabledAt)
+	if err == sql.ErrNoRows {
+		return nil, "", errorIDNotFound, USER_NOT_FOUND
+	} else if err != nil {
+		a.logger.Warn(errorCouldNotLogin, zap.String("profile", "refresh"), zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if disabledAt != 0 {
+		return a.checkBan(userID, handle)
+	}
+
+	return userID, handle, "", 0
+}
+
+// checkBan is used when a disabled user authenticates, returning a USER_DELETED error if they deleted their account
+// or a USER_BANNED error while a ban is in force. Once their suspensions have ended they are let in.
+func (a *authenticationService) checkBan(userID []byte, handle string) ([]byte, string, string, Error_Code) {
+	var deletedAt int64
+	if err := a.db.QueryRow("SELECT deleted_at FROM users WHERE id = $1", userID).Scan(&deletedAt); err != nil {
+		a.logger.Error("Could not check user deletion", zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if deletedAt != 0 {
+		return nil, "", "Account has been deleted", USER_DELETED
+	}
+
+	ban, err := userBanActive(a.db, userID)
+	if err != nil {
+		a.logger.Error("Could not check user ban", zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if ban != nil {
+		// The user ID is returned so the ban can be included in the response.
+		return userID, "", ban.Message(), USER_BANNED
+	}
+	return userID, handle, "", 0
+}
+
+// checkSessionUser is used when a session token is presented. Tokens stay valid until they expire, so users who have
+// since been banned, deleted their account or been merged into another account are turned away here.
+func (a *authenticationService) checkSessionUser(userID uuid.UUID) (string, Error_Code) {
+	var disabledAt int64
+	err := a.db.QueryRow("SELECT disabled_at FROM users WHERE id = $1", userID.Bytes()).Scan(&disabledAt)
+	if err == sql.ErrNoRows {
+		return errorIDNotFound, USER_NOT_FOUND
+	} else if err != nil {
+		a.logger.Warn("Could not check session user", zap.Error(err))
+		return errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if disabledAt == 0 {
+		return "", 0
+	}
+	_, _, message, code := a.checkBan(userID.Bytes(), "")
+	return message, code
+}
+
+// checkMfa asks users enrolled in multi-factor authentication for a code from their app or a recovery code, unless the
+// runtime MFA function lets the login through without one. Wrong codes count towards a lockout of the user.
+func (a *authenticationService) checkMfa(authReq *AuthenticateRequest, userID []byte, handle string) ([]byte, string, string, Error_Code) {
+	enabled, err := mfaEnabled(a.db, userID)
+	if err != nil {
+		a.logger.Error("Could not check multi-factor authentication", zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if !enabled {
+		return userID, handle, "", 0
+	}
+
+	uid := uuid.FromBytesOrNil(userID)
+	if fn := a.runtime.GetRuntimeCallback(MFA, ""); fn != nil {
+		demand, err := a.runtime.InvokeFunctionMfa(fn, uid, handle, map[string]interface{}{
+			"Type": RUNTIME_MESSAGES[fmt.Sprintf("%T", authReq.Id)],
+		})
+		if err != nil {
+			a.logger.Error("Runtime MFA function caused an error", zap.Error(err))
+			return nil, "", "Runtime MFA function caused an error", RUNTIME_FUNCTION_EXCEPTION
+		}
+		if !demand {
+			return userID, handle, "", 0
+		}
+	}
+
+	if authReq.MfaCode == "" {
+		return nil, "", "Multi-factor authentication code required", MFA_REQUIRED
+	}
+
+	// Social logins have no account to lock out before the user is known, so codes are limited per user as well.
+	account := "mfa:" + uid.String()
+	if lockedMs := a.rateLimiter.Check("", account, nowMs()); lockedMs > 0 {
+		return nil, "", "Too many failed attempts, try again later", AUTH_RATE_LIMITED
+	}
+	valid, err := mfaVerify(a.db, userID, authReq.MfaCode)
+	if err != nil {
+		a.logger.Error("Could not verify multi-factor authentication code", zap.Error(err))
+		return nil, "", errorCouldNotLogin, RUNTIME_EXCEPTION
+	}
+	if !valid {
+		a.rateLimiter.Fail("", account, nowMs())
+		return nil, "", errorInvalidMfaCode.Error(), MFA_INVALID
+	}
+	a.rateLimiter.Succeed(account)
+
+	return userID, handle, "", 0
+}
+
 func (a *authenticationService) register(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code) {
 	// Route to correct register handler
 	var registerFunc func(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, string, Error_Code)
@@ -691,10 +1305,33 @@ func (a *authenticationService) register(authReq *AuthenticateRequest) ([]byte,
 		registerFunc = a.registerGameCenter
 	case *AuthenticateRequest_Steam:
 		registerFunc = a.registerSteam
+		if a.config.GetSocial().Steam.ImportFriends {
+			registerHook = func(authReq *AuthenticateRequest, userID []byte, handle string, identifier string) {
+				l := a.logger.With(zap.String("user_id", uuid.FromBytesOrNil(userID).String()))
+				steamID, err := strconv.ParseUint(identifier, 10, 64)
+				if err != nil {
+					l.Error("Could not import friends from Steam", zap.Error(err))
+					return
+				}
+				a.pipeline.addSteamFriends(l, userID, handle, steamID)
+			}
+		}
 	case *AuthenticateRequest_Email_:
 		registerFunc = a.registerEmail
+		registerHook = func(authReq *AuthenticateRequest, userID []byte, handle string, identifier string) {
+			// Sent in the background so a slow mail server does not hold up registration.
+			go func() {
+				if _, err := EmailVerificationSend(a.logger, a.db, a.config, a.mailer, uuid.FromBytesOrNil(userID)); err != nil {
+					a.logger.Warn("Could not send email verification", zap.Error(err))
+				}
+			}()
+		}
 	case *AuthenticateRequest_Custom:
 		registerFunc = a.registerCustom
+	case *AuthenticateRequest_Apple_:
+		registerFunc = a.registerApple
+	case *AuthenticateRequest_Oidc:
+		registerFunc = a.registerOIDC
 	default:
 		return nil, "", errorInvalidPayload, BAD_INPUT
 	}
@@ -1088,6 +1725,144 @@ WHERE NOT EXISTS
 	return userID, handle, customID, "", 0
 }
 
+func (a *authenticationService) registerApple(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, string, Error_Code) {
+	if a.config.GetSocial().Apple.BundleID == "" {
+		return nil, "", "", "Apple registration not available", AUTH_ERROR
+	}
+
+	apple := authReq.GetApple()
+	if apple == nil || apple.Token == "" {
+		return nil, "", "", "Apple identity token is required", BAD_INPUT
+	} else if invalidCharsRegex.MatchString(apple.Token) {
+		return nil, "", "", "Invalid Apple identity token, no spaces or control characters allowed", BAD_INPUT
+	} else if apple.DeviceId != "" && (invalidCharsRegex.MatchString(apple.DeviceId) || len(apple.DeviceId) < 10 || len(apple.DeviceId) > 128) {
+		return nil, "", "", "Invalid device ID, must be 10-128 bytes with no spaces or control characters", BAD_INPUT
+	}
+
+	appleProfile, err := a.socialClient.CheckAppleToken(a.config.GetSocial().Apple.BundleID, apple.Token)
+	if err != nil {
+		a.logger.Warn("Could not check Apple identity token", zap.Error(err))
+		return nil, "", "", errorCouldNotRegister, AUTH_ERROR
+	}
+
+	updatedAt := nowMs()
+
+	// An existing device account is moved to the Apple ID, unless it already has one.
+	if apple.DeviceId != "" {
+		var userID []byte
+		var handle string
+		err = tx.QueryRow(`
+UPDATE users SET apple_id = $2, updated_at = $3
+WHERE id = (SELECT user_id FROM user_device WHERE id = $1)
+AND apple_id IS NULL AND disabled_at = 0
+AND NOT EXISTS
+(SELECT id
+ FROM users
+ WHERE apple_id = $2)
+RETURNING id, handle`,
+			apple.DeviceId,
+			appleProfile.ID,
+			updatedAt).
+			Scan(&userID, &handle)
+		if err == nil {
+			return userID, handle, appleProfile.ID, "", 0
+		} else if err != sql.ErrNoRows {
+			a.logger.Warn("Could not register Apple profile from device, query error", zap.Error(err))
+			return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+		}
+	}
+
+	userID := uuid.NewV4().Bytes()
+	handle := a.generateHandle()
+	res, err := tx.Exec(`
+INSERT INTO users (id, handle, apple_id, created_at, updated_at)
+SELECT $1 AS id,
+	 $2 AS handle,
+	 $3 AS apple_id,
+	 $4 AS created_at,
+	 $4 AS updated_at
+WHERE NOT EXISTS
+(SELECT id
+ FROM users
+ WHERE apple_id = $3)`,
+		userID,
+		handle,
+		appleProfile.ID,
+		updatedAt)
+
+	if err != nil {
+		a.logger.Warn("Could not register new Apple profile, query error", zap.Error(err))
+		return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return nil, "", "", errorIDAlreadyInUse, USER_REGISTER_INUSE
+	}
+
+	err = a.addUserEdgeMetadata(tx, userID, updatedAt)
+	if err != nil {
+		a.logger.Error("Could not register new Apple profile, user edge metadata error", zap.Error(err))
+		return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+	}
+
+	return userID, handle, appleProfile.ID, "", 0
+}
+
+func (a *authenticationService) registerOIDC(tx *sql.Tx, authReq *AuthenticateRequest) ([]byte, string, string, string, Error_Code) {
+	customID, handle, message, code := a.checkOIDCToken(authReq.GetOidc())
+	if message != "" {
+		return nil, "", "", message, code
+	}
+
+	// The identity provider's name for the user is kept if nobody has taken it.
+	if handle != "" {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM users WHERE handle = $1", handle).Scan(&exists)
+		if err == nil {
+			handle = ""
+		} else if err != sql.ErrNoRows {
+			a.logger.Warn("Could not register new OpenID Connect profile, query error", zap.Error(err))
+			return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+		}
+	}
+	if handle == "" {
+		handle = a.generateHandle()
+	}
+
+	updatedAt := nowMs()
+	userID := uuid.NewV4().Bytes()
+	res, err := tx.Exec(`
+INSERT INTO users (id, handle, custom_id, created_at, updated_at)
+SELECT $1 AS id,
+	 $2 AS handle,
+	 $3 AS custom_id,
+	 $4 AS created_at,
+	 $4 AS updated_at
+WHERE NOT EXISTS
+(SELECT id
+ FROM users
+ WHERE custom_id = $3)`,
+		userID,
+		handle,
+		customID,
+		updatedAt)
+
+	if err != nil {
+		a.logger.Warn("Could not register new OpenID Connect profile, query error", zap.Error(err))
+		return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return nil, "", "", errorIDAlreadyInUse, USER_REGISTER_INUSE
+	}
+
+	err = a.addUserEdgeMetadata(tx, userID, updatedAt)
+	if err != nil {
+		a.logger.Error("Could not register new OpenID Connect profile, user edge metadata error", zap.Error(err))
+		return nil, "", "", errorCouldNotRegister, RUNTIME_EXCEPTION
+	}
+
+	return userID, handle, customID, "", 0
+}
+
 func (a *authenticationService) generateHandle() string {
 	b := make([]byte, 10)
 	for i := range b {
@@ -1096,36 +1871,46 @@ func (a *authenticationService) generateHandle() string {
 	return string(b)
 }
 
-func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID, string, int64, bool) {
+func (a *authenticationService) authenticateToken(tokenString string) (uuid.UUID, string, int64, string, bool) {
 	if tokenString == "" {
 		a.logger.Warn("Token missing")
-		return uuid.Nil, "", 0, false
+		return uuid.Nil, "", 0, "", false
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return a.hmacSecretByte, nil
-	})
+	uid, handle, exp, refreshID, err := sessionTokenParse(a.hmacSecretByte, tokenString)
+	if err != nil {
+		a.logger.Warn("Token invalid", zap.String("token", tokenString), zap.Error(err))
+		return uuid.Nil, "", 0, "", false
+	}
+	return uid, handle, exp, refreshID, true
+}
 
-	if err == nil {
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			uid, uerr := uuid.FromString(claims["uid"].(string))
-			if uerr != nil {
-				a.logger.Warn("Invalid user ID in token", zap.String("token", tokenString), zap.Error(uerr))
-				return uuid.Nil, "", 0, false
-			}
-			return uid, claims["han"].(string), int64(claims["exp"].(float64)), true
+// Drain stops new sockets connecting and tells connected sessions the server is shutting down. It returns once the
+// drain period ends, or sooner if every session and authoritative match has finished.
+func (a *authenticationService) Drain() {
+	a.draining.Store(true)
+	a.registry.notifyShutdown()
+
+	deadline := time.After(time.Duration(a.config.GetSocket().ShutdownDrainMs) * time.Millisecond)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if a.registry.count() == 0 && a.pipeline.matchRegistry.Count() == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
 		}
 	}
-
-	a.logger.Warn("Token invalid", zap.String("token", tokenString), zap.Error(err))
-	return uuid.Nil, "", 0, false
 }
 
 func (a *authenticationService) Stop() {
 	// TODO stop incoming net connections
+	if a.grpcServer != nil {
+		a.grpcServer.Stop()
+	}
 	a.registry.stop()
 }
 
@@ -0,0 +1,462 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Flags set in the first byte of a datagram body.
+const (
+	datagramFlagReliable = 1 << iota
+	datagramFlagAck
+)
+
+const (
+	datagramTokenSize  = 16
+	datagramKeySize    = 32
+	datagramHeaderSize = 5 // Flags byte and sequence number.
+	// Larger datagrams risk being fragmented on the way, so bigger match data stays on the socket.
+	datagramMaxSize = 1200
+	// Number of sequence numbers remembered per session to drop repeats. Older datagrams are dropped too.
+	datagramReceivedWindow = 256
+	// Datagrams received for a session but not yet processed. More are dropped, and reliable ones sent again.
+	datagramInboundQueueSize = 64
+)
+
+// DatagramServer exchanges match data with clients as encrypted UDP datagrams, alongside their socket. Sessions opt
+// in by binding, which gives them a token that identifies their datagrams and a key that seals them.
+type DatagramServer struct {
+	sync.RWMutex
+	logger     *zap.Logger
+	config     *SocketConfig
+	conn       *net.UDPConn
+	peers      map[string]*datagramPeer
+	stopped    bool
+	stopCh     chan struct{}
+	resendTick *time.Ticker
+	reaped     *atomic.Int64
+}
+
+type datagramPeer struct {
+	sync.Mutex
+	server       *DatagramServer
+	session      *session
+	token        []byte
+	aead         cipher.AEAD
+	reliable     map[int64]bool
+	addr         *net.UDPAddr
+	seq          uint32
+	pending      map[uint32]*datagramPending
+	received     [datagramReceivedWindow]uint32
+	receivedMax  uint32
+	inbound      chan *Envelope
+	lastReceived time.Time
+	lastPing     time.Time
+}
+
+type datagramPending struct {
+	datagram []byte
+	payload  []byte
+	sentAt   time.Time
+	resends  int
+}
+
+// NewDatagramServer creates a new DatagramServer. It does not listen until started.
+func NewDatagramServer(logger *zap.Logger, config Config) *DatagramServer {
+	return &DatagramServer{
+		logger: logger,
+		config: config.GetSocket(),
+		peers:  make(map[string]*datagramPeer),
+		stopCh: make(chan struct{}),
+		reaped: atomic.NewInt64(0),
+	}
+}
+
+// Reaped returns the number of datagram bindings dropped because the client stopped sending datagrams.
+func (d *DatagramServer) Reaped() int64 {
+	return d.reaped.Load()
+}
+
+func (d *DatagramServer) enabled() bool {
+	return d.config.DatagramPort != 0
+}
+
+// Start listens for datagrams. It does nothing if no datagram port is configured.
+func (d *DatagramServer) Start(logger *zap.Logger) {
+	if !d.enabled() {
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: d.config.DatagramPort})
+	if err != nil {
+		logger.Fatal("Datagram listener failed", zap.Error(err))
+	}
+	d.conn = conn
+	d.resendTick = time.NewTicker(time.Duration(d.config.DatagramResendMs) * time.Millisecond)
+
+	go d.read()
+	go d.resendPeriodically()
+
+	logger.Info("Datagram", zap.Int("port", d.config.DatagramPort))
+}
+
+// Stop closes the listener and forgets all bindings.
+func (d *DatagramServer) Stop() {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped || d.conn == nil {
+		return
+	}
+	d.stopped = true
+	close(d.stopCh)
+	d.resendTick.Stop()
+	d.conn.Close()
+	for token, peer := range d.peers {
+		close(peer.inbound)
+		delete(d.peers, token)
+	}
+}
+
+// bind issues the session a new token and key, replacing any earlier binding it had. Envelopes the session sends as
+// datagrams are passed to the handler.
+func (d *DatagramServer) bind(s *session, reliableOpCodes []int64, handler func(logger *zap.Logger, session *session, envelope *Envelope)) (*TDatagramBinding, error) {
+	if !d.enabled() {
+		return nil, errors.New("datagrams are not enabled")
+	}
+
+	token := make([]byte, datagramTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	key := make([]byte, datagramKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	reliable := make(map[int64]bool, len(reliableOpCodes))
+	for _, opCode := range reliableOpCodes {
+		reliable[opCode] = true
+	}
+
+	peer := &datagramPeer{
+		server:       d,
+		session:      s,
+		token:        token,
+		aead:         aead,
+		reliable:     reliable,
+		pending:      make(map[uint32]*datagramPending),
+		inbound:      make(chan *Envelope, datagramInboundQueueSize),
+		lastReceived: time.Now(),
+		lastPing:     time.Now(),
+	}
+
+	d.Lock()
+	if d.stopped {
+		d.Unlock()
+		return nil, errors.New("datagram server stopped")
+	}
+	if previous := s.setDatagramPeer(peer); previous != nil {
+		if _, ok := d.peers[string(previous.token)]; ok {
+			delete(d.peers, string(previous.token))
+			close(previous.inbound)
+		}
+	}
+	d.peers[string(token)] = peer
+	d.Unlock()
+
+	// Each session processes its datagrams in order on its own, like its socket messages.
+	go func() {
+		for envelope := range peer.inbound {
+			handler(s.logger.With(zap.String("cid", envelope.CollationId)), s, envelope)
+		}
+	}()
+
+	return &TDatagramBinding{
+		Port:  int32(d.config.DatagramPort),
+		Token: token,
+		Key:   key,
+	}, nil
+}
+
+func (d *DatagramServer) read() {
+	buf := make([]byte, datagramMaxSize*2)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.stopCh:
+				return
+			default:
+			}
+			d.logger.Warn("Error reading datagram", zap.Error(err))
+			continue
+		}
+		if n < datagramTokenSize {
+			continue
+		}
+
+		d.RLock()
+		peer := d.peers[string(buf[:datagramTokenSize])]
+		if peer != nil {
+			peer.receive(buf[:n], addr)
+		}
+		d.RUnlock()
+	}
+}
+
+func (d *DatagramServer) resendPeriodically() {
+	for {
+		select {
+		case <-d.resendTick.C:
+			d.resend()
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// resend sends unacknowledged reliable datagrams again and keeps routes to clients open. It drops bindings of sessions
+// that have since closed, and of clients that have stopped sending datagrams.
+func (d *DatagramServer) resend() {
+	now := time.Now()
+	pongWait := time.Duration(d.config.DatagramPongWaitMs) * time.Millisecond
+
+	d.Lock()
+	peers := make([]*datagramPeer, 0, len(d.peers))
+	for token, peer := range d.peers {
+		if peer.session.isStopped() {
+			delete(d.peers, token)
+			close(peer.inbound)
+			continue
+		}
+		peer.Lock()
+		silent := now.Sub(peer.lastReceived) > pongWait
+		peer.Unlock()
+		if silent {
+			delete(d.peers, token)
+			close(peer.inbound)
+			peer.session.clearDatagramPeer(peer)
+			d.reaped.Inc()
+			peer.session.logger.Info("Dropped datagram binding of client that stopped sending datagrams")
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	d.Unlock()
+
+	wait := time.Duration(d.config.DatagramResendMs) * time.Millisecond
+	pingPeriod := time.Duration(d.config.DatagramPingPeriodMs) * time.Millisecond
+	for _, peer := range peers {
+		var fallback [][]byte
+		peer.Lock()
+		addr := peer.addr
+		if addr != nil && now.Sub(peer.lastPing) >= pingPeriod {
+			// An empty datagram, which the client answers with one of its own.
+			if ping, err := peer.seal(0, 0, nil); err == nil {
+				d.write(ping, addr)
+			}
+			peer.lastPing = now
+		}
+		for seq, pending := range peer.pending {
+			if now.Sub(pending.sentAt) < wait {
+				continue
+			}
+			if pending.resends >= d.config.DatagramMaxResends {
+				delete(peer.pending, seq)
+				fallback = append(fallback, pending.payload)
+				continue
+			}
+			pending.resends++
+			pending.sentAt = now
+			d.write(pending.datagram, addr)
+		}
+		peer.Unlock()
+
+		// The client is not receiving datagrams, but match data sent reliably must still arrive.
+		for _, payload := range fallback {
+			peer.session.sendBytes(payload, true)
+		}
+	}
+}
+
+func (d *DatagramServer) write(datagram []byte, addr *net.UDPAddr) {
+	if _, err := d.conn.WriteToUDP(datagram, addr); err != nil {
+		d.logger.Warn("Could not write datagram", zap.String("remoteAddress", addr.String()), zap.Error(err))
+	}
+}
+
+// receive opens a datagram from the client, handling acknowledgements and queueing any envelope it carries.
+func (p *datagramPeer) receive(datagram []byte, addr *net.UDPAddr) {
+	nonceSize := p.aead.NonceSize()
+	if len(datagram) < datagramTokenSize+nonceSize {
+		return
+	}
+	nonce := datagram[datagramTokenSize : datagramTokenSize+nonceSize]
+	body, err := p.aead.Open(nil, nonce, datagram[datagramTokenSize+nonceSize:], p.token)
+	if err != nil || len(body) < datagramHeaderSize {
+		return
+	}
+	flags := body[0]
+	seq := binary.BigEndian.Uint32(body[1:datagramHeaderSize])
+
+	p.Lock()
+	defer p.Unlock()
+
+	if flags&datagramFlagAck != 0 {
+		// Acknowledgements carry our sequence numbers, so repeats can't be told apart and must not move the binding.
+		delete(p.pending, seq)
+		return
+	}
+
+	if seq == 0 || (seq <= p.receivedMax && p.receivedMax-seq >= datagramReceivedWindow) {
+		// Sequence numbers start at 1, and datagrams older than the window can't be told apart from repeats.
+		return
+	}
+	if p.wasReceived(seq) {
+		if flags&datagramFlagReliable != 0 {
+			// Our acknowledgement was lost, repeat it to the address we already know.
+			p.sendAck(seq)
+		}
+		return
+	}
+
+	// Only the newest authentic datagram moves the binding, so clients can roam between networks but datagrams
+	// captured and sent again from elsewhere cannot take it over.
+	if seq > p.receivedMax {
+		p.receivedMax = seq
+		p.addr = addr
+	}
+	p.lastReceived = time.Now()
+
+	if len(body) == datagramHeaderSize {
+		// Nothing to process, the client only let us know where it is.
+		p.remember(seq)
+		return
+	}
+
+	envelope := &Envelope{}
+	if err := unmarshalEnvelope(p.session.format, body[datagramHeaderSize:], envelope); err != nil {
+		p.remember(seq)
+		return
+	}
+	if envelope.GetMatchDataSend() == nil {
+		p.remember(seq)
+		p.session.logger.Debug("Dropped datagram not carrying match data", zap.String("type", fmt.Sprintf("%T", envelope.Payload)))
+		return
+	}
+
+	select {
+	case p.inbound <- envelope:
+	default:
+		if flags&datagramFlagReliable == 0 {
+			p.remember(seq)
+		}
+		// Leave reliable datagrams unacknowledged so the client sends them again.
+		return
+	}
+
+	p.remember(seq)
+	if flags&datagramFlagReliable != 0 {
+		p.sendAck(seq)
+	}
+}
+
+// wasReceived reports whether a client sequence number within the window was already processed. It must be called
+// with the peer locked.
+func (p *datagramPeer) wasReceived(seq uint32) bool {
+	return seq <= p.receivedMax && p.received[seq%datagramReceivedWindow] == seq
+}
+
+// remember records a client sequence number as processed. Each slot holds the latest sequence number that maps to it,
+// and anything it replaces has already left the window. It must be called with the peer locked.
+func (p *datagramPeer) remember(seq uint32) {
+	p.received[seq%datagramReceivedWindow] = seq
+}
+
+// sendAck must be called with the peer locked.
+func (p *datagramPeer) sendAck(seq uint32) {
+	datagram, err := p.seal(datagramFlagAck, seq, nil)
+	if err != nil {
+		return
+	}
+	p.server.write(datagram, p.addr)
+}
+
+// send delivers a match data payload already marshalled in the session's format. It returns false if the payload
+// must go over the socket instead, because it is too large or the client has not sent a datagram yet.
+func (p *datagramPeer) send(payload []byte, opCode int64) bool {
+	// A session with no socket may be waiting to be resumed, and holds on to its messages.
+	if p.session.isStopped() {
+		return false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.addr == nil {
+		return false
+	}
+
+	var flags byte
+	reliable := p.reliable[opCode]
+	if reliable {
+		flags = datagramFlagReliable
+	}
+	datagram, err := p.seal(flags, p.seq+1, payload)
+	if err != nil || len(datagram) > datagramMaxSize {
+		return false
+	}
+	p.seq++
+	if reliable {
+		p.pending[p.seq] = &datagramPending{datagram: datagram, payload: payload, sentAt: time.Now()}
+	}
+
+	p.server.write(datagram, p.addr)
+	return true
+}
+
+func (p *datagramPeer) seal(flags byte, seq uint32, payload []byte) ([]byte, error) {
+	body := make([]byte, datagramHeaderSize+len(payload))
+	body[0] = flags
+	binary.BigEndian.PutUint32(body[1:datagramHeaderSize], seq)
+	copy(body[datagramHeaderSize:], payload)
+
+	nonceSize := p.aead.NonceSize()
+	datagram := make([]byte, datagramTokenSize+nonceSize, datagramTokenSize+nonceSize+len(body)+p.aead.Overhead())
+	copy(datagram, p.token)
+	if _, err := rand.Read(datagram[datagramTokenSize:]); err != nil {
+		return nil, err
+	}
+	return p.aead.Seal(datagram, datagram[datagramTokenSize:], body, p.token), nil
+}
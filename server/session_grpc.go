@@ -0,0 +1,153 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// grpcService serves the gRPC API. Requests go through the same authentication and pipeline code as the HTTP API
+// and sockets, with credentials given in metadata on every call.
+type grpcService struct {
+	a *authenticationService
+}
+
+// startGRPCServer listens for gRPC calls if a port is configured.
+func (a *authenticationService) startGRPCServer(logger *zap.Logger) {
+	port := a.config.GetSocket().GRPCPort
+	if port == 0 {
+		return
+	}
+
+	a.grpcServer = grpc.NewServer(grpc.MaxRecvMsgSize(int(a.config.GetSocket().MaxMessageSizeBytes)))
+	RegisterNakamaServer(a.grpcServer, &grpcService{a: a})
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		logger.Fatal("gRPC listener failed", zap.Error(err))
+	}
+	go func() {
+		if err := a.grpcServer.Serve(a.clientIPFilter.Listener(a.logger, listener)); err != nil {
+			logger.Fatal("gRPC listener failed", zap.Error(err))
+		}
+	}()
+	logger.Info("gRPC", zap.Int("port", port))
+}
+
+func (g *grpcService) Login(ctx context.Context, authReq *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return g.authenticate(ctx, authReq, AUTH_HISTORY_LOGIN, "login", g.a.login)
+}
+
+func (g *grpcService) Register(ctx context.Context, authReq *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return g.authenticate(ctx, authReq, AUTH_HISTORY_REGISTER, "register", g.a.registerChallenged(grpcClientIP(ctx)))
+}
+
+func (g *grpcService) authenticate(ctx context.Context, authReq *AuthenticateRequest, eventType int64, hookName string,
+	retrieveUserID func(authReq *AuthenticateRequest) ([]byte, string, string, Error_Code)) (*AuthenticateResponse, error) {
+
+	if g.a.draining.Load() {
+		return nil, grpc.Errorf(codes.Unavailable, "Server is shutting down")
+	}
+
+	scheme, credentials := grpcAuthorization(ctx)
+	if scheme != "basic" {
+		return nil, grpc.Errorf(codes.Unauthenticated, "Missing or invalid authentication metadata")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unauthenticated, "Missing or invalid authentication metadata")
+	}
+	if username := strings.SplitN(string(decoded), ":", 2)[0]; username != g.a.config.GetSocket().ServerKey {
+		return nil, grpc.Errorf(codes.Unauthenticated, "Invalid server key")
+	}
+
+	authResponse, _, after := g.a.authenticate(authReq, eventType, hookName, grpcClientIP(ctx), grpcUserAgent(ctx), retrieveUserID)
+	if after != nil {
+		// The response is only sent once the call returns, so the hook can't wait for it.
+		after()
+	}
+	return authResponse, nil
+}
+
+func (g *grpcService) Call(ctx context.Context, envelope *Envelope) (*Envelope, error) {
+	if g.a.draining.Load() {
+		return nil, grpc.Errorf(codes.Unavailable, "Server is shutting down")
+	}
+
+	scheme, token := grpcAuthorization(ctx)
+	if scheme != "bearer" {
+		return nil, grpc.Errorf(codes.Unauthenticated, "Missing or invalid token")
+	}
+	uid, handle, exp, refreshID, auth := g.a.authenticateToken(token)
+	if !auth {
+		return nil, grpc.Errorf(codes.Unauthenticated, "Missing or invalid token")
+	}
+	if message, code := g.a.checkSessionUser(uid); message != "" {
+		switch code {
+		case RUNTIME_EXCEPTION:
+			return nil, grpc.Errorf(codes.Internal, message)
+		case USER_BANNED:
+			return nil, grpc.Errorf(codes.PermissionDenied, message)
+		default:
+			return nil, grpc.Errorf(codes.Unauthenticated, message)
+		}
+	}
+
+	session := newCallSession(g.a.logger, g.a.config, uid, handle, exp, refreshID, grpcClientIP(ctx), grpcUserAgent(ctx))
+	return g.a.pipeline.call(session.logger.With(zap.String("cid", envelope.CollationId)), session, envelope), nil
+}
+
+// grpcAuthorization returns the lower cased scheme and the credentials from the call's authorization metadata.
+func grpcAuthorization(ctx context.Context) (string, string) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["authorization"]) == 0 {
+		return "", ""
+	}
+	parts := strings.SplitN(md["authorization"][0], " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// grpcClientIP returns the address of the caller. PROXY protocol headers are already applied by the listener.
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return ip
+}
+
+func grpcUserAgent(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["user-agent"]) == 0 {
+		return ""
+	}
+	return md["user-agent"][0]
+}
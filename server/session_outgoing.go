@@ -0,0 +1,279 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// What a session does with a message when its outgoing queue is full.
+const (
+	// Drop the oldest queued message of the same kind, match data or not, to make room. If none is queued the new
+	// message is dropped.
+	sessionQueuePolicyDropOldest = "drop_oldest"
+	// Drop everything queued and close the session.
+	sessionQueuePolicyDisconnect = "disconnect"
+)
+
+// Field numbers of Envelope.batch and EnvelopeBatch.envelopes in api.proto, used to batch already encoded envelopes.
+const (
+	envelopeBatchField          = 173
+	envelopeBatchEnvelopesField = 1
+)
+
+var errSessionQueueFull = errors.New("session outgoing queue full")
+
+type sessionOutgoing struct {
+	payload   []byte
+	matchData bool
+}
+
+// sessionQueueStats counts, across all sessions, messages dropped and sessions closed because their outgoing queue
+// was full.
+type sessionQueueStats struct {
+	dropped     *atomic.Int64
+	disconnects *atomic.Int64
+}
+
+func newSessionQueueStats() *sessionQueueStats {
+	return &sessionQueueStats{
+		dropped:     atomic.NewInt64(0),
+		disconnects: atomic.NewInt64(0),
+	}
+}
+
+// sendBytes queues the payload to be written to the socket, applying the configured policy if the queue is full.
+func (s *session) sendBytes(payload []byte, matchData bool) error {
+	config := s.config.GetSocket()
+
+	s.Lock()
+	if s.stopped {
+		// Messages for a session waiting to be resumed are kept, those for a resumed session go to its successor.
+		successor := s.resumedBy
+		if successor == nil && s.detached {
+			for len(s.outgoing) > 0 && len(s.outgoing) >= config.ResumeBufferSize {
+				s.queueStats.dropped.Inc()
+				s.outgoing[0] = nil
+				s.outgoing = s.outgoing[1:]
+			}
+			s.outgoing = append(s.outgoing, &sessionOutgoing{payload: payload, matchData: matchData})
+		}
+		s.Unlock()
+		if successor != nil {
+			return successor.sendBytes(payload, matchData)
+		}
+		return nil
+	}
+
+	if len(s.outgoing) >= config.OutgoingQueueSize {
+		policy := config.OutgoingQueuePolicy
+		if matchData {
+			policy = config.OutgoingQueueMatchDataPolicy
+		}
+
+		if policy == sessionQueuePolicyDisconnect {
+			// The client is too far behind for anything queued to still be useful.
+			s.outgoing = nil
+			s.stopLocked(websocket.FormatCloseMessage(sessionCloseSlow, "Client is not reading messages fast enough"))
+			s.Unlock()
+			s.queueStats.disconnects.Inc()
+			s.logger.Warn("Closing session with full outgoing queue", zap.Int("size", config.OutgoingQueueSize))
+			go s.unregister(s, false)
+			return errSessionQueueFull
+		}
+
+		s.queueStats.dropped.Inc()
+		dropped := false
+		for i, queued := range s.outgoing {
+			if queued.matchData == matchData {
+				copy(s.outgoing[i:], s.outgoing[i+1:])
+				s.outgoing[len(s.outgoing)-1] = nil
+				s.outgoing = s.outgoing[:len(s.outgoing)-1]
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			s.Unlock()
+			return nil
+		}
+	}
+
+	s.outgoing = append(s.outgoing, &sessionOutgoing{payload: payload, matchData: matchData})
+	s.Unlock()
+
+	select {
+	case s.outgoingCh <- struct{}{}:
+	default:
+		// The writer is already due to look at the queue.
+	}
+	return nil
+}
+
+// queueDepth returns the number of messages waiting to be written.
+func (s *session) queueDepth() int {
+	s.Lock()
+	depth := len(s.outgoing)
+	s.Unlock()
+	return depth
+}
+
+// processOutgoing writes queued messages to the socket until the session stops. A session closed by the server has
+// its remaining messages written before the connection is closed.
+func (s *session) processOutgoing() {
+	defer close(s.outgoingDone)
+	for {
+		select {
+		case <-s.outgoingCh:
+			s.holdForBatch()
+			if !s.writeOutgoing() {
+				s.cleanupClosedConnection(true)
+				return
+			}
+		case <-s.pingTickerStopCh:
+			s.Lock()
+			graceful := s.closeGraceful
+			s.Unlock()
+			if graceful {
+				s.writeOutgoing()
+				s.closeNow()
+			}
+			return
+		}
+	}
+}
+
+// holdForBatch waits out the batch window, so messages sent shortly after the one that woke the writer go out in the
+// same frame. Match data and sessions being closed are not held up.
+func (s *session) holdForBatch() {
+	window := s.config.GetSocket().BatchWindowMs
+	if !s.batch || window <= 0 {
+		return
+	}
+
+	s.Lock()
+	hold := !s.stopped
+	for _, message := range s.outgoing {
+		if message.matchData {
+			hold = false
+			break
+		}
+	}
+	s.Unlock()
+	if !hold {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(window) * time.Millisecond)
+	select {
+	case <-timer.C:
+	case <-s.pingTickerStopCh:
+		timer.Stop()
+	}
+}
+
+// writeOutgoing writes messages until the queue is empty, returning false if a write fails.
+func (s *session) writeOutgoing() bool {
+	config := s.config.GetSocket()
+	messageType := websocket.BinaryMessage
+	if s.format == sessionFormatJSON {
+		messageType = websocket.TextMessage
+	}
+
+	for {
+		messages := s.takeOutgoing(config)
+		if len(messages) == 0 {
+			return true
+		}
+		payload := messages[0].payload
+		matchData := messages[0].matchData
+		if len(messages) > 1 {
+			payload = batchEnvelopes(s.format, messages)
+			for _, message := range messages {
+				matchData = matchData && message.matchData
+			}
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WriteWaitMs) * time.Millisecond))
+		// Match data is latency sensitive and usually small, so it is not worth the time to compress.
+		s.conn.EnableWriteCompression(!matchData && len(payload) >= config.CompressionMinBytes)
+		if err := s.conn.WriteMessage(messageType, payload); err != nil {
+			s.logger.Warn("Could not write message", zap.Error(err))
+			// Keep the messages in case the session is resumed.
+			s.Lock()
+			s.outgoing = append(messages, s.outgoing...)
+			s.Unlock()
+			return false
+		}
+	}
+}
+
+// takeOutgoing removes the next message from the queue, or as many as fit in a batch if the client takes batches.
+func (s *session) takeOutgoing(config *SocketConfig) []*sessionOutgoing {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.outgoing) == 0 {
+		return nil
+	}
+	count := 1
+	if s.batch && config.BatchWindowMs > 0 {
+		size := len(s.outgoing[0].payload)
+		for count < len(s.outgoing) && size+len(s.outgoing[count].payload) <= config.BatchMaxBytes {
+			size += len(s.outgoing[count].payload)
+			count++
+		}
+	}
+
+	messages := make([]*sessionOutgoing, count)
+	copy(messages, s.outgoing)
+	for i := 0; i < count; i++ {
+		s.outgoing[i] = nil
+	}
+	s.outgoing = s.outgoing[count:]
+	return messages
+}
+
+// batchEnvelopes wraps encoded envelopes in one batch envelope, without decoding them again.
+func batchEnvelopes(format string, messages []*sessionOutgoing) []byte {
+	if format == sessionFormatJSON {
+		buf := bytes.NewBufferString(`{"batch":{"envelopes":[`)
+		for i, message := range messages {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(message.payload)
+		}
+		buf.WriteString("]}}")
+		return buf.Bytes()
+	}
+
+	batch := make([]byte, 0)
+	for _, message := range messages {
+		batch = append(batch, proto.EncodeVarint(envelopeBatchEnvelopesField<<3|proto.WireBytes)...)
+		batch = append(batch, proto.EncodeVarint(uint64(len(message.payload)))...)
+		batch = append(batch, message.payload...)
+	}
+	payload := proto.EncodeVarint(envelopeBatchField<<3 | proto.WireBytes)
+	payload = append(payload, proto.EncodeVarint(uint64(len(batch)))...)
+	return append(payload, batch...)
+}
@@ -15,10 +15,13 @@
 package server
 
 import (
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/satori/go.uuid"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -30,32 +33,123 @@ type SessionRegistry struct {
 	tracker    Tracker
 	matchmaker Matchmaker
 	sessions   map[uuid.UUID]*session
+	resumable  map[string]*session
+	queueStats *sessionQueueStats
+	reaped     *atomic.Int64
+	stopCh     chan struct{}
 }
 
 // NewSessionRegistry creates a new SessionRegistry
 func NewSessionRegistry(logger *zap.Logger, config Config, tracker Tracker, matchmaker Matchmaker) *SessionRegistry {
-	return &SessionRegistry{
+	a := &SessionRegistry{
 		logger:     logger,
 		config:     config,
 		tracker:    tracker,
 		matchmaker: matchmaker,
 		sessions:   make(map[uuid.UUID]*session),
+		resumable:  make(map[string]*session),
+		queueStats: newSessionQueueStats(),
+		reaped:     atomic.NewInt64(0),
+		stopCh:     make(chan struct{}),
 	}
+
+	go a.reapPeriodically()
+
+	return a
+}
+
+// reapPeriodically looks for sessions whose client stopped answering pings but whose socket has not failed, and
+// cleans them up as if it had.
+func (a *SessionRegistry) reapPeriodically() {
+	ticker := time.NewTicker(time.Duration(a.config.GetSocket().PingPeriodMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stopCh:
+			return
+		}
+
+		dead := make([]*session, 0)
+		a.RLock()
+		for _, s := range a.sessions {
+			if s.dead() && !s.isStopped() {
+				dead = append(dead, s)
+			}
+		}
+		a.RUnlock()
+
+		for _, s := range dead {
+			s.logger.Info("Reaping session that stopped answering pings", zap.Int32("missed_pongs", s.missedPongs.Load()))
+			a.reaped.Inc()
+			s.cleanupClosedConnection(true)
+		}
+	}
+}
+
+// Reaped returns the number of sessions reaped for not answering pings.
+func (a *SessionRegistry) Reaped() int64 {
+	return a.reaped.Load()
 }
 
+// stop closes all sessions, untracking their presences before it returns. It gives the sessions up to the socket
+// write wait time to write the messages they have queued.
 func (a *SessionRegistry) stop() {
+	close(a.stopCh)
 	a.Lock()
+	sessions := make([]*session, 0, len(a.sessions))
+	for id, session := range a.sessions {
+		delete(a.sessions, id)
+		sessions = append(sessions, session)
+		session.closeWithReason(websocket.CloseGoingAway, "Server shutting down")
+	}
+	a.resumable = make(map[string]*session)
+	a.Unlock()
+
+	for _, session := range sessions {
+		a.matchmaker.RemoveAll(session.id) // Drop all active matchmaking requests for this session.
+		a.tracker.UntrackAll(session.id)   // Drop all tracked presences for this session.
+	}
+
+	deadline := time.After(time.Duration(a.config.GetSocket().WriteWaitMs) * time.Millisecond)
+	for _, session := range sessions {
+		select {
+		case <-session.outgoingDone:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// notifyShutdown tells every session the server is shutting down, with a reconnect hint spread at random over the
+// configured window after the drain period.
+func (a *SessionRegistry) notifyShutdown() {
+	config := a.config.GetSocket()
+	a.RLock()
+	sessions := make([]*session, 0, len(a.sessions))
 	for _, session := range a.sessions {
-		if a.sessions[session.id] != nil {
-			delete(a.sessions, session.id)
-			go func() {
-				a.matchmaker.RemoveAll(session.id) // Drop all active matchmaking requests for this session.
-				a.tracker.UntrackAll(session.id)   // Drop all tracked presences for this session.
-			}()
+		sessions = append(sessions, session)
+	}
+	a.RUnlock()
+
+	for _, session := range sessions {
+		reconnectAfter := int64(config.ShutdownDrainMs)
+		if config.ShutdownReconnectSpreadMs > 0 {
+			reconnectAfter += rand.Int63n(int64(config.ShutdownReconnectSpreadMs))
 		}
-		session.close()
+		session.Send(&Envelope{Payload: &Envelope_ServerShutdown{ServerShutdown: &ServerShutdown{
+			DrainMs:          int64(config.ShutdownDrainMs),
+			ReconnectAfterMs: reconnectAfter,
+		}}})
 	}
-	a.Unlock()
+}
+
+// count returns the number of sessions connected to this node.
+func (a *SessionRegistry) count() int {
+	a.RLock()
+	count := len(a.sessions)
+	a.RUnlock()
+	return count
 }
 
 // Get returns a session matching the sessionID
@@ -67,12 +161,84 @@ func (a *SessionRegistry) Get(sessionID uuid.UUID) *session {
 	return s
 }
 
-func (a *SessionRegistry) add(userID uuid.UUID, handle string, lang string, expiry int64, conn *websocket.Conn, processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
-	s := NewSession(a.logger, a.config, userID, handle, lang, expiry, conn, a.remove)
+// QueueStats returns the number of messages waiting to be written across all sessions and the most any one session
+// has waiting, along with how many messages were dropped and sessions closed because their outgoing queue was full.
+func (a *SessionRegistry) QueueStats() (int, int, int64, int64) {
+	queued, maxDepth := 0, 0
+	a.RLock()
+	for _, s := range a.sessions {
+		depth := s.queueDepth()
+		queued += depth
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	a.RUnlock()
+	return queued, maxDepth, a.queueStats.dropped.Load(), a.queueStats.disconnects.Load()
+}
+
+// getLocal returns the sessions on this node for the given presences, taking the registry lock once.
+// Presences with no matching session are returned separately.
+func (a *SessionRegistry) getLocal(ps []Presence) ([]*session, []Presence) {
+	sessions := make([]*session, 0, len(ps))
+	var missing []Presence
+	a.RLock()
+	for _, p := range ps {
+		if s := a.sessions[p.ID.SessionID]; s != nil {
+			sessions = append(sessions, s)
+		} else {
+			missing = append(missing, p)
+		}
+	}
+	a.RUnlock()
+	return sessions, missing
+}
+
+func (a *SessionRegistry) add(userID uuid.UUID, handle string, lang string, expiry int64, refreshID string, clientIP string, userAgent string, format string, batch bool, resumeToken string, conn *websocket.Conn, processRequest func(logger *zap.Logger, session *session, envelope *Envelope)) {
+	config := a.config.GetSocket()
+	var s *session
 	a.Lock()
+	if previous := a.resumable[resumeToken]; resumeToken != "" && previous != nil && previous.userID == userID && previous.format == format {
+		delete(a.resumable, resumeToken)
+		s = NewSession(a.logger, a.config, previous.id, userID, handle, lang, expiry, refreshID, clientIP, userAgent, format, batch, conn, a.unregister, a.queueStats)
+		s.matchData = previous.matchData
+		s.Send(&Envelope{Payload: &Envelope_SessionResumable{SessionResumable: &SessionResumable{
+			Token:    s.resumeToken,
+			WindowMs: int64(config.ResumeWindowMs),
+			Resumed:  true,
+		}}})
+
+		// Hand over the messages held for the client. Anything sent to the previous session from now on is passed on.
+		previous.Lock()
+		previous.resumedBy = s
+		s.Lock()
+		s.outgoing = append(s.outgoing, previous.outgoing...)
+		s.Unlock()
+		previous.outgoing = nil
+		previous.Unlock()
+
+		s.logger.Info("Session resumed", zap.Int("held", len(s.outgoing)-1))
+	} else {
+		s = NewSession(a.logger, a.config, uuid.NewV4(), userID, handle, lang, expiry, refreshID, clientIP, userAgent, format, batch, conn, a.unregister, a.queueStats)
+		if config.ResumeWindowMs > 0 {
+			s.Send(&Envelope{Payload: &Envelope_SessionResumable{SessionResumable: &SessionResumable{
+				Token:    s.resumeToken,
+				WindowMs: int64(config.ResumeWindowMs),
+			}}})
+		}
+	}
 	a.sessions[s.id] = s
 	a.Unlock()
 
+	// Only the newest socket is kept when users are limited to one.
+	if a.config.GetSession().SingleSocket {
+		for _, other := range a.userSessions(userID) {
+			if other.id != s.id {
+				a.disconnect(other, sessionCloseReplaced, "Session replaced by a new login")
+			}
+		}
+	}
+
 	// Register the session for notifications.
 	a.tracker.Track(s.id, "notifications", s.userID, PresenceMeta{Handle: handle})
 
@@ -80,9 +246,65 @@ func (a *SessionRegistry) add(userID uuid.UUID, handle string, lang string, expi
 	s.Consume(processRequest)
 }
 
+// userSessions returns the sessions of the user on this node.
+func (a *SessionRegistry) userSessions(userID uuid.UUID) []*session {
+	sessions := make([]*session, 0, 1)
+	a.RLock()
+	for _, s := range a.sessions {
+		if s.userID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	a.RUnlock()
+	return sessions
+}
+
+// disconnect removes the session and closes its socket, sending the reason to the client.
+func (a *SessionRegistry) disconnect(s *session, code int, reason string) {
+	a.remove(s)
+	s.closeWithReason(code, reason)
+}
+
+// disconnectUser closes all sessions of the user on this node, sending the reason to the client.
+func (a *SessionRegistry) disconnectUser(userID uuid.UUID, code int, reason string) {
+	for _, s := range a.userSessions(userID) {
+		a.disconnect(s, code, reason)
+	}
+}
+
+// unregister is called by a session whose connection closed. A resumable session is kept, with its presences, until
+// it is resumed or the resume window passes.
+func (a *SessionRegistry) unregister(s *session, resumable bool) {
+	if !resumable {
+		a.remove(s)
+		return
+	}
+
+	a.Lock()
+	if a.sessions[s.id] != s {
+		a.Unlock()
+		return
+	}
+	a.resumable[s.resumeToken] = s
+	a.Unlock()
+
+	time.AfterFunc(time.Duration(a.config.GetSocket().ResumeWindowMs)*time.Millisecond, func() {
+		a.Lock()
+		expired := a.resumable[s.resumeToken] == s
+		a.Unlock()
+		if expired {
+			a.remove(s)
+		}
+	})
+}
+
 func (a *SessionRegistry) remove(c *session) {
 	a.Lock()
-	if a.sessions[c.id] != nil {
+	if a.resumable[c.resumeToken] == c {
+		delete(a.resumable, c.resumeToken)
+	}
+	// A resumed session replaces the one it resumed under the same ID.
+	if a.sessions[c.id] == c {
 		delete(a.sessions, c.id)
 		go func() {
 			a.matchmaker.RemoveAll(c.id) // Drop all active matchmaking requests for this session.
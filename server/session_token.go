@@ -0,0 +1,117 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/satori/go.uuid"
+)
+
+// sessionTokenCreate signs a short-lived access token. The refresh ID names the refresh token issued alongside it, so
+// logging out of the session can revoke it. Returns the token and its expiry in seconds.
+func sessionTokenCreate(hmacSecretByte []byte, userID uuid.UUID, handle string, refreshID string, expiryMs int64) (string, int64) {
+	exp := time.Now().UTC().Add(time.Duration(expiryMs) * time.Millisecond).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"uid": userID.String(),
+		"exp": exp,
+		"han": handle,
+		"rid": refreshID,
+	})
+	signedToken, _ := token.SignedString(hmacSecretByte)
+	return signedToken, exp
+}
+
+// sessionTokenParse checks an access token, returning the user ID, handle, expiry and refresh ID in it.
+func sessionTokenParse(hmacSecretByte []byte, tokenString string) (uuid.UUID, string, int64, string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return hmacSecretByte, nil
+	})
+	if err != nil {
+		return uuid.Nil, "", 0, "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return uuid.Nil, "", 0, "", errors.New("Invalid token")
+	}
+	uidString, _ := claims["uid"].(string)
+	uid, err := uuid.FromString(uidString)
+	if err != nil {
+		return uuid.Nil, "", 0, "", err
+	}
+	handle, _ := claims["han"].(string)
+	exp, _ := claims["exp"].(float64)
+	// Tokens issued before refresh tokens existed have no refresh ID.
+	refreshID, _ := claims["rid"].(string)
+	return uid, handle, int64(exp), refreshID, nil
+}
+
+// refreshTokenCreate stores a new refresh token for the user, returning its ID and the token to send.
+func refreshTokenCreate(db *sql.DB, userID []byte, expiryMs int64) (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	id := uuid.NewV4()
+	ts := nowMs()
+	_, err = db.Exec(`
+INSERT INTO user_refresh_token (id, token_hash, user_id, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5)`, id.Bytes(), tokenHash(token), userID, ts, ts+expiryMs)
+	if err != nil {
+		return "", "", err
+	}
+	return id.String(), token, nil
+}
+
+// refreshTokenUse removes the refresh token, returning the user it was issued to if it was still valid. Each refresh
+// token can only be used once, the caller issues a new one in its place.
+func refreshTokenUse(db *sql.DB, token string) ([]byte, error) {
+	var userID []byte
+	var expiresAt int64
+	err := db.QueryRow("DELETE FROM user_refresh_token WHERE token_hash = $1 RETURNING user_id, expires_at", tokenHash(token)).
+		Scan(&userID, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt <= nowMs() {
+		return nil, sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+// RefreshTokenRevoke removes a refresh token of the user, so the session it was issued to cannot be refreshed.
+func RefreshTokenRevoke(db *sql.DB, userID uuid.UUID, refreshID string) error {
+	id, err := uuid.FromString(refreshID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM user_refresh_token WHERE id = $1 AND user_id = $2", id.Bytes(), userID.Bytes())
+	return err
+}
+
+// RefreshTokensRevoke removes all refresh tokens of the user, so none of their sessions can be refreshed.
+func RefreshTokensRevoke(db *sql.DB, userID uuid.UUID) error {
+	_, err := db.Exec("DELETE FROM user_refresh_token WHERE user_id = $1", userID.Bytes())
+	return err
+}
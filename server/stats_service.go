@@ -33,16 +33,28 @@ type statsService struct {
 	config    Config
 	tracker   Tracker
 	startedAt int64
+	authLimit *AuthRateLimiter
+	cache     *RuntimeCache
+	limits    *RuntimeLimits
+	registry  *SessionRegistry
+	datagram  *DatagramServer
+	msgLimit  *MessageRateLimiter
 }
 
 // NewStatsService creates a new StatsService
-func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, startedAt int64) StatsService {
+func NewStatsService(logger *zap.Logger, config Config, version string, tracker Tracker, startedAt int64, authLimit *AuthRateLimiter, cache *RuntimeCache, limits *RuntimeLimits, registry *SessionRegistry, datagram *DatagramServer, msgLimit *MessageRateLimiter) StatsService {
 	return &statsService{
 		logger:    logger,
 		version:   version,
 		config:    config,
 		tracker:   tracker,
 		startedAt: startedAt,
+		authLimit: authLimit,
+		cache:     cache,
+		limits:    limits,
+		registry:  registry,
+		datagram:  datagram,
+		msgLimit:  msgLimit,
 	}
 }
 
@@ -59,9 +71,36 @@ func (s *statsService) GetStats() []map[string]interface{} {
 	data["started_at"] = s.startedAt
 	data["health_status"] = s.GetHealthStatus()
 	data["version"] = s.version
-	data["address"] = s.getLocalIP()
+	data["address"] = localIP(s.logger)
 	data["process_count"] = runtime.NumGoroutine()
 	data["presence_count"] = s.getPresenceCount()
+	authLockouts, authRateLimited := s.authLimit.Stats()
+	data["auth_lockout_count"] = authLockouts
+	data["auth_rate_limited_count"] = authRateLimited
+	cacheSize, cacheHits, cacheMisses, cacheEvictions := s.cache.Stats()
+	data["runtime_cache_size"] = cacheSize
+	data["runtime_cache_hit_count"] = cacheHits
+	data["runtime_cache_miss_count"] = cacheMisses
+	data["runtime_cache_eviction_count"] = cacheEvictions
+	if lookups := cacheHits + cacheMisses; lookups > 0 {
+		data["runtime_cache_hit_rate"] = float64(cacheHits) / float64(lookups)
+	} else {
+		data["runtime_cache_hit_rate"] = 0.0
+	}
+	timeAborts, instructionAborts, libraryAborts := s.limits.Stats()
+	data["runtime_time_limit_abort_count"] = timeAborts
+	data["runtime_instruction_limit_abort_count"] = instructionAborts
+	data["runtime_library_bytes_limit_abort_count"] = libraryAborts
+	queued, maxDepth, dropped, disconnects := s.registry.QueueStats()
+	data["socket_outgoing_queued"] = queued
+	data["socket_outgoing_queue_max_depth"] = maxDepth
+	data["socket_outgoing_dropped_count"] = dropped
+	data["socket_outgoing_disconnect_count"] = disconnects
+	data["socket_reaped_count"] = s.registry.Reaped()
+	data["datagram_reaped_count"] = s.datagram.Reaped()
+	messageRateLimited, messageRateLimitedByType := s.msgLimit.Stats()
+	data["message_rate_limited_count"] = messageRateLimited
+	data["message_rate_limited_by_type"] = messageRateLimitedByType
 
 	stats := make([]map[string]interface{}, 1)
 	stats[0] = data
@@ -69,11 +108,11 @@ func (s *statsService) GetStats() []map[string]interface{} {
 	return stats
 }
 
-// GetLocalIP returns the non loopback local IP of the host
-func (s *statsService) getLocalIP() string {
+// localIP returns the non loopback local IP of the host
+func localIP(logger *zap.Logger) string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		s.logger.Error("Could not get interface addresses", zap.Error(err))
+		logger.Error("Could not get interface addresses", zap.Error(err))
 		return "127.0.0.1"
 	}
 	for _, address := range addrs {
@@ -85,7 +124,7 @@ func (s *statsService) getLocalIP() string {
 		}
 	}
 
-	s.logger.Warn("No non-loopback address was found")
+	logger.Warn("No non-loopback address was found")
 	return "127.0.0.1"
 }
 
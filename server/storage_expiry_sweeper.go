@@ -0,0 +1,137 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StorageExpirySweeper periodically removes storage records whose expiry time has passed. Until they are swept,
+// expired records are already treated as not found by storage operations. It also discards expired uploads.
+type StorageExpirySweeper struct {
+	logger         *zap.Logger
+	db             *sql.DB
+	batchSize      int
+	uploadExpiryMs int64
+	ticker         *time.Ticker
+	stopCh         chan bool
+}
+
+// NewStorageExpirySweeper creates a new StorageExpirySweeper and starts it.
+func NewStorageExpirySweeper(logger *zap.Logger, db *sql.DB, config *StorageConfig) *StorageExpirySweeper {
+	s := &StorageExpirySweeper{
+		logger:         logger,
+		db:             db,
+		batchSize:      config.ExpirySweepBatchSize,
+		uploadExpiryMs: config.UploadExpiryMs,
+		ticker:         time.NewTicker(time.Duration(config.ExpirySweepIntervalMs) * time.Millisecond),
+		stopCh:         make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.sweep()
+				s.sweepUploads()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *StorageExpirySweeper) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+// sweep removes expired records in batches, until a batch comes up short or the sweeper is stopped.
+func (s *StorageExpirySweeper) sweep() {
+	ts := nowMs()
+	total := int64(0)
+	for {
+		count, err := s.sweepBatch(ts)
+		if err != nil {
+			s.logger.Error("Could not remove expired storage records", zap.Error(err))
+			return
+		}
+		total += count
+		if count < int64(s.batchSize) {
+			break
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+	}
+
+	if total != 0 {
+		s.logger.Debug("Removed expired storage records", zap.Int64("count", total))
+	}
+}
+
+// sweepBatch removes a batch of expired records, updating their owners' storage usage.
+func (s *StorageExpirySweeper) sweepBatch(ts int64) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+UPDATE storage SET deleted_at = $1, updated_at = $1
+WHERE (bucket, collection, user_id, record, deleted_at) IN (
+  SELECT bucket, collection, user_id, record, deleted_at FROM storage@deleted_at_expires_at_idx
+  WHERE deleted_at = 0 AND expires_at > 0 AND expires_at <= $1
+  LIMIT $2
+)
+RETURNING user_id, length(value)`, ts, s.batchSize)
+	if err != nil {
+		s.rollback(tx)
+		return 0, err
+	}
+	count, err := storageUsageRemove(tx, rows)
+	if err != nil {
+		s.rollback(tx)
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
+
+func (s *StorageExpirySweeper) rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil {
+		s.logger.Error("Could not remove expired storage records, rollback error", zap.Error(err))
+	}
+}
+
+// sweepUploads discards uploads that were not committed in time.
+func (s *StorageExpirySweeper) sweepUploads() {
+	res, err := s.db.Exec("DELETE FROM storage_upload WHERE created_at <= $1", nowMs()-s.uploadExpiryMs)
+	if err != nil {
+		s.logger.Error("Could not remove expired storage uploads", zap.Error(err))
+		return
+	}
+	if count, _ := res.RowsAffected(); count != 0 {
+		s.logger.Debug("Removed expired storage uploads", zap.Int64("count", count))
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// StorageChange describes a record that was written or removed.
+type StorageChange struct {
+	Bucket         string
+	Collection     string
+	Record         string
+	UserId         []byte
+	Version        []byte
+	PermissionRead int64
+	Removed        bool
+}
+
+// StorageFeed delivers changes of stored records to the sessions subscribed to them, either to single records or to
+// whole collections. Subscriptions are presences in "storage:" tracker topics, so they end with the session.
+//
+// Changes only carry the record key and version, clients fetch the value with the usual read checks. Collection
+// subscribers only receive changes of public records and their own records, record subscribers were checked for read
+// access when they subscribed.
+type StorageFeed struct {
+	logger        *zap.Logger
+	tracker       Tracker
+	messageRouter MessageRouter
+}
+
+// NewStorageFeed creates a new StorageFeed.
+func NewStorageFeed(logger *zap.Logger, tracker Tracker, messageRouter MessageRouter) *StorageFeed {
+	return &StorageFeed{
+		logger:        logger,
+		tracker:       tracker,
+		messageRouter: messageRouter,
+	}
+}
+
+func storageFeedTopic(bucket string, collection string, userID []byte, record string) string {
+	if record == "" {
+		return fmt.Sprintf("storage:%q:%q", bucket, collection)
+	}
+	return fmt.Sprintf("storage:%q:%q:%x:%q", bucket, collection, userID, record)
+}
+
+// Subscribe the session to changes of a record, or of the whole collection if the record is empty.
+func (f *StorageFeed) Subscribe(sessionID uuid.UUID, userID uuid.UUID, handle string, bucket string, collection string, owner []byte, record string) {
+	f.tracker.Track(sessionID, storageFeedTopic(bucket, collection, owner, record), userID, PresenceMeta{Handle: handle})
+}
+
+// Unsubscribe the session from changes of a record, or of the whole collection if the record is empty.
+func (f *StorageFeed) Unsubscribe(sessionID uuid.UUID, userID uuid.UUID, bucket string, collection string, owner []byte, record string) {
+	f.tracker.Untrack(sessionID, storageFeedTopic(bucket, collection, owner, record), userID)
+}
+
+// Publish changes to their subscribers. Does nothing if there is no feed, as when the runtime is used alone.
+func (f *StorageFeed) Publish(changes []*StorageChange) {
+	if f == nil {
+		return
+	}
+
+	for _, c := range changes {
+		sessions := make(map[uuid.UUID]bool)
+		to := make([]Presence, 0)
+		for _, p := range f.tracker.ListByTopic(storageFeedTopic(c.Bucket, c.Collection, c.UserId, c.Record)) {
+			if !sessions[p.ID.SessionID] {
+				sessions[p.ID.SessionID] = true
+				to = append(to, p)
+			}
+		}
+		for _, p := range f.tracker.ListByTopic(storageFeedTopic(c.Bucket, c.Collection, nil, "")) {
+			if sessions[p.ID.SessionID] || (c.PermissionRead != 2 && !bytes.Equal(p.UserID.Bytes(), c.UserId)) {
+				continue
+			}
+			sessions[p.ID.SessionID] = true
+			to = append(to, p)
+		}
+		if len(to) == 0 {
+			continue
+		}
+
+		change := &StorageChanges_Change{
+			Bucket:     c.Bucket,
+			Collection: c.Collection,
+			Record:     c.Record,
+			UserId:     c.UserId,
+			Version:    c.Version,
+			Removed:    c.Removed,
+		}
+		f.messageRouter.Send(f.logger, to, &Envelope{Payload: &Envelope_StorageChanges{StorageChanges: &StorageChanges{Changes: []*StorageChanges_Change{change}}}})
+	}
+}
+
+// storageWriteChanges describes writes made by the caller. The read permission of records shared with the caller is
+// not known, so only owners and record subscribers are sent those changes.
+func storageWriteChanges(caller uuid.UUID, data []*StorageData, keys []*StorageKey) []*StorageChange {
+	changes := make([]*StorageChange, len(keys))
+	for i, k := range keys {
+		read := data[i].PermissionRead
+		if caller != uuid.Nil && !bytes.Equal(data[i].UserId, caller.Bytes()) {
+			read = 1
+		}
+		changes[i] = &StorageChange{Bucket: k.Bucket, Collection: k.Collection, Record: k.Record, UserId: k.UserId, Version: k.Version, PermissionRead: read}
+	}
+	return changes
+}
+
+// storageUpdateChanges describes updates made by the caller.
+func storageUpdateChanges(updates []*StorageKeyUpdate, keys []*StorageKey) []*StorageChange {
+	changes := make([]*StorageChange, len(keys))
+	for i, k := range keys {
+		changes[i] = &StorageChange{Bucket: k.Bucket, Collection: k.Collection, Record: k.Record, UserId: k.UserId, Version: k.Version, PermissionRead: updates[i].PermissionRead}
+	}
+	return changes
+}
+
+// storageIncrementChanges describes a counter increment made by the caller.
+func storageIncrementChanges(caller uuid.UUID, data *StorageData) []*StorageChange {
+	key := &StorageKey{Bucket: data.Bucket, Collection: data.Collection, Record: data.Record, UserId: data.UserId, Version: data.Version}
+	return storageWriteChanges(caller, []*StorageData{data}, []*StorageKey{key})
+}
+
+// storageRemoveChanges describes removed records. Their read permission is not known, so only owners and record
+// subscribers are sent these changes.
+func storageRemoveChanges(keys []*StorageKey) []*StorageChange {
+	changes := make([]*StorageChange, len(keys))
+	for i, k := range keys {
+		changes[i] = &StorageChange{Bucket: k.Bucket, Collection: k.Collection, Record: k.Record, UserId: k.UserId, PermissionRead: 1, Removed: true}
+	}
+	return changes
+}
@@ -0,0 +1,342 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Span kinds as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type tracerContextKey struct{}
+
+// Tracer records spans of work done for a request and exports them in batches to an OpenTelemetry collector, over
+// OTLP/HTTP with JSON encoding. Spans are passed down through contexts. A trace is started for a sampled fraction of
+// received messages, and work done with a context from one becomes part of that trace.
+type Tracer struct {
+	logger  *zap.Logger
+	config  *TracingConfig
+	node    string
+	client  *http.Client
+	queue   chan *Span
+	dropped *atomic.Int64
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	once    sync.Once
+}
+
+// Span is one timed piece of work in a trace. Methods on a nil span do nothing, so work that is not traced does not
+// need to check.
+type Span struct {
+	sync.Mutex
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+// NewTracer creates a new Tracer. Nothing is traced if no endpoint is configured.
+func NewTracer(logger *zap.Logger, config *TracingConfig, node string) *Tracer {
+	return &Tracer{
+		logger:  logger,
+		config:  config,
+		node:    node,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *Span, config.QueueSize),
+		dropped: atomic.NewInt64(0),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+// Enabled reports whether requests are traced.
+func (t *Tracer) Enabled() bool {
+	return t.config.Endpoint != ""
+}
+
+// Start begins exporting finished spans. It does nothing if tracing is off.
+func (t *Tracer) Start() {
+	if !t.Enabled() {
+		return
+	}
+	go t.exportPeriodically()
+}
+
+// Stop exports spans already finished and stops exporting.
+func (t *Tracer) Stop() {
+	if !t.Enabled() {
+		return
+	}
+	t.once.Do(func() {
+		close(t.stopCh)
+	})
+	<-t.doneCh
+}
+
+// Dropped returns the number of finished spans dropped because the export queue was full.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+// StartTrace starts a span handling a request, in a new trace if the request is sampled. The returned context
+// carries the span, or is the given context unchanged with a nil span if the request is not traced.
+func (t *Tracer) StartTrace(ctx context.Context, name string) (context.Context, *Span) {
+	if parent := SpanFromContext(ctx); parent != nil {
+		return t.start(ctx, parent, name, spanKindServer)
+	}
+	if !t.Enabled() || !t.sampled() {
+		return ctx, nil
+	}
+	return t.start(ctx, nil, name, spanKindServer)
+}
+
+// StartSpan starts a span as part of the trace the context carries. Nothing is traced if it carries none.
+func (t *Tracer) StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return t.start(ctx, parent, name, spanKindInternal)
+}
+
+// startClientSpan is StartSpan for calls out to other services, such as the database.
+func (t *Tracer) startClientSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return t.start(ctx, parent, name, spanKindClient)
+}
+
+func (t *Tracer) start(ctx context.Context, parent *Span, name string, kind int) (context.Context, *Span) {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, tracerContextKey{}, span), span
+}
+
+func (t *Tracer) sampled() bool {
+	if t.config.SampleRate >= 1 {
+		return true
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.config.SampleRate
+}
+
+// SpanFromContext returns the span the context carries, or nil if none.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(tracerContextKey{}).(*Span)
+	return span
+}
+
+// SetAttribute records a string, bool, integer or float value describing the work.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.Unlock()
+}
+
+// SetError marks the work as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	s.err = err
+	s.Unlock()
+}
+
+// End finishes the span and queues it for export. Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+		s.tracer.dropped.Inc()
+	}
+}
+
+func (t *Tracer) exportPeriodically() {
+	defer close(t.doneCh)
+	ticker := time.NewTicker(time.Duration(t.config.ExportIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.config.BatchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < t.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stopCh:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= t.config.BatchSize {
+						t.export(batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	data, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		t.logger.Error("Could not marshal spans", zap.Error(err))
+		return
+	}
+	resp, err := t.client.Post(t.config.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.logger.Warn("Could not export spans", zap.Int("count", len(spans)), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.logger.Warn("Could not export spans", zap.Int("count", len(spans)), zap.Int("status", resp.StatusCode))
+	}
+}
+
+// otlpRequest builds an OTLP ExportTraceServiceRequest in its JSON encoding.
+func (t *Tracer) otlpRequest(spans []*Span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		span.Lock()
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.traceID[:]),
+			"spanId":            hex.EncodeToString(span.spanID[:]),
+			"name":              span.name,
+			"kind":              span.kind,
+			"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.attributes),
+		}
+		if span.parentID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(span.parentID[:])
+		}
+		if span.err != nil {
+			s["status"] = map[string]interface{}{"code": 2, "message": span.err.Error()}
+		}
+		span.Unlock()
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	resource := map[string]interface{}{
+		"service.name":        t.config.ServiceName,
+		"service.instance.id": t.node,
+	}
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]interface{}{"name": "nakama"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	otlp := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprintf("%v", value)}
+		}
+		otlp = append(otlp, map[string]interface{}{"key": key, "value": v})
+	}
+	return otlp
+}
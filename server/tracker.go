@@ -28,6 +28,8 @@ type PresenceID struct {
 
 type PresenceMeta struct {
 	Handle string
+	// Spectator is only set on match presences that receive match data but do not play.
+	Spectator bool
 }
 
 type Presence struct {
@@ -58,6 +60,8 @@ type Tracker interface {
 	ListLocalByTopic(topic string) []Presence
 	// List presences by topic and user ID.
 	ListByTopicUser(topic string, userID uuid.UUID) []Presence
+	// List presences on the current node by session ID.
+	ListLocalBySession(sessionID uuid.UUID) []Presence
 }
 
 type presenceCompact struct {
@@ -172,6 +176,8 @@ func (t *TrackerService) UpdateAll(sessionID uuid.UUID, meta PresenceMeta) {
 	t.Lock()
 	for pc, m := range t.values {
 		if pc.ID.SessionID == sessionID {
+			// Spectating is particular to each match presence, not the session.
+			meta.Spectator = m.Spectator
 			joins = append(joins, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: meta})
 			leaves = append(leaves, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
 		}
@@ -240,6 +246,111 @@ func (t *TrackerService) ListByTopicUser(topic string, userID uuid.UUID) []Prese
 	return ps
 }
 
+func (t *TrackerService) ListLocalBySession(sessionID uuid.UUID) []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc, m := range t.values {
+		if pc.ID.SessionID == sessionID && pc.ID.Node == t.name {
+			ps = append(ps, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	t.RUnlock()
+	return ps
+}
+
+// ListLocal lists every presence on the current node.
+func (t *TrackerService) ListLocal() []Presence {
+	ps := make([]Presence, 0)
+	t.RLock()
+	for pc, m := range t.values {
+		if pc.ID.Node == t.name {
+			ps = append(ps, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	t.RUnlock()
+	return ps
+}
+
+// ApplyRemote applies presence changes replicated from another cluster node.
+// Presences not belonging to that node are ignored.
+func (t *TrackerService) ApplyRemote(node string, joins, leaves []Presence) {
+	if node == t.name {
+		return
+	}
+	applyJoins := make([]Presence, 0, len(joins))
+	applyLeaves := make([]Presence, 0, len(leaves))
+	t.Lock()
+	// Leaves first, an update arrives as a leave and a join of the same presence.
+	for _, p := range leaves {
+		if p.ID.Node != node {
+			continue
+		}
+		pc := presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID}
+		if m, ok := t.values[pc]; ok {
+			delete(t.values, pc)
+			applyLeaves = append(applyLeaves, Presence{ID: p.ID, Topic: p.Topic, UserID: p.UserID, Meta: m})
+		}
+	}
+	for _, p := range joins {
+		if p.ID.Node != node {
+			continue
+		}
+		pc := presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID}
+		if m, ok := t.values[pc]; ok {
+			if m == p.Meta {
+				continue
+			}
+			applyLeaves = append(applyLeaves, Presence{ID: p.ID, Topic: p.Topic, UserID: p.UserID, Meta: m})
+		}
+		t.values[pc] = p.Meta
+		applyJoins = append(applyJoins, p)
+	}
+	if len(applyJoins) != 0 || len(applyLeaves) != 0 {
+		t.notifyDiffListeners(applyJoins, applyLeaves)
+	}
+	t.Unlock()
+}
+
+// SyncRemote replaces every presence held for another cluster node with the given set.
+func (t *TrackerService) SyncRemote(node string, ps []Presence) {
+	if node == t.name {
+		return
+	}
+	incoming := make(map[presenceCompact]PresenceMeta, len(ps))
+	for _, p := range ps {
+		if p.ID.Node == node {
+			incoming[presenceCompact{ID: p.ID, Topic: p.Topic, UserID: p.UserID}] = p.Meta
+		}
+	}
+	joins := make([]Presence, 0)
+	leaves := make([]Presence, 0)
+	t.Lock()
+	for pc, m := range t.values {
+		if pc.ID.Node != node {
+			continue
+		}
+		if im, ok := incoming[pc]; !ok || im != m {
+			delete(t.values, pc)
+			leaves = append(leaves, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	for pc, m := range incoming {
+		if _, ok := t.values[pc]; !ok {
+			t.values[pc] = m
+			joins = append(joins, Presence{ID: pc.ID, Topic: pc.Topic, UserID: pc.UserID, Meta: m})
+		}
+	}
+	if len(joins) != 0 || len(leaves) != 0 {
+		t.notifyDiffListeners(joins, leaves)
+	}
+	t.Unlock()
+}
+
+// UntrackNode removes every presence held for another cluster node, once it has left the cluster.
+func (t *TrackerService) UntrackNode(node string) {
+	t.SyncRemote(node, nil)
+}
+
 func (t *TrackerService) notifyDiffListeners(joins, leaves []Presence) {
 	go func() {
 		for _, f := range t.diffListeners {
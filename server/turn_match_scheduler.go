@@ -0,0 +1,137 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// How often the scheduler looks for turn-based match turns that have expired.
+const turnMatchSchedulerInterval = 10 * time.Second
+
+// TurnMatchScheduler forfeits turn-based matches for users who do not move before their turn expires, and notifies
+// the users in the match.
+type TurnMatchScheduler struct {
+	logger              *zap.Logger
+	db                  *sql.DB
+	notificationService *NotificationService
+	ticker              *time.Ticker
+	stopCh              chan bool
+}
+
+// NewTurnMatchScheduler creates a new TurnMatchScheduler and starts it.
+func NewTurnMatchScheduler(logger *zap.Logger, db *sql.DB, notificationService *NotificationService) *TurnMatchScheduler {
+	s := &TurnMatchScheduler{
+		logger:              logger,
+		db:                  db,
+		notificationService: notificationService,
+		ticker:              time.NewTicker(turnMatchSchedulerInterval),
+		stopCh:              make(chan bool),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.expireTurns()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *TurnMatchScheduler) Stop() {
+	s.ticker.Stop()
+	close(s.stopCh)
+}
+
+func (s *TurnMatchScheduler) expireTurns() {
+	rows, err := s.db.Query("SELECT id FROM turn_match WHERE ended = FALSE AND turn_expires_at > 0 AND turn_expires_at <= $1 LIMIT 100", nowMs())
+	if err != nil {
+		s.logger.Error("Could not find expired turn match turns", zap.Error(err))
+		return
+	}
+	matchIDs := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var matchID []byte
+		if err = rows.Scan(&matchID); err != nil {
+			s.logger.Error("Could not find expired turn match turns, scan error", zap.Error(err))
+			rows.Close()
+			return
+		}
+		matchIDs = append(matchIDs, uuid.FromBytesOrNil(matchID))
+	}
+	rows.Close()
+
+	for _, matchID := range matchIDs {
+		if match := s.expireTurn(matchID); match != nil {
+			turnMatchNotify(s.logger, s.notificationService, match, nil)
+		}
+	}
+}
+
+// expireTurn forfeits the match for the user whose turn expired, and returns the match if it changed.
+func (s *TurnMatchScheduler) expireTurn(matchID uuid.UUID) (match *TurnMatch) {
+	matchLogger := s.logger.With(zap.String("match_id", matchID.String()))
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		matchLogger.Error("Could not expire turn match turn, begin error", zap.Error(err))
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			matchLogger.Warn("Could not expire turn match turn", zap.Error(err))
+			if e := tx.Rollback(); e != nil {
+				matchLogger.Error("Could not expire turn match turn, rollback error", zap.Error(e))
+			}
+			match = nil
+		} else if match == nil {
+			if e := tx.Rollback(); e != nil {
+				matchLogger.Error("Could not expire turn match turn, rollback error", zap.Error(e))
+			}
+		} else {
+			if e := tx.Commit(); e != nil {
+				matchLogger.Error("Could not expire turn match turn, commit error", zap.Error(e))
+				match = nil
+			}
+		}
+	}()
+
+	match, err = turnMatchLoad(tx, matchID)
+	if err != nil {
+		return nil
+	}
+	ts := nowMs()
+	// The user may have moved since the expired turns were found.
+	if match == nil || match.Ended || match.TurnExpiresAt == 0 || match.TurnExpiresAt > ts {
+		return nil
+	}
+
+	userID := match.TurnUserId
+	if _, err = turnMatchForfeit(tx, match, userID, ts); err != nil {
+		return nil
+	}
+
+	matchLogger.Info("Turn expired, forfeited turn match", zap.String("user_id", uuid.FromBytesOrNil(userID).String()))
+	return match
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthRateLimiterAccountLockout(t *testing.T) {
+	config := &server.AuthRateLimitConfig{IPMaxFailures: 0, AccountMaxFailures: 3, WindowMs: 1000, LockoutMs: 5000}
+	limiter := server.NewAuthRateLimiter(logger, config)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, int64(0), limiter.Check("127.0.0.1", "device:abc", 100), "attempt was locked out")
+		limiter.Fail("127.0.0.1", "device:abc", 100)
+	}
+	assert.Equal(t, int64(5000), limiter.Check("10.0.0.1", "device:abc", 100), "account was not locked out")
+	assert.Equal(t, int64(0), limiter.Check("127.0.0.1", "device:other", 100), "other account was locked out")
+	assert.Equal(t, int64(0), limiter.Check("127.0.0.1", "device:abc", 5100), "lockout did not end")
+
+	lockouts, rejected := limiter.Stats()
+	assert.Equal(t, int64(1), lockouts, "lockouts did not match")
+	assert.Equal(t, int64(1), rejected, "rejected did not match")
+}
+
+func TestAuthRateLimiterIPLockout(t *testing.T) {
+	config := &server.AuthRateLimitConfig{IPMaxFailures: 2, AccountMaxFailures: 0, WindowMs: 1000, LockoutMs: 5000}
+	limiter := server.NewAuthRateLimiter(logger, config)
+
+	limiter.Fail("127.0.0.1", "device:a", 100)
+	limiter.Fail("127.0.0.1", "device:b", 100)
+	assert.NotEqual(t, int64(0), limiter.Check("127.0.0.1", "device:c", 200), "IP was not locked out")
+	assert.Equal(t, int64(0), limiter.Check("10.0.0.1", "device:a", 200), "other IP was locked out")
+}
+
+func TestAuthRateLimiterWindow(t *testing.T) {
+	config := &server.AuthRateLimitConfig{IPMaxFailures: 0, AccountMaxFailures: 2, WindowMs: 1000, LockoutMs: 5000}
+	limiter := server.NewAuthRateLimiter(logger, config)
+
+	// Failures in separate windows do not add up, and a success clears them.
+	limiter.Fail("127.0.0.1", "email:a@example.com", 100)
+	limiter.Fail("127.0.0.1", "email:a@example.com", 1200)
+	assert.Equal(t, int64(0), limiter.Check("127.0.0.1", "email:a@example.com", 1300), "account was locked out")
+	limiter.Succeed("email:a@example.com")
+	limiter.Fail("127.0.0.1", "email:a@example.com", 1400)
+	assert.Equal(t, int64(0), limiter.Check("127.0.0.1", "email:a@example.com", 1500), "account was locked out")
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatFilterNoRules(t *testing.T) {
+	f, err := server.NewChatFilter(server.NewSocialConfig().Chat)
+	assert.Nil(t, err, "err was not nil")
+
+	data, ok := f.Apply([]byte(`{"text":"hello"}`))
+	assert.True(t, ok, "message was rejected")
+	assert.Equal(t, `{"text":"hello"}`, string(data), "data was changed")
+}
+
+func TestChatFilterReject(t *testing.T) {
+	config := server.NewSocialConfig().Chat
+	config.FilterWords = []string{"darn"}
+	f, err := server.NewChatFilter(config)
+	assert.Nil(t, err, "err was not nil")
+
+	_, ok := f.Apply([]byte(`{"text":"well DARN it"}`))
+	assert.False(t, ok, "message was not rejected")
+
+	_, ok = f.Apply([]byte(`{"text":"darning socks"}`))
+	assert.True(t, ok, "partial word match was rejected")
+}
+
+func TestChatFilterMask(t *testing.T) {
+	config := server.NewSocialConfig().Chat
+	config.FilterPatterns = []string{"[0-9]{3}-[0-9]{4}"}
+	config.FilterMask = true
+	f, err := server.NewChatFilter(config)
+	assert.Nil(t, err, "err was not nil")
+
+	data, ok := f.Apply([]byte(`{"text":"call 555-1234","tags":["555-9876"]}`))
+	assert.True(t, ok, "message was rejected")
+	assert.Equal(t, `{"tags":["********"],"text":"call ********"}`, string(data), "data was not masked")
+}
+
+func TestChatFilterInvalidPattern(t *testing.T) {
+	config := server.NewSocialConfig().Chat
+	config.FilterPatterns = []string{"("}
+	_, err := server.NewChatFilter(config)
+	assert.NotNil(t, err, "err was nil")
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPFilterAllowDeny(t *testing.T) {
+	config := server.NewSocketConfig().ClientIP
+	config.Allow = []string{"10.0.0.0/8"}
+	config.Deny = []string{"10.0.0.1"}
+	f, err := server.NewClientIPFilter(config)
+	assert.Nil(t, err, "err was not nil")
+
+	assert.True(t, f.Allowed("10.1.2.3"), "allowed address was denied")
+	assert.False(t, f.Allowed("10.0.0.1"), "denied address was allowed")
+	assert.False(t, f.Allowed("192.168.0.1"), "address outside allow ranges was allowed")
+}
+
+func TestClientIPFilterInvalidRange(t *testing.T) {
+	config := server.NewSocketConfig().ClientIP
+	config.Deny = []string{"10.0.0.0/33"}
+	_, err := server.NewClientIPFilter(config)
+	assert.NotNil(t, err, "err was nil")
+}
+
+func TestClientIPFilterForwardedFor(t *testing.T) {
+	config := server.NewSocketConfig().ClientIP
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	f, err := server.NewClientIPFilter(config)
+	assert.Nil(t, err, "err was not nil")
+
+	r, _ := http.NewRequest("GET", "/api", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.3")
+	assert.Equal(t, "203.0.113.7", f.ClientIP(r), "client address was not taken from trusted hops")
+
+	r.RemoteAddr = "192.0.2.5:4000"
+	assert.Equal(t, "192.0.2.5", f.ClientIP(r), "untrusted peer was able to forward an address")
+}
+
+func TestClientIPFilterProxyProtocol(t *testing.T) {
+	config := server.NewSocketConfig().ClientIP
+	config.ProxyProtocol = true
+	f, err := server.NewClientIPFilter(config)
+	assert.Nil(t, err, "err was not nil")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "err was not nil")
+	defer listener.Close()
+	listener = f.Listener(logger, listener)
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+		header = append(header, 203, 0, 113, 7, 127, 0, 0, 1, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(header[24:26], 4567)
+		binary.BigEndian.PutUint16(header[26:28], 7350)
+		conn.Write(append(header, []byte("hello")...))
+		conn.Close()
+	}()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "err was not nil")
+	data, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, "203.0.113.7:4567", conn.RemoteAddr().String(), "remote address was not taken from header")
+	assert.Equal(t, "hello", string(data), "data after header was not kept")
+}
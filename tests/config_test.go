@@ -19,6 +19,12 @@ func TestConfigLoad(t *testing.T) {
 	if c.GetRuntime().HTTPKey != "testkey" {
 		t.Error("Unmatched config value - runtime.http_key")
 	}
+	if c.GetRuntime().HTTPClient.MaxResponseBytes != 65536 {
+		t.Error("Unmatched config value - runtime.http_client.max_response_bytes")
+	}
+	if c.GetRuntime().HTTPClient.TimeoutMs != 5000 {
+		t.Error("Unmatched config value - runtime.http_client.timeout_ms default")
+	}
 }
 
 func TestConfigLoadOverride(t *testing.T) {
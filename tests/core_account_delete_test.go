@@ -0,0 +1,87 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountDelete(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+
+	code, err := server.AccountDelete(logger, db, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// The account is hidden from other users until it is erased.
+	users, err := server.UsersFetchIds(logger, db, [][]byte{userID.Bytes()})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, users, 0, "deleted user was fetched")
+
+	var disabledAt int64
+	err = db.QueryRow("SELECT disabled_at FROM users WHERE id = $1", userID.Bytes()).Scan(&disabledAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEqual(t, int64(0), disabledAt, "deleted user was not disabled")
+
+	code, err = server.AccountDelete(logger, db, userID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
+
+func TestAccountDeleteCancel(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+
+	code, err := server.AccountDeleteCancel(logger, db, userID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	_, err = server.AccountDelete(logger, db, userID)
+	assert.Nil(t, err, "err was not nil")
+	code, err = server.AccountDeleteCancel(logger, db, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	users, err := server.UsersFetchIds(logger, db, [][]byte{userID.Bytes()})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, users, 1, "restored user was not fetched")
+}
+
+func TestAccountDeleteNotFound(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	code, err := server.AccountDelete(logger, db, uuid.NewV4())
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.USER_NOT_FOUND, code, "code did not match")
+}
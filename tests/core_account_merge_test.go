@@ -0,0 +1,102 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func storageWriteRaw(t *testing.T, db *sql.DB, userID uuid.UUID, record string, value string) {
+	_, err := db.Exec(`
+INSERT INTO storage (id, user_id, bucket, collection, record, value, version, created_at, updated_at)
+VALUES ($1, $2, 'merge', 'test', $3, $4, $5, 1, 1)`, uuid.NewV4().Bytes(), userID.Bytes(), record, []byte(value), []byte(generateString()))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountMerge(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	targetID := createEmailUser(t, db, generateString()+"@example.com")
+	sourceID := uuid.NewV4()
+	facebookID := generateString()
+	deviceID := generateString()
+	_, err = db.Exec("INSERT INTO users (id, handle, facebook_id, created_at, updated_at) VALUES ($1, $2, $3, 1, 1)",
+		sourceID.Bytes(), generateString(), facebookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO user_device (id, user_id) VALUES ($1, $2)", deviceID, sourceID.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storageWriteRaw(t, db, targetID, "shared", `{"owner":"target"}`)
+	storageWriteRaw(t, db, sourceID, "shared", `{"owner":"source"}`)
+	storageWriteRaw(t, db, sourceID, "source", `{"owner":"source"}`)
+
+	code, err := server.AccountMerge(logger, db, nil, targetID, sourceID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	var mergedFacebookID string
+	err = db.QueryRow("SELECT facebook_id FROM users WHERE id = $1", targetID.Bytes()).Scan(&mergedFacebookID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, facebookID, mergedFacebookID, "facebook ID did not match")
+
+	var deviceUserID []byte
+	err = db.QueryRow("SELECT user_id FROM user_device WHERE id = $1", deviceID).Scan(&deviceUserID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, targetID.Bytes(), deviceUserID, "device user ID did not match")
+
+	var exists int
+	err = db.QueryRow("SELECT 1 FROM users WHERE id = $1", sourceID.Bytes()).Scan(&exists)
+	assert.Equal(t, sql.ErrNoRows, err, "source user was not removed")
+
+	// The target keeps its own copy of records both accounts had.
+	var value []byte
+	err = db.QueryRow("SELECT value FROM storage WHERE user_id = $1 AND bucket = 'merge' AND collection = 'test' AND record = 'shared' AND deleted_at = 0",
+		targetID.Bytes()).Scan(&value)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, `{"owner":"target"}`, string(value), "value did not match")
+
+	err = db.QueryRow("SELECT value FROM storage WHERE user_id = $1 AND bucket = 'merge' AND collection = 'test' AND record = 'source' AND deleted_at = 0",
+		targetID.Bytes()).Scan(&value)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, `{"owner":"source"}`, string(value), "value did not match")
+}
+
+func TestAccountMergeSelf(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+	code, err := server.AccountMerge(logger, db, nil, userID, userID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
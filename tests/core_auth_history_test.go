@@ -0,0 +1,58 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthHistoryList(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+	for i := 1; i <= 12; i++ {
+		_, err = db.Exec("INSERT INTO auth_history (user_id, created_at, id, type, provider, ip, user_agent) VALUES ($1, $2, $3, $4, 'email', '127.0.0.1', 'test')",
+			userID.Bytes(), int64(i), uuid.NewV4().Bytes(), server.AUTH_HISTORY_LOGIN)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, code, err := server.AuthHistoryList(logger, db, userID, 5, nil)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	entries, cursor, code, err := server.AuthHistoryList(logger, db, userID, 10, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, entries, 10, "entries did not match")
+	assert.NotEmpty(t, cursor, "cursor was empty")
+	assert.Equal(t, int64(12), entries[0].CreatedAt, "most recent entry was not first")
+	assert.Equal(t, "email", entries[0].Provider, "provider did not match")
+
+	entries, cursor, code, err = server.AuthHistoryList(logger, db, userID, 10, cursor)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, entries, 2, "entries did not match")
+	assert.Empty(t, cursor, "cursor was not empty")
+	assert.Equal(t, int64(1), entries[1].CreatedAt, "oldest entry was not last")
+}
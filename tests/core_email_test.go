@@ -0,0 +1,160 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"nakama/server"
+	"strings"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testMailer keeps the email it is asked to send.
+type testMailer struct {
+	sent []string
+}
+
+func (m *testMailer) Send(to string, subject string, body string) error {
+	m.sent = append(m.sent, body)
+	return nil
+}
+
+// token is the token at the end of the last email sent.
+func (m *testMailer) token() string {
+	lines := strings.Split(strings.TrimSpace(m.sent[len(m.sent)-1]), "\n")
+	return lines[len(lines)-1]
+}
+
+func createEmailUser(t *testing.T, db *sql.DB, email string) uuid.UUID {
+	userID := uuid.NewV4()
+	ts := int64(1)
+	_, err := db.Exec("INSERT INTO users (id, handle, email, password, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5)",
+		userID.Bytes(), generateString(), email, []byte("password"), ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestEmailVerify(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	mailer := &testMailer{}
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+
+	code, err := server.EmailVerificationSend(logger, db, server.NewConfig(), mailer, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, mailer.sent, 1, "sent length was not 1")
+
+	token := mailer.token()
+	code, err = server.EmailVerify(logger, db, token)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	var verifiedAt int64
+	err = db.QueryRow("SELECT verified_at FROM users WHERE id = $1", userID.Bytes()).Scan(&verifiedAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEqual(t, int64(0), verifiedAt, "verified at was 0")
+
+	// Tokens only work once.
+	code, err = server.EmailVerify(logger, db, token)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	// Nothing more to verify.
+	code, err = server.EmailVerificationSend(logger, db, server.NewConfig(), mailer, userID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
+
+func TestEmailVerifyReplacedToken(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	mailer := &testMailer{}
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+
+	_, err = server.EmailVerificationSend(logger, db, server.NewConfig(), mailer, userID)
+	assert.Nil(t, err, "err was not nil")
+	first := mailer.token()
+	_, err = server.EmailVerificationSend(logger, db, server.NewConfig(), mailer, userID)
+	assert.Nil(t, err, "err was not nil")
+
+	code, err := server.EmailVerify(logger, db, first)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	code, err = server.EmailVerify(logger, db, mailer.token())
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+}
+
+func TestPasswordReset(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	mailer := &testMailer{}
+	email := generateString() + "@example.com"
+	userID := createEmailUser(t, db, email)
+
+	code, err := server.PasswordResetSend(logger, db, server.NewConfig(), mailer, strings.ToUpper(email))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, mailer.sent, 1, "sent length was not 1")
+
+	code, err = server.PasswordReset(logger, db, mailer.token(), "short")
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	code, err = server.PasswordReset(logger, db, mailer.token(), "newpassword")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	var password []byte
+	var verifiedAt int64
+	err = db.QueryRow("SELECT password, verified_at FROM users WHERE id = $1", userID.Bytes()).Scan(&password, &verifiedAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.Nil(t, bcrypt.CompareHashAndPassword(password, []byte("newpassword")), "password did not match")
+	assert.NotEqual(t, int64(0), verifiedAt, "verified at was 0")
+}
+
+func TestPasswordResetSendUnknownEmail(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	mailer := &testMailer{}
+	code, err := server.PasswordResetSend(logger, db, server.NewConfig(), mailer, generateString()+"@example.com")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, mailer.sent, 0, "sent length was not 0")
+}
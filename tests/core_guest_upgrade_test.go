@@ -0,0 +1,93 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func createDeviceUser(t *testing.T, db *sql.DB) uuid.UUID {
+	userID := uuid.NewV4()
+	ts := int64(1)
+	_, err := db.Exec("INSERT INTO users (id, handle, created_at, updated_at) VALUES ($1, $2, $3, $3)",
+		userID.Bytes(), generateString(), ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO user_device (id, user_id) VALUES ($1, $2)", generateString()+generateString(), userID.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestGuestUpgrade(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createDeviceUser(t, db)
+	handle := generateString()
+	customID := generateString() + generateString()
+
+	code, err := server.GuestUpgrade(logger, db, userID, handle, "custom", customID, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	var storedHandle string
+	var storedCustomID sql.NullString
+	err = db.QueryRow("SELECT handle, custom_id FROM users WHERE id = $1", userID.Bytes()).Scan(&storedHandle, &storedCustomID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, handle, storedHandle, "handle did not match")
+	assert.Equal(t, customID, storedCustomID.String, "custom ID did not match")
+
+	// Upgraded accounts are no longer guests.
+	code, err = server.GuestUpgrade(logger, db, userID, generateString(), "custom", generateString()+generateString(), nil)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
+
+func TestGuestUpgradeHandleInUse(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	takenID := createDeviceUser(t, db)
+	var takenHandle string
+	if err = db.QueryRow("SELECT handle FROM users WHERE id = $1", takenID.Bytes()).Scan(&takenHandle); err != nil {
+		t.Fatal(err)
+	}
+
+	userID := createDeviceUser(t, db)
+	customID := generateString() + generateString()
+	code, err := server.GuestUpgrade(logger, db, userID, takenHandle, "custom", customID, nil)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.USER_HANDLE_INUSE, code, "code did not match")
+
+	// Nothing is linked when the handle cannot be claimed.
+	var count int64
+	err = db.QueryRow("SELECT COUNT(id) FROM users WHERE custom_id = $1", customID).Scan(&count)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), count, "custom ID was linked")
+}
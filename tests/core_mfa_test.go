@@ -0,0 +1,83 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"nakama/server"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// totpCode computes the current code for a base32 secret, as an authenticator app would.
+func totpCode(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestMfaEnrollConfirmDisable(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+
+	secret, uri, code, err := server.MfaEnroll(logger, db, userID, "Nakama", "player")
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/"), "uri was not an otpauth URI")
+
+	_, code, err = server.MfaConfirm(logger, db, userID, "000000")
+	if totpCode(t, secret) != "000000" {
+		assert.NotNil(t, err, "err was nil")
+		assert.Equal(t, server.MFA_INVALID, code, "code did not match")
+	}
+
+	recoveryCodes, code, err := server.MfaConfirm(logger, db, userID, totpCode(t, secret))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, recoveryCodes, 10, "recovery codes did not match")
+
+	// Enrollment cannot be restarted while enabled.
+	_, _, code, err = server.MfaEnroll(logger, db, userID, "Nakama", "player")
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	code, err = server.MfaDisable(logger, db, userID, recoveryCodes[0])
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	code, err = server.MfaDisable(logger, db, userID, recoveryCodes[1])
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
@@ -15,6 +15,7 @@
 package tests
 
 import (
+	"context"
 	"nakama/server"
 	"testing"
 
@@ -46,7 +47,7 @@ func setupNotificationService() (*server.NotificationService, error) {
 	logger, _ := zap.NewDevelopment(zap.AddStacktrace(zap.ErrorLevel))
 	tracker := server.NewTrackerService("test-tracker")
 	msgRouter := &fakeMessageRouter{}
-	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewSocialConfig().Notification)
+	ns := server.NewNotificationService(logger, db, tracker, msgRouter, server.NewMetrics(server.NewMetricsConfig()), server.NewTracer(logger, server.NewTracingConfig(), "nakama"), server.NewSocialConfig().Notification)
 	return ns, nil
 }
 
@@ -62,7 +63,7 @@ func TestNotificationService(t *testing.T) {
 }
 
 func testNotificationServiceSend(t *testing.T) {
-	err := notificationService.NotificationSend([]*server.NNotification{
+	err := notificationService.NotificationSend(context.Background(), []*server.NNotification{
 		{
 			UserID:     notificationUserID.Bytes(),
 			Persistent: true,
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"nakama/server"
 	"testing"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
@@ -44,7 +45,7 @@ func TestStorageWriteRuntimeGlobalSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -111,7 +112,7 @@ func TestStorageWriteRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -170,7 +171,7 @@ func TestStorageWriteRuntimeUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -211,12 +212,12 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
@@ -236,7 +237,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -260,7 +261,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -290,7 +291,7 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -314,12 +315,12 @@ func TestStorageWriteRuntimeGlobalSingleIfMatchExistsFail(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWriteRuntimeGlobalSingleIfNoneMatchNotExists(t *testing.T) {
@@ -340,7 +341,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -370,7 +371,7 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -394,12 +395,12 @@ func TestStorageWriteRuntimeGlobalSingleIfNoneMatchExists(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWriteRuntimeGlobalMultipleIfMatchNotExists(t *testing.T) {
@@ -428,12 +429,12 @@ func TestStorageWriteRuntimeGlobalMultipleIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWritePipelineSingleGlobalNotAllowed(t *testing.T) {
@@ -453,7 +454,7 @@ func TestStorageWritePipelineSingleGlobalNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4(), data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.NewV4(), data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
@@ -479,12 +480,13 @@ func TestStorageWritePipelineSingleOtherClientNotAllowed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.NewV4(), data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.NewV4(), data)
 
+	// Other users' records can only be written when shared through their ACL.
 	assert.Nil(t, keys, "keys was not nil")
-	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "A client can only write their own records", err.Error(), "error message did not match")
+	assert.Equal(t, "A client can only write their own records, or records shared with them", err.Error(), "error message did not match")
 }
 
 func TestStorageWritePipelineUserSingle(t *testing.T) {
@@ -507,7 +509,7 @@ func TestStorageWritePipelineUserSingle(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -558,7 +560,7 @@ func TestStorageWritePipelineUserMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -616,7 +618,7 @@ func TestStorageWriteRuntimeGlobalMultipleSameKey(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -690,7 +692,7 @@ func TestStorageWritePipelineUserMultipleSameKey(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -751,12 +753,12 @@ func TestStorageWritePipelineIfMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
@@ -779,7 +781,7 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -803,12 +805,12 @@ func TestStorageWritePipelineIfMatchExistsFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWritePipelineIfMatchExists(t *testing.T) {
@@ -832,7 +834,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -856,7 +858,7 @@ func TestStorageWritePipelineIfMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -890,7 +892,7 @@ func TestStorageWritePipelineIfNoneMatchNotExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -924,7 +926,7 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -948,12 +950,12 @@ func TestStorageWritePipelineIfNoneMatchExists(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageWritePipelinePermissionFail(t *testing.T) {
@@ -977,7 +979,7 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1000,12 +1002,12 @@ func TestStorageWritePipelinePermissionFail(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err = server.StorageWrite(logger, db, uid, data)
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, keys, "keys was not nil")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
 	assert.NotNil(t, err, "err was nil")
-	assert.Equal(t, "Storage write rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
+	assert.Equal(t, "Storage write rejected: not found, version or condition check failed, or permission denied", err.Error(), "error message did not match")
 }
 
 func TestStorageFetchRuntimeGlobalPrivate(t *testing.T) {
@@ -1027,7 +1029,7 @@ func TestStorageFetchRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1080,7 +1082,7 @@ func TestStorageFetchRuntimeMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1140,7 +1142,7 @@ func TestStorageFetchRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1194,7 +1196,7 @@ func TestStorageFetchPipelineGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1242,7 +1244,7 @@ func TestStorageFetchPipelineUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1291,7 +1293,7 @@ func TestStorageFetchPipelineUserRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1347,7 +1349,7 @@ func TestStorageFetchPipelineUserPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1403,7 +1405,7 @@ func TestStorageFetchPipelineUserOtherRead(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1452,7 +1454,7 @@ func TestStorageFetchPipelineUserOtherPublic(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1518,7 +1520,7 @@ func TestStorageFetchPipelineUserOtherPublicMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1583,7 +1585,7 @@ func TestStorageRemoveRuntimeGlobalPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1632,7 +1634,7 @@ func TestStorageRemoveRuntimeGlobalPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1683,7 +1685,7 @@ func TestStorageRemoveRuntimeUserPublic(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1735,7 +1737,7 @@ func TestStorageRemoveRuntimeUserPrivate(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1785,7 +1787,7 @@ func TestStorageRemovePipelineGlobalRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1831,7 +1833,7 @@ func TestStorageRemovePipelineUserOtherRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1879,7 +1881,7 @@ func TestStorageRemovePipelineUserWrite(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1926,7 +1928,7 @@ func TestStorageRemovePipelineUserDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -1994,7 +1996,7 @@ func TestStorageRemoveRuntimeGlobalIfMatchRejected(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2040,7 +2042,7 @@ func TestStorageRemoveRuntimeGlobalIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2094,7 +2096,7 @@ func TestStorageRemoveRuntimeGlobalMultiple(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2149,7 +2151,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixed(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2208,7 +2210,7 @@ func TestStorageRemoveRuntimeGlobalMultipleMixedIfMatch(t *testing.T) {
 			PermissionWrite: 1,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2276,7 +2278,7 @@ func TestStorageRemovePipelineUserMultipleMixedDenied(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2345,7 +2347,7 @@ func TestStorageRemoveRuntimeUserMultipleMixed(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2413,7 +2415,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatchFail(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2514,7 +2516,7 @@ func TestStorageRemoveRuntimeUserMultipleIfMatch(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2611,7 +2613,7 @@ func TestStorageListRuntimeUser(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2669,7 +2671,7 @@ func TestStorageListPipelineUserSelf(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2726,7 +2728,7 @@ func TestStorageListPipelineUserOther(t *testing.T) {
 			PermissionWrite: 0,
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
@@ -2768,7 +2770,7 @@ func TestStorageUpdateRuntimeNewRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err := server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2806,7 +2808,7 @@ func TestStorageUpdateRuntimeExistingRecord(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2829,7 +2831,7 @@ func TestStorageUpdateRuntimeExistingRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2878,7 +2880,7 @@ func TestStorageUpdatePipelineNewRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err := server.StorageUpdate(logger, db, server.NewStorageConfig(), uid, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2921,7 +2923,7 @@ func TestStorageUpdatePipelineExistingRecord(t *testing.T) {
 			PermissionWrite: int64(1),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2945,7 +2947,7 @@ func TestStorageUpdatePipelineExistingRecord(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uid, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -2988,7 +2990,7 @@ func TestStorageUpdatePipelineExistingRecordPermissionDenied(t *testing.T) {
 			PermissionWrite: int64(0),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uid, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uid, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3012,7 +3014,7 @@ func TestStorageUpdatePipelineExistingRecordPermissionDenied(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uid, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uid, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3043,7 +3045,7 @@ func TestStorageUpdateRuntimeBadPatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err := server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: jsonpatch incr operation does not apply: doc is missing path: /foo/bar", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3075,7 +3077,7 @@ func TestStorageUpdateRuntimeNewRecordIfNoneMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err := server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3113,7 +3115,7 @@ func TestStorageUpdateRuntimeExistingRecordIfNoneMatch(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3135,7 +3137,7 @@ func TestStorageUpdateRuntimeExistingRecordIfNoneMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3167,7 +3169,7 @@ func TestStorageUpdateRuntimeNewRecordIfMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err := server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err := server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
@@ -3191,7 +3193,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatch(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3213,7 +3215,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatch(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3251,7 +3253,7 @@ func TestStorageUpdateRuntimeExistingRecordIfMatchBadVersion(t *testing.T) {
 			Value:      []byte(`{"foo":{"bar":1}}`),
 		},
 	}
-	keys, code, err := server.StorageWrite(logger, db, uuid.Nil, data)
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
 	assert.Nil(t, err, "err was not nil")
 	assert.Equal(t, 0, int(code), "code was not 0")
 	assert.NotNil(t, keys, "values was nil")
@@ -3273,9 +3275,814 @@ func TestStorageUpdateRuntimeExistingRecordIfMatchBadVersion(t *testing.T) {
 		},
 	}
 
-	keys, code, err = server.StorageUpdate(logger, db, uuid.Nil, updates)
+	keys, code, err = server.StorageUpdate(logger, db, server.NewStorageConfig(), uuid.Nil, updates)
 	assert.NotNil(t, err, "err was not nil")
 	assert.Equal(t, "Storage update index 0 rejected: not found, version check failed, or permission denied", err.Error(), "error message did not match")
 	assert.Equal(t, server.STORAGE_REJECTED, code, "code was not STORAGE_REJECTED")
 	assert.Nil(t, keys, "values was nil")
 }
+
+func TestStorageWriteRuntimeGlobalSingleConditionPass(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	record := generateString()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			Value:           []byte("{\"wallet\":{\"coins\":150},\"name\":\"foo\"}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	data = []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			Value:           []byte("{\"wallet\":{\"coins\":50},\"name\":\"foo\"}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+			Conditions: []*server.StorageCondition{
+				&server.StorageCondition{Field: "wallet.coins", Op: ">=", Value: float64(100)},
+				&server.StorageCondition{Field: "name", Op: "=", Value: "foo"},
+			},
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+	assert.EqualValues(t, []byte(fmt.Sprintf("%x", sha256.Sum256(data[0].Value))), keys[0].Version, "version did not match")
+}
+
+func TestStorageWriteRuntimeGlobalSingleConditionFail(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	record := generateString()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			Value:           []byte("{\"wallet\":{\"coins\":50}}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	data = []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          record,
+			Value:           []byte("{\"wallet\":{\"coins\":0}}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+			Conditions: []*server.StorageCondition{
+				&server.StorageCondition{Field: "wallet.coins", Op: ">=", Value: float64(100)},
+			},
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+}
+
+func TestStorageWriteRuntimeGlobalSingleConditionIfNoneMatch(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			Value:           []byte("{\"foo\":\"bar\"}"),
+			Version:         []byte("*"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+			Conditions: []*server.StorageCondition{
+				&server.StorageCondition{Field: "foo", Op: "=", Value: "bar"},
+			},
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+}
+
+func TestStorageQueryRuntimeGlobalFilterSort(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	config := &server.StorageConfig{
+		Indexes: []*server.StorageIndexConfig{
+			&server.StorageIndexConfig{Bucket: "testbucket", Collection: collection, Fields: []string{"class", "stats.level"}},
+		},
+	}
+	err = server.StorageIndexesSync(logger, db, config)
+	assert.Nil(t, err, "err was not nil")
+
+	values := []string{
+		"{\"class\":\"mage\",\"stats\":{\"level\":3}}",
+		"{\"class\":\"warrior\",\"stats\":{\"level\":9}}",
+		"{\"class\":\"mage\",\"stats\":{\"level\":7}}",
+	}
+	data := make([]*server.StorageData, len(values))
+	for i, v := range values {
+		data[i] = &server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          generateString(),
+			Value:           []byte(v),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+		}
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	filters := []*server.StorageCondition{
+		&server.StorageCondition{Field: "class", Op: "=", Value: "mage"},
+	}
+	results, cursor, code, err := server.StorageQuery(logger, db, uuid.Nil, nil, "testbucket", collection, filters, "stats.level", true, 10, nil)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Nil(t, cursor, "cursor was not nil")
+	assert.Len(t, results, 2, "results length was not 2")
+	assert.Equal(t, data[2].Record, results[0].Record, "record did not match")
+	assert.Equal(t, data[0].Record, results[1].Record, "record did not match")
+}
+
+func TestStorageQueryNotIndexed(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	filters := []*server.StorageCondition{
+		&server.StorageCondition{Field: "class", Op: "=", Value: "mage"},
+	}
+	results, _, code, err := server.StorageQuery(logger, db, uuid.Nil, nil, "testbucket", generateString(), filters, "", false, 10, nil)
+
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Nil(t, results, "results was not nil")
+}
+
+func TestStorageWriteRuntimeGlobalSingleExpired(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			Value:           []byte("{\"foo\":\"bar\"}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+			ExpiresAt:       time.Now().UnixNano()/1000000 + 100,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+
+	time.Sleep(200 * time.Millisecond)
+
+	fetched, code, err := server.StorageFetch(logger, db, uuid.Nil, keys)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, fetched, 0, "fetched length was not 0")
+
+	// An expired record that has not been swept yet does not block if-none-match writes.
+	data[0].Version = []byte("*")
+	data[0].ExpiresAt = 0
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+}
+
+func TestStorageWriteRuntimeGlobalSingleExpiresInPast(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			Value:           []byte("{\"foo\":\"bar\"}"),
+			PermissionRead:  2,
+			PermissionWrite: 1,
+			ExpiresAt:       1,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, data)
+
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+}
+
+func TestStorageBatchRuntimeGlobal(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	removed := &server.StorageData{
+		Bucket:          "testbucket",
+		Collection:      "testcollection",
+		Record:          generateString(),
+		Value:           []byte("{\"item\":\"sword\"}"),
+		PermissionRead:  2,
+		PermissionWrite: 1,
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, []*server.StorageData{removed})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	written := &server.StorageData{
+		Bucket:          "testbucket",
+		Collection:      "othercollection",
+		Record:          generateString(),
+		Value:           []byte("{\"item\":\"sword\"}"),
+		PermissionRead:  2,
+		PermissionWrite: 1,
+	}
+	removes := []*server.StorageKey{
+		&server.StorageKey{Bucket: removed.Bucket, Collection: removed.Collection, Record: removed.Record},
+	}
+	keys, code, err := server.StorageBatch(logger, db, server.NewStorageConfig(), uuid.Nil, []*server.StorageData{written}, removes)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+
+	fetchKeys := []*server.StorageKey{
+		&server.StorageKey{Bucket: removed.Bucket, Collection: removed.Collection, Record: removed.Record},
+		&server.StorageKey{Bucket: written.Bucket, Collection: written.Collection, Record: written.Record},
+	}
+	data, code, err := server.StorageFetch(logger, db, uuid.Nil, fetchKeys)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, data, 1, "data length was not 1")
+	assert.Equal(t, written.Record, data[0].Record, "record did not match")
+}
+
+func TestStorageBatchRuntimeGlobalRejected(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	kept := &server.StorageData{
+		Bucket:          "testbucket",
+		Collection:      "testcollection",
+		Record:          generateString(),
+		Value:           []byte("{\"item\":\"sword\"}"),
+		PermissionRead:  2,
+		PermissionWrite: 1,
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.Nil, []*server.StorageData{kept})
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	// The write's version check fails, so the remove must not be applied either.
+	written := &server.StorageData{
+		Bucket:          "testbucket",
+		Collection:      "othercollection",
+		Record:          generateString(),
+		Value:           []byte("{\"item\":\"sword\"}"),
+		Version:         []byte("fail"),
+		PermissionRead:  2,
+		PermissionWrite: 1,
+	}
+	removes := []*server.StorageKey{
+		&server.StorageKey{Bucket: kept.Bucket, Collection: kept.Collection, Record: kept.Record},
+	}
+	keys, code, err := server.StorageBatch(logger, db, server.NewStorageConfig(), uuid.Nil, []*server.StorageData{written}, removes)
+
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+
+	data, code, err := server.StorageFetch(logger, db, uuid.Nil, removes)
+
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, data, 1, "data length was not 1")
+}
+
+func TestStorageAclSharedReadWrite(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	owner := uuid.NewV4()
+	grantee := uuid.NewV4()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			UserId:          owner.Bytes(),
+			Value:           []byte("{\"coins\":10}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), owner, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, code, err := server.StorageFetch(logger, db, grantee, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, fetched, 0, "fetched length was not 0")
+
+	entries := []*server.StorageAcl{
+		&server.StorageAcl{UserId: grantee.Bytes(), Read: true, Write: true},
+	}
+	code, err = server.StorageAclSet(logger, db, owner, keys[0], entries)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	fetched, code, err = server.StorageFetch(logger, db, grantee, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, fetched, 1, "fetched length was not 1")
+
+	data[0].Value = []byte("{\"coins\":20}")
+	_, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), grantee, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	acl, code, err := server.StorageAclFetch(logger, db, owner, keys[0])
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, acl, 1, "acl length was not 1")
+}
+
+func TestStorageAclNotGranted(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	owner := uuid.NewV4()
+	other := uuid.NewV4()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			UserId:          owner.Bytes(),
+			Value:           []byte("{\"coins\":10}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), owner, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), other, data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+}
+
+func TestStorageUploadCommitFetchRange(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	userID := uuid.NewV4()
+	value := []byte("{\"description\":\"" + generateString() + generateString() + "\"}")
+	data := &server.StorageData{
+		Bucket:          "testbucket",
+		Collection:      "testcollection",
+		Record:          generateString(),
+		PermissionRead:  1,
+		PermissionWrite: 1,
+	}
+	uploadID, code, err := server.StorageUploadBegin(logger, db, config, userID, data, int64(len(value)))
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	half := len(value) / 2
+	received, code, err := server.StorageUploadAppend(logger, db, config, userID, uploadID, 0, value[:half])
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(half), received, "received did not match")
+
+	_, _, code, err = server.StorageUploadCommit(logger, db, config, userID, uploadID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	received, code, err = server.StorageUploadAppend(logger, db, config, userID, uploadID, int64(half), value[half:])
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(len(value)), received, "received did not match")
+
+	_, key, code, err := server.StorageUploadCommit(logger, db, config, userID, uploadID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	key.UserId = userID.Bytes()
+	fetched, size, code, err := server.StorageFetchRange(logger, db, userID, key, 2, 11)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Equal(t, int64(len(value)), size, "size did not match")
+	assert.Equal(t, value[2:13], fetched.Value, "value did not match")
+}
+
+func TestStorageUploadAppendWrongOffset(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	userID := uuid.NewV4()
+	data := &server.StorageData{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     generateString(),
+	}
+	uploadID, _, err := server.StorageUploadBegin(logger, db, config, userID, data, 100)
+	assert.Nil(t, err, "err was not nil")
+
+	received, code, err := server.StorageUploadAppend(logger, db, config, userID, uploadID, 10, []byte("{}"))
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Equal(t, int64(0), received, "received was not 0")
+}
+
+func TestStorageUploadBeginOverQuota(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.UploadUserQuotaBytes = 100
+	userID := uuid.NewV4()
+	data := &server.StorageData{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     generateString(),
+	}
+	_, _, err = server.StorageUploadBegin(logger, db, config, userID, data, 60)
+	assert.Nil(t, err, "err was not nil")
+
+	uploadID, code, err := server.StorageUploadBegin(logger, db, config, userID, data, 60)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+	assert.Nil(t, uploadID, "upload ID was not nil")
+}
+
+func TestStorageWriteQuotaExceeded(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.UserQuotaBytes = 20
+	userID := uuid.NewV4()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			UserId:          userID.Bytes(),
+			Value:           []byte("{\"foo\":\"bar\"}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, code, err := server.StorageWrite(logger, db, config, userID, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	data[0].Record = generateString()
+	keys, code, err := server.StorageWrite(logger, db, config, userID, data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_QUOTA_EXCEEDED, code, "code did not match")
+	assert.Nil(t, keys, "keys was not nil")
+
+	// The runtime is not limited by quotas.
+	_, code, err = server.StorageWrite(logger, db, config, uuid.Nil, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	used, quota, code, err := server.StorageUsageFetch(logger, db, config, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(26), used, "used did not match")
+	assert.Equal(t, int64(20), quota, "quota did not match")
+}
+
+func TestStorageQuotaSetRemove(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	config := server.NewStorageConfig()
+	config.UserQuotaBytes = 10
+	userID := uuid.NewV4()
+	err = server.StorageQuotaSet(logger, db, userID, 100)
+	assert.Nil(t, err, "err was not nil")
+
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      "testcollection",
+			Record:          generateString(),
+			UserId:          userID.Bytes(),
+			Value:           []byte("{\"foo\":\"bar\"}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, config, userID, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	used, quota, _, err := server.StorageUsageFetch(logger, db, config, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(13), used, "used did not match")
+	assert.Equal(t, int64(100), quota, "quota did not match")
+
+	keys[0].Version = nil
+	code, err = server.StorageRemove(logger, db, userID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	err = server.StorageQuotaSet(logger, db, userID, -1)
+	assert.Nil(t, err, "err was not nil")
+
+	used, quota, _, err = server.StorageUsageFetch(logger, db, config, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), used, "used was not 0")
+	assert.Equal(t, int64(10), quota, "quota did not match")
+}
+
+func TestStorageWriteSchemaRejected(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	collection := generateString()
+	schema := []byte(`{"type": "object", "required": ["coins"], "properties": {"coins": {"type": "integer", "minimum": 0}}}`)
+	code, err := server.StorageSchemaSet(logger, db, "testbucket", collection, schema)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	defer server.StorageSchemaSet(logger, db, "testbucket", collection, nil)
+
+	userID := uuid.NewV4()
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          "testbucket",
+			Collection:      collection,
+			Record:          generateString(),
+			UserId:          userID.Bytes(),
+			Value:           []byte("{\"coins\":-1}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	keys, code, err := server.StorageWrite(logger, db, server.NewStorageConfig(), userID, data)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+	assert.Contains(t, err.Error(), "/coins: must be at least 0", "error did not name the field")
+	assert.Nil(t, keys, "keys was not nil")
+
+	data[0].Value = []byte("{\"coins\":10}")
+	keys, code, err = server.StorageWrite(logger, db, server.NewStorageConfig(), userID, data)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, keys, 1, "keys length was not 1")
+}
+
+func TestStorageSchemaSetInvalid(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	code, err := server.StorageSchemaSet(logger, db, "testbucket", generateString(), []byte(`{"type": "text"}`))
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+}
+
+func TestStorageIncrement(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4()
+	key := &server.StorageKey{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     generateString(),
+		UserId:     userID.Bytes(),
+	}
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          key.Bucket,
+			Collection:      key.Collection,
+			Record:          key.Record,
+			UserId:          key.UserId,
+			Value:           []byte("{\"wallet\":{\"coins\":10}}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, server.NewStorageConfig(), userID, data)
+	assert.Nil(t, err, "err was not nil")
+
+	updated, value, code, err := server.StorageIncrement(logger, db, server.NewStorageConfig(), userID, key, "wallet.coins", 5, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Equal(t, float64(15), value, "value did not match")
+
+	// A missing field starts at 0.
+	_, value, _, err = server.StorageIncrement(logger, db, server.NewStorageConfig(), userID, key, "wallet.gems", 2, nil)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, float64(2), value, "value did not match")
+
+	fetched, _, err := server.StorageFetch(logger, db, userID, []*server.StorageKey{key})
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, fetched, 1, "fetched length was not 1")
+	assert.JSONEq(t, "{\"wallet\":{\"coins\":15,\"gems\":2}}", string(fetched[0].Value), "value did not match")
+	assert.NotEqual(t, updated.Version, fetched[0].Version, "version did not change")
+}
+
+func TestStorageIncrementConditionRejected(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4()
+	key := &server.StorageKey{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     generateString(),
+		UserId:     userID.Bytes(),
+	}
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          key.Bucket,
+			Collection:      key.Collection,
+			Record:          key.Record,
+			UserId:          key.UserId,
+			Value:           []byte("{\"coins\":10}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, server.NewStorageConfig(), userID, data)
+	assert.Nil(t, err, "err was not nil")
+
+	conditions := []*server.StorageCondition{&server.StorageCondition{Field: "coins", Op: ">=", Value: float64(20)}}
+	_, _, code, err := server.StorageIncrement(logger, db, server.NewStorageConfig(), userID, key, "coins", -20, conditions)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+}
+
+func TestStorageIncrementNotNumber(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := uuid.NewV4()
+	key := &server.StorageKey{
+		Bucket:     "testbucket",
+		Collection: "testcollection",
+		Record:     generateString(),
+		UserId:     userID.Bytes(),
+	}
+	data := []*server.StorageData{
+		&server.StorageData{
+			Bucket:          key.Bucket,
+			Collection:      key.Collection,
+			Record:          key.Record,
+			UserId:          key.UserId,
+			Value:           []byte("{\"coins\":\"ten\"}"),
+			PermissionRead:  1,
+			PermissionWrite: 1,
+		},
+	}
+	_, _, err = server.StorageWrite(logger, db, server.NewStorageConfig(), userID, data)
+	assert.Nil(t, err, "err was not nil")
+
+	_, _, code, err := server.StorageIncrement(logger, db, server.NewStorageConfig(), userID, key, "coins", 1, nil)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.STORAGE_REJECTED, code, "code did not match")
+}
+
+func TestStorageFetchStatusMixedOwners(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	record := generateString()
+	publicID := uuid.NewV4()
+	privateID := uuid.NewV4()
+	for _, d := range []*server.StorageData{
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: publicID.Bytes(), Value: []byte("{\"name\":\"public\"}"), PermissionRead: 2, PermissionWrite: 1},
+		&server.StorageData{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: privateID.Bytes(), Value: []byte("{\"name\":\"private\"}"), PermissionRead: 1, PermissionWrite: 1},
+	} {
+		_, _, err = server.StorageWrite(logger, db, server.NewStorageConfig(), uuid.FromBytesOrNil(d.UserId), []*server.StorageData{d})
+		assert.Nil(t, err, "err was not nil")
+	}
+
+	keys := []*server.StorageKey{
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: publicID.Bytes()},
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: privateID.Bytes()},
+		&server.StorageKey{Bucket: "testbucket", Collection: "testcollection", Record: record, UserId: uuid.NewV4().Bytes()},
+	}
+	data, statuses, code, err := server.StorageFetchStatus(logger, db, uuid.NewV4(), keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.Len(t, data, 1, "data length was not 1")
+	assert.Equal(t, publicID.Bytes(), data[0].UserId, "user ID did not match")
+	assert.Equal(t, []server.StorageKeyStatus{server.StorageKeyFound, server.StorageKeyDenied, server.StorageKeyMissing}, statuses, "statuses did not match")
+
+	// The owner can read their own private record.
+	data, statuses, _, err = server.StorageFetchStatus(logger, db, privateID, keys)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, data, 2, "data length was not 2")
+	assert.Equal(t, []server.StorageKeyStatus{server.StorageKeyFound, server.StorageKeyFound, server.StorageKeyMissing}, statuses, "statuses did not match")
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserBanSuspendAndLift(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	userID := createEmailUser(t, db, generateString()+"@example.com")
+	adminID := uuid.NewV4()
+
+	ban, code, err := server.UserBanCreate(logger, db, adminID, userID, "cheating", 60000)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+	assert.NotEqual(t, int64(0), ban.ExpiresAt, "expires at was 0")
+
+	var disabledAt int64
+	err = db.QueryRow("SELECT disabled_at FROM users WHERE id = $1", userID.Bytes()).Scan(&disabledAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEqual(t, int64(0), disabledAt, "disabled at was 0")
+
+	code, err = server.UserBanLift(logger, db, adminID, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, 0, int(code), "code was not 0")
+
+	err = db.QueryRow("SELECT disabled_at FROM users WHERE id = $1", userID.Bytes()).Scan(&disabledAt)
+	assert.Nil(t, err, "err was not nil")
+	assert.Equal(t, int64(0), disabledAt, "disabled at was not 0")
+
+	// Nothing more to lift, but the ban stays on record.
+	code, err = server.UserBanLift(logger, db, adminID, userID)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.BAD_INPUT, code, "code did not match")
+
+	bans, err := server.UserBansList(logger, db, userID)
+	assert.Nil(t, err, "err was not nil")
+	assert.Len(t, bans, 1, "bans length was not 1")
+	assert.Equal(t, "cheating", bans[0].Reason, "reason did not match")
+	assert.Equal(t, adminID, bans[0].CreatedBy, "created by did not match")
+	assert.Equal(t, adminID, bans[0].LiftedBy, "lifted by did not match")
+	assert.NotEqual(t, int64(0), bans[0].LiftedAt, "lifted at was 0")
+}
+
+func TestUserBanUnknownUser(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	_, code, err := server.UserBanCreate(logger, db, uuid.Nil, uuid.NewV4(), "", 0)
+	assert.NotNil(t, err, "err was nil")
+	assert.Equal(t, server.USER_NOT_FOUND, code, "code did not match")
+}
@@ -148,3 +148,88 @@ func TestGroupCreateMultiple(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestGroupCreateMaxCount(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:     generateString(),
+		Creator:  uuid.NewV4(),
+		MaxCount: 5,
+	}})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(groups) != 1 || groups[0].MaxCount != 5 {
+		t.Error("Expected group max count to be 5")
+	}
+}
+
+func TestGroupCreateInvalidMaxCount(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	_, err = server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:     generateString(),
+		Creator:  uuid.NewV4(),
+		MaxCount: -1,
+	}})
+	if err == nil {
+		t.Error("Expected error but was nil")
+	}
+}
+
+func TestGroupUsersAddPromoteKick(t *testing.T) {
+	db, err := setupDB()
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	adminID := createDeviceUser(t, db)
+	memberID := createDeviceUser(t, db)
+	groups, err := server.GroupsCreate(logger, db, []*server.GroupCreateParam{{
+		Name:    generateString(),
+		Creator: adminID,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupID := uuid.FromBytesOrNil(groups[0].Id)
+
+	// The script runtime may add users without being a group admin.
+	if _, _, _, err = server.GroupUsersAdd(logger, db, uuid.Nil, groupID, memberID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, code, err := server.GroupUsersAdd(logger, db, adminID, groupID, memberID); err == nil || code != server.BAD_INPUT {
+		t.Error("Expected adding an existing member to fail")
+	}
+	if _, code, err := server.GroupUsersKick(logger, db, memberID, groupID, adminID, 0); err == nil || code != server.BAD_INPUT {
+		t.Error("Expected a kick by a member who is not an admin to fail")
+	}
+
+	if _, _, err = server.GroupUsersPromote(logger, db, adminID, groupID, memberID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.GroupUsersKick(logger, db, uuid.Nil, groupID, memberID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, code, err := server.GroupUsersKick(logger, db, uuid.Nil, groupID, adminID, 0); err == nil || code != server.GROUP_LAST_ADMIN {
+		t.Error("Expected kicking the last admin to fail")
+	}
+
+	var count int64
+	if err = db.QueryRow("SELECT count FROM groups WHERE id = $1", groupID.Bytes()).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected group count to be 1, was %v", count)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderboardRankCacheDescending(t *testing.T) {
+	c := server.NewLeaderboardRankCache(server.NewLeaderboardConfig())
+	leaderboardID := []byte("leaderboard")
+
+	assert.Equal(t, int64(1), c.Set(leaderboardID, 0, 1, []byte("a"), []byte("1"), 10, 100, 1), "rank was not 1")
+	assert.Equal(t, int64(1), c.Set(leaderboardID, 0, 1, []byte("b"), []byte("2"), 20, 100, 1), "rank was not 1")
+	assert.Equal(t, int64(2), c.Get(leaderboardID, 0, []byte("a")), "rank was not 2")
+
+	// Equal scores are ranked by who reached them first.
+	assert.Equal(t, int64(3), c.Set(leaderboardID, 0, 1, []byte("c"), []byte("3"), 10, 200, 1), "rank was not 3")
+
+	// Updating an existing owner moves their record.
+	assert.Equal(t, int64(1), c.Set(leaderboardID, 0, 1, []byte("c"), []byte("3"), 30, 300, 2), "rank was not 1")
+	assert.Equal(t, int64(2), c.Get(leaderboardID, 0, []byte("b")), "rank was not 2")
+	assert.Equal(t, int64(3), c.Get(leaderboardID, 0, []byte("a")), "rank was not 3")
+
+	c.Delete(leaderboardID, 0, []byte("c"))
+	assert.Equal(t, int64(0), c.Get(leaderboardID, 0, []byte("c")), "deleted owner was ranked")
+	assert.Equal(t, int64(1), c.Get(leaderboardID, 0, []byte("b")), "rank was not 1")
+
+	c.DeletePeriod(leaderboardID, 0)
+	assert.Equal(t, int64(0), c.Get(leaderboardID, 0, []byte("b")), "deleted period was ranked")
+}
+
+func TestLeaderboardRankCacheStaleUpdate(t *testing.T) {
+	c := server.NewLeaderboardRankCache(server.NewLeaderboardConfig())
+	leaderboardID := []byte("leaderboard")
+
+	c.Set(leaderboardID, 0, 1, []byte("a"), []byte("1"), 20, 100, 1)
+	c.Set(leaderboardID, 0, 1, []byte("b"), []byte("2"), 10, 100, 1)
+
+	// The second submission for "b" is cached before the first, which must not undo it.
+	assert.Equal(t, int64(1), c.Set(leaderboardID, 0, 1, []byte("b"), []byte("2"), 30, 300, 3), "rank was not 1")
+	assert.Equal(t, int64(1), c.Set(leaderboardID, 0, 1, []byte("b"), []byte("2"), 15, 200, 2), "stale update moved the record")
+	assert.Equal(t, int64(2), c.Get(leaderboardID, 0, []byte("a")), "rank was not 2")
+
+	// A different record for the same owner replaces it regardless.
+	assert.Equal(t, int64(2), c.Set(leaderboardID, 0, 1, []byte("b"), []byte("4"), 15, 400, 1), "rank was not 2")
+}
+
+func TestLeaderboardRankCacheRandom(t *testing.T) {
+	c := server.NewLeaderboardRankCache(server.NewLeaderboardConfig())
+	leaderboardID := []byte("leaderboard")
+
+	scores := make(map[string]int64)
+	for i := 0; i < 2000; i++ {
+		owner := strconv.Itoa(rand.Intn(500))
+		score := int64(rand.Intn(100000))
+		scores[owner] = score
+		// Use the owner as the record ID and a constant update time, so ties break on the owner alone.
+		c.Set(leaderboardID, 0, 0, []byte(owner), []byte(owner), score, 1, int64(i+1))
+	}
+
+	owners := make([]string, 0, len(scores))
+	for owner := range scores {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if scores[owners[i]] != scores[owners[j]] {
+			return scores[owners[i]] < scores[owners[j]]
+		}
+		return owners[i] < owners[j]
+	})
+
+	for i, owner := range owners {
+		assert.Equal(t, int64(i+1), c.Get(leaderboardID, 0, []byte(owner)), "rank mismatch for "+owner)
+	}
+}
+
+func TestLeaderboardRankCacheMaxRecords(t *testing.T) {
+	config := server.NewLeaderboardConfig()
+	config.RankCacheMaxRecords = 2
+	c := server.NewLeaderboardRankCache(config)
+	leaderboardID := []byte("leaderboard")
+
+	c.Set(leaderboardID, 0, 1, []byte("a"), []byte("1"), 10, 100, 1)
+	c.Set(leaderboardID, 0, 1, []byte("b"), []byte("2"), 20, 100, 1)
+	assert.Equal(t, int64(0), c.Set(leaderboardID, 0, 1, []byte("c"), []byte("3"), 30, 100, 1), "oversized leaderboard was ranked")
+	assert.Equal(t, int64(0), c.Get(leaderboardID, 0, []byte("a")), "oversized leaderboard was ranked")
+}
+
+func TestLeaderboardRankCacheDisabled(t *testing.T) {
+	config := server.NewLeaderboardConfig()
+	config.RankCache = false
+	c := server.NewLeaderboardRankCache(config)
+
+	assert.Equal(t, int64(0), c.Set([]byte("leaderboard"), 0, 1, []byte("a"), []byte("1"), 10, 100, 1), "disabled cache returned a rank")
+}
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"sort"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
@@ -36,7 +37,7 @@ func add(props map[string]interface{}, filters map[string]server.MatchmakerFilte
 func addRequest(count int, props map[string]interface{}, filters map[string]server.MatchmakerFilter) (uuid.UUID, map[server.MatchmakerKey]*server.MatchmakerProfile, []*server.MatchmakerAcceptedProperty) {
 	userID := uuid.NewV4()
 	profile := &server.MatchmakerProfile{
-		Meta:          server.PresenceMeta{userID.String()},
+		Meta:          server.PresenceMeta{Handle: userID.String()},
 		RequiredCount: count,
 		Properties:    props,
 		Filters:       filters,
@@ -268,6 +269,336 @@ func TestMatchmakeUnmatchingRange(t *testing.T) {
 	}
 }
 
+// A waiting user's expanding range widens enough to accept a user outside the original range
+func TestMatchmakeExpandingRange(t *testing.T) {
+	newMatchmaker()
+
+	matchedCh := make(chan map[server.MatchmakerKey]*server.MatchmakerProfile, 1)
+	matchmaker.AddMatchListener(func(selected map[server.MatchmakerKey]*server.MatchmakerProfile, _ []*server.MatchmakerAcceptedProperty) {
+		matchedCh <- selected
+	})
+
+	// Added just before the first expansion is due.
+	userID := uuid.NewV4()
+	matchmaker.Add(uuid.NewV4(), userID, &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: 2,
+		Properties:    map[string]interface{}{"rank": int64(10)},
+		Filters: map[string]server.MatchmakerFilter{
+			"rank": &server.MatchmakerExpandingRangeFilter{
+				MatchmakerRangeFilter: server.MatchmakerRangeFilter{8, 12},
+				Step:                  5,
+				Interval:              2 * time.Second,
+				Limit:                 5,
+			},
+		},
+		CreatedAt: time.Now().UTC().Add(-1 * time.Second),
+	})
+
+	_, matched, matchedCriteria := add(map[string]interface{}{
+		"rank": int64(15),
+	}, nil)
+	if matched != nil || matchedCriteria != nil {
+		t.Fatal("Expected Matchmaking to fail before the range expanded")
+	}
+
+	select {
+	case selected := <-matchedCh:
+		if len(selected) != 2 {
+			t.Fatal("Matchmaking did not matched expected result")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Matchmaking failed to match after the range expanded")
+	}
+}
+
+func addParty(count int, size int) (map[server.MatchmakerKey]*server.MatchmakerProfile, []*server.MatchmakerAcceptedProperty) {
+	userID := uuid.NewV4()
+	members := make([]server.Presence, size-1)
+	for i := range members {
+		members[i] = server.Presence{ID: server.PresenceID{Node: "test_node", SessionID: uuid.NewV4()}, UserID: uuid.NewV4()}
+	}
+	profile := &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: count,
+		Properties:    map[string]interface{}{},
+		Members:       members,
+	}
+	_, m, p := matchmaker.Add(uuid.NewV4(), userID, profile)
+	return m, p
+}
+
+// A party is matched as one unit, and only where every member fits
+func TestMatchmakeParty(t *testing.T) {
+	newMatchmaker()
+
+	matched, _ := addParty(4, 3)
+	if matched != nil {
+		t.Fatal("Somehow found matches with a new matchmaker!")
+	}
+
+	matched, _ = addParty(4, 2)
+	if matched != nil {
+		t.Fatal("Expected Matchmaking to fail as the party does not fit")
+	}
+
+	_, matched, matchedCriteria := addRequest(4, map[string]interface{}{}, nil)
+	if matched == nil || matchedCriteria == nil {
+		t.Fatal("Matchmaking failed with nil result")
+	}
+
+	seats := 0
+	for _, profile := range matched {
+		seats += 1 + len(profile.Members)
+	}
+	if len(matched) != 2 || seats != 4 {
+		t.Fatal("Matchmaking did not matched expected result")
+	}
+}
+
+// Waiting tickets report their progress, and are removed once they time out
+func TestMatchmakeStatusTimeout(t *testing.T) {
+	newMatchmaker()
+
+	timedOut := make(chan server.MatchmakerKey, 1)
+	matchmaker.AddTimeoutListener(func(key server.MatchmakerKey, _ *server.MatchmakerProfile) {
+		timedOut <- key
+	})
+
+	sessionID := uuid.NewV4()
+	userID := uuid.NewV4()
+	ticket, _, _ := matchmaker.Add(sessionID, userID, &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: 2,
+		Properties:    map[string]interface{}{},
+		Filters: map[string]server.MatchmakerFilter{
+			"rank": &server.MatchmakerRangeFilter{8, 12},
+		},
+		Timeout: 1 * time.Second,
+	})
+
+	status, err := matchmaker.Status(sessionID, userID, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Position != 1 || status.Waiting != 1 {
+		t.Fatal("Matchmaking status did not match expected result")
+	}
+
+	select {
+	case key := <-timedOut:
+		if key.Ticket != ticket {
+			t.Fatal("Unexpected ticket timed out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ticket did not time out")
+	}
+
+	if _, err := matchmaker.Status(sessionID, userID, ticket); err == nil {
+		t.Fatal("Timed out ticket still waiting")
+	}
+}
+
+func TestMatchmakeBackfill(t *testing.T) {
+	newMatchmaker()
+
+	type assignment struct {
+		matchID uuid.UUID
+		key     server.MatchmakerKey
+	}
+	assigned := make(chan assignment, 2)
+	matchmaker.AddBackfillListener(func(matchID uuid.UUID, key server.MatchmakerKey, _ *server.MatchmakerProfile) {
+		assigned <- assignment{matchID, key}
+	})
+
+	// A waiting ticket is assigned as soon as a match with a place for it registers a backfill.
+	waitingUserID, _, _ := add(map[string]interface{}{"rank": int64(10)}, map[string]server.MatchmakerFilter{})
+	matchID := uuid.NewV4()
+	matchmaker.Backfill(matchID, &server.MatchmakerBackfill{
+		SessionID:     uuid.NewV4(),
+		RequiredCount: 2,
+		OpenSlots:     2,
+		Properties:    map[string]interface{}{},
+		Filters: map[string]server.MatchmakerFilter{
+			"rank": &server.MatchmakerRangeFilter{5, 15},
+		},
+	})
+	select {
+	case a := <-assigned:
+		if a.matchID != matchID || a.key.UserID != waitingUserID {
+			t.Fatal("Unexpected backfill assignment")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting ticket was not backfilled")
+	}
+
+	// New tickets fill the remaining place before being matched with each other.
+	_, matched, _ := add(map[string]interface{}{"rank": int64(20)}, map[string]server.MatchmakerFilter{})
+	if matched != nil {
+		t.Fatal("Unfit ticket should not be matched")
+	}
+	userID, matched, _ := add(map[string]interface{}{"rank": int64(12)}, map[string]server.MatchmakerFilter{})
+	if matched != nil {
+		t.Fatal("Ticket should be backfilled rather than matched")
+	}
+	select {
+	case a := <-assigned:
+		if a.matchID != matchID || a.key.UserID != userID {
+			t.Fatal("Unexpected backfill assignment")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("New ticket was not backfilled")
+	}
+
+	// The backfill is full, so tickets are matched with each other again.
+	_, matched, _ = add(map[string]interface{}{"rank": int64(12)}, map[string]server.MatchmakerFilter{})
+	if len(matched) != 2 {
+		t.Fatal("Matchmaking after backfill did not match expected result")
+	}
+}
+
+func addQuery(props map[string]interface{}, query string) (map[server.MatchmakerKey]*server.MatchmakerProfile, error) {
+	q, err := server.ParseMatchmakerQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	userID := uuid.NewV4()
+	_, m, _ := matchmaker.Add(uuid.NewV4(), userID, &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: 2,
+		Properties:    props,
+		Filters:       map[string]server.MatchmakerFilter{},
+		Query:         q,
+	})
+	return m, nil
+}
+
+func TestMatchmakeQuery(t *testing.T) {
+	newMatchmaker()
+
+	for _, props := range []map[string]interface{}{
+		{"region": []string{"asia"}, "mode": []string{"ranked"}, "rank": int64(15)},
+		{"region": []string{"eu"}, "mode": []string{"practice"}, "rank": int64(15)},
+		{"region": []string{"eu"}, "mode": []string{"ranked"}, "rank": int64(25)},
+	} {
+		// Waiting tickets only accept the searching tickets below, not each other.
+		if matched, err := addQuery(props, "searching:true"); err != nil || matched != nil {
+			t.Fatal("Waiting tickets should not match each other")
+		}
+	}
+
+	query := "region:eu|us -mode:practice rank:>=10 rank:<20"
+	matched, err := addQuery(map[string]interface{}{"searching": true}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != nil {
+		t.Fatal("No waiting ticket should match the query")
+	}
+
+	// A new ticket that fits the query is matched with the waiting searcher.
+	matched, err = addQuery(map[string]interface{}{"region": []string{"us"}, "mode": []string{"casual"}, "rank": int64(19)}, "searching:true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matched) != 2 {
+		t.Fatal("Matchmaking query did not match expected result")
+	}
+}
+
+func TestMatchmakeQueryInvalid(t *testing.T) {
+	for _, query := range []string{"region", "region:", ":eu", "rank:>=ten", "rank:20..10", "mode:ranked||casual"} {
+		if _, err := server.ParseMatchmakerQuery(query); err == nil {
+			t.Fatalf("Query '%v' should not parse", query)
+		}
+	}
+}
+
+func addLatencies(latencies map[string]int64) map[server.MatchmakerKey]*server.MatchmakerProfile {
+	userID := uuid.NewV4()
+	_, m, _ := matchmaker.Add(uuid.NewV4(), userID, &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: 2,
+		Properties:    map[string]interface{}{},
+		Filters:       map[string]server.MatchmakerFilter{},
+		Latencies:     latencies,
+		MaxRttSpread:  100,
+	})
+	return m
+}
+
+func TestMatchmakeRegion(t *testing.T) {
+	newMatchmaker()
+
+	if addLatencies(map[string]int64{"eu": 30, "us": 120}) != nil {
+		t.Fatal("Matchmaking should not have matched a single ticket")
+	}
+	if addLatencies(map[string]int64{"asia": 40}) != nil {
+		t.Fatal("Tickets without a shared region should not be matched")
+	}
+	if addLatencies(map[string]int64{"eu": 200}) != nil {
+		t.Fatal("Tickets whose round trips are too far apart should not be matched")
+	}
+
+	matched := addLatencies(map[string]int64{"eu": 90, "us": 60})
+	if len(matched) != 2 {
+		t.Fatal("Matchmaking did not match expected result")
+	}
+	profiles := make([]*server.MatchmakerProfile, 0)
+	for _, profile := range matched {
+		profiles = append(profiles, profile)
+	}
+	if region, ok := server.MatchmakerRegion(profiles); !ok || region != "eu" {
+		t.Fatal("Matchmaking did not choose the region with the lowest worst round trip")
+	}
+}
+
+func addTeam(mmr int64, teamCount int) map[server.MatchmakerKey]*server.MatchmakerProfile {
+	userID := uuid.NewV4()
+	_, m, _ := matchmaker.Add(uuid.NewV4(), userID, &server.MatchmakerProfile{
+		Meta:          server.PresenceMeta{Handle: userID.String()},
+		RequiredCount: 4,
+		Properties:    map[string]interface{}{"mmr": mmr},
+		Filters:       map[string]server.MatchmakerFilter{},
+		TeamCount:     teamCount,
+		TeamProperty:  "mmr",
+	})
+	return m
+}
+
+func TestMatchmakeTeams(t *testing.T) {
+	newMatchmaker()
+
+	addTeam(2000, 2)
+	addTeam(1900, 2)
+	addTeam(1500, 4)
+	addTeam(1100, 2)
+	matched := addTeam(1000, 2)
+	if len(matched) != 4 {
+		t.Fatal("Matchmaking did not match expected result")
+	}
+
+	teams := server.MatchmakerTeams(matched)
+	if len(teams) != 2 {
+		t.Fatal("Matchmaking did not split the match into two teams")
+	}
+	for _, team := range teams {
+		if len(team) != 2 {
+			t.Fatal("Matchmaking teams are not of equal size")
+		}
+		var total int64
+		for _, key := range team {
+			if matched[key].TeamCount != 2 {
+				t.Fatal("Matchmaking matched a ticket asking for different teams")
+			}
+			total += server.MatchmakerTeamTotal(matched[key])
+		}
+		if total != 3000 {
+			t.Fatalf("Matchmaking teams are not balanced, team total %v", total)
+		}
+	}
+}
+
 func TestMatchmakeUnmatchingAllTerms(t *testing.T) {
 	newMatchmaker()
 
@@ -551,3 +882,27 @@ func TestMatchmakeMultiFilterMultiuser(t *testing.T) {
 		t.Fatal("Matchmaking did not matched expected result")
 	}
 }
+
+// Tickets are counted against the session that added them
+func TestMatchmakeCountBySession(t *testing.T) {
+	newMatchmaker()
+
+	sessionID := uuid.NewV4()
+	userID := uuid.NewV4()
+	for i := 0; i < 2; i++ {
+		matchmaker.Add(sessionID, userID, &server.MatchmakerProfile{
+			Meta:          server.PresenceMeta{Handle: userID.String()},
+			RequiredCount: 3,
+			Properties:    map[string]interface{}{"mode": []string{"ctf"}},
+			Filters:       map[string]server.MatchmakerFilter{"mode": &server.MatchmakerTermFilter{Terms: []string{"tdm"}}},
+		})
+	}
+	addRequest(5, nil, nil)
+
+	if count := matchmaker.CountBySession(sessionID); count != 2 {
+		t.Fatalf("Expected 2 tickets for the session, got %v", count)
+	}
+	if count := matchmaker.CountBySession(uuid.NewV4()); count != 0 {
+		t.Fatalf("Expected no tickets for another session, got %v", count)
+	}
+}
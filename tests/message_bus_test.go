@@ -0,0 +1,92 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNATS accepts one client and echoes published messages back to its subscriptions of the same subject.
+func fakeNATS(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "INFO {\"max_payload\":64}\r\n")
+		subs := make(map[string]string)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "SUB":
+				subs[fields[1]] = fields[2]
+			case "PUB":
+				size, _ := strconv.Atoi(fields[2])
+				data := make([]byte, size+2)
+				io.ReadFull(reader, data)
+				if sid, ok := subs[fields[1]]; ok {
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s", fields[1], sid, size, data)
+				}
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestMessageBusNATS(t *testing.T) {
+	bus, err := server.NewMessageBus(l, &server.MessageBusConfig{Backend: "nats", Address: fakeNATS(t), Prefix: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	received := make(chan string, 1)
+	assert.Nil(t, bus.Subscribe("events", func(data []byte) {
+		received <- string(data)
+	}), "subscribe failed")
+	assert.Nil(t, bus.Publish("events", []byte("hello")), "publish failed")
+
+	select {
+	case data := <-received:
+		assert.Equal(t, "hello", data, "message did not match")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	assert.NotNil(t, bus.Publish("events", make([]byte, 65)), "message over server maximum was published")
+}
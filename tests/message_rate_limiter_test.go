@@ -0,0 +1,54 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRateLimiterBurstAndRefill(t *testing.T) {
+	l := server.NewMessageRateLimiter(map[string]*server.MessageRateLimitConfig{
+		"ttopicmessagesend": {Rate: 2, Burst: 3},
+	})
+	sessionID := uuid.NewV4()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(sessionID, "ttopicmessagesend", 1000), "message within burst was rejected")
+	}
+	assert.False(t, l.Allow(sessionID, "ttopicmessagesend", 1000), "message over burst was allowed")
+	assert.True(t, l.Allow(sessionID, "ttopicmessagesend", 1500), "message after refill was rejected")
+	assert.False(t, l.Allow(sessionID, "ttopicmessagesend", 1500), "refill allowed more than the rate")
+
+	rejected, byType := l.Stats()
+	assert.Equal(t, int64(2), rejected, "rejected count did not match")
+	assert.Equal(t, int64(2), byType["ttopicmessagesend"], "rejected count by type did not match")
+}
+
+func TestMessageRateLimiterKeys(t *testing.T) {
+	l := server.NewMessageRateLimiter(map[string]*server.MessageRateLimitConfig{
+		"tstoragewrite": {Rate: 1, Burst: 1},
+	})
+	sessionID := uuid.NewV4()
+
+	assert.True(t, l.Allow(sessionID, "tstoragewrite", 1000), "first message was rejected")
+	assert.False(t, l.Allow(sessionID, "tstoragewrite", 1000), "second message was allowed")
+	assert.True(t, l.Allow(uuid.NewV4(), "tstoragewrite", 1000), "other session was limited")
+	assert.True(t, l.Allow(sessionID, "tstoragefetch", 1000), "message type without a limit was limited")
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(m *server.Metrics) string {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMetricsMessageHistogram(t *testing.T) {
+	config := server.NewMetricsConfig()
+	config.Enabled = true
+	config.LatencyBucketsMs = []float64{10, 100}
+	m := server.NewMetrics(config)
+
+	m.ObserveMessage("tselffetch", time.Now())
+	m.ObserveMessage("tselffetch", time.Now().Add(-50*time.Millisecond))
+	m.ObserveQuery("  select * from users", time.Now(), nil)
+	m.ObserveQuery("INSERT INTO users", time.Now(), errors.New("failed"))
+	m.ObserveNotifications(3, 1)
+
+	out := scrapeMetrics(m)
+	assert.Contains(t, out, "# TYPE nakama_message_duration_seconds histogram", "histogram type missing")
+	assert.Contains(t, out, `nakama_message_duration_seconds_bucket{type="tselffetch",le="0.01"} 1`, "first bucket did not match")
+	assert.Contains(t, out, `nakama_message_duration_seconds_bucket{type="tselffetch",le="0.1"} 2`, "second bucket did not match")
+	assert.Contains(t, out, `nakama_message_duration_seconds_bucket{type="tselffetch",le="+Inf"} 2`, "+Inf bucket did not match")
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="tselffetch"} 2`, "count did not match")
+	assert.Contains(t, out, `nakama_db_query_duration_seconds_count{statement="SELECT"} 1`, "query statement did not match")
+	assert.Contains(t, out, `nakama_db_query_errors_total{statement="INSERT"} 1`, "query error did not match")
+	assert.Contains(t, out, "nakama_notifications_sent_total 3", "notifications sent did not match")
+	assert.Contains(t, out, "nakama_notifications_delivered_total 1", "notifications delivered did not match")
+}
+
+func TestMetricsLabelLimits(t *testing.T) {
+	config := server.NewMetricsConfig()
+	config.Enabled = true
+	config.MaxLabelValues = 2
+	m := server.NewMetrics(config)
+
+	for _, messageType := range []string{"tselffetch", "tselfupdate", "tusersfetch", "tfriendsadd"} {
+		m.ObserveMessage(messageType, time.Now())
+	}
+	out := scrapeMetrics(m)
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="tselffetch"} 1`, "first type missing")
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="tselfupdate"} 1`, "second type missing")
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="other"} 2`, "types over the limit were not counted as other")
+	assert.False(t, strings.Contains(out, "tusersfetch"), "type over the limit was labelled")
+
+	config = server.NewMetricsConfig()
+	config.Enabled = true
+	config.MessageTypes = []string{"tselffetch"}
+	m = server.NewMetrics(config)
+	m.ObserveMessage("tselffetch", time.Now())
+	m.ObserveMessage("tselfupdate", time.Now())
+	out = scrapeMetrics(m)
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="tselffetch"} 1`, "listed type missing")
+	assert.Contains(t, out, `nakama_message_duration_seconds_count{type="other"} 1`, "unlisted type was not counted as other")
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	m := server.NewMetrics(server.NewMetricsConfig())
+	m.ObserveMessage("tselffetch", time.Now())
+	assert.False(t, strings.Contains(scrapeMetrics(m), "tselffetch"), "message observed while metrics were disabled")
+}
@@ -156,6 +156,20 @@ do
   assert(message == "\"WARN logger.\"")
 end
 
+-- logger_debug
+do
+  local message = nk.logger_debug("DEBUG logger.")
+  assert(message == "DEBUG logger.")
+end
+
+-- logger_error with fields
+do
+  local message = nk.logger_error("ERROR logger.", {item = "sword", count = 3, tags = {"a", "b"}})
+  assert(message == "ERROR logger.")
+  local status, res = pcall(nk.logger_info, "INFO logger.", "not a table")
+  assert(status == false)
+end
+
 -- users_fetch_id
 do
   local user_ids = {"4c2ae592-b2a7-445e-98ec-697694478b1c"}
@@ -289,6 +303,16 @@ do
   assert(code == 200, "'code' must equal 200")
 end
 
+-- cache_set, cache_get, cache_delete
+do
+  nk.cache_set("e2e_catalog", {items = {"sword", "shield"}}, 60000)
+  local catalog = nk.cache_get("e2e_catalog")
+  assert(catalog, "'catalog' must not be nil")
+  assert(catalog.items[2] == "shield", "'catalog.items[2]' must equal 'shield'")
+  nk.cache_delete("e2e_catalog")
+  assert(nk.cache_get("e2e_catalog") == nil, "'catalog' must be nil after delete")
+end
+
 -- json_decode
 do
   local object = nk.json_decode('{"hello": "world"}')
@@ -395,6 +419,20 @@ do
   assert(result[2].foo == "foo2")
   assert(result[2].bar == 2)
 
+  local query = "SELECT * FROM " .. t .. " ORDER BY bar ASC"
+  local status, result = pcall(nk.sql_query, query, {}, 3)
+  assert(status)
+  assert(#result == 3)
+  local status, result = pcall(nk.sql_query, query, {}, 2)
+  assert(not status)
+  assert(string.ends(result, "sql query error: returned more than 2 rows"))
+
+  local query = "SELECT * FROM " .. t .. " WHERE foo = $1"
+  local status, result = pcall(nk.sql_query, query, {foo = "foo1"})
+  assert(not status)
+  local status, result = pcall(nk.sql_query, query, {{"foo1"}})
+  assert(not status)
+
   local query = "DELETE FROM " .. t .. " WHERE bar = $1"
   local params = {2}
   local status, result = pcall(nk.sql_exec, query, params)
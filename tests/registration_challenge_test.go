@@ -0,0 +1,77 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"crypto/sha256"
+	"nakama/server"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func solveChallenge(challenge string, difficulty uint) string {
+	for nonce := 0; ; nonce++ {
+		answer := challenge + ":" + strconv.Itoa(nonce)
+		hash := sha256.Sum256([]byte(answer))
+		// Difficulties up to 16 bits only need the first two bytes.
+		if (uint16(hash[0])<<8|uint16(hash[1]))>>(16-difficulty) == 0 {
+			return answer
+		}
+	}
+}
+
+func TestRegistrationChallengePow(t *testing.T) {
+	config := &server.ChallengeConfig{Provider: "pow", Difficulty: 8, ExpiryMs: 60000}
+	challenge, err := server.NewRegistrationChallenge(logger, config, []byte("secret"))
+	assert.Nil(t, err, "err was not nil")
+
+	issued, err := challenge.Issue()
+	assert.Nil(t, err, "err was not nil")
+	assert.NotEmpty(t, issued, "challenge was empty")
+
+	answer := solveChallenge(issued, 8)
+	assert.Nil(t, challenge.Verify(answer, ""), "answer was not accepted")
+	assert.NotNil(t, challenge.Verify(answer, ""), "answer was accepted twice")
+}
+
+func TestRegistrationChallengePowInvalid(t *testing.T) {
+	config := &server.ChallengeConfig{Provider: "pow", Difficulty: 8, ExpiryMs: 60000}
+	challenge, err := server.NewRegistrationChallenge(logger, config, []byte("secret"))
+	assert.Nil(t, err, "err was not nil")
+
+	issued, err := challenge.Issue()
+	assert.Nil(t, err, "err was not nil")
+
+	// Challenges signed with another secret are rejected, even when solved.
+	other, err := server.NewRegistrationChallenge(logger, config, []byte("other"))
+	assert.Nil(t, err, "err was not nil")
+	assert.NotNil(t, other.Verify(solveChallenge(issued, 8), ""), "answer to another server's challenge was accepted")
+
+	assert.NotNil(t, challenge.Verify("", ""), "empty answer was accepted")
+	assert.NotNil(t, challenge.Verify(issued, ""), "challenge without nonce was accepted")
+}
+
+func TestRegistrationChallengeNone(t *testing.T) {
+	challenge, err := server.NewRegistrationChallenge(logger, server.NewSessionConfig().Challenge, []byte("secret"))
+	assert.Nil(t, err, "err was not nil")
+	assert.Nil(t, challenge.Verify("", ""), "registration without a challenge was rejected")
+}
+
+func TestRegistrationChallengeUnknownProvider(t *testing.T) {
+	_, err := server.NewRegistrationChallenge(logger, &server.ChallengeConfig{Provider: "unknown"}, []byte("secret"))
+	assert.NotNil(t, err, "err was nil")
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"nakama/server"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeCacheExpiry(t *testing.T) {
+	cache := server.NewRuntimeCache(&server.RuntimeCacheConfig{MaxEntries: 10, DefaultTTLMs: 1000})
+
+	cache.Set("a", "default", 0, 100)
+	cache.Set("b", "custom", 5000, 100)
+
+	value, found := cache.Get("a", 1000)
+	assert.True(t, found, "value was not found")
+	assert.Equal(t, "default", value, "value did not match")
+	_, found = cache.Get("a", 1100)
+	assert.False(t, found, "value did not expire with the default TTL")
+	_, found = cache.Get("b", 1100)
+	assert.True(t, found, "value expired before its TTL")
+
+	cache.Delete("b")
+	_, found = cache.Get("b", 1100)
+	assert.False(t, found, "value was not deleted")
+
+	size, hits, misses, evictions := cache.Stats()
+	assert.Equal(t, 0, size, "size did not match")
+	assert.Equal(t, int64(2), hits, "hits did not match")
+	assert.Equal(t, int64(2), misses, "misses did not match")
+	assert.Equal(t, int64(0), evictions, "evictions did not match")
+}
+
+func TestRuntimeCacheEviction(t *testing.T) {
+	cache := server.NewRuntimeCache(&server.RuntimeCacheConfig{MaxEntries: 2, DefaultTTLMs: 1000})
+
+	cache.Set("a", 1, 0, 100)
+	cache.Set("b", 2, 0, 100)
+	// Reading a makes b the least recently used.
+	cache.Get("a", 100)
+	cache.Set("c", 3, 0, 100)
+
+	_, found := cache.Get("b", 100)
+	assert.False(t, found, "least recently used value was not evicted")
+	_, found = cache.Get("a", 100)
+	assert.True(t, found, "recently used value was evicted")
+	_, found = cache.Get("c", 100)
+	assert.True(t, found, "new value was not stored")
+
+	size, _, _, evictions := cache.Stats()
+	assert.Equal(t, 2, size, "size did not match")
+	assert.Equal(t, int64(1), evictions, "evictions did not match")
+}
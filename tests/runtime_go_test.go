@@ -0,0 +1,138 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+type testGoMatch struct{}
+
+func (m *testGoMatch) MatchInit(ctx *server.RuntimeGoContext, params map[string]interface{}) (interface{}, int, string, error) {
+	return 0, 20, "native", nil
+}
+
+func (m *testGoMatch) MatchJoinAttempt(ctx *server.RuntimeGoContext, dispatcher server.RuntimeGoMatchDispatcher, tick int64, state interface{}, presence server.Presence) (interface{}, bool, string) {
+	return state, true, ""
+}
+
+func (m *testGoMatch) MatchJoin(ctx *server.RuntimeGoContext, dispatcher server.RuntimeGoMatchDispatcher, tick int64, state interface{}, presences []server.Presence) interface{} {
+	return state
+}
+
+func (m *testGoMatch) MatchLeave(ctx *server.RuntimeGoContext, dispatcher server.RuntimeGoMatchDispatcher, tick int64, state interface{}, presences []server.Presence) interface{} {
+	return state
+}
+
+func (m *testGoMatch) MatchLoop(ctx *server.RuntimeGoContext, dispatcher server.RuntimeGoMatchDispatcher, tick int64, state interface{}, messages []*server.RuntimeGoMatchMessage) interface{} {
+	return state.(int) + len(messages)
+}
+
+func init() {
+	server.RegisterRuntimeGoModule("test", func(logger *zap.Logger, db *sql.DB, initializer server.RuntimeGoInitializer) error {
+		if err := initializer.RegisterRPC("go_echo", func(ctx *server.RuntimeGoContext, payload []byte) ([]byte, error) {
+			if ctx.UserID == uuid.Nil {
+				return nil, errors.New("no user")
+			}
+			return payload, nil
+		}); err != nil {
+			return err
+		}
+		if err := initializer.RegisterRPC("go_panic", func(ctx *server.RuntimeGoContext, payload []byte) ([]byte, error) {
+			panic("unexpected")
+		}); err != nil {
+			return err
+		}
+		if err := initializer.RegisterBefore("nonexistentmessage", nil); err == nil {
+			return errors.New("registered a hook for an unknown message")
+		}
+		return initializer.RegisterMatch("go_counter", func() server.RuntimeGoMatch {
+			return &testGoMatch{}
+		})
+	})
+}
+
+func TestRuntimeGoRPC(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fn := r.GetRuntimeGoRPC("go_echo")
+	if fn == nil {
+		t.Fatal("Go RPC function not registered")
+	}
+	result, err := r.InvokeGoFunctionRPC(fn, uuid.NewV4(), "handle", 0, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "payload" {
+		t.Error("Go RPC function result did not match")
+	}
+	if _, err = r.InvokeGoFunctionRPC(fn, uuid.Nil, "", 0, nil); err == nil || err.Error() != "no user" {
+		t.Error("Go RPC function error was not returned")
+	}
+
+	if _, err = r.InvokeGoFunctionRPC(r.GetRuntimeGoRPC("go_panic"), uuid.NewV4(), "handle", 0, nil); err == nil {
+		t.Error("Go RPC function panic was not returned as an error")
+	}
+}
+
+func TestRuntimeGoMatch(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := server.NewRuntimeConfig()
+	c.Path = filepath.Join(DATA_PATH, "modules")
+	registry := server.NewMatchRegistry(logger, "test_node", server.NewMatchConfig(), server.NewTrackerService("test_node"), nil, nil)
+	r, err := server.NewRuntime(logger, logger, db, c, nil, nil, registry, nil, server.NewStorageConfig(), nil, server.NewRuntimeCache(c.Cache), server.NewRuntimeLimits(c.Limits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	defer registry.Stop()
+
+	matchID, err := registry.Create(r, "go_counter", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh := registry.Get(matchID)
+	if mh == nil {
+		t.Fatal("Match not found after create")
+	}
+	if mh.TickRate != 20 {
+		t.Error("Match tick rate was not set from MatchInit")
+	}
+	matches, _, _, err := registry.List(0, nil, "native", "go_counter", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Error("Match not listed by label")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestRuntimeJobScheduler(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	okID := "ok-" + uuid.NewV4().String()
+	failID := "fail-" + uuid.NewV4().String()
+	writeLuaModule("jobs.lua", `
+local nk = require("nakama")
+nk.register_job("`+okID+`", "* * * * * * *", function(ctx, payload)
+	assert(ctx.ExecutionMode == "job")
+	assert(payload.Id == "`+okID+`")
+end)
+nk.register_job("`+failID+`", "* * * * * * *", function(ctx, payload)
+	error("job failed")
+end)
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// Two schedulers with the same jobs stand in for two nodes of a cluster.
+	s1, err := server.NewRuntimeJobScheduler(logger, db, "node1", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := server.NewRuntimeJobScheduler(logger, db, "node2", r)
+	if err != nil {
+		s1.Stop()
+		t.Fatal(err)
+	}
+	time.Sleep(3500 * time.Millisecond)
+	s1.Stop()
+	s2.Stop()
+
+	statuses, err := server.RuntimeJobsList(db, r.GetRuntimeJobs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 jobs, got %v", len(statuses))
+	}
+	for _, st := range statuses {
+		// Runs once a second, a run is never repeated by the second node.
+		if st.Runs < 2 || st.Runs > 4 {
+			t.Errorf("Job %v ran %v times", st.ID, st.Runs)
+		}
+		if st.NextRunAt <= st.LastRunAt {
+			t.Errorf("Job %v was not rescheduled", st.ID)
+		}
+		switch st.ID {
+		case okID:
+			if st.LastStatus != server.RUNTIME_JOB_STATUS_SUCCEEDED || st.Failures != 0 {
+				t.Errorf("Job %v did not succeed", st.ID)
+			}
+		case failID:
+			if st.LastStatus != server.RUNTIME_JOB_STATUS_FAILED || st.Failures != st.Runs || st.LastError == "" {
+				t.Errorf("Job %v failure was not recorded", st.ID)
+			}
+		}
+	}
+}
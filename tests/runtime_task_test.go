@@ -0,0 +1,101 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"nakama/server"
+)
+
+func TestRuntimeTaskWorker(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("tasks.lua", `
+local nk = require("nakama")
+nk.register_task("reward", function(ctx, task)
+	assert(ctx.ExecutionMode == "task")
+	assert(task.Payload.amount == 100)
+end)
+nk.register_task("broken", function(ctx, task)
+	error("task failed")
+end)
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	okID, err := server.RuntimeTaskEnqueue(db, "reward", []byte(`{"amount":100}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadID, err := server.RuntimeTaskEnqueue(db, "broken", []byte(`{}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.NewRuntimeConfig().Task
+	config.PollIntervalMs = 50
+	config.MaxAttempts = 2
+	config.RetryBackoffMs = 10
+	w := server.NewRuntimeTaskWorker(logger, db, r, config)
+	time.Sleep(500 * time.Millisecond)
+	w.Stop()
+
+	var count int
+	if err = db.QueryRow("SELECT count(id) FROM runtime_task WHERE id = $1", okID.Bytes()).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Finished task was not removed")
+	}
+
+	tasks, err := server.RuntimeTasksDeadList(db, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead *server.RuntimeTask
+	for _, task := range tasks {
+		if task.ID == deadID {
+			dead = task
+		}
+	}
+	if dead == nil {
+		t.Fatal("Failed task was not kept as a dead letter")
+	}
+	if dead.Attempts != 2 || dead.LastError == "" {
+		t.Error("Failed task attempts were not recorded")
+	}
+
+	retried, err := server.RuntimeTaskRetry(db, deadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retried {
+		t.Error("Dead task was not retried")
+	}
+	if retried, _ = server.RuntimeTaskRetry(db, deadID); retried {
+		t.Error("Pending task was retried")
+	}
+	db.Exec("DELETE FROM runtime_task WHERE id = $1", deadID.Bytes())
+}
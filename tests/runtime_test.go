@@ -17,9 +17,13 @@ package tests
 import (
 	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"nakama/server"
 
@@ -39,7 +43,7 @@ func newRuntime() (*server.Runtime, error) {
 	}
 	c := server.NewRuntimeConfig()
 	c.Path = filepath.Join(DATA_PATH, "modules")
-	return server.NewRuntime(logger, logger, db, c, nil)
+	return server.NewRuntime(logger, logger, db, c, nil, nil, nil, nil, server.NewStorageConfig(), nil, server.NewRuntimeCache(c.Cache), server.NewRuntimeLimits(c.Limits))
 }
 
 func writeStatsModule() {
@@ -547,6 +551,64 @@ nk.leaderboard_create(leaderboard_id, "desc", "0 0 * * 1", metadata, false)
 	}
 }
 
+func TestRuntimeLeaderboardCreateGroupNotFound(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("leaderboard_group.lua", `
+local nk = require("nakama")
+
+local status, res = pcall(nk.leaderboard_create, nk.uuid_v4(), "desc", "0 0 * * 1", {}, false, nk.uuid_v4())
+assert(status == false)
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuntimeLeaderboardAuthoritativeList(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("leaderboard_list.lua", `
+local nk = require("nakama")
+
+local id = nk.uuid_v4()
+nk.leaderboard_create(id, "desc", "", {}, false)
+nk.leaderboard_authoritative_set(id, true)
+
+local found = false
+local boards, cursor = nk.leaderboards_list(100)
+while true do
+  for _, b in ipairs(boards) do
+    if b.Id == id then
+      found = true
+      assert(b.Authoritative == true)
+      assert(b.Sort == "desc")
+    end
+  end
+  if cursor == nil then
+    break
+  end
+  boards, cursor = nk.leaderboards_list(100, cursor)
+end
+assert(found)
+
+local status, res = pcall(nk.leaderboard_authoritative_set, nk.uuid_v4(), true)
+assert(status == false)
+
+local record = nk.leaderboard_submit_set(id, 10, nk.uuid_v4(), "someone")
+assert(record.Score == 10)
+	`)
+
+	setupDB()
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+}
+
 func TestStorageWrite(t *testing.T) {
 	defer os.RemoveAll(DATA_PATH)
 	writeLuaModule("storage_write.lua", `
@@ -592,3 +654,426 @@ end
 		t.Error(err)
 	}
 }
+
+func TestRuntimeMatchCreate(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("match.lua", `
+local nk = require("nakama")
+nk.register_match("counter", {
+  match_init = function(context, params)
+    return {count = params.start}, 20, "casual"
+  end,
+  match_loop = function(context, dispatcher, tick, state, messages)
+    state.count = state.count + #messages
+    return state
+  end
+})
+`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := server.NewRuntimeConfig()
+	c.Path = filepath.Join(DATA_PATH, "modules")
+	registry := server.NewMatchRegistry(logger, "test_node", server.NewMatchConfig(), server.NewTrackerService("test_node"), nil, nil)
+	r, err := server.NewRuntime(logger, logger, db, c, nil, nil, registry, nil, server.NewStorageConfig(), nil, server.NewRuntimeCache(c.Cache), server.NewRuntimeLimits(c.Limits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	defer registry.Stop()
+
+	matchID, err := registry.Create(r, "counter", map[string]interface{}{"start": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mh := registry.Get(matchID)
+	if mh == nil {
+		t.Fatal("Match not found after create")
+	}
+	if mh.TickRate != 20 {
+		t.Error("Match tick rate was not set from match_init")
+	}
+
+	matches, _, _, err := registry.List(0, nil, "casual", "counter", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Label != "casual" {
+		t.Error("Match not listed by label")
+	}
+	if matches, _, _, _ = registry.List(0, nil, "ranked", "", nil, 0, 0); len(matches) != 0 {
+		t.Error("Match listed under another label")
+	}
+
+	if _, err = registry.UpdateLabel(matchID, uuid.Nil, `{"mode": "ranked", "level": 12}`); err != nil {
+		t.Fatal(err)
+	}
+	query, err := server.ParseMatchmakerQuery("mode:ranked level:>=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches, _, _, _ = registry.List(0, nil, "", "", query, 0, 0); len(matches) != 1 {
+		t.Error("Match not listed by label query after label update")
+	}
+	if _, err = registry.UpdateLabel(matchID, uuid.NewV4(), "casual"); err == nil {
+		t.Error("Authoritative match label updated by a client")
+	}
+
+	if _, err = registry.Create(r, "missing", nil); err == nil {
+		t.Error("Created match with unregistered handler")
+	}
+}
+
+func TestRuntimeRegisterBeforeAuthentication(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("auth-hooks.lua", `
+local nakama = require("nakama")
+
+-- Turn custom tokens into the custom ID they stand for.
+nakama.register_before(function(ctx, payload)
+	payload.custom = string.gsub(payload.custom, "^token:", "")
+	return payload
+end, "authenticaterequest_custom")
+
+-- Only let in allowed custom IDs, and nobody else during maintenance.
+nakama.register_before(function(ctx, payload)
+	if ctx.AuthEndpoint ~= "login" then
+		return "Registration is closed for maintenance"
+	end
+	if payload.custom ~= "allowed-player-id" then
+		return false
+	end
+	return payload
+end, "authenticaterequest")
+	`)
+
+	jsonpbMarshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  true,
+		EmitDefaults: false,
+		Indent:       "",
+		OrigName:     false,
+	}
+	jsonpbUnmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: false,
+	}
+
+	r, err := newRuntime()
+	defer r.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authReq := &server.AuthenticateRequest{CollationId: "123", Id: &server.AuthenticateRequest_Custom{Custom: "token:allowed-player-id"}}
+	result, err := server.RuntimeBeforeHookAuthentication(r, jsonpbMarshaler, jsonpbUnmarshaler, authReq, "login", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.GetCustom() != "allowed-player-id" {
+		t.Error("Custom token was not substituted")
+	}
+	if result.CollationId != "123" {
+		t.Error("Input CollationId is not the same as output")
+	}
+
+	authReq = &server.AuthenticateRequest{Id: &server.AuthenticateRequest_Custom{Custom: "token:other-player-id"}}
+	if _, err = server.RuntimeBeforeHookAuthentication(r, jsonpbMarshaler, jsonpbUnmarshaler, authReq, "login", "127.0.0.1"); err == nil || err.Error() != "Authentication denied" {
+		t.Error("Authentication was not denied")
+	}
+
+	authReq = &server.AuthenticateRequest{Id: &server.AuthenticateRequest_Custom{Custom: "token:allowed-player-id"}}
+	if _, err = server.RuntimeBeforeHookAuthentication(r, jsonpbMarshaler, jsonpbUnmarshaler, authReq, "register", "127.0.0.1"); err == nil || err.Error() != "Registration is closed for maintenance" {
+		t.Error("Authentication was not denied with the hook's message")
+	}
+}
+
+func TestRuntimeHTTPRequestLimits(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("http-request.lua", `
+local nk = require("nakama")
+nk.register_rpc(function(ctx, payload)
+	local url, timeout = payload:match("^(%S+) (%d+)$")
+	local code, headers, body = nk.http_request(url, "GET", {}, nil, tonumber(timeout))
+	return body
+end, "fetch")
+	`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", 2048)))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := server.NewRuntimeConfig()
+	c.Path = filepath.Join(DATA_PATH, "modules")
+	c.HTTPClient.MaxResponseBytes = 1024
+	r, err := server.NewRuntime(logger, logger, db, c, nil, nil, nil, nil, server.NewStorageConfig(), nil, server.NewRuntimeCache(c.Cache), server.NewRuntimeLimits(c.Limits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fn := r.GetRuntimeCallback(server.RPC, "fetch")
+
+	m, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte(ts.URL+"/small 1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != "ok" {
+		t.Error("Invocation failed. Return result not expected")
+	}
+
+	if _, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte(ts.URL+"/large 1000")); err == nil || !strings.Contains(err.Error(), "exceeds 1024 bytes") {
+		t.Error("Response larger than the limit was not rejected", err)
+	}
+
+	if _, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte(ts.URL+"/slow 50")); err == nil {
+		t.Error("Request slower than its timeout did not fail")
+	}
+
+	if _, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte(ts.URL+"/small 60000")); err == nil {
+		t.Error("Timeout above the configured maximum was not rejected")
+	}
+}
+
+func TestRuntimeReload(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("reload.lua", `
+local nakama = require("nakama")
+nakama.register_rpc(function(ctx, payload) return "v1" end, "version")
+	`)
+
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	reloads := 0
+	r.AddReloadListener(func() {
+		reloads++
+	})
+
+	writeLuaModule("reload.lua", `
+local nakama = require("nakama")
+nakama.register_rpc(function(ctx, payload) return "v2" end, "version")
+	`)
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if reloads != 1 {
+		t.Error("Reload listener was not called")
+	}
+
+	m, err := r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "version"), uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != "v2" {
+		t.Error("Reloaded module was not used", string(m))
+	}
+
+	writeLuaModule("broken.lua", `
+local nakama = require("nakama")
+nakama.register_rpc(function(ctx, payload) return "v3" end
+	`)
+	if err = r.Reload(); err == nil {
+		t.Error("Reload with a syntax error was not rejected")
+	}
+	writeLuaModule("broken.lua", `
+error("registration failed")
+	`)
+	if err = r.Reload(); err == nil {
+		t.Error("Reload with an evaluation error was not rejected")
+	}
+	if reloads != 1 {
+		t.Error("Reload listener was called for a rejected reload")
+	}
+
+	m, err = r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "version"), uuid.Nil, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != "v2" {
+		t.Error("Rejected reload replaced the loaded modules", string(m))
+	}
+}
+
+func TestRuntimeInvocationLimits(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("limits.lua", `
+local nk = require("nakama")
+nk.register_rpc(function(ctx, payload)
+	local count = 0
+	while payload == "forever" or count < 10 do
+		pcall(function() count = count + 1 end)
+	end
+	return tostring(count)
+end, "loop")
+nk.register_rpc(function(ctx, payload)
+	local t = {}
+	while true do
+		pcall(function() t[#t + 1] = string.rep("x", 1000000) end)
+	end
+end, "grow")
+	`)
+
+	db, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := server.NewRuntimeConfig()
+	c.Path = filepath.Join(DATA_PATH, "modules")
+	c.Limits.MaxInstructions = 100000
+	c.Limits.MaxExecutionMs = 0
+	limits := server.NewRuntimeLimits(c.Limits)
+	r, err := server.NewRuntime(logger, logger, db, c, nil, nil, nil, nil, server.NewStorageConfig(), nil, server.NewRuntimeCache(c.Cache), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fn := r.GetRuntimeCallback(server.RPC, "loop")
+
+	m, err := r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte("bounded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != "10" {
+		t.Error("Invocation failed. Return result not expected", string(m))
+	}
+
+	if _, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte("forever")); err == nil || !strings.Contains(err.Error(), "100000 instructions") {
+		t.Error("Invocation over the instruction limit was not aborted", err)
+	}
+
+	c.Limits.MaxInstructions = 0
+	c.Limits.MaxExecutionMs = 50
+	start := time.Now()
+	if _, err = r.InvokeFunctionRPC(fn, uuid.Nil, "", 0, []byte("forever")); err == nil || !strings.Contains(err.Error(), "50 ms") {
+		t.Error("Invocation over the time limit was not aborted", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Invocation over the time limit was aborted late")
+	}
+
+	c.Limits.MaxExecutionMs = 0
+	c.Limits.MaxLibraryBytes = 10000000
+	if _, err = r.InvokeFunctionRPC(r.GetRuntimeCallback(server.RPC, "grow"), uuid.Nil, "", 0, nil); err == nil || !strings.Contains(err.Error(), "more than 10000000 bytes") {
+		t.Error("Invocation over the library bytes limit was not aborted", err)
+	}
+
+	timeAborts, instructionAborts, libraryAborts := limits.Stats()
+	if timeAborts != 1 || instructionAborts != 1 || libraryAborts != 1 {
+		t.Error("Aborted invocations were not counted", timeAborts, instructionAborts, libraryAborts)
+	}
+}
+
+func TestRuntimeServerRPC(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("server-rpc.lua", `
+local nk = require("nakama")
+nk.register_rpc(function(ctx, payload)
+	assert(ctx.UserId == nil)
+	return ctx.ServerCaller .. " " .. payload
+end, "whoami")
+	`)
+
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fn := r.GetRuntimeCallback(server.RPC, "whoami")
+	m, err := r.InvokeFunctionServerRPC(fn, "billing", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m) != "billing hello" {
+		t.Error("Invocation failed. Return result not expected", string(m))
+	}
+}
+
+func TestRuntimeRegisterBeforeReject(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("reject.lua", `
+local nakama = require("nakama")
+nakama.register_before(function(ctx, payload) return "Storage is read only" end, "tstoragewrite")
+nakama.register_before(function(ctx, payload) return false end, "tpurchasevalidation")
+	`)
+
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	jsonpbMarshaler := &jsonpb.Marshaler{EnumsAsInts: true}
+	jsonpbUnmarshaler := &jsonpb.Unmarshaler{}
+
+	fn := r.GetRuntimeCallback(server.BEFORE, "tstoragewrite")
+	envelope := &server.Envelope{
+		CollationId: "123",
+		Payload: &server.Envelope_StorageWrite{
+			StorageWrite: &server.TStorageWrite{},
+		}}
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, jsonpbMarshaler, jsonpbUnmarshaler, envelope); err == nil || err.Error() != "Storage is read only" {
+		t.Error("Message was not rejected with the hook's reason", err)
+	}
+
+	fn = r.GetRuntimeCallback(server.BEFORE, "tpurchasevalidation")
+	if fn == nil {
+		t.Fatal("Before hook for purchase validation was not registered")
+	}
+	envelope = &server.Envelope{
+		CollationId: "124",
+		Payload: &server.Envelope_Purchase{
+			Purchase: &server.TPurchaseValidation{},
+		}}
+	if _, err = r.InvokeFunctionBefore(fn, uuid.Nil, "", 0, jsonpbMarshaler, jsonpbUnmarshaler, envelope); err == nil || err.Error() != "Message rejected" {
+		t.Error("Message was not rejected", err)
+	}
+}
+
+func TestRuntimeRegisterAfterWithResponse(t *testing.T) {
+	defer os.RemoveAll(DATA_PATH)
+	writeLuaModule("after.lua", `
+local nakama = require("nakama")
+nakama.register_after(function(ctx, payload, response)
+	assert(payload.collationId == "123")
+	assert(response.collationId == "123")
+	assert(response.self.user.handle == "someone")
+end, "tselffetch")
+	`)
+
+	r, err := newRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fn := r.GetRuntimeCallback(server.AFTER, "tselffetch")
+	payload := map[string]interface{}{"collationId": "123"}
+	response := map[string]interface{}{
+		"collationId": "123",
+		"self": map[string]interface{}{
+			"user": map[string]interface{}{"handle": "someone"},
+		},
+	}
+	if err = r.InvokeFunctionAfter(fn, uuid.Nil, "", 0, payload, response); err != nil {
+		t.Error(err)
+	}
+}
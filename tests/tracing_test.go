@@ -0,0 +1,128 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nakama/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Status       *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func newTestTracer(t *testing.T, sampleRate float64) (*server.Tracer, chan otlpSpan, func()) {
+	spans := make(chan otlpSpan, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := &otlpRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			t.Error(err)
+		}
+		for _, rs := range request.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans <- span
+				}
+			}
+		}
+	}))
+
+	config := server.NewTracingConfig()
+	config.Endpoint = collector.URL
+	config.SampleRate = sampleRate
+	config.ExportIntervalMs = 10
+	tracer := server.NewTracer(l, config, "nakama")
+	tracer.Start()
+	return tracer, spans, func() {
+		tracer.Stop()
+		collector.Close()
+	}
+}
+
+func TestTracingParentChild(t *testing.T) {
+	tracer, spans, stop := newTestTracer(t, 1)
+
+	ctx, root := tracer.StartTrace(context.Background(), "pipeline tselffetch")
+	_, child := tracer.StartSpan(ctx, "notification send")
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+	stop()
+	close(spans)
+
+	byName := make(map[string]otlpSpan)
+	for span := range spans {
+		byName[span.Name] = span
+	}
+	assert.Len(t, byName, 2, "spans exported did not match")
+	rootSpan, childSpan := byName["pipeline tselffetch"], byName["notification send"]
+	assert.Equal(t, 2, rootSpan.Kind, "root span kind was not server")
+	assert.Empty(t, rootSpan.ParentSpanID, "root span had a parent")
+	assert.Equal(t, rootSpan.TraceID, childSpan.TraceID, "child span was not in the same trace")
+	assert.Equal(t, rootSpan.SpanID, childSpan.ParentSpanID, "child span parent did not match")
+	if assert.NotNil(t, childSpan.Status, "child span status missing") {
+		assert.Equal(t, 2, childSpan.Status.Code, "child span status was not error")
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	tracer, spans, stop := newTestTracer(t, 0)
+
+	ctx, root := tracer.StartTrace(context.Background(), "pipeline tselffetch")
+	assert.Nil(t, root, "unsampled request was traced")
+	_, child := tracer.StartSpan(ctx, "notification send")
+	assert.Nil(t, child, "span started outside a trace")
+	child.SetAttribute("count", 1)
+	child.End()
+	root.End()
+	stop()
+	close(spans)
+
+	assert.Len(t, spans, 0, "spans were exported")
+}
+
+func TestTracingDisabled(t *testing.T) {
+	tracer := server.NewTracer(l, server.NewTracingConfig(), "nakama")
+	assert.False(t, tracer.Enabled(), "tracing was enabled without an endpoint")
+	_, root := tracer.StartTrace(context.Background(), "pipeline tselffetch")
+	assert.Nil(t, root, "request was traced without an endpoint")
+	tracer.Start()
+	tracer.Stop()
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"nakama/server"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackerRemotePresences(t *testing.T) {
+	tracker := server.NewTrackerService("node-a")
+	diffs := make(chan int, 10)
+	tracker.AddDiffListener(func(joins, leaves []server.Presence) {
+		diffs <- len(joins) - len(leaves)
+	})
+	awaitDiff := func() int {
+		select {
+		case d := <-diffs:
+			return d
+		case <-time.After(time.Second):
+			t.Fatal("no diff received")
+			return 0
+		}
+	}
+
+	remote := server.Presence{ID: server.PresenceID{Node: "node-b", SessionID: uuid.NewV4()}, Topic: "room:lobby", UserID: uuid.NewV4()}
+	other := server.Presence{ID: server.PresenceID{Node: "node-c", SessionID: uuid.NewV4()}, Topic: "room:lobby", UserID: uuid.NewV4()}
+
+	// Presences claiming to be on another node than the sender are ignored.
+	tracker.ApplyRemote("node-b", []server.Presence{remote, other}, nil)
+	assert.Equal(t, 1, awaitDiff(), "remote join was not applied")
+	assert.Len(t, tracker.ListByTopic("room:lobby"), 1, "presence from wrong node was applied")
+	assert.Empty(t, tracker.ListLocalByTopic("room:lobby"), "remote presence listed as local")
+
+	synced := server.Presence{ID: server.PresenceID{Node: "node-b", SessionID: uuid.NewV4()}, Topic: "room:lobby", UserID: uuid.NewV4()}
+	tracker.SyncRemote("node-b", []server.Presence{synced})
+	assert.Equal(t, 0, awaitDiff(), "sync did not replace presence")
+	ps := tracker.ListByTopic("room:lobby")
+	assert.Len(t, ps, 1, "sync did not replace presence")
+	assert.Equal(t, synced.ID, ps[0].ID, "sync did not replace presence")
+
+	tracker.UntrackNode("node-b")
+	assert.Equal(t, -1, awaitDiff(), "node presences were not removed")
+	assert.Equal(t, 0, tracker.Count(), "node presences were not removed")
+}